@@ -26,3 +26,17 @@ type Backend interface {
 	// SendEvent sends event to the backend.
 	SendEvent(context.Context, *Event) error
 }
+
+// FlushStateKeeper is an optional interface a Backend can implement if sending it a MetricMap updates state it keeps
+// across flushes, such as the running totals of counters, so sending it the same MetricMap again would count it twice.
+type FlushStateKeeper interface {
+	// KeepsFlushState returns true if sending a MetricMap updates state kept across flushes.
+	KeepsFlushState() bool
+}
+
+// BatchEventSender is an optional interface a Backend can implement to send several events in a single request, when
+// events are batched.
+type BatchEventSender interface {
+	// SendEvents sends the events to the backend, in order.
+	SendEvents(context.Context, []*Event) error
+}
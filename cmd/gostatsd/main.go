@@ -9,7 +9,10 @@ import (
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,6 +20,7 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends"
+	"github.com/atlassian/gostatsd/pkg/backends/cloudwatch"
 	"github.com/atlassian/gostatsd/pkg/statsd"
 	"github.com/atlassian/gostatsd/pkg/transport"
 
@@ -39,9 +43,12 @@ const (
 	ParamVersion = "version"
 )
 
+// hostnameResolutionTimeout bounds how long resolving the hostname can take, in case the cloud provider is slow.
+const hostnameResolutionTimeout = 10 * time.Second
+
 func main() {
 	rand.Seed(time.Now().UnixNano())
-	v, version, err := setupConfiguration()
+	v, cmd, version, err := setupConfiguration()
 	if err != nil {
 		if err == pflag.ErrHelp {
 			return
@@ -52,12 +59,12 @@ func main() {
 		fmt.Printf("Version: %s - Commit: %s - Date: %s\n", Version, GitCommit, BuildDate)
 		return
 	}
-	if err := run(v); err != nil {
+	if err := run(v, cmd); err != nil {
 		logrus.Fatalf("%v", err)
 	}
 }
 
-func run(v *viper.Viper) error {
+func run(v *viper.Viper, cmd *pflag.FlagSet) error {
 	profileAddr := v.GetString(ParamProfile)
 	if profileAddr != "" {
 		go func() {
@@ -73,7 +80,13 @@ func run(v *viper.Viper) error {
 
 	ctx, cancelFunc := context.WithCancel(context.Background())
 	defer cancelFunc()
-	cancelOnInterrupt(ctx, cancelFunc)
+	var drain chan struct{}
+	if s.ShutdownDrainTimeout > 0 {
+		drain = make(chan struct{})
+		s.Drain = drain
+	}
+	cancelOnInterrupt(ctx, cancelFunc, drain)
+	reloadOnHangup(ctx, s, v, cmd)
 
 	if err := s.Run(ctx); err != nil && err != context.Canceled {
 		return fmt.Errorf("server error: %v", err)
@@ -98,53 +111,204 @@ func constructServer(v *viper.Viper) (*statsd.Server, error) {
 			return nil, err
 		}
 	}
+	// Hostname
+	var cloudProvider gostatsd.CloudProvider
+	if cloud != nil {
+		cloudProvider = cloud.CloudProvider()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), hostnameResolutionTimeout)
+	hostname, err := statsd.ResolveHostname(ctx, v.GetStringSlice(statsd.ParamHostnameStrategy), v.GetString(statsd.ParamHostname), cloudProvider)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	nameSeparator := v.GetString(statsd.ParamNameSeparator)
+	if nameSeparator != "" && (len(nameSeparator) != 1 || !strings.Contains(statsd.NameSeparators, nameSeparator)) {
+		return nil, fmt.Errorf("invalid %s %q, must be one of %q", statsd.ParamNameSeparator, nameSeparator, strings.Split(statsd.NameSeparators, ""))
+	}
+	if minWorkers := v.GetInt(statsd.ParamMinWorkers); minWorkers < 0 || minWorkers > v.GetInt(statsd.ParamMaxWorkers) {
+		return nil, fmt.Errorf("invalid %s %d, must be between 0 and %s", statsd.ParamMinWorkers, minWorkers, statsd.ParamMaxWorkers)
+	}
+	if setMaxMembers := v.GetInt(statsd.ParamSetMaxMembers); setMaxMembers <= 0 {
+		return nil, fmt.Errorf("invalid %s %d, must be positive", statsd.ParamSetMaxMembers, setMaxMembers)
+	}
+	if perSourceRateLimit := v.GetFloat64(statsd.ParamPerSourceRateLimit); perSourceRateLimit < 0 {
+		return nil, fmt.Errorf("invalid %s %v, must not be negative", statsd.ParamPerSourceRateLimit, perSourceRateLimit)
+	}
+	if badLineDumpLinesPerSecond := v.GetFloat64(statsd.ParamBadLineDumpLinesPerSecond); badLineDumpLinesPerSecond <= 0 {
+		return nil, fmt.Errorf("invalid %s %v, must be positive", statsd.ParamBadLineDumpLinesPerSecond, badLineDumpLinesPerSecond)
+	}
+	if timerReservoirSize := v.GetInt(statsd.ParamTimerReservoirSize); timerReservoirSize < 0 {
+		return nil, fmt.Errorf("invalid %s %d, must not be negative", statsd.ParamTimerReservoirSize, timerReservoirSize)
+	}
+	if healthMaxFlushAge := v.GetDuration(statsd.ParamHealthMaxFlushAge); healthMaxFlushAge < 0 {
+		return nil, fmt.Errorf("invalid %s %v, must not be negative", statsd.ParamHealthMaxFlushAge, healthMaxFlushAge)
+	}
+	socketPermissions, err := strconv.ParseUint(v.GetString(statsd.ParamSocketPermissions), 8, 32)
+	if err != nil || socketPermissions > 0777 {
+		return nil, fmt.Errorf("invalid %s %q, must be octal permissions such as %s", statsd.ParamSocketPermissions, v.GetString(statsd.ParamSocketPermissions), statsd.DefaultSocketPermissions)
+	}
 	// Backends
+	v.Set("build-version", Version) // Backends which report the version of gostatsd read it from here
+	backendInitMode := v.GetString(statsd.ParamBackendInitMode)
+	if backendInitMode != statsd.BackendInitModeStrict && backendInitMode != statsd.BackendInitModeLenient {
+		return nil, fmt.Errorf("invalid %s %q, must be %s or %s", statsd.ParamBackendInitMode, backendInitMode, statsd.BackendInitModeStrict, statsd.BackendInitModeLenient)
+	}
+	switch backendOrder := v.GetString(statsd.ParamBackendOrder); backendOrder {
+	case statsd.BackendOrderFixed, statsd.BackendOrderRandom, statsd.BackendOrderRoundRobin:
+	default:
+		return nil, fmt.Errorf("invalid %s %q, must be one of %s, %s or %s", statsd.ParamBackendOrder, backendOrder, statsd.BackendOrderFixed, statsd.BackendOrderRandom, statsd.BackendOrderRoundRobin)
+	}
+	if sampleRate := v.GetFloat64(statsd.ParamSampleRate); sampleRate <= 0 || sampleRate > 1 {
+		return nil, fmt.Errorf("invalid %s %v, must be greater than 0 and at most 1", statsd.ParamSampleRate, sampleRate)
+	}
 	backendNames := v.GetStringSlice(statsd.ParamBackends)
-	backendsList := make([]gostatsd.Backend, len(backendNames))
-	for i, backendName := range backendNames {
+	backendsList := make([]gostatsd.Backend, 0, len(backendNames))
+	backendNamespaces := map[string][]string{}
+	backendFilters := map[string]*statsd.BackendFilter{}
+	backendNamespaceOverrides := map[string]string{}
+	backendExtraTags := map[string]gostatsd.Tags{}
+	failedBackends := 0
+	for _, backendName := range backendNames {
 		backend, errBackend := backends.InitBackend(backendName, v, pool)
 		if errBackend != nil {
-			return nil, errBackend
+			if backendInitMode == statsd.BackendInitModeStrict {
+				return nil, errBackend
+			}
+			logrus.WithError(errBackend).Error("Failed to initialise backend, continuing without it")
+			failedBackends++
+			continue
+		}
+		backendsList = append(backendsList, backend)
+		// Namespaces can be overridden in the backend's own section
+		if key := backendName + "." + statsd.ParamFlushNamespaces; v.IsSet(key) {
+			backendNamespaces[backendName] = v.GetStringSlice(key)
+		}
+		// The namespace can be overridden in the backend's own section, except for cloudwatch where it is already the
+		// CloudWatch namespace
+		if key := backendName + "." + statsd.ParamNamespace; v.IsSet(key) && backendName != cloudwatch.BackendName {
+			backendNamespaceOverrides[backendName] = v.GetString(key)
+		}
+		if tags := v.GetStringSlice(backendName + "." + statsd.ParamBackendExtraTags); len(tags) > 0 {
+			backendExtraTags[backendName] = tags
+		}
+		// Filters are compiled once here, rather than every flush
+		if filter := statsd.NewBackendFilter(
+			v.GetStringSlice(backendName+"."+statsd.ParamBackendInclude),
+			v.GetStringSlice(backendName+"."+statsd.ParamBackendExclude),
+		); filter != nil {
+			backendFilters[backendName] = filter
 		}
-		backendsList[i] = backend
 	}
 	// Percentiles
 	pt, err := getPercentiles(v.GetStringSlice(statsd.ParamPercentThreshold))
 	if err != nil {
 		return nil, err
 	}
+	// Timer histogram buckets
+	hb, err := statsd.ParseHistogramBuckets(v.GetStringSlice(statsd.ParamTimerHistogramBuckets))
+	if err != nil {
+		return nil, err
+	}
+	// Tag value limits
+	tvl, err := getTagValueLimits(v.GetStringSlice(statsd.ParamTagValueLimits))
+	if err != nil {
+		return nil, err
+	}
 	// Create server
 	return &statsd.Server{
-		Backends:            backendsList,
-		CloudHandlerFactory: cloud,
-		InternalTags:        v.GetStringSlice(statsd.ParamInternalTags),
-		InternalNamespace:   v.GetString(statsd.ParamInternalNamespace),
-		DefaultTags:         v.GetStringSlice(statsd.ParamDefaultTags),
-		Hostname:            v.GetString(statsd.ParamHostname),
-		ExpiryInterval:      v.GetDuration(statsd.ParamExpiryInterval),
-		FlushInterval:       v.GetDuration(statsd.ParamFlushInterval),
-		IgnoreHost:          v.GetBool(statsd.ParamIgnoreHost),
-		MaxReaders:          v.GetInt(statsd.ParamMaxReaders),
-		MaxParsers:          v.GetInt(statsd.ParamMaxParsers),
-		MaxWorkers:          v.GetInt(statsd.ParamMaxWorkers),
-		MaxQueueSize:        v.GetInt(statsd.ParamMaxQueueSize),
-		MaxConcurrentEvents: v.GetInt(statsd.ParamMaxConcurrentEvents),
-		EstimatedTags:       v.GetInt(statsd.ParamEstimatedTags),
-		MetricsAddr:         v.GetString(statsd.ParamMetricsAddr),
-		Namespace:           v.GetString(statsd.ParamNamespace),
-		StatserType:         v.GetString(statsd.ParamStatserType),
-		PercentThreshold:    pt,
-		HeartbeatEnabled:    v.GetBool(statsd.ParamHeartbeatEnabled),
-		ReceiveBatchSize:    v.GetInt(statsd.ParamReceiveBatchSize),
-		ConnPerReader:       v.GetBool(statsd.ParamConnPerReader),
-		ServerMode:          v.GetString(statsd.ParamServerMode),
-		LogRawMetric:        v.GetBool(statsd.ParamLogRawMetric),
+		Backends:             backendsList,
+		FailedBackends:       failedBackends,
+		CloudHandlerFactory:  cloud,
+		InternalTags:         v.GetStringSlice(statsd.ParamInternalTags),
+		InternalNamespace:    v.GetString(statsd.ParamInternalNamespace),
+		DefaultTags:          v.GetStringSlice(statsd.ParamDefaultTags),
+		Hostname:             hostname,
+		ExpiryInterval:       v.GetDuration(statsd.ParamExpiryInterval),
+		FlushInterval:        v.GetDuration(statsd.ParamFlushInterval),
+		IgnoreHost:           v.GetBool(statsd.ParamIgnoreHost),
+		MaxReaders:           v.GetInt(statsd.ParamMaxReaders),
+		MaxParsers:           v.GetInt(statsd.ParamMaxParsers),
+		MaxWorkers:           v.GetInt(statsd.ParamMaxWorkers),
+		MinWorkers:           v.GetInt(statsd.ParamMinWorkers),
+		WorkerScaleInterval:  v.GetDuration(statsd.ParamWorkerScaleInterval),
+		MaxQueueSize:         v.GetInt(statsd.ParamMaxQueueSize),
+		MaxConcurrentEvents:  v.GetInt(statsd.ParamMaxConcurrentEvents),
+		MaxEventSize:         v.GetInt(statsd.ParamMaxEventSize),
+		MaxMetricNames:       v.GetInt(statsd.ParamMaxMetricNames),
+		MaxSeries:            v.GetInt(statsd.ParamMaxSeries),
+		FlushSequenceTag:     v.GetString(statsd.ParamFlushSequenceTag),
+		FlushNamespaces:      v.GetStringSlice(statsd.ParamFlushNamespaces),
+		BackendNamespaces:    backendNamespaces,
+		BackendFilters:       backendFilters,
+		TagValueLimits:       tvl,
+		CountersAsGauges:     v.GetStringSlice(statsd.ParamCountersAsGauges),
+		EstimatedTags:        v.GetInt(statsd.ParamEstimatedTags),
+		MetricsAddr:          v.GetString(statsd.ParamMetricsAddr),
+		ShutdownDrainTimeout: v.GetDuration(statsd.ParamShutdownDrainTimeout),
+		TCPAddr:              v.GetString(statsd.ParamTCPAddr),
+		TCPMaxConnections:    v.GetInt(statsd.ParamTCPMaxConnections),
+		TCPFraming:           v.GetString(statsd.ParamTCPFraming),
+		AdminAddr:            v.GetString(statsd.ParamAdminAddr),
+		Namespace:            v.GetString(statsd.ParamNamespace),
+		StatserType:          v.GetString(statsd.ParamStatserType),
+		PercentThreshold:     pt,
+		PercentileMinSamples: v.GetInt(statsd.ParamPercentileMinSamples),
+		WeightedTimers:       v.GetBool(statsd.ParamTimerSampleRateWeighting),
+		TimerReservoirSize:   v.GetInt(statsd.ParamTimerReservoirSize),
+		SetMemberTTL:         v.GetDuration(statsd.ParamSetMemberTTL),
+		SetEmitMembers:       v.GetStringSlice(statsd.ParamSetEmitMembers),
+		SetMaxMembers:        v.GetInt(statsd.ParamSetMaxMembers),
+		SuppressZeroCounters: v.GetBool(statsd.ParamSuppressZeroCounters),
+		FlushLatency:         v.GetBool(statsd.ParamFlushLatency),
+		CounterRates:         v.GetBool(statsd.ParamCounterRates),
+		StdoutFallbackAfter:  v.GetInt(statsd.ParamStdoutFallbackAfter),
+		BackendQueueSize:     v.GetInt(statsd.ParamBackendQueueSize),
+		BackendRetries:       v.GetInt(statsd.ParamBackendRetries),
+		BackendOrder:         v.GetString(statsd.ParamBackendOrder),
+		BackendLag:           v.GetBool(statsd.ParamBackendLag),
+		WorkerHash:           v.GetString(statsd.ParamWorkerHash),
+		WorkerHashTags:       v.GetBool(statsd.ParamWorkerHashTags),
+		SampleRate:           v.GetFloat64(statsd.ParamSampleRate),
+		WarmupTimeout:        v.GetDuration(statsd.ParamWarmupTimeout),
+		CatalogTTL:           v.GetDuration(statsd.ParamCatalogTTL),
+		CatalogMaxNames:      v.GetInt(statsd.ParamCatalogMaxNames),
+		NameSeparator:        nameSeparator,
+		HeartbeatEnabled:     v.GetBool(statsd.ParamHeartbeatEnabled),
+		CanaryName:           v.GetString(statsd.ParamCanaryName),
+		CanaryValue:          v.GetFloat64(statsd.ParamCanaryValue),
+		CanaryTags:           v.GetStringSlice(statsd.ParamCanaryTags),
+		ReceiveBatchSize:     v.GetInt(statsd.ParamReceiveBatchSize),
+		ConnPerReader:        v.GetBool(statsd.ParamConnPerReader),
+		ServerMode:           v.GetString(statsd.ParamServerMode),
+		LogRawMetric:         v.GetBool(statsd.ParamLogRawMetric),
+		ParseTiming:          v.GetBool(statsd.ParamParseTiming),
+		MaxLineLength:        v.GetInt(statsd.ParamMaxLineLength),
+		CaptureFile:          v.GetString(statsd.ParamCaptureFile),
 		HeartbeatTags: gostatsd.Tags{
 			fmt.Sprintf("version:%s", Version),
 			fmt.Sprintf("commit:%s", GitCommit),
 		},
 		DisabledSubTypes:          gostatsd.DisabledSubMetrics(v),
 		BadLineRateLimitPerSecond: rate.Limit(v.GetFloat64(statsd.ParamBadLinesPerMinute) / 60.0),
+		MaxCardinalityPerMetric:   v.GetInt(statsd.ParamMaxCardinalityPerMetric),
+		AlignFlushToInterval:      v.GetBool(statsd.ParamAlignFlushToInterval),
+		TimerHistogramBuckets:     hb,
+		EventRateLimitPerSecond:   rate.Limit(v.GetFloat64(statsd.ParamMaxEventsPerSecond)),
+		EventBatchWindow:          v.GetDuration(statsd.ParamEventBatchWindow),
+		EventBatchSize:            v.GetInt(statsd.ParamEventBatchSize),
+		PerSourceRateLimit:        rate.Limit(v.GetFloat64(statsd.ParamPerSourceRateLimit)),
+		BadLineDumpFile:           v.GetString(statsd.ParamBadLineDumpFile),
+		BadLineDumpMaxSize:        v.GetInt64(statsd.ParamBadLineDumpMaxSize),
+		BadLineDumpMaxBackups:     v.GetInt(statsd.ParamBadLineDumpMaxBackups),
+		BadLineDumpLinesPerSecond: rate.Limit(v.GetFloat64(statsd.ParamBadLineDumpLinesPerSecond)),
+		BackendNamespaceOverrides: backendNamespaceOverrides,
+		BackendExtraTags:          backendExtraTags,
+		SocketPath:                v.GetString(statsd.ParamSocketPath),
+		SocketType:                v.GetString(statsd.ParamSocketType),
+		SocketPermissions:         os.FileMode(socketPermissions),
+		SocketFraming:             v.GetString(statsd.ParamSocketFraming),
+		HealthMaxFlushAge:         v.GetDuration(statsd.ParamHealthMaxFlushAge),
 		Viper:                     v,
 		TransportPool:             pool,
 	}, nil
@@ -162,11 +326,37 @@ func getPercentiles(s []string) ([]float64, error) {
 	return percentThresholds, nil
 }
 
-// cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.
-func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
+func getTagValueLimits(s []string) (map[string]int, error) {
+	limits := make(map[string]int, len(s))
+	for _, sLimit := range s {
+		idx := strings.LastIndexByte(sLimit, ':')
+		if idx <= 0 {
+			return nil, fmt.Errorf("invalid tag value limit %q, expected key:K", sLimit)
+		}
+		limit, err := strconv.Atoi(sLimit[idx+1:])
+		if err != nil || limit < 1 {
+			return nil, fmt.Errorf("invalid tag value limit %q, K must be a positive integer", sLimit)
+		}
+		limits[sLimit[:idx]] = limit
+	}
+	return limits, nil
+}
+
+// cancelOnInterrupt calls f when os.Interrupt or SIGTERM is received.  If drain is not nil, it is closed on the
+// first signal instead, so the server drains before stopping, and f is only called on a second signal.
+func cancelOnInterrupt(ctx context.Context, f context.CancelFunc, drain chan struct{}) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
+		if drain != nil {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+				logrus.Info("Received signal, draining before stopping")
+				close(drain)
+			}
+		}
 		select {
 		case <-ctx.Done():
 		case <-c:
@@ -175,7 +365,95 @@ func cancelOnInterrupt(ctx context.Context, f context.CancelFunc) {
 	}()
 }
 
-func setupConfiguration() (*viper.Viper, bool, error) {
+// reloadOnHangup re-reads the configuration file when SIGHUP is received, and applies the parameters which can be
+// changed without a restart.  Any other parameter which differs from the configuration file the server was started
+// with is logged, and left unchanged.
+func reloadOnHangup(ctx context.Context, s *statsd.Server, v *viper.Viper, cmd *pflag.FlagSet) {
+	configPath := v.GetString(ParamConfigPath)
+	if configPath == "" {
+		return
+	}
+	started, err := readConfigFileOnly(configPath)
+	if err != nil {
+		logrus.Warnf("Failed to read configuration file, changes which require a restart won't be reported: %v", err)
+		started = viper.New()
+	}
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(c)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-c:
+				logrus.Info("Received SIGHUP, reloading configuration")
+				if err := reload(s, started, cmd); err != nil {
+					logrus.Errorf("Failed to reload configuration, keeping the current configuration: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// reload applies the configuration file to s.  started is the configuration file s was started with.
+func reload(s *statsd.Server, started *viper.Viper, cmd *pflag.FlagSet) error {
+	v, err := reloadConfiguration(cmd)
+	if err != nil {
+		return err
+	}
+	current, err := readConfigFileOnly(v.GetString(ParamConfigPath))
+	if err != nil {
+		return err
+	}
+	if err := s.Reload(v); err != nil {
+		return err
+	}
+	setLogLevel(v)
+	for _, key := range restartRequired(started, current) {
+		logrus.Warnf("Configuration %s changed, restart to apply it", key)
+	}
+	return nil
+}
+
+// restartRequired returns the keys which differ between the configurations, other than those which can be reloaded.
+func restartRequired(v, nv *viper.Viper) []string {
+	keys := map[string]struct{}{}
+	for _, key := range v.AllKeys() {
+		keys[key] = struct{}{}
+	}
+	for _, key := range nv.AllKeys() {
+		keys[key] = struct{}{}
+	}
+	var changed []string
+	for key := range keys {
+		if !isReloadable(key) && !reflect.DeepEqual(v.Get(key), nv.Get(key)) {
+			changed = append(changed, key)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func isReloadable(key string) bool {
+	if key == ParamVerbose {
+		return true
+	}
+	for _, param := range statsd.ReloadableParams {
+		if key == param {
+			return true
+		}
+	}
+	for _, prefix := range statsd.ReloadablePrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func setupConfiguration() (*viper.Viper, *pflag.FlagSet, bool, error) {
 	v := viper.New()
 	defer setupLogger(v) // Apply logging configuration in case of early exit
 	util.InitViper(v, "")
@@ -192,32 +470,68 @@ func setupConfiguration() (*viper.Viper, bool, error) {
 
 	statsd.AddFlags(cmd)
 
+	bindFlags(v, cmd)
+
+	if err := cmd.Parse(os.Args[1:]); err != nil {
+		return nil, nil, false, err
+	}
+
+	if err := readConfigFile(v); err != nil {
+		return nil, nil, false, err
+	}
+
+	return v, cmd, version, nil
+}
+
+// reloadConfiguration reads the configuration file again, with the command line flags already parsed in to cmd.
+func reloadConfiguration(cmd *pflag.FlagSet) (*viper.Viper, error) {
+	v := viper.New()
+	util.InitViper(v, "")
+	bindFlags(v, cmd)
+	if err := readConfigFile(v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+func bindFlags(v *viper.Viper, cmd *pflag.FlagSet) {
 	cmd.VisitAll(func(flag *pflag.Flag) {
 		if err := v.BindPFlag(flag.Name, flag); err != nil {
 			panic(err) // Should never happen
 		}
 	})
+}
 
-	if err := cmd.Parse(os.Args[1:]); err != nil {
-		return nil, false, err
+// readConfigFileOnly reads the configuration file without any defaults or flags, so it only has what's in the file.
+func readConfigFileOnly(configPath string) (*viper.Viper, error) {
+	v := viper.New()
+	v.SetConfigFile(configPath)
+	if err := v.ReadInConfig(); err != nil {
+		return nil, err
 	}
+	return v, nil
+}
 
+func readConfigFile(v *viper.Viper) error {
 	configPath := v.GetString(ParamConfigPath)
-	if configPath != "" {
-		v.SetConfigFile(configPath)
-		if err := v.ReadInConfig(); err != nil {
-			return nil, false, err
-		}
+	if configPath == "" {
+		return nil
 	}
-
-	return v, version, nil
+	v.SetConfigFile(configPath)
+	return v.ReadInConfig()
 }
 
 func setupLogger(v *viper.Viper) {
-	if v.GetBool(ParamVerbose) {
-		logrus.SetLevel(logrus.DebugLevel)
-	}
+	setLogLevel(v)
 	if v.GetBool(ParamJSON) {
 		logrus.SetFormatter(&logrus.JSONFormatter{})
 	}
 }
+
+func setLogLevel(v *viper.Viper) {
+	if v.GetBool(ParamVerbose) {
+		logrus.SetLevel(logrus.DebugLevel)
+	} else {
+		logrus.SetLevel(logrus.InfoLevel)
+	}
+}
@@ -33,6 +33,10 @@ var metrics = &Metrics{
 		Name: "statsd.tester.set",
 		Type: gostatsd.SET,
 	},
+	{
+		Name: "statsd.tester.distribution",
+		Type: gostatsd.DISTRIBUTION,
+	},
 }
 
 func (s *Server) write(conn net.Conn, buf *bytes.Buffer) {
@@ -75,6 +79,12 @@ func (s *Server) writeLines(conn net.Conn, buf *bytes.Buffer) {
 				value := rand.Intn(9) + 1
 				s.writeLine(conn, buf, "%s%s_%d:%d|s\n", s.Namespace, metric.Name, num, value)
 			}
+		case gostatsd.DISTRIBUTION:
+			n := rand.Intn(9) + 1
+			for i := 0; i < n; i++ {
+				value := rand.Float64() * 100
+				s.writeLine(conn, buf, "%s%s_%d:%f|d\n", s.Namespace, metric.Name, num, value)
+			}
 		}
 	}
 }
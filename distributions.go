@@ -0,0 +1,34 @@
+package gostatsd
+
+// Distributions stores a map of distributions by tags.  Each distribution keeps every value it received in a Timer,
+// but unlike a timer only Count, Min, Max, Sum and Percentiles are calculated when it is flushed.
+type Distributions map[string]map[string]Timer
+
+// MetricsName returns the name of the aggregated metrics collection.
+func (d Distributions) MetricsName() string {
+	return "Distributions"
+}
+
+// Delete deletes the metrics from the collection.
+func (d Distributions) Delete(k string) {
+	delete(d, k)
+}
+
+// DeleteChild deletes the metrics from the collection for the given tags.
+func (d Distributions) DeleteChild(k, tags string) {
+	delete(d[k], tags)
+}
+
+// HasChildren returns whether there are more children nested under the key.
+func (d Distributions) HasChildren(k string) bool {
+	return len(d[k]) != 0
+}
+
+// Each iterates over each distribution.
+func (d Distributions) Each(f func(metricName string, tagsKey string, d Timer)) {
+	for key, value := range d {
+		for tags, distribution := range value {
+			f(key, tags, distribution)
+		}
+	}
+}
@@ -6,6 +6,7 @@ type Gauge struct {
 	Timestamp Nanotime // Last time value was updated
 	Hostname  string   // Hostname of the source of the metric
 	Tags      Tags     // The tags for the gauge
+	Delta     bool     // The value is added to the previous value of the gauge, or to zero if there isn't one
 }
 
 // NewGauge initialises a new gauge.
@@ -11,6 +11,7 @@ require (
 	github.com/githubnemo/CompileDaemon v1.0.0
 	github.com/go-redis/redis v6.15.7+incompatible
 	github.com/golang/protobuf v1.3.3
+	github.com/golang/snappy v0.0.4
 	github.com/golangci/golangci-lint v1.23.3
 	github.com/gorilla/mux v1.7.3
 	github.com/howeyc/fsnotify v0.9.0 // indirect
@@ -20,15 +21,17 @@ require (
 	github.com/libp2p/go-reuseport v0.0.1
 	github.com/magiconair/properties v1.8.1
 	github.com/mozilla/tls-observatory v0.0.0-20190404164649-a3c1b6cfecfd
+	github.com/segmentio/kafka-go v0.4.20
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/pflag v1.0.5
 	github.com/spf13/viper v1.6.2
 	github.com/stephens2424/writerset v1.0.2 // indirect
-	github.com/stretchr/testify v1.4.0
+	github.com/stretchr/testify v1.6.1
 	github.com/tilinna/clock v1.0.2
 	golang.org/x/net v0.0.0-20200202094626-16171245cfb2
 	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
 	golang.org/x/tools v0.0.0-20200207224406-61798d64f025
+	gopkg.in/yaml.v2 v2.2.8
 	k8s.io/api v0.17.3
 	k8s.io/apimachinery v0.17.3
 	k8s.io/client-go v0.17.3
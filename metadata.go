@@ -0,0 +1,61 @@
+package gostatsd
+
+import (
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// MetricMetadata describes a metric for backends which are able to include it in their output.
+type MetricMetadata struct {
+	Unit        string // The unit of the metric, in a form the backend understands
+	Description string // A human readable description of the metric
+}
+
+// MetadataRule applies MetricMetadata to any metric with a name matching Match.
+type MetadataRule struct {
+	Match StringMatchList
+	MetricMetadata
+}
+
+// MetadataRules is an ordered list of MetadataRule.
+type MetadataRules []MetadataRule
+
+// Lookup returns the metadata of the first rule to match the metric name, or false if no rule matches.
+func (mr MetadataRules) Lookup(name string) (MetricMetadata, bool) {
+	for _, rule := range mr {
+		if rule.Match.MatchAny(name) {
+			return rule.MetricMetadata, true
+		}
+	}
+	return MetricMetadata{}, false
+}
+
+// MetricMetadataFromViper reads the rules named in metric-metadata, each configured in a section named
+// metadata.<name>.
+func MetricMetadataFromViper(v *viper.Viper) MetadataRules {
+	ruleNameList := v.GetStringSlice("metric-metadata")
+	var rules MetadataRules
+	for _, ruleName := range ruleNameList {
+		vRule := v.Sub("metadata." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Metadata rule doesn't exist: %v", ruleName)
+			continue
+		}
+		vRule.SetDefault("match-metrics", []string{})
+		vRule.SetDefault("unit", "")
+		vRule.SetDefault("description", "")
+
+		var match StringMatchList
+		for _, test := range vRule.GetStringSlice("match-metrics") {
+			match = append(match, NewStringMatch(test))
+		}
+		rules = append(rules, MetadataRule{
+			Match: match,
+			MetricMetadata: MetricMetadata{
+				Unit:        vRule.GetString("unit"),
+				Description: vRule.GetString("description"),
+			},
+		})
+	}
+	return rules
+}
@@ -0,0 +1,43 @@
+package gostatsd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetricMetadataFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+metric-metadata='latency missing all-http'
+
+[metadata.latency]
+match-metrics='http.latency'
+unit='seconds'
+description='Time taken to serve a request'
+
+[metadata.all-http]
+match-metrics='http.*'
+unit='requests'
+`))
+	require.NoError(t, err)
+
+	rules := MetricMetadataFromViper(v)
+	require.Len(t, rules, 2)
+
+	meta, ok := rules.Lookup("http.latency")
+	assert.True(t, ok)
+	assert.Equal(t, MetricMetadata{Unit: "seconds", Description: "Time taken to serve a request"}, meta)
+
+	meta, ok = rules.Lookup("http.requests")
+	assert.True(t, ok)
+	assert.Equal(t, MetricMetadata{Unit: "requests"}, meta)
+
+	_, ok = rules.Lookup("db.queries")
+	assert.False(t, ok)
+}
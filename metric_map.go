@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
@@ -11,23 +12,29 @@ import (
 // MetricMap is used for storing aggregated or consolidated Metric values.
 // The keys of each map are metric names.
 type MetricMap struct {
-	Counters Counters
-	Timers   Timers
-	Gauges   Gauges
-	Sets     Sets
+	Counters      Counters
+	Timers        Timers
+	Gauges        Gauges
+	Sets          Sets
+	Distributions Distributions
 }
 
 func NewMetricMap() *MetricMap {
 	return &MetricMap{
-		Counters: Counters{},
-		Timers:   Timers{},
-		Gauges:   Gauges{},
-		Sets:     Sets{},
+		Counters:      Counters{},
+		Timers:        Timers{},
+		Gauges:        Gauges{},
+		Sets:          Sets{},
+		Distributions: Distributions{},
 	}
 }
 
-// Receive adds a single Metric to the MetricMap, and releases the Metric.
+// Receive adds a single Metric to the MetricMap, and releases the Metric.  A zero, negative or NaN sample rate is
+// treated as 1, as the value of a counter and the count of a timer or distribution are divided by it.
 func (mm *MetricMap) Receive(m *Metric) {
+	if !(m.Rate > 0) {
+		m.Rate = 1
+	}
 	tagsKey := m.FormatTagsKey()
 
 	switch m.Type {
@@ -39,6 +46,8 @@ func (mm *MetricMap) Receive(m *Metric) {
 		mm.receiveTimer(m, tagsKey)
 	case SET:
 		mm.receiveSet(m, tagsKey)
+	case DISTRIBUTION:
+		mm.receiveDistribution(m, tagsKey)
 	default:
 		logrus.StandardLogger().Errorf("Unknown metric type %s for %s", m.Type, m.Name)
 	}
@@ -46,102 +55,459 @@ func (mm *MetricMap) Receive(m *Metric) {
 }
 
 func (mm *MetricMap) Merge(mmFrom *MetricMap) {
-	mmFrom.Counters.Each(func(metricName string, tagsKey string, counterFrom Counter) {
-		v, ok := mm.Counters[metricName]
+	mmFrom.Counters.Each(mm.MergeCounter)
+	mmFrom.Gauges.Each(mm.MergeGauge)
+	mmFrom.Timers.Each(mm.MergeTimer)
+	mmFrom.Sets.Each(mm.MergeSet)
+	mmFrom.Distributions.Each(mm.MergeDistribution)
+}
+
+// MergeCounter merges a single Counter in to the MetricMap.
+func (mm *MetricMap) MergeCounter(metricName string, tagsKey string, counterFrom Counter) {
+	v, ok := mm.Counters[metricName]
+	if ok {
+		counterInto, ok := v[tagsKey]
 		if ok {
-			counterInto, ok := v[tagsKey]
-			if ok {
-				if counterInto.Timestamp < counterFrom.Timestamp {
-					counterInto.Timestamp = counterFrom.Timestamp
-				}
-				counterInto.Value += counterFrom.Value
-			} else {
-				counterInto = counterFrom
+			if counterInto.Timestamp < counterFrom.Timestamp {
+				counterInto.Timestamp = counterFrom.Timestamp
 			}
-			v[tagsKey] = counterInto
+			counterInto.Value += counterFrom.Value
 		} else {
-			mm.Counters[metricName] = map[string]Counter{
-				tagsKey: counterFrom,
-			}
+			counterInto = counterFrom
 		}
-	})
+		v[tagsKey] = counterInto
+	} else {
+		mm.Counters[metricName] = map[string]Counter{
+			tagsKey: counterFrom,
+		}
+	}
+}
 
-	mmFrom.Gauges.Each(func(metricName string, tagsKey string, gaugeFrom Gauge) {
-		v, ok := mm.Gauges[metricName]
+// MergeGauge merges a single Gauge in to the MetricMap.
+func (mm *MetricMap) MergeGauge(metricName string, tagsKey string, gaugeFrom Gauge) {
+	v, ok := mm.Gauges[metricName]
+	if ok {
+		gaugeInto, ok := v[tagsKey]
 		if ok {
-			gaugeInto, ok := v[tagsKey]
-			if ok {
+			if gaugeFrom.Delta {
+				// A delta is applied to whatever it follows, and a gauge which is only deltas stays a delta.
 				if gaugeInto.Timestamp < gaugeFrom.Timestamp {
 					gaugeInto.Timestamp = gaugeFrom.Timestamp
-					gaugeInto.Value = gaugeFrom.Value
 				}
-			} else {
-				gaugeInto = gaugeFrom
+				gaugeInto.Value += gaugeFrom.Value
+			} else if gaugeInto.Timestamp <= gaugeFrom.Timestamp {
+				// The last update wins, including if it has the same timestamp, so the value and timestamp are
+				// always from the same update.
+				gaugeInto.Timestamp = gaugeFrom.Timestamp
+				gaugeInto.Value = gaugeFrom.Value
+				gaugeInto.Delta = false
 			}
-			v[tagsKey] = gaugeInto
 		} else {
-			mm.Gauges[metricName] = map[string]Gauge{
-				tagsKey: gaugeFrom,
-			}
+			gaugeInto = gaugeFrom
 		}
-	})
+		v[tagsKey] = gaugeInto
+	} else {
+		mm.Gauges[metricName] = map[string]Gauge{
+			tagsKey: gaugeFrom,
+		}
+	}
+}
 
-	mmFrom.Timers.Each(func(metricName string, tagsKey string, timerFrom Timer) {
-		v, ok := mm.Timers[metricName]
+// MergeTimer merges a single Timer in to the MetricMap.
+func (mm *MetricMap) MergeTimer(metricName string, tagsKey string, timerFrom Timer) {
+	v, ok := mm.Timers[metricName]
+	if ok {
+		timerInto, ok := v[tagsKey]
 		if ok {
-			timerInto, ok := v[tagsKey]
-			if ok {
-				if timerInto.Timestamp < timerFrom.Timestamp {
-					timerInto.Timestamp = timerFrom.Timestamp
-				}
-				timerInto.Values = append(timerInto.Values, timerFrom.Values...)
-				timerInto.SampledCount += timerFrom.SampledCount
-			} else {
-				timerInto = timerFrom
+			if timerInto.Timestamp < timerFrom.Timestamp {
+				timerInto.Timestamp = timerFrom.Timestamp
 			}
-			v[tagsKey] = timerInto
+			timerInto.AppendValues(timerFrom)
 		} else {
-			mm.Timers[metricName] = map[string]Timer{
-				tagsKey: timerFrom,
+			timerInto = timerFrom
+		}
+		v[tagsKey] = timerInto
+	} else {
+		mm.Timers[metricName] = map[string]Timer{
+			tagsKey: timerFrom,
+		}
+	}
+}
+
+// MergeSet merges a single Set in to the MetricMap.
+func (mm *MetricMap) MergeSet(metricName string, tagsKey string, setFrom Set) {
+	v, ok := mm.Sets[metricName]
+	if ok {
+		setInto, ok := v[tagsKey]
+		if ok {
+			if setInto.Timestamp < setFrom.Timestamp {
+				setInto.Timestamp = setFrom.Timestamp
 			}
+			for setValue := range setFrom.Values {
+				setInto.Values[setValue] = struct{}{}
+			}
+		} else {
+			setInto = setFrom
 		}
-	})
-	mmFrom.Sets.Each(func(metricName string, tagsKey string, setFrom Set) {
-		v, ok := mm.Sets[metricName]
+		v[tagsKey] = setInto
+	} else {
+		mm.Sets[metricName] = map[string]Set{
+			tagsKey: setFrom,
+		}
+	}
+}
+
+// MergeDistribution merges a single distribution in to the MetricMap.
+func (mm *MetricMap) MergeDistribution(metricName string, tagsKey string, distributionFrom Timer) {
+	v, ok := mm.Distributions[metricName]
+	if ok {
+		distributionInto, ok := v[tagsKey]
 		if ok {
-			setInto, ok := v[tagsKey]
-			if ok {
-				if setInto.Timestamp < setFrom.Timestamp {
-					setInto.Timestamp = setFrom.Timestamp
-				}
-				for setValue := range setFrom.Values {
-					setInto.Values[setValue] = struct{}{}
-				}
-			} else {
-				setInto = setFrom
+			if distributionInto.Timestamp < distributionFrom.Timestamp {
+				distributionInto.Timestamp = distributionFrom.Timestamp
 			}
-			v[tagsKey] = setInto
+			distributionInto.AppendValues(distributionFrom)
 		} else {
-			mm.Sets[metricName] = map[string]Set{
-				tagsKey: setFrom,
+			distributionInto = distributionFrom
+		}
+		v[tagsKey] = distributionInto
+	} else {
+		mm.Distributions[metricName] = map[string]Timer{
+			tagsKey: distributionFrom,
+		}
+	}
+}
+
+// WithTags returns a shallow copy of the MetricMap with tags appended to every metric.  The original MetricMap and
+// the tags of its metrics are not modified.  The tagsKey of each metric is preserved, so it should only be used when
+// the same tags are being added to everything.
+func (mm *MetricMap) WithTags(tags Tags) *MetricMap {
+	mmNew := NewMetricMap()
+	mm.Counters.Each(func(metricName string, tagsKey string, c Counter) {
+		c.Tags = c.Tags.Concat(tags)
+		if v, ok := mmNew.Counters[metricName]; ok {
+			v[tagsKey] = c
+		} else {
+			mmNew.Counters[metricName] = map[string]Counter{tagsKey: c}
+		}
+	})
+	mm.Gauges.Each(func(metricName string, tagsKey string, g Gauge) {
+		g.Tags = g.Tags.Concat(tags)
+		if v, ok := mmNew.Gauges[metricName]; ok {
+			v[tagsKey] = g
+		} else {
+			mmNew.Gauges[metricName] = map[string]Gauge{tagsKey: g}
+		}
+	})
+	mm.Timers.Each(func(metricName string, tagsKey string, t Timer) {
+		t.Tags = t.Tags.Concat(tags)
+		if v, ok := mmNew.Timers[metricName]; ok {
+			v[tagsKey] = t
+		} else {
+			mmNew.Timers[metricName] = map[string]Timer{tagsKey: t}
+		}
+	})
+	mm.Sets.Each(func(metricName string, tagsKey string, s Set) {
+		s.Tags = s.Tags.Concat(tags)
+		if v, ok := mmNew.Sets[metricName]; ok {
+			v[tagsKey] = s
+		} else {
+			mmNew.Sets[metricName] = map[string]Set{tagsKey: s}
+		}
+	})
+	mm.Distributions.Each(func(metricName string, tagsKey string, d Timer) {
+		d.Tags = d.Tags.Concat(tags)
+		if v, ok := mmNew.Distributions[metricName]; ok {
+			v[tagsKey] = d
+		} else {
+			mmNew.Distributions[metricName] = map[string]Timer{tagsKey: d}
+		}
+	})
+	return mmNew
+}
+
+// WithNamespaces returns a shallow copy of the MetricMap with every metric repeated under each of the namespaces,
+// which are prefixed to the metric name with a dot.  An empty namespace leaves the name unchanged.  The original
+// MetricMap is not modified.
+func (mm *MetricMap) WithNamespaces(namespaces []string) *MetricMap {
+	mmNew := NewMetricMap()
+	for _, namespace := range namespaces {
+		prefix := ""
+		if namespace != "" {
+			prefix = namespace + "."
+		}
+		for metricName, v := range mm.Counters {
+			mmNew.Counters[prefix+metricName] = v
+		}
+		for metricName, v := range mm.Gauges {
+			mmNew.Gauges[prefix+metricName] = v
+		}
+		for metricName, v := range mm.Timers {
+			mmNew.Timers[prefix+metricName] = v
+		}
+		for metricName, v := range mm.Sets {
+			mmNew.Sets[prefix+metricName] = v
+		}
+		for metricName, v := range mm.Distributions {
+			mmNew.Distributions[prefix+metricName] = v
+		}
+	}
+	return mmNew
+}
+
+// WithNamespaceReplaced returns a shallow copy of the MetricMap with the namespace from removed from the start of the
+// metric names which have it, and the namespace to prefixed to every metric name.  An empty namespace is neither
+// removed nor prefixed.  The original MetricMap is not modified.
+//
+// If a name with the namespace from and one without it are renamed to the same name, such as prod.x and x when prod
+// is removed, their series are merged.  A series of both with the same tags is kept from the name with the namespace
+// from, and the other is dropped with a warning.
+func (mm *MetricMap) WithNamespaceReplaced(from, to string) *MetricMap {
+	if from == to {
+		return mm
+	}
+	hasNamespace := func(metricName string) bool {
+		return from != "" && strings.HasPrefix(metricName, from+".")
+	}
+	rename := func(metricName string) string {
+		if hasNamespace(metricName) {
+			metricName = metricName[len(from)+1:]
+		}
+		if to != "" {
+			metricName = to + "." + metricName
+		}
+		return metricName
+	}
+	// replaces returns true if the series of metricName with tagsKey replaces the series with the same tags of the
+	// other name which is renamed to newName.
+	replaces := func(metricName, newName, tagsKey string) bool {
+		kept, dropped := from+"."+metricName, metricName
+		if hasNamespace(metricName) {
+			kept, dropped = metricName, metricName[len(from)+1:]
+		}
+		logrus.StandardLogger().Warnf("Dropping series of %s with tags %q, as %s has the same series and both are renamed to %s", dropped, tagsKey, kept, newName)
+		return kept == metricName
+	}
+	mmNew := NewMetricMap()
+	for metricName, v := range mm.Counters {
+		newName := rename(metricName)
+		existing, ok := mmNew.Counters[newName]
+		if !ok {
+			mmNew.Counters[newName] = v
+			continue
+		}
+		merged := make(map[string]Counter, len(existing)+len(v))
+		for tagsKey, m := range existing {
+			merged[tagsKey] = m
+		}
+		for tagsKey, m := range v {
+			if _, ok := merged[tagsKey]; ok && !replaces(metricName, newName, tagsKey) {
+				continue
+			}
+			merged[tagsKey] = m
+		}
+		mmNew.Counters[newName] = merged
+	}
+	for metricName, v := range mm.Gauges {
+		newName := rename(metricName)
+		existing, ok := mmNew.Gauges[newName]
+		if !ok {
+			mmNew.Gauges[newName] = v
+			continue
+		}
+		merged := make(map[string]Gauge, len(existing)+len(v))
+		for tagsKey, m := range existing {
+			merged[tagsKey] = m
+		}
+		for tagsKey, m := range v {
+			if _, ok := merged[tagsKey]; ok && !replaces(metricName, newName, tagsKey) {
+				continue
+			}
+			merged[tagsKey] = m
+		}
+		mmNew.Gauges[newName] = merged
+	}
+	for metricName, v := range mm.Timers {
+		newName := rename(metricName)
+		existing, ok := mmNew.Timers[newName]
+		if !ok {
+			mmNew.Timers[newName] = v
+			continue
+		}
+		merged := make(map[string]Timer, len(existing)+len(v))
+		for tagsKey, m := range existing {
+			merged[tagsKey] = m
+		}
+		for tagsKey, m := range v {
+			if _, ok := merged[tagsKey]; ok && !replaces(metricName, newName, tagsKey) {
+				continue
+			}
+			merged[tagsKey] = m
+		}
+		mmNew.Timers[newName] = merged
+	}
+	for metricName, v := range mm.Sets {
+		newName := rename(metricName)
+		existing, ok := mmNew.Sets[newName]
+		if !ok {
+			mmNew.Sets[newName] = v
+			continue
+		}
+		merged := make(map[string]Set, len(existing)+len(v))
+		for tagsKey, m := range existing {
+			merged[tagsKey] = m
+		}
+		for tagsKey, m := range v {
+			if _, ok := merged[tagsKey]; ok && !replaces(metricName, newName, tagsKey) {
+				continue
+			}
+			merged[tagsKey] = m
+		}
+		mmNew.Sets[newName] = merged
+	}
+	for metricName, v := range mm.Distributions {
+		newName := rename(metricName)
+		existing, ok := mmNew.Distributions[newName]
+		if !ok {
+			mmNew.Distributions[newName] = v
+			continue
+		}
+		merged := make(map[string]Timer, len(existing)+len(v))
+		for tagsKey, m := range existing {
+			merged[tagsKey] = m
+		}
+		for tagsKey, m := range v {
+			if _, ok := merged[tagsKey]; ok && !replaces(metricName, newName, tagsKey) {
+				continue
 			}
+			merged[tagsKey] = m
 		}
+		mmNew.Distributions[newName] = merged
+	}
+	return mmNew
+}
+
+// WithCounterRates returns a shallow copy of the MetricMap with each counter replaced by two gauges, <name> with the
+// count for the flush interval, and <name>.per_second with the rate.  This lets backends which serialize counters
+// differently all emit the same two series.  A gauge with the same name and tags as one of the new gauges is
+// replaced.  The original MetricMap is not modified.
+func (mm *MetricMap) WithCounterRates() *MetricMap {
+	mmNew := &MetricMap{
+		Counters:      Counters{},
+		Timers:        mm.Timers,
+		Gauges:        make(Gauges, len(mm.Gauges)+2*len(mm.Counters)),
+		Sets:          mm.Sets,
+		Distributions: mm.Distributions,
+	}
+	for metricName, v := range mm.Gauges {
+		mmNew.Gauges[metricName] = v
+	}
+	copied := map[string]bool{} // Names of gauges which have been copied so they can be modified
+	addGauge := func(metricName, tagsKey string, g Gauge) {
+		v, ok := mmNew.Gauges[metricName]
+		if !ok {
+			v = map[string]Gauge{}
+			mmNew.Gauges[metricName] = v
+			copied[metricName] = true
+		} else if !copied[metricName] {
+			vNew := make(map[string]Gauge, len(v)+1)
+			for k, gauge := range v {
+				vNew[k] = gauge
+			}
+			v = vNew
+			mmNew.Gauges[metricName] = v
+			copied[metricName] = true
+		}
+		v[tagsKey] = g
+	}
+	mm.Counters.Each(func(metricName string, tagsKey string, c Counter) {
+		addGauge(metricName, tagsKey, NewGauge(c.Timestamp, float64(c.Value), c.Hostname, c.Tags))
+		addGauge(metricName+".per_second", tagsKey, NewGauge(c.Timestamp, c.PerSecond, c.Hostname, c.Tags))
 	})
+	return mmNew
+}
+
+// Copy returns a deep copy of the MetricMap, which is safe to keep after the original is modified.  Tags are shared,
+// as they are never modified in place.
+func (mm *MetricMap) Copy() *MetricMap {
+	mmNew := &MetricMap{
+		Counters:      make(Counters, len(mm.Counters)),
+		Gauges:        make(Gauges, len(mm.Gauges)),
+		Timers:        make(Timers, len(mm.Timers)),
+		Sets:          make(Sets, len(mm.Sets)),
+		Distributions: make(Distributions, len(mm.Distributions)),
+	}
+	for metricName, v := range mm.Counters {
+		vNew := make(map[string]Counter, len(v))
+		for tagsKey, c := range v {
+			vNew[tagsKey] = c
+		}
+		mmNew.Counters[metricName] = vNew
+	}
+	for metricName, v := range mm.Gauges {
+		vNew := make(map[string]Gauge, len(v))
+		for tagsKey, g := range v {
+			vNew[tagsKey] = g
+		}
+		mmNew.Gauges[metricName] = vNew
+	}
+	for metricName, v := range mm.Timers {
+		vNew := make(map[string]Timer, len(v))
+		for tagsKey, t := range v {
+			t.Values = append([]float64(nil), t.Values...)
+			t.Weights = append([]float64(nil), t.Weights...)
+			t.Percentiles = append(Percentiles(nil), t.Percentiles...)
+			t.Histogram = append([]HistogramBucket(nil), t.Histogram...)
+			vNew[tagsKey] = t
+		}
+		mmNew.Timers[metricName] = vNew
+	}
+	for metricName, v := range mm.Sets {
+		vNew := make(map[string]Set, len(v))
+		for tagsKey, s := range v {
+			values := make(map[string]struct{}, len(s.Values))
+			for value := range s.Values {
+				values[value] = struct{}{}
+			}
+			s.Values = values
+			vNew[tagsKey] = s
+		}
+		mmNew.Sets[metricName] = vNew
+	}
+	for metricName, v := range mm.Distributions {
+		vNew := make(map[string]Timer, len(v))
+		for tagsKey, d := range v {
+			d.Values = append([]float64(nil), d.Values...)
+			d.Weights = append([]float64(nil), d.Weights...)
+			d.Percentiles = append(Percentiles(nil), d.Percentiles...)
+			vNew[tagsKey] = d
+		}
+		mmNew.Distributions[metricName] = vNew
+	}
+	return mmNew
 }
 
 func (mm *MetricMap) IsEmpty() bool {
-	return len(mm.Counters)+len(mm.Timers)+len(mm.Sets)+len(mm.Gauges) == 0
+	return len(mm.Counters)+len(mm.Timers)+len(mm.Sets)+len(mm.Gauges)+len(mm.Distributions) == 0
 }
 
 // Split will split a MetricMap up in to multiple MetricMaps, where each one contains metrics only for its buckets.
 func (mm *MetricMap) Split(count int) []*MetricMap {
+	return mm.SplitFunc(count, func(metricName, hostname string, tags Tags) int {
+		return Bucket(metricName, hostname, count)
+	})
+}
+
+// SplitFunc will split a MetricMap up in to count MetricMaps, putting each metric in the MetricMap with the index
+// returned by bucket.  The maps of each metric name are not shared with the original MetricMap.
+func (mm *MetricMap) SplitFunc(count int, bucket func(metricName, hostname string, tags Tags) int) []*MetricMap {
 	maps := make([]*MetricMap, count)
 	for i := 0; i < count; i++ {
 		maps[i] = NewMetricMap()
 	}
 
 	mm.Counters.Each(func(metricName string, tagsKey string, c Counter) {
-		mmSplit := maps[Bucket(metricName, c.Hostname, count)]
+		mmSplit := maps[bucket(metricName, c.Hostname, c.Tags)]
 		if v, ok := mmSplit.Counters[metricName]; ok {
 			v[tagsKey] = c
 		} else {
@@ -149,7 +515,7 @@ func (mm *MetricMap) Split(count int) []*MetricMap {
 		}
 	})
 	mm.Gauges.Each(func(metricName string, tagsKey string, g Gauge) {
-		mmSplit := maps[Bucket(metricName, g.Hostname, count)]
+		mmSplit := maps[bucket(metricName, g.Hostname, g.Tags)]
 		if v, ok := mmSplit.Gauges[metricName]; ok {
 			v[tagsKey] = g
 		} else {
@@ -157,7 +523,7 @@ func (mm *MetricMap) Split(count int) []*MetricMap {
 		}
 	})
 	mm.Timers.Each(func(metricName string, tagsKey string, t Timer) {
-		mmSplit := maps[Bucket(metricName, t.Hostname, count)]
+		mmSplit := maps[bucket(metricName, t.Hostname, t.Tags)]
 		if v, ok := mmSplit.Timers[metricName]; ok {
 			v[tagsKey] = t
 		} else {
@@ -165,13 +531,21 @@ func (mm *MetricMap) Split(count int) []*MetricMap {
 		}
 	})
 	mm.Sets.Each(func(metricName string, tagsKey string, s Set) {
-		mmSplit := maps[Bucket(metricName, s.Hostname, count)]
+		mmSplit := maps[bucket(metricName, s.Hostname, s.Tags)]
 		if v, ok := mmSplit.Sets[metricName]; ok {
 			v[tagsKey] = s
 		} else {
 			mmSplit.Sets[metricName] = map[string]Set{tagsKey: s}
 		}
 	})
+	mm.Distributions.Each(func(metricName string, tagsKey string, d Timer) {
+		mmSplit := maps[bucket(metricName, d.Hostname, d.Tags)]
+		if v, ok := mmSplit.Distributions[metricName]; ok {
+			v[tagsKey] = d
+		} else {
+			mmSplit.Distributions[metricName] = map[string]Timer{tagsKey: d}
+		}
+	})
 
 	return maps
 }
@@ -202,31 +576,42 @@ func (mm *MetricMap) receiveGauge(m *Metric, tagsKey string) {
 	if ok {
 		g, ok := v[tagsKey]
 		if ok {
-			if m.Timestamp > g.Timestamp {
+			if m.GaugeDelta {
+				g.Value += m.Value
+				if m.Timestamp > g.Timestamp {
+					g.Timestamp = m.Timestamp
+				}
+			} else if m.Timestamp >= g.Timestamp {
 				g.Value = m.Value
 				g.Timestamp = m.Timestamp
+				g.Delta = false
 			}
 		} else {
-			g = NewGauge(m.Timestamp, m.Value, m.Hostname, m.Tags)
+			g = newReceivedGauge(m)
 		}
 		v[tagsKey] = g
 	} else {
 		mm.Gauges[m.Name] = map[string]Gauge{
-			tagsKey: NewGauge(m.Timestamp, m.Value, m.Hostname, m.Tags),
+			tagsKey: newReceivedGauge(m),
 		}
 	}
 }
 
+func newReceivedGauge(m *Metric) Gauge {
+	g := NewGauge(m.Timestamp, m.Value, m.Hostname, m.Tags)
+	g.Delta = m.GaugeDelta
+	return g
+}
+
 func (mm *MetricMap) receiveTimer(m *Metric, tagsKey string) {
 	v, ok := mm.Timers[m.Name]
 	if ok {
 		t, ok := v[tagsKey]
 		if ok {
-			t.Values = append(t.Values, m.Value)
+			t.AddValue(m.Value, 1.0/m.Rate)
 			if m.Timestamp > t.Timestamp {
 				t.Timestamp = m.Timestamp
 			}
-			t.SampledCount += 1.0 / m.Rate
 		} else {
 			t = NewTimer(m.Timestamp, []float64{m.Value}, m.Hostname, m.Tags)
 			t.SampledCount = 1.0 / m.Rate
@@ -242,6 +627,30 @@ func (mm *MetricMap) receiveTimer(m *Metric, tagsKey string) {
 	}
 }
 
+func (mm *MetricMap) receiveDistribution(m *Metric, tagsKey string) {
+	v, ok := mm.Distributions[m.Name]
+	if ok {
+		d, ok := v[tagsKey]
+		if ok {
+			d.AddValue(m.Value, 1.0/m.Rate)
+			if m.Timestamp > d.Timestamp {
+				d.Timestamp = m.Timestamp
+			}
+		} else {
+			d = NewTimer(m.Timestamp, []float64{m.Value}, m.Hostname, m.Tags)
+			d.SampledCount = 1.0 / m.Rate
+		}
+		v[tagsKey] = d
+	} else {
+		d := NewTimer(m.Timestamp, []float64{m.Value}, m.Hostname, m.Tags)
+		d.SampledCount = 1.0 / m.Rate
+
+		mm.Distributions[m.Name] = map[string]Timer{
+			tagsKey: d,
+		}
+	}
+}
+
 func (mm *MetricMap) receiveSet(m *Metric, tagsKey string) {
 	v, ok := mm.Sets[m.Name]
 	if ok {
@@ -278,6 +687,11 @@ func (mm *MetricMap) String() string {
 	mm.Sets.Each(func(k, tags string, set Set) {
 		_, _ = fmt.Fprintf(buf, "stats.set.%s: %d tags=%s\n", k, len(set.Values), tags)
 	})
+	mm.Distributions.Each(func(k, tags string, distribution Timer) {
+		for _, value := range distribution.Values {
+			_, _ = fmt.Fprintf(buf, "stats.distribution.%s: %f tags=%s\n", k, value, tags)
+		}
+	})
 	return buf.String()
 }
 
@@ -301,14 +715,15 @@ func (mm *MetricMap) DispatchMetrics(ctx context.Context, handler RawMetricHandl
 
 	mm.Gauges.Each(func(metricName string, tagsKey string, g Gauge) {
 		m := &Metric{
-			Name:      metricName,
-			Type:      GAUGE,
-			Value:     g.Value,
-			Rate:      1,
-			Tags:      g.Tags.Copy(),
-			TagsKey:   tagsKey,
-			Timestamp: g.Timestamp,
-			Hostname:  g.Hostname,
+			Name:       metricName,
+			Type:       GAUGE,
+			Value:      g.Value,
+			Rate:       1,
+			Tags:       g.Tags.Copy(),
+			TagsKey:    tagsKey,
+			Timestamp:  g.Timestamp,
+			Hostname:   g.Hostname,
+			GaugeDelta: g.Delta,
 		}
 		metrics = append(metrics, m)
 	})
@@ -317,7 +732,10 @@ func (mm *MetricMap) DispatchMetrics(ctx context.Context, handler RawMetricHandl
 		// Compensate for t.SampledCount so the final handler will multiply it back out.  This whole thing will
 		// disappear once the backend aggregator is refactored (issue #210)
 		rate := float64(len(t.Values)) / t.SampledCount
-		for _, value := range t.Values {
+		for idx, value := range t.Values {
+			if t.Weights != nil {
+				rate = 1 / t.Weights[idx]
+			}
 			m := &Metric{
 				Name:      metricName,
 				Type:      TIMER,
@@ -348,5 +766,26 @@ func (mm *MetricMap) DispatchMetrics(ctx context.Context, handler RawMetricHandl
 		}
 	})
 
+	mm.Distributions.Each(func(metricName string, tagsKey string, d Timer) {
+		// Compensate for d.SampledCount the same as for timers
+		rate := float64(len(d.Values)) / d.SampledCount
+		for idx, value := range d.Values {
+			if d.Weights != nil {
+				rate = 1 / d.Weights[idx]
+			}
+			m := &Metric{
+				Name:      metricName,
+				Type:      DISTRIBUTION,
+				Value:     value,
+				Rate:      rate,
+				Tags:      d.Tags.Copy(),
+				TagsKey:   tagsKey,
+				Timestamp: d.Timestamp,
+				Hostname:  d.Hostname,
+			}
+			metrics = append(metrics, m)
+		}
+	})
+
 	handler.DispatchMetrics(ctx, metrics)
 }
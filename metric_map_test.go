@@ -1,6 +1,7 @@
 package gostatsd
 
 import (
+	"math"
 	"sort"
 	"testing"
 
@@ -142,6 +143,103 @@ func BenchmarkReceives(b *testing.B) {
 	}
 }
 
+func TestReceiveTimersAndDistributions(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	mm.Receive(&Metric{Name: "latency", Value: 1, Rate: 1, Type: TIMER, Timestamp: 10})
+	mm.Receive(&Metric{Name: "latency", Value: 2, Rate: 1, Type: DISTRIBUTION, Timestamp: 10})
+	mm.Receive(&Metric{Name: "latency", Value: 3, Rate: 0.5, Type: DISTRIBUTION, Timestamp: 20})
+	mm.Receive(&Metric{Name: "latency", Value: 4, Rate: 1, Type: TIMER, Timestamp: 20})
+
+	require.Equal(t, Timers{
+		"latency": map[string]Timer{
+			"": {Values: []float64{1, 4}, Timestamp: 20, SampledCount: 2},
+		},
+	}, mm.Timers)
+	require.Equal(t, Distributions{
+		"latency": map[string]Timer{
+			"": {Values: []float64{2, 3}, Weights: []float64{1, 2}, Timestamp: 20, SampledCount: 3},
+		},
+	}, mm.Distributions)
+
+	merged := NewMetricMap()
+	merged.Merge(mm)
+	merged.Merge(mm.Copy())
+	require.Equal(t, []float64{1, 4, 1, 4}, merged.Timers["latency"][""].Values)
+	require.Equal(t, []float64{2, 3, 2, 3}, merged.Distributions["latency"][""].Values)
+	require.Equal(t, []float64{1, 2, 1, 2}, merged.Distributions["latency"][""].Weights)
+}
+
+func TestReceiveGaugeLastUpdateWins(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	mm.Receive(&Metric{Name: "g", Value: 1, Type: GAUGE, Timestamp: 20})
+	mm.Receive(&Metric{Name: "g", Value: 2, Type: GAUGE, Timestamp: 10}) // Older, ignored
+	mm.Receive(&Metric{Name: "g", Value: 3, Type: GAUGE, Timestamp: 20}) // Same time, but received later
+	require.Equal(t, Gauge{Value: 3, Timestamp: 20}, mm.Gauges["g"][""])
+
+	merged := NewMetricMap()
+	merged.MergeGauge("g", "", Gauge{Value: 4, Timestamp: 30})
+	merged.MergeGauge("g", "", Gauge{Value: 5, Timestamp: 25})
+	merged.MergeGauge("g", "", Gauge{Value: 6, Timestamp: 30})
+	require.Equal(t, Gauge{Value: 6, Timestamp: 30}, merged.Gauges["g"][""])
+}
+
+func TestReceiveGaugeDelta(t *testing.T) {
+	t.Parallel()
+	for name, tc := range map[string]struct {
+		metrics  []*Metric
+		expected Gauge
+	}{
+		"first seen delta": {
+			metrics: []*Metric{
+				{Name: "g", Value: 5, Type: GAUGE, GaugeDelta: true, Timestamp: 10},
+				{Name: "g", Value: -2, Type: GAUGE, GaugeDelta: true, Timestamp: 20},
+			},
+			expected: Gauge{Value: 3, Timestamp: 20, Delta: true},
+		},
+		"absolute then delta": {
+			metrics: []*Metric{
+				{Name: "g", Value: 10, Type: GAUGE, Timestamp: 10},
+				{Name: "g", Value: 5, Type: GAUGE, GaugeDelta: true, Timestamp: 20},
+				{Name: "g", Value: -3, Type: GAUGE, GaugeDelta: true, Timestamp: 20},
+			},
+			expected: Gauge{Value: 12, Timestamp: 20},
+		},
+		"delta then absolute": {
+			metrics: []*Metric{
+				{Name: "g", Value: 5, Type: GAUGE, GaugeDelta: true, Timestamp: 10},
+				{Name: "g", Value: 7, Type: GAUGE, Timestamp: 20},
+			},
+			expected: Gauge{Value: 7, Timestamp: 20},
+		},
+		"absolute then delta then absolute then delta": {
+			metrics: []*Metric{
+				{Name: "g", Value: 10, Type: GAUGE, Timestamp: 10},
+				{Name: "g", Value: 1, Type: GAUGE, GaugeDelta: true, Timestamp: 20},
+				{Name: "g", Value: 2, Type: GAUGE, Timestamp: 30},
+				{Name: "g", Value: 4, Type: GAUGE, GaugeDelta: true, Timestamp: 30},
+			},
+			expected: Gauge{Value: 6, Timestamp: 30},
+		},
+	} {
+		tc := tc
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			mm := NewMetricMap()
+			merged := NewMetricMap()
+			for _, m := range tc.metrics {
+				single := NewMetricMap()
+				single.Receive(&Metric{Name: m.Name, Value: m.Value, Type: m.Type, GaugeDelta: m.GaugeDelta, Timestamp: m.Timestamp})
+				merged.Merge(single)
+				mm.Receive(m)
+			}
+			require.Equal(t, tc.expected, mm.Gauges["g"][""])
+			require.Equal(t, tc.expected, merged.Gauges["g"][""])
+		})
+	}
+}
+
 func TestMetricMapDispatch(t *testing.T) {
 	ctx, done := testContext(t)
 	defer done()
@@ -241,6 +339,7 @@ func TestMetricMapMerge(t *testing.T) {
 			"": {
 				SampledCount: 1 + (1 / 0.1) + 1 + (1 / 0.1),
 				Values:       []float64{10, 10, 20, 20},
+				Weights:      []float64{1, 1 / 0.1, 1, 1 / 0.1},
 				Timestamp:    20,
 			},
 		},
@@ -267,6 +366,32 @@ func TestMetricMapMerge(t *testing.T) {
 	require.Equal(t, expected.Sets, merged.Sets)
 }
 
+func TestTimerAppendValuesWeights(t *testing.T) {
+	t.Parallel()
+	uniform := Timer{Values: []float64{1, 2}, SampledCount: 20}
+
+	timer := Timer{}
+	timer.AppendValues(uniform)
+	require.Nil(t, timer.Weights)
+	timer.AppendValues(uniform)
+	require.Nil(t, timer.Weights)
+	timer.AddValue(3, 10)
+	require.Nil(t, timer.Weights)
+	require.EqualValues(t, 50, timer.SampledCount)
+
+	timer.AddValue(4, 1)
+	require.Equal(t, []float64{10, 10, 10, 10, 10, 1}, timer.Weights)
+	timer.AppendValues(uniform)
+	require.Equal(t, []float64{1, 2, 1, 2, 3, 4, 1, 2}, timer.Values)
+	require.Equal(t, []float64{10, 10, 10, 10, 10, 1, 10, 10}, timer.Weights)
+	require.EqualValues(t, 71, timer.SampledCount)
+
+	into := Timer{Values: []float64{5}, SampledCount: 1}
+	into.AppendValues(timer)
+	require.Equal(t, []float64{1, 10, 10, 10, 10, 10, 1, 10, 10}, into.Weights)
+	require.EqualValues(t, 72, into.SampledCount)
+}
+
 func TestMetricMapSplit(t *testing.T) {
 	mmOriginal := NewMetricMap()
 	mmOriginal.Counters["m"] = map[string]Counter{
@@ -297,6 +422,13 @@ func TestMetricMapSplit(t *testing.T) {
 		"t.s.h4": {Tags: Tags{"t"}, Hostname: "h4", Values: map[string]struct{}{"40": {}, "20": {}}},
 		"t.s.h5": {Tags: Tags{"t"}, Hostname: "h5", Values: map[string]struct{}{"50": {}, "10": {}}},
 	}
+	mmOriginal.Distributions["m"] = map[string]Timer{
+		"t.s.h1": {Tags: Tags{"t"}, Hostname: "h1", Values: []float64{10, 50}},
+		"t.s.h2": {Tags: Tags{"t"}, Hostname: "h2", Values: []float64{20, 40}},
+		"t.s.h3": {Tags: Tags{"t"}, Hostname: "h3", Values: []float64{30, 30}},
+		"t.s.h4": {Tags: Tags{"t"}, Hostname: "h4", Values: []float64{40, 20}},
+		"t.s.h5": {Tags: Tags{"t"}, Hostname: "h5", Values: []float64{50, 10}},
+	}
 
 	mmMerged := NewMetricMap()
 	mms := mmOriginal.Split(2)
@@ -306,6 +438,7 @@ func TestMetricMapSplit(t *testing.T) {
 		require.True(t, len(mmSplit.Gauges) > 0)
 		require.True(t, len(mmSplit.Timers) > 0)
 		require.True(t, len(mmSplit.Sets) > 0)
+		require.True(t, len(mmSplit.Distributions) > 0)
 		mmMerged.Merge(mmSplit)
 	}
 	// Make sure when merge back they are the same
@@ -339,4 +472,188 @@ func TestMetricMapIsEmpty(t *testing.T) {
 	require.False(t, mm.IsEmpty())
 	mm.Sets.Delete("m")
 	require.True(t, mm.IsEmpty())
+
+	// Distribution
+	mm.Distributions["m"] = map[string]Timer{"t.s.h1": {Tags: Tags{"t"}, Hostname: "h1", Values: []float64{10}}}
+	require.False(t, mm.IsEmpty())
+	mm.Distributions.Delete("m")
+	require.True(t, mm.IsEmpty())
+}
+
+func TestMetricMapCopy(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	for _, metric := range metricsFixtures() {
+		mm.Receive(metric)
+	}
+	mm.Timers.Each(func(metricName, tagsKey string, tm Timer) {
+		tm.Histogram = []HistogramBucket{{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 1}}
+		mm.Timers[metricName][tagsKey] = tm
+	})
+	mmCopy := mm.Copy()
+	require.Equal(t, mm, mmCopy)
+
+	// Modifying the original in place doesn't affect the copy
+	expected := mm.Copy()
+	mm.Counters.Each(func(metricName, tagsKey string, c Counter) {
+		c.Value++
+		mm.Counters[metricName][tagsKey] = c
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, tm Timer) {
+		tm.Values[0]++
+		tm.Histogram[0].Count++
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s Set) {
+		s.Values["new"] = struct{}{}
+	})
+	assert.Equal(t, expected, mmCopy)
+}
+
+func TestMetricMapWithTags(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	for _, metric := range metricsFixtures() {
+		mm.Receive(metric)
+	}
+	mmTagged := mm.WithTags(Tags{"extra:tag"})
+
+	count := 0
+	check := func(metricName, tagsKey string, originalTags, taggedTags Tags) {
+		count++
+		assert.Equal(t, originalTags.Concat(Tags{"extra:tag"}), taggedTags, "%s %s", metricName, tagsKey)
+		assert.NotContains(t, originalTags, "extra:tag")
+	}
+	mm.Counters.Each(func(metricName, tagsKey string, c Counter) {
+		check(metricName, tagsKey, c.Tags, mmTagged.Counters[metricName][tagsKey].Tags)
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g Gauge) {
+		check(metricName, tagsKey, g.Tags, mmTagged.Gauges[metricName][tagsKey].Tags)
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, tm Timer) {
+		check(metricName, tagsKey, tm.Tags, mmTagged.Timers[metricName][tagsKey].Tags)
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s Set) {
+		check(metricName, tagsKey, s.Tags, mmTagged.Sets[metricName][tagsKey].Tags)
+	})
+	require.NotZero(t, count)
+}
+
+func TestMetricMapWithCounterRates(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	mm.Counters["requests"] = map[string]Counter{
+		"":      {Value: 20, PerSecond: 2, Timestamp: 10},
+		"a:b":   {Value: 5, PerSecond: 0.5, Timestamp: 10, Hostname: "h", Tags: Tags{"a:b"}},
+		"c:d,e": {Value: 0, PerSecond: 0, Timestamp: 5, Tags: Tags{"c:d", "e"}},
+	}
+	mm.Gauges["requests"] = map[string]Gauge{
+		"x:y": {Value: 1, Timestamp: 10, Tags: Tags{"x:y"}},
+	}
+	mm.Gauges["other"] = map[string]Gauge{
+		"": {Value: 3, Timestamp: 10},
+	}
+	mm.Timers["latency"] = map[string]Timer{
+		"": {Values: []float64{1}, Timestamp: 10},
+	}
+	mmRates := mm.WithCounterRates()
+
+	assert.Empty(t, mmRates.Counters)
+	assert.Equal(t, mm.Timers, mmRates.Timers)
+	assert.Equal(t, mm.Sets, mmRates.Sets)
+	expected := Gauges{
+		"requests": map[string]Gauge{
+			"":      {Value: 20, Timestamp: 10},
+			"a:b":   {Value: 5, Timestamp: 10, Hostname: "h", Tags: Tags{"a:b"}},
+			"c:d,e": {Value: 0, Timestamp: 5, Tags: Tags{"c:d", "e"}},
+			"x:y":   {Value: 1, Timestamp: 10, Tags: Tags{"x:y"}},
+		},
+		"requests.per_second": map[string]Gauge{
+			"":      {Value: 2, Timestamp: 10},
+			"a:b":   {Value: 0.5, Timestamp: 10, Hostname: "h", Tags: Tags{"a:b"}},
+			"c:d,e": {Value: 0, Timestamp: 5, Tags: Tags{"c:d", "e"}},
+		},
+		"other": map[string]Gauge{
+			"": {Value: 3, Timestamp: 10},
+		},
+	}
+	assert.Equal(t, expected, mmRates.Gauges)
+
+	// The original is unchanged
+	assert.Len(t, mm.Counters["requests"], 3)
+	assert.Len(t, mm.Gauges["requests"], 1)
+	assert.NotContains(t, mm.Gauges, "requests.per_second")
+}
+
+func TestMetricMapWithNamespaces(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	for _, metric := range metricsFixtures() {
+		mm.Receive(metric)
+	}
+	mmNamespaced := mm.WithNamespaces([]string{"", "new"})
+
+	assert.Equal(t, 2*len(mm.Counters), len(mmNamespaced.Counters))
+	assert.Equal(t, 2*len(mm.Gauges), len(mmNamespaced.Gauges))
+	assert.Equal(t, 2*len(mm.Timers), len(mmNamespaced.Timers))
+	assert.Equal(t, 2*len(mm.Sets), len(mmNamespaced.Sets))
+	mm.Counters.Each(func(metricName, tagsKey string, c Counter) {
+		assert.Equal(t, c, mmNamespaced.Counters[metricName][tagsKey])
+		assert.Equal(t, c, mmNamespaced.Counters["new."+metricName][tagsKey])
+	})
+	mm.Gauges.Each(func(metricName, tagsKey string, g Gauge) {
+		assert.Equal(t, g, mmNamespaced.Gauges["new."+metricName][tagsKey])
+	})
+	mm.Timers.Each(func(metricName, tagsKey string, tm Timer) {
+		assert.Equal(t, tm, mmNamespaced.Timers["new."+metricName][tagsKey])
+	})
+	mm.Sets.Each(func(metricName, tagsKey string, s Set) {
+		assert.Equal(t, s, mmNamespaced.Sets["new."+metricName][tagsKey])
+	})
+}
+
+func TestMetricMapWithNamespaceReplaced(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	mm.Counters["prod.requests"] = map[string]Counter{"": {Value: 1}}
+	mm.Gauges["prod.queue"] = map[string]Gauge{"": {Value: 2}}
+	mm.Timers["latency"] = map[string]Timer{"": {Values: []float64{3}}}
+	mm.Sets["production.users"] = map[string]Set{"": {Values: map[string]struct{}{"a": {}}}}
+
+	replaced := mm.WithNamespaceReplaced("prod", "vendor")
+	assert.Equal(t, mm.Counters["prod.requests"], replaced.Counters["vendor.requests"])
+	assert.Equal(t, mm.Gauges["prod.queue"], replaced.Gauges["vendor.queue"])
+	assert.Equal(t, mm.Timers["latency"], replaced.Timers["vendor.latency"])
+	assert.Equal(t, mm.Sets["production.users"], replaced.Sets["vendor.production.users"])
+	assert.Len(t, replaced.Counters, 1)
+	assert.Contains(t, mm.Counters, "prod.requests") // The original is unchanged
+
+	removed := mm.WithNamespaceReplaced("prod", "")
+	assert.Contains(t, removed.Counters, "requests")
+	assert.Contains(t, removed.Timers, "latency")
+
+	assert.Same(t, mm, mm.WithNamespaceReplaced("prod", "prod"))
+}
+
+func TestMetricMapWithNamespaceReplacedCollisions(t *testing.T) {
+	t.Parallel()
+	mm := NewMetricMap()
+	mm.Counters["prod.requests"] = map[string]Counter{"a:1": {Value: 1}, "a:2": {Value: 2}}
+	mm.Counters["requests"] = map[string]Counter{"a:2": {Value: 3}, "a:3": {Value: 4}}
+	mm.Gauges["queue"] = map[string]Gauge{"": {Value: 5}}
+	mm.Gauges["prod.queue"] = map[string]Gauge{"": {Value: 6}}
+
+	for _, to := range []string{"", "vendor"} {
+		prefix := ""
+		if to != "" {
+			prefix = to + "."
+		}
+		replaced := mm.WithNamespaceReplaced("prod", to)
+		assert.Equal(t, map[string]Counter{"a:1": {Value: 1}, "a:2": {Value: 2}, "a:3": {Value: 4}}, replaced.Counters[prefix+"requests"])
+		assert.Equal(t, map[string]Gauge{"": {Value: 6}}, replaced.Gauges[prefix+"queue"])
+		assert.Len(t, replaced.Counters, 1)
+		assert.Len(t, replaced.Gauges, 1)
+	}
+	// The original is unchanged
+	assert.Len(t, mm.Counters["prod.requests"], 2)
+	assert.Len(t, mm.Counters["requests"], 2)
 }
@@ -18,10 +18,14 @@ const (
 	GAUGE
 	// SET is statsd set type
 	SET
+	// DISTRIBUTION is DogStatsD distribution type
+	DISTRIBUTION
 )
 
 func (m MetricType) String() string {
 	switch m {
+	case DISTRIBUTION:
+		return "distribution"
 	case SET:
 		return "set"
 	case GAUGE:
@@ -46,6 +50,7 @@ type Metric struct {
 	SourceIP    IP         // IP of the source of the metric
 	Timestamp   Nanotime   // Most accurate known timestamp of this metric
 	Type        MetricType // The type of metric
+	GaugeDelta  bool       // For a gauge, the value is added to the current value, rather than replacing it
 	DoneFunc    func()     // Returns the metric to the pool. May be nil. Call Metric.Done(), not this.
 }
 
@@ -61,6 +66,7 @@ func (m *Metric) Reset() {
 	m.SourceIP = ""
 	m.Timestamp = 0
 	m.Type = 0
+	m.GaugeDelta = false
 }
 
 // Bucket will pick a distribution bucket for this metric to land in.  max is exclusive.
@@ -75,6 +75,7 @@ type RawMessageV2 struct {
 	Gauges               map[string]*GaugeTagV2   `protobuf:"bytes,2,rep,name=Gauges,proto3" json:"Gauges,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	Sets                 map[string]*SetTagV2     `protobuf:"bytes,3,rep,name=Sets,proto3" json:"Sets,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	Timers               map[string]*TimerTagV2   `protobuf:"bytes,4,rep,name=Timers,proto3" json:"Timers,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Distributions        map[string]*TimerTagV2   `protobuf:"bytes,5,rep,name=Distributions,proto3" json:"Distributions,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	XXX_NoUnkeyedLiteral struct{}                 `json:"-"`
 	XXX_unrecognized     []byte                   `json:"-"`
 	XXX_sizecache        int32                    `json:"-"`
@@ -132,6 +133,13 @@ func (m *RawMessageV2) GetTimers() map[string]*TimerTagV2 {
 	return nil
 }
 
+func (m *RawMessageV2) GetDistributions() map[string]*TimerTagV2 {
+	if m != nil {
+		return m.Distributions
+	}
+	return nil
+}
+
 type CounterTagV2 struct {
 	TagMap               map[string]*RawCounterV2 `protobuf:"bytes,1,rep,name=TagMap,proto3" json:"TagMap,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
 	XXX_NoUnkeyedLiteral struct{}                 `json:"-"`
@@ -342,6 +350,7 @@ type RawGaugeV2 struct {
 	Tags                 []string `protobuf:"bytes,1,rep,name=Tags,proto3" json:"Tags,omitempty"`
 	Hostname             string   `protobuf:"bytes,2,opt,name=Hostname,proto3" json:"Hostname,omitempty"`
 	Value                float64  `protobuf:"fixed64,3,opt,name=Value,proto3" json:"Value,omitempty"`
+	Delta                bool     `protobuf:"varint,4,opt,name=Delta,proto3" json:"Delta,omitempty"`
 	XXX_NoUnkeyedLiteral struct{} `json:"-"`
 	XXX_unrecognized     []byte   `json:"-"`
 	XXX_sizecache        int32    `json:"-"`
@@ -392,6 +401,13 @@ func (m *RawGaugeV2) GetValue() float64 {
 	return 0
 }
 
+func (m *RawGaugeV2) GetDelta() bool {
+	if m != nil {
+		return m.Delta
+	}
+	return false
+}
+
 type RawSetV2 struct {
 	Tags                 []string `protobuf:"bytes,1,rep,name=Tags,proto3" json:"Tags,omitempty"`
 	Hostname             string   `protobuf:"bytes,2,opt,name=Hostname,proto3" json:"Hostname,omitempty"`
@@ -624,6 +640,7 @@ func init() {
 	proto.RegisterMapType((map[string]*GaugeTagV2)(nil), "pb.RawMessageV2.GaugesEntry")
 	proto.RegisterMapType((map[string]*SetTagV2)(nil), "pb.RawMessageV2.SetsEntry")
 	proto.RegisterMapType((map[string]*TimerTagV2)(nil), "pb.RawMessageV2.TimersEntry")
+	proto.RegisterMapType((map[string]*TimerTagV2)(nil), "pb.RawMessageV2.DistributionsEntry")
 	proto.RegisterType((*CounterTagV2)(nil), "pb.CounterTagV2")
 	proto.RegisterMapType((map[string]*RawCounterV2)(nil), "pb.CounterTagV2.TagMapEntry")
 	proto.RegisterType((*GaugeTagV2)(nil), "pb.GaugeTagV2")
@@ -644,48 +661,51 @@ func init() {
 func init() { proto.RegisterFile("pb/gostatsd.proto", fileDescriptor_gostatsd_02649f73f2826ea1) }
 
 var fileDescriptor_gostatsd_02649f73f2826ea1 = []byte{
-	// 684 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x55, 0x5d, 0x6f, 0xd3, 0x30,
-	0x14, 0x9d, 0x9b, 0xb4, 0x4d, 0x6e, 0xbb, 0x29, 0x58, 0x03, 0x85, 0x6a, 0x42, 0x55, 0x34, 0x4d,
-	0xe5, 0xa5, 0xa0, 0x02, 0x12, 0xda, 0xdb, 0x04, 0xd5, 0x56, 0x8d, 0x4d, 0x93, 0x5b, 0x8d, 0x67,
-	0x77, 0x33, 0x51, 0x45, 0x9b, 0x44, 0x8e, 0xbb, 0xd2, 0x1f, 0xc0, 0x13, 0x4f, 0xf0, 0x67, 0xf8,
-	0x7b, 0xc8, 0x76, 0x9a, 0xc6, 0x6d, 0xd0, 0x36, 0xc1, 0x53, 0x7d, 0x3f, 0xce, 0xb9, 0xc7, 0xe7,
-	0x46, 0x2e, 0x3c, 0x49, 0xc6, 0xaf, 0xc2, 0x38, 0x15, 0x54, 0xa4, 0xb7, 0xdd, 0x84, 0xc7, 0x22,
-	0xc6, 0x95, 0x64, 0x1c, 0xfc, 0xb2, 0xa1, 0x49, 0xe8, 0xe2, 0x82, 0xa5, 0x29, 0x0d, 0xd9, 0x75,
-	0x0f, 0x1f, 0x83, 0xf3, 0x21, 0x9e, 0x47, 0x82, 0xf1, 0xd4, 0x47, 0x6d, 0xab, 0xd3, 0xe8, 0xbd,
-	0xe8, 0x26, 0xe3, 0x6e, 0xb1, 0xa7, 0xbb, 0x6a, 0xe8, 0x47, 0x82, 0x2f, 0x49, 0xde, 0x8f, 0xdf,
-	0x42, 0xed, 0x94, 0xce, 0x43, 0x96, 0xfa, 0x15, 0x85, 0x3c, 0xd8, 0x42, 0xea, 0xb2, 0xc6, 0x65,
-	0xbd, 0xb8, 0x0b, 0xf6, 0x90, 0x89, 0xd4, 0xb7, 0x14, 0xa6, 0xb5, 0x85, 0x91, 0x45, 0x8d, 0x50,
-	0x7d, 0x72, 0xca, 0x68, 0x32, 0x93, 0xfa, 0xec, 0xbf, 0x4c, 0xd1, 0xe5, 0x6c, 0x8a, 0x0e, 0x5a,
-	0x17, 0xb0, 0x6b, 0xc8, 0xc6, 0x1e, 0x58, 0x5f, 0xd9, 0xd2, 0x47, 0x6d, 0xd4, 0x71, 0x89, 0x3c,
-	0xe2, 0x23, 0xa8, 0xde, 0xd1, 0xe9, 0x9c, 0xf9, 0x95, 0x36, 0xea, 0x34, 0x7a, 0x9e, 0xe4, 0xcd,
-	0x30, 0x23, 0x1a, 0x5e, 0xf7, 0x88, 0x2e, 0x1f, 0x57, 0xde, 0xa3, 0xd6, 0x00, 0x1a, 0x85, 0xbb,
-	0x94, 0x90, 0x1d, 0x9a, 0x64, 0x7b, 0x92, 0x4c, 0x21, 0xb6, 0xa8, 0xfa, 0xe0, 0xe6, 0x57, 0x2c,
-	0x21, 0x0a, 0x4c, 0xa2, 0xa6, 0x24, 0x1a, 0x32, 0x51, 0xa6, 0xa8, 0x70, 0xef, 0x07, 0x2a, 0x52,
-	0x88, 0x4d, 0xaa, 0xe0, 0x27, 0x82, 0x66, 0xf1, 0xe2, 0xca, 0x72, 0x1a, 0x5e, 0xd0, 0x24, 0xfb,
-	0x24, 0x0e, 0x36, 0xad, 0xe9, 0xea, 0xf2, 0xca, 0x72, 0x15, 0xb4, 0xce, 0xa1, 0x51, 0x48, 0x3f,
-	0xd0, 0x70, 0x42, 0x17, 0x19, 0xb1, 0xa9, 0xe9, 0x07, 0x02, 0x58, 0xfb, 0x87, 0x7b, 0x1b, 0x8a,
-	0x5a, 0xa6, 0xbf, 0xa5, 0x7a, 0x06, 0xf7, 0xe9, 0x29, 0x73, 0x88, 0xd0, 0x85, 0xa2, 0x35, 0xd5,
-	0x7c, 0x47, 0xe0, 0xac, 0x96, 0x80, 0x5f, 0x6f, 0x68, 0xf1, 0x8b, 0x2b, 0x2a, 0x55, 0x72, 0x7a,
-	0x9f, 0x92, 0xb2, 0xa5, 0x13, 0xba, 0x18, 0x32, 0xb1, 0xed, 0xca, 0x7a, 0x87, 0xe5, 0xae, 0xac,
-	0xeb, 0xff, 0xd5, 0x15, 0x45, 0x6b, 0xaa, 0x19, 0xa9, 0xb7, 0x24, 0x5f, 0x1f, 0xc6, 0x60, 0x8f,
-	0x68, 0xa8, 0xdf, 0x11, 0x97, 0xa8, 0x33, 0x6e, 0x81, 0x73, 0x16, 0xa7, 0x22, 0xa2, 0x33, 0x4d,
-	0xe8, 0x92, 0x3c, 0xc6, 0xfb, 0x50, 0xbd, 0x56, 0x93, 0xac, 0x36, 0xea, 0x58, 0x44, 0x07, 0x01,
-	0x01, 0x58, 0x2f, 0xe1, 0xdf, 0x38, 0xd1, 0x9a, 0xd3, 0x59, 0xd9, 0xf9, 0x68, 0xc6, 0x67, 0x50,
-	0x53, 0x24, 0xfa, 0xc5, 0x72, 0x49, 0x16, 0x05, 0x77, 0x4a, 0x67, 0x66, 0xcb, 0xa3, 0x59, 0xdb,
-	0xd0, 0x18, 0xd2, 0x59, 0x32, 0x65, 0xca, 0xbe, 0x4c, 0x6d, 0x31, 0x55, 0x98, 0x2b, 0xdf, 0x3d,
-	0x94, 0xcf, 0xfd, 0x6d, 0x41, 0xbd, 0x7f, 0xc7, 0x22, 0x79, 0x97, 0x7d, 0xa8, 0x8e, 0x26, 0x62,
-	0xca, 0xb2, 0xfd, 0xe9, 0x40, 0x69, 0x61, 0xdf, 0x44, 0x36, 0x53, 0x9d, 0x71, 0x00, 0xcd, 0x8f,
-	0x54, 0xb0, 0x33, 0x9a, 0x24, 0x2c, 0x62, 0xb7, 0x99, 0xe5, 0x46, 0xce, 0xd0, 0x6b, 0x6f, 0xe8,
-	0x3d, 0x82, 0xbd, 0x93, 0x30, 0xe4, 0x2c, 0xa4, 0x62, 0x12, 0x47, 0xe7, 0x6c, 0xe9, 0x57, 0x55,
-	0xc7, 0x46, 0x56, 0xf6, 0x0d, 0xe3, 0x39, 0xbf, 0x61, 0xa3, 0x65, 0xc2, 0x2e, 0x25, 0x53, 0x4d,
-	0xf7, 0x99, 0xd9, 0xdc, 0xaf, 0xba, 0xe9, 0x97, 0xee, 0x1a, 0x5c, 0xf9, 0x8e, 0x9e, 0xbf, 0x8a,
-	0xf1, 0x3b, 0x70, 0xae, 0xf8, 0x24, 0xe6, 0x13, 0xb1, 0xf4, 0xdd, 0x36, 0xea, 0xec, 0xf5, 0x9e,
-	0xcb, 0x0f, 0x33, 0x33, 0x42, 0xff, 0xae, 0x1a, 0x48, 0xde, 0x8a, 0x5f, 0x82, 0x2d, 0x47, 0xfa,
-	0xa0, 0x20, 0x4f, 0x8b, 0x90, 0x93, 0x29, 0xe3, 0x42, 0x16, 0x89, 0x6a, 0x09, 0x0e, 0x61, 0xd7,
-	0x60, 0xc1, 0x00, 0xb5, 0xcb, 0x98, 0xcf, 0xe8, 0xd4, 0xdb, 0xc1, 0x75, 0xb0, 0x3e, 0xc5, 0x0b,
-	0x0f, 0x05, 0xc7, 0xe0, 0xe6, 0x40, 0xec, 0x80, 0x3d, 0x88, 0xbe, 0xc4, 0xde, 0x0e, 0x6e, 0x40,
-	0xfd, 0x33, 0xe5, 0xd1, 0x24, 0x0a, 0x3d, 0x84, 0x5d, 0xa8, 0xf6, 0x39, 0x8f, 0xb9, 0x57, 0x91,
-	0xf9, 0xe1, 0xfc, 0xe6, 0x86, 0xa5, 0xa9, 0x67, 0x8d, 0x6b, 0xea, 0x7f, 0xf8, 0xcd, 0x9f, 0x00,
-	0x00, 0x00, 0xff, 0xff, 0x08, 0x18, 0x8e, 0x08, 0x9c, 0x07, 0x00, 0x00,
+	// 731 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xac, 0x56, 0x4d, 0x6b, 0xdb, 0x4a,
+	0x14, 0xcd, 0x58, 0xfe, 0x90, 0xae, 0x9d, 0xa0, 0x37, 0xe4, 0x3d, 0xf4, 0xcc, 0xe3, 0x61, 0xd4,
+	0x10, 0xdc, 0x8d, 0x5b, 0xdc, 0x16, 0x4a, 0x76, 0xa1, 0x31, 0x89, 0x49, 0x13, 0xc2, 0xd8, 0xa4,
+	0xeb, 0x71, 0x32, 0x55, 0x45, 0x6d, 0x49, 0x8c, 0xc6, 0x71, 0xfd, 0x03, 0xba, 0xea, 0xaa, 0xbf,
+	0xa4, 0xcb, 0xfe, 0xbd, 0x32, 0x33, 0xb2, 0xad, 0xb1, 0x54, 0x92, 0x90, 0xae, 0xa2, 0x3b, 0xf7,
+	0x9c, 0x73, 0x8f, 0xcf, 0x1d, 0x86, 0xc0, 0x5f, 0xc9, 0xe4, 0x45, 0x10, 0xa7, 0x82, 0x8a, 0xf4,
+	0xb6, 0x97, 0xf0, 0x58, 0xc4, 0xb8, 0x92, 0x4c, 0xfc, 0x1f, 0x35, 0x68, 0x11, 0xba, 0xb8, 0x60,
+	0x69, 0x4a, 0x03, 0x76, 0xdd, 0xc7, 0x47, 0x60, 0xbf, 0x8b, 0xe7, 0x91, 0x60, 0x3c, 0xf5, 0x50,
+	0xc7, 0xea, 0x36, 0xfb, 0xff, 0xf7, 0x92, 0x49, 0x2f, 0x8f, 0xe9, 0xad, 0x00, 0x83, 0x48, 0xf0,
+	0x25, 0x59, 0xe3, 0xf1, 0x6b, 0xa8, 0x9f, 0xd2, 0x79, 0xc0, 0x52, 0xaf, 0xa2, 0x98, 0xff, 0x15,
+	0x98, 0xba, 0xad, 0x79, 0x19, 0x16, 0xf7, 0xa0, 0x3a, 0x62, 0x22, 0xf5, 0x2c, 0xc5, 0x69, 0x17,
+	0x38, 0xb2, 0xa9, 0x19, 0x0a, 0x27, 0xa7, 0x8c, 0xc3, 0x99, 0xf4, 0x57, 0xfd, 0xcd, 0x14, 0xdd,
+	0xce, 0xa6, 0xe8, 0x02, 0x0f, 0x61, 0xf7, 0x24, 0x4c, 0x05, 0x0f, 0x27, 0x73, 0x11, 0xc6, 0x51,
+	0xea, 0xd5, 0x14, 0xf9, 0x59, 0x81, 0x6c, 0xa0, 0xb4, 0x86, 0xc9, 0x6c, 0x5f, 0xc0, 0xae, 0x91,
+	0x00, 0x76, 0xc1, 0xfa, 0xcc, 0x96, 0x1e, 0xea, 0xa0, 0xae, 0x43, 0xe4, 0x27, 0x3e, 0x84, 0xda,
+	0x1d, 0x9d, 0xce, 0x99, 0x57, 0xe9, 0xa0, 0x6e, 0xb3, 0xef, 0xca, 0x29, 0x19, 0x67, 0x4c, 0x83,
+	0xeb, 0x3e, 0xd1, 0xed, 0xa3, 0xca, 0x5b, 0xd4, 0x1e, 0x42, 0x33, 0x17, 0x4b, 0x89, 0xd8, 0x81,
+	0x29, 0xb6, 0x27, 0xc5, 0x14, 0xa3, 0x20, 0x35, 0x00, 0x67, 0x9d, 0x56, 0x89, 0x90, 0x6f, 0x0a,
+	0xb5, 0xa4, 0xd0, 0x88, 0x89, 0x32, 0x47, 0xb9, 0x08, 0x1f, 0xe8, 0x48, 0x31, 0x0a, 0x52, 0x57,
+	0x80, 0x8b, 0x81, 0x3e, 0x45, 0xd1, 0xff, 0x8e, 0xa0, 0x95, 0x8f, 0x52, 0xdd, 0x07, 0x1a, 0x5c,
+	0xd0, 0xc4, 0x43, 0x9b, 0xfb, 0x90, 0x47, 0xf4, 0x74, 0x7b, 0x75, 0x1f, 0x54, 0xd1, 0x3e, 0x87,
+	0x66, 0xee, 0xf8, 0x81, 0x2b, 0x24, 0x74, 0x91, 0x09, 0x9b, 0x9e, 0xbe, 0x21, 0x80, 0xcd, 0x46,
+	0x70, 0x7f, 0xcb, 0x51, 0xdb, 0xdc, 0x58, 0xa9, 0x9f, 0xe1, 0x7d, 0x7e, 0xca, 0x12, 0x22, 0x74,
+	0xa1, 0x64, 0x4d, 0x37, 0x5f, 0x11, 0xd8, 0xab, 0xb5, 0xe2, 0x97, 0x5b, 0x5e, 0xbc, 0xfc, 0xd2,
+	0x4b, 0x9d, 0x9c, 0xde, 0xe7, 0xa4, 0xec, 0x1a, 0x11, 0xba, 0x18, 0x31, 0x51, 0x4c, 0x65, 0xb3,
+	0xc3, 0xf2, 0x54, 0x36, 0xfd, 0x3f, 0x9a, 0x8a, 0x92, 0x35, 0xdd, 0x8c, 0xa1, 0x95, 0x5f, 0x1f,
+	0xc6, 0x50, 0x1d, 0xd3, 0x40, 0x3f, 0x72, 0x0e, 0x51, 0xdf, 0xb8, 0x0d, 0xf6, 0x59, 0x9c, 0x8a,
+	0x88, 0xce, 0xb4, 0xa0, 0x43, 0xd6, 0x35, 0xde, 0x87, 0xda, 0xb5, 0x9a, 0x64, 0x75, 0x50, 0xd7,
+	0x22, 0xba, 0xf0, 0x3f, 0x01, 0x6c, 0x96, 0xf0, 0x34, 0x4d, 0x94, 0x69, 0xca, 0xd3, 0x13, 0x36,
+	0x15, 0xd4, 0xab, 0x76, 0x50, 0xd7, 0x26, 0xba, 0xf0, 0x09, 0xd8, 0xab, 0x90, 0x1f, 0x3d, 0xe7,
+	0x1f, 0xa8, 0x2b, 0x69, 0xfd, 0xc8, 0x3a, 0x24, 0xab, 0xfc, 0x3b, 0x80, 0x4d, 0x58, 0x8f, 0x56,
+	0xed, 0x40, 0x73, 0x44, 0x67, 0xc9, 0x94, 0xa9, 0x50, 0xb3, 0xdf, 0x90, 0x3f, 0xca, 0xcd, 0x95,
+	0x4f, 0x35, 0x5a, 0xcf, 0xfd, 0x69, 0x41, 0x63, 0x70, 0xc7, 0x22, 0xf9, 0x5b, 0xf6, 0xa1, 0x36,
+	0x0e, 0xc5, 0x94, 0x65, 0x5b, 0xd5, 0x85, 0xf2, 0xc2, 0xbe, 0x88, 0x6c, 0xa6, 0xfa, 0xc6, 0x3e,
+	0xb4, 0x4e, 0xa8, 0x60, 0x67, 0x34, 0x49, 0x58, 0xc4, 0x6e, 0xb3, 0x45, 0x18, 0x67, 0x86, 0xdf,
+	0xea, 0x96, 0xdf, 0x43, 0xd8, 0x3b, 0x0e, 0x02, 0xce, 0x02, 0x2a, 0x9f, 0xa2, 0x73, 0xb6, 0xf4,
+	0x6a, 0x0a, 0xb1, 0x75, 0x2a, 0x71, 0xa3, 0x78, 0xce, 0x6f, 0xd8, 0x78, 0x99, 0xb0, 0x4b, 0xa9,
+	0x54, 0xd7, 0x38, 0xf3, 0x74, 0x9d, 0x57, 0xc3, 0xcc, 0x4b, 0xa3, 0x86, 0x57, 0x9e, 0xad, 0xe7,
+	0xaf, 0x6a, 0xfc, 0x06, 0xec, 0x2b, 0x1e, 0xc6, 0x3c, 0x14, 0x4b, 0xcf, 0xe9, 0xa0, 0xee, 0x5e,
+	0xff, 0x5f, 0x79, 0x5d, 0xb3, 0x20, 0xf4, 0xdf, 0x15, 0x80, 0xac, 0xa1, 0xf8, 0x39, 0x54, 0xe5,
+	0x48, 0x0f, 0x14, 0xe5, 0xef, 0x3c, 0xe5, 0x78, 0xca, 0xb8, 0x90, 0x4d, 0xa2, 0x20, 0xfe, 0x01,
+	0xec, 0x1a, 0x2a, 0x18, 0xa0, 0x7e, 0x19, 0xf3, 0x19, 0x9d, 0xba, 0x3b, 0xb8, 0x01, 0xd6, 0xfb,
+	0x78, 0xe1, 0x22, 0xff, 0x08, 0x9c, 0x35, 0x11, 0xdb, 0x50, 0x1d, 0x46, 0x1f, 0x63, 0x77, 0x07,
+	0x37, 0xa1, 0xf1, 0x81, 0xf2, 0x28, 0x8c, 0x02, 0x17, 0x61, 0x07, 0x6a, 0x03, 0xce, 0x63, 0xee,
+	0x56, 0xe4, 0xf9, 0x68, 0x7e, 0x73, 0xc3, 0xd2, 0xd4, 0xb5, 0x26, 0x75, 0xf5, 0xaf, 0xc3, 0xab,
+	0x5f, 0x03, 0x00, 0xfd, 0xc6, 0x8f, 0x95, 0x4f, 0x08, 0x00, 0x00,
 }
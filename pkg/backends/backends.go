@@ -6,11 +6,17 @@ import (
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/backends/cloudwatch"
 	"github.com/atlassian/gostatsd/pkg/backends/datadog"
+	"github.com/atlassian/gostatsd/pkg/backends/elasticsearch"
 	"github.com/atlassian/gostatsd/pkg/backends/graphite"
+	"github.com/atlassian/gostatsd/pkg/backends/influxdb"
+	"github.com/atlassian/gostatsd/pkg/backends/kafka"
 	"github.com/atlassian/gostatsd/pkg/backends/newrelic"
 	"github.com/atlassian/gostatsd/pkg/backends/null"
+	"github.com/atlassian/gostatsd/pkg/backends/otlp"
+	"github.com/atlassian/gostatsd/pkg/backends/prometheus"
 	"github.com/atlassian/gostatsd/pkg/backends/statsdaemon"
 	"github.com/atlassian/gostatsd/pkg/backends/stdout"
+	"github.com/atlassian/gostatsd/pkg/backends/victoriametrics"
 	"github.com/atlassian/gostatsd/pkg/transport"
 
 	log "github.com/sirupsen/logrus"
@@ -19,13 +25,19 @@ import (
 
 // All known backends.
 var backends = map[string]gostatsd.BackendFactory{
-	datadog.BackendName:     datadog.NewClientFromViper,
-	graphite.BackendName:    graphite.NewClientFromViper,
-	null.BackendName:        null.NewClientFromViper,
-	statsdaemon.BackendName: statsdaemon.NewClientFromViper,
-	stdout.BackendName:      stdout.NewClientFromViper,
-	cloudwatch.BackendName:  cloudwatch.NewClientFromViper,
-	newrelic.BackendName:    newrelic.NewClientFromViper,
+	datadog.BackendName:         datadog.NewClientFromViper,
+	graphite.BackendName:        graphite.NewClientFromViper,
+	null.BackendName:            null.NewClientFromViper,
+	statsdaemon.BackendName:     statsdaemon.NewClientFromViper,
+	stdout.BackendName:          stdout.NewClientFromViper,
+	cloudwatch.BackendName:      cloudwatch.NewClientFromViper,
+	newrelic.BackendName:        newrelic.NewClientFromViper,
+	elasticsearch.BackendName:   elasticsearch.NewClientFromViper,
+	victoriametrics.BackendName: victoriametrics.NewClientFromViper,
+	prometheus.BackendName:      prometheus.NewClientFromViper,
+	otlp.BackendName:            otlp.NewClientFromViper,
+	kafka.BackendName:           kafka.NewClientFromViper,
+	influxdb.BackendName:        influxdb.NewClientFromViper,
 }
 
 // GetBackend creates an instance of the named backend, or nil if
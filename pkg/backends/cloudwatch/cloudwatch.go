@@ -2,16 +2,22 @@ package cloudwatch
 
 import (
 	"context"
+	"fmt"
+	"sort"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
 	"github.com/atlassian/gostatsd/pkg/transport"
 	"github.com/atlassian/gostatsd/pkg/util"
 
+	"github.com/cenkalti/backoff"
 	log "github.com/sirupsen/logrus"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
@@ -22,15 +28,32 @@ import (
 // https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_limits.html
 const MAX_DIMENSIONS = 10
 
+// Maximum number of metric data per PutMetricData request
+const maxMetricDataPerRequest = 20
+
+// Throttled requests are retried for up to the flush interval, or this long if it isn't known
+const defaultMaxRequestElapsedTime = 1 * time.Second
+
 // BackendName is the name of this backend.
 const BackendName = "cloudwatch"
 
 // Client is an object that is used to send messages to AWS CloudWatch.
 type Client struct {
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with a throttling error
+
 	cloudwatch cloudwatchiface.CloudWatchAPI
 	namespace  string
 
-	disabledSubtypes gostatsd.TimerSubtypes
+	maxDimensions         int
+	statisticSets         bool          // Timers are also sent as a StatisticSet, so CloudWatch can aggregate them
+	maxRequestElapsedTime time.Duration // Throttled requests are retried for up to this long
+	timestampOffset       time.Duration // Added to every timestamp sent, to compensate for clock skew
+	disabledSubtypes      gostatsd.TimerSubtypes
+	metadata              gostatsd.MetadataRules
 }
 
 // NewClientFromViper constructs a Cloudwatch backend.
@@ -38,17 +61,47 @@ func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd
 	g := util.GetSubViper(v, "cloudwatch")
 	g.SetDefault("namespace", "StatsD")
 	g.SetDefault("transport", "default")
+	g.SetDefault("timestamp_offset", 0)
+	g.SetDefault("max_dimensions", MAX_DIMENSIONS)
+	g.SetDefault("statistic_sets", true)
+	maxRequestElapsedTime := v.GetDuration("flush-interval") // Main viper, not sub-viper
+	if maxRequestElapsedTime <= 0 {
+		maxRequestElapsedTime = defaultMaxRequestElapsedTime
+	}
+	g.SetDefault("max_request_elapsed_time", maxRequestElapsedTime)
 
 	return NewClient(
 		g.GetString("namespace"),
 		g.GetString("transport"),
+		g.GetInt("max_dimensions"),
+		g.GetBool("statistic_sets"),
+		g.GetDuration("max_request_elapsed_time"),
+		g.GetDuration("timestamp_offset"),
 		gostatsd.DisabledSubMetrics(v),
+		gostatsd.MetricMetadataFromViper(v),
 		pool,
 	)
 }
 
-// NewClient constructs a AWS Cloudwatch backend.
-func NewClient(namespace, transport string, disabled gostatsd.TimerSubtypes, pool *transport.TransportPool) (*Client, error) {
+// NewClient constructs a AWS Cloudwatch backend.  Metrics with more than maxDimensions tags have the tags which sort
+// last dropped.  Requests rejected because they were throttled are retried for up to maxRequestElapsedTime.
+func NewClient(
+	namespace,
+	transport string,
+	maxDimensions int,
+	statisticSets bool,
+	maxRequestElapsedTime time.Duration,
+	timestampOffset time.Duration,
+	disabled gostatsd.TimerSubtypes,
+	metadata gostatsd.MetadataRules,
+	pool *transport.TransportPool,
+) (*Client, error) {
+	if maxDimensions < 0 || maxDimensions > MAX_DIMENSIONS {
+		return nil, fmt.Errorf("[%s] max_dimensions must be between 0 and %d", BackendName, MAX_DIMENSIONS)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] max_request_elapsed_time must be positive", BackendName)
+	}
 	httpClient, err := pool.Get(transport)
 	if err != nil {
 		return nil, err
@@ -63,12 +116,40 @@ func NewClient(namespace, transport string, disabled gostatsd.TimerSubtypes, poo
 	return &Client{
 		cloudwatch: cloudwatch.New(sess),
 
-		namespace:        namespace,
-		disabledSubtypes: disabled,
+		namespace:             namespace,
+		maxDimensions:         maxDimensions,
+		statisticSets:         statisticSets,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		timestampOffset:       timestampOffset,
+		disabledSubtypes:      disabled,
+		metadata:              metadata,
 	}, nil
 }
 
-func extractDimensions(tags gostatsd.Tags) (dimensions []*cloudwatch.Dimension) {
+// Run emits the lifetime number of batches in each state.
+func (client *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&client.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&client.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&client.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&client.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&client.batchesThrottled)), nil)
+		}
+	}
+}
+
+// extractDimensions converts tags to dimensions.  If there are more than maxDimensions, the dimensions are sorted by
+// name and value and the last are dropped, so the same tags always produce the same dimensions.
+func extractDimensions(tags gostatsd.Tags, maxDimensions int) (dimensions []*cloudwatch.Dimension) {
 	dimensions = []*cloudwatch.Dimension{}
 
 	for _, tag := range tags {
@@ -89,23 +170,29 @@ func extractDimensions(tags gostatsd.Tags) (dimensions []*cloudwatch.Dimension)
 
 	// Check that there are not too many dimensions
 	dimensionCount := len(dimensions)
-	if dimensionCount > MAX_DIMENSIONS {
-		log.Warnf("[%s] Too many dimensions (%d) specified, truncating to %d", BackendName, dimensionCount, MAX_DIMENSIONS)
-		return dimensions[:MAX_DIMENSIONS]
+	if dimensionCount > maxDimensions {
+		log.Warnf("[%s] Too many dimensions (%d) specified, truncating to %d", BackendName, dimensionCount, maxDimensions)
+		sort.Slice(dimensions, func(i, j int) bool {
+			if *dimensions[i].Name != *dimensions[j].Name {
+				return *dimensions[i].Name < *dimensions[j].Name
+			}
+			return *dimensions[i].Value < *dimensions[j].Value
+		})
+		return dimensions[:maxDimensions]
 	}
 
 	return dimensions
 }
 
-func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []*cloudwatch.MetricDatum) {
+func (client *Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []*cloudwatch.MetricDatum) {
 	disabled := client.disabledSubtypes
 
 	metricData = []*cloudwatch.MetricDatum{}
-	now := time.Now()
+	now := time.Now().Add(client.timestampOffset)
 	prefix := ""
 
 	addMetricData := func(key string, unit string, value float64, tags gostatsd.Tags) {
-		dimensions := extractDimensions(tags)
+		dimensions := extractDimensions(tags, client.maxDimensions)
 		key = prefix + key
 
 		metricData = append(metricData, &cloudwatch.MetricDatum{
@@ -125,6 +212,23 @@ func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []
 
 	prefix = "stats.timers."
 	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		if client.statisticSets && len(timer.Values) > 0 {
+			// The StatisticSet is of the sampled values, as CloudWatch can't scale the count by the sample rate.
+			name := prefix + key
+			unit := "Milliseconds"
+			metricData = append(metricData, &cloudwatch.MetricDatum{
+				MetricName: &name,
+				Timestamp:  &now,
+				Unit:       &unit,
+				StatisticValues: &cloudwatch.StatisticSet{
+					Minimum:     aws.Float64(timer.Min),
+					Maximum:     aws.Float64(timer.Max),
+					Sum:         aws.Float64(timer.Sum),
+					SampleCount: aws.Float64(float64(len(timer.Values))),
+				},
+				Dimensions: extractDimensions(timer.Tags, client.maxDimensions),
+			})
+		}
 		if !disabled.Lower {
 			addMetricData(key+".lower", "Milliseconds", timer.Min, timer.Tags)
 		}
@@ -155,25 +259,56 @@ func (client Client) buildMetricData(metrics *gostatsd.MetricMap) (metricData []
 		for _, pct := range timer.Percentiles {
 			addMetricData(key+"."+pct.Str, "Milliseconds", pct.Float, timer.Tags)
 		}
+		for _, bucket := range timer.Histogram {
+			addMetricData(key+"."+bucket.Name, "Count", float64(bucket.Count), timer.Tags)
+		}
 	})
 
 	prefix = "stats.gauge."
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		addMetricData(key, "None", gauge.Value, gauge.Tags)
+		addMetricData(key, client.unitFor(key), gauge.Value, gauge.Tags)
 	})
 
 	prefix = "stats.set."
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
-		addMetricData(key, "None", float64(len(set.Values)), set.Tags)
+		addMetricData(key, client.unitFor(key), float64(len(set.Values)), set.Tags)
+	})
+
+	prefix = "stats.distribution."
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		unit := client.unitFor(key)
+		if !disabled.DistributionMin {
+			addMetricData(key+".min", unit, dist.Min, dist.Tags)
+		}
+		if !disabled.DistributionMax {
+			addMetricData(key+".max", unit, dist.Max, dist.Tags)
+		}
+		if !disabled.DistributionCount {
+			addMetricData(key+".count", "Count", float64(dist.Count), dist.Tags)
+		}
+		if !disabled.DistributionSum {
+			addMetricData(key+".sum", unit, dist.Sum, dist.Tags)
+		}
+		for _, pct := range dist.Percentiles {
+			addMetricData(key+"."+pct.Str, unit, pct.Float, dist.Tags)
+		}
 	})
 
 	return metricData
 }
 
+// unitFor returns the configured unit for a gauge, set or distribution, or None if there isn't one.  Counters and
+// timers always use their own units.
+func (client *Client) unitFor(key string) string {
+	if meta, ok := client.metadata.Lookup(key); ok && meta.Unit != "" {
+		return meta.Unit
+	}
+	return "None"
+}
+
 // SendMetricsAsync sends the metrics in a MetricsMap to AWS Cloudwatch,
 // preparing payload synchronously but doing the send asynchronously.
-func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
-	api := client.cloudwatch
+func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
 	metricData := client.buildMetricData(metrics)
 	length := len(metricData)
 	errors := []error{}
@@ -184,40 +319,65 @@ func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.Met
 	}
 
 	go func() {
-		start := 0
-
 		// Send metrics in batches of 20
 		// We are not allowed to add more to a single PutMetricData request
 		// https://docs.aws.amazon.com/AmazonCloudWatch/latest/monitoring/cloudwatch_limits.html
-		for start < length {
-			end := start + 20
-
+		for start := 0; start < length; start += maxMetricDataPerRequest {
+			end := start + maxMetricDataPerRequest
 			if end > length {
 				end = length
 			}
+			atomic.AddUint64(&client.batchesCreated, 1)
+			errors = append(errors, client.putMetricData(ctx, metricData[start:end]))
+		}
 
-			if start >= end {
-				// No more metrics to sent
-				break
-			}
+		cb(errors)
+	}()
+}
 
-			data := metricData[start:end]
-			start = end
+// putMetricData sends a batch of metric data, retrying with backoff while CloudWatch is throttling requests, for up
+// to maxRequestElapsedTime.  Other errors are not retried.
+func (client *Client) putMetricData(ctx context.Context, data []*cloudwatch.MetricDatum) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = client.maxRequestElapsedTime
+	for {
+		_, err := client.cloudwatch.PutMetricDataWithContext(ctx, &cloudwatch.PutMetricDataInput{
+			MetricData: data,
+			Namespace:  &client.namespace,
+		})
+		if err == nil {
+			atomic.AddUint64(&client.batchesSent, 1)
+			return nil
+		}
+		if !request.IsErrorThrottle(err) {
+			atomic.AddUint64(&client.batchesDropped, 1)
+			return err
+		}
 
-			_, err := api.PutMetricData(&cloudwatch.PutMetricDataInput{
-				MetricData: data,
-				Namespace:  &client.namespace,
-			})
+		atomic.AddUint64(&client.batchesThrottled, 1)
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			atomic.AddUint64(&client.batchesDropped, 1)
+			return fmt.Errorf("[%s] %w", BackendName, err)
+		}
+
+		log.Warnf("[%s] throttled sending metrics, sleeping for %s: %v", BackendName, next, err)
 
-			errors = append(errors, err)
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&client.batchesDropped, 1)
+			return ctx.Err()
+		case <-timer.C:
 		}
 
-		cb(errors)
-	}()
+		atomic.AddUint64(&client.batchesRetried, 1)
+	}
 }
 
 // Events currently not supported.
-func (client Client) SendEvent(ctx context.Context, e *gostatsd.Event) (retErr error) {
+func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) (retErr error) {
 	return nil
 }
 
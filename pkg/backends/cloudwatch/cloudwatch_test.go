@@ -2,7 +2,10 @@ package cloudwatch
 
 import (
 	"context"
+	"fmt"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -10,6 +13,9 @@ import (
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/transport"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
 
@@ -23,7 +29,7 @@ type mockedCloudwatch struct {
 	PutMetricDataHandler func(*cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error)
 }
 
-func (m *mockedCloudwatch) PutMetricData(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+func (m *mockedCloudwatch) PutMetricDataWithContext(ctx aws.Context, input *cloudwatch.PutMetricDataInput, opts ...request.Option) (*cloudwatch.PutMetricDataOutput, error) {
 	return m.PutMetricDataHandler(input)
 }
 
@@ -31,7 +37,7 @@ func TestSendMetrics(t *testing.T) {
 	t.Parallel()
 
 	p := transport.NewTransportPool(logrus.New(), viper.New())
-	cli, err := NewClient("ns", "default", gostatsd.TimerSubtypes{}, p)
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, false, time.Second, 0, gostatsd.TimerSubtypes{}, nil, p)
 	require.NoError(t, err)
 
 	expected := []struct {
@@ -88,7 +94,7 @@ func TestSendMetricDimensions(t *testing.T) {
 	t.Parallel()
 
 	p := transport.NewTransportPool(logrus.New(), viper.New())
-	cli, err := NewClient("ns", "default", gostatsd.TimerSubtypes{}, p)
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, false, time.Second, 0, gostatsd.TimerSubtypes{}, nil, p)
 	require.NoError(t, err)
 
 	metricMap := &gostatsd.MetricMap{
@@ -189,3 +195,178 @@ func metricsOneOfEach() *gostatsd.MetricMap {
 		},
 	}
 }
+
+func TestBuildMetricDataUnits(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	metadata := gostatsd.MetadataRules{
+		{Match: gostatsd.StringMatchList{gostatsd.NewStringMatch("queue.*")}, MetricMetadata: gostatsd.MetricMetadata{Unit: "Bytes"}},
+	}
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, false, time.Second, 0, gostatsd.TimerSubtypes{}, metadata, p)
+	require.NoError(t, err)
+
+	metricMap := gostatsd.NewMetricMap()
+	metricMap.Gauges["queue.size"] = map[string]gostatsd.Gauge{"": {Value: 10}}
+	metricMap.Gauges["other"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+
+	units := map[string]string{}
+	for _, datum := range cli.buildMetricData(metricMap) {
+		units[*datum.MetricName] = *datum.Unit
+	}
+	assert.Equal(t, map[string]string{
+		"stats.gauge.queue.size": "Bytes",
+		"stats.gauge.other":      "None",
+	}, units)
+}
+
+func TestBuildMetricDataTimerHistogram(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	disabled := gostatsd.TimerSubtypes{Lower: true, Upper: true, Count: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true}
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, false, time.Second, 0, disabled, nil, p)
+	require.NoError(t, err)
+
+	metricMap := gostatsd.NewMetricMap()
+	metricMap.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count:       3,
+		Percentiles: gostatsd.Percentiles{{Str: "upper_90", Float: 12.5}},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+
+	units := map[string]string{}
+	values := map[string]float64{}
+	for _, datum := range cli.buildMetricData(metricMap) {
+		units[*datum.MetricName] = *datum.Unit
+		values[*datum.MetricName] = *datum.Value
+	}
+	assert.Equal(t, map[string]string{
+		"stats.timers.t1.upper_90":         "Milliseconds",
+		"stats.timers.t1.histogram.le_10":  "Count",
+		"stats.timers.t1.histogram.le_inf": "Count",
+	}, units)
+	assert.Equal(t, map[string]float64{
+		"stats.timers.t1.upper_90":         12.5,
+		"stats.timers.t1.histogram.le_10":  2,
+		"stats.timers.t1.histogram.le_inf": 3,
+	}, values)
+}
+
+func TestBuildMetricDataStatisticSets(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, true, time.Second, 0, gostatsd.TimerSubtypes{}, nil, p)
+	require.NoError(t, err)
+
+	var statisticSets []*cloudwatch.MetricDatum
+	for _, datum := range cli.buildMetricData(metricsOneOfEach()) {
+		if datum.StatisticValues != nil {
+			statisticSets = append(statisticSets, datum)
+		}
+	}
+	require.Len(t, statisticSets, 1)
+	assert.Equal(t, "stats.timers.t1", *statisticSets[0].MetricName)
+	assert.Equal(t, "Milliseconds", *statisticSets[0].Unit)
+	assert.Nil(t, statisticSets[0].Value)
+	assert.Equal(t, &cloudwatch.StatisticSet{
+		Minimum:     aws.Float64(0),
+		Maximum:     aws.Float64(1),
+		Sum:         aws.Float64(1),
+		SampleCount: aws.Float64(2),
+	}, statisticSets[0].StatisticValues)
+	require.NoError(t, statisticSets[0].Validate())
+}
+
+func TestExtractDimensionsTruncatesDeterministically(t *testing.T) {
+	t.Parallel()
+
+	names := func(dimensions []*cloudwatch.Dimension) []string {
+		var result []string
+		for _, d := range dimensions {
+			result = append(result, *d.Name+":"+*d.Value)
+		}
+		return result
+	}
+	expected := []string{"a:1", "b:3", "b:4"}
+	assert.Equal(t, expected, names(extractDimensions(gostatsd.Tags{"d:1", "b:4", "c:1", "a:1", "b:3"}, 3)))
+	assert.Equal(t, expected, names(extractDimensions(gostatsd.Tags{"b:3", "a:1", "c:1", "b:4", "d:1"}, 3)))
+	// Tags within the limit keep their order
+	assert.Equal(t, []string{"b:1", "a:set"}, names(extractDimensions(gostatsd.Tags{"b:1", "a"}, 3)))
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	_, err := NewClient("ns", "default", MAX_DIMENSIONS+1, false, time.Second, 0, gostatsd.TimerSubtypes{}, nil, p)
+	assert.Error(t, err)
+}
+
+func TestSendMetricsBatchesAndRetriesThrottling(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, false, time.Second, 0, gostatsd.TimerSubtypes{}, nil, p)
+	require.NoError(t, err)
+
+	metricMap := gostatsd.NewMetricMap()
+	for i := 0; i < 25; i++ {
+		metricMap.Gauges[fmt.Sprintf("g%d", i)] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	}
+
+	var batches []int
+	calls := 0
+	cli.cloudwatch = &mockedCloudwatch{
+		PutMetricDataHandler: func(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+			calls++
+			if calls == 1 {
+				return nil, awserr.New("Throttling", "Rate exceeded", nil)
+			}
+			batches = append(batches, len(input.MetricData))
+			return &cloudwatch.PutMetricDataOutput{}, nil
+		},
+	}
+
+	res := make(chan []error, 1)
+	cli.SendMetricsAsync(context.Background(), metricMap, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []int{20, 5}, batches)
+	assert.EqualValues(t, 2, cli.batchesCreated)
+	assert.EqualValues(t, 1, cli.batchesThrottled)
+	assert.EqualValues(t, 1, cli.batchesRetried)
+	assert.EqualValues(t, 2, cli.batchesSent)
+	assert.EqualValues(t, 0, cli.batchesDropped)
+}
+
+func TestSendMetricsDoesNotRetryOtherErrors(t *testing.T) {
+	t.Parallel()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("ns", "default", MAX_DIMENSIONS, false, time.Second, 0, gostatsd.TimerSubtypes{}, nil, p)
+	require.NoError(t, err)
+
+	calls := 0
+	cli.cloudwatch = &mockedCloudwatch{
+		PutMetricDataHandler: func(input *cloudwatch.PutMetricDataInput) (*cloudwatch.PutMetricDataOutput, error) {
+			calls++
+			return nil, awserr.New("InvalidParameterValue", "bad", nil)
+		},
+	}
+
+	res := make(chan []error, 1)
+	cli.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+	assert.Equal(t, 1, calls)
+	assert.EqualValues(t, 1, cli.batchesDropped)
+}
@@ -0,0 +1,86 @@
+package cumulative
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultTTL is how long the total of a counter is kept after it was last flushed, so a counter which is received
+// again within it continues from its previous total.
+const DefaultTTL = 1 * time.Hour
+
+// Total is the running total of a counter.
+type Total struct {
+	Value int64     // Sum of every value flushed since Start
+	Start time.Time // When the total started counting from zero
+
+	lastSeen time.Time
+}
+
+// Counters keeps the running totals of counters across flushes, for backends whose consumers expect monotonic
+// counters rather than the value for each flush interval.  A total restarts from zero with a new start time if the
+// counter isn't flushed for the TTL, which consumers see as a counter reset.  Negative counter values decrease the
+// total, which consumers will also see as a reset.
+type Counters struct {
+	ttl time.Duration
+
+	mu     sync.Mutex
+	totals map[string]map[string]*Total // Keyed by name, then tags key, like gostatsd.Counters
+}
+
+// NewCounters creates a new Counters which forgets totals that aren't updated for ttl.
+func NewCounters(ttl time.Duration) *Counters {
+	return &Counters{
+		ttl:    ttl,
+		totals: map[string]map[string]*Total{},
+	}
+}
+
+// Add adds value to the total of the counter identified by name and tagsKey, and returns the new total.
+func (c *Counters) Add(name, tagsKey string, value int64, now time.Time) Total {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	byTags, ok := c.totals[name]
+	if !ok {
+		byTags = map[string]*Total{}
+		c.totals[name] = byTags
+	}
+	total, ok := byTags[tagsKey]
+	if !ok || now.Sub(total.lastSeen) > c.ttl {
+		total = &Total{Start: now}
+		byTags[tagsKey] = total
+	}
+	total.Value += value
+	total.lastSeen = now
+	return *total
+}
+
+// Expire forgets the totals which haven't been updated for the TTL.
+func (c *Counters) Expire(now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for name, byTags := range c.totals {
+		for tagsKey, total := range byTags {
+			if now.Sub(total.lastSeen) > c.ttl {
+				delete(byTags, tagsKey)
+			}
+		}
+		if len(byTags) == 0 {
+			delete(c.totals, name)
+		}
+	}
+}
+
+// Len returns the number of totals being kept.
+func (c *Counters) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for _, byTags := range c.totals {
+		n += len(byTags)
+	}
+	return n
+}
@@ -0,0 +1,47 @@
+package cumulative
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCountersAdd(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0)
+	c := NewCounters(time.Minute)
+
+	assert.Equal(t, Total{Value: 5, Start: start, lastSeen: start}, c.Add("a", "", 5, start))
+	now := start.Add(10 * time.Second)
+	assert.Equal(t, Total{Value: 8, Start: start, lastSeen: now}, c.Add("a", "", 3, now))
+
+	// Each tags key has its own total
+	assert.EqualValues(t, 1, c.Add("a", "x:y", 1, now).Value)
+	assert.EqualValues(t, 2, c.Add("b", "", 2, now).Value)
+	assert.Equal(t, 3, c.Len())
+
+	// Restarts once the TTL has passed
+	later := now.Add(2 * time.Minute)
+	assert.Equal(t, Total{Value: 4, Start: later, lastSeen: later}, c.Add("a", "", 4, later))
+}
+
+func TestCountersExpire(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0)
+	c := NewCounters(time.Minute)
+
+	c.Add("a", "", 1, start)
+	c.Add("a", "x:y", 1, start.Add(30*time.Second))
+	c.Add("b", "", 1, start)
+
+	c.Expire(start.Add(time.Minute))
+	assert.Equal(t, 3, c.Len())
+
+	c.Expire(start.Add(time.Minute + time.Second))
+	assert.Equal(t, 1, c.Len())
+	assert.EqualValues(t, 2, c.Add("a", "x:y", 1, start.Add(time.Minute+time.Second)).Value)
+
+	c.Expire(start.Add(time.Hour))
+	assert.Zero(t, c.Len())
+}
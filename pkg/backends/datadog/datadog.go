@@ -11,6 +11,7 @@ import (
 	"net/url"
 	"runtime"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -37,6 +38,11 @@ const (
 	// maxResponseSize is the maximum response size we are willing to read.
 	maxResponseSize     = 10 * 1024
 	maxConcurrentEvents = 20
+
+	// apiVersionV1 is the version 1 series API, with metrics in the payload format of the Datadog Agent v5.
+	apiVersionV1 = "v1"
+	// apiVersionV2 is the version 2 series API.
+	apiVersionV2 = "v2"
 )
 
 var (
@@ -53,13 +59,15 @@ var (
 
 // Client represents a Datadog client.
 type Client struct {
-	batchesCreated uint64 // Accumulated number of batches created
-	batchesRetried uint64 // Accumulated number of batches retried (first send is not a retry)
-	batchesDropped uint64 // Accumulated number of batches aborted (data loss)
-	batchesSent    uint64 // Accumulated number of batches successfully sent
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
 
 	apiKey                string
 	apiEndpoint           string
+	apiVersion            string
 	userAgent             string
 	maxRequestElapsedTime time.Duration
 	client                *http.Client
@@ -68,6 +76,8 @@ type Client struct {
 	eventsBufferSem       chan *bytes.Buffer // Two in one - a semaphore and a buffer pool
 	now                   func() time.Time   // Returns current time. Useful for testing.
 	compressPayload       bool
+	gaugeTimestamps       bool          // Send gauges with the time they were last updated, rather than the flush time
+	timestampOffset       time.Duration // Added to every timestamp sent, to compensate for clock skew
 
 	disabledSubtypes gostatsd.TimerSubtypes
 	flushInterval    time.Duration
@@ -145,6 +155,7 @@ func (d *Client) Run(ctx context.Context) {
 			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&d.batchesRetried)), nil)
 			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&d.batchesDropped)), nil)
 			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&d.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&d.batchesThrottled)), nil)
 		}
 	}
 }
@@ -154,7 +165,7 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 		ts: &timeSeries{
 			Series: make([]metric, 0, d.metricsPerBatch),
 		},
-		timestamp:        float64(d.now().Unix()),
+		timestamp:        float64(d.now().Add(d.timestampOffset).Unix()),
 		flushIntervalSec: d.flushInterval.Seconds(),
 		metricsPerBatch:  d.metricsPerBatch,
 		cb:               cb,
@@ -197,11 +208,37 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 		for _, pct := range timer.Percentiles {
 			fl.addMetricf(gauge, pct.Float, timer.Hostname, timer.Tags, "%s.%s", key, pct.Str)
 		}
+		for _, bucket := range timer.Histogram {
+			fl.addMetricf(gauge, float64(bucket.Count), timer.Hostname, timer.Tags, "%s.%s", key, bucket.Name)
+		}
+		fl.maybeFlush()
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		if !d.disabledSubtypes.DistributionMin {
+			fl.addMetricf(gauge, dist.Min, dist.Hostname, dist.Tags, "%s.min", key)
+		}
+		if !d.disabledSubtypes.DistributionMax {
+			fl.addMetricf(gauge, dist.Max, dist.Hostname, dist.Tags, "%s.max", key)
+		}
+		if !d.disabledSubtypes.DistributionCount {
+			fl.addMetricf(gauge, float64(dist.Count), dist.Hostname, dist.Tags, "%s.count", key)
+		}
+		if !d.disabledSubtypes.DistributionSum {
+			fl.addMetricf(gauge, dist.Sum, dist.Hostname, dist.Tags, "%s.sum", key)
+		}
+		for _, pct := range dist.Percentiles {
+			fl.addMetricf(gauge, pct.Float, dist.Hostname, dist.Tags, "%s.%s", key, pct.Str)
+		}
 		fl.maybeFlush()
 	})
 
 	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
-		fl.addMetric(gauge, g.Value, g.Hostname, g.Tags, key)
+		if d.gaugeTimestamps && g.Timestamp != 0 {
+			fl.addMetricAt(gauge, g.Value, float64((int64(g.Timestamp)+int64(d.timestampOffset))/int64(time.Second)), g.Hostname, g.Tags, key)
+		} else {
+			fl.addMetric(gauge, g.Value, g.Hostname, g.Tags, key)
+		}
 		fl.maybeFlush()
 	})
 
@@ -214,6 +251,9 @@ func (d *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 }
 
 func (d *Client) postMetrics(ctx context.Context, buffer *bytes.Buffer, ts *timeSeries) error {
+	if d.apiVersion == apiVersionV2 {
+		return d.post(ctx, buffer, "/api/v2/series", "metrics", ts.toV2())
+	}
 	return d.post(ctx, buffer, "/api/v1/series", "metrics", ts)
 }
 
@@ -261,10 +301,13 @@ func (d *Client) post(ctx context.Context, buffer *bytes.Buffer, path, typeOfPos
 			return nil
 		}
 
-		next := b.NextBackOff()
+		next, throttled := util.NextRetry(b, err)
+		if throttled {
+			atomic.AddUint64(&d.batchesThrottled, 1)
+		}
 		if next == backoff.Stop {
 			atomic.AddUint64(&d.batchesDropped, 1)
-			return fmt.Errorf("[%s] %v", BackendName, err)
+			return fmt.Errorf("[%s] %w", BackendName, err)
 		}
 
 		log.Warnf("[%s] failed to send %s, sleeping for %s: %v", BackendName, typeOfPost, next, err)
@@ -322,14 +365,14 @@ func (d *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, path,
 		}
 		resp, err := d.client.Do(req)
 		if err != nil {
-			return fmt.Errorf("error POSTing: %s", strings.Replace(err.Error(), d.apiKey, "*****", -1))
+			return fmt.Errorf("error POSTing: %w", &redactedError{err: err, secret: d.apiKey})
 		}
 		defer resp.Body.Close()
 		body := io.LimitReader(resp.Body, maxResponseSize)
 		if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
 			b, _ := ioutil.ReadAll(body)
 			log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			return util.NewStatusError(resp)
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
 		return nil
@@ -353,17 +396,23 @@ func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd
 	dd.SetDefault("max_requests", defaultMaxRequests)
 	dd.SetDefault("user-agent", defaultUserAgent)
 	dd.SetDefault("transport", "default")
+	dd.SetDefault("api_version", apiVersionV1)
+	dd.SetDefault("gauge_timestamps", false)
+	dd.SetDefault("timestamp_offset", 0)
 
 	return NewClient(
 		dd.GetString("api_endpoint"),
 		dd.GetString("api_key"),
 		dd.GetString("user-agent"),
 		dd.GetString("transport"),
+		dd.GetString("api_version"),
 		dd.GetInt("metrics_per_batch"),
 		uint(dd.GetInt("max_requests")),
 		dd.GetBool("compress_payload"),
+		dd.GetBool("gauge_timestamps"),
 		dd.GetDuration("max_request_elapsed_time"),
 		v.GetDuration("flush-interval"), // Main viper, not sub-viper
+		dd.GetDuration("timestamp_offset"),
 		gostatsd.DisabledSubMetrics(v),
 		pool,
 	)
@@ -374,12 +423,15 @@ func NewClient(
 	apiEndpoint,
 	apiKey,
 	userAgent,
-	transport string,
+	transport,
+	apiVersion string,
 	metricsPerBatch int,
 	maxRequests uint,
-	compressPayload bool,
+	compressPayload,
+	gaugeTimestamps bool,
 	maxRequestElapsedTime,
-	flushInterval time.Duration,
+	flushInterval,
+	timestampOffset time.Duration,
 	disabled gostatsd.TimerSubtypes,
 	pool *transport.TransportPool,
 ) (*Client, error) {
@@ -392,6 +444,9 @@ func NewClient(
 	if userAgent == "" {
 		return nil, fmt.Errorf("[%s] user-agent is required", BackendName)
 	}
+	if apiVersion != apiVersionV1 && apiVersion != apiVersionV2 {
+		return nil, fmt.Errorf("[%s] apiVersion must be one of '%s' or '%s'", BackendName, apiVersionV1, apiVersionV2)
+	}
 	if metricsPerBatch <= 0 {
 		return nil, fmt.Errorf("[%s] metricsPerBatch must be positive", BackendName)
 	}
@@ -410,6 +465,9 @@ func NewClient(
 		"max-requests":             maxRequests,
 		"metrics-per-batch":        metricsPerBatch,
 		"compress-payload":         compressPayload,
+		"api-version":              apiVersion,
+		"gauge-timestamps":         gaugeTimestamps,
+		"timestamp-offset":         timestampOffset,
 	}).Info("created backend")
 
 	metricsBufferSem := make(chan *bytes.Buffer, maxRequests)
@@ -423,6 +481,7 @@ func NewClient(
 	return &Client{
 		apiKey:                apiKey,
 		apiEndpoint:           apiEndpoint,
+		apiVersion:            apiVersion,
 		userAgent:             userAgent,
 		maxRequestElapsedTime: maxRequestElapsedTime,
 		client:                httpClient.Client,
@@ -430,18 +489,41 @@ func NewClient(
 		metricsBufferSem:      metricsBufferSem,
 		eventsBufferSem:       eventsBufferSem,
 		compressPayload:       compressPayload,
+		gaugeTimestamps:       gaugeTimestamps,
+		timestampOffset:       timestampOffset,
 		now:                   time.Now,
 		flushInterval:         flushInterval,
 		disabledSubtypes:      disabled,
 	}, nil
 }
 
+// compressorPool holds zlib writers for reuse, as each allocates large internal buffers.
+var compressorPool = sync.Pool{
+	New: func() interface{} {
+		compressor, _ := zlib.NewWriterLevel(nil, zlib.BestCompression) // Only fails for an invalid level
+		return compressor
+	},
+}
+
+// redactedError hides a secret, such as the API key in the URL of a failed request, from the message of an error.
+type redactedError struct {
+	err    error
+	secret string
+}
+
+func (e *redactedError) Error() string {
+	return strings.Replace(e.err.Error(), e.secret, "*****", -1)
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
 func deflate(w io.Writer, f func(io.Writer) error) error {
-	compressor, err := zlib.NewWriterLevel(w, zlib.BestCompression)
-	if err != nil {
-		return fmt.Errorf("unable to create zlib writer: %v", err)
-	}
-	err = f(compressor)
+	compressor := compressorPool.Get().(*zlib.Writer)
+	defer compressorPool.Put(compressor)
+	compressor.Reset(w)
+	err := f(compressor)
 	if err != nil {
 		return fmt.Errorf("unable to write compressed payload: %v", err)
 	}
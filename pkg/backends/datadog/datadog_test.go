@@ -5,8 +5,10 @@ import (
 	"compress/zlib"
 	"context"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
@@ -44,7 +46,7 @@ func TestRetries(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", defaultMetricsPerBatch, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", "v1", defaultMetricsPerBatch, defaultMaxRequests, true, false, 2*time.Second, 1*time.Second, 0, gostatsd.TimerSubtypes{}, p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
@@ -76,7 +78,7 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1, defaultMaxRequests, true, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, p)
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", "v1", 1, defaultMaxRequests, true, false, 2*time.Second, 1*time.Second, 0, gostatsd.TimerSubtypes{}, p)
 	require.NoError(t, err)
 	res := make(chan []error, 1)
 	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
@@ -89,6 +91,38 @@ func TestSendMetricsInMultipleBatches(t *testing.T) {
 	assert.EqualValues(t, 2, requestNum)
 }
 
+func TestSendMetricsThrottled(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/series", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = ioutil.ReadAll(r.Body)
+		if atomic.AddUint32(&requestNum, 1) == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	client, err := NewClient(ts.URL, "apiKey123", "agent", "default", "v1", defaultMetricsPerBatch, defaultMaxRequests, true, false, 5*time.Second, 1*time.Second, 0, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	start := time.Now()
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), twoCounters(), func(errs []error) {
+		res <- errs
+	})
+	for _, err := range <-res {
+		assert.NoError(t, err)
+	}
+	// The retry waits for Retry-After, rather than the shorter backoff
+	assert.True(t, time.Since(start) >= time.Second)
+	assert.EqualValues(t, 2, atomic.LoadUint32(&requestNum))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesThrottled))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesRetried))
+}
+
 func TestSendMetrics(t *testing.T) {
 	t.Parallel()
 	mux := http.NewServeMux()
@@ -129,7 +163,7 @@ func TestSendMetrics(t *testing.T) {
 	v := viper.New()
 	v.Set("transport.default.client-timeout", 1*time.Second)
 	p := transport.NewTransportPool(logrus.New(), v)
-	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", 1000, defaultMaxRequests, true, 2*time.Second, 1100*time.Millisecond, gostatsd.TimerSubtypes{}, p)
+	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", "v1", 1000, defaultMaxRequests, true, false, 2*time.Second, 1100*time.Millisecond, 0, gostatsd.TimerSubtypes{}, p)
 	require.NoError(t, err)
 	cli.now = func() time.Time {
 		return time.Unix(100, 0)
@@ -144,7 +178,146 @@ func TestSendMetrics(t *testing.T) {
 	}
 }
 
+func TestSendMetricsV2(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/series", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		expected := `{"series":[` +
+			`{"metric":"c1","type":2,"interval":1,"points":[{"timestamp":100,"value":1.1}],"tags":["tag1"],"resources":[{"name":"h1","type":"host"}]},` +
+			`{"metric":"c1.count","type":3,"interval":1,"points":[{"timestamp":100,"value":5}],"tags":["tag1"],"resources":[{"name":"h1","type":"host"}]},` +
+			`{"metric":"g1","type":3,"interval":1,"points":[{"timestamp":100,"value":3}],"tags":["tag3"],"resources":[{"name":"h3","type":"host"}]}]}`
+		assert.Equal(t, expected, string(data))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+	cli, err := NewClient(ts.URL, "apiKey123", "agent", "default", "v2", 1000, defaultMaxRequests, false, false, 2*time.Second, 1100*time.Millisecond, 0, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	cli.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	mm := metricsOneOfEach()
+	mm.Timers = gostatsd.Timers{}
+	mm.Sets = gostatsd.Sets{}
+	res := make(chan []error, 1)
+	cli.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 1)
+	assert.NoError(t, errs[0])
+}
+
+func TestNewClientAPIVersion(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	_, err := NewClient("http://localhost", "apiKey123", "agent", "default", "v3", 1000, defaultMaxRequests, false, false, 2*time.Second, time.Second, 0, gostatsd.TimerSubtypes{}, p)
+	require.Error(t, err)
+}
+
+func TestGaugeTimestamps(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("http://localhost", "apiKey123", "agent", "default", "v1", 1000, defaultMaxRequests, false, true, 2*time.Second, time.Second, 0, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	cli.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {Value: 5, Timestamp: gostatsd.Nanotime(time.Unix(80, 0).UnixNano())},
+	}
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Timestamp: gostatsd.Nanotime(time.Unix(90, 500).UnixNano())},
+	}
+	mm.Gauges["g2"] = map[string]gostatsd.Gauge{
+		"": {Value: 4}, // No timestamp, so the flush time is used
+	}
+
+	timestamps := map[string]float64{}
+	cli.processMetrics(mm, func(ts *timeSeries) {
+		for _, m := range ts.Series {
+			timestamps[m.Metric] = m.Points[0][0]
+		}
+	})
+	expected := map[string]float64{
+		"c1":       100,
+		"c1.count": 100,
+		"g1":       90,
+		"g2":       100,
+	}
+	assert.Equal(t, expected, timestamps)
+}
+
+func TestTimestampOffset(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("http://localhost", "apiKey123", "agent", "default", "v1", 1000, defaultMaxRequests, false, true, 2*time.Second, time.Second, 5*time.Second, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	cli.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {Value: 5},
+	}
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Timestamp: gostatsd.Nanotime(time.Unix(90, 500).UnixNano())},
+	}
+
+	timestamps := map[string]float64{}
+	cli.processMetrics(mm, func(ts *timeSeries) {
+		for _, m := range ts.Series {
+			timestamps[m.Metric] = m.Points[0][0]
+		}
+	})
+	expected := map[string]float64{
+		"c1":       105,
+		"c1.count": 105,
+		"g1":       95,
+	}
+	assert.Equal(t, expected, timestamps)
+}
+
 // twoCounters returns two counters.
+func TestTimerHistogram(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cli, err := NewClient("http://localhost", "apiKey123", "agent", "default", "v1", 1000, defaultMaxRequests, false, false, 2*time.Second, time.Second, 0, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"": {
+			Count: 3,
+			Histogram: []gostatsd.HistogramBucket{
+				{Name: "histogram.le_10", Bound: 10, Count: 2},
+				{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+			},
+		},
+	}
+
+	buckets := map[string]metric{}
+	cli.processMetrics(mm, func(ts *timeSeries) {
+		for _, m := range ts.Series {
+			if strings.HasPrefix(m.Metric, "t1.histogram.") {
+				buckets[m.Metric] = m
+			}
+		}
+	})
+	require.Len(t, buckets, 2)
+	assert.Equal(t, gauge, buckets["t1.histogram.le_10"].Type)
+	assert.EqualValues(t, 2, buckets["t1.histogram.le_10"].Points[0][1])
+	assert.Equal(t, gauge, buckets["t1.histogram.le_inf"].Type)
+	assert.EqualValues(t, 3, buckets["t1.histogram.le_inf"].Points[0][1])
+}
+
 func twoCounters() *gostatsd.MetricMap {
 	return &gostatsd.MetricMap{
 		Counters: gostatsd.Counters{
@@ -2,6 +2,7 @@ package datadog
 
 import (
 	"fmt"
+	"math"
 
 	"github.com/atlassian/gostatsd"
 )
@@ -42,6 +43,65 @@ type metric struct {
 // point is a Datadog data point.
 type point [2]float64
 
+// timeSeriesV2 represents a time series data structure for version 2 of the series API.
+type timeSeriesV2 struct {
+	Series []metricV2 `json:"series"`
+}
+
+// metricV2 represents a metric data structure for version 2 of the series API.
+type metricV2 struct {
+	Metric    string       `json:"metric"`
+	Type      metricTypeV2 `json:"type"`
+	Interval  int64        `json:"interval,omitempty"`
+	Points    [1]pointV2   `json:"points"`
+	Tags      []string     `json:"tags,omitempty"`
+	Resources []resourceV2 `json:"resources,omitempty"`
+}
+
+// metricTypeV2 is the numeric metric type of version 2 of the series API.
+type metricTypeV2 int
+
+const (
+	rateV2  metricTypeV2 = 2
+	gaugeV2 metricTypeV2 = 3
+)
+
+// pointV2 is a Datadog data point for version 2 of the series API.
+type pointV2 struct {
+	Timestamp int64   `json:"timestamp"`
+	Value     float64 `json:"value"`
+}
+
+// resourceV2 is a resource a metric is associated with, such as its host.
+type resourceV2 struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+// toV2 converts the series to the format of version 2 of the series API.  The interval is rounded to whole seconds.
+func (ts *timeSeries) toV2() *timeSeriesV2 {
+	tsV2 := &timeSeriesV2{
+		Series: make([]metricV2, 0, len(ts.Series)),
+	}
+	for _, m := range ts.Series {
+		mV2 := metricV2{
+			Metric:   m.Metric,
+			Type:     gaugeV2,
+			Interval: int64(math.Round(m.Interval)),
+			Points:   [1]pointV2{{Timestamp: int64(m.Points[0][0]), Value: m.Points[0][1]}},
+			Tags:     m.Tags,
+		}
+		if m.Type == rate {
+			mV2.Type = rateV2
+		}
+		if m.Host != "" {
+			mV2.Resources = []resourceV2{{Name: m.Host, Type: "host"}}
+		}
+		tsV2.Series = append(tsV2.Series, mV2)
+	}
+	return tsV2
+}
+
 // addMetricf adds a metric to the series.
 func (f *flush) addMetricf(metricType metricType, value float64, hostname string, tags gostatsd.Tags, nameFormat string, a ...interface{}) {
 	f.addMetric(metricType, value, hostname, tags, fmt.Sprintf(nameFormat, a...))
@@ -49,11 +109,16 @@ func (f *flush) addMetricf(metricType metricType, value float64, hostname string
 
 // addMetric adds a metric to the series.
 func (f *flush) addMetric(metricType metricType, value float64, hostname string, tags gostatsd.Tags, name string) {
+	f.addMetricAt(metricType, value, f.timestamp, hostname, tags, name)
+}
+
+// addMetricAt adds a metric to the series with an explicit timestamp, in seconds.
+func (f *flush) addMetricAt(metricType metricType, value, timestamp float64, hostname string, tags gostatsd.Tags, name string) {
 	f.ts.Series = append(f.ts.Series, metric{
 		Host:     hostname,
 		Interval: f.flushIntervalSec,
 		Metric:   name,
-		Points:   [1]point{{f.timestamp, value}},
+		Points:   [1]point{{timestamp, value}},
 		Tags:     tags,
 		Type:     metricType,
 	})
@@ -0,0 +1,642 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName                  = "elasticsearch"
+	defaultUserAgent             = "gostatsd"
+	defaultIndex                 = "gostatsd-{2006.01.02}"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	// defaultMaxRequestBytes is the default maximum size of a single _bulk request body.
+	defaultMaxRequestBytes = 5 * 1024 * 1024
+	// maxResponseSize is the maximum response size we are willing to read.  Bulk responses contain an item for every
+	// document, so this is much larger than for other backends.
+	maxResponseSize = 10 * 1024 * 1024
+)
+
+var (
+	// defaultMaxRequests is the number of parallel outgoing requests to Elasticsearch.
+	defaultMaxRequests = uint(2 * runtime.NumCPU())
+)
+
+// Client represents an Elasticsearch (or OpenSearch) client, which indexes metrics via the _bulk API.
+type Client struct {
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
+	documentsIndexed uint64 // Accumulated number of documents successfully indexed
+	documentsFailed  uint64 // Accumulated number of documents rejected in a successfully sent batch (data loss)
+
+	endpoint              string
+	index                 string
+	username              string
+	password              string
+	apiKey                string
+	userAgent             string
+	maxRequestElapsedTime time.Duration
+	maxRequestBytes       int
+	client                *http.Client
+	requestSem            chan struct{}
+	bufferPool            *util.BufferPool // Request bodies, reused between flushes
+	now                   func() time.Time // Returns current time. Useful for testing.
+
+	disabledSubtypes gostatsd.TimerSubtypes
+	metadata         gostatsd.MetadataRules
+}
+
+// document is a single data point as indexed in Elasticsearch.
+type document struct {
+	Timestamp   string            `json:"@timestamp"`
+	Name        string            `json:"name"`
+	Type        string            `json:"type"`
+	Value       float64           `json:"value"`
+	Host        string            `json:"host,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Unit        string            `json:"unit,omitempty"`
+	Description string            `json:"description,omitempty"`
+}
+
+// event is an event as indexed in Elasticsearch.
+type event struct {
+	Timestamp      string            `json:"@timestamp"`
+	Type           string            `json:"type"`
+	Title          string            `json:"title"`
+	Text           string            `json:"text"`
+	Host           string            `json:"host,omitempty"`
+	AggregationKey string            `json:"aggregation_key,omitempty"`
+	SourceTypeName string            `json:"source_type_name,omitempty"`
+	Tags           map[string]string `json:"tags,omitempty"`
+	Priority       string            `json:"priority,omitempty"`
+	AlertType      string            `json:"alert_type,omitempty"`
+}
+
+// bulkResponse is the subset of the _bulk response which is used to detect partial failures.
+type bulkResponse struct {
+	Errors bool `json:"errors"`
+	Items  []map[string]struct {
+		Status int `json:"status"`
+		Error  struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	} `json:"items"`
+}
+
+// SendMetricsAsync flushes the metrics to Elasticsearch, preparing payload synchronously but doing the send
+// asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	batches := c.processMetrics(metrics)
+	if len(batches) == 0 {
+		cb(nil)
+		return
+	}
+
+	results := make(chan error)
+	for _, batch := range batches {
+		batch := batch
+		atomic.AddUint64(&c.batchesCreated, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case c.requestSem <- struct{}{}:
+				defer func() {
+					c.bufferPool.Put(batch.buf)
+					<-c.requestSem
+				}()
+				err := c.postBulk(ctx, batch)
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+	}
+	go func() {
+		errs := make([]error, 0, len(batches))
+	loop:
+		for i := 0; i < len(batches); i++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&c.batchesThrottled)), nil)
+			statser.Gauge("backend.documents_indexed", float64(atomic.LoadUint64(&c.documentsIndexed)), nil)
+			statser.Gauge("backend.documents_failed", float64(atomic.LoadUint64(&c.documentsFailed)), nil)
+		}
+	}
+}
+
+// bulkBatch is a serialized _bulk request body.
+type bulkBatch struct {
+	body      []byte
+	buf       *bytes.Buffer // Holds body, to be returned to the pool after sending
+	documents int
+}
+
+// bulkWriter serializes documents in to _bulk request bodies, starting a new body before maxBytes is exceeded.
+type bulkWriter struct {
+	action    []byte
+	timestamp string
+	maxBytes  int
+	pool      *util.BufferPool
+	buf       *bytes.Buffer
+	documents int
+	doc       bytes.Buffer
+	encoder   *json.Encoder
+	batches   []bulkBatch
+}
+
+func (bw *bulkWriter) add(metricType, name string, value float64, hostname string, tags map[string]string, meta gostatsd.MetricMetadata) {
+	bw.doc.Reset()
+	// Encode appends a newline, which is the separator required by the _bulk API.
+	if err := bw.encoder.Encode(&document{
+		Timestamp:   bw.timestamp,
+		Name:        name,
+		Type:        metricType,
+		Value:       value,
+		Host:        hostname,
+		Tags:        tags,
+		Unit:        meta.Unit,
+		Description: meta.Description,
+	}); err != nil {
+		log.Warnf("[%s] unable to marshal %s: %v", BackendName, name, err)
+		return
+	}
+
+	size := len(bw.action) + bw.doc.Len()
+	if bw.documents > 0 && bw.buf.Len()+size > bw.maxBytes {
+		bw.finish()
+	}
+	bw.buf.Write(bw.action)
+	bw.buf.Write(bw.doc.Bytes())
+	bw.documents++
+}
+
+func (bw *bulkWriter) finish() {
+	if bw.documents > 0 {
+		bw.batches = append(bw.batches, bulkBatch{body: bw.buf.Bytes(), buf: bw.buf, documents: bw.documents})
+		bw.buf = bw.pool.Get()
+		bw.documents = 0
+	}
+}
+
+// processMetrics serializes all metrics in to _bulk request bodies.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap) []bulkBatch {
+	now := c.now()
+	bw := &bulkWriter{
+		action:    []byte(fmt.Sprintf(`{"index":{"_index":%q}}`+"\n", c.indexName(now))),
+		timestamp: now.UTC().Format(time.RFC3339Nano),
+		maxBytes:  c.maxRequestBytes,
+		pool:      c.bufferPool,
+		buf:       c.bufferPool.Get(),
+	}
+	bw.encoder = json.NewEncoder(&bw.doc)
+	bw.encoder.SetEscapeHTML(false)
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		tags := tagsToFields(counter.Tags)
+		meta, _ := c.metadata.Lookup(key)
+		bw.add("counter", key+".count", float64(counter.Value), counter.Hostname, tags, meta)
+		bw.add("counter", key+".per_second", counter.PerSecond, counter.Hostname, tags, meta)
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		tags := tagsToFields(timer.Tags)
+		meta, _ := c.metadata.Lookup(key)
+		if !c.disabledSubtypes.Lower {
+			bw.add("timer", key+".lower", timer.Min, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.Upper {
+			bw.add("timer", key+".upper", timer.Max, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.Count {
+			bw.add("timer", key+".count", float64(timer.Count), timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.CountPerSecond {
+			bw.add("timer", key+".count_ps", timer.PerSecond, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.Mean {
+			bw.add("timer", key+".mean", timer.Mean, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.Median {
+			bw.add("timer", key+".median", timer.Median, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.StdDev {
+			bw.add("timer", key+".std", timer.StdDev, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.Sum {
+			bw.add("timer", key+".sum", timer.Sum, timer.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.SumSquares {
+			bw.add("timer", key+".sum_squares", timer.SumSquares, timer.Hostname, tags, meta)
+		}
+		for _, pct := range timer.Percentiles {
+			bw.add("timer", key+"."+pct.Str, pct.Float, timer.Hostname, tags, meta)
+		}
+		// The buckets are counts, so they don't have the unit of the timer.
+		bucketMeta := gostatsd.MetricMetadata{Description: meta.Description}
+		for _, bucket := range timer.Histogram {
+			bw.add("timer", key+"."+bucket.Name, float64(bucket.Count), timer.Hostname, tags, bucketMeta)
+		}
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		tags := tagsToFields(dist.Tags)
+		meta, _ := c.metadata.Lookup(key)
+		if !c.disabledSubtypes.DistributionMin {
+			bw.add("distribution", key+".min", dist.Min, dist.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.DistributionMax {
+			bw.add("distribution", key+".max", dist.Max, dist.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.DistributionCount {
+			bw.add("distribution", key+".count", float64(dist.Count), dist.Hostname, tags, meta)
+		}
+		if !c.disabledSubtypes.DistributionSum {
+			bw.add("distribution", key+".sum", dist.Sum, dist.Hostname, tags, meta)
+		}
+		for _, pct := range dist.Percentiles {
+			bw.add("distribution", key+"."+pct.Str, pct.Float, dist.Hostname, tags, meta)
+		}
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, g gostatsd.Gauge) {
+		meta, _ := c.metadata.Lookup(key)
+		bw.add("gauge", key, g.Value, g.Hostname, tagsToFields(g.Tags), meta)
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		meta, _ := c.metadata.Lookup(key)
+		bw.add("set", key, float64(len(set.Values)), set.Hostname, tagsToFields(set.Tags), meta)
+	})
+
+	bw.finish()
+	c.bufferPool.Put(bw.buf)
+	return bw.batches
+}
+
+// tagsToFields converts tags in to a map of fields.  Tags of the form key:value become {key: value}, and tags
+// without a value become {tag: ""}.
+func tagsToFields(tags gostatsd.Tags) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	fields := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			fields[tag[:idx]] = tag[idx+1:]
+		} else {
+			fields[tag] = ""
+		}
+	}
+	return fields
+}
+
+// indexName expands the index template for the given time.  Any text inside {} is treated as a Go time layout, for
+// example gostatsd-{2006.01.02} gives a daily index.
+func (c *Client) indexName(t time.Time) string {
+	t = t.UTC()
+	var sb strings.Builder
+	tmpl := c.index
+	for {
+		start := strings.IndexByte(tmpl, '{')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(tmpl[start:], '}')
+		if end < 0 {
+			break
+		}
+		sb.WriteString(tmpl[:start])
+		sb.WriteString(t.Format(tmpl[start+1 : start+end]))
+		tmpl = tmpl[start+end+1:]
+	}
+	sb.WriteString(tmpl)
+	return sb.String()
+}
+
+// SendEvent indexes an event in Elasticsearch.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	ts := time.Unix(e.DateHappened, 0)
+	body, err := json.Marshal(newEvent(e, ts))
+	if err != nil {
+		return fmt.Errorf("[%s] unable to marshal event: %v", BackendName, err)
+	}
+
+	return c.retry(ctx, "event", func() error {
+		resp, err := c.do(ctx, "/"+c.indexName(ts)+"/_doc", "application/json", body)
+		if err != nil {
+			return err
+		}
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+		return nil
+	})
+}
+
+// SendEvents indexes the events in Elasticsearch with a single _bulk request, each in the index for the time it
+// happened.
+func (c *Client) SendEvents(ctx context.Context, events []*gostatsd.Event) error {
+	var body bytes.Buffer
+	for _, e := range events {
+		ts := time.Unix(e.DateHappened, 0)
+		doc, err := json.Marshal(newEvent(e, ts))
+		if err != nil {
+			return fmt.Errorf("[%s] unable to marshal event: %v", BackendName, err)
+		}
+		fmt.Fprintf(&body, `{"index":{"_index":%q}}`+"\n", c.indexName(ts)) // #nosec
+		body.Write(doc)
+		body.WriteByte('\n')
+	}
+
+	return c.retry(ctx, "events", func() error {
+		resp, err := c.do(ctx, "/_bulk", "application/x-ndjson", body.Bytes())
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if _, err := c.countFailures(resp.Body); err != nil {
+			log.Warnf("[%s] unable to parse bulk response: %v", BackendName, err)
+		}
+		return nil
+	})
+}
+
+func newEvent(e *gostatsd.Event, ts time.Time) *event {
+	return &event{
+		Timestamp:      ts.UTC().Format(time.RFC3339Nano),
+		Type:           "event",
+		Title:          e.Title,
+		Text:           e.Text,
+		Host:           e.Hostname,
+		AggregationKey: e.AggregationKey,
+		SourceTypeName: e.SourceTypeName,
+		Tags:           tagsToFields(e.Tags),
+		Priority:       e.Priority.StringWithEmptyDefault(),
+		AlertType:      e.AlertType.StringWithEmptyDefault(),
+	}
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// postBulk sends a single _bulk request, retrying if the request as a whole fails.  Documents which are rejected
+// individually are counted and logged, but not retried.
+func (c *Client) postBulk(ctx context.Context, batch bulkBatch) error {
+	err := c.retry(ctx, "metrics", func() error {
+		resp, err := c.do(ctx, "/_bulk", "application/x-ndjson", batch.body)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		failed, err := c.countFailures(resp.Body)
+		if err != nil {
+			// The request was accepted, so don't risk indexing everything twice.
+			log.Warnf("[%s] unable to parse bulk response: %v", BackendName, err)
+			return nil
+		}
+		atomic.AddUint64(&c.documentsFailed, uint64(failed))
+		atomic.AddUint64(&c.documentsIndexed, uint64(batch.documents-failed))
+		return nil
+	})
+	if err == nil {
+		atomic.AddUint64(&c.batchesSent, 1)
+	} else {
+		atomic.AddUint64(&c.batchesDropped, 1)
+	}
+	return err
+}
+
+// countFailures returns the number of items in a _bulk response which were not indexed.
+func (c *Client) countFailures(body io.Reader) (int, error) {
+	var br bulkResponse
+	if err := json.NewDecoder(io.LimitReader(body, maxResponseSize)).Decode(&br); err != nil {
+		return 0, err
+	}
+	if !br.Errors {
+		return 0, nil
+	}
+	failed := 0
+	logged := false
+	for _, item := range br.Items {
+		for _, result := range item {
+			if result.Status < http.StatusOK || result.Status >= http.StatusMultipleChoices {
+				failed++
+				if !logged {
+					logged = true
+					log.Warnf("[%s] document rejected with status %d: %s: %s", BackendName, result.Status, result.Error.Type, result.Error.Reason)
+				}
+			}
+		}
+	}
+	return failed, nil
+}
+
+func (c *Client) retry(ctx context.Context, typeOfPost string, post func() error) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		err := post()
+		if err == nil {
+			return nil
+		}
+
+		next, throttled := util.NextRetry(b, err)
+		if throttled && typeOfPost == "metrics" {
+			atomic.AddUint64(&c.batchesThrottled, 1)
+		}
+		if next == backoff.Stop {
+			return fmt.Errorf("[%s] %w", BackendName, err)
+		}
+
+		log.Warnf("[%s] failed to send %s, sleeping for %s: %v", BackendName, typeOfPost, next, err)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		if typeOfPost == "metrics" {
+			atomic.AddUint64(&c.batchesRetried, 1)
+		}
+	}
+}
+
+// do performs a POST request, returning an error if the status code does not indicate success.  The caller must
+// close the body of the returned response.
+func (c *Client) do(ctx context.Context, path, contentType string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", c.endpoint+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "ApiKey "+c.apiKey)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error POSTing: %w", err)
+	}
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 10*1024))
+		_ = resp.Body.Close()
+		log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
+		return nil, util.NewStatusError(resp)
+	}
+	return resp, nil
+}
+
+// NewClientFromViper returns a new Elasticsearch client.
+func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	es := util.GetSubViper(v, "elasticsearch")
+	es.SetDefault("index", defaultIndex)
+	es.SetDefault("username", "")
+	es.SetDefault("password", "")
+	es.SetDefault("api-key", "")
+	es.SetDefault("max-request-bytes", defaultMaxRequestBytes)
+	es.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	es.SetDefault("max-requests", defaultMaxRequests)
+	es.SetDefault("user-agent", defaultUserAgent)
+	es.SetDefault("transport", "default")
+
+	return NewClient(
+		es.GetString("endpoint"),
+		es.GetString("index"),
+		es.GetString("username"),
+		es.GetString("password"),
+		es.GetString("api-key"),
+		es.GetString("user-agent"),
+		es.GetString("transport"),
+		es.GetInt("max-request-bytes"),
+		uint(es.GetInt("max-requests")),
+		es.GetDuration("max-request-elapsed-time"),
+		gostatsd.DisabledSubMetrics(v),
+		gostatsd.MetricMetadataFromViper(v),
+		pool,
+	)
+}
+
+// NewClient returns a new Elasticsearch client.
+func NewClient(
+	endpoint,
+	index,
+	username,
+	password,
+	apiKey,
+	userAgent,
+	transport string,
+	maxRequestBytes int,
+	maxRequests uint,
+	maxRequestElapsedTime time.Duration,
+	disabled gostatsd.TimerSubtypes,
+	metadata gostatsd.MetadataRules,
+	pool *transport.TransportPool,
+) (*Client, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("[%s] endpoint is required", BackendName)
+	}
+	if index == "" {
+		return nil, fmt.Errorf("[%s] index is required", BackendName)
+	}
+	if userAgent == "" {
+		return nil, fmt.Errorf("[%s] user-agent is required", BackendName)
+	}
+	if maxRequestBytes <= 0 {
+		return nil, fmt.Errorf("[%s] max-request-bytes must be positive", BackendName)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] max-requests must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] max-request-elapsed-time must be positive", BackendName)
+	}
+
+	logger := log.WithField("backend", BackendName)
+	httpClient, err := pool.Get(transport)
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	logger.WithFields(log.Fields{
+		"endpoint":                 endpoint,
+		"index":                    index,
+		"max-request-bytes":        maxRequestBytes,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+	}).Info("created backend")
+
+	return &Client{
+		endpoint:              strings.TrimRight(endpoint, "/"),
+		index:                 index,
+		username:              username,
+		password:              password,
+		apiKey:                apiKey,
+		userAgent:             userAgent,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		maxRequestBytes:       maxRequestBytes,
+		client:                httpClient.Client,
+		requestSem:            make(chan struct{}, maxRequests),
+		bufferPool:            util.NewBufferPool(2 * maxRequestBytes), // Allow for a document larger than the limit
+		now:                   time.Now,
+		disabledSubtypes:      disabled,
+		metadata:              metadata,
+	}, nil
+}
@@ -0,0 +1,284 @@
+package elasticsearch
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func newTestClient(t *testing.T, url string, maxRequestBytes int) *Client {
+	return newTestClientWithMetadata(t, url, maxRequestBytes, nil)
+}
+
+func newTestClientWithMetadata(t *testing.T, url string, maxRequestBytes int, metadata gostatsd.MetadataRules) *Client {
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(url, defaultIndex, "user", "pass", "", "agent", "default", maxRequestBytes, 1, 2*time.Second, gostatsd.TimerSubtypes{}, metadata, p)
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	}
+	return client
+}
+
+func TestSendMetricsBulk(t *testing.T) {
+	t.Parallel()
+	var docs []map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		user, pass, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", user)
+		assert.Equal(t, "pass", pass)
+		assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+			assert.Equal(t, "gostatsd-2020.03.04", action["index"]["_index"])
+			require.True(t, scanner.Scan())
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			docs = append(docs, doc)
+		}
+		_, _ = w.Write([]byte(`{"errors":false,"items":[]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, defaultMaxRequestBytes)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Hostname: "h1", Tags: gostatsd.Tags{"team:payments", "simple"}},
+	}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	for _, err := range <-res {
+		assert.NoError(t, err)
+	}
+
+	require.Len(t, docs, 1)
+	assert.Equal(t, map[string]interface{}{
+		"@timestamp": "2020-03-04T05:06:07Z",
+		"name":       "g1",
+		"type":       "gauge",
+		"value":      float64(3),
+		"host":       "h1",
+		"tags":       map[string]interface{}{"team": "payments", "simple": ""},
+	}, docs[0])
+	assert.EqualValues(t, 1, client.documentsIndexed)
+	assert.EqualValues(t, 1, client.batchesSent)
+}
+
+func TestSendMetricsMetadata(t *testing.T) {
+	t.Parallel()
+	var docs []map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			require.True(t, scanner.Scan())
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			docs = append(docs, doc)
+		}
+		_, _ = w.Write([]byte(`{"errors":false,"items":[]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClientWithMetadata(t, ts.URL, defaultMaxRequestBytes, gostatsd.MetadataRules{
+		{
+			Match:          gostatsd.StringMatchList{gostatsd.NewStringMatch("queue.*")},
+			MetricMetadata: gostatsd.MetricMetadata{Unit: "bytes", Description: "Size of the queue"},
+		},
+	})
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["queue.size"] = map[string]gostatsd.Gauge{"": {Value: 10}}
+	mm.Gauges["other"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	for _, err := range <-res {
+		assert.NoError(t, err)
+	}
+
+	require.Len(t, docs, 2)
+	byName := map[string]map[string]interface{}{}
+	for _, doc := range docs {
+		byName[doc["name"].(string)] = doc
+	}
+	assert.Equal(t, "bytes", byName["queue.size"]["unit"])
+	assert.Equal(t, "Size of the queue", byName["queue.size"]["description"])
+	assert.NotContains(t, byName["other"], "unit")
+	assert.NotContains(t, byName["other"], "description")
+}
+
+func TestProcessMetricsTimerHistogram(t *testing.T) {
+	t.Parallel()
+	client := newTestClientWithMetadata(t, "http://localhost", defaultMaxRequestBytes, gostatsd.MetadataRules{
+		{
+			Match:          gostatsd.StringMatchList{gostatsd.NewStringMatch("t1")},
+			MetricMetadata: gostatsd.MetricMetadata{Unit: "ms", Description: "Latency"},
+		},
+	})
+	client.disabledSubtypes = gostatsd.TimerSubtypes{Lower: true, Upper: true, Count: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true}
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count:       3,
+		Percentiles: gostatsd.Percentiles{{Str: "upper_90", Float: 12.5}},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+
+	var docs []map[string]interface{}
+	for _, batch := range client.processMetrics(mm) {
+		lines := strings.Split(strings.TrimSpace(string(batch.body)), "\n")
+		for i := 1; i < len(lines); i += 2 {
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(lines[i]), &doc))
+			delete(doc, "@timestamp")
+			docs = append(docs, doc)
+		}
+	}
+
+	// The buckets are counts, so they don't have the unit of the timer.
+	assert.Equal(t, []map[string]interface{}{
+		{"name": "t1.upper_90", "type": "timer", "value": 12.5, "unit": "ms", "description": "Latency"},
+		{"name": "t1.histogram.le_10", "type": "timer", "value": float64(2), "description": "Latency"},
+		{"name": "t1.histogram.le_inf", "type": "timer", "value": float64(3), "description": "Latency"},
+	}, docs)
+}
+
+func TestSendMetricsPartialFailure(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"errors":true,"items":[
+			{"index":{"status":201}},
+			{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}
+		]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, defaultMaxRequestBytes)
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {Value: 5, PerSecond: 0.5},
+	}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	for _, err := range <-res {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 1, client.documentsIndexed)
+	assert.EqualValues(t, 1, client.documentsFailed)
+}
+
+func TestSendMetricsSplitsBySize(t *testing.T) {
+	t.Parallel()
+	var requests uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requests, 1)
+		_, _ = w.Write([]byte(`{"errors":false,"items":[]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	// Small enough that every document gets its own request
+	client := newTestClient(t, ts.URL, 10)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	mm.Gauges["g2"] = map[string]gostatsd.Gauge{"": {Value: 2}}
+	mm.Sets["s1"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"a": {}}}}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	assert.Len(t, errs, 3)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 3, atomic.LoadUint32(&requests))
+}
+
+func TestSendEventsBulk(t *testing.T) {
+	t.Parallel()
+	var indexes []string
+	var docs []map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_bulk", func(w http.ResponseWriter, r *http.Request) {
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &action))
+			indexes = append(indexes, action["index"]["_index"])
+			require.True(t, scanner.Scan())
+			var doc map[string]interface{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &doc))
+			docs = append(docs, doc)
+		}
+		_, _ = w.Write([]byte(`{"errors":false,"items":[]}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, defaultMaxRequestBytes)
+	err := client.SendEvents(context.Background(), []*gostatsd.Event{
+		{Title: "deploy", Text: "web", DateHappened: time.Date(2020, 3, 4, 23, 0, 0, 0, time.UTC).Unix()},
+		{Title: "restart", DateHappened: time.Date(2020, 3, 5, 1, 0, 0, 0, time.UTC).Unix()},
+	})
+	require.NoError(t, err)
+
+	// Each event is indexed by when it happened, in the order sent
+	assert.Equal(t, []string{"gostatsd-2020.03.04", "gostatsd-2020.03.05"}, indexes)
+	require.Len(t, docs, 2)
+	assert.Equal(t, "deploy", docs[0]["title"])
+	assert.Equal(t, "web", docs[0]["text"])
+	assert.Equal(t, "2020-03-04T23:00:00Z", docs[0]["@timestamp"])
+	assert.Equal(t, "restart", docs[1]["title"])
+}
+
+func TestIndexName(t *testing.T) {
+	t.Parallel()
+	c := &Client{}
+	ts := time.Date(2020, 3, 4, 5, 6, 7, 0, time.UTC)
+	for tmpl, expected := range map[string]string{
+		"gostatsd-{2006.01.02}":    "gostatsd-2020.03.04",
+		"gostatsd":                 "gostatsd",
+		"metrics-{2006}-m{01}":     "metrics-2020-m03",
+		"odd-{2006":                "odd-{2006",
+		"{2006.01.02.15}-gostatsd": "2020.03.04.05-gostatsd",
+	} {
+		c.index = tmpl
+		assert.Equal(t, expected, c.indexName(ts), tmpl)
+	}
+}
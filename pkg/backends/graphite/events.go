@@ -0,0 +1,79 @@
+package graphite
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// event is the body of a request to the Graphite events API, which Graphite renders as annotations.
+type event struct {
+	What string   `json:"what"`
+	Tags []string `json:"tags"`
+	When int64    `json:"when"`
+	Data string   `json:"data"`
+}
+
+// newEvent converts e to a Graphite event.  The hostname, priority and alert type are added as tags, as the events
+// API has nowhere else to put them.
+func newEvent(e *gostatsd.Event, now time.Time) *event {
+	tags := make([]string, 0, len(e.Tags)+3)
+	tags = append(tags, e.Tags...)
+	if e.Hostname != "" {
+		tags = append(tags, "host:"+e.Hostname)
+	}
+	if priority := e.Priority.StringWithEmptyDefault(); priority != "" {
+		tags = append(tags, "priority:"+priority)
+	}
+	if alertType := e.AlertType.StringWithEmptyDefault(); alertType != "" {
+		tags = append(tags, "alert_type:"+alertType)
+	}
+	when := e.DateHappened
+	if when == 0 {
+		when = now.Unix()
+	}
+	return &event{
+		What: e.Title,
+		Tags: tags,
+		When: when,
+		Data: e.Text,
+	}
+}
+
+// SendEvent posts the event to the Graphite events API, if events_url is configured, otherwise it is discarded.
+func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	if client.eventsURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(newEvent(e, time.Now()))
+	if err != nil {
+		return fmt.Errorf("[%s] unable to marshal event: %v", BackendName, err)
+	}
+	req, err := http.NewRequest("POST", client.eventsURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("[%s] unable to create http.Request: %v", BackendName, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "gostatsd")
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("[%s] error POSTing event: %v", BackendName, err)
+	}
+	defer func() {
+		_, _ = io.Copy(ioutil.Discard, resp.Body)
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyStart, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("[%s] received bad status code %d posting event: %s", BackendName, resp.StatusCode, bodyStart)
+	}
+	return nil
+}
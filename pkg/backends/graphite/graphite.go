@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"net/http"
 	"regexp"
 	"strings"
 	"sync"
@@ -38,6 +39,8 @@ const (
 	DefaultPrefixGauge = "gauges"
 	// DefaultPrefixSet is the default sets prefix.
 	DefaultPrefixSet = "sets"
+	// PrefixDistribution is the distributions prefix.
+	PrefixDistribution = "distributions"
 	// DefaultGlobalSuffix is the default global suffix.
 	DefaultGlobalSuffix = ""
 	// DefaultMode controls whether to use legacy namespace, no tags, or tags
@@ -63,9 +66,15 @@ type Client struct {
 	timerNamespace   string
 	gaugesNamespace  string
 	setsNamespace    string
+	distNamespace    string
 	globalSuffix     string
 	legacyNamespace  bool
 	enableTags       bool
+	tagNodes         []string      // Keys of tags to fold in to the metric name, in order
+	gaugeTimestamps  bool          // Send gauges with the time they were last updated, rather than the flush time
+	timestampOffset  time.Duration // Added to every timestamp sent, to compensate for clock skew
+	eventsURL        string        // URL of the Graphite events API, events are discarded if empty
+	httpClient       *http.Client
 	disabledSubtypes gostatsd.TimerSubtypes
 }
 
@@ -73,6 +82,11 @@ func (client *Client) Run(ctx context.Context) {
 	client.sender.Run(ctx)
 }
 
+// WaitReady waits for the first connection to the Graphite server to be established.
+func (client *Client) WaitReady(ctx context.Context) error {
+	return client.sender.WaitReady(ctx)
+}
+
 // SendMetricsAsync flushes the metrics to the Graphite server, preparing payload synchronously but doing the send asynchronously.
 func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
 	buf := client.preparePayload(metrics, time.Now())
@@ -107,6 +121,37 @@ func asGraphiteTag(tag string) string {
 	return "unnamed=" + tag
 }
 
+// normalizeNode will normalize a tag value for use as a single node of a metric name, so it will also replace "."
+// with "_".
+func normalizeNode(s string) string {
+	return normalizeMetricName(strings.Replace(s, ".", "_", -1))
+}
+
+// hasTagKey returns true if tag is of the form key:value.
+func hasTagKey(tag, key string) bool {
+	return len(tag) > len(key) && tag[len(key)] == ':' && strings.HasPrefix(tag, key)
+}
+
+// tagValue returns the value of the first tag with the key, or false if there is none.
+func tagValue(tags gostatsd.Tags, key string) (string, bool) {
+	for _, tag := range tags {
+		if hasTagKey(tag, key) {
+			return tag[len(key)+1:], true
+		}
+	}
+	return "", false
+}
+
+// isTagNode returns true if the tag is folded in to the metric name.
+func (client *Client) isTagNode(tag string) bool {
+	for _, key := range client.tagNodes {
+		if hasTagKey(tag, key) {
+			return true
+		}
+	}
+	return false
+}
+
 // prepareName will create a metric name, handling correct prefix, suffixes, and tags, with an optional host tag if
 // not overridden by a tag on the metric.
 func (client *Client) prepareName(namespace, name, suffix, hostname string, tags gostatsd.Tags) string {
@@ -116,6 +161,12 @@ func (client *Client) prepareName(namespace, name, suffix, hostname string, tags
 		buf.WriteByte('.')
 	}
 	buf.WriteString(normalizeMetricName(name))
+	for _, key := range client.tagNodes {
+		if value, ok := tagValue(tags, key); ok && value != "" {
+			buf.WriteByte('.')
+			buf.WriteString(normalizeNode(value))
+		}
+	}
 	if suffix != "" {
 		buf.WriteByte('.')
 		buf.WriteString(suffix)
@@ -128,6 +179,9 @@ func (client *Client) prepareName(namespace, name, suffix, hostname string, tags
 	if client.enableTags {
 		haveHost := false
 		for _, tag := range tags {
+			if client.isTagNode(tag) {
+				continue
+			}
 			graphiteTag := asGraphiteTag(tag)
 			buf.WriteByte(';')
 			buf.WriteString(graphiteTag)
@@ -146,7 +200,7 @@ func (client *Client) prepareName(namespace, name, suffix, hostname string, tags
 
 func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time) *bytes.Buffer {
 	buf := client.sender.GetBuffer()
-	now := ts.Unix()
+	now := ts.Add(client.timestampOffset).Unix()
 	if client.legacyNamespace {
 		metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 			_, _ = fmt.Fprintf(buf, "%s %d %d\n", client.prepareName("stats_counts", key, "", counter.Hostname, counter.Tags), counter.Value, now)
@@ -189,9 +243,33 @@ func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time)
 		for _, pct := range timer.Percentiles {
 			_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.timerNamespace, key, pct.Str, timer.Hostname, timer.Tags), pct.Float, now)
 		}
+		for _, bucket := range timer.Histogram {
+			_, _ = fmt.Fprintf(buf, "%s %d %d\n", client.prepareName(client.timerNamespace, key, bucket.Name, timer.Hostname, timer.Tags), bucket.Count, now)
+		}
+	})
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		if !client.disabledSubtypes.DistributionMin {
+			_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.distNamespace, key, "min", dist.Hostname, dist.Tags), dist.Min, now)
+		}
+		if !client.disabledSubtypes.DistributionMax {
+			_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.distNamespace, key, "max", dist.Hostname, dist.Tags), dist.Max, now)
+		}
+		if !client.disabledSubtypes.DistributionCount {
+			_, _ = fmt.Fprintf(buf, "%s %d %d\n", client.prepareName(client.distNamespace, key, "count", dist.Hostname, dist.Tags), dist.Count, now)
+		}
+		if !client.disabledSubtypes.DistributionSum {
+			_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.distNamespace, key, "sum", dist.Hostname, dist.Tags), dist.Sum, now)
+		}
+		for _, pct := range dist.Percentiles {
+			_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.distNamespace, key, pct.Str, dist.Hostname, dist.Tags), pct.Float, now)
+		}
 	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.gaugesNamespace, key, "", gauge.Hostname, gauge.Tags), gauge.Value, now)
+		timestamp := now
+		if client.gaugeTimestamps && gauge.Timestamp != 0 {
+			timestamp = (int64(gauge.Timestamp) + int64(client.timestampOffset)) / int64(time.Second)
+		}
+		_, _ = fmt.Fprintf(buf, "%s %f %d\n", client.prepareName(client.gaugesNamespace, key, "", gauge.Hostname, gauge.Tags), gauge.Value, timestamp)
 	})
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
 		_, _ = fmt.Fprintf(buf, "%s %d %d\n", client.prepareName(client.setsNamespace, key, "", set.Hostname, set.Tags), len(set.Values), now)
@@ -199,11 +277,6 @@ func (client *Client) preparePayload(metrics *gostatsd.MetricMap, ts time.Time)
 	return buf
 }
 
-// SendEvent discards events.
-func (client *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
-	return nil
-}
-
 // Name returns the name of the backend.
 func (client *Client) Name() string {
 	return BackendName
@@ -222,6 +295,10 @@ func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd
 	g.SetDefault("prefix_set", DefaultPrefixSet)
 	g.SetDefault("global_suffix", DefaultGlobalSuffix)
 	g.SetDefault("mode", DefaultMode)
+	g.SetDefault("gauge_timestamps", false)
+	g.SetDefault("timestamp_offset", 0)
+	g.SetDefault("events_url", "")
+	g.SetDefault("events_transport", "default")
 	return NewClient(
 		g.GetString("address"),
 		g.GetDuration("dial_timeout"),
@@ -233,7 +310,13 @@ func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd
 		g.GetString("prefix_set"),
 		g.GetString("global_suffix"),
 		g.GetString("mode"),
+		g.GetStringSlice("tag_nodes"),
+		g.GetBool("gauge_timestamps"),
+		g.GetDuration("timestamp_offset"),
+		g.GetString("events_url"),
+		g.GetString("events_transport"),
 		gostatsd.DisabledSubMetrics(v),
+		pool,
 	)
 }
 
@@ -249,7 +332,13 @@ func NewClient(
 	prefixSet string,
 	globalSuffix string,
 	mode string,
+	tagNodes []string,
+	gaugeTimestamps bool,
+	timestampOffset time.Duration,
+	eventsURL string,
+	eventsTransport string,
 	disabled gostatsd.TimerSubtypes,
+	pool *transport.TransportPool,
 ) (*Client, error) {
 	if address == "" {
 		return nil, fmt.Errorf("[%s] address is required", BackendName)
@@ -277,28 +366,40 @@ func NewClient(
 		return nil, fmt.Errorf("[%s] mode must be one of 'legacy', 'basic', or 'tags'", BackendName)
 	}
 
-	var counterNamespace, timerNamespace, gaugesNamespace, setsNamespace string
+	var counterNamespace, timerNamespace, gaugesNamespace, setsNamespace, distNamespace string
 
 	if legacyNamespace {
 		counterNamespace = DefaultGlobalPrefix
 		timerNamespace = combine(DefaultGlobalPrefix, "timers")
 		gaugesNamespace = combine(DefaultGlobalPrefix, "gauges")
 		setsNamespace = combine(DefaultGlobalPrefix, "sets")
+		distNamespace = combine(DefaultGlobalPrefix, PrefixDistribution)
 	} else {
 		globalPrefix := globalPrefix
 		counterNamespace = combine(globalPrefix, prefixCounter)
 		timerNamespace = combine(globalPrefix, prefixTimer)
 		gaugesNamespace = combine(globalPrefix, prefixGauge)
 		setsNamespace = combine(globalPrefix, prefixSet)
+		distNamespace = combine(globalPrefix, PrefixDistribution)
 	}
 
 	counterNamespace = normalizeMetricName(counterNamespace)
 	timerNamespace = normalizeMetricName(timerNamespace)
 	gaugesNamespace = normalizeMetricName(gaugesNamespace)
 	setsNamespace = normalizeMetricName(setsNamespace)
+	distNamespace = normalizeMetricName(distNamespace)
 	globalSuffix = normalizeMetricName(globalSuffix)
 
-	log.Infof("[%s] address=%s dialTimeout=%s writeTimeout=%s counterNamespace=%s timerNamespace=%s gaugesNamespace=%s setsNamespace=%s globalSuffix=%s mode=%s",
+	var httpClient *http.Client
+	if eventsURL != "" {
+		c, err := pool.Get(eventsTransport)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] failed to create http client for events: %v", BackendName, err)
+		}
+		httpClient = c.Client
+	}
+
+	log.Infof("[%s] address=%s dialTimeout=%s writeTimeout=%s counterNamespace=%s timerNamespace=%s gaugesNamespace=%s setsNamespace=%s globalSuffix=%s mode=%s tagNodes=%v gaugeTimestamps=%t timestampOffset=%s eventsURL=%s",
 		BackendName,
 		address,
 		dialTimeout,
@@ -309,6 +410,10 @@ func NewClient(
 		setsNamespace,
 		globalSuffix,
 		mode,
+		tagNodes,
+		gaugeTimestamps,
+		timestampOffset,
+		eventsURL,
 	)
 
 	return &Client{
@@ -330,9 +435,15 @@ func NewClient(
 		timerNamespace:   timerNamespace,
 		gaugesNamespace:  gaugesNamespace,
 		setsNamespace:    setsNamespace,
+		distNamespace:    distNamespace,
 		globalSuffix:     globalSuffix,
 		legacyNamespace:  legacyNamespace,
 		enableTags:       enableTags,
+		tagNodes:         tagNodes,
+		gaugeTimestamps:  gaugeTimestamps,
+		timestampOffset:  timestampOffset,
+		eventsURL:        eventsURL,
+		httpClient:       httpClient,
 		disabledSubtypes: disabled,
 	}, nil
 }
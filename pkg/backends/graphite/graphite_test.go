@@ -2,8 +2,12 @@ package graphite
 
 import (
 	"context"
+	"encoding/json"
 	"io"
+	"math"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"sort"
 	"strings"
 	"sync"
@@ -11,8 +15,11 @@ import (
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
 
 	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -40,7 +47,7 @@ func TestPreparePayloadLegacy(t *testing.T) {
 		"stats.timers.t1.count_90.gs 90.000000 1234\n" +
 		"stats.gauges.g1.gs 3.000000 1234\n" +
 		"stats.sets.users.gs 3 1234\n"
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "ignored1", "ignored2", "ignored3", "ignored4", "ignored5", "gs", "legacy", gostatsd.TimerSubtypes{})
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "ignored1", "ignored2", "ignored3", "ignored4", "ignored5", "gs", "legacy", nil, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -71,7 +78,7 @@ func TestPreparePayloadBasic(t *testing.T) {
 		"gp.pt.t1.count_90.gs 90.000000 1234\n" +
 		"gp.pg.g1.gs 3.000000 1234\n" +
 		"gp.ps.users.gs 3 1234\n"
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", gostatsd.TimerSubtypes{})
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", nil, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -102,7 +109,7 @@ func TestPreparePayloadTags(t *testing.T) {
 		"gp.pt.t1.count_90.gs 90.000000 1234\n" +
 		"gp.pg.g1.gs 3.000000 1234\n" +
 		"gp.ps.users.gs 3 1234\n"
-	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", gostatsd.TimerSubtypes{})
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", nil, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
 	require.NoError(t, err)
 	b := cl.preparePayload(metrics, time.Unix(1234, 0))
 	expected = sortLines(expected)
@@ -110,6 +117,70 @@ func TestPreparePayloadTags(t *testing.T) {
 	require.Equal(t, expected, actual)
 }
 
+func TestPreparePayloadDistributions(t *testing.T) {
+	t.Parallel()
+	metrics := gostatsd.NewMetricMap()
+	metrics.Timers["latency"] = map[string]gostatsd.Timer{"": {Count: 2, Min: 1, Max: 3}}
+	metrics.Distributions["latency"] = map[string]gostatsd.Timer{"": {
+		Count:       2,
+		Min:         10,
+		Max:         30,
+		Sum:         40,
+		Percentiles: gostatsd.Percentiles{{Str: "p90", Float: 30}},
+	}}
+	expected := "gp.pt.latency.lower.gs 1.000000 1234\n" +
+		"gp.pt.latency.upper.gs 3.000000 1234\n" +
+		"gp.distributions.latency.min.gs 10.000000 1234\n" +
+		"gp.distributions.latency.max.gs 30.000000 1234\n" +
+		"gp.distributions.latency.sum.gs 40.000000 1234\n" +
+		"gp.distributions.latency.p90.gs 30.000000 1234\n"
+	disabled := gostatsd.TimerSubtypes{
+		Count:             true,
+		CountPerSecond:    true,
+		Mean:              true,
+		Median:            true,
+		StdDev:            true,
+		Sum:               true,
+		SumSquares:        true,
+		DistributionCount: true,
+	}
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", nil, false, 0, "", "", disabled, nil)
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, sortLines(expected), sortLines(b.String()))
+}
+
+func TestPreparePayloadTimerHistogram(t *testing.T) {
+	t.Parallel()
+	metrics := gostatsd.NewMetricMap()
+	metrics.Timers["latency"] = map[string]gostatsd.Timer{"": {
+		Count:       3,
+		Percentiles: gostatsd.Percentiles{{Str: "upper_90", Float: 12.5}},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+	expected := "gp.pt.latency.count.gs 3 1234\n" +
+		"gp.pt.latency.upper_90.gs 12.500000 1234\n" +
+		"gp.pt.latency.histogram.le_10.gs 2 1234\n" +
+		"gp.pt.latency.histogram.le_inf.gs 3 1234\n"
+	disabled := gostatsd.TimerSubtypes{
+		Lower:          true,
+		Upper:          true,
+		CountPerSecond: true,
+		Mean:           true,
+		Median:         true,
+		StdDev:         true,
+		Sum:            true,
+		SumSquares:     true,
+	}
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", nil, false, 0, "", "", disabled, nil)
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, sortLines(expected), sortLines(b.String()))
+}
+
 func sortLines(s string) string {
 	lines := strings.Split(s, "\n")
 	sort.Strings(lines)
@@ -122,7 +193,7 @@ func TestSendMetricsAsync(t *testing.T) {
 	require.NoError(t, err)
 	defer l.Close()
 	addr := l.Addr().String()
-	c, err := NewClient(addr, 1*time.Second, 10*time.Second, "", "", "", "", "", "", "basic", gostatsd.TimerSubtypes{})
+	c, err := NewClient(addr, 1*time.Second, 10*time.Second, "", "", "", "", "", "", "basic", nil, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
 	require.NoError(t, err)
 
 	var acceptWg sync.WaitGroup
@@ -177,6 +248,115 @@ func metrics() *gostatsd.MetricMap {
 	return mm
 }
 
+func TestPreparePayloadTagNodes(t *testing.T) {
+	t.Parallel()
+	metrics := gostatsd.NewMetricMap()
+	metrics.Counters["latency"] = map[string]gostatsd.Counter{
+		"region:us.service:a.b": {Value: 5, PerSecond: 1.1, Tags: gostatsd.Tags{"region:us", "service:a.b"}},
+		"k:v.region:eu":         {Value: 10, PerSecond: 2.2, Tags: gostatsd.Tags{"k:v", "region:eu"}},
+		"k:v":                   {Value: 15, PerSecond: 3.3, Tags: gostatsd.Tags{"k:v"}},
+	}
+	expectedBasic := "gp.pc.latency.us.a_b.count.gs 5 1234\n" +
+		"gp.pc.latency.us.a_b.rate.gs 1.100000 1234\n" +
+		"gp.pc.latency.eu.count.gs 10 1234\n" +
+		"gp.pc.latency.eu.rate.gs 2.200000 1234\n" +
+		"gp.pc.latency.count.gs 15 1234\n" +
+		"gp.pc.latency.rate.gs 3.300000 1234\n"
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "basic", []string{"region", "service"}, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, sortLines(expectedBasic), sortLines(b.String()))
+
+	// Folded tags are not repeated as graphite tags
+	expectedTags := "gp.pc.latency.us.a_b.count.gs 5 1234\n" +
+		"gp.pc.latency.us.a_b.rate.gs 1.100000 1234\n" +
+		"gp.pc.latency.eu.count.gs;k=v 10 1234\n" +
+		"gp.pc.latency.eu.rate.gs;k=v 2.200000 1234\n" +
+		"gp.pc.latency.count.gs;k=v 15 1234\n" +
+		"gp.pc.latency.rate.gs;k=v 3.300000 1234\n"
+	cl, err = NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "gp", "pc", "pt", "pg", "ps", "gs", "tags", []string{"region", "service"}, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
+	require.NoError(t, err)
+	b = cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, sortLines(expectedTags), sortLines(b.String()))
+}
+
+func TestPreparePayloadGaugeTimestamps(t *testing.T) {
+	t.Parallel()
+	metrics := gostatsd.NewMetricMap()
+	metrics.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {Value: 5, PerSecond: 1.5, Timestamp: gostatsd.Nanotime(time.Unix(1000, 0).UnixNano())},
+	}
+	metrics.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Timestamp: gostatsd.Nanotime(time.Unix(1200, 500).UnixNano())},
+	}
+	metrics.Gauges["g2"] = map[string]gostatsd.Gauge{
+		"": {Value: 4}, // No timestamp, so the flush time is used
+	}
+	expected := "pc.c1.count 5 1234\n" +
+		"pc.c1.rate 1.500000 1234\n" +
+		"pg.g1 3.000000 1200\n" +
+		"pg.g2 4.000000 1234\n"
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "", "pc", "pt", "pg", "ps", "", "basic", nil, true, 0, "", "", gostatsd.TimerSubtypes{}, nil)
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, sortLines(expected), sortLines(b.String()))
+}
+
+func TestPreparePayloadTimestampOffset(t *testing.T) {
+	t.Parallel()
+	metrics := gostatsd.NewMetricMap()
+	metrics.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {PerSecond: 1.5, Value: 5},
+	}
+	metrics.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Timestamp: gostatsd.Nanotime(time.Unix(1200, 500).UnixNano())},
+	}
+	expected := "pc.c1.count 5 1224\n" +
+		"pc.c1.rate 1.500000 1224\n" +
+		"pg.g1 3.000000 1190\n"
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "", "pc", "pt", "pg", "ps", "", "basic", nil, true, -10*time.Second, "", "", gostatsd.TimerSubtypes{}, nil)
+	require.NoError(t, err)
+	b := cl.preparePayload(metrics, time.Unix(1234, 0))
+	require.Equal(t, sortLines(expected), sortLines(b.String()))
+}
+
+func TestSendEvent(t *testing.T) {
+	t.Parallel()
+	var received []event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/events/", r.URL.Path)
+		var e event
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&e))
+		received = append(received, e)
+	}))
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	cl, err := NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "", "", "", "", "", "", "basic", nil, false, 0, ts.URL+"/events/", "default", gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	err = cl.SendEvent(context.Background(), &gostatsd.Event{
+		Title:        "deploy",
+		Text:         "deployed v2",
+		DateHappened: 1234,
+		Hostname:     "h",
+		AlertType:    gostatsd.AlertError,
+		Tags:         gostatsd.Tags{"service:foo"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, []event{{
+		What: "deploy",
+		Tags: []string{"service:foo", "host:h", "alert_type:error"},
+		When: 1234,
+		Data: "deployed v2",
+	}}, received)
+
+	// Without an events URL, events are discarded.
+	cl, err = NewClient("127.0.0.1:9", 1*time.Second, 1*time.Second, "", "", "", "", "", "", "basic", nil, false, 0, "", "", gostatsd.TimerSubtypes{}, nil)
+	require.NoError(t, err)
+	require.NoError(t, cl.SendEvent(context.Background(), &gostatsd.Event{Title: "deploy"}))
+	require.Len(t, received, 1)
+}
+
 func metricsWithTags() *gostatsd.MetricMap {
 	timestamp := gostatsd.Nanotime(time.Unix(123456, 0).UnixNano())
 
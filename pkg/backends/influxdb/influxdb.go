@@ -0,0 +1,511 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "influxdb"
+	// APIVersion1 is the InfluxDB 1.x write API, which writes to a database and retention policy.
+	APIVersion1 = "v1"
+	// APIVersion2 is the InfluxDB 2.x write API, which writes to a bucket of an organization.
+	APIVersion2 = "v2"
+
+	defaultUserAgent             = "gostatsd"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	defaultPrecision             = "ns"
+	// defaultMetricsPerBatch is the default number of lines to send in a single batch.
+	defaultMetricsPerBatch = 1000
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+var (
+	// defaultMaxRequests is the number of parallel outgoing requests to InfluxDB.
+	defaultMaxRequests = uint(2 * runtime.NumCPU())
+
+	// defaultWriteURLs are the write endpoints of a local server for each API version.
+	defaultWriteURLs = map[string]string{
+		APIVersion1: "http://localhost:8086/write",
+		APIVersion2: "http://localhost:8086/api/v2/write",
+	}
+
+	// precisions are the durations of each supported timestamp precision.
+	precisions = map[string]time.Duration{
+		"ns": time.Nanosecond,
+		"us": time.Microsecond,
+		"ms": time.Millisecond,
+		"s":  time.Second,
+	}
+
+	// v1Precisions are the names the 1.x write API uses for each precision, as it predates "us".
+	v1Precisions = map[string]string{
+		"ns": "ns",
+		"us": "u",
+		"ms": "ms",
+		"s":  "s",
+	}
+
+	// droppedRegexp matches the number of points dropped in a partial write error.
+	droppedRegexp = regexp.MustCompile(`dropped=(\d+)`)
+)
+
+// Client represents an InfluxDB client, which sends metrics in the line protocol.
+type Client struct {
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
+	partialWrites    uint64 // Accumulated number of batches only partially written
+	pointsRejected   uint64 // Accumulated number of points dropped by partial writes
+
+	writeURL              string
+	token                 string
+	username              string
+	password              string
+	userAgent             string
+	maxRequestElapsedTime time.Duration
+	client                *http.Client
+	metricsPerBatch       int
+	precision             time.Duration
+	requestSem            chan struct{}    // Limits the number of concurrent requests
+	bufferPool            *util.BufferPool // Buffers for batches
+	now                   func() time.Time // Returns current time. Useful for testing.
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// SendMetricsAsync flushes the metrics to InfluxDB, preparing payload synchronously but doing the send
+// asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	counter := 0
+	results := make(chan error)
+	c.processMetrics(metrics, func(batch *bytes.Buffer) {
+		atomic.AddUint64(&c.batchesCreated, 1)
+		go func() {
+			defer c.bufferPool.Put(batch)
+			select {
+			case <-ctx.Done():
+				return
+			case c.requestSem <- struct{}{}:
+				err := c.post(ctx, batch.Bytes())
+				<-c.requestSem
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+		counter++
+	})
+	go func() {
+		errs := make([]error, 0, counter)
+	loop:
+		for i := 0; i < counter; i++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&c.batchesThrottled)), nil)
+			statser.Gauge("backend.partial_writes", float64(atomic.LoadUint64(&c.partialWrites)), nil)
+			statser.Gauge("backend.points_rejected", float64(atomic.LoadUint64(&c.pointsRejected)), nil)
+		}
+	}
+}
+
+// processMetrics serializes the metrics in to batches of at most metricsPerBatch lines, calling cb with each.  A
+// counter is a single line with count and rate fields, a timer or distribution is a single line with a field for
+// each aggregation, and gauges and sets have a single value field.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*bytes.Buffer)) {
+	timestamp := c.now().UnixNano() / int64(c.precision)
+	batch := c.bufferPool.Get()
+	lines := 0
+	add := func(name, hostname string, tags gostatsd.Tags, fields []lineprotocol.Field) {
+		if !lineprotocol.AppendLine(batch, name, lineprotocol.ConvertTags(tags, hostname), fields, timestamp) {
+			return
+		}
+		lines++
+		if lines >= c.metricsPerBatch {
+			cb(batch)
+			batch = c.bufferPool.Get()
+			lines = 0
+		}
+	}
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		add(key, counter.Hostname, counter.Tags, []lineprotocol.Field{
+			{Key: "count", Value: float64(counter.Value)},
+			{Key: "rate", Value: counter.PerSecond},
+		})
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		add(key, timer.Hostname, timer.Tags, c.timerFields(timer))
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		add(key, dist.Hostname, dist.Tags, c.distributionFields(dist))
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		add(key, gauge.Hostname, gauge.Tags, []lineprotocol.Field{{Key: "value", Value: gauge.Value}})
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		add(key, set.Hostname, set.Tags, []lineprotocol.Field{{Key: "value", Value: float64(len(set.Values))}})
+	})
+
+	if lines > 0 {
+		cb(batch)
+	} else {
+		c.bufferPool.Put(batch)
+	}
+}
+
+// timerFields returns the fields for the aggregations of a timer which aren't disabled.
+func (c *Client) timerFields(timer gostatsd.Timer) []lineprotocol.Field {
+	fields := make([]lineprotocol.Field, 0, 9+len(timer.Percentiles)+len(timer.Histogram))
+	if !c.disabledSubtypes.Lower {
+		fields = append(fields, lineprotocol.Field{Key: "lower", Value: timer.Min})
+	}
+	if !c.disabledSubtypes.Upper {
+		fields = append(fields, lineprotocol.Field{Key: "upper", Value: timer.Max})
+	}
+	if !c.disabledSubtypes.Count {
+		fields = append(fields, lineprotocol.Field{Key: "count", Value: float64(timer.Count)})
+	}
+	if !c.disabledSubtypes.CountPerSecond {
+		fields = append(fields, lineprotocol.Field{Key: "count_ps", Value: timer.PerSecond})
+	}
+	if !c.disabledSubtypes.Mean {
+		fields = append(fields, lineprotocol.Field{Key: "mean", Value: timer.Mean})
+	}
+	if !c.disabledSubtypes.Median {
+		fields = append(fields, lineprotocol.Field{Key: "median", Value: timer.Median})
+	}
+	if !c.disabledSubtypes.StdDev {
+		fields = append(fields, lineprotocol.Field{Key: "std", Value: timer.StdDev})
+	}
+	if !c.disabledSubtypes.Sum {
+		fields = append(fields, lineprotocol.Field{Key: "sum", Value: timer.Sum})
+	}
+	if !c.disabledSubtypes.SumSquares {
+		fields = append(fields, lineprotocol.Field{Key: "sum_squares", Value: timer.SumSquares})
+	}
+	for _, pct := range timer.Percentiles {
+		fields = append(fields, lineprotocol.Field{Key: pct.Str, Value: pct.Float})
+	}
+	for _, bucket := range timer.Histogram {
+		fields = append(fields, lineprotocol.Field{Key: bucket.Name, Value: float64(bucket.Count)})
+	}
+	return fields
+}
+
+// distributionFields returns the fields for the aggregations of a distribution which aren't disabled.
+func (c *Client) distributionFields(dist gostatsd.Timer) []lineprotocol.Field {
+	fields := make([]lineprotocol.Field, 0, 4+len(dist.Percentiles))
+	if !c.disabledSubtypes.DistributionMin {
+		fields = append(fields, lineprotocol.Field{Key: "min", Value: dist.Min})
+	}
+	if !c.disabledSubtypes.DistributionMax {
+		fields = append(fields, lineprotocol.Field{Key: "max", Value: dist.Max})
+	}
+	if !c.disabledSubtypes.DistributionCount {
+		fields = append(fields, lineprotocol.Field{Key: "count", Value: float64(dist.Count)})
+	}
+	if !c.disabledSubtypes.DistributionSum {
+		fields = append(fields, lineprotocol.Field{Key: "sum", Value: dist.Sum})
+	}
+	for _, pct := range dist.Percentiles {
+		fields = append(fields, lineprotocol.Field{Key: pct.Str, Value: pct.Float})
+	}
+	return fields
+}
+
+// post sends the payload to InfluxDB, retrying with backoff until maxRequestElapsedTime.
+func (c *Client) post(ctx context.Context, body []byte) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		err := c.doPost(ctx, body)
+		if err == nil {
+			atomic.AddUint64(&c.batchesSent, 1)
+			return nil
+		}
+
+		next, throttled := util.NextRetry(b, err)
+		if throttled {
+			atomic.AddUint64(&c.batchesThrottled, 1)
+		}
+		if next == backoff.Stop {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] %w", BackendName, err)
+		}
+
+		log.Warnf("[%s] failed to send metrics, sleeping for %s: %v", BackendName, next, err)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&c.batchesRetried, 1)
+	}
+}
+
+func (c *Client) doPost(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", c.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.token != "" {
+		req.Header.Set("Authorization", "Token "+c.token)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		if c.handlePartialWrite(resp.StatusCode, b) {
+			return nil
+		}
+		log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
+		return util.NewStatusError(resp)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// handlePartialWrite records the points dropped by InfluxDB, if the response of a rejected request is a partial
+// write, returning true if it is.  The rest of the points were written, so the request is not retried, as the
+// dropped points will be dropped again.  A partial write is a 400 Bad Request from 1.x, or a 422 Unprocessable
+// Entity from 2.x, with an error such as "partial write: field type conflict: ... dropped=2".
+func (c *Client) handlePartialWrite(statusCode int, body []byte) bool {
+	if statusCode != http.StatusBadRequest && statusCode != http.StatusUnprocessableEntity {
+		return false
+	}
+	if !bytes.Contains(body, []byte("partial write")) {
+		return false
+	}
+	atomic.AddUint64(&c.partialWrites, 1)
+	if m := droppedRegexp.FindSubmatch(body); m != nil {
+		if dropped, err := strconv.ParseUint(string(m[1]), 10, 64); err == nil {
+			atomic.AddUint64(&c.pointsRejected, dropped)
+		}
+	}
+	log.Warnf("[%s] partial write: %s", BackendName, body)
+	return true
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// NewClientFromViper returns a new InfluxDB client.
+func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	i := util.GetSubViper(v, "influxdb")
+	i.SetDefault("write-url", "")
+	i.SetDefault("api-version", APIVersion2)
+	i.SetDefault("org", "")
+	i.SetDefault("bucket", "")
+	i.SetDefault("db", "")
+	i.SetDefault("rp", "")
+	i.SetDefault("precision", defaultPrecision)
+	i.SetDefault("token", "")
+	i.SetDefault("username", "")
+	i.SetDefault("password", "")
+	i.SetDefault("metrics-per-batch", defaultMetricsPerBatch)
+	i.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	i.SetDefault("max-requests", defaultMaxRequests)
+	i.SetDefault("user-agent", defaultUserAgent)
+	i.SetDefault("transport", "default")
+
+	return NewClient(
+		i.GetString("write-url"),
+		i.GetString("api-version"),
+		i.GetString("org"),
+		i.GetString("bucket"),
+		i.GetString("db"),
+		i.GetString("rp"),
+		i.GetString("precision"),
+		i.GetString("token"),
+		i.GetString("username"),
+		i.GetString("password"),
+		i.GetString("user-agent"),
+		i.GetString("transport"),
+		i.GetInt("metrics-per-batch"),
+		uint(i.GetInt("max-requests")),
+		i.GetDuration("max-request-elapsed-time"),
+		gostatsd.DisabledSubMetrics(v),
+		pool,
+	)
+}
+
+// NewClient returns a new InfluxDB client.  If writeURL is empty, the write endpoint of the API version on
+// localhost is used.
+func NewClient(
+	writeURL,
+	apiVersion,
+	org,
+	bucket,
+	database,
+	retentionPolicy,
+	precision,
+	token,
+	username,
+	password,
+	userAgent,
+	transport string,
+	metricsPerBatch int,
+	maxRequests uint,
+	maxRequestElapsedTime time.Duration,
+	disabled gostatsd.TimerSubtypes,
+	pool *transport.TransportPool,
+) (*Client, error) {
+	if _, ok := defaultWriteURLs[apiVersion]; !ok {
+		return nil, fmt.Errorf("[%s] api-version must be %s or %s", BackendName, APIVersion1, APIVersion2)
+	}
+	if writeURL == "" {
+		writeURL = defaultWriteURLs[apiVersion]
+	}
+	unit, ok := precisions[precision]
+	if !ok {
+		return nil, fmt.Errorf("[%s] precision must be one of ns, us, ms or s", BackendName)
+	}
+	if token != "" && username != "" {
+		return nil, fmt.Errorf("[%s] only one of username or token may be set", BackendName)
+	}
+	if userAgent == "" {
+		return nil, fmt.Errorf("[%s] user-agent is required", BackendName)
+	}
+	if metricsPerBatch <= 0 {
+		return nil, fmt.Errorf("[%s] metricsPerBatch must be positive", BackendName)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] maxRequests must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
+	}
+
+	u, err := url.Parse(writeURL)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] invalid write-url: %v", BackendName, err)
+	}
+	query := u.Query()
+	switch apiVersion {
+	case APIVersion1:
+		if database == "" {
+			return nil, fmt.Errorf("[%s] db is required for api-version %s", BackendName, APIVersion1)
+		}
+		query.Set("db", database)
+		if retentionPolicy != "" {
+			query.Set("rp", retentionPolicy)
+		}
+		query.Set("precision", v1Precisions[precision])
+	case APIVersion2:
+		if org == "" || bucket == "" {
+			return nil, fmt.Errorf("[%s] org and bucket are required for api-version %s", BackendName, APIVersion2)
+		}
+		query.Set("org", org)
+		query.Set("bucket", bucket)
+		query.Set("precision", precision)
+	}
+	u.RawQuery = query.Encode()
+
+	logger := log.WithField("backend", BackendName)
+	httpClient, err := pool.Get(transport)
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	logger.WithFields(log.Fields{
+		"write-url":                writeURL,
+		"api-version":              apiVersion,
+		"precision":                precision,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+		"metrics-per-batch":        metricsPerBatch,
+	}).Info("created backend")
+
+	return &Client{
+		writeURL:              u.String(),
+		token:                 token,
+		username:              username,
+		password:              password,
+		userAgent:             userAgent,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client:                httpClient.Client,
+		metricsPerBatch:       metricsPerBatch,
+		precision:             unit,
+		requestSem:            make(chan struct{}, maxRequests),
+		bufferPool:            util.NewBufferPool(0),
+		now:                   time.Now,
+		disabledSubtypes:      disabled,
+	}, nil
+}
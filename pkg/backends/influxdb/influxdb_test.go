@@ -0,0 +1,284 @@
+package influxdb
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func newTestPool() *transport.TransportPool {
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	return transport.NewTransportPool(logrus.New(), v)
+}
+
+func newTestClient(t *testing.T, writeURL, apiVersion, precision string, metricsPerBatch int) *Client {
+	client, err := NewClient(writeURL, apiVersion, "org", "bucket", "db", "", precision, "", "", "", "agent", "default", metricsPerBatch, defaultMaxRequests, 2*time.Second, gostatsd.TimerSubtypes{}, newTestPool())
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Unix(100, 123456789)
+	}
+	return client
+}
+
+func metricsOneOfEach() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"tag1": {PerSecond: 1.5, Value: 15, Hostname: "h1", Tags: gostatsd.Tags{"tag1"}},
+	}
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"a:b": {
+			Count:      2,
+			PerSecond:  0.2,
+			Mean:       0.5,
+			Median:     0.5,
+			Min:        0,
+			Max:        1,
+			StdDev:     0.5,
+			Sum:        1,
+			SumSquares: 1,
+			Values:     []float64{0, 1},
+			Percentiles: gostatsd.Percentiles{
+				gostatsd.Percentile{Float: 1, Str: "upper_90"},
+			},
+			Tags: gostatsd.Tags{"a:b"},
+		},
+	}
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Hostname: "h3"},
+	}
+	mm.Sets["users"] = map[string]gostatsd.Set{
+		"c:d": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Tags: gostatsd.Tags{"c:d"}},
+	}
+	return mm
+}
+
+func sortLines(s string) []string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func sendMetrics(client *Client, mm *gostatsd.MetricMap) []error {
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	return <-res
+}
+
+func TestSendMetricsV2(t *testing.T) {
+	t.Parallel()
+	var body string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Token secret", r.Header.Get("Authorization"))
+		assert.Equal(t, "org", r.URL.Query().Get("org"))
+		assert.Equal(t, "bucket", r.URL.Query().Get("bucket"))
+		assert.Equal(t, "ms", r.URL.Query().Get("precision"))
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/api/v2/write", APIVersion2, "ms", 1000)
+	client.token = "secret"
+	errs := sendMetrics(client, metricsOneOfEach())
+	require.Equal(t, []error{nil}, errs)
+
+	expected := "c1,host=h1,unnamed=tag1 count=15,rate=1.5 100123\n" +
+		"t1,a=b lower=0,upper=1,count=2,count_ps=0.2,mean=0.5,median=0.5,std=0.5,sum=1,sum_squares=1,upper_90=1 100123\n" +
+		"g1,host=h3 value=3 100123\n" +
+		"users,c=d value=2 100123\n"
+	assert.Equal(t, sortLines(expected), sortLines(body))
+}
+
+func TestSendMetricsV1(t *testing.T) {
+	t.Parallel()
+	var body string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		username, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", username)
+		assert.Equal(t, "pass", password)
+		assert.Equal(t, "db", r.URL.Query().Get("db"))
+		assert.Equal(t, "autogen", r.URL.Query().Get("rp"))
+		assert.Equal(t, "u", r.URL.Query().Get("precision"))
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client, err := NewClient(ts.URL+"/write", APIVersion1, "", "", "db", "autogen", "us", "", "user", "pass", "agent", "default", 1000, defaultMaxRequests, 2*time.Second, gostatsd.TimerSubtypes{}, newTestPool())
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Unix(100, 123456789)
+	}
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3},
+	}
+	require.Equal(t, []error{nil}, sendMetrics(client, mm))
+	assert.Equal(t, "g1 value=3 100123456\n", body)
+}
+
+func TestProcessMetricsTimerHistogram(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "http://localhost/api/v2/write", APIVersion2, "ms", 1000)
+	client.disabledSubtypes = gostatsd.TimerSubtypes{Lower: true, Upper: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true}
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count:       3,
+		Percentiles: gostatsd.Percentiles{{Str: "upper_90", Float: 12.5}},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+	var body string
+	client.processMetrics(mm, func(buf *bytes.Buffer) {
+		body += buf.String()
+	})
+	assert.Equal(t, "t1 count=3,upper_90=12.5,histogram.le_10=2,histogram.le_inf=3 100123\n", body)
+}
+
+func TestSendMetricsEscaping(t *testing.T) {
+	t.Parallel()
+	var body string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = string(data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/api/v2/write", APIVersion2, "s", 1000)
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["my timer,x"] = map[string]gostatsd.Timer{
+		"": {
+			Count:       1,
+			Percentiles: gostatsd.Percentiles{{Float: 2, Str: "p 9,9=x"}},
+			Tags:        gostatsd.Tags{"a key:a,b=c d"},
+		},
+	}
+	client.disabledSubtypes = gostatsd.TimerSubtypes{
+		Lower: true, Upper: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true,
+	}
+	require.Equal(t, []error{nil}, sendMetrics(client, mm))
+	assert.Equal(t, `my\ timer\,x,a\ key=a\,b\=c\ d count=1,p\ 9\,9\=x=2 100`+"\n", body)
+}
+
+func TestSendMetricsInMultipleBatches(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, strings.Count(string(data), "\n"))
+		atomic.AddUint32(&requestNum, 1)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/api/v2/write", APIVersion2, "ns", 1)
+	errs := sendMetrics(client, metricsOneOfEach())
+	require.Len(t, errs, 4)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 4, atomic.LoadUint32(&requestNum))
+	assert.EqualValues(t, 4, atomic.LoadUint64(&client.batchesSent))
+}
+
+func TestSendMetricsPartialWrite(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requestNum, 1)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		_, _ = w.Write([]byte(`{"code":"unprocessable entity","message":"failure writing points to database: partial write: field type conflict: input field \"value\" on measurement \"g1\" is type float, already exists as type integer dropped=1"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/api/v2/write", APIVersion2, "ns", 1000)
+	require.Equal(t, []error{nil}, sendMetrics(client, metricsOneOfEach()))
+	assert.EqualValues(t, 1, atomic.LoadUint32(&requestNum)) // The points dropped would be dropped again
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.partialWrites))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.pointsRejected))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesSent))
+}
+
+func TestSendMetricsFailure(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v2/write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"code":"invalid","message":"unable to parse 'g1 value=': missing field value"}`))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/api/v2/write", APIVersion2, "ns", 1000)
+	client.maxRequestElapsedTime = -1
+	errs := sendMetrics(client, metricsOneOfEach())
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "[influxdb] received bad status code 400")
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesDropped))
+	assert.Zero(t, atomic.LoadUint64(&client.partialWrites))
+}
+
+func TestNewClientValidation(t *testing.T) {
+	t.Parallel()
+	p := newTestPool()
+	newClient := func(apiVersion, org, bucket, db, precision, token, username string) error {
+		_, err := NewClient("", apiVersion, org, bucket, db, "", precision, token, username, "", "agent", "default", 1000, defaultMaxRequests, time.Second, gostatsd.TimerSubtypes{}, p)
+		return err
+	}
+	assert.NoError(t, newClient(APIVersion2, "org", "bucket", "", "ns", "token", ""))
+	assert.NoError(t, newClient(APIVersion1, "", "", "db", "s", "", "user"))
+	assert.EqualError(t, newClient("v3", "org", "bucket", "", "ns", "", ""), "[influxdb] api-version must be v1 or v2")
+	assert.EqualError(t, newClient(APIVersion2, "org", "bucket", "", "m", "", ""), "[influxdb] precision must be one of ns, us, ms or s")
+	assert.EqualError(t, newClient(APIVersion2, "org", "", "", "ns", "", ""), "[influxdb] org and bucket are required for api-version v2")
+	assert.EqualError(t, newClient(APIVersion1, "", "", "", "ns", "", ""), "[influxdb] db is required for api-version v1")
+	assert.EqualError(t, newClient(APIVersion2, "org", "bucket", "", "ns", "token", "user"), "[influxdb] only one of username or token may be set")
+
+	client, err := NewClient("", APIVersion2, "my org", "b", "", "", "ns", "", "", "", "agent", "default", 1000, defaultMaxRequests, time.Second, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	assert.Equal(t, "http://localhost:8086/api/v2/write?bucket=b&org=my+org&precision=ns", client.writeURL)
+}
@@ -0,0 +1,154 @@
+package kafka
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+)
+
+const (
+	// FormatJSON serializes each metric as a line of JSON.
+	FormatJSON = "json"
+	// FormatAvro serializes each metric as an Avro single object encoding of AvroSchema.
+	FormatAvro = "avro"
+
+	// AvroSchema is the schema of metrics serialized as Avro, in Parsing Canonical Form.  The timestamp is the time of
+	// the flush in milliseconds since the epoch, and fields has an entry for each aggregation of the metric.
+	AvroSchema = `{"name":"gostatsd.Metric","type":"record","fields":[` +
+		`{"name":"name","type":"string"},` +
+		`{"name":"type","type":"string"},` +
+		`{"name":"host","type":"string"},` +
+		`{"name":"tags","type":{"type":"map","values":"string"}},` +
+		`{"name":"timestamp","type":"long"},` +
+		`{"name":"fields","type":{"type":"map","values":"double"}}]}`
+
+	// rabinEmpty is the initial value of the CRC-64-AVRO fingerprint.
+	rabinEmpty = 0xc15d213aa4d7a795
+)
+
+var (
+	rabinTable = makeRabinTable()
+	// avroHeader is the marker and schema fingerprint which starts every Avro single object encoding.
+	avroHeader = append([]byte{0xc3, 0x01}, fingerprint(AvroSchema)...)
+)
+
+// metric is a single flushed metric, which is serialized as the value of a message.
+type metric struct {
+	name       string
+	metricType string
+	host       string
+	tags       []lineprotocol.Tag
+	timestamp  int64 // Milliseconds since the epoch
+	fields     []lineprotocol.Field
+}
+
+// jsonMetric is the JSON representation of a metric.
+type jsonMetric struct {
+	Name      string             `json:"name"`
+	Type      string             `json:"type"`
+	Host      string             `json:"host,omitempty"`
+	Tags      map[string]string  `json:"tags,omitempty"`
+	Timestamp int64              `json:"timestamp"`
+	Fields    map[string]float64 `json:"fields"`
+}
+
+// finiteFields returns the fields which are not NaN or infinite, as they can't be represented in JSON.
+func finiteFields(fields []lineprotocol.Field) []lineprotocol.Field {
+	finite := fields[:0]
+	for _, f := range fields {
+		if !math.IsNaN(f.Value) && !math.IsInf(f.Value, 0) {
+			finite = append(finite, f)
+		}
+	}
+	return finite
+}
+
+// encodeJSON appends m to buf as a line of JSON.
+func encodeJSON(buf *bytes.Buffer, m *metric) error {
+	jm := jsonMetric{
+		Name:      m.name,
+		Type:      m.metricType,
+		Host:      m.host,
+		Timestamp: m.timestamp,
+		Fields:    make(map[string]float64, len(m.fields)),
+	}
+	if len(m.tags) > 0 {
+		jm.Tags = make(map[string]string, len(m.tags))
+		for _, t := range m.tags {
+			jm.Tags[t.Key] = t.Value
+		}
+	}
+	for _, f := range m.fields {
+		jm.Fields[f.Key] = f.Value
+	}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	// Encode appends a newline.
+	return encoder.Encode(&jm)
+}
+
+// encodeAvro appends the Avro single object encoding of m to buf.
+func encodeAvro(buf *bytes.Buffer, m *metric) error {
+	buf.Write(avroHeader)
+	avroString(buf, m.name)
+	avroString(buf, m.metricType)
+	avroString(buf, m.host)
+	if len(m.tags) > 0 {
+		avroLong(buf, int64(len(m.tags)))
+		for _, t := range m.tags {
+			avroString(buf, t.Key)
+			avroString(buf, t.Value)
+		}
+	}
+	avroLong(buf, 0)
+	avroLong(buf, m.timestamp)
+	if len(m.fields) > 0 {
+		avroLong(buf, int64(len(m.fields)))
+		for _, f := range m.fields {
+			avroString(buf, f.Key)
+			var scratch [8]byte
+			binary.LittleEndian.PutUint64(scratch[:], math.Float64bits(f.Value))
+			buf.Write(scratch[:])
+		}
+	}
+	avroLong(buf, 0)
+	return nil
+}
+
+// avroLong appends the zigzag variable length encoding of an Avro int or long.
+func avroLong(buf *bytes.Buffer, v int64) {
+	var scratch [binary.MaxVarintLen64]byte
+	buf.Write(scratch[:binary.PutVarint(scratch[:], v)])
+}
+
+func avroString(buf *bytes.Buffer, s string) {
+	avroLong(buf, int64(len(s)))
+	buf.WriteString(s)
+}
+
+func makeRabinTable() [256]uint64 {
+	var table [256]uint64
+	for i := range table {
+		fp := uint64(i)
+		for j := 0; j < 8; j++ {
+			fp = (fp >> 1) ^ (rabinEmpty & -(fp & 1))
+		}
+		table[i] = fp
+	}
+	return table
+}
+
+// fingerprint returns the little endian CRC-64-AVRO fingerprint of a schema, which identifies the schema in a single
+// object encoding.
+func fingerprint(schema string) []byte {
+	fp := uint64(rabinEmpty)
+	for i := 0; i < len(schema); i++ {
+		fp = (fp >> 8) ^ rabinTable[byte(fp)^schema[i]]
+	}
+	b := make([]byte, 8)
+	binary.LittleEndian.PutUint64(b, fp)
+	return b
+}
@@ -0,0 +1,465 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName      = "kafka"
+	defaultClientID  = "gostatsd"
+	defaultFormat    = FormatJSON
+	defaultAcks      = "all"
+	defaultTimeout   = 10 * time.Second
+	defaultCodecName = "none"
+	// defaultMaxAttempts is the default number of times a batch is written before it is dropped.  Only errors which
+	// Kafka marks as temporary, such as a partition leader moving, are retried.
+	defaultMaxAttempts = 3
+	// batchTimeout is how long the writer waits for more messages before sending a batch.  Every message of a flush
+	// is written at once, so there is no point waiting long.
+	batchTimeout = 10 * time.Millisecond
+	// defaultMaxBatchBytes is the default maximum size of the records sent to a partition in a single request, which
+	// is below the default maximum message size of a broker.
+	defaultMaxBatchBytes = 900 * 1024
+)
+
+// codecs are the compression codecs which can be configured, by name.
+var codecs = map[string]kafka.Compression{
+	"none":   0,
+	"gzip":   kafka.Gzip,
+	"snappy": kafka.Snappy,
+	"lz4":    kafka.Lz4,
+	"zstd":   kafka.Zstd,
+}
+
+// acksValues are the values of acks which can be configured, and the acknowledgements they request.
+var acksValues = map[string]kafka.RequiredAcks{
+	"all": kafka.RequireAll,
+	"-1":  kafka.RequireAll,
+	"0":   kafka.RequireNone,
+	"1":   kafka.RequireOne,
+}
+
+// messageWriter writes messages to a topic.  It is implemented by *kafka.Writer.
+type messageWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Client represents a Kafka producer, which sends every flushed metric as a message to a topic.
+type Client struct {
+	batchesCreated  uint64 // Accumulated number of record batches created
+	batchesDropped  uint64 // Accumulated number of record batches which failed to be delivered (data loss)
+	batchesSent     uint64 // Accumulated number of record batches successfully delivered
+	messagesDropped uint64 // Accumulated number of messages which failed to be delivered (data loss)
+	messagesSent    uint64 // Accumulated number of messages successfully delivered
+
+	writer messageWriter
+	encode func(*bytes.Buffer, *metric) error
+	now    func() time.Time // Returns current time. Useful for testing.
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// SendMetricsAsync flushes the metrics to Kafka, preparing payload synchronously but doing the send asynchronously.
+// The callback has a nil error if any message was delivered, and the first error of the messages which weren't, so
+// a flush is only retried when nothing was delivered.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	messages := c.processMetrics(metrics)
+	if len(messages) == 0 {
+		cb(nil)
+		return
+	}
+
+	go func() {
+		cb(c.write(ctx, messages))
+	}()
+}
+
+// write writes the messages, dropping any which are too large to be sent, and counts those delivered and dropped.
+func (c *Client) write(ctx context.Context, messages []kafka.Message) []error {
+	var tooLarge error
+	for {
+		err := c.writer.WriteMessages(ctx, messages...)
+		var mtl kafka.MessageTooLargeError
+		if errors.As(err, &mtl) {
+			log.Warnf("[%s] dropping message for %s larger than max-batch-bytes", BackendName, mtl.Message.Key)
+			atomic.AddUint64(&c.messagesDropped, 1)
+			if tooLarge == nil {
+				tooLarge = fmt.Errorf("[%s] %w", BackendName, err)
+			}
+			messages = mtl.Remaining
+			if len(messages) == 0 {
+				return []error{tooLarge}
+			}
+			continue
+		}
+
+		var errs []error
+		var writeErrs kafka.WriteErrors
+		switch {
+		case err == nil:
+			atomic.AddUint64(&c.messagesSent, uint64(len(messages)))
+			errs = []error{nil}
+		case errors.As(err, &writeErrs):
+			delivered := false
+			var failed error
+			for _, e := range writeErrs {
+				if e == nil {
+					delivered = true
+					atomic.AddUint64(&c.messagesSent, 1)
+					continue
+				}
+				atomic.AddUint64(&c.messagesDropped, 1)
+				if failed == nil {
+					failed = fmt.Errorf("[%s] %w", BackendName, e)
+				}
+			}
+			if delivered {
+				errs = append(errs, nil)
+			}
+			errs = append(errs, failed)
+		default:
+			atomic.AddUint64(&c.messagesDropped, uint64(len(messages)))
+			errs = []error{fmt.Errorf("[%s] %w", BackendName, err)}
+		}
+		if tooLarge != nil {
+			errs = append(errs, tooLarge)
+		}
+		return errs
+	}
+}
+
+// completed is called by the writer when it has finished with a batch of messages for a partition.
+func (c *Client) completed(messages []kafka.Message, err error) {
+	atomic.AddUint64(&c.batchesCreated, 1)
+	if err != nil {
+		atomic.AddUint64(&c.batchesDropped, 1)
+		return
+	}
+	atomic.AddUint64(&c.batchesSent, 1)
+}
+
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+	defer func() {
+		if err := c.writer.Close(); err != nil {
+			log.Warnf("[%s] failed to close writer: %v", BackendName, err)
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.messages_dropped", float64(atomic.LoadUint64(&c.messagesDropped)), nil)
+			statser.Gauge("backend.messages_sent", float64(atomic.LoadUint64(&c.messagesSent)), nil)
+		}
+	}
+}
+
+// processMetrics serializes every metric in to a message keyed by its name, so every series of a name is sent to the
+// same partition.  A counter has count and rate fields, a timer or distribution has a field for each aggregation, and
+// gauges and sets have a single value field.  Fields which are NaN or infinite are dropped, and a metric with no
+// fields left is not sent.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap) []kafka.Message {
+	timestamp := c.now().UnixNano() / int64(time.Millisecond)
+	var messages []kafka.Message
+	var buf bytes.Buffer
+	add := func(metricType, name, hostname string, tags gostatsd.Tags, fields []lineprotocol.Field) {
+		fields = finiteFields(fields)
+		if len(fields) == 0 {
+			return
+		}
+		buf.Reset()
+		m := &metric{
+			name:       name,
+			metricType: metricType,
+			host:       hostname,
+			tags:       lineprotocol.ConvertTags(tags, ""),
+			timestamp:  timestamp,
+			fields:     fields,
+		}
+		if err := c.encode(&buf, m); err != nil {
+			log.Warnf("[%s] unable to encode %s: %v", BackendName, name, err)
+			return
+		}
+		messages = append(messages, kafka.Message{Key: []byte(name), Value: append([]byte(nil), buf.Bytes()...)})
+	}
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		add("counter", key, counter.Hostname, counter.Tags, []lineprotocol.Field{
+			{Key: "count", Value: float64(counter.Value)},
+			{Key: "rate", Value: counter.PerSecond},
+		})
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		add("timer", key, timer.Hostname, timer.Tags, c.timerFields(timer))
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		add("distribution", key, dist.Hostname, dist.Tags, c.distributionFields(dist))
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		add("gauge", key, gauge.Hostname, gauge.Tags, []lineprotocol.Field{{Key: "value", Value: gauge.Value}})
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		add("set", key, set.Hostname, set.Tags, []lineprotocol.Field{{Key: "value", Value: float64(len(set.Values))}})
+	})
+
+	return messages
+}
+
+// timerFields returns the fields for the aggregations of a timer which aren't disabled.
+func (c *Client) timerFields(timer gostatsd.Timer) []lineprotocol.Field {
+	fields := make([]lineprotocol.Field, 0, 9+len(timer.Percentiles)+len(timer.Histogram))
+	if !c.disabledSubtypes.Lower {
+		fields = append(fields, lineprotocol.Field{Key: "lower", Value: timer.Min})
+	}
+	if !c.disabledSubtypes.Upper {
+		fields = append(fields, lineprotocol.Field{Key: "upper", Value: timer.Max})
+	}
+	if !c.disabledSubtypes.Count {
+		fields = append(fields, lineprotocol.Field{Key: "count", Value: float64(timer.Count)})
+	}
+	if !c.disabledSubtypes.CountPerSecond {
+		fields = append(fields, lineprotocol.Field{Key: "count_ps", Value: timer.PerSecond})
+	}
+	if !c.disabledSubtypes.Mean {
+		fields = append(fields, lineprotocol.Field{Key: "mean", Value: timer.Mean})
+	}
+	if !c.disabledSubtypes.Median {
+		fields = append(fields, lineprotocol.Field{Key: "median", Value: timer.Median})
+	}
+	if !c.disabledSubtypes.StdDev {
+		fields = append(fields, lineprotocol.Field{Key: "std", Value: timer.StdDev})
+	}
+	if !c.disabledSubtypes.Sum {
+		fields = append(fields, lineprotocol.Field{Key: "sum", Value: timer.Sum})
+	}
+	if !c.disabledSubtypes.SumSquares {
+		fields = append(fields, lineprotocol.Field{Key: "sum_squares", Value: timer.SumSquares})
+	}
+	for _, pct := range timer.Percentiles {
+		fields = append(fields, lineprotocol.Field{Key: pct.Str, Value: pct.Float})
+	}
+	for _, bucket := range timer.Histogram {
+		fields = append(fields, lineprotocol.Field{Key: bucket.Name, Value: float64(bucket.Count)})
+	}
+	return fields
+}
+
+// distributionFields returns the fields for the aggregations of a distribution which aren't disabled.
+func (c *Client) distributionFields(dist gostatsd.Timer) []lineprotocol.Field {
+	fields := make([]lineprotocol.Field, 0, 4+len(dist.Percentiles))
+	if !c.disabledSubtypes.DistributionMin {
+		fields = append(fields, lineprotocol.Field{Key: "min", Value: dist.Min})
+	}
+	if !c.disabledSubtypes.DistributionMax {
+		fields = append(fields, lineprotocol.Field{Key: "max", Value: dist.Max})
+	}
+	if !c.disabledSubtypes.DistributionCount {
+		fields = append(fields, lineprotocol.Field{Key: "count", Value: float64(dist.Count)})
+	}
+	if !c.disabledSubtypes.DistributionSum {
+		fields = append(fields, lineprotocol.Field{Key: "sum", Value: dist.Sum})
+	}
+	for _, pct := range dist.Percentiles {
+		fields = append(fields, lineprotocol.Field{Key: pct.Str, Value: pct.Float})
+	}
+	return fields
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// NewClientFromViper returns a new Kafka client.
+func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	k := util.GetSubViper(v, "kafka")
+	k.SetDefault("brokers", []string{})
+	k.SetDefault("topic", "")
+	k.SetDefault("format", defaultFormat)
+	k.SetDefault("client-id", defaultClientID)
+	k.SetDefault("acks", defaultAcks)
+	k.SetDefault("compression", defaultCodecName)
+	k.SetDefault("timeout", defaultTimeout)
+	k.SetDefault("max-batch-bytes", defaultMaxBatchBytes)
+	k.SetDefault("max-attempts", defaultMaxAttempts)
+	k.SetDefault("tls", false)
+	k.SetDefault("sasl-mechanism", "")
+	k.SetDefault("username", "")
+	k.SetDefault("password", "")
+
+	return NewClient(
+		k.GetStringSlice("brokers"),
+		k.GetString("topic"),
+		k.GetString("format"),
+		k.GetString("client-id"),
+		k.GetString("acks"),
+		k.GetString("compression"),
+		k.GetDuration("timeout"),
+		k.GetInt("max-batch-bytes"),
+		k.GetInt("max-attempts"),
+		k.GetBool("tls"),
+		k.GetString("sasl-mechanism"),
+		k.GetString("username"),
+		k.GetString("password"),
+		gostatsd.DisabledSubMetrics(v),
+	)
+}
+
+// NewClient returns a new Kafka client.  Brokers is the list of host:port addresses used to find the leaders of the
+// partitions of topic, which need not be every broker in the cluster.
+func NewClient(
+	brokers []string,
+	topic,
+	format,
+	clientID,
+	acks,
+	compression string,
+	timeout time.Duration,
+	maxBatchBytes,
+	maxAttempts int,
+	useTLS bool,
+	saslMechanism,
+	username,
+	password string,
+	disabled gostatsd.TimerSubtypes,
+) (*Client, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("[%s] brokers is required", BackendName)
+	}
+	if topic == "" {
+		return nil, fmt.Errorf("[%s] topic is required", BackendName)
+	}
+	var encode func(*bytes.Buffer, *metric) error
+	switch format {
+	case FormatJSON:
+		encode = encodeJSON
+	case FormatAvro:
+		encode = encodeAvro
+	default:
+		return nil, fmt.Errorf("[%s] format must be %s or %s", BackendName, FormatJSON, FormatAvro)
+	}
+	requiredAcks, ok := acksValues[strings.ToLower(acks)]
+	if !ok {
+		return nil, fmt.Errorf("[%s] acks must be all, -1, 0 or 1", BackendName)
+	}
+	codec, ok := codecs[strings.ToLower(compression)]
+	if !ok {
+		return nil, fmt.Errorf("[%s] compression must be none, gzip, snappy, lz4 or zstd", BackendName)
+	}
+	if timeout <= 0 {
+		return nil, fmt.Errorf("[%s] timeout must be positive", BackendName)
+	}
+	if maxBatchBytes <= 0 {
+		return nil, fmt.Errorf("[%s] max-batch-bytes must be positive", BackendName)
+	}
+	if maxAttempts <= 0 {
+		return nil, fmt.Errorf("[%s] max-attempts must be positive", BackendName)
+	}
+	mechanism, err := newSASLMechanism(saslMechanism, username, password)
+	if err != nil {
+		return nil, err
+	}
+	var tlsConfig *tls.Config
+	if useTLS {
+		tlsConfig = &tls.Config{}
+	}
+
+	log.WithFields(log.Fields{
+		"backend":         BackendName,
+		"brokers":         brokers,
+		"topic":           topic,
+		"format":          format,
+		"acks":            acks,
+		"compression":     compression,
+		"timeout":         timeout,
+		"max-batch-bytes": maxBatchBytes,
+		"max-attempts":    maxAttempts,
+		"tls":             useTLS,
+		"sasl-mechanism":  saslMechanism,
+	}).Info("created backend")
+
+	c := &Client{
+		encode:           encode,
+		now:              time.Now,
+		disabledSubtypes: disabled,
+	}
+	c.writer = &kafka.Writer{
+		Addr:         kafka.TCP(brokers...),
+		Topic:        topic,
+		Balancer:     &kafka.Murmur2Balancer{},
+		MaxAttempts:  maxAttempts,
+		BatchSize:    math.MaxInt32, // Batches are only limited by BatchBytes
+		BatchBytes:   int64(maxBatchBytes),
+		BatchTimeout: batchTimeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+		RequiredAcks: requiredAcks,
+		Completion:   c.completed,
+		Compression:  codec,
+		ErrorLogger:  kafka.LoggerFunc(log.WithField("backend", BackendName).Debugf),
+		Transport: &kafka.Transport{
+			DialTimeout: timeout,
+			ClientID:    clientID,
+			TLS:         tlsConfig,
+			SASL:        mechanism,
+		},
+	}
+	return c, nil
+}
+
+// newSASLMechanism returns the SASL mechanism to authenticate with, or nil if there is none.
+func newSASLMechanism(name, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToLower(name) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("[%s] sasl-mechanism must be plain, scram-sha-256 or scram-sha-512", BackendName)
+	}
+}
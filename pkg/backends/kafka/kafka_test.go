@@ -0,0 +1,440 @@
+package kafka
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func metricsOneOfEach() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"tag1": {PerSecond: 1.5, Value: 15, Hostname: "h1", Tags: gostatsd.Tags{"tag1"}},
+	}
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"a:b": {
+			Count:      3,
+			PerSecond:  0.3,
+			Mean:       0.5,
+			Median:     0.5,
+			Min:        0,
+			Max:        1,
+			StdDev:     0.5,
+			Sum:        1.5,
+			SumSquares: 1.25,
+			Values:     []float64{0, 0.5, 1},
+			Percentiles: gostatsd.Percentiles{
+				gostatsd.Percentile{Float: 1, Str: "upper_90"},
+			},
+			Tags: gostatsd.Tags{"a:b"},
+		},
+	}
+	mm.Gauges["g.1"] = map[string]gostatsd.Gauge{
+		"":  {Value: 3, Hostname: "h3"},
+		"x": {Value: math.NaN(), Tags: gostatsd.Tags{"x"}},
+	}
+	mm.Sets["users"] = map[string]gostatsd.Set{
+		"c-d:e": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Tags: gostatsd.Tags{"c-d:e"}},
+	}
+	return mm
+}
+
+func newTestClient(t *testing.T, brokers []string, format string, disabled gostatsd.TimerSubtypes) *Client {
+	client, err := NewClient(brokers, "metrics", format, "test", "all", "none", time.Second, defaultMaxBatchBytes, defaultMaxAttempts, false, "", "", "", disabled)
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	return client
+}
+
+func TestProcessMetricsJSON(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{Mean: true, SumSquares: true})
+	records := client.processMetrics(metricsOneOfEach())
+	values := map[string]string{}
+	for _, r := range records {
+		assert.True(t, bytes.HasSuffix(r.Value, []byte("\n")))
+		values[string(r.Key)] = string(r.Value)
+	}
+	assert.Equal(t, map[string]string{
+		"c1":    `{"name":"c1","type":"counter","host":"h1","tags":{"unnamed":"tag1"},"timestamp":100000,"fields":{"count":15,"rate":1.5}}` + "\n",
+		"t1":    `{"name":"t1","type":"timer","tags":{"a":"b"},"timestamp":100000,"fields":{"count":3,"count_ps":0.3,"lower":0,"median":0.5,"std":0.5,"sum":1.5,"upper":1,"upper_90":1}}` + "\n",
+		"g.1":   `{"name":"g.1","type":"gauge","host":"h3","timestamp":100000,"fields":{"value":3}}` + "\n",
+		"users": `{"name":"users","type":"set","tags":{"c-d":"e"},"timestamp":100000,"fields":{"value":2}}` + "\n",
+	}, values)
+	assert.Len(t, records, 4)
+}
+
+func TestProcessMetricsTimerHistogram(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{Lower: true, Upper: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true})
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count:       3,
+		Percentiles: gostatsd.Percentiles{{Str: "upper_90", Float: 12.5}},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+	records := client.processMetrics(mm)
+	require.Len(t, records, 1)
+	assert.Equal(t, `{"name":"t1","type":"timer","timestamp":100000,"fields":{"count":3,"histogram.le_10":2,"histogram.le_inf":3,"upper_90":12.5}}`+"\n", string(records[0].Value))
+}
+
+// decodeAvro decodes a single object encoding of AvroSchema.
+func decodeAvro(t *testing.T, b []byte) map[string]interface{} {
+	require.True(t, bytes.HasPrefix(b, avroHeader))
+	b = b[len(avroHeader):]
+	long := func() int64 {
+		v, n := binary.Varint(b)
+		require.True(t, n > 0)
+		b = b[n:]
+		return v
+	}
+	str := func() string {
+		n := long()
+		s := string(b[:n])
+		b = b[n:]
+		return s
+	}
+	m := map[string]interface{}{"name": str(), "type": str(), "host": str()}
+	tags := map[string]string{}
+	for n := long(); n != 0; n = long() {
+		for i := int64(0); i < n; i++ {
+			k := str()
+			tags[k] = str()
+		}
+	}
+	m["tags"] = tags
+	m["timestamp"] = long()
+	fields := map[string]float64{}
+	for n := long(); n != 0; n = long() {
+		for i := int64(0); i < n; i++ {
+			k := str()
+			fields[k] = math.Float64frombits(binary.LittleEndian.Uint64(b))
+			b = b[8:]
+		}
+	}
+	m["fields"] = fields
+	require.Empty(t, b)
+	return m
+}
+
+func TestProcessMetricsAvro(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatAvro, gostatsd.TimerSubtypes{})
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"tag1": {PerSecond: 1.5, Value: 15, Hostname: "h1", Tags: gostatsd.Tags{"env:prod"}},
+	}
+	mm.Gauges["g.1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3},
+	}
+	records := client.processMetrics(mm)
+	require.Len(t, records, 2)
+	assert.Equal(t, map[string]interface{}{
+		"name":      "c1",
+		"type":      "counter",
+		"host":      "h1",
+		"tags":      map[string]string{"env": "prod"},
+		"timestamp": int64(100000),
+		"fields":    map[string]float64{"count": 15, "rate": 1.5},
+	}, decodeAvro(t, records[0].Value))
+	assert.Equal(t, map[string]interface{}{
+		"name":      "g.1",
+		"type":      "gauge",
+		"host":      "",
+		"tags":      map[string]string{},
+		"timestamp": int64(100000),
+		"fields":    map[string]float64{"value": 3},
+	}, decodeAvro(t, records[1].Value))
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("kafka.brokers", []string{"localhost:9092"})
+	v.Set("kafka.topic", "metrics")
+	v.Set("kafka.compression", "snappy")
+	v.Set("kafka.acks", "1")
+	v.Set("kafka.tls", true)
+	v.Set("kafka.sasl-mechanism", "SCRAM-SHA-512")
+	v.Set("kafka.username", "user")
+	v.Set("kafka.password", "pass")
+	backend, err := NewClientFromViper(v, nil)
+	require.NoError(t, err)
+	writer := backend.(*Client).writer.(*kafka.Writer)
+	assert.Equal(t, kafka.Snappy, writer.Compression)
+	assert.Equal(t, kafka.RequireOne, writer.RequiredAcks)
+	assert.Equal(t, defaultMaxAttempts, writer.MaxAttempts)
+	assert.EqualValues(t, defaultMaxBatchBytes, writer.BatchBytes)
+	assert.IsType(t, &kafka.Murmur2Balancer{}, writer.Balancer)
+	transport := writer.Transport.(*kafka.Transport)
+	assert.Equal(t, defaultClientID, transport.ClientID)
+	assert.NotNil(t, transport.TLS)
+	assert.Equal(t, "SCRAM-SHA-512", transport.SASL.Name())
+
+	for key, value := range map[string]interface{}{
+		"topic":          "",
+		"format":         "xml",
+		"acks":           "2",
+		"compression":    "lzma",
+		"max-attempts":   0,
+		"sasl-mechanism": "gssapi",
+	} {
+		v := viper.New()
+		v.Set("kafka.brokers", []string{"localhost:9092"})
+		v.Set("kafka.topic", "metrics")
+		v.Set("kafka."+key, value)
+		_, err := NewClientFromViper(v, nil)
+		assert.Error(t, err, key)
+	}
+}
+
+// fakeWriter records the messages written to it, and fails each message with an error from errs for its key.
+type fakeWriter struct {
+	mu       sync.Mutex
+	errs     map[string]error
+	maxBytes int
+	wait     bool
+	written  []kafka.Message
+}
+
+func (fw *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	if fw.wait {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	for i, msg := range msgs {
+		if fw.maxBytes > 0 && len(msg.Key)+len(msg.Value) > fw.maxBytes {
+			remaining := append(append([]kafka.Message(nil), msgs[:i]...), msgs[i+1:]...)
+			return kafka.MessageTooLargeError{Message: msg, Remaining: remaining}
+		}
+	}
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	var werr kafka.WriteErrors
+	for i, msg := range msgs {
+		if err := fw.errs[string(msg.Key)]; err != nil {
+			if werr == nil {
+				werr = make(kafka.WriteErrors, len(msgs))
+			}
+			werr[i] = err
+			continue
+		}
+		fw.written = append(fw.written, msg)
+	}
+	if werr != nil {
+		return werr
+	}
+	return nil
+}
+
+func (fw *fakeWriter) Close() error {
+	return nil
+}
+
+func (fw *fakeWriter) keys() []string {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	keys := make([]string, 0, len(fw.written))
+	for _, msg := range fw.written {
+		keys = append(keys, string(msg.Key))
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sendMetrics(client *Client, mm *gostatsd.MetricMap) []error {
+	var errs []error
+	done := make(chan struct{})
+	client.SendMetricsAsync(context.Background(), mm, func(e []error) {
+		errs = e
+		close(done)
+	})
+	<-done
+	return errs
+}
+
+func gauges(names ...string) *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	for _, name := range names {
+		mm.Receive(&gostatsd.Metric{Name: name, Value: 1, Type: gostatsd.GAUGE})
+	}
+	return mm
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{})
+	fw := &fakeWriter{}
+	client.writer = fw
+
+	mm := gostatsd.NewMetricMap()
+	for i := 0; i < 20; i++ {
+		mm.Receive(&gostatsd.Metric{Name: "m" + strconv.Itoa(i), Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:1"}})
+		mm.Receive(&gostatsd.Metric{Name: "m" + strconv.Itoa(i), Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"a:2"}})
+	}
+	assert.Equal(t, []error{nil}, sendMetrics(client, mm))
+	assert.Len(t, fw.keys(), 40)
+	assert.EqualValues(t, 40, client.messagesSent)
+	assert.Zero(t, client.messagesDropped)
+}
+
+func TestSendMetricsPartialFailure(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{})
+	fw := &fakeWriter{errs: map[string]error{"b": kafka.NotLeaderForPartition}}
+	client.writer = fw
+
+	errs := sendMetrics(client, gauges("a", "b"))
+	require.Len(t, errs, 2)
+	assert.NoError(t, errs[0])
+	assert.True(t, errors.Is(errs[1], kafka.NotLeaderForPartition))
+	assert.Equal(t, []string{"a"}, fw.keys())
+	assert.EqualValues(t, 1, client.messagesSent)
+	assert.EqualValues(t, 1, client.messagesDropped)
+}
+
+func TestSendMetricsFailure(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{})
+	client.writer = &fakeWriter{errs: map[string]error{"a": kafka.NotLeaderForPartition, "b": kafka.NotLeaderForPartition}}
+
+	errs := sendMetrics(client, gauges("a", "b"))
+	require.Len(t, errs, 1)
+	assert.EqualError(t, errs[0], "[kafka] "+kafka.NotLeaderForPartition.Error())
+	assert.Zero(t, client.messagesSent)
+	assert.EqualValues(t, 2, client.messagesDropped)
+}
+
+func TestSendMetricsTooLarge(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{})
+	fw := &fakeWriter{maxBytes: 100}
+	client.writer = fw
+
+	errs := sendMetrics(client, gauges("a", strings.Repeat("b", 100), "c"))
+	require.Len(t, errs, 2)
+	assert.NoError(t, errs[0])
+	assert.Error(t, errs[1])
+	assert.Equal(t, []string{"a", "c"}, fw.keys())
+	assert.EqualValues(t, 2, client.messagesSent)
+	assert.EqualValues(t, 1, client.messagesDropped)
+}
+
+func TestSendMetricsContextDone(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{})
+	client.writer = &fakeWriter{wait: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	done := make(chan []error)
+	client.SendMetricsAsync(ctx, gauges("m"), func(errs []error) {
+		done <- errs
+	})
+	select {
+	case errs := <-done:
+		require.Len(t, errs, 1)
+		assert.True(t, errors.Is(errs[0], context.DeadlineExceeded))
+		assert.EqualValues(t, 1, client.messagesDropped)
+	case <-time.After(time.Second):
+		t.Fatal("send was not cancelled")
+	}
+}
+
+func TestCompleted(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, []string{"localhost:9092"}, FormatJSON, gostatsd.TimerSubtypes{})
+	client.completed(make([]kafka.Message, 2), nil)
+	client.completed(make([]kafka.Message, 1), kafka.RequestTimedOut)
+	assert.EqualValues(t, 2, client.batchesCreated)
+	assert.EqualValues(t, 1, client.batchesSent)
+	assert.EqualValues(t, 1, client.batchesDropped)
+}
+
+func TestSendMetricsNoBrokers(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := listener.Addr().String()
+	require.NoError(t, listener.Close())
+	client := newTestClient(t, []string{addr}, FormatJSON, gostatsd.TimerSubtypes{})
+	defer client.writer.Close()
+
+	errs := sendMetrics(client, gauges("m"))
+	require.Len(t, errs, 1)
+	assert.Error(t, errs[0])
+	assert.EqualValues(t, 1, client.messagesDropped)
+}
+
+// TestSendMetricsToBroker produces to a real broker, and is skipped unless GOSTATSD_TEST_KAFKA_BROKERS is set to a
+// comma separated list of brokers which allow topics to be created automatically.
+func TestSendMetricsToBroker(t *testing.T) {
+	t.Parallel()
+	brokers := os.Getenv("GOSTATSD_TEST_KAFKA_BROKERS")
+	if brokers == "" {
+		t.Skip("GOSTATSD_TEST_KAFKA_BROKERS is not set")
+	}
+	topic := "gostatsd-test-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	client, err := NewClient(strings.Split(brokers, ","), topic, FormatJSON, "test", "all", "gzip", 10*time.Second, 500, defaultMaxAttempts, false, "", "", "", gostatsd.TimerSubtypes{})
+	require.NoError(t, err)
+	defer client.writer.Close()
+
+	conn, err := kafka.DialLeader(context.Background(), "tcp", strings.Split(brokers, ",")[0], topic, 0)
+	require.NoError(t, err)
+	require.NoError(t, conn.Close())
+
+	names := make([]string, 20)
+	for i := range names {
+		names[i] = "m" + strconv.Itoa(i)
+	}
+	// Topic creation can take a while to propagate, so the first flushes may fail with a temporary error.
+	var errs []error
+	for attempt := 0; attempt < 10; attempt++ {
+		if errs = sendMetrics(client, gauges(names...)); len(errs) == 1 && errs[0] == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	require.Equal(t, []error{nil}, errs)
+	assert.True(t, client.batchesSent > 1) // max-batch-bytes of 500 splits the messages in to several batches
+
+	reader := kafka.NewReader(kafka.ReaderConfig{Brokers: strings.Split(brokers, ","), Topic: topic, Partition: 0})
+	defer reader.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	msg, err := reader.ReadMessage(ctx)
+	require.NoError(t, err)
+	assert.Contains(t, string(msg.Value), `"type":"gauge"`)
+}
+
+func TestJSONIsValid(t *testing.T) {
+	t.Parallel()
+	var buf bytes.Buffer
+	require.NoError(t, encodeJSON(&buf, &metric{name: "a\"b", metricType: "gauge", timestamp: 1}))
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, "a\"b", decoded["name"])
+}
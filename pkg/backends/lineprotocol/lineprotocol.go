@@ -0,0 +1,104 @@
+package lineprotocol
+
+import (
+	"bytes"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// UnnamedTagKey is the key used for gostatsd tags which have no key.
+const UnnamedTagKey = "unnamed"
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+)
+
+// Tag is a single tag of a line.
+type Tag struct {
+	Key   string
+	Value string
+}
+
+// Field is a single field of a line.
+type Field struct {
+	Key   string
+	Value float64
+}
+
+// ConvertTags converts gostatsd tags of the form key:value to line protocol tags, sorted by key as recommended by
+// the line protocol.  A tag without a key is given the key UnnamedTagKey, and tags with an empty value are dropped
+// as they can't be represented.  If there is no host tag, one is added for hostname if it is not empty.  Only the
+// first tag with each key is kept.
+func ConvertTags(tags gostatsd.Tags, hostname string) []Tag {
+	result := make([]Tag, 0, len(tags)+1)
+	haveHost := false
+	for _, tag := range tags {
+		t := Tag{Key: UnnamedTagKey, Value: tag}
+		if idx := strings.IndexByte(tag, ':'); idx != -1 {
+			t = Tag{Key: tag[:idx], Value: tag[idx+1:]}
+		}
+		if t.Key == "" || t.Value == "" {
+			continue
+		}
+		if t.Key == "host" {
+			haveHost = true
+		}
+		result = append(result, t)
+	}
+	if !haveHost && hostname != "" {
+		result = append(result, Tag{Key: "host", Value: hostname})
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	deduped := result[:0]
+	for i, t := range result {
+		if i > 0 && t.Key == result[i-1].Key {
+			continue
+		}
+		deduped = append(deduped, t)
+	}
+	return deduped
+}
+
+// AppendLine writes a single line for the measurement to buf, with a timestamp in the precision expected by the
+// receiver.  Fields which are NaN or infinite can't be represented and are skipped, and if there are no fields
+// left nothing is written.  It returns true if a line was written.
+func AppendLine(buf *bytes.Buffer, measurement string, tags []Tag, fields []Field, timestamp int64) bool {
+	written := 0
+	for _, field := range fields {
+		if math.IsNaN(field.Value) || math.IsInf(field.Value, 0) {
+			continue
+		}
+		if written == 0 {
+			_, _ = measurementEscaper.WriteString(buf, measurement)
+			for _, tag := range tags {
+				buf.WriteByte(',')
+				_, _ = keyEscaper.WriteString(buf, tag.Key)
+				buf.WriteByte('=')
+				_, _ = keyEscaper.WriteString(buf, tag.Value)
+			}
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		_, _ = keyEscaper.WriteString(buf, field.Key)
+		buf.WriteByte('=')
+		var scratch [32]byte
+		buf.Write(strconv.AppendFloat(scratch[:0], field.Value, 'f', -1, 64))
+		written++
+	}
+	if written == 0 {
+		return false
+	}
+	buf.WriteByte(' ')
+	var scratch [20]byte
+	buf.Write(strconv.AppendInt(scratch[:0], timestamp, 10))
+	buf.WriteByte('\n')
+	return true
+}
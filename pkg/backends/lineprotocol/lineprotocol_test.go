@@ -0,0 +1,46 @@
+package lineprotocol
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestConvertTags(t *testing.T) {
+	t.Parallel()
+	tags := ConvertTags(gostatsd.Tags{"b:2", "a:1", "flag", "empty:", ":novalue", "b:3"}, "h1")
+	expected := []Tag{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2"},
+		{Key: "host", Value: "h1"},
+		{Key: "unnamed", Value: "flag"},
+	}
+	assert.Equal(t, expected, tags)
+
+	// An explicit host tag takes precedence over the hostname
+	tags = ConvertTags(gostatsd.Tags{"host:h2"}, "h1")
+	assert.Equal(t, []Tag{{Key: "host", Value: "h2"}}, tags)
+
+	assert.Empty(t, ConvertTags(nil, ""))
+}
+
+func TestAppendLine(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	tags := []Tag{{Key: "a key", Value: "a,b=c"}}
+	fields := []Field{{Key: "count", Value: 5}, {Key: "bad", Value: math.NaN()}, {Key: "rate", Value: 0.25}}
+	assert.True(t, AppendLine(buf, "my metric,x", tags, fields, 1234))
+	assert.Equal(t, "my\\ metric\\,x,a\\ key=a\\,b\\=c count=5,rate=0.25 1234\n", buf.String())
+
+	buf.Reset()
+	assert.True(t, AppendLine(buf, "m", nil, []Field{{Key: "value", Value: 1e21}}, 1))
+	assert.Equal(t, "m value=1000000000000000000000 1\n", buf.String())
+
+	buf.Reset()
+	assert.False(t, AppendLine(buf, "m", nil, []Field{{Key: "value", Value: math.Inf(1)}}, 1))
+	assert.Empty(t, buf.String())
+}
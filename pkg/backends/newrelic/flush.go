@@ -89,6 +89,11 @@ func (f *flush) addTimerMetric(n *Client, metricType string, timer gostatsd.Time
 				f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
 			}
 		}
+		// Histogram buckets are counts rather than percentiles.
+		for _, bucket := range timer.Histogram {
+			gaugeMetric := newDimensionalMetricSet(n, f, name+"."+bucket.Name, "gauge", float64(bucket.Count), timer.Tags, timer.Timestamp)
+			f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
+		}
 		f.ts.Metrics = append(f.ts.Metrics, timerMetric)
 	} else {
 		timerMetric := newMetricSet(n, f, name, metricType, float64(timer.Count), timer.Tags, timer.Timestamp)
@@ -123,10 +128,57 @@ func (f *flush) addTimerMetric(n *Client, metricType string, timer gostatsd.Time
 		for _, pct := range timer.Percentiles {
 			timerMetric[pct.Str] = pct.Float
 		}
+		for _, bucket := range timer.Histogram {
+			timerMetric[bucket.Name] = float64(bucket.Count)
+		}
 		f.ts.Metrics = append(f.ts.Metrics, timerMetric)
 	}
 }
 
+// addDistributionMetric adds a distribution metric to the series.
+func (f *flush) addDistributionMetric(n *Client, metricType string, dist gostatsd.Timer, tagsKey, name string) {
+	if n.flushType == flushTypeMetrics {
+		distMetric := newDimensionalMetricSet(n, f, name, metricType, float64(dist.Count), dist.Tags, dist.Timestamp)
+
+		distMetric.Value = map[string]float64{
+			"count": float64(dist.Count),
+			"sum":   dist.Sum,
+			"min":   dist.Min,
+			"max":   dist.Max,
+		}
+
+		// Distribution percentiles are named p<N>, see the timer percentiles above for the format
+		for _, pct := range dist.Percentiles {
+			gaugeMetric := newDimensionalMetricSet(n, f, name+".percentiles", "gauge", pct.Float, dist.Tags, dist.Timestamp)
+			percentileResult, err := strconv.ParseFloat(strings.TrimPrefix(pct.Str, "p"), 64) // eg. for p99 will return 99
+			if err == nil {
+				gaugeMetric.Attributes["percentile"] = percentileResult
+				f.ts.Metrics = append(f.ts.Metrics, gaugeMetric)
+			}
+		}
+		f.ts.Metrics = append(f.ts.Metrics, distMetric)
+	} else {
+		distMetric := newMetricSet(n, f, name, metricType, float64(dist.Count), dist.Tags, dist.Timestamp)
+
+		if !n.disabledSubtypes.DistributionMin {
+			distMetric[n.timerMin] = dist.Min
+		}
+		if !n.disabledSubtypes.DistributionMax {
+			distMetric[n.timerMax] = dist.Max
+		}
+		if !n.disabledSubtypes.DistributionCount {
+			distMetric[n.timerCount] = float64(dist.Count)
+		}
+		if !n.disabledSubtypes.DistributionSum {
+			distMetric[n.timerSum] = dist.Sum
+		}
+		for _, pct := range dist.Percentiles {
+			distMetric[pct.Str] = pct.Float
+		}
+		f.ts.Metrics = append(f.ts.Metrics, distMetric)
+	}
+}
+
 func (f *flush) maybeFlush() {
 	if uint(len(f.ts.Metrics))+20 >= f.metricsPerBatch { // flush before it reaches max size and grows the slice
 		f.cb(f.ts)
@@ -183,7 +235,7 @@ func newDimensionalMetricSet(n *Client, f *flush, metricName, Type string, Value
 
 	n.setTags(tags, metricSet.Attributes)
 	switch Type {
-	case "timer":
+	case "timer", "distribution":
 		metricSet.Type = "summary"
 		metricSet.Name = metricSet.Name + ".summary"
 	case "counter":
@@ -12,6 +12,7 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -74,10 +75,11 @@ type Client struct {
 	timerSum        string
 	timerSumSquares string
 
-	batchesCreated uint64 // Accumulated number of batches created
-	batchesRetried uint64 // Accumulated number of batches retried (first send is not a retry)
-	batchesDropped uint64 // Accumulated number of batches aborted (data loss)
-	batchesSent    uint64 // Accumulated number of batches successfully sent
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
 
 	userAgent             string
 	maxRequestElapsedTime time.Duration
@@ -183,6 +185,7 @@ func (n *Client) RunMetrics(ctx context.Context, statser stats.Statser) {
 			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&n.batchesRetried)), nil)
 			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&n.batchesDropped)), nil)
 			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&n.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&n.batchesThrottled)), nil)
 		}
 	}
 }
@@ -218,20 +221,40 @@ func (n *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*timeSeries
 		fl.maybeFlush()
 	})
 
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		fl.addDistributionMetric(n, "distribution", dist, tagsKey, key)
+		fl.maybeFlush()
+	})
+
 	fl.finish()
 }
 
 // SendEvent sends an event to New Relic.
 func (n *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return n.sendEvents(ctx, n.EventFormatter(e))
+}
+
+// SendEvents sends the events to New Relic in a single request.
+func (n *Client) SendEvents(ctx context.Context, events []*gostatsd.Event) error {
+	data := make([]interface{}, 0, len(events))
+	for _, e := range events {
+		data = append(data, n.eventData(e))
+	}
+	return n.sendEvents(ctx, n.eventsPayload(data))
+}
+
+func (n *Client) sendEvents(ctx context.Context, data interface{}) error {
 	if n.address != "" {
-		// Event format depends on flush type
-		data := n.EventFormatter(e)
 		b, err := json.Marshal(data)
 		if err != nil {
 			return err
 		}
+		var buffer bytes.Buffer
+		if err := n.encodeBody(&buffer, b); err != nil {
+			return err
+		}
 
-		post, err := n.postWrapper(ctx, b, "events")
+		post, err := n.postWrapper(ctx, buffer.Bytes(), "events")
 		if err != nil {
 			return err
 		}
@@ -243,6 +266,10 @@ func (n *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
 
 // EventFormatter formats gostatsd events
 func (n *Client) EventFormatter(e *gostatsd.Event) interface{} {
+	return n.eventsPayload([]interface{}{n.eventData(e)})
+}
+
+func (n *Client) eventData(e *gostatsd.Event) map[string]interface{} {
 	event := map[string]interface{}{
 		"name":           "event",
 		"Title":          e.Title,
@@ -259,11 +286,20 @@ func (n *Client) EventFormatter(e *gostatsd.Event) interface{} {
 	switch n.flushType {
 	case flushTypeInsights, flushTypeMetrics:
 		event["eventType"] = n.eventType
-		return []interface{}{event}
 	default:
 		event["event_type"] = n.eventType
+	}
+	return event
+}
+
+// eventsPayload returns the body of a request sending the formatted events, which depends on the flush type.
+func (n *Client) eventsPayload(events []interface{}) interface{} {
+	switch n.flushType {
+	case flushTypeInsights, flushTypeMetrics:
+		return events
+	default:
 		return newInfraPayload(map[string]interface{}{
-			"metrics": []interface{}{event},
+			"metrics": events,
 		})
 	}
 }
@@ -288,10 +324,13 @@ func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{
 			return nil
 		}
 
-		next := b.NextBackOff()
+		next, throttled := util.NextRetry(b, err)
+		if throttled {
+			atomic.AddUint64(&n.batchesThrottled, 1)
+		}
 		if next == backoff.Stop {
 			atomic.AddUint64(&n.batchesDropped, 1)
-			return fmt.Errorf("[%s] %v", BackendName, err)
+			return fmt.Errorf("[%s] %w", BackendName, err)
 		}
 
 		log.Warnf("[%s] failed to send, sleeping for %s: %v", BackendName, next, err)
@@ -309,57 +348,68 @@ func (n *Client) post(ctx context.Context, buffer *bytes.Buffer, data interface{
 }
 
 func (n *Client) constructPost(ctx context.Context, buffer *bytes.Buffer, data interface{}) (func() error /*doPost*/, error) {
-	var mJSON []byte
-	var mErr error
+	var NRPayload interface{}
 	switch n.flushType {
 	case flushTypeInsights:
-		NRPayload := data.(*timeSeries).Metrics
-		mJSON, mErr = json.Marshal(NRPayload)
+		NRPayload = data.(*timeSeries).Metrics
 	case flushTypeMetrics:
-		NRPayload := n.newMetricsPayload(data.(*timeSeries).Metrics)
-		mJSON, mErr = json.Marshal([]interface{}{NRPayload})
+		NRPayload = []interface{}{n.newMetricsPayload(data.(*timeSeries).Metrics)}
 	default:
-		NRPayload := newInfraPayload(data)
-		mJSON, mErr = json.Marshal(NRPayload)
+		NRPayload = newInfraPayload(data)
 	}
 
-	if mErr != nil {
-		return nil, fmt.Errorf("[%s] unable to marshal: %v", BackendName, mErr)
+	mJSON := jsonBufferPool.Get()
+	defer jsonBufferPool.Put(mJSON)
+	if err := json.NewEncoder(mJSON).Encode(NRPayload); err != nil {
+		return nil, fmt.Errorf("[%s] unable to marshal: %v", BackendName, err)
 	}
+	mJSON.Truncate(mJSON.Len() - 1) // Encode appends a newline, which json.Marshal doesn't
 
-	return n.postWrapper(ctx, mJSON, "metrics")
+	if err := n.encodeBody(buffer, mJSON.Bytes()); err != nil {
+		return nil, fmt.Errorf("[%s] unable to compress: %v", BackendName, err)
+	}
+	return n.postWrapper(ctx, buffer.Bytes(), "metrics")
+}
+
+// compressed returns true if request bodies must be compressed.
+//
+// Insights Event API requires gzip or deflate compression
+// https://docs.newrelic.com/docs/insights/insights-data-sources/custom-data/introduction-event-api#h2-basic-workflow
+// Metrics API requires gzip or identity
+// https://docs.newrelic.com/docs/data-ingest-apis/get-data-new-relic/metric-api/report-metrics-metric-api#headers-query-parameters
+// Use GZIP as standard across both
+func (n *Client) compressed() bool {
+	return (n.flushType == flushTypeInsights || n.flushType == flushTypeMetrics) && n.apiKey != ""
+}
+
+// encodeBody writes the request body for json to buffer, compressing it if required.
+func (n *Client) encodeBody(buffer *bytes.Buffer, json []byte) error {
+	if !n.compressed() {
+		_, err := buffer.Write(json)
+		return err
+	}
+	zw := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(zw)
+	zw.Reset(buffer)
+	if _, err := zw.Write(json); err != nil {
+		return err
+	}
+	// Close to ensure a flush
+	return zw.Close()
 }
 
-// postWrapper compresses JSON for Insights
-func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string) (func() error, error) {
+// postWrapper returns a function to post body, which must already be compressed if required.  The function can be
+// called again to retry.
+func (n *Client) postWrapper(ctx context.Context, body []byte, dataType string) (func() error, error) {
 	return func() error {
 		headers := map[string]string{
 			"Content-Type": "application/json",
 			"User-Agent":   n.userAgent,
 		}
 
-		// Insights Event API requires gzip or deflate compression
-		// https://docs.newrelic.com/docs/insights/insights-data-sources/custom-data/introduction-event-api#h2-basic-workflow
-		// Metrics API requires gzip or identity
-		// https://docs.newrelic.com/docs/data-ingest-apis/get-data-new-relic/metric-api/report-metrics-metric-api#headers-query-parameters
-		// Use GZIP as standard across both
-		if (n.flushType == flushTypeInsights || n.flushType == flushTypeMetrics) && n.apiKey != "" {
+		if n.compressed() {
 			headers["X-Insert-Key"] = n.apiKey
 			headers["Content-Encoding"] = "gzip"
-
-			// compress json
-			var buf bytes.Buffer
-			zw := gzip.NewWriter(&buf)
-			_, err := zw.Write([]byte(json))
-			if err != nil {
-				return err
-			}
-
-			// Close to ensure a flush
-			if err := zw.Close(); err != nil {
-				return err
-			}
-			json = buf.Bytes()
 		}
 
 		address := n.address
@@ -367,7 +417,7 @@ func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string)
 			address = n.addressMetrics
 		}
 
-		req, err := http.NewRequest("POST", address, bytes.NewBuffer(json))
+		req, err := http.NewRequest("POST", address, bytes.NewReader(body))
 		if err != nil {
 			return fmt.Errorf("unable to create http.Request: %v", err)
 		}
@@ -377,7 +427,7 @@ func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string)
 		}
 		resp, err := n.client.Do(req)
 		if err != nil {
-			return fmt.Errorf("error POSTing: %s", err.Error())
+			return fmt.Errorf("error POSTing: %w", err)
 		}
 		defer resp.Body.Close()
 		body := io.LimitReader(resp.Body, maxResponseSize)
@@ -387,7 +437,7 @@ func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string)
 				"status": resp.StatusCode,
 				"body":   b,
 			}).Infof("[%s] failed request", BackendName)
-			return fmt.Errorf("received bad status code %d", resp.StatusCode)
+			return util.NewStatusError(resp)
 		}
 		_, _ = io.Copy(ioutil.Discard, body)
 		return nil
@@ -395,6 +445,17 @@ func (n *Client) postWrapper(ctx context.Context, json []byte, dataType string)
 
 }
 
+var (
+	// jsonBufferPool holds buffers for the uncompressed JSON of each batch, which is only needed until it's compressed.
+	jsonBufferPool = util.NewBufferPool(0)
+	// gzipWriterPool holds gzip writers for reuse, as each allocates large internal buffers.
+	gzipWriterPool = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	}
+)
+
 // NewClientFromViper returns a new New Relic client.
 func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
 	nr := util.GetSubViper(v, "newrelic")
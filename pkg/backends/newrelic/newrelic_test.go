@@ -5,6 +5,7 @@ import (
 	"context"
 	"encoding/json"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"sync/atomic"
@@ -114,7 +115,7 @@ func TestSendMetrics(t *testing.T) {
 				`[{"event_type":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"g1","metric_type":"gauge","metric_value":3,"tag3":"true","timestamp":0},` +
 				`{"event_type":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"c1","metric_per_second":1.1,"metric_type":"counter","metric_value":5,"tag1":"true","timestamp":0},` +
 				`{"event_type":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"users","metric_type":"set","metric_value":3,"tag4":"true","timestamp":0},` +
-				`{"count_90":0.1,"event_type":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"t1","metric_per_second":1.1,"metric_type":"timer","metric_value":1,` +
+				`{"count_90":0.1,"event_type":"GoStatsD","histogram.le_10":1,"histogram.le_inf":1,"integration_version":"2.3.0","interval":1,"metric_name":"t1","metric_per_second":1.1,"metric_type":"timer","metric_value":1,` +
 				`"samples_count":1,"samples_max":1,"samples_mean":0.5,"samples_median":0.5,"samples_min":0,"samples_std_dev":0.1,"samples_sum":1,"samples_sum_squares":1,"tag2":"true","timestamp":0}]}]}`,
 		},
 		{
@@ -124,7 +125,7 @@ func TestSendMetrics(t *testing.T) {
 			expected: `[{"eventType":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"g1","metric_type":"gauge","metric_value":3,"tag3":"true","timestamp":0},` +
 				`{"eventType":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"c1","metric_per_second":1.1,"metric_type":"counter","metric_value":5,"tag1":"true","timestamp":0},` +
 				`{"eventType":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"users","metric_type":"set","metric_value":3,"tag4":"true","timestamp":0},` +
-				`{"count_90":0.1,"eventType":"GoStatsD","integration_version":"2.3.0","interval":1,"metric_name":"t1","metric_per_second":1.1,"metric_type":"timer","metric_value":1,"samples_count":1,` +
+				`{"count_90":0.1,"eventType":"GoStatsD","histogram.le_10":1,"histogram.le_inf":1,"integration_version":"2.3.0","interval":1,"metric_name":"t1","metric_per_second":1.1,"metric_type":"timer","metric_value":1,"samples_count":1,` +
 				`"samples_max":1,"samples_mean":0.5,"samples_median":0.5,"samples_min":0,"samples_std_dev":0.1,"samples_sum":1,"samples_sum_squares":1,"tag2":"true","timestamp":0}]`,
 		},
 		{
@@ -141,6 +142,8 @@ func TestSendMetrics(t *testing.T) {
 				`{"name":"t1.std_dev","value":0.1,"type":"gauge","attributes":{"statsdType":"gauge","tag2":"true"}},` +
 				`{"name":"t1.sum_squares","value":1,"type":"gauge","attributes":{"statsdType":"gauge","tag2":"true"}},` +
 				`{"name":"t1.count.percentiles","value":0.1,"type":"gauge","attributes":{"percentile":90,"statsdType":"gauge","tag2":"true"}},` +
+				`{"name":"t1.histogram.le_10","value":1,"type":"gauge","attributes":{"statsdType":"gauge","tag2":"true"}},` +
+				`{"name":"t1.histogram.le_inf","value":1,"type":"gauge","attributes":{"statsdType":"gauge","tag2":"true"}},` +
 				`{"name":"t1.summary","value":{"count":1,"max":1,"min":0,"sum":1},"type":"summary","attributes":{"statsdType":"timer","tag2":"true"}}]}]`,
 		},
 	}
@@ -252,6 +255,10 @@ func metricsOneOfEach() *gostatsd.MetricMap {
 					Percentiles: gostatsd.Percentiles{
 						gostatsd.Percentile{Float: 0.1, Str: "count_90"},
 					},
+					Histogram: []gostatsd.HistogramBucket{
+						{Name: "histogram.le_10", Bound: 10, Count: 1},
+						{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 1},
+					},
 					Timestamp: 0,
 					Hostname:  "h2",
 					Tags:      gostatsd.Tags{"tag2"},
@@ -322,3 +329,39 @@ func TestEventFormatter(t *testing.T) {
 		})
 	}
 }
+
+func TestSendEventsInOneRequest(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	var events []map[string]interface{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/data", func(w http.ResponseWriter, r *http.Request) {
+		defer r.Body.Close()
+		atomic.AddUint32(&requestNum, 1)
+		zr, err := gzip.NewReader(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.NoError(t, json.NewDecoder(zr).Decode(&events))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	v.SetDefault("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+
+	client, err := NewClient("default", ts.URL+"/v1/data", "", "GoStatsD", "insights", "api-key", "", "metric_name", "metric_type",
+		"metric_per_second", "metric_value", "samples_min", "samples_max", "samples_count",
+		"samples_mean", "samples_median", "samples_std_dev", "samples_sum", "samples_sum_squares", "agent",
+		defaultMetricsPerBatch, defaultMaxRequests, 2*time.Second, 1*time.Second, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+
+	err = client.SendEvents(context.Background(), []*gostatsd.Event{{Title: "deploy"}, {Title: "restart"}})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, requestNum)
+	require.Len(t, events, 2)
+	assert.Equal(t, "deploy", events[0]["Title"])
+	assert.Equal(t, "restart", events[1]["Title"])
+	assert.Equal(t, "GoStatsD", events[1]["eventType"])
+}
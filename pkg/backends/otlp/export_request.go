@@ -0,0 +1,374 @@
+package otlp
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+)
+
+// Field tags of the OTLP protobuf messages, as (field number << 3) | wire type.
+const (
+	tagRequestResourceMetrics      = 1<<3 | 2
+	tagResourceMetricsResource     = 1<<3 | 2
+	tagResourceMetricsScopeMetrics = 2<<3 | 2
+	tagResourceAttributes          = 1<<3 | 2
+	tagScopeMetricsScope           = 1<<3 | 2
+	tagScopeMetricsMetrics         = 2<<3 | 2
+	tagScopeName                   = 1<<3 | 2
+	tagScopeVersion                = 2<<3 | 2
+	tagKeyValueKey                 = 1<<3 | 2
+	tagKeyValueValue               = 2<<3 | 2
+	tagAnyValueString              = 1<<3 | 2
+
+	tagMetricName        = 1<<3 | 2
+	tagMetricDescription = 2<<3 | 2
+	tagMetricUnit        = 3<<3 | 2
+	tagMetricGauge       = 5<<3 | 2
+	tagMetricSum         = 7<<3 | 2
+	tagMetricHistogram   = 9<<3 | 2
+	tagMetricSummary     = 11<<3 | 2
+
+	// The data points are field 1 of Gauge, Sum, Histogram and Summary.
+	tagDataPoints             = 1<<3 | 2
+	tagAggregationTemporality = 2<<3 | 0
+	tagSumIsMonotonic         = 3<<3 | 0
+
+	// The times are fields 2 and 3 of every type of data point.
+	tagPointStartTime          = 2<<3 | 1
+	tagPointTime               = 3<<3 | 1
+	tagNumberAsDouble          = 4<<3 | 1
+	tagNumberAsInt             = 6<<3 | 1
+	tagNumberAttributes        = 7<<3 | 2
+	tagHistogramCount          = 4<<3 | 1
+	tagHistogramSum            = 5<<3 | 1
+	tagHistogramBucketCounts   = 6<<3 | 2
+	tagHistogramExplicitBounds = 7<<3 | 2
+	tagHistogramAttributes     = 9<<3 | 2
+	tagHistogramMin            = 11<<3 | 1
+	tagHistogramMax            = 12<<3 | 1
+	tagSummaryCount            = 4<<3 | 1
+	tagSummarySum              = 5<<3 | 1
+	tagSummaryQuantileValues   = 6<<3 | 2
+	tagSummaryAttributes       = 7<<3 | 2
+	tagQuantileQuantile        = 1<<3 | 1
+	tagQuantileValue           = 2<<3 | 1
+
+	// Field numbers of ExportMetricsServiceResponse and ExportMetricsPartialSuccess.
+	fieldResponsePartialSuccess     = 1
+	fieldPartialSuccessRejected     = 1
+	fieldPartialSuccessErrorMessage = 2
+)
+
+const (
+	// aggregationTemporalityDelta is the AggregationTemporality of values which only cover the flush interval.
+	aggregationTemporalityDelta = 1
+	// aggregationTemporalityCumulative is the AggregationTemporality of values which cover the time since their
+	// start time.
+	aggregationTemporalityCumulative = 2
+)
+
+// scopeName is the name of the InstrumentationScope the metrics are exported with.
+const scopeName = "gostatsd"
+
+// quantile is a single ValueAtQuantile of a Summary data point.
+type quantile struct {
+	quantile float64
+	value    float64
+}
+
+// exportRequest encodes an ExportMetricsServiceRequest, one Metric with a single data point at a time, without
+// depending on the generated OpenTelemetry protobufs.  The metrics are grouped by host, with a ResourceMetrics for
+// each host.
+type exportRequest struct {
+	metrics  map[string]*proto.Buffer // Encoded Metrics by host, each prefixed with tagScopeMetricsMetrics
+	version  string                   // The version in the resource and scope of each ResourceMetrics
+	metadata gostatsd.MetadataRules   // The unit and description of each Metric, by name
+	count    int
+
+	// Scratch space for the messages being encoded, from the outermost to the innermost.
+	metric   *proto.Buffer
+	data     *proto.Buffer
+	point    *proto.Buffer
+	keyValue *proto.Buffer
+	value    *proto.Buffer
+}
+
+func newExportRequest(version string, metadata gostatsd.MetadataRules) *exportRequest {
+	return &exportRequest{
+		metrics:  map[string]*proto.Buffer{},
+		version:  version,
+		metadata: metadata,
+		metric:   proto.NewBuffer(nil),
+		data:     proto.NewBuffer(nil),
+		point:    proto.NewBuffer(nil),
+		keyValue: proto.NewBuffer(nil),
+		value:    proto.NewBuffer(nil),
+	}
+}
+
+// The errors from encoding in to a proto.Buffer are always nil, so they are ignored below.
+
+// addSum appends a Sum with a single monotonic data point, with the aggregation temporality given.
+func (r *exportRequest) addSum(name, host string, attributes []lineprotocol.Tag, value int64, temporality uint64, start, end uint64) {
+	r.startPoint(tagNumberAttributes, attributes, start, end)
+	_ = r.point.EncodeVarint(tagNumberAsInt)
+	_ = r.point.EncodeFixed64(uint64(value))
+	r.startData()
+	_ = r.data.EncodeVarint(tagAggregationTemporality)
+	_ = r.data.EncodeVarint(temporality)
+	_ = r.data.EncodeVarint(tagSumIsMonotonic)
+	_ = r.data.EncodeVarint(1)
+	r.addMetric(name, host, tagMetricSum)
+}
+
+// addGauge appends a Gauge with a single data point.
+func (r *exportRequest) addGauge(name, host string, attributes []lineprotocol.Tag, value float64, end uint64) {
+	r.startPoint(tagNumberAttributes, attributes, 0, end)
+	_ = r.point.EncodeVarint(tagNumberAsDouble)
+	_ = r.point.EncodeFixed64(math.Float64bits(value))
+	r.startData()
+	r.addMetric(name, host, tagMetricGauge)
+}
+
+// addHistogram appends a delta Histogram with a single data point.  bucketCounts must have one more element than
+// bounds, and sum to count.
+func (r *exportRequest) addHistogram(name, host string, attributes []lineprotocol.Tag, bounds []float64, count uint64, bucketCounts []uint64, sum, min, max float64, start, end uint64) {
+	r.startPoint(tagHistogramAttributes, attributes, start, end)
+	r.value.Reset()
+	for _, c := range bucketCounts {
+		_ = r.value.EncodeFixed64(c)
+	}
+	_ = r.point.EncodeVarint(tagHistogramCount)
+	_ = r.point.EncodeFixed64(count)
+	_ = r.point.EncodeVarint(tagHistogramSum)
+	_ = r.point.EncodeFixed64(math.Float64bits(sum))
+	_ = r.point.EncodeVarint(tagHistogramBucketCounts)
+	_ = r.point.EncodeRawBytes(r.value.Bytes())
+	r.value.Reset()
+	for _, b := range bounds {
+		_ = r.value.EncodeFixed64(math.Float64bits(b))
+	}
+	_ = r.point.EncodeVarint(tagHistogramExplicitBounds)
+	_ = r.point.EncodeRawBytes(r.value.Bytes())
+	_ = r.point.EncodeVarint(tagHistogramMin)
+	_ = r.point.EncodeFixed64(math.Float64bits(min))
+	_ = r.point.EncodeVarint(tagHistogramMax)
+	_ = r.point.EncodeFixed64(math.Float64bits(max))
+	r.startData()
+	_ = r.data.EncodeVarint(tagAggregationTemporality)
+	_ = r.data.EncodeVarint(aggregationTemporalityDelta)
+	r.addMetric(name, host, tagMetricHistogram)
+}
+
+// addSummary appends a Summary with a single data point.
+func (r *exportRequest) addSummary(name, host string, attributes []lineprotocol.Tag, count uint64, sum float64, quantiles []quantile, start, end uint64) {
+	r.startPoint(tagSummaryAttributes, attributes, start, end)
+	_ = r.point.EncodeVarint(tagSummaryCount)
+	_ = r.point.EncodeFixed64(count)
+	_ = r.point.EncodeVarint(tagSummarySum)
+	_ = r.point.EncodeFixed64(math.Float64bits(sum))
+	for _, q := range quantiles {
+		r.value.Reset()
+		_ = r.value.EncodeVarint(tagQuantileQuantile)
+		_ = r.value.EncodeFixed64(math.Float64bits(q.quantile))
+		_ = r.value.EncodeVarint(tagQuantileValue)
+		_ = r.value.EncodeFixed64(math.Float64bits(q.value))
+		_ = r.point.EncodeVarint(tagSummaryQuantileValues)
+		_ = r.point.EncodeRawBytes(r.value.Bytes())
+	}
+	r.startData()
+	r.addMetric(name, host, tagMetricSummary)
+}
+
+// startPoint starts encoding a data point with the attributes and times given, omitting a start time of 0.
+func (r *exportRequest) startPoint(attributesTag uint64, attributes []lineprotocol.Tag, start, end uint64) {
+	r.point.Reset()
+	for _, a := range attributes {
+		r.encodeKeyValue(r.point, attributesTag, a.Key, a.Value)
+	}
+	if start != 0 {
+		_ = r.point.EncodeVarint(tagPointStartTime)
+		_ = r.point.EncodeFixed64(start)
+	}
+	_ = r.point.EncodeVarint(tagPointTime)
+	_ = r.point.EncodeFixed64(end)
+}
+
+// startData starts encoding a Gauge, Sum, Histogram or Summary holding the data point encoded.
+func (r *exportRequest) startData() {
+	r.data.Reset()
+	_ = r.data.EncodeVarint(tagDataPoints)
+	_ = r.data.EncodeRawBytes(r.point.Bytes())
+}
+
+// addMetric appends a Metric holding the data encoded, in the field given by dataTag.  The unit and description of
+// the Metric are those of the first metadata rule matching its name, if any.
+func (r *exportRequest) addMetric(name, host string, dataTag uint64) {
+	r.metric.Reset()
+	_ = r.metric.EncodeVarint(tagMetricName)
+	_ = r.metric.EncodeStringBytes(name)
+	if meta, ok := r.metadata.Lookup(name); ok {
+		if meta.Description != "" {
+			_ = r.metric.EncodeVarint(tagMetricDescription)
+			_ = r.metric.EncodeStringBytes(meta.Description)
+		}
+		if meta.Unit != "" {
+			_ = r.metric.EncodeVarint(tagMetricUnit)
+			_ = r.metric.EncodeStringBytes(meta.Unit)
+		}
+	}
+	_ = r.metric.EncodeVarint(dataTag)
+	_ = r.metric.EncodeRawBytes(r.data.Bytes())
+
+	buf := r.metrics[host]
+	if buf == nil {
+		buf = proto.NewBuffer(nil)
+		r.metrics[host] = buf
+	}
+	_ = buf.EncodeVarint(tagScopeMetricsMetrics)
+	_ = buf.EncodeRawBytes(r.metric.Bytes())
+	r.count++
+}
+
+// encodeKeyValue appends a KeyValue with a string value to buf as the field given by tag.
+func (r *exportRequest) encodeKeyValue(buf *proto.Buffer, tag uint64, key, value string) {
+	r.value.Reset()
+	_ = r.value.EncodeVarint(tagAnyValueString)
+	_ = r.value.EncodeStringBytes(value)
+	r.keyValue.Reset()
+	_ = r.keyValue.EncodeVarint(tagKeyValueKey)
+	_ = r.keyValue.EncodeStringBytes(key)
+	_ = r.keyValue.EncodeVarint(tagKeyValueValue)
+	_ = r.keyValue.EncodeRawBytes(r.value.Bytes())
+	_ = buf.EncodeVarint(tag)
+	_ = buf.EncodeRawBytes(r.keyValue.Bytes())
+}
+
+// Bytes returns the encoded ExportMetricsServiceRequest.  Each ResourceMetrics has the resource attributes
+// host.name (if the host isn't empty), service.name and service.version (if the version isn't empty), and a single
+// ScopeMetrics.
+func (r *exportRequest) Bytes() []byte {
+	hosts := make([]string, 0, len(r.metrics))
+	for host := range r.metrics {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	request := proto.NewBuffer(nil)
+	resourceMetrics := proto.NewBuffer(nil)
+	message := proto.NewBuffer(nil)
+	for _, host := range hosts {
+		resourceMetrics.Reset()
+
+		message.Reset()
+		if host != "" {
+			r.encodeKeyValue(message, tagResourceAttributes, "host.name", host)
+		}
+		r.encodeKeyValue(message, tagResourceAttributes, "service.name", scopeName)
+		if r.version != "" {
+			r.encodeKeyValue(message, tagResourceAttributes, "service.version", r.version)
+		}
+		_ = resourceMetrics.EncodeVarint(tagResourceMetricsResource)
+		_ = resourceMetrics.EncodeRawBytes(message.Bytes())
+
+		r.value.Reset()
+		_ = r.value.EncodeVarint(tagScopeName)
+		_ = r.value.EncodeStringBytes(scopeName)
+		if r.version != "" {
+			_ = r.value.EncodeVarint(tagScopeVersion)
+			_ = r.value.EncodeStringBytes(r.version)
+		}
+		message.Reset()
+		_ = message.EncodeVarint(tagScopeMetricsScope)
+		_ = message.EncodeRawBytes(r.value.Bytes())
+		message.SetBuf(append(message.Bytes(), r.metrics[host].Bytes()...))
+		_ = resourceMetrics.EncodeVarint(tagResourceMetricsScopeMetrics)
+		_ = resourceMetrics.EncodeRawBytes(message.Bytes())
+
+		_ = request.EncodeVarint(tagRequestResourceMetrics)
+		_ = request.EncodeRawBytes(resourceMetrics.Bytes())
+	}
+	return request.Bytes()
+}
+
+// partialSuccess is the ExportMetricsPartialSuccess of an ExportMetricsServiceResponse.
+type partialSuccess struct {
+	rejectedDataPoints int64
+	errorMessage       string
+}
+
+var errTruncatedResponse = errors.New("truncated response")
+
+// decodeResponse decodes the partial success of an ExportMetricsServiceResponse.  An empty response is a success,
+// and has no partial success.
+func decodeResponse(b []byte) (partialSuccess, error) {
+	var ps partialSuccess
+	err := decodeMessage(b, func(field uint64, value uint64, bytes []byte) error {
+		if field != fieldResponsePartialSuccess || bytes == nil {
+			return nil
+		}
+		return decodeMessage(bytes, func(field uint64, value uint64, bytes []byte) error {
+			switch field {
+			case fieldPartialSuccessRejected:
+				ps.rejectedDataPoints = int64(value)
+			case fieldPartialSuccessErrorMessage:
+				ps.errorMessage = string(bytes)
+			}
+			return nil
+		})
+	})
+	return ps, err
+}
+
+// decodeMessage calls f with the number and value of each field in b, skipping fields it doesn't understand.  The
+// value of varint and fixed fields is passed as value, and the value of length delimited fields as bytes.
+func decodeMessage(b []byte, f func(field uint64, value uint64, bytes []byte) error) error {
+	for len(b) > 0 {
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errTruncatedResponse
+		}
+		b = b[n:]
+		var value uint64
+		var bytes []byte
+		switch tag & 7 {
+		case 0:
+			value, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errTruncatedResponse
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return errTruncatedResponse
+			}
+			value = binary.LittleEndian.Uint64(b)
+			b = b[8:]
+		case 2:
+			length, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < length {
+				return errTruncatedResponse
+			}
+			bytes = b[n : n+int(length)]
+			b = b[n+int(length):]
+		case 5:
+			if len(b) < 4 {
+				return errTruncatedResponse
+			}
+			value = uint64(binary.LittleEndian.Uint32(b))
+			b = b[4:]
+		default:
+			return errors.New("unsupported wire type in response")
+		}
+		if err := f(tag>>3, value, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
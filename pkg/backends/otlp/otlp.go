@@ -0,0 +1,543 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/cumulative"
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName                  = "otlp"
+	defaultUserAgent             = "gostatsd"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	// defaultMetricsPerBatch is the default number of metrics to send in a single batch.
+	defaultMetricsPerBatch = 1000
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+
+	// TimerModeSummary sends each timer as a Summary, with quantiles for its percentiles.
+	TimerModeSummary = "summary"
+	// TimerModeHistogram sends each timer as a Histogram, with its values counted in explicit buckets.
+	TimerModeHistogram = "histogram"
+)
+
+// defaultMaxRequests is the number of parallel outgoing requests to the OTLP endpoint.
+var defaultMaxRequests = uint(2 * runtime.NumCPU())
+
+// defaultHistogramBounds are the bucket boundaries of timers sent as histograms, the same as the default
+// boundaries of the OpenTelemetry SDKs.
+var defaultHistogramBounds = []string{"0", "5", "10", "25", "50", "75", "100", "250", "500", "750", "1000", "2500", "5000", "7500", "10000"}
+
+// Client represents an OTLP/HTTP metrics exporter.
+type Client struct {
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
+	pointsRejected   uint64 // Accumulated number of data points rejected in partially successful requests
+
+	endpoint              string
+	userAgent             string
+	version               string
+	maxRequestElapsedTime time.Duration
+	flushInterval         time.Duration
+	client                *http.Client
+	metricsPerBatch       int
+	requestSem            chan struct{}    // Limits the number of concurrent requests
+	now                   func() time.Time // Returns current time. Useful for testing.
+	timerMode             string
+	histogramBounds       []float64
+	cumulativeCounters    *cumulative.Counters // Optional, running totals of counters sent as cumulative Sums
+	metadata              gostatsd.MetadataRules
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// SendMetricsAsync flushes the metrics to the OTLP endpoint, preparing payload synchronously but doing the send
+// asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	counter := 0
+	results := make(chan error)
+	c.processMetrics(metrics, func(r *exportRequest) {
+		atomic.AddUint64(&c.batchesCreated, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case c.requestSem <- struct{}{}:
+				err := c.post(ctx, r.Bytes())
+				<-c.requestSem
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+		counter++
+	})
+	go func() {
+		errs := make([]error, 0, counter)
+	loop:
+		for i := 0; i < counter; i++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&c.batchesThrottled)), nil)
+			statser.Gauge("backend.points_rejected", float64(atomic.LoadUint64(&c.pointsRejected)), nil)
+		}
+	}
+}
+
+// processMetrics serializes the metrics in to ExportMetricsServiceRequests of at most metricsPerBatch metrics,
+// calling cb with each.  Every metric has a single data point with the time of the flush.  A counter is a monotonic
+// delta Sum covering the flush interval, or a cumulative Sum of its running total if cumulative counters are enabled,
+// a timer is a Summary or a delta Histogram depending on the timer mode, a distribution is a Summary, and gauges and
+// sets are a Gauge.  In summary mode, a timer with histogram buckets is also a delta Histogram of its buckets named
+// <name>.histogram.  The host of each metric is the host.name of its resource.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*exportRequest)) {
+	now := c.now()
+	end := uint64(now.UnixNano())
+	start := uint64(now.Add(-c.flushInterval).UnixNano())
+	if c.cumulativeCounters != nil {
+		c.cumulativeCounters.Expire(now)
+	}
+	r := newExportRequest(c.version, c.metadata)
+	next := func() {
+		if r.count >= c.metricsPerBatch {
+			cb(r)
+			r = newExportRequest(c.version, c.metadata)
+		}
+	}
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		attributes := lineprotocol.ConvertTags(counter.Tags, "")
+		if c.cumulativeCounters != nil {
+			total := c.cumulativeCounters.Add(key, tagsKey, counter.Value, now)
+			r.addSum(key, counter.Hostname, attributes, total.Value, aggregationTemporalityCumulative, uint64(total.Start.UnixNano()), end)
+		} else {
+			r.addSum(key, counter.Hostname, attributes, counter.Value, aggregationTemporalityDelta, start, end)
+		}
+		next()
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		attributes := lineprotocol.ConvertTags(timer.Tags, "")
+		if c.timerMode == TimerModeHistogram {
+			if len(timer.Values) == 0 {
+				return
+			}
+			r.addHistogram(key, timer.Hostname, attributes, c.histogramBounds, uint64(timer.Count), c.bucketCounts(timer), timer.Sum, timer.Min, timer.Max, start, end)
+		} else {
+			r.addSummary(key, timer.Hostname, attributes, uint64(timer.Count), timer.Sum, c.quantiles(timer), start, end)
+			if len(timer.Histogram) > 0 {
+				next()
+				bounds, counts, count := timerHistogram(timer)
+				r.addHistogram(key+".histogram", timer.Hostname, attributes, bounds, count, counts, timer.Sum, timer.Min, timer.Max, start, end)
+			}
+		}
+		next()
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		r.addSummary(key, dist.Hostname, lineprotocol.ConvertTags(dist.Tags, ""), uint64(dist.Count), dist.Sum, c.distributionQuantiles(dist), start, end)
+		next()
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		r.addGauge(key, gauge.Hostname, lineprotocol.ConvertTags(gauge.Tags, ""), gauge.Value, end)
+		next()
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		r.addGauge(key, set.Hostname, lineprotocol.ConvertTags(set.Tags, ""), float64(len(set.Values)), end)
+		next()
+	})
+
+	if r.count > 0 {
+		cb(r)
+	}
+}
+
+// bucketCounts counts the values of a timer in each histogram bucket.  Bucket i holds the values greater than bound
+// i-1 and at most bound i, and the last bucket holds the values greater than the last bound.  The values may be
+// sampled, or received with a sample rate, so the counts are scaled to sum to the count of the timer, weighting each
+// value by its weight if the values are weighted.
+func (c *Client) bucketCounts(timer gostatsd.Timer) []uint64 {
+	weights := make([]float64, len(c.histogramBounds)+1)
+	var total float64
+	for i, v := range timer.Values {
+		weight := 1.0
+		if timer.Weights != nil {
+			weight = timer.Weights[i]
+		}
+		weights[sort.SearchFloat64s(c.histogramBounds, v)] += weight
+		total += weight
+	}
+
+	// The cumulative counts are rounded, rather than each bucket, so the counts always sum to the count.
+	counts := make([]uint64, len(weights))
+	var cumulativeWeight float64
+	var counted uint64
+	for i, weight := range weights {
+		cumulativeWeight += weight
+		cumulativeCount := uint64(math.Round(cumulativeWeight / total * float64(timer.Count)))
+		counts[i] = cumulativeCount - counted
+		counted = cumulativeCount
+	}
+	return counts
+}
+
+// timerHistogram returns the bounds, bucket counts and count of the histogram buckets of a timer.  The buckets of the
+// timer are cumulative, and the last one is the +Inf bucket, so it has no bound and its count is the count of the
+// timer.
+func timerHistogram(timer gostatsd.Timer) ([]float64, []uint64, uint64) {
+	bounds := make([]float64, 0, len(timer.Histogram)-1)
+	counts := make([]uint64, 0, len(timer.Histogram))
+	counted := 0
+	for _, bucket := range timer.Histogram {
+		if !math.IsInf(bucket.Bound, 1) {
+			bounds = append(bounds, bucket.Bound)
+		}
+		var count uint64
+		if bucket.Count > counted {
+			count = uint64(bucket.Count - counted)
+			counted = bucket.Count
+		}
+		counts = append(counts, count)
+	}
+	return bounds, counts, uint64(counted)
+}
+
+// quantiles returns the quantiles of a timer which aren't disabled, sorted.  The lower, median and upper values are
+// the 0, 0.5 and 1 quantiles, and the percentiles are the quantile they are the boundary of, so upper_90 and
+// lower_10 are the 0.9 and 0.1 quantiles.
+func (c *Client) quantiles(timer gostatsd.Timer) []quantile {
+	qs := make([]quantile, 0, 3+len(timer.Percentiles))
+	if !c.disabledSubtypes.Lower {
+		qs = append(qs, quantile{0, timer.Min})
+	}
+	if !c.disabledSubtypes.Median {
+		qs = append(qs, quantile{0.5, timer.Median})
+	}
+	if !c.disabledSubtypes.Upper {
+		qs = append(qs, quantile{1, timer.Max})
+	}
+	for _, pct := range timer.Percentiles {
+		var s string
+		if strings.HasPrefix(pct.Str, "upper_") {
+			s = pct.Str[len("upper_"):]
+		} else if strings.HasPrefix(pct.Str, "lower_") {
+			s = pct.Str[len("lower_"):]
+		} else {
+			continue
+		}
+		if p, err := strconv.ParseFloat(s, 64); err == nil && p >= 0 && p <= 100 {
+			qs = append(qs, quantile{p / 100, pct.Float})
+		}
+	}
+	sort.SliceStable(qs, func(i, j int) bool {
+		return qs[i].quantile < qs[j].quantile
+	})
+	deduped := qs[:0]
+	for i, q := range qs {
+		if i > 0 && q.quantile == qs[i-1].quantile {
+			continue
+		}
+		deduped = append(deduped, q)
+	}
+	return deduped
+}
+
+// distributionQuantiles returns the quantiles of a distribution which aren't disabled, sorted.  The min and max are
+// the 0 and 1 quantiles, and p90 is the 0.9 quantile.
+func (c *Client) distributionQuantiles(dist gostatsd.Timer) []quantile {
+	qs := make([]quantile, 0, 2+len(dist.Percentiles))
+	if !c.disabledSubtypes.DistributionMin {
+		qs = append(qs, quantile{0, dist.Min})
+	}
+	for _, pct := range dist.Percentiles {
+		if p, err := strconv.ParseFloat(strings.TrimPrefix(pct.Str, "p"), 64); err == nil && p > 0 && p < 100 {
+			qs = append(qs, quantile{p / 100, pct.Float})
+		}
+	}
+	if !c.disabledSubtypes.DistributionMax {
+		qs = append(qs, quantile{1, dist.Max})
+	}
+	sort.SliceStable(qs, func(i, j int) bool {
+		return qs[i].quantile < qs[j].quantile
+	})
+	return qs
+}
+
+// post sends the payload to the OTLP endpoint, retrying with backoff until maxRequestElapsedTime.
+func (c *Client) post(ctx context.Context, body []byte) error {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		err := c.doPost(ctx, body)
+		if err == nil {
+			atomic.AddUint64(&c.batchesSent, 1)
+			return nil
+		}
+
+		next, throttled := util.NextRetry(b, err)
+		if throttled {
+			atomic.AddUint64(&c.batchesThrottled, 1)
+		}
+		if next == backoff.Stop {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] %w", BackendName, err)
+		}
+
+		log.Warnf("[%s] failed to send metrics, sleeping for %s: %v", BackendName, next, err)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&c.batchesRetried, 1)
+	}
+}
+
+func (c *Client) doPost(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", c.userAgent)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
+		return util.NewStatusError(resp)
+	}
+	b, err := ioutil.ReadAll(respBody)
+	if err != nil {
+		// The request succeeded, so it isn't retried.
+		log.Warnf("[%s] failed to read response: %v", BackendName, err)
+		return nil
+	}
+	c.handlePartialSuccess(b)
+	return nil
+}
+
+// handlePartialSuccess records the data points rejected by the endpoint, if the response of a successful request
+// is a partial success.  The request is not retried, as the rejected data points will be rejected again.
+func (c *Client) handlePartialSuccess(b []byte) {
+	ps, err := decodeResponse(b)
+	if err != nil {
+		log.Warnf("[%s] failed to decode response: %v", BackendName, err)
+		return
+	}
+	if ps.rejectedDataPoints > 0 {
+		atomic.AddUint64(&c.pointsRejected, uint64(ps.rejectedDataPoints))
+		log.Warnf("[%s] %d data points rejected: %s", BackendName, ps.rejectedDataPoints, ps.errorMessage)
+	} else if ps.errorMessage != "" {
+		log.Warnf("[%s] export succeeded with warning: %s", BackendName, ps.errorMessage)
+	}
+}
+
+// KeepsFlushState returns true if cumulative counters are enabled, as sending a flush adds to their totals.
+func (c *Client) KeepsFlushState() bool {
+	return c.cumulativeCounters != nil
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// NewClientFromViper returns a new OTLP client.
+func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	o := util.GetSubViper(v, "otlp")
+	o.SetDefault("endpoint", "")
+	o.SetDefault("timer-mode", TimerModeSummary)
+	o.SetDefault("histogram-bounds", defaultHistogramBounds)
+	o.SetDefault("metrics-per-batch", defaultMetricsPerBatch)
+	o.SetDefault("cumulative-counters", false)
+	o.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	o.SetDefault("max-requests", defaultMaxRequests)
+	o.SetDefault("user-agent", defaultUserAgent)
+	o.SetDefault("transport", "default")
+
+	bounds, err := parseBounds(o.GetStringSlice("histogram-bounds"))
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(
+		o.GetString("endpoint"),
+		o.GetString("user-agent"),
+		o.GetString("transport"),
+		v.GetString("build-version"), // Main viper, not sub-viper
+		o.GetString("timer-mode"),
+		bounds,
+		o.GetInt("metrics-per-batch"),
+		o.GetBool("cumulative-counters"),
+		uint(o.GetInt("max-requests")),
+		o.GetDuration("max-request-elapsed-time"),
+		v.GetDuration("flush-interval"), // Main viper, not sub-viper
+		gostatsd.MetricMetadataFromViper(v),
+		gostatsd.DisabledSubMetrics(v),
+		pool,
+	)
+}
+
+// parseBounds parses histogram bucket boundaries.
+func parseBounds(s []string) ([]float64, error) {
+	bounds := make([]float64, len(s))
+	for i, b := range s {
+		f, err := strconv.ParseFloat(b, 64)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] invalid histogram-bounds %q: %v", BackendName, b, err)
+		}
+		bounds[i] = f
+	}
+	return bounds, nil
+}
+
+// NewClient returns a new OTLP client.  version is reported as the service.version of the metrics, and may be
+// empty.
+func NewClient(
+	endpoint,
+	userAgent,
+	transport,
+	version,
+	timerMode string,
+	histogramBounds []float64,
+	metricsPerBatch int,
+	cumulativeCounters bool,
+	maxRequests uint,
+	maxRequestElapsedTime time.Duration,
+	flushInterval time.Duration,
+	metadata gostatsd.MetadataRules,
+	disabled gostatsd.TimerSubtypes,
+	pool *transport.TransportPool,
+) (*Client, error) {
+	if endpoint == "" {
+		return nil, fmt.Errorf("[%s] endpoint is required", BackendName)
+	}
+	if userAgent == "" {
+		return nil, fmt.Errorf("[%s] user-agent is required", BackendName)
+	}
+	if timerMode != TimerModeSummary && timerMode != TimerModeHistogram {
+		return nil, fmt.Errorf("[%s] timer-mode must be %s or %s", BackendName, TimerModeSummary, TimerModeHistogram)
+	}
+	if !sort.Float64sAreSorted(histogramBounds) {
+		return nil, fmt.Errorf("[%s] histogram-bounds must be sorted", BackendName)
+	}
+	if metricsPerBatch <= 0 {
+		return nil, fmt.Errorf("[%s] metricsPerBatch must be positive", BackendName)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] maxRequests must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("[%s] flushInterval must be positive", BackendName)
+	}
+
+	logger := log.WithField("backend", BackendName)
+	httpClient, err := pool.Get(transport)
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	logger.WithFields(log.Fields{
+		"endpoint":                 endpoint,
+		"timer-mode":               timerMode,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+		"metrics-per-batch":        metricsPerBatch,
+		"cumulative-counters":      cumulativeCounters,
+	}).Info("created backend")
+
+	var counters *cumulative.Counters
+	if cumulativeCounters {
+		counters = cumulative.NewCounters(cumulative.DefaultTTL)
+	}
+
+	return &Client{
+		endpoint:              endpoint,
+		userAgent:             userAgent,
+		version:               version,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		flushInterval:         flushInterval,
+		client:                httpClient.Client,
+		metricsPerBatch:       metricsPerBatch,
+		requestSem:            make(chan struct{}, maxRequests),
+		now:                   time.Now,
+		timerMode:             timerMode,
+		histogramBounds:       histogramBounds,
+		cumulativeCounters:    counters,
+		metadata:              metadata,
+		disabledSubtypes:      disabled,
+	}, nil
+}
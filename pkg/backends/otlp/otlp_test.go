@@ -0,0 +1,469 @@
+package otlp
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func newTestClient(t *testing.T, url, timerMode string, metricsPerBatch int) *Client {
+	return newTestClientWithOptions(t, url, timerMode, metricsPerBatch, false, nil)
+}
+
+func newTestClientWithOptions(t *testing.T, url, timerMode string, metricsPerBatch int, cumulativeCounters bool, metadata gostatsd.MetadataRules) *Client {
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(url, "agent", "default", "1.0", timerMode, []float64{0.5, 1}, metricsPerBatch, cumulativeCounters, defaultMaxRequests, 2*time.Second, 10*time.Second, metadata, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	return client
+}
+
+func metricsOneOfEach() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"tag1": {PerSecond: 1.5, Value: 15, Hostname: "h1", Tags: gostatsd.Tags{"tag1"}},
+	}
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"a:b": {
+			Count:      3,
+			PerSecond:  0.3,
+			Mean:       0.5,
+			Median:     0.5,
+			Min:        0,
+			Max:        1,
+			StdDev:     0.5,
+			Sum:        1.5,
+			SumSquares: 1.25,
+			Values:     []float64{0, 0.5, 1},
+			Percentiles: gostatsd.Percentiles{
+				gostatsd.Percentile{Float: 1, Str: "upper_90"},
+				gostatsd.Percentile{Float: 2, Str: "sum_90"},
+			},
+			Hostname: "h1",
+			Tags:     gostatsd.Tags{"a:b"},
+		},
+	}
+	mm.Gauges["g.1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Hostname: "h3"},
+	}
+	mm.Sets["users"] = map[string]gostatsd.Set{
+		"c-d:e": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Tags: gostatsd.Tags{"c-d:e"}},
+	}
+	return mm
+}
+
+// fields are the fields of a decoded protobuf message, by field number.
+type fields struct {
+	values map[uint64][]uint64
+	bytes  map[uint64][][]byte
+}
+
+func decodeFields(t *testing.T, b []byte) fields {
+	f := fields{values: map[uint64][]uint64{}, bytes: map[uint64][][]byte{}}
+	require.NoError(t, decodeMessage(b, func(field uint64, value uint64, bytes []byte) error {
+		if bytes != nil {
+			f.bytes[field] = append(f.bytes[field], bytes)
+		} else {
+			f.values[field] = append(f.values[field], value)
+		}
+		return nil
+	}))
+	return f
+}
+
+// decodeAttributes decodes KeyValues with string values in to key=value pairs.
+func decodeAttributes(t *testing.T, kvs [][]byte) string {
+	var attributes []string
+	for _, kv := range kvs {
+		f := decodeFields(t, kv)
+		value := decodeFields(t, f.bytes[2][0])
+		attributes = append(attributes, fmt.Sprintf("%s=%s", f.bytes[1][0], value.bytes[1][0]))
+	}
+	return "{" + strings.Join(attributes, ",") + "}"
+}
+
+// decodeFixed64s decodes packed fixed64 values.
+func decodeFixed64s(b []byte) []uint64 {
+	var values []uint64
+	for ; len(b) >= 8; b = b[8:] {
+		values = append(values, binary.LittleEndian.Uint64(b))
+	}
+	return values
+}
+
+func float(bits uint64) float64 {
+	return math.Float64frombits(bits)
+}
+
+// decodeExportRequest decodes an ExportMetricsServiceRequest, returning a line describing each metric, sorted.  The
+// times are in seconds.
+func decodeExportRequest(t *testing.T, body []byte) []string {
+	var lines []string
+	for _, rm := range decodeFields(t, body).bytes[tagRequestResourceMetrics>>3] {
+		rmf := decodeFields(t, rm)
+		resource := decodeAttributes(t, decodeFields(t, rmf.bytes[1][0]).bytes[1])
+		sm := decodeFields(t, rmf.bytes[2][0])
+		scope := decodeFields(t, sm.bytes[1][0])
+		require.Equal(t, "gostatsd", string(scope.bytes[1][0]))
+		require.Equal(t, "1.0", string(scope.bytes[2][0]))
+		for _, m := range sm.bytes[2] {
+			mf := decodeFields(t, m)
+			var line string
+			switch {
+			case mf.bytes[5] != nil:
+				p := decodeFields(t, decodeFields(t, mf.bytes[5][0]).bytes[1][0])
+				line = fmt.Sprintf("gauge %s %v @%d", decodeAttributes(t, p.bytes[7]), float(p.values[4][0]), p.values[3][0]/1e9)
+			case mf.bytes[7] != nil:
+				data := decodeFields(t, mf.bytes[7][0])
+				p := decodeFields(t, data.bytes[1][0])
+				line = fmt.Sprintf("sum temporality=%d monotonic=%d %s %d @%d-%d", data.values[2][0], data.values[3][0],
+					decodeAttributes(t, p.bytes[7]), int64(p.values[6][0]), p.values[2][0]/1e9, p.values[3][0]/1e9)
+			case mf.bytes[9] != nil:
+				data := decodeFields(t, mf.bytes[9][0])
+				p := decodeFields(t, data.bytes[1][0])
+				var bounds []float64
+				for _, b := range decodeFixed64s(p.bytes[7][0]) {
+					bounds = append(bounds, float(b))
+				}
+				line = fmt.Sprintf("histogram temporality=%d %s count=%d sum=%v min=%v max=%v bounds=%v counts=%v @%d-%d",
+					data.values[2][0], decodeAttributes(t, p.bytes[9]), p.values[4][0], float(p.values[5][0]),
+					float(p.values[11][0]), float(p.values[12][0]), bounds, decodeFixed64s(p.bytes[6][0]),
+					p.values[2][0]/1e9, p.values[3][0]/1e9)
+			case mf.bytes[11] != nil:
+				p := decodeFields(t, decodeFields(t, mf.bytes[11][0]).bytes[1][0])
+				var quantiles []string
+				for _, q := range p.bytes[6] {
+					qf := decodeFields(t, q)
+					quantiles = append(quantiles, fmt.Sprintf("%v=%v", float(qf.values[1][0]), float(qf.values[2][0])))
+				}
+				line = fmt.Sprintf("summary %s count=%d sum=%v quantiles=%s @%d-%d", decodeAttributes(t, p.bytes[7]),
+					p.values[4][0], float(p.values[5][0]), strings.Join(quantiles, ","), p.values[2][0]/1e9, p.values[3][0]/1e9)
+			default:
+				require.Fail(t, "unexpected metric type")
+			}
+			if mf.bytes[2] != nil {
+				line += fmt.Sprintf(" description=%q", mf.bytes[2][0])
+			}
+			if mf.bytes[3] != nil {
+				line += fmt.Sprintf(" unit=%s", mf.bytes[3][0])
+			}
+			lines = append(lines, fmt.Sprintf("%s %s %s", resource, mf.bytes[1][0], line))
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func sendMetrics(t *testing.T, client *Client, mm *gostatsd.MetricMap) []error {
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	return <-res
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	var body []byte
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, "agent", r.Header.Get("User-Agent"))
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = data
+		w.Header().Set("Content-Type", "application/x-protobuf")
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/v1/metrics", TimerModeSummary, 1000)
+	require.Equal(t, []error{nil}, sendMetrics(t, client, metricsOneOfEach()))
+
+	expected := []string{
+		`{host.name=h1,service.name=gostatsd,service.version=1.0} c1 sum temporality=1 monotonic=1 {unnamed=tag1} 15 @90-100`,
+		`{host.name=h1,service.name=gostatsd,service.version=1.0} t1 summary {a=b} count=3 sum=1.5 quantiles=0=0,0.5=0.5,0.9=1,1=1 @90-100`,
+		`{host.name=h3,service.name=gostatsd,service.version=1.0} g.1 gauge {} 3 @100`,
+		`{service.name=gostatsd,service.version=1.0} users gauge {c-d=e} 2 @100`,
+	}
+	assert.Equal(t, expected, decodeExportRequest(t, body))
+}
+
+func TestSendMetricsHistogram(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	var body []byte
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = data
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/v1/metrics", TimerModeHistogram, 1000)
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"": {Count: 4, Min: 0, Max: 2, Sum: 3.5, Values: []float64{0, 0.5, 1, 2}},
+	}
+	mm.Timers["t2"] = map[string]gostatsd.Timer{
+		"": {Count: 0}, // Skipped, as it has no values
+	}
+	// Sampled, so the counts are scaled up to the count of the timer.
+	mm.Timers["t3"] = map[string]gostatsd.Timer{
+		"": {Count: 10, SampledCount: 10, Min: 0, Max: 2, Sum: 3.5, Values: []float64{0, 0.5, 1, 2}},
+	}
+	// Weighted, so each value is counted by its weight.
+	mm.Timers["t4"] = map[string]gostatsd.Timer{
+		"": {Count: 7, SampledCount: 7, Min: 0, Max: 2, Sum: 2, Values: []float64{0, 2}, Weights: []float64{1, 6}},
+	}
+	require.Equal(t, []error{nil}, sendMetrics(t, client, mm))
+
+	assert.Equal(t, []string{
+		`{service.name=gostatsd,service.version=1.0} t1 histogram temporality=1 {} count=4 sum=3.5 min=0 max=2 bounds=[0.5 1] counts=[2 1 1] @90-100`,
+		`{service.name=gostatsd,service.version=1.0} t3 histogram temporality=1 {} count=10 sum=3.5 min=0 max=2 bounds=[0.5 1] counts=[5 3 2] @90-100`,
+		`{service.name=gostatsd,service.version=1.0} t4 histogram temporality=1 {} count=7 sum=2 min=0 max=2 bounds=[0.5 1] counts=[1 0 6] @90-100`,
+	}, decodeExportRequest(t, body))
+}
+
+func TestSendMetricsTimerHistogramBuckets(t *testing.T) {
+	t.Parallel()
+	bodies := make(chan []byte, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies <- data
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"": {
+			Count:  4,
+			Min:    0,
+			Max:    20,
+			Sum:    25.5,
+			Median: 2.5,
+			Values: []float64{0, 0.5, 5, 20},
+			Histogram: []gostatsd.HistogramBucket{
+				{Name: "histogram.le_1", Bound: 1, Count: 2},
+				{Name: "histogram.le_10", Bound: 10, Count: 3},
+				{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 4},
+			},
+		},
+	}
+
+	// In summary mode the buckets are a separate Histogram, rather than quantiles of the Summary.
+	client := newTestClient(t, ts.URL+"/v1/metrics", TimerModeSummary, 1000)
+	require.Equal(t, []error{nil}, sendMetrics(t, client, mm))
+	assert.Equal(t, []string{
+		`{service.name=gostatsd,service.version=1.0} t1 summary {} count=4 sum=25.5 quantiles=0=0,0.5=2.5,1=20 @90-100`,
+		`{service.name=gostatsd,service.version=1.0} t1.histogram histogram temporality=1 {} count=4 sum=25.5 min=0 max=20 bounds=[1 10] counts=[2 1 1] @90-100`,
+	}, decodeExportRequest(t, <-bodies))
+
+	// In histogram mode the timer is already a Histogram, with the buckets of histogram-bounds.
+	client = newTestClient(t, ts.URL+"/v1/metrics", TimerModeHistogram, 1000)
+	require.Equal(t, []error{nil}, sendMetrics(t, client, mm))
+	assert.Equal(t, []string{
+		`{service.name=gostatsd,service.version=1.0} t1 histogram temporality=1 {} count=4 sum=25.5 min=0 max=20 bounds=[0.5 1] counts=[2 0 2] @90-100`,
+	}, decodeExportRequest(t, <-bodies))
+}
+
+func TestSendMetricsCumulativeCounters(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	var body []byte
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = data
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClientWithOptions(t, ts.URL+"/v1/metrics", TimerModeSummary, 1000, true, nil)
+	assert.True(t, client.KeepsFlushState()) // A retried flush would be added to the totals twice
+	counters := func(value int64) *gostatsd.MetricMap {
+		mm := gostatsd.NewMetricMap()
+		mm.Counters["c1"] = map[string]gostatsd.Counter{
+			"": {Value: value},
+		}
+		return mm
+	}
+	require.Equal(t, []error{nil}, sendMetrics(t, client, counters(15)))
+	assert.Equal(t, []string{
+		`{service.name=gostatsd,service.version=1.0} c1 sum temporality=2 monotonic=1 {} 15 @100-100`,
+	}, decodeExportRequest(t, body))
+
+	// The total keeps its start time.
+	client.now = func() time.Time {
+		return time.Unix(110, 0)
+	}
+	require.Equal(t, []error{nil}, sendMetrics(t, client, counters(5)))
+	assert.Equal(t, []string{
+		`{service.name=gostatsd,service.version=1.0} c1 sum temporality=2 monotonic=1 {} 20 @100-110`,
+	}, decodeExportRequest(t, body))
+}
+
+func TestSendMetricsMetadata(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	var body []byte
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = data
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	metadata := gostatsd.MetadataRules{
+		{Match: gostatsd.StringMatchList{gostatsd.NewStringMatch("c*")}, MetricMetadata: gostatsd.MetricMetadata{Unit: "By", Description: "Bytes sent"}},
+		{Match: gostatsd.StringMatchList{gostatsd.NewStringMatch("g.1")}, MetricMetadata: gostatsd.MetricMetadata{Unit: "1"}},
+	}
+	client := newTestClientWithOptions(t, ts.URL+"/v1/metrics", TimerModeSummary, 1000, false, metadata)
+	assert.False(t, client.KeepsFlushState())
+	require.Equal(t, []error{nil}, sendMetrics(t, client, metricsOneOfEach()))
+	assert.Equal(t, []string{
+		`{host.name=h1,service.name=gostatsd,service.version=1.0} c1 sum temporality=1 monotonic=1 {unnamed=tag1} 15 @90-100 description="Bytes sent" unit=By`,
+		`{host.name=h1,service.name=gostatsd,service.version=1.0} t1 summary {a=b} count=3 sum=1.5 quantiles=0=0,0.5=0.5,0.9=1,1=1 @90-100`,
+		`{host.name=h3,service.name=gostatsd,service.version=1.0} g.1 gauge {} 3 @100 unit=1`,
+		`{service.name=gostatsd,service.version=1.0} users gauge {c-d=e} 2 @100`,
+	}, decodeExportRequest(t, body))
+}
+
+func TestSendMetricsInMultipleBatches(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, decodeExportRequest(t, data), 1)
+		atomic.AddUint32(&requestNum, 1)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/v1/metrics", TimerModeSummary, 1)
+	errs := sendMetrics(t, client, metricsOneOfEach())
+	require.Len(t, errs, 4)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 4, atomic.LoadUint32(&requestNum))
+}
+
+func TestSendMetricsPartialSuccess(t *testing.T) {
+	t.Parallel()
+	partialSuccess := proto.NewBuffer(nil)
+	_ = partialSuccess.EncodeVarint(fieldPartialSuccessRejected << 3)
+	_ = partialSuccess.EncodeVarint(3)
+	_ = partialSuccess.EncodeVarint(fieldPartialSuccessErrorMessage<<3 | 2)
+	_ = partialSuccess.EncodeStringBytes("bad points")
+	response := proto.NewBuffer(nil)
+	_ = response.EncodeVarint(fieldResponsePartialSuccess<<3 | 2)
+	_ = response.EncodeRawBytes(partialSuccess.Bytes())
+
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requestNum, 1)
+		_, _ = w.Write(response.Bytes())
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/v1/metrics", TimerModeSummary, 1000)
+	require.Equal(t, []error{nil}, sendMetrics(t, client, metricsOneOfEach()))
+	assert.EqualValues(t, 1, atomic.LoadUint32(&requestNum)) // Not retried
+	assert.EqualValues(t, 3, atomic.LoadUint64(&client.pointsRejected))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesSent))
+}
+
+func TestSendMetricsFailure(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	client, err := NewClient(ts.URL+"/v1/metrics", "agent", "default", "", TimerModeSummary, nil, 1000, false, 1, -1, time.Second, nil, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	errs := sendMetrics(t, client, metricsOneOfEach())
+	require.Len(t, errs, 1)
+	require.Error(t, errs[0])
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesDropped))
+}
+
+func TestQuantiles(t *testing.T) {
+	t.Parallel()
+	client := &Client{disabledSubtypes: gostatsd.TimerSubtypes{Median: true}}
+	assert.Equal(t, []quantile{{0, 1}, {0.1, 2}, {0.9, 8}, {0.99, 9}, {1, 10}}, client.quantiles(gostatsd.Timer{
+		Min: 1,
+		Max: 10,
+		Percentiles: gostatsd.Percentiles{
+			gostatsd.Percentile{Float: 9, Str: "upper_99"},
+			gostatsd.Percentile{Float: 8, Str: "upper_90"},
+			gostatsd.Percentile{Float: 2, Str: "lower_10"},
+			gostatsd.Percentile{Float: 5, Str: "mean_90"},
+		},
+	}))
+}
+
+func TestNewClientFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("flush-interval", time.Second)
+	v.Set("build-version", "1.0")
+	v.Set("otlp.endpoint", "http://localhost:4318/v1/metrics")
+	v.Set("otlp.timer-mode", TimerModeHistogram)
+	v.Set("otlp.histogram-bounds", []interface{}{1, 2.5})
+	backend, err := NewClientFromViper(v, transport.NewTransportPool(logrus.New(), v))
+	require.NoError(t, err)
+	client := backend.(*Client)
+	assert.Equal(t, "1.0", client.version)
+	assert.Equal(t, TimerModeHistogram, client.timerMode)
+	assert.Equal(t, []float64{1, 2.5}, client.histogramBounds)
+
+	v.Set("otlp.timer-mode", "unknown")
+	_, err = NewClientFromViper(v, transport.NewTransportPool(logrus.New(), v))
+	require.Error(t, err)
+}
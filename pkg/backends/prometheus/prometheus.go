@@ -0,0 +1,443 @@
+package prometheus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/cumulative"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	"github.com/golang/snappy"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName                  = "prometheus"
+	defaultUserAgent             = "gostatsd"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	// defaultMetricsPerBatch is the default number of time series to send in a single batch.
+	defaultMetricsPerBatch = 1000
+	// remoteWriteVersion is the version of the remote write protocol spoken.
+	remoteWriteVersion = "0.1.0"
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+// defaultMaxRequests is the number of parallel outgoing requests to the remote write endpoint.
+var defaultMaxRequests = uint(2 * runtime.NumCPU())
+
+// Client represents a Prometheus remote write client.
+type Client struct {
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
+
+	remoteWriteURL        string
+	username              string
+	password              string
+	bearerToken           string
+	userAgent             string
+	maxRequestElapsedTime time.Duration
+	client                *http.Client
+	metricsPerBatch       int
+	requestSem            chan struct{}        // Limits the number of concurrent requests
+	now                   func() time.Time     // Returns current time. Useful for testing.
+	cumulativeCounters    *cumulative.Counters // Optional, running totals of counters sent as <name>_total
+	metadata              gostatsd.MetadataRules
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// SendMetricsAsync flushes the metrics to the remote write endpoint, preparing payload synchronously but doing the
+// send asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	counter := 0
+	results := make(chan error)
+	c.processMetrics(metrics, func(wr *writeRequest) {
+		atomic.AddUint64(&c.batchesCreated, 1)
+		go func() {
+			select {
+			case <-ctx.Done():
+				return
+			case c.requestSem <- struct{}{}:
+				err := c.post(ctx, wr.Bytes())
+				<-c.requestSem
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+		counter++
+	})
+	go func() {
+		errs := make([]error, 0, counter)
+	loop:
+		for i := 0; i < counter; i++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&c.batchesThrottled)), nil)
+		}
+	}
+}
+
+// processMetrics serializes the metrics in to WriteRequests of at most metricsPerBatch time series, calling cb with
+// each.  Every time series has a single sample with the time of the flush.  A counter is a <name>_count and
+// <name>_rate series, and a <name>_total series if cumulative counters are enabled, a timer is a series for each
+// aggregation and a <name>_bucket series with an le label for each histogram bucket, and gauges and sets are a single
+// series named after the metric.  Each series of a metric matching a metadata rule has a MetricMetadata with the
+// description as its help and the unit, in every WriteRequest it is in.  The unit of a timer isn't the unit of its
+// buckets, which only have the help.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*writeRequest)) {
+	now := c.now()
+	timestamp := now.UnixNano() / int64(time.Millisecond)
+	if c.cumulativeCounters != nil {
+		c.cumulativeCounters.Expire(now)
+	}
+	wr := newWriteRequest()
+	// unitless is set for series which don't have the unit of the metric, such as the counts of histogram buckets.
+	addLabels := func(key, name string, labels []label, metricType uint64, value float64, unitless bool) {
+		if !wr.add(labels, value, timestamp) {
+			return
+		}
+		if meta, ok := c.metadata.Lookup(key); ok {
+			if unitless {
+				meta.Unit = ""
+			}
+			wr.describe(sanitizeMetricName(name), metricType, meta)
+		}
+		if wr.count >= c.metricsPerBatch {
+			cb(wr)
+			wr = newWriteRequest()
+		}
+	}
+	add := func(key, suffix string, metricType uint64, hostname string, tags gostatsd.Tags, value float64) {
+		addLabels(key, key+suffix, convertLabels(key+suffix, tags, hostname), metricType, value, false)
+	}
+
+	// Only the running totals are Prometheus counters, as the other series of a counter are for each flush.
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		add(key, "_count", metricTypeGauge, counter.Hostname, counter.Tags, float64(counter.Value))
+		add(key, "_rate", metricTypeGauge, counter.Hostname, counter.Tags, counter.PerSecond)
+		if c.cumulativeCounters != nil {
+			total := c.cumulativeCounters.Add(key, tagsKey, counter.Value, now)
+			add(key, "_total", metricTypeCounter, counter.Hostname, counter.Tags, float64(total.Value))
+		}
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		for _, agg := range c.timerAggregations(timer) {
+			add(key, "_"+agg.name, metricTypeGauge, timer.Hostname, timer.Tags, agg.value)
+		}
+		name := key + "_bucket"
+		for _, bucket := range timer.Histogram {
+			addLabels(key, name, bucketLabels(name, timer.Tags, timer.Hostname, bucket.Bound), metricTypeGauge, float64(bucket.Count), true)
+		}
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		for _, agg := range c.distributionAggregations(dist) {
+			add(key, "_"+agg.name, metricTypeGauge, dist.Hostname, dist.Tags, agg.value)
+		}
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		add(key, "", metricTypeGauge, gauge.Hostname, gauge.Tags, gauge.Value)
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		add(key, "", metricTypeGauge, set.Hostname, set.Tags, float64(len(set.Values)))
+	})
+
+	if wr.count > 0 {
+		cb(wr)
+	}
+}
+
+// aggregation is the value of a single aggregation of a timer or distribution.
+type aggregation struct {
+	name  string
+	value float64
+}
+
+// timerAggregations returns the aggregations of a timer which aren't disabled.
+func (c *Client) timerAggregations(timer gostatsd.Timer) []aggregation {
+	aggs := make([]aggregation, 0, 9+len(timer.Percentiles))
+	if !c.disabledSubtypes.Lower {
+		aggs = append(aggs, aggregation{"lower", timer.Min})
+	}
+	if !c.disabledSubtypes.Upper {
+		aggs = append(aggs, aggregation{"upper", timer.Max})
+	}
+	if !c.disabledSubtypes.Count {
+		aggs = append(aggs, aggregation{"count", float64(timer.Count)})
+	}
+	if !c.disabledSubtypes.CountPerSecond {
+		aggs = append(aggs, aggregation{"count_ps", timer.PerSecond})
+	}
+	if !c.disabledSubtypes.Mean {
+		aggs = append(aggs, aggregation{"mean", timer.Mean})
+	}
+	if !c.disabledSubtypes.Median {
+		aggs = append(aggs, aggregation{"median", timer.Median})
+	}
+	if !c.disabledSubtypes.StdDev {
+		aggs = append(aggs, aggregation{"std", timer.StdDev})
+	}
+	if !c.disabledSubtypes.Sum {
+		aggs = append(aggs, aggregation{"sum", timer.Sum})
+	}
+	if !c.disabledSubtypes.SumSquares {
+		aggs = append(aggs, aggregation{"sum_squares", timer.SumSquares})
+	}
+	for _, pct := range timer.Percentiles {
+		aggs = append(aggs, aggregation{pct.Str, pct.Float})
+	}
+	return aggs
+}
+
+// distributionAggregations returns the aggregations of a distribution which aren't disabled.
+func (c *Client) distributionAggregations(dist gostatsd.Timer) []aggregation {
+	aggs := make([]aggregation, 0, 4+len(dist.Percentiles))
+	if !c.disabledSubtypes.DistributionMin {
+		aggs = append(aggs, aggregation{"min", dist.Min})
+	}
+	if !c.disabledSubtypes.DistributionMax {
+		aggs = append(aggs, aggregation{"max", dist.Max})
+	}
+	if !c.disabledSubtypes.DistributionCount {
+		aggs = append(aggs, aggregation{"count", float64(dist.Count)})
+	}
+	if !c.disabledSubtypes.DistributionSum {
+		aggs = append(aggs, aggregation{"sum", dist.Sum})
+	}
+	for _, pct := range dist.Percentiles {
+		aggs = append(aggs, aggregation{pct.Str, pct.Float})
+	}
+	return aggs
+}
+
+// post sends the payload to the remote write endpoint, retrying with backoff until maxRequestElapsedTime.
+func (c *Client) post(ctx context.Context, payload []byte) error {
+	body := snappy.Encode(nil, payload)
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		err := c.doPost(ctx, body)
+		if err == nil {
+			atomic.AddUint64(&c.batchesSent, 1)
+			return nil
+		}
+
+		next, throttled := util.NextRetry(b, err)
+		if throttled {
+			atomic.AddUint64(&c.batchesThrottled, 1)
+		}
+		if next == backoff.Stop {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] %w", BackendName, err)
+		}
+
+		log.Warnf("[%s] failed to send metrics, sleeping for %s: %v", BackendName, next, err)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&c.batchesRetried, 1)
+	}
+}
+
+func (c *Client) doPost(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", c.remoteWriteURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", remoteWriteVersion)
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
+		return util.NewStatusError(resp)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// KeepsFlushState returns true if cumulative counters are enabled, as sending a flush adds to their totals.
+func (c *Client) KeepsFlushState() bool {
+	return c.cumulativeCounters != nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// NewClientFromViper returns a new Prometheus remote write client.
+func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	p := util.GetSubViper(v, "prometheus")
+	p.SetDefault("remote-write-url", "")
+	p.SetDefault("username", "")
+	p.SetDefault("password", "")
+	p.SetDefault("bearer-token", "")
+	p.SetDefault("metrics-per-batch", defaultMetricsPerBatch)
+	p.SetDefault("cumulative-counters", false)
+	p.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
+	p.SetDefault("max-requests", defaultMaxRequests)
+	p.SetDefault("user-agent", defaultUserAgent)
+	p.SetDefault("transport", "default")
+
+	return NewClient(
+		p.GetString("remote-write-url"),
+		p.GetString("username"),
+		p.GetString("password"),
+		p.GetString("bearer-token"),
+		p.GetString("user-agent"),
+		p.GetString("transport"),
+		p.GetInt("metrics-per-batch"),
+		uint(p.GetInt("max-requests")),
+		p.GetBool("cumulative-counters"),
+		p.GetDuration("max-request-elapsed-time"),
+		gostatsd.MetricMetadataFromViper(v),
+		gostatsd.DisabledSubMetrics(v),
+		pool,
+	)
+}
+
+// NewClient returns a new Prometheus remote write client.
+func NewClient(
+	remoteWriteURL,
+	username,
+	password,
+	bearerToken,
+	userAgent,
+	transport string,
+	metricsPerBatch int,
+	maxRequests uint,
+	cumulativeCounters bool,
+	maxRequestElapsedTime time.Duration,
+	metadata gostatsd.MetadataRules,
+	disabled gostatsd.TimerSubtypes,
+	pool *transport.TransportPool,
+) (*Client, error) {
+	if remoteWriteURL == "" {
+		return nil, fmt.Errorf("[%s] remote-write-url is required", BackendName)
+	}
+	if bearerToken != "" && username != "" {
+		return nil, fmt.Errorf("[%s] only one of username or bearer-token may be set", BackendName)
+	}
+	if userAgent == "" {
+		return nil, fmt.Errorf("[%s] user-agent is required", BackendName)
+	}
+	if metricsPerBatch <= 0 {
+		return nil, fmt.Errorf("[%s] metricsPerBatch must be positive", BackendName)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] maxRequests must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
+	}
+
+	logger := log.WithField("backend", BackendName)
+	httpClient, err := pool.Get(transport)
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	logger.WithFields(log.Fields{
+		"remote-write-url":         remoteWriteURL,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+		"metrics-per-batch":        metricsPerBatch,
+		"cumulative-counters":      cumulativeCounters,
+	}).Info("created backend")
+
+	var counters *cumulative.Counters
+	if cumulativeCounters {
+		counters = cumulative.NewCounters(cumulative.DefaultTTL)
+	}
+
+	return &Client{
+		remoteWriteURL:        remoteWriteURL,
+		username:              username,
+		password:              password,
+		bearerToken:           bearerToken,
+		userAgent:             userAgent,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client:                httpClient.Client,
+		metricsPerBatch:       metricsPerBatch,
+		requestSem:            make(chan struct{}, maxRequests),
+		now:                   time.Now,
+		cumulativeCounters:    counters,
+		metadata:              metadata,
+		disabledSubtypes:      disabled,
+	}, nil
+}
@@ -0,0 +1,425 @@
+package prometheus
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func newTestClient(t *testing.T, url, username, bearerToken string, metricsPerBatch int, cumulativeCounters bool) *Client {
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(url, username, "secret", bearerToken, "agent", "default", metricsPerBatch, defaultMaxRequests, cumulativeCounters, 2*time.Second, nil, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	return client
+}
+
+func metricsOneOfEach() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"tag1": {PerSecond: 1.5, Value: 15, Hostname: "h1", Tags: gostatsd.Tags{"tag1"}},
+	}
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"a:b": {
+			Count:      2,
+			PerSecond:  0.2,
+			Mean:       0.5,
+			Median:     0.5,
+			Min:        0,
+			Max:        1,
+			StdDev:     0.5,
+			Sum:        1,
+			SumSquares: 1,
+			Values:     []float64{0, 1},
+			Percentiles: gostatsd.Percentiles{
+				gostatsd.Percentile{Float: 1, Str: "upper_90"},
+			},
+			Tags: gostatsd.Tags{"a:b"},
+		},
+	}
+	mm.Gauges["g.1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Hostname: "h3"},
+	}
+	mm.Sets["users"] = map[string]gostatsd.Set{
+		"c-d:e": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Tags: gostatsd.Tags{"c-d:e"}},
+	}
+	return mm
+}
+
+// decodeWriteRequest decodes a snappy compressed WriteRequest, returning each time series and the TYPE, HELP and UNIT
+// of each MetricMetadata in the text exposition format, sorted.
+func decodeWriteRequest(t *testing.T, body []byte) []string {
+	payload, err := snappy.Decode(nil, body)
+	require.NoError(t, err)
+
+	// decodeMessage calls field with the tag of each field in b, and a func to decode its value with.
+	decodeMessage := func(b []byte, field func(tag uint64, value func() uint64, bytes func() []byte)) {
+		value := func() uint64 {
+			v, n := binary.Uvarint(b)
+			require.True(t, n > 0)
+			b = b[n:]
+			return v
+		}
+		bytes := func() []byte {
+			n := value()
+			v := b[:n]
+			b = b[n:]
+			return v
+		}
+		for len(b) > 0 {
+			tag := value()
+			if tag&7 == 1 { // Fixed 64 bits, only used for the sample value
+				bits := binary.LittleEndian.Uint64(b)
+				b = b[8:]
+				field(tag, func() uint64 { return bits }, nil)
+				continue
+			}
+			field(tag, value, bytes)
+		}
+	}
+
+	var series []string
+	decodeMessage(payload, func(tag uint64, _ func() uint64, bytes func() []byte) {
+		if tag == tagWriteRequestMetadata {
+			var family, metricType string
+			var lines []string
+			decodeMessage(bytes(), func(tag uint64, value func() uint64, bytes func() []byte) {
+				switch tag {
+				case tagMetadataType:
+					metricType = map[uint64]string{metricTypeCounter: "counter", metricTypeGauge: "gauge"}[value()]
+				case tagMetadataMetricFamilyName:
+					family = string(bytes())
+				case tagMetadataHelp:
+					lines = append(lines, "HELP %s "+string(bytes()))
+				case tagMetadataUnit:
+					lines = append(lines, "UNIT %s "+string(bytes()))
+				default:
+					require.Fail(t, "unexpected tag", tag)
+				}
+			})
+			for _, line := range append(lines, "TYPE %s "+metricType) {
+				series = append(series, "# "+fmt.Sprintf(line, family))
+			}
+			return
+		}
+		require.EqualValues(t, tagWriteRequestTimeseries, tag)
+		var labels []string
+		var sample string
+		decodeMessage(bytes(), func(tag uint64, _ func() uint64, bytes func() []byte) {
+			switch tag {
+			case tagTimeSeriesLabels:
+				var name, value string
+				decodeMessage(bytes(), func(tag uint64, _ func() uint64, bytes func() []byte) {
+					switch tag {
+					case tagLabelName:
+						name = string(bytes())
+					case tagLabelValue:
+						value = string(bytes())
+					}
+				})
+				labels = append(labels, fmt.Sprintf("%s=%q", name, value))
+			case tagTimeSeriesSamples:
+				decodeMessage(bytes(), func(tag uint64, value func() uint64, _ func() []byte) {
+					switch tag {
+					case tagSampleValue:
+						sample += strconv.FormatFloat(math.Float64frombits(value()), 'g', -1, 64)
+					case tagSampleTimestamp:
+						sample += " " + strconv.FormatUint(value(), 10)
+					}
+				})
+			default:
+				require.Fail(t, "unexpected tag", tag)
+			}
+		})
+		series = append(series, "{"+strings.Join(labels, ",")+"} "+sample)
+	})
+	sort.Strings(series)
+	return series
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	var body []byte
+	mux.HandleFunc("/api/v1/write", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "snappy", r.Header.Get("Content-Encoding"))
+		assert.Equal(t, "application/x-protobuf", r.Header.Get("Content-Type"))
+		assert.Equal(t, remoteWriteVersion, r.Header.Get("X-Prometheus-Remote-Write-Version"))
+		username, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", username)
+		assert.Equal(t, "secret", password)
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = data
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/api/v1/write", "user", "", 1000, false)
+	assert.False(t, client.KeepsFlushState())
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 1)
+	require.NoError(t, errs[0])
+
+	expected := []string{
+		`{__name__="c1_count",host="h1",unnamed="tag1"} 15 100000`,
+		`{__name__="c1_rate",host="h1",unnamed="tag1"} 1.5 100000`,
+		`{__name__="t1_lower",a="b"} 0 100000`,
+		`{__name__="t1_upper",a="b"} 1 100000`,
+		`{__name__="t1_count",a="b"} 2 100000`,
+		`{__name__="t1_count_ps",a="b"} 0.2 100000`,
+		`{__name__="t1_mean",a="b"} 0.5 100000`,
+		`{__name__="t1_median",a="b"} 0.5 100000`,
+		`{__name__="t1_std",a="b"} 0.5 100000`,
+		`{__name__="t1_sum",a="b"} 1 100000`,
+		`{__name__="t1_sum_squares",a="b"} 1 100000`,
+		`{__name__="t1_upper_90",a="b"} 1 100000`,
+		`{__name__="g_1",host="h3"} 3 100000`,
+		`{__name__="users",c_d="e"} 2 100000`,
+	}
+	sort.Strings(expected)
+	assert.Equal(t, expected, decodeWriteRequest(t, body))
+}
+
+func TestSendMetricsInMultipleBatches(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Len(t, decodeWriteRequest(t, data), 1)
+		atomic.AddUint32(&requestNum, 1)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/write", "", "token", 1, false)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{"": {Value: 1}}
+	mm.Gauges["g2"] = map[string]gostatsd.Gauge{"": {Value: math.NaN()}} // Skipped
+	mm.Sets["s1"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"a": {}}}}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 2)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 2, atomic.LoadUint32(&requestNum))
+}
+
+func TestSendMetricsCumulativeCounters(t *testing.T) {
+	t.Parallel()
+	bodies := make(chan []byte, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies <- data
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/write", "", "", 1000, true)
+	assert.True(t, client.KeepsFlushState()) // A retried flush would be added to the totals twice
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {PerSecond: 1.5, Value: 15},
+	}
+	for i := 0; i < 2; i++ {
+		res := make(chan []error, 1)
+		client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+			res <- errs
+		})
+		require.Equal(t, []error{nil}, <-res)
+	}
+
+	assert.Contains(t, decodeWriteRequest(t, <-bodies), `{__name__="c1_total"} 15 100000`)
+	assert.Contains(t, decodeWriteRequest(t, <-bodies), `{__name__="c1_total"} 30 100000`)
+}
+
+func TestSendMetricsMetadata(t *testing.T) {
+	t.Parallel()
+	var body []byte
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = data
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/write", "", "", 1000, true)
+	client.metadata = gostatsd.MetadataRules{
+		{Match: gostatsd.StringMatchList{gostatsd.NewStringMatch("c1")}, MetricMetadata: gostatsd.MetricMetadata{Unit: "bytes", Description: "Bytes sent"}},
+		{Match: gostatsd.StringMatchList{gostatsd.NewStringMatch("g.*")}, MetricMetadata: gostatsd.MetricMetadata{Description: "Queue size"}},
+	}
+	mm := metricsOneOfEach()
+	mm.Counters["c1"]["tag2"] = gostatsd.Counter{PerSecond: 0.5, Value: 5, Tags: gostatsd.Tags{"tag2"}}
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+		res <- errs
+	})
+	require.Equal(t, []error{nil}, <-res)
+
+	// Each family has a single MetricMetadata, however many series it has.
+	series := decodeWriteRequest(t, body)
+	var metadata []string
+	for _, s := range series {
+		if strings.HasPrefix(s, "#") {
+			metadata = append(metadata, s)
+		}
+	}
+	assert.Equal(t, []string{
+		"# HELP c1_count Bytes sent",
+		"# HELP c1_rate Bytes sent",
+		"# HELP c1_total Bytes sent",
+		"# HELP g_1 Queue size",
+		"# TYPE c1_count gauge",
+		"# TYPE c1_rate gauge",
+		"# TYPE c1_total counter",
+		"# TYPE g_1 gauge",
+		"# UNIT c1_count bytes",
+		"# UNIT c1_rate bytes",
+		"# UNIT c1_total bytes",
+	}, metadata)
+}
+
+func TestProcessMetricsTimerHistogram(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "http://localhost/write", "", "", 1000, false)
+	client.disabledSubtypes = gostatsd.TimerSubtypes{Lower: true, Upper: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, SumSquares: true}
+	client.metadata = gostatsd.MetadataRules{
+		{Match: gostatsd.StringMatchList{gostatsd.NewStringMatch("t1")}, MetricMetadata: gostatsd.MetricMetadata{Unit: "milliseconds", Description: "Latency"}},
+	}
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"a:b,le:x": {
+			Count: 3,
+			Sum:   16,
+			Histogram: []gostatsd.HistogramBucket{
+				{Name: "histogram.le_0_5", Bound: 0.5, Count: 1},
+				{Name: "histogram.le_10", Bound: 10, Count: 2},
+				{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+			},
+			Tags: gostatsd.Tags{"a:b", "le:x"},
+		},
+	}
+	var series []string
+	client.processMetrics(mm, func(wr *writeRequest) {
+		series = append(series, decodeWriteRequest(t, snappy.Encode(nil, wr.Bytes()))...)
+	})
+
+	// The buckets are counts, so they don't have the unit of the timer.
+	expected := []string{
+		"# HELP t1_bucket Latency",
+		"# HELP t1_count Latency",
+		"# HELP t1_sum Latency",
+		"# TYPE t1_bucket gauge",
+		"# TYPE t1_count gauge",
+		"# TYPE t1_sum gauge",
+		"# UNIT t1_count milliseconds",
+		"# UNIT t1_sum milliseconds",
+		`{__name__="t1_bucket",a="b",le="0.5"} 1 100000`,
+		`{__name__="t1_bucket",a="b",le="10"} 2 100000`,
+		`{__name__="t1_bucket",a="b",le="+Inf"} 3 100000`,
+		`{__name__="t1_count",a="b",le="x"} 3 100000`,
+		`{__name__="t1_sum",a="b",le="x"} 16 100000`,
+	}
+	sort.Strings(expected)
+	assert.Equal(t, expected, series)
+}
+
+func TestSendMetricsFailure(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/write", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	v := viper.New()
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(ts.URL+"/write", "", "", "", "agent", "default", 1000, 1, false, -1, nil, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 1)
+	require.Error(t, errs[0])
+	assert.EqualValues(t, 1, atomic.LoadUint64(&client.batchesDropped))
+}
+
+func TestConvertLabels(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []label{
+		{name: "_9lives", value: "yes"},
+		{name: "__name__", value: "_1_req:total"},
+		{name: "host", value: "h1"},
+		{name: "ser_vice", value: "a.b"},
+	}, convertLabels("1.req:total", gostatsd.Tags{"ser-vice:a.b", "ser.vice:ignored", "9lives:yes", "empty:"}, "h1"))
+}
+
+func TestBucketLabels(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []label{
+		{name: "__name__", value: "t1_bucket"},
+		{name: "host", value: "h1"},
+		{name: "le", value: "0.5"},
+	}, bucketLabels("t1_bucket", nil, "h1", 0.5))
+	assert.Equal(t, []label{
+		{name: "__name__", value: "t1_bucket"},
+		{name: "le", value: "+Inf"},
+		{name: "z", value: "y"},
+	}, bucketLabels("t1_bucket", gostatsd.Tags{"z:y", "le:x"}, "", math.Inf(1)))
+}
+
+func TestNewClientAuth(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	_, err := NewClient("http://localhost/write", "user", "secret", "token", "agent", "default", 1000, defaultMaxRequests, false, time.Second, nil, gostatsd.TimerSubtypes{}, p)
+	require.Error(t, err)
+}
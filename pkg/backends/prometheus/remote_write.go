@@ -0,0 +1,207 @@
+package prometheus
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+)
+
+// Field tags of the remote write protobuf messages, as (field number << 3) | wire type.
+const (
+	tagWriteRequestTimeseries   = 1<<3 | 2
+	tagWriteRequestMetadata     = 3<<3 | 2
+	tagTimeSeriesLabels         = 1<<3 | 2
+	tagTimeSeriesSamples        = 2<<3 | 2
+	tagLabelName                = 1<<3 | 2
+	tagLabelValue               = 2<<3 | 2
+	tagSampleValue              = 1<<3 | 1
+	tagSampleTimestamp          = 2<<3 | 0
+	tagMetadataType             = 1<<3 | 0
+	tagMetadataMetricFamilyName = 2<<3 | 2
+	tagMetadataHelp             = 4<<3 | 2
+	tagMetadataUnit             = 5<<3 | 2
+)
+
+// The MetricType of a MetricMetadata.
+const (
+	metricTypeCounter = 1
+	metricTypeGauge   = 2
+)
+
+// nameLabel is the label holding the metric name.
+const nameLabel = "__name__"
+
+// bucketLabel is the label holding the upper bound of a histogram bucket.
+const bucketLabel = "le"
+
+// label is a Prometheus label.
+type label struct {
+	name  string
+	value string
+}
+
+// writeRequest encodes a remote write WriteRequest, one TimeSeries with a single sample at a time, without depending
+// on the generated Prometheus protobufs.
+type writeRequest struct {
+	buf       *proto.Buffer
+	series    *proto.Buffer       // Scratch space for the TimeSeries being encoded
+	message   *proto.Buffer       // Scratch space for the Label or Sample being encoded
+	described map[string]struct{} // The metric family names with a MetricMetadata
+	count     int
+}
+
+func newWriteRequest() *writeRequest {
+	return &writeRequest{
+		buf:       proto.NewBuffer(nil),
+		series:    proto.NewBuffer(nil),
+		message:   proto.NewBuffer(nil),
+		described: map[string]struct{}{},
+	}
+}
+
+// add appends a TimeSeries with a single sample.  labels must be sorted by name, and include nameLabel.  Values which
+// are NaN or infinite can't be represented and are skipped.  It returns true if a TimeSeries was added.
+func (w *writeRequest) add(labels []label, value float64, timestampMs int64) bool {
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return false
+	}
+
+	// The errors from encoding in to a proto.Buffer are always nil.
+	w.series.Reset()
+	for _, l := range labels {
+		w.message.Reset()
+		_ = w.message.EncodeVarint(tagLabelName)
+		_ = w.message.EncodeStringBytes(l.name)
+		_ = w.message.EncodeVarint(tagLabelValue)
+		_ = w.message.EncodeStringBytes(l.value)
+		_ = w.series.EncodeVarint(tagTimeSeriesLabels)
+		_ = w.series.EncodeRawBytes(w.message.Bytes())
+	}
+
+	w.message.Reset()
+	_ = w.message.EncodeVarint(tagSampleValue)
+	_ = w.message.EncodeFixed64(math.Float64bits(value))
+	_ = w.message.EncodeVarint(tagSampleTimestamp)
+	_ = w.message.EncodeVarint(uint64(timestampMs))
+	_ = w.series.EncodeVarint(tagTimeSeriesSamples)
+	_ = w.series.EncodeRawBytes(w.message.Bytes())
+
+	_ = w.buf.EncodeVarint(tagWriteRequestTimeseries)
+	_ = w.buf.EncodeRawBytes(w.series.Bytes())
+	w.count++
+	return true
+}
+
+// describe appends a MetricMetadata with the help and unit of meta for the metric family, unless the family already
+// has one.
+func (w *writeRequest) describe(family string, metricType uint64, meta gostatsd.MetricMetadata) {
+	if _, ok := w.described[family]; ok {
+		return
+	}
+	w.described[family] = struct{}{}
+
+	w.message.Reset()
+	_ = w.message.EncodeVarint(tagMetadataType)
+	_ = w.message.EncodeVarint(metricType)
+	_ = w.message.EncodeVarint(tagMetadataMetricFamilyName)
+	_ = w.message.EncodeStringBytes(family)
+	if meta.Description != "" {
+		_ = w.message.EncodeVarint(tagMetadataHelp)
+		_ = w.message.EncodeStringBytes(meta.Description)
+	}
+	if meta.Unit != "" {
+		_ = w.message.EncodeVarint(tagMetadataUnit)
+		_ = w.message.EncodeStringBytes(meta.Unit)
+	}
+	_ = w.buf.EncodeVarint(tagWriteRequestMetadata)
+	_ = w.buf.EncodeRawBytes(w.message.Bytes())
+}
+
+// Bytes returns the encoded WriteRequest.
+func (w *writeRequest) Bytes() []byte {
+	return w.buf.Bytes()
+}
+
+// convertLabels converts gostatsd tags to Prometheus labels the same way as the line protocol converts them to tags,
+// with label names sanitized, and the label for name added.  The result is sorted by name, and only the first label
+// with each name is kept.
+func convertLabels(name string, tags gostatsd.Tags, hostname string) []label {
+	tagList := lineprotocol.ConvertTags(tags, hostname)
+	labels := make([]label, 0, len(tagList)+1)
+	labels = append(labels, label{name: nameLabel, value: sanitizeMetricName(name)})
+	for _, t := range tagList {
+		labels = append(labels, label{name: sanitizeLabelName(t.Key), value: t.Value})
+	}
+	sort.SliceStable(labels, func(i, j int) bool {
+		return labels[i].name < labels[j].name
+	})
+	deduped := labels[:0]
+	for i, l := range labels {
+		if i > 0 && l.name == labels[i-1].name {
+			continue
+		}
+		deduped = append(deduped, l)
+	}
+	return deduped
+}
+
+// bucketLabels returns the labels of the series of a histogram bucket, which are the labels of the timer with an le
+// label for the upper bound of the bucket, such as 0.5, 100 or +Inf.  The le label replaces an le tag.
+func bucketLabels(name string, tags gostatsd.Tags, hostname string, bound float64) []label {
+	le := label{name: bucketLabel, value: "+Inf"}
+	if !math.IsInf(bound, 1) {
+		le.value = strconv.FormatFloat(bound, 'f', -1, 64)
+	}
+	labels := convertLabels(name, tags, hostname)
+	i := sort.Search(len(labels), func(i int) bool {
+		return labels[i].name >= bucketLabel
+	})
+	if i < len(labels) && labels[i].name == bucketLabel {
+		labels[i] = le
+		return labels
+	}
+	labels = append(labels, label{})
+	copy(labels[i+1:], labels[i:])
+	labels[i] = le
+	return labels
+}
+
+// sanitizeMetricName replaces the characters which aren't valid in a metric name with underscores, and prefixes an
+// underscore if it starts with a digit.  Valid names match [a-zA-Z_:][a-zA-Z0-9_:]*.
+func sanitizeMetricName(name string) string {
+	return sanitize(name, true)
+}
+
+// sanitizeLabelName replaces the characters which aren't valid in a label name with underscores, and prefixes an
+// underscore if it starts with a digit.  Valid names match [a-zA-Z_][a-zA-Z0-9_]*.
+func sanitizeLabelName(name string) string {
+	return sanitize(name, false)
+}
+
+func sanitize(name string, allowColon bool) string {
+	if name == "" {
+		return "_"
+	}
+	var sb strings.Builder
+	sb.Grow(len(name) + 1)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c == ':' && allowColon:
+		case c >= '0' && c <= '9':
+			if i == 0 {
+				sb.WriteByte('_')
+			}
+		default:
+			c = '_'
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
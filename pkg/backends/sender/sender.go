@@ -27,6 +27,10 @@ type Sender struct {
 	Sink         chan Stream
 	BufPool      sync.Pool
 	WriteTimeout time.Duration
+
+	connectedInit  sync.Once
+	connectedClose sync.Once
+	connected      chan struct{} // Closed once the first connection is established, see connectedChan
 }
 
 func (s *Sender) Run(ctx context.Context) {
@@ -73,6 +77,9 @@ func (s *Sender) Run(ctx context.Context) {
 			}
 			continue
 		}
+		s.connectedClose.Do(func() {
+			close(s.connectedChan())
+		})
 		if stream, errs, err = s.innerRun(ctx, w, stream, errs); err != nil {
 			errs = append(errs, err)
 			if err == context.Canceled || err == context.DeadlineExceeded {
@@ -82,6 +89,23 @@ func (s *Sender) Run(ctx context.Context) {
 	}
 }
 
+// WaitReady waits for the first connection to be established.
+func (s *Sender) WaitReady(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.connectedChan():
+		return nil
+	}
+}
+
+func (s *Sender) connectedChan() chan struct{} {
+	s.connectedInit.Do(func() {
+		s.connected = make(chan struct{})
+	})
+	return s.connected
+}
+
 func (s *Sender) innerRun(ctx context.Context, conn net.Conn, stream *Stream, errs []error) (*Stream, []error, error) {
 	defer func() {
 		if err := conn.Close(); err != nil {
@@ -7,6 +7,7 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -196,6 +197,33 @@ func TestSendCallsCallbackOnCtxDone2(t *testing.T) {
 	cbWg.Wait()
 }
 
+func TestWaitReady(t *testing.T) {
+	t.Parallel()
+	var fail uint32 = 1
+	sender := Sender{
+		ConnFactory: func() (net.Conn, error) {
+			if atomic.LoadUint32(&fail) == 1 {
+				return nil, errors.New("(donotwant)")
+			}
+			return &dummyConn{}, nil
+		},
+		Sink: make(chan Stream),
+	}
+	var wg wait.Group
+	defer wg.Wait()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	wg.StartWithContext(ctx, sender.Run)
+
+	// Not ready while connecting fails
+	waitCtx, waitCancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer waitCancel()
+	assert.Equal(t, context.DeadlineExceeded, sender.WaitReady(waitCtx))
+
+	atomic.StoreUint32(&fail, 0)
+	assert.NoError(t, sender.WaitReady(ctx))
+}
+
 type dummyConn struct {
 	buf      bytes.Buffer
 	writeErr error
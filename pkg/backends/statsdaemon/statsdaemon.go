@@ -53,6 +53,11 @@ func (client *Client) Run(ctx context.Context) {
 	client.sender.Run(ctx)
 }
 
+// WaitReady waits for the first connection to the statsd server to be established.
+func (client *Client) WaitReady(ctx context.Context) error {
+	return client.sender.WaitReady(ctx)
+}
+
 // SendMetricsAsync flushes the metrics to the statsd server, preparing payload synchronously but doing the send asynchronously.
 func (client *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
 	sink := make(chan *bytes.Buffer, sendChannelSize)
@@ -89,8 +94,7 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 		client.sender.PutBuffer(buf)
 	}()
 	line := new(bytes.Buffer)
-	writeLine := func(format, name, tags string, value interface{}) {
-		line.Reset()
+	formatLine := func(format, name, tags string, value interface{}) {
 		if tags == "" || client.disableTags {
 			format += "\n"
 			fmt.Fprintf(line, format, name, value) // #nosec
@@ -98,6 +102,8 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 			format += "|#%s\n"
 			fmt.Fprintf(line, format, name, value, tags) // #nosec
 		}
+	}
+	sendLine := func() {
 		// Make sure we don't go over max udp datagram size
 		if buf.Len()+line.Len() > client.packetSize {
 			b, stop := handler(buf)
@@ -108,6 +114,11 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 		}
 		fmt.Fprint(buf, line) // #nosec
 	}
+	writeLine := func(format, name, tags string, value interface{}) {
+		line.Reset()
+		formatLine(format, name, tags, value)
+		sendLine()
+	}
 	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		// do not send statsd stats as they will be recalculated on the master instead
 		if !strings.HasPrefix(key, "statsd.") {
@@ -119,8 +130,19 @@ func (client *Client) processMetrics(metrics *gostatsd.MetricMap, handler overfl
 			writeLine("%s:%f|ms", key, tagsKey, tr)
 		}
 	})
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		for _, dr := range dist.Values {
+			writeLine("%s:%f|d", key, tagsKey, dr)
+		}
+	})
 	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
-		writeLine("%s:%f|g", key, tagsKey, gauge.Value)
+		line.Reset()
+		if gauge.Value < 0 {
+			// A negative gauge would be a delta, so it's reset to zero first, in the same datagram.
+			formatLine("%s:%d|g", key, tagsKey, 0)
+		}
+		formatLine("%s:%f|g", key, tagsKey, gauge.Value)
+		sendLine()
 	})
 	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
 		for k := range set.Values {
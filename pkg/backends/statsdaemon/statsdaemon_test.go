@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"math"
 	"strings"
 	"testing"
 	"time"
@@ -58,6 +59,44 @@ var gaugeMetic = gostatsd.MetricMap{
 	},
 }
 
+func TestProcessMetricsNegativeGauge(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, false, false, nil)
+	require.NoError(t, err)
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["temp"] = map[string]gostatsd.Gauge{
+		"tag1": gostatsd.NewGauge(gostatsd.Nanotime(time.Now().UnixNano()), -2, "", nil),
+	}
+	c.processMetrics(mm, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		// Zeroed first so it's not received as a delta
+		assert.EqualValues(t, "temp:0|g|#tag1\ntemp:-2.000000|g|#tag1\n", buf.String())
+		return new(bytes.Buffer), false
+	})
+}
+
+func TestProcessMetricsTimerHistogram(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient("localhost:8125", 1*time.Second, 1*time.Second, true, false, nil)
+	require.NoError(t, err)
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count:  2,
+		Values: []float64{1, 20},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 1},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 2},
+		},
+	}}
+
+	// The values are sent rather than the buckets, so the receiving statsd aggregates them itself.
+	var sent string
+	c.processMetrics(mm, func(buf *bytes.Buffer) (*bytes.Buffer, bool) {
+		sent += buf.String()
+		return new(bytes.Buffer), false
+	})
+	assert.Equal(t, "t1:1.000000|ms\nt1:20.000000|ms\n", sent)
+}
+
 func TestProcessMetrics(t *testing.T) {
 	t.Parallel()
 	input := []struct {
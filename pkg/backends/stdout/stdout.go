@@ -5,10 +5,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
@@ -19,20 +21,30 @@ const BackendName = "stdout"
 
 // Client is an object that is used to send messages to stdout.
 type Client struct {
-	disabledSubtypes gostatsd.TimerSubtypes
+	disabledSubtypes     gostatsd.TimerSubtypes
+	serializeConcurrency int // Number of metric types serialized in parallel
 }
 
 // NewClientFromViper constructs a stdout backend.
 func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	s := util.GetSubViper(v, "stdout")
+	s.SetDefault("serialize_concurrency", 1)
+
 	return NewClient(
 		gostatsd.DisabledSubMetrics(v),
+		s.GetInt("serialize_concurrency"),
 	)
 }
 
-// NewClient constructs a stdout backend.
-func NewClient(disabled gostatsd.TimerSubtypes) (*Client, error) {
+// NewClient constructs a stdout backend.  serializeConcurrency is the number of metric types serialized in parallel
+// for each flush, 1 to serialize them one after the other.
+func NewClient(disabled gostatsd.TimerSubtypes, serializeConcurrency int) (*Client, error) {
+	if serializeConcurrency <= 0 {
+		return nil, fmt.Errorf("[%s] serialize_concurrency must be positive", BackendName)
+	}
 	return &Client{
-		disabledSubtypes: disabled,
+		disabledSubtypes:     disabled,
+		serializeConcurrency: serializeConcurrency,
 	}, nil
 }
 
@@ -54,7 +66,7 @@ func tagToMetricName(tag string) string {
 
 // SendMetricsAsync prints the metrics in a MetricsMap to the stdout, preparing payload synchronously but doing the send asynchronously.
 func (client Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
-	buf := preparePayload(metrics, &client.disabledSubtypes)
+	buf := preparePayload(metrics, &client.disabledSubtypes, client.serializeConcurrency)
 	go func() {
 		cb([]error{writePayload(buf)})
 	}()
@@ -71,15 +83,59 @@ func writePayload(buf *bytes.Buffer) (retErr error) {
 	return err
 }
 
-func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtypes) *bytes.Buffer {
-	buf := new(bytes.Buffer)
+// preparePayload serializes the metrics, with up to concurrency metric types serialized in parallel.  The output is
+// the same regardless of concurrency, with counters, timers, gauges, sets and distributions in that order.
+func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtypes, concurrency int) *bytes.Buffer {
 	now := time.Now().Unix()
-	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+	serializers := []func(*bytes.Buffer){
+		func(buf *bytes.Buffer) { writeCounters(buf, metrics.Counters, now) },
+		func(buf *bytes.Buffer) { writeTimers(buf, metrics.Timers, disabled, now) },
+		func(buf *bytes.Buffer) { writeGauges(buf, metrics.Gauges, now) },
+		func(buf *bytes.Buffer) { writeSets(buf, metrics.Sets, now) },
+		func(buf *bytes.Buffer) { writeDistributions(buf, metrics.Distributions, disabled, now) },
+	}
+
+	if concurrency <= 1 {
+		buf := new(bytes.Buffer)
+		for _, serialize := range serializers {
+			serialize(buf)
+		}
+		return buf
+	}
+
+	bufs := make([]*bytes.Buffer, len(serializers))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	wg.Add(len(serializers))
+	for idx, serialize := range serializers {
+		idx, serialize := idx, serialize
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			bufs[idx] = new(bytes.Buffer)
+			serialize(bufs[idx])
+			<-sem
+		}()
+	}
+	wg.Wait()
+
+	buf := bufs[0]
+	for _, b := range bufs[1:] {
+		buf.Write(b.Bytes())
+	}
+	return buf
+}
+
+func writeCounters(buf *bytes.Buffer, counters gostatsd.Counters, now int64) {
+	counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		nk := composeMetricName(key, tagsKey)
 		fmt.Fprintf(buf, "stats.counter.%s.count %d %d\n", nk, counter.Value, now)          // #nosec
 		fmt.Fprintf(buf, "stats.counter.%s.per_second %f %d\n", nk, counter.PerSecond, now) // #nosec
 	})
-	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+}
+
+func writeTimers(buf *bytes.Buffer, timers gostatsd.Timers, disabled *gostatsd.TimerSubtypes, now int64) {
+	timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		nk := composeMetricName(key, tagsKey)
 		if !disabled.Lower {
 			fmt.Fprintf(buf, "stats.timers.%s.lower %f %d\n", nk, timer.Min, now) // #nosec
@@ -111,16 +167,45 @@ func preparePayload(metrics *gostatsd.MetricMap, disabled *gostatsd.TimerSubtype
 		for _, pct := range timer.Percentiles {
 			fmt.Fprintf(buf, "stats.timers.%s.%s %f %d\n", nk, pct.Str, pct.Float, now) // #nosec
 		}
+		for _, bucket := range timer.Histogram {
+			fmt.Fprintf(buf, "stats.timers.%s.%s %d %d\n", nk, bucket.Name, bucket.Count, now) // #nosec
+		}
 	})
-	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+}
+
+func writeGauges(buf *bytes.Buffer, gauges gostatsd.Gauges, now int64) {
+	gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		nk := composeMetricName(key, tagsKey)
 		fmt.Fprintf(buf, "stats.gauge.%s %f %d\n", nk, gauge.Value, now) // #nosec
 	})
-	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+}
+
+func writeSets(buf *bytes.Buffer, sets gostatsd.Sets, now int64) {
+	sets.Each(func(key, tagsKey string, set gostatsd.Set) {
 		nk := composeMetricName(key, tagsKey)
 		fmt.Fprintf(buf, "stats.set.%s %d %d\n", nk, len(set.Values), now) // #nosec
 	})
-	return buf
+}
+
+func writeDistributions(buf *bytes.Buffer, distributions gostatsd.Distributions, disabled *gostatsd.TimerSubtypes, now int64) {
+	distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		nk := composeMetricName(key, tagsKey)
+		if !disabled.DistributionMin {
+			fmt.Fprintf(buf, "stats.distribution.%s.min %f %d\n", nk, dist.Min, now) // #nosec
+		}
+		if !disabled.DistributionMax {
+			fmt.Fprintf(buf, "stats.distribution.%s.max %f %d\n", nk, dist.Max, now) // #nosec
+		}
+		if !disabled.DistributionCount {
+			fmt.Fprintf(buf, "stats.distribution.%s.count %d %d\n", nk, dist.Count, now) // #nosec
+		}
+		if !disabled.DistributionSum {
+			fmt.Fprintf(buf, "stats.distribution.%s.sum %f %d\n", nk, dist.Sum, now) // #nosec
+		}
+		for _, pct := range dist.Percentiles {
+			fmt.Fprintf(buf, "stats.distribution.%s.%s %f %d\n", nk, pct.Str, pct.Float, now) // #nosec
+		}
+	})
 }
 
 // SendEvent prints events to the stdout.
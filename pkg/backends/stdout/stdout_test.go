@@ -0,0 +1,83 @@
+package stdout
+
+import (
+	"math"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// withoutTimestamps returns the lines of the payload without the timestamp, which may differ between payloads.
+func withoutTimestamps(payload string) []string {
+	lines := strings.Split(strings.TrimSpace(payload), "\n")
+	for idx, line := range lines {
+		lines[idx] = line[:strings.LastIndexByte(line, ' ')]
+	}
+	return lines
+}
+
+func TestPreparePayloadConcurrency(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{"a:b": {Value: 5, PerSecond: 0.5}}
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {Count: 2, Min: 1, Max: 3}}
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{"": {Value: 3}}
+	mm.Sets["s1"] = map[string]gostatsd.Set{"": {Values: map[string]struct{}{"x": {}}}}
+	mm.Distributions["t1"] = map[string]gostatsd.Timer{"": {
+		Count:       2,
+		Min:         1,
+		Max:         3,
+		Sum:         4,
+		Percentiles: gostatsd.Percentiles{{Str: "p90", Float: 3}},
+	}}
+	disabled := gostatsd.TimerSubtypes{Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true, CountPerSecond: true, DistributionSum: true}
+
+	expected := []string{
+		"stats.counter.c1.a.b.count 5",
+		"stats.counter.c1.a.b.per_second 0.500000",
+		"stats.timers.t1.lower 1.000000",
+		"stats.timers.t1.upper 3.000000",
+		"stats.timers.t1.count 2",
+		"stats.gauge.g1 3.000000",
+		"stats.set.s1 1",
+		"stats.distribution.t1.min 1.000000",
+		"stats.distribution.t1.max 3.000000",
+		"stats.distribution.t1.count 2",
+		"stats.distribution.t1.p90 3.000000",
+	}
+	for _, concurrency := range []int{1, 2, 4, 8} {
+		buf := preparePayload(mm, &disabled, concurrency)
+		assert.Equal(t, expected, withoutTimestamps(buf.String()), "concurrency %d", concurrency)
+	}
+}
+
+func TestPreparePayloadTimerHistogram(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count: 3,
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+	disabled := gostatsd.TimerSubtypes{Lower: true, Upper: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true, CountPerSecond: true}
+
+	expected := []string{
+		"stats.timers.t1.count 3",
+		"stats.timers.t1.histogram.le_10 2",
+		"stats.timers.t1.histogram.le_inf 3",
+	}
+	buf := preparePayload(mm, &disabled, 1)
+	assert.Equal(t, expected, withoutTimestamps(buf.String()))
+}
+
+func TestNewClientConcurrency(t *testing.T) {
+	t.Parallel()
+	_, err := NewClient(gostatsd.TimerSubtypes{}, 0)
+	require.Error(t, err)
+}
@@ -0,0 +1,467 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/cumulative"
+	"github.com/atlassian/gostatsd/pkg/backends/lineprotocol"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// BackendName is the name of this backend.
+	BackendName = "victoriametrics"
+	// defaultAddress is the default address of the VictoriaMetrics server.
+	defaultAddress               = "http://localhost:8428"
+	defaultUserAgent             = "gostatsd"
+	defaultMaxRequestElapsedTime = 15 * time.Second
+	// defaultMetricsPerBatch is the default number of lines to send in a single batch.
+	defaultMetricsPerBatch = 1000
+	// importPath is the path of the InfluxDB line protocol import endpoint.
+	importPath = "/influx/write"
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 10 * 1024
+)
+
+// defaultMaxRequests is the number of parallel outgoing requests to VictoriaMetrics.
+var defaultMaxRequests = uint(2 * runtime.NumCPU())
+
+// Client represents a VictoriaMetrics client, which sends metrics in the InfluxDB line protocol.
+type Client struct {
+	batchesCreated   uint64 // Accumulated number of batches created
+	batchesRetried   uint64 // Accumulated number of batches retried (first send is not a retry)
+	batchesDropped   uint64 // Accumulated number of batches aborted (data loss)
+	batchesSent      uint64 // Accumulated number of batches successfully sent
+	batchesThrottled uint64 // Accumulated number of batches rejected with 429 Too Many Requests
+
+	writeURL              string
+	username              string
+	password              string
+	bearerToken           string
+	userAgent             string
+	maxRequestElapsedTime time.Duration
+	client                *http.Client
+	metricsPerBatch       int
+	requestSem            chan struct{}    // Limits the number of concurrent requests
+	bufferPool            *util.BufferPool // Buffers for batches and compressed payloads
+	now                   func() time.Time // Returns current time. Useful for testing.
+	timestampOffset       time.Duration    // Added to every timestamp sent, to compensate for clock skew
+	compressPayload       bool
+	cumulativeCounters    *cumulative.Counters // Optional, running totals of counters sent as the total field
+
+	disabledSubtypes gostatsd.TimerSubtypes
+}
+
+// SendMetricsAsync flushes the metrics to VictoriaMetrics, preparing payload synchronously but doing the send
+// asynchronously.
+func (c *Client) SendMetricsAsync(ctx context.Context, metrics *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	counter := 0
+	results := make(chan error)
+	c.processMetrics(metrics, func(batch *bytes.Buffer) {
+		atomic.AddUint64(&c.batchesCreated, 1)
+		go func() {
+			defer c.bufferPool.Put(batch)
+			select {
+			case <-ctx.Done():
+				return
+			case c.requestSem <- struct{}{}:
+				err := c.post(ctx, batch.Bytes())
+				<-c.requestSem
+
+				select {
+				case <-ctx.Done():
+				case results <- err:
+				}
+			}
+		}()
+		counter++
+	})
+	go func() {
+		errs := make([]error, 0, counter)
+	loop:
+		for i := 0; i < counter; i++ {
+			select {
+			case <-ctx.Done():
+				errs = append(errs, ctx.Err())
+				break loop
+			case err := <-results:
+				errs = append(errs, err)
+			}
+		}
+		cb(errs)
+	}()
+}
+
+func (c *Client) Run(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags(gostatsd.Tags{"backend:" + BackendName})
+
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backend.created", float64(atomic.LoadUint64(&c.batchesCreated)), nil)
+			statser.Gauge("backend.retried", float64(atomic.LoadUint64(&c.batchesRetried)), nil)
+			statser.Gauge("backend.dropped", float64(atomic.LoadUint64(&c.batchesDropped)), nil)
+			statser.Gauge("backend.sent", float64(atomic.LoadUint64(&c.batchesSent)), nil)
+			statser.Gauge("backend.throttled", float64(atomic.LoadUint64(&c.batchesThrottled)), nil)
+		}
+	}
+}
+
+// processMetrics serializes the metrics in to batches of at most metricsPerBatch lines, calling cb with each.  A
+// counter is a single line with count and rate fields, and a total field if cumulative counters are enabled, a timer is a single line with a field for each aggregation,
+// and gauges and sets have a single value field.
+func (c *Client) processMetrics(metrics *gostatsd.MetricMap, cb func(*bytes.Buffer)) {
+	now := c.now()
+	timestamp := now.Add(c.timestampOffset).UnixNano()
+	if c.cumulativeCounters != nil {
+		c.cumulativeCounters.Expire(now)
+	}
+	batch := c.bufferPool.Get()
+	lines := 0
+	add := func(name, hostname string, tags gostatsd.Tags, fields []lineprotocol.Field) {
+		if !lineprotocol.AppendLine(batch, name, lineprotocol.ConvertTags(tags, hostname), fields, timestamp) {
+			return
+		}
+		lines++
+		if lines >= c.metricsPerBatch {
+			cb(batch)
+			batch = c.bufferPool.Get()
+			lines = 0
+		}
+	}
+
+	metrics.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		fields := []lineprotocol.Field{
+			{Key: "count", Value: float64(counter.Value)},
+			{Key: "rate", Value: counter.PerSecond},
+		}
+		if c.cumulativeCounters != nil {
+			total := c.cumulativeCounters.Add(key, tagsKey, counter.Value, now)
+			fields = append(fields, lineprotocol.Field{Key: "total", Value: float64(total.Value)})
+		}
+		add(key, counter.Hostname, counter.Tags, fields)
+	})
+
+	metrics.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		add(key, timer.Hostname, timer.Tags, c.timerFields(timer))
+	})
+
+	metrics.Distributions.Each(func(key, tagsKey string, dist gostatsd.Timer) {
+		add(key, dist.Hostname, dist.Tags, c.distributionFields(dist))
+	})
+
+	metrics.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		add(key, gauge.Hostname, gauge.Tags, []lineprotocol.Field{{Key: "value", Value: gauge.Value}})
+	})
+
+	metrics.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		add(key, set.Hostname, set.Tags, []lineprotocol.Field{{Key: "value", Value: float64(len(set.Values))}})
+	})
+
+	if lines > 0 {
+		cb(batch)
+	} else {
+		c.bufferPool.Put(batch)
+	}
+}
+
+// timerFields returns the fields for the aggregations of a timer which aren't disabled.
+func (c *Client) timerFields(timer gostatsd.Timer) []lineprotocol.Field {
+	fields := make([]lineprotocol.Field, 0, 9+len(timer.Percentiles)+len(timer.Histogram))
+	if !c.disabledSubtypes.Lower {
+		fields = append(fields, lineprotocol.Field{Key: "lower", Value: timer.Min})
+	}
+	if !c.disabledSubtypes.Upper {
+		fields = append(fields, lineprotocol.Field{Key: "upper", Value: timer.Max})
+	}
+	if !c.disabledSubtypes.Count {
+		fields = append(fields, lineprotocol.Field{Key: "count", Value: float64(timer.Count)})
+	}
+	if !c.disabledSubtypes.CountPerSecond {
+		fields = append(fields, lineprotocol.Field{Key: "count_ps", Value: timer.PerSecond})
+	}
+	if !c.disabledSubtypes.Mean {
+		fields = append(fields, lineprotocol.Field{Key: "mean", Value: timer.Mean})
+	}
+	if !c.disabledSubtypes.Median {
+		fields = append(fields, lineprotocol.Field{Key: "median", Value: timer.Median})
+	}
+	if !c.disabledSubtypes.StdDev {
+		fields = append(fields, lineprotocol.Field{Key: "std", Value: timer.StdDev})
+	}
+	if !c.disabledSubtypes.Sum {
+		fields = append(fields, lineprotocol.Field{Key: "sum", Value: timer.Sum})
+	}
+	if !c.disabledSubtypes.SumSquares {
+		fields = append(fields, lineprotocol.Field{Key: "sum_squares", Value: timer.SumSquares})
+	}
+	for _, pct := range timer.Percentiles {
+		fields = append(fields, lineprotocol.Field{Key: pct.Str, Value: pct.Float})
+	}
+	for _, bucket := range timer.Histogram {
+		fields = append(fields, lineprotocol.Field{Key: bucket.Name, Value: float64(bucket.Count)})
+	}
+	return fields
+}
+
+// distributionFields returns the fields for the aggregations of a distribution which aren't disabled.
+func (c *Client) distributionFields(dist gostatsd.Timer) []lineprotocol.Field {
+	fields := make([]lineprotocol.Field, 0, 4+len(dist.Percentiles))
+	if !c.disabledSubtypes.DistributionMin {
+		fields = append(fields, lineprotocol.Field{Key: "min", Value: dist.Min})
+	}
+	if !c.disabledSubtypes.DistributionMax {
+		fields = append(fields, lineprotocol.Field{Key: "max", Value: dist.Max})
+	}
+	if !c.disabledSubtypes.DistributionCount {
+		fields = append(fields, lineprotocol.Field{Key: "count", Value: float64(dist.Count)})
+	}
+	if !c.disabledSubtypes.DistributionSum {
+		fields = append(fields, lineprotocol.Field{Key: "sum", Value: dist.Sum})
+	}
+	for _, pct := range dist.Percentiles {
+		fields = append(fields, lineprotocol.Field{Key: pct.Str, Value: pct.Float})
+	}
+	return fields
+}
+
+// post sends the payload to VictoriaMetrics, retrying with backoff until maxRequestElapsedTime.
+func (c *Client) post(ctx context.Context, payload []byte) error {
+	body := payload
+	if c.compressPayload {
+		compressed := c.bufferPool.Get()
+		defer c.bufferPool.Put(compressed)
+		if err := compress(compressed, payload); err != nil {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] unable to compress payload: %v", BackendName, err)
+		}
+		body = compressed.Bytes()
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = c.maxRequestElapsedTime
+	for {
+		err := c.doPost(ctx, body)
+		if err == nil {
+			atomic.AddUint64(&c.batchesSent, 1)
+			return nil
+		}
+
+		next, throttled := util.NextRetry(b, err)
+		if throttled {
+			atomic.AddUint64(&c.batchesThrottled, 1)
+		}
+		if next == backoff.Stop {
+			atomic.AddUint64(&c.batchesDropped, 1)
+			return fmt.Errorf("[%s] %w", BackendName, err)
+		}
+
+		log.Warnf("[%s] failed to send metrics, sleeping for %s: %v", BackendName, next, err)
+
+		timer := time.NewTimer(next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+
+		atomic.AddUint64(&c.batchesRetried, 1)
+	}
+}
+
+func (c *Client) doPost(ctx context.Context, body []byte) error {
+	req, err := http.NewRequest("POST", c.writeURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", c.userAgent)
+	if c.compressPayload {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	if c.bearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	} else if c.username != "" {
+		req.SetBasicAuth(c.username, c.password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POSTing: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode < http.StatusOK || resp.StatusCode > http.StatusNoContent {
+		b, _ := ioutil.ReadAll(respBody)
+		log.Infof("[%s] failed request status: %d\n%s", BackendName, resp.StatusCode, b)
+		return util.NewStatusError(resp)
+	}
+	_, _ = io.Copy(ioutil.Discard, respBody)
+	return nil
+}
+
+// compressorPool holds gzip writers for reuse, as each allocates large internal buffers.
+var compressorPool = sync.Pool{
+	New: func() interface{} {
+		return gzip.NewWriter(nil)
+	},
+}
+
+func compress(w io.Writer, payload []byte) error {
+	compressor := compressorPool.Get().(*gzip.Writer)
+	defer compressorPool.Put(compressor)
+	compressor.Reset(w)
+	if _, err := compressor.Write(payload); err != nil {
+		return err
+	}
+	return compressor.Close()
+}
+
+// SendEvent discards events.
+func (c *Client) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// KeepsFlushState returns true if cumulative counters are enabled, as sending a flush adds to their totals.
+func (c *Client) KeepsFlushState() bool {
+	return c.cumulativeCounters != nil
+}
+
+// Name returns the name of the backend.
+func (c *Client) Name() string {
+	return BackendName
+}
+
+// NewClientFromViper returns a new VictoriaMetrics client.
+func NewClientFromViper(v *viper.Viper, pool *transport.TransportPool) (gostatsd.Backend, error) {
+	vm := util.GetSubViper(v, "victoriametrics")
+	vm.SetDefault("address", defaultAddress)
+	vm.SetDefault("username", "")
+	vm.SetDefault("password", "")
+	vm.SetDefault("bearer_token", "")
+	vm.SetDefault("metrics_per_batch", defaultMetricsPerBatch)
+	vm.SetDefault("compress_payload", true)
+	vm.SetDefault("cumulative_counters", false)
+	vm.SetDefault("max_request_elapsed_time", defaultMaxRequestElapsedTime)
+	vm.SetDefault("max_requests", defaultMaxRequests)
+	vm.SetDefault("user-agent", defaultUserAgent)
+	vm.SetDefault("transport", "default")
+	vm.SetDefault("timestamp_offset", 0)
+
+	return NewClient(
+		vm.GetString("address"),
+		vm.GetString("username"),
+		vm.GetString("password"),
+		vm.GetString("bearer_token"),
+		vm.GetString("user-agent"),
+		vm.GetString("transport"),
+		vm.GetInt("metrics_per_batch"),
+		uint(vm.GetInt("max_requests")),
+		vm.GetBool("compress_payload"),
+		vm.GetBool("cumulative_counters"),
+		vm.GetDuration("max_request_elapsed_time"),
+		vm.GetDuration("timestamp_offset"),
+		gostatsd.DisabledSubMetrics(v),
+		pool,
+	)
+}
+
+// NewClient returns a new VictoriaMetrics client.
+func NewClient(
+	address,
+	username,
+	password,
+	bearerToken,
+	userAgent,
+	transport string,
+	metricsPerBatch int,
+	maxRequests uint,
+	compressPayload,
+	cumulativeCounters bool,
+	maxRequestElapsedTime,
+	timestampOffset time.Duration,
+	disabled gostatsd.TimerSubtypes,
+	pool *transport.TransportPool,
+) (*Client, error) {
+	if address == "" {
+		return nil, fmt.Errorf("[%s] address is required", BackendName)
+	}
+	if bearerToken != "" && username != "" {
+		return nil, fmt.Errorf("[%s] only one of username or bearer_token may be set", BackendName)
+	}
+	if userAgent == "" {
+		return nil, fmt.Errorf("[%s] user-agent is required", BackendName)
+	}
+	if metricsPerBatch <= 0 {
+		return nil, fmt.Errorf("[%s] metricsPerBatch must be positive", BackendName)
+	}
+	if maxRequests == 0 {
+		return nil, fmt.Errorf("[%s] maxRequests must be positive", BackendName)
+	}
+	if maxRequestElapsedTime <= 0 && maxRequestElapsedTime != -1 {
+		return nil, fmt.Errorf("[%s] maxRequestElapsedTime must be positive", BackendName)
+	}
+
+	logger := log.WithField("backend", BackendName)
+	httpClient, err := pool.Get(transport)
+	if err != nil {
+		logger.WithError(err).Error("failed to create http client")
+		return nil, err
+	}
+	logger.WithFields(log.Fields{
+		"address":                  address,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+		"max-requests":             maxRequests,
+		"metrics-per-batch":        metricsPerBatch,
+		"compress-payload":         compressPayload,
+		"cumulative-counters":      cumulativeCounters,
+		"timestamp-offset":         timestampOffset,
+	}).Info("created backend")
+
+	var counters *cumulative.Counters
+	if cumulativeCounters {
+		counters = cumulative.NewCounters(cumulative.DefaultTTL)
+	}
+
+	return &Client{
+		writeURL:              strings.TrimSuffix(address, "/") + importPath,
+		username:              username,
+		password:              password,
+		bearerToken:           bearerToken,
+		userAgent:             userAgent,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		client:                httpClient.Client,
+		metricsPerBatch:       metricsPerBatch,
+		requestSem:            make(chan struct{}, maxRequests),
+		bufferPool:            util.NewBufferPool(0),
+		now:                   time.Now,
+		timestampOffset:       timestampOffset,
+		compressPayload:       compressPayload,
+		cumulativeCounters:    counters,
+		disabledSubtypes:      disabled,
+	}, nil
+}
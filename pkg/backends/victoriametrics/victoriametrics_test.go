@@ -0,0 +1,201 @@
+package victoriametrics
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/transport"
+)
+
+func newTestClient(t *testing.T, address, username, bearerToken string, metricsPerBatch int, compress, cumulativeCounters bool) *Client {
+	v := viper.New()
+	v.Set("transport.default.client-timeout", 1*time.Second)
+	p := transport.NewTransportPool(logrus.New(), v)
+	client, err := NewClient(address, username, "secret", bearerToken, "agent", "default", metricsPerBatch, defaultMaxRequests, compress, cumulativeCounters, 2*time.Second, 0, gostatsd.TimerSubtypes{}, p)
+	require.NoError(t, err)
+	client.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	return client
+}
+
+func metricsOneOfEach() *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"tag1": {PerSecond: 1.5, Value: 15, Hostname: "h1", Tags: gostatsd.Tags{"tag1"}},
+	}
+	mm.Timers["t1"] = map[string]gostatsd.Timer{
+		"a:b": {
+			Count:      2,
+			PerSecond:  0.2,
+			Mean:       0.5,
+			Median:     0.5,
+			Min:        0,
+			Max:        1,
+			StdDev:     0.5,
+			Sum:        1,
+			SumSquares: 1,
+			Values:     []float64{0, 1},
+			Percentiles: gostatsd.Percentiles{
+				gostatsd.Percentile{Float: 1, Str: "upper_90"},
+			},
+			Tags: gostatsd.Tags{"a:b"},
+		},
+	}
+	mm.Gauges["g1"] = map[string]gostatsd.Gauge{
+		"": {Value: 3, Hostname: "h3"},
+	}
+	mm.Sets["users"] = map[string]gostatsd.Set{
+		"c:d": {Values: map[string]struct{}{"joe": {}, "bob": {}}, Tags: gostatsd.Tags{"c:d"}},
+	}
+	return mm
+}
+
+func sortLines(s string) []string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	sort.Strings(lines)
+	return lines
+}
+
+func TestSendMetrics(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	var body string
+	mux.HandleFunc("/influx/write", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		username, password, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "user", username)
+		assert.Equal(t, "secret", password)
+		reader, err := gzip.NewReader(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		data, err := ioutil.ReadAll(reader)
+		if !assert.NoError(t, err) {
+			return
+		}
+		body = string(data)
+		w.WriteHeader(http.StatusNoContent)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL+"/", "user", "", 1000, true, false)
+	assert.False(t, client.KeepsFlushState())
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 1)
+	require.NoError(t, errs[0])
+
+	expected := "c1,host=h1,unnamed=tag1 count=15,rate=1.5 100000000000\n" +
+		"t1,a=b lower=0,upper=1,count=2,count_ps=0.2,mean=0.5,median=0.5,std=0.5,sum=1,sum_squares=1,upper_90=1 100000000000\n" +
+		"g1,host=h3 value=3 100000000000\n" +
+		"users,c=d value=2 100000000000\n"
+	assert.Equal(t, sortLines(expected), sortLines(body))
+}
+
+func TestProcessMetricsTimerHistogram(t *testing.T) {
+	t.Parallel()
+	client := newTestClient(t, "http://localhost/", "", "", 1000, false, false)
+	client.disabledSubtypes = gostatsd.TimerSubtypes{Lower: true, Upper: true, CountPerSecond: true, Mean: true, Median: true, StdDev: true, Sum: true, SumSquares: true}
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["t1"] = map[string]gostatsd.Timer{"": {
+		Count:       3,
+		Percentiles: gostatsd.Percentiles{{Str: "upper_90", Float: 12.5}},
+		Histogram: []gostatsd.HistogramBucket{
+			{Name: "histogram.le_10", Bound: 10, Count: 2},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 3},
+		},
+	}}
+	var body string
+	client.processMetrics(mm, func(buf *bytes.Buffer) {
+		body += buf.String()
+	})
+	assert.Equal(t, "t1 count=3,upper_90=12.5,histogram.le_10=2,histogram.le_inf=3 100000000000\n", body)
+}
+
+func TestSendMetricsInMultipleBatches(t *testing.T) {
+	t.Parallel()
+	var requestNum uint32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/influx/write", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		data, err := ioutil.ReadAll(r.Body)
+		if !assert.NoError(t, err) {
+			return
+		}
+		assert.Equal(t, 1, strings.Count(string(data), "\n"))
+		atomic.AddUint32(&requestNum, 1)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, "", "token", 1, false, false)
+	res := make(chan []error, 1)
+	client.SendMetricsAsync(context.Background(), metricsOneOfEach(), func(errs []error) {
+		res <- errs
+	})
+	errs := <-res
+	require.Len(t, errs, 4)
+	for _, err := range errs {
+		assert.NoError(t, err)
+	}
+	assert.EqualValues(t, 4, atomic.LoadUint32(&requestNum))
+}
+
+func TestSendMetricsCumulativeCounters(t *testing.T) {
+	t.Parallel()
+	bodies := make(chan string, 2)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/influx/write", func(w http.ResponseWriter, r *http.Request) {
+		data, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		bodies <- string(data)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	client := newTestClient(t, ts.URL, "", "", 1000, false, true)
+	assert.True(t, client.KeepsFlushState()) // A retried flush would be added to the totals twice
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["c1"] = map[string]gostatsd.Counter{
+		"": {PerSecond: 1.5, Value: 15},
+	}
+	for i := 0; i < 2; i++ {
+		res := make(chan []error, 1)
+		client.SendMetricsAsync(context.Background(), mm, func(errs []error) {
+			res <- errs
+		})
+		require.Equal(t, []error{nil}, <-res)
+	}
+
+	assert.Equal(t, "c1 count=15,rate=1.5,total=15 100000000000\n", <-bodies)
+	assert.Equal(t, "c1 count=15,rate=1.5,total=30 100000000000\n", <-bodies)
+}
+
+func TestNewClientAuth(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	_, err := NewClient("http://localhost", "user", "secret", "token", "agent", "default", 1000, defaultMaxRequests, true, false, time.Second, 0, gostatsd.TimerSubtypes{}, p)
+	require.Error(t, err)
+}
@@ -0,0 +1,176 @@
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// ErrNotActive is returned by Stop when no capture is running.
+var ErrNotActive = errors.New("capture is not active")
+
+// Options controls what is captured.
+type Options struct {
+	SourceIP gostatsd.IP // Only capture datagrams from this address, or everything if empty
+	Rate     float64     // Maximum number of datagrams to capture per second
+	Limit    uint64      // Stop capturing after this many datagrams, 0 for unlimited
+}
+
+// Status describes the state of the Capturer.
+type Status struct {
+	Active   bool        `json:"active"`
+	File     string      `json:"file"`
+	SourceIP gostatsd.IP `json:"source_ip,omitempty"`
+	Rate     float64     `json:"rate,omitempty"`
+	Limit    uint64      `json:"limit,omitempty"`
+	Captured uint64      `json:"captured"`
+}
+
+// Capturer writes a rate limited sample of raw datagrams to a file, for debugging misbehaving clients.  It is
+// inactive until Start is called, and checking if it is active is cheap enough to do for every datagram.
+//
+// Each datagram is written as a header line of "<timestamp> <source ip> <length>", followed by the raw datagram
+// and a newline.  The length allows datagrams containing newlines or binary data to be read back unambiguously.
+type Capturer struct {
+	active int32 // Must be accessed atomically
+
+	path   string
+	logger logrus.FieldLogger
+
+	mu       sync.Mutex
+	file     *os.File
+	opts     Options
+	limiter  *rate.Limiter
+	captured uint64
+	buf      []byte
+}
+
+// NewCapturer creates a new Capturer which writes to the file at path.
+func NewCapturer(logger logrus.FieldLogger, path string) *Capturer {
+	return &Capturer{
+		path:   path,
+		logger: logger.WithField("component", "capture"),
+	}
+}
+
+// Active returns true if a capture is running.
+func (c *Capturer) Active() bool {
+	return atomic.LoadInt32(&c.active) != 0
+}
+
+// Start begins capturing datagrams, appending to the capture file.  A capture which is already running is replaced.
+func (c *Capturer) Start(opts Options) error {
+	if opts.Rate <= 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		file, err := os.OpenFile(c.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to open capture file: %v", err)
+		}
+		c.file = file
+	}
+	burst := int(opts.Rate)
+	if burst < 1 {
+		burst = 1
+	}
+	c.opts = opts
+	c.limiter = rate.NewLimiter(rate.Limit(opts.Rate), burst)
+	c.captured = 0
+	atomic.StoreInt32(&c.active, 1)
+
+	c.logger.WithFields(logrus.Fields{
+		"file":      c.path,
+		"source-ip": opts.SourceIP,
+		"rate":      opts.Rate,
+		"limit":     opts.Limit,
+	}).Info("Started capture")
+	return nil
+}
+
+// Stop ends the running capture and closes the capture file.
+func (c *Capturer) Stop() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil {
+		return ErrNotActive
+	}
+	return c.stop()
+}
+
+// stop must be called with mu held.
+func (c *Capturer) stop() error {
+	atomic.StoreInt32(&c.active, 0)
+	err := c.file.Close()
+	c.file = nil
+	c.logger.WithField("captured", c.captured).Info("Stopped capture")
+	return err
+}
+
+// Status returns the current state of the Capturer.
+func (c *Capturer) Status() Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s := Status{
+		Active:   c.file != nil,
+		File:     c.path,
+		Captured: c.captured,
+	}
+	if s.Active {
+		s.SourceIP = c.opts.SourceIP
+		s.Rate = c.opts.Rate
+		s.Limit = c.opts.Limit
+	}
+	return s
+}
+
+// Capture writes the datagram to the capture file, if a capture is running, the datagram matches the source filter,
+// and the rate limit allows it.
+func (c *Capturer) Capture(ip gostatsd.IP, timestamp gostatsd.Nanotime, msg []byte) {
+	if !c.Active() {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.file == nil || (c.opts.SourceIP != "" && c.opts.SourceIP != ip) || !c.limiter.Allow() {
+		return
+	}
+
+	c.buf = append(c.buf[:0], time.Unix(0, int64(timestamp)).UTC().Format(time.RFC3339Nano)...)
+	c.buf = append(c.buf, ' ')
+	c.buf = append(c.buf, ip...)
+	c.buf = append(c.buf, ' ')
+	c.buf = strconv.AppendInt(c.buf, int64(len(msg)), 10)
+	c.buf = append(c.buf, '\n')
+	c.buf = append(c.buf, msg...)
+	c.buf = append(c.buf, '\n')
+	if _, err := c.file.Write(c.buf); err != nil {
+		c.logger.WithError(err).Error("Failed to write to capture file, stopping capture")
+		_ = c.stop()
+		return
+	}
+
+	c.captured++
+	if c.opts.Limit > 0 && c.captured >= c.opts.Limit {
+		if err := c.stop(); err != nil {
+			c.logger.WithError(err).Warn("Failed to close capture file")
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package capture
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newTestCapturer(t *testing.T) (*Capturer, string, func()) {
+	dir, err := ioutil.TempDir("", "capture")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "capture.log")
+	return NewCapturer(logrus.New(), path), path, func() { _ = os.RemoveAll(dir) }
+}
+
+func TestCaptureInactive(t *testing.T) {
+	t.Parallel()
+	c, _, cleanup := newTestCapturer(t)
+	defer cleanup()
+	assert.False(t, c.Active())
+	c.Capture("10.0.0.1", 0, []byte("a:1|c"))
+	assert.Equal(t, ErrNotActive, c.Stop())
+	assert.Equal(t, Status{File: c.path}, c.Status())
+}
+
+func TestCaptureSourceIPAndLimit(t *testing.T) {
+	t.Parallel()
+	c, path, cleanup := newTestCapturer(t)
+	defer cleanup()
+	require.NoError(t, c.Start(Options{SourceIP: "10.0.0.1", Rate: 1000, Limit: 2}))
+	assert.True(t, c.Active())
+
+	ts := gostatsd.Nanotime(time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC).UnixNano())
+	c.Capture("10.0.0.2", ts, []byte("ignored:1|c"))
+	c.Capture("10.0.0.1", ts, []byte("a:1|c\nb:2|g"))
+	c.Capture("10.0.0.1", ts, []byte("c:3|ms"))
+	// Limit has been reached, so this is not captured
+	c.Capture("10.0.0.1", ts, []byte("d:4|s"))
+
+	assert.False(t, c.Active())
+	assert.Equal(t, Status{File: path, Captured: 2}, c.Status())
+
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "2020-01-02T03:04:05Z 10.0.0.1 11\na:1|c\nb:2|g\n2020-01-02T03:04:05Z 10.0.0.1 6\nc:3|ms\n", string(data))
+}
+
+func TestCaptureRateLimit(t *testing.T) {
+	t.Parallel()
+	c, _, cleanup := newTestCapturer(t)
+	defer cleanup()
+	require.NoError(t, c.Start(Options{Rate: 0.001}))
+	for i := 0; i < 10; i++ {
+		c.Capture("10.0.0.1", 0, []byte("a:1|c"))
+	}
+	status := c.Status()
+	assert.True(t, status.Active)
+	assert.EqualValues(t, 1, status.Captured)
+	require.NoError(t, c.Stop())
+}
+
+func TestCaptureInvalidRate(t *testing.T) {
+	t.Parallel()
+	c, _, cleanup := newTestCapturer(t)
+	defer cleanup()
+	assert.Error(t, c.Start(Options{}))
+	assert.False(t, c.Active())
+}
@@ -0,0 +1,191 @@
+package catalog
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// maxTagKeys is the maximum number of tag keys tracked for each metric, so a client which puts values in tag keys
+// can't use unbounded memory.
+const maxTagKeys = 100
+
+// Metric describes a metric which has been seen, and the keys of the tags it has been seen with.
+type Metric struct {
+	Name     string               `json:"name"`
+	Type     string               `json:"type"`
+	LastSeen time.Time            `json:"last_seen"`
+	TagKeys  map[string]time.Time `json:"tag_keys"` // When each tag key was last seen
+}
+
+// Snapshot is the content of a Catalog at a point in time.
+type Snapshot struct {
+	Metrics      []Metric `json:"metrics"`
+	NamesDropped uint64   `json:"names_dropped"` // Number of metrics not tracked because the catalog was full
+}
+
+type metricKey struct {
+	name       string
+	metricType gostatsd.MetricType
+}
+
+type entry struct {
+	lastSeen gostatsd.Nanotime
+	tagKeys  map[string]gostatsd.Nanotime
+}
+
+// Catalog tracks the names and tag keys of the metrics which have been aggregated, and when each was last seen.
+// Anything not seen for the TTL is forgotten, and at most maxNames metrics are tracked, so memory use is bounded.
+// It is safe for concurrent use.
+type Catalog struct {
+	ttl      time.Duration
+	maxNames int
+	now      func() time.Time // Returns current time. Useful for testing.
+
+	mu           sync.Mutex
+	metrics      map[metricKey]*entry
+	namesDropped uint64
+	lastExpired  time.Time
+}
+
+// NewCatalog creates a new Catalog which forgets anything not seen for ttl, and tracks at most maxNames metrics, or
+// an unlimited number if maxNames is 0.
+func NewCatalog(ttl time.Duration, maxNames int) *Catalog {
+	return &Catalog{
+		ttl:      ttl,
+		maxNames: maxNames,
+		now:      time.Now,
+		metrics:  make(map[metricKey]*entry),
+	}
+}
+
+// ObserveMap records every metric in mm, using the time it was last received.
+func (c *Catalog) ObserveMap(mm *gostatsd.MetricMap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	mm.Counters.Each(func(name, _ string, m gostatsd.Counter) {
+		c.observe(name, gostatsd.COUNTER, m.Tags, m.Timestamp)
+	})
+	mm.Gauges.Each(func(name, _ string, m gostatsd.Gauge) {
+		c.observe(name, gostatsd.GAUGE, m.Tags, m.Timestamp)
+	})
+	mm.Timers.Each(func(name, _ string, m gostatsd.Timer) {
+		c.observe(name, gostatsd.TIMER, m.Tags, m.Timestamp)
+	})
+	mm.Sets.Each(func(name, _ string, m gostatsd.Set) {
+		c.observe(name, gostatsd.SET, m.Tags, m.Timestamp)
+	})
+	mm.Distributions.Each(func(name, _ string, m gostatsd.Timer) {
+		c.observe(name, gostatsd.DISTRIBUTION, m.Tags, m.Timestamp)
+	})
+
+	// Expiring is a scan of everything, so only do it once per TTL.  Entries are kept for at most twice the TTL.
+	now := c.now()
+	if now.Sub(c.lastExpired) >= c.ttl {
+		c.expire(now)
+	}
+}
+
+// observe records a single metric, c.mu must be held.
+func (c *Catalog) observe(name string, metricType gostatsd.MetricType, tags gostatsd.Tags, ts gostatsd.Nanotime) {
+	key := metricKey{name: name, metricType: metricType}
+	e, ok := c.metrics[key]
+	if !ok {
+		if c.maxNames > 0 && len(c.metrics) >= c.maxNames {
+			c.namesDropped++
+			return
+		}
+		e = &entry{tagKeys: make(map[string]gostatsd.Nanotime, len(tags))}
+		c.metrics[key] = e
+	}
+	if ts > e.lastSeen {
+		e.lastSeen = ts
+	}
+	for _, tag := range tags {
+		tagKey := tag
+		if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+			tagKey = tag[:idx]
+		}
+		last, ok := e.tagKeys[tagKey]
+		if !ok && len(e.tagKeys) >= maxTagKeys {
+			continue
+		}
+		if ts > last {
+			e.tagKeys[tagKey] = ts
+		}
+	}
+}
+
+// expire forgets every metric and tag key which hasn't been seen for the TTL, c.mu must be held.
+func (c *Catalog) expire(now time.Time) {
+	c.lastExpired = now
+	cutoff := gostatsd.Nanotime(now.Add(-c.ttl).UnixNano())
+	for key, e := range c.metrics {
+		if e.lastSeen < cutoff {
+			delete(c.metrics, key)
+			continue
+		}
+		for tagKey, last := range e.tagKeys {
+			if last < cutoff {
+				delete(e.tagKeys, tagKey)
+			}
+		}
+	}
+}
+
+// Snapshot returns every metric seen within the TTL, sorted by name and then type.
+func (c *Catalog) Snapshot() Snapshot {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(c.now())
+	snapshot := Snapshot{
+		Metrics:      make([]Metric, 0, len(c.metrics)),
+		NamesDropped: c.namesDropped,
+	}
+	for key, e := range c.metrics {
+		m := Metric{
+			Name:     key.name,
+			Type:     key.metricType.String(),
+			LastSeen: time.Unix(0, int64(e.lastSeen)).UTC(),
+			TagKeys:  make(map[string]time.Time, len(e.tagKeys)),
+		}
+		for tagKey, last := range e.tagKeys {
+			m.TagKeys[tagKey] = time.Unix(0, int64(last)).UTC()
+		}
+		snapshot.Metrics = append(snapshot.Metrics, m)
+	}
+	sort.Slice(snapshot.Metrics, func(i, j int) bool {
+		if snapshot.Metrics[i].Name != snapshot.Metrics[j].Name {
+			return snapshot.Metrics[i].Name < snapshot.Metrics[j].Name
+		}
+		return snapshot.Metrics[i].Type < snapshot.Metrics[j].Type
+	})
+	return snapshot
+}
+
+// RunMetrics emits the size of the catalog, and how many metrics it has dropped, every flush.
+func (c *Catalog) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			c.mu.Lock()
+			size, dropped := len(c.metrics), c.namesDropped
+			c.mu.Unlock()
+			statser.Gauge("catalog.metrics", float64(size), nil)
+			statser.Gauge("catalog.names_dropped", float64(dropped), nil)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package catalog
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newTestMap(ts time.Time, metrics ...*gostatsd.Metric) *gostatsd.MetricMap {
+	mm := gostatsd.NewMetricMap()
+	for _, m := range metrics {
+		m.Timestamp = gostatsd.Nanotime(ts.UnixNano())
+		m.Rate = 1
+		mm.Receive(m)
+	}
+	return mm
+}
+
+func TestCatalogObserveMap(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0).UTC()
+	now := start
+	c := NewCatalog(time.Minute, 0)
+	c.now = func() time.Time { return now }
+
+	c.ObserveMap(newTestMap(start,
+		&gostatsd.Metric{Name: "req", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"env:prod", "status:200"}},
+		&gostatsd.Metric{Name: "req", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"env:dev", "canary"}},
+		&gostatsd.Metric{Name: "lat", Type: gostatsd.TIMER, Value: 1},
+		&gostatsd.Metric{Name: "req", Type: gostatsd.GAUGE, Value: 1},
+	))
+	later := start.Add(30 * time.Second)
+	now = later
+	c.ObserveMap(newTestMap(later,
+		&gostatsd.Metric{Name: "req", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"env:prod"}},
+		&gostatsd.Metric{Name: "users", Type: gostatsd.SET, StringValue: "a"},
+	))
+
+	assert.Equal(t, Snapshot{
+		Metrics: []Metric{
+			{Name: "lat", Type: "timer", LastSeen: start, TagKeys: map[string]time.Time{}},
+			{Name: "req", Type: "counter", LastSeen: later, TagKeys: map[string]time.Time{"env": later, "status": start, "canary": start}},
+			{Name: "req", Type: "gauge", LastSeen: start, TagKeys: map[string]time.Time{}},
+			{Name: "users", Type: "set", LastSeen: later, TagKeys: map[string]time.Time{}},
+		},
+	}, c.Snapshot())
+
+	// Anything not seen for the TTL is forgotten
+	now = start.Add(80 * time.Second)
+	assert.Equal(t, Snapshot{
+		Metrics: []Metric{
+			{Name: "req", Type: "counter", LastSeen: later, TagKeys: map[string]time.Time{"env": later}},
+			{Name: "users", Type: "set", LastSeen: later, TagKeys: map[string]time.Time{}},
+		},
+	}, c.Snapshot())
+}
+
+func TestCatalogMaxNames(t *testing.T) {
+	t.Parallel()
+	ts := time.Unix(1000, 0)
+	c := NewCatalog(time.Minute, 2)
+	c.now = func() time.Time { return ts }
+	c.ObserveMap(newTestMap(ts,
+		&gostatsd.Metric{Name: "a", Type: gostatsd.COUNTER, Value: 1},
+		&gostatsd.Metric{Name: "b", Type: gostatsd.COUNTER, Value: 1},
+	))
+	c.ObserveMap(newTestMap(ts,
+		&gostatsd.Metric{Name: "a", Type: gostatsd.COUNTER, Value: 1, Tags: gostatsd.Tags{"new:tag"}},
+		&gostatsd.Metric{Name: "c", Type: gostatsd.COUNTER, Value: 1},
+	))
+
+	snapshot := c.Snapshot()
+	require.Len(t, snapshot.Metrics, 2)
+	assert.Equal(t, "a", snapshot.Metrics[0].Name)
+	assert.Contains(t, snapshot.Metrics[0].TagKeys, "new")
+	assert.Equal(t, "b", snapshot.Metrics[1].Name)
+	assert.EqualValues(t, 1, snapshot.NamesDropped)
+}
+
+func TestCatalogMaxTagKeys(t *testing.T) {
+	t.Parallel()
+	ts := time.Unix(1000, 0)
+	c := NewCatalog(time.Minute, 0)
+	c.now = func() time.Time { return ts }
+	tags := make(gostatsd.Tags, 0, maxTagKeys+10)
+	for i := 0; i < maxTagKeys+10; i++ {
+		tags = append(tags, "key"+strconv.Itoa(i)+":value")
+	}
+	c.ObserveMap(newTestMap(ts, &gostatsd.Metric{Name: "a", Type: gostatsd.GAUGE, Value: 1, Tags: tags}))
+
+	snapshot := c.Snapshot()
+	require.Len(t, snapshot.Metrics, 1)
+	assert.Len(t, snapshot.Metrics[0].TagKeys, maxTagKeys)
+}
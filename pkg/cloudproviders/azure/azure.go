@@ -0,0 +1,283 @@
+package azure
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/util"
+)
+
+const (
+	// ProviderName is the name of Azure cloud provider.
+	ProviderName             = "azure"
+	defaultClientTimeout     = 5 * time.Second
+	defaultMaxInstancesBatch = 32
+	// defaultMetadataAddress is the address of the Azure Instance Metadata Service.
+	defaultMetadataAddress = "http://169.254.169.254"
+	defaultAPIVersion      = "2021-02-01"
+	// maxResponseSize is the maximum response size we are willing to read.
+	maxResponseSize = 1024 * 1024
+)
+
+// Provider represents an Azure provider.  The Instance Metadata Service only describes the VM it is queried from, so
+// only metrics and events from the private IPs of the VM gostatsd is running on are enriched.
+type Provider struct {
+	metadataRequests uint64 // The cumulative number of requests to the Instance Metadata Service
+	metadataErrors   uint64 // The cumulative number of failed requests to the Instance Metadata Service
+	metadataFound    uint64 // The cumulative number of IPs found to belong to the VM
+	failing          uint32 // 1 if the most recent request failed, so failures are only logged once
+
+	logger logrus.FieldLogger
+
+	client       *http.Client
+	metadataURL  string
+	MaxInstances int
+}
+
+// instanceMetadata is the subset of the response of the instance endpoint of the Instance Metadata Service used.
+type instanceMetadata struct {
+	Compute struct {
+		VMID     string `json:"vmId"`
+		Name     string `json:"name"`
+		Location string `json:"location"`
+		Zone     string `json:"zone"`
+		TagsList []struct {
+			Name  string `json:"name"`
+			Value string `json:"value"`
+		} `json:"tagsList"`
+	} `json:"compute"`
+	Network struct {
+		Interface []struct {
+			IPv4 struct {
+				IPAddress []struct {
+					PrivateIPAddress string `json:"privateIpAddress"`
+				} `json:"ipAddress"`
+			} `json:"ipv4"`
+			IPv6 struct {
+				IPAddress []struct {
+					PrivateIPAddress string `json:"privateIpAddress"`
+				} `json:"ipAddress"`
+			} `json:"ipv6"`
+		} `json:"interface"`
+	} `json:"network"`
+}
+
+// privateIPs returns the private IPv4 and IPv6 addresses of every interface of the VM, primary first.
+func (m *instanceMetadata) privateIPs() []gostatsd.IP {
+	var ips []gostatsd.IP
+	for _, iface := range m.Network.Interface {
+		for _, addr := range iface.IPv4.IPAddress {
+			ips = append(ips, gostatsd.IP(addr.PrivateIPAddress))
+		}
+		for _, addr := range iface.IPv6.IPAddress {
+			ips = append(ips, gostatsd.IP(addr.PrivateIPAddress))
+		}
+	}
+	return ips
+}
+
+// tags returns the tags of the VM, and the region and zone it is in.
+func (m *instanceMetadata) tags() gostatsd.Tags {
+	tags := make(gostatsd.Tags, 0, len(m.Compute.TagsList)+2)
+	for _, tag := range m.Compute.TagsList {
+		tags = append(tags, gostatsd.NormalizeTagKey(tag.Name)+":"+tag.Value)
+	}
+	tags = append(tags, "region:"+m.Compute.Location)
+	if m.Compute.Zone != "" {
+		tags = append(tags, "zone:"+m.Compute.Zone)
+	}
+	return tags
+}
+
+func (p *Provider) EstimatedTags() int {
+	return 10 + 2 // 10 for VM tags, 1 for the region and 1 for the zone
+}
+
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			// These are namespaced not tagged because they're very specific
+			statser.Gauge("cloudprovider.azure.metadatarequests", float64(atomic.LoadUint64(&p.metadataRequests)), nil)
+			statser.Gauge("cloudprovider.azure.metadataerrors", float64(atomic.LoadUint64(&p.metadataErrors)), nil)
+			statser.Gauge("cloudprovider.azure.metadatafound", float64(atomic.LoadUint64(&p.metadataFound)), nil)
+		}
+	}
+}
+
+// Instance returns instances details from Azure.
+// ip -> nil pointer if instance was not found.
+// map is returned even in case of errors because it may contain partial data.
+//
+// A single request is made to the Instance Metadata Service for every batch of IPs.  If it fails, no instances are
+// found, and the failure is logged the first time only, so an unreachable or throttled service doesn't flood the
+// logs.  The IPs are then looked up again once they expire from the cache.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.IP) (map[gostatsd.IP]*gostatsd.Instance, error) {
+	instances := make(map[gostatsd.IP]*gostatsd.Instance, len(IP))
+	for _, ip := range IP {
+		instances[ip] = nil // initialize map. Used for lookups to see if info for IP was requested
+	}
+
+	p.logger.WithField("ips", IP).Debug("Looking up instances")
+	metadata, err := p.getMetadata(ctx)
+	if err != nil {
+		atomic.AddUint64(&p.metadataErrors, 1)
+		if atomic.SwapUint32(&p.failing, 1) == 0 {
+			p.logger.WithError(err).Warn("Error querying Azure Instance Metadata Service, metrics will not be enriched until it recovers")
+		}
+		return instances, nil
+	}
+	if atomic.SwapUint32(&p.failing, 0) == 1 {
+		p.logger.Info("Azure Instance Metadata Service has recovered")
+	}
+
+	tags := metadata.tags()
+	found := uint64(0)
+	for _, ip := range metadata.privateIPs() {
+		if _, ok := instances[ip]; !ok {
+			continue
+		}
+		found++
+		instances[ip] = &gostatsd.Instance{
+			ID:   metadata.Compute.VMID,
+			Tags: tags,
+		}
+		p.logger.WithFields(logrus.Fields{
+			"instance": metadata.Compute.VMID,
+			"ip":       ip,
+			"tags":     tags,
+		}).Debug("Added tags")
+	}
+	atomic.AddUint64(&p.metadataFound, found)
+
+	for ip, instance := range instances {
+		if instance == nil {
+			p.logger.WithField("ip", ip).Debug("No results looking up instance")
+		}
+	}
+	return instances, nil
+}
+
+// getMetadata queries the Instance Metadata Service for the VM.
+func (p *Provider) getMetadata(ctx context.Context) (*instanceMetadata, error) {
+	atomic.AddUint64(&p.metadataRequests, 1)
+
+	req, err := http.NewRequest("GET", p.metadataURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create http.Request: %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Metadata", "true")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying metadata: %v", err)
+	}
+	defer resp.Body.Close()
+	body := io.LimitReader(resp.Body, maxResponseSize)
+	if resp.StatusCode != http.StatusOK {
+		_, _ = io.Copy(ioutil.Discard, body)
+		if resp.StatusCode == http.StatusTooManyRequests {
+			return nil, util.NewThrottledError(resp)
+		}
+		return nil, fmt.Errorf("received bad status code %d", resp.StatusCode)
+	}
+	var metadata instanceMetadata
+	if err := json.NewDecoder(body).Decode(&metadata); err != nil {
+		return nil, fmt.Errorf("error decoding metadata: %v", err)
+	}
+	return &metadata, nil
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return p.MaxInstances
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// SelfIP returns host's IPv4 address.
+func (p *Provider) SelfIP() (gostatsd.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), p.client.Timeout)
+	defer cancel()
+	metadata, err := p.getMetadata(ctx)
+	if err != nil {
+		return gostatsd.UnknownIP, err
+	}
+	for _, iface := range metadata.Network.Interface {
+		for _, addr := range iface.IPv4.IPAddress {
+			return gostatsd.IP(addr.PrivateIPAddress), nil
+		}
+	}
+	return gostatsd.UnknownIP, errors.New("no private IPv4 address in metadata")
+}
+
+// NewProviderFromViper returns a new azure provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CloudProvider, error) {
+	a := util.GetSubViper(v, "azure")
+	a.SetDefault("client_timeout", defaultClientTimeout)
+	a.SetDefault("max_instances_batch", defaultMaxInstancesBatch)
+	a.SetDefault("metadata_address", defaultMetadataAddress)
+	a.SetDefault("api_version", defaultAPIVersion)
+
+	return NewProvider(
+		logger,
+		a.GetString("metadata_address"),
+		a.GetString("api_version"),
+		a.GetDuration("client_timeout"),
+		a.GetInt("max_instances_batch"),
+	)
+}
+
+// NewProvider returns a new azure provider, which queries the Instance Metadata Service at metadataAddress.
+func NewProvider(logger logrus.FieldLogger, metadataAddress, apiVersion string, clientTimeout time.Duration, maxInstances int) (*Provider, error) {
+	if clientTimeout <= 0 {
+		return nil, errors.New("client timeout must be positive")
+	}
+	if maxInstances <= 0 {
+		return nil, errors.New("max number of instances per batch must be positive")
+	}
+	if apiVersion == "" {
+		return nil, errors.New("api version is required")
+	}
+
+	// The Instance Metadata Service must not be accessed through a proxy.
+	transport := &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   clientTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:    2,
+		IdleConnTimeout: 1 * time.Minute,
+	}
+	return &Provider{
+		logger: logger,
+		client: &http.Client{
+			Transport: transport,
+			Timeout:   clientTimeout,
+		},
+		metadataURL:  strings.TrimSuffix(metadataAddress, "/") + "/metadata/instance?api-version=" + apiVersion,
+		MaxInstances: maxInstances,
+	}, nil
+}
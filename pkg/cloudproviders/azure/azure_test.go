@@ -0,0 +1,119 @@
+package azure
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const testMetadata = `{
+  "compute": {
+    "vmId": "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+    "name": "examplevmname",
+    "location": "westus",
+    "zone": "1",
+    "tagsList": [
+      {"name": "Department", "value": "IT"},
+      {"name": "service", "value": "web"}
+    ]
+  },
+  "network": {
+    "interface": [
+      {
+        "ipv4": {"ipAddress": [{"privateIpAddress": "10.144.133.132", "publicIpAddress": ""}]},
+        "ipv6": {"ipAddress": []}
+      },
+      {
+        "ipv4": {"ipAddress": [{"privateIpAddress": "10.144.133.133", "publicIpAddress": ""}]},
+        "ipv6": {"ipAddress": [{"privateIpAddress": "fd00::1"}]}
+      }
+    ]
+  }
+}`
+
+func newTestProvider(t *testing.T, handler http.HandlerFunc) *Provider {
+	ts := httptest.NewServer(handler)
+	t.Cleanup(ts.Close)
+	p, err := NewProvider(logrus.New(), ts.URL, defaultAPIVersion, time.Second, defaultMaxInstancesBatch)
+	require.NoError(t, err)
+	return p
+}
+
+func TestInstance(t *testing.T) {
+	t.Parallel()
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.Header.Get("Metadata"))
+		assert.Equal(t, "/metadata/instance", r.URL.Path)
+		assert.Equal(t, defaultAPIVersion, r.URL.Query().Get("api-version"))
+		_, _ = w.Write([]byte(testMetadata))
+	})
+
+	instances, err := p.Instance(context.Background(), "10.144.133.133", "fd00::1", "10.0.0.1")
+	require.NoError(t, err)
+	expected := &gostatsd.Instance{
+		ID:   "02aab8a4-74ef-476e-8182-f6d2ba4166a6",
+		Tags: gostatsd.Tags{"Department:IT", "service:web", "region:westus", "zone:1"},
+	}
+	assert.Equal(t, map[gostatsd.IP]*gostatsd.Instance{
+		"10.144.133.133": expected,
+		"fd00::1":        expected,
+		"10.0.0.1":       nil,
+	}, instances)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&p.metadataRequests))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&p.metadataFound))
+
+	ip, err := p.SelfIP()
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.IP("10.144.133.132"), ip)
+}
+
+func TestInstanceThrottled(t *testing.T) {
+	t.Parallel()
+	var throttle uint32 = 1
+	p := newTestProvider(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadUint32(&throttle) == 1 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte(testMetadata))
+	})
+
+	for i := 0; i < 2; i++ {
+		instances, err := p.Instance(context.Background(), "10.144.133.132")
+		require.NoError(t, err)
+		assert.Equal(t, map[gostatsd.IP]*gostatsd.Instance{"10.144.133.132": nil}, instances)
+	}
+	assert.EqualValues(t, 2, atomic.LoadUint64(&p.metadataErrors))
+	assert.EqualValues(t, 1, atomic.LoadUint32(&p.failing))
+
+	atomic.StoreUint32(&throttle, 0)
+	instances, err := p.Instance(context.Background(), "10.144.133.132")
+	require.NoError(t, err)
+	assert.NotNil(t, instances["10.144.133.132"])
+	assert.EqualValues(t, 0, atomic.LoadUint32(&p.failing))
+}
+
+func TestInstanceUnreachable(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	p, err := NewProvider(logrus.New(), ts.URL, defaultAPIVersion, time.Second, defaultMaxInstancesBatch)
+	require.NoError(t, err)
+
+	instances, err := p.Instance(context.Background(), "10.144.133.132")
+	require.NoError(t, err)
+	assert.Equal(t, map[gostatsd.IP]*gostatsd.Instance{"10.144.133.132": nil}, instances)
+	assert.EqualValues(t, 1, atomic.LoadUint64(&p.metadataErrors))
+
+	_, err = p.SelfIP()
+	require.Error(t, err)
+}
@@ -7,6 +7,8 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/aws"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders/azure"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders/hostfile"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/k8s"
 
 	"github.com/sirupsen/logrus"
@@ -14,8 +16,10 @@ import (
 
 // All registered cloud providers.
 var providers = map[string]gostatsd.CloudProviderFactory{
-	aws.ProviderName: aws.NewProviderFromViper,
-	k8s.ProviderName: k8s.NewProviderFromViper,
+	aws.ProviderName:      aws.NewProviderFromViper,
+	azure.ProviderName:    azure.NewProviderFromViper,
+	hostfile.ProviderName: hostfile.NewProviderFromViper,
+	k8s.ProviderName:      k8s.NewProviderFromViper,
 }
 
 // Get creates an instance of the named provider, or nil if
@@ -0,0 +1,233 @@
+package hostfile
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/util"
+)
+
+const (
+	// ProviderName is the name of the host file cloud provider.
+	ProviderName = "hostfile"
+	// ParamHostTagsFile is the name of the parameter with the path of the file mapping hosts to tags.
+	ParamHostTagsFile = "host-tags-file"
+	// ParamReloadInterval is the name of the parameter with how often the file is checked for changes.
+	ParamReloadInterval = "reload-interval"
+	// DefaultReloadInterval is the default interval the file is checked for changes.
+	DefaultReloadInterval = 30 * time.Second
+	// resolveTimeout bounds how long resolving the hostnames in the file can take.
+	resolveTimeout    = 10 * time.Second
+	maxInstancesBatch = 32
+)
+
+// Provider is a cloud provider which tags metrics and events with tags from a static file, keyed by the IP address or
+// hostname of their source.  It is intended for hosts without a metadata service, such as bare metal.
+//
+// The file is YAML or JSON, mapping each address to a list of tags:
+//
+//	10.0.0.1: [role:db, rack:r1]
+//	web-1.example.com: [role:web]
+//
+// Hostnames are resolved when the file is loaded.  The file is checked for changes every reload interval, and if it
+// has been modified it is loaded again.  The previous hosts are kept if it fails to load.
+type Provider struct {
+	reloads      uint64 // The cumulative number of times the file has been loaded
+	reloadErrors uint64 // The cumulative number of times the file has failed to load
+
+	logger         logrus.FieldLogger
+	path           string
+	reloadInterval time.Duration
+	resolver       *net.Resolver
+
+	hosts   atomic.Value // hostTags, replaced when the file is reloaded
+	modTime time.Time    // Modification time of the file when it was last loaded, only accessed by Run
+	size    int64        // Size of the file when it was last loaded, only accessed by Run
+}
+
+// hostTags is the instance of each IP in the file.
+type hostTags map[gostatsd.IP]*gostatsd.Instance
+
+// NewProviderFromViper returns a new host file provider.
+func NewProviderFromViper(v *viper.Viper, logger logrus.FieldLogger, _ string) (gostatsd.CloudProvider, error) {
+	h := util.GetSubViper(v, ProviderName)
+	h.SetDefault(ParamHostTagsFile, "")
+	h.SetDefault(ParamReloadInterval, DefaultReloadInterval)
+
+	return NewProvider(logger, h.GetString(ParamHostTagsFile), h.GetDuration(ParamReloadInterval))
+}
+
+// NewProvider returns a new host file provider, which loads the file at path and checks it for changes every
+// reloadInterval.
+func NewProvider(logger logrus.FieldLogger, path string, reloadInterval time.Duration) (*Provider, error) {
+	if path == "" {
+		return nil, errors.New(ParamHostTagsFile + " is required")
+	}
+	if reloadInterval <= 0 {
+		return nil, errors.New(ParamReloadInterval + " must be positive")
+	}
+	p := &Provider{
+		logger:         logger.WithField("path", path),
+		path:           path,
+		reloadInterval: reloadInterval,
+		resolver:       net.DefaultResolver,
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.load(context.Background(), info); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Run checks the file for changes every reload interval until ctx is done.
+func (p *Provider) Run(ctx context.Context) {
+	ticker := time.NewTicker(p.reloadInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.reloadIfModified(ctx)
+		}
+	}
+}
+
+// reloadIfModified loads the file again if its modification time or size has changed since it was last loaded.
+func (p *Provider) reloadIfModified(ctx context.Context) {
+	info, err := os.Stat(p.path)
+	if err != nil {
+		atomic.AddUint64(&p.reloadErrors, 1)
+		p.logger.WithError(err).Warn("Unable to check host tags file, keeping previous hosts")
+		return
+	}
+	if info.ModTime().Equal(p.modTime) && info.Size() == p.size {
+		return
+	}
+	if err := p.load(ctx, info); err != nil {
+		atomic.AddUint64(&p.reloadErrors, 1)
+		p.logger.WithError(err).Warn("Unable to reload host tags file, keeping previous hosts")
+		return
+	}
+	p.logger.Info("Reloaded host tags file")
+}
+
+// load reads and parses the file, replacing the hosts.  It is called by NewProvider, and afterwards only by Run.
+func (p *Provider) load(ctx context.Context, info os.FileInfo) error {
+	data, err := ioutil.ReadFile(p.path)
+	if err != nil {
+		return err
+	}
+	var entries map[string][]string
+	if err := yaml.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("unable to parse %s: %v", p.path, err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, resolveTimeout)
+	defer cancel()
+	hosts := make(hostTags, len(entries))
+	for address, tags := range entries {
+		instance := &gostatsd.Instance{
+			ID:   address,
+			Tags: tags,
+		}
+		if ip := net.ParseIP(address); ip != nil {
+			hosts.add(gostatsd.IP(ip.String()), instance)
+			continue
+		}
+		ips, err := p.resolver.LookupHost(ctx, address)
+		if err != nil {
+			// Hosts which can't be resolved are skipped rather than failing the whole file.
+			p.logger.WithError(err).WithField("host", address).Warn("Unable to resolve host in host tags file")
+			continue
+		}
+		for _, ip := range ips {
+			hosts.add(gostatsd.IP(ip), instance)
+		}
+	}
+
+	p.hosts.Store(hosts)
+	p.modTime = info.ModTime()
+	p.size = info.Size()
+	atomic.AddUint64(&p.reloads, 1)
+	return nil
+}
+
+// add adds the instance for ip.  If ip already has an instance, such as when it is listed both by address and by a
+// hostname which resolves to it, the tags of both are kept.
+func (h hostTags) add(ip gostatsd.IP, instance *gostatsd.Instance) {
+	existing, ok := h[ip]
+	if !ok {
+		h[ip] = instance
+		return
+	}
+	tags := make(gostatsd.Tags, 0, len(existing.Tags)+len(instance.Tags))
+	h[ip] = &gostatsd.Instance{
+		ID:   existing.ID,
+		Tags: append(append(tags, existing.Tags...), instance.Tags...),
+	}
+}
+
+// EstimatedTags returns a guess of how many tags are likely to be added by the provider.
+func (p *Provider) EstimatedTags() int {
+	return 5
+}
+
+func (p *Provider) RunMetrics(ctx context.Context, statser stats.Statser) {
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			// These are namespaced not tagged because they're very specific
+			statser.Gauge("cloudprovider.hostfile.reloads", float64(atomic.LoadUint64(&p.reloads)), nil)
+			statser.Gauge("cloudprovider.hostfile.reloaderrors", float64(atomic.LoadUint64(&p.reloadErrors)), nil)
+			statser.Gauge("cloudprovider.hostfile.hosts", float64(len(p.hosts.Load().(hostTags))), nil)
+		}
+	}
+}
+
+// Instance returns the instance of each IP in the file.
+// ip -> nil pointer if the IP is not in the file.
+func (p *Provider) Instance(ctx context.Context, IP ...gostatsd.IP) (map[gostatsd.IP]*gostatsd.Instance, error) {
+	hosts := p.hosts.Load().(hostTags)
+	instances := make(map[gostatsd.IP]*gostatsd.Instance, len(IP))
+	for _, ip := range IP {
+		instances[ip] = hosts[ip]
+	}
+	return instances, nil
+}
+
+// MaxInstancesBatch returns maximum number of instances that could be requested via the Instance method.
+func (p *Provider) MaxInstancesBatch() int {
+	return maxInstancesBatch
+}
+
+// Name returns the name of the provider.
+func (p *Provider) Name() string {
+	return ProviderName
+}
+
+// SelfIP returns host's IPv4 address.
+func (p *Provider) SelfIP() (gostatsd.IP, error) {
+	// Like the k8s provider, this is only used for start/stop events of gostatsd, so the IP isn't looked up.
+	return gostatsd.UnknownIP, nil
+}
@@ -0,0 +1,101 @@
+package hostfile
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "hostfile")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func writeFile(t *testing.T, path, content string) {
+	require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+}
+
+func TestInstance(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(tempDir(t), "hosts.yaml")
+	writeFile(t, path, `
+10.0.0.1: [role:db, rack:r1]
+"fd00::0001": [role:web]
+localhost: [env:local]
+127.0.0.1: [role:agent]
+`)
+	p, err := NewProvider(logrus.New(), path, time.Minute)
+	require.NoError(t, err)
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "fd00::1", "127.0.0.1", "10.0.0.2")
+	require.NoError(t, err)
+	require.Len(t, instances, 4)
+	assert.Equal(t, &gostatsd.Instance{ID: "10.0.0.1", Tags: gostatsd.Tags{"role:db", "rack:r1"}}, instances["10.0.0.1"])
+	assert.Equal(t, &gostatsd.Instance{ID: "fd00::0001", Tags: gostatsd.Tags{"role:web"}}, instances["fd00::1"])
+	// 127.0.0.1 is listed by address and by hostname.
+	assert.ElementsMatch(t, gostatsd.Tags{"env:local", "role:agent"}, instances["127.0.0.1"].Tags)
+	assert.Nil(t, instances["10.0.0.2"])
+}
+
+func TestInstanceJSON(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(tempDir(t), "hosts.json")
+	writeFile(t, path, `{"10.0.0.1": ["role:db"]}`)
+	p, err := NewProvider(logrus.New(), path, time.Minute)
+	require.NoError(t, err)
+
+	instances, err := p.Instance(context.Background(), "10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"role:db"}, instances["10.0.0.1"].Tags)
+}
+
+func TestReload(t *testing.T) {
+	t.Parallel()
+	path := filepath.Join(tempDir(t), "hosts.yaml")
+	writeFile(t, path, `10.0.0.1: [role:db]`)
+	p, err := NewProvider(logrus.New(), path, time.Minute)
+	require.NoError(t, err)
+
+	writeFile(t, path, `10.0.0.2: [role:web, rack:r2]`)
+	p.reloadIfModified(context.Background())
+	instances, err := p.Instance(context.Background(), "10.0.0.1", "10.0.0.2")
+	require.NoError(t, err)
+	assert.Nil(t, instances["10.0.0.1"])
+	assert.Equal(t, gostatsd.Tags{"role:web", "rack:r2"}, instances["10.0.0.2"].Tags)
+	assert.EqualValues(t, 2, p.reloads)
+
+	// An invalid file keeps the previous hosts.
+	writeFile(t, path, `10.0.0.3: [role:web`)
+	p.reloadIfModified(context.Background())
+	instances, err = p.Instance(context.Background(), "10.0.0.2")
+	require.NoError(t, err)
+	assert.Equal(t, gostatsd.Tags{"role:web", "rack:r2"}, instances["10.0.0.2"].Tags)
+	assert.EqualValues(t, 1, p.reloadErrors)
+}
+
+func TestNewProviderErrors(t *testing.T) {
+	t.Parallel()
+	dir := tempDir(t)
+	invalid := filepath.Join(dir, "invalid.yaml")
+	writeFile(t, invalid, `10.0.0.1: role:db`)
+
+	_, err := NewProvider(logrus.New(), "", time.Minute)
+	assert.Error(t, err)
+	_, err = NewProvider(logrus.New(), invalid, 0)
+	assert.Error(t, err)
+	_, err = NewProvider(logrus.New(), filepath.Join(dir, "missing.yaml"), time.Minute)
+	assert.Error(t, err)
+	_, err = NewProvider(logrus.New(), invalid, time.Minute)
+	assert.Error(t, err)
+}
@@ -294,6 +294,14 @@ func (p *Provider) Run(ctx context.Context) {
 	p.factory.Start(ctx.Done())
 }
 
+// WaitReady waits for the informer cache to sync, so pods which already exist can be looked up.
+func (p *Provider) WaitReady(ctx context.Context) error {
+	if !cache.WaitForCacheSync(ctx.Done(), p.podsInf.HasSynced) {
+		return ctx.Err()
+	}
+	return nil
+}
+
 func createKubernetesClient(userAgent, kubeconfigPath, kubeconfigContext string, apiQPS, apiQPSBurst float64) (kubernetes.Interface, error) {
 	var restConfig *rest.Config
 	var err error
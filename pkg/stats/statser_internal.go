@@ -21,7 +21,7 @@ type InternalStatser struct {
 
 	buffer chan *gostatsd.Metric
 
-	tags      gostatsd.Tags
+	tags      atomic.Value // gostatsd.Tags, replaced by SetTags
 	namespace string
 	hostname  string
 	handler   gostatsd.PipelineHandler
@@ -33,13 +33,19 @@ const bufferSize = 1000 // estimating this is difficult and tends to cause probl
 // NewInternalStatser creates a new Statser which sends metrics to the
 // supplied InternalHandler.
 func NewInternalStatser(tags gostatsd.Tags, namespace, hostname string, handler gostatsd.PipelineHandler) *InternalStatser {
-	return &InternalStatser{
+	is := &InternalStatser{
 		buffer:    make(chan *gostatsd.Metric, bufferSize),
-		tags:      tags,
 		namespace: namespace,
 		hostname:  hostname,
 		handler:   handler,
 	}
+	is.tags.Store(tags)
+	return is
+}
+
+// SetTags replaces the tags added to every metric.
+func (is *InternalStatser) SetTags(tags gostatsd.Tags) {
+	is.tags.Store(tags)
 }
 
 // Run will pull internal metrics off a small buffer, and dispatch them.  It
@@ -138,6 +144,6 @@ func (is *InternalStatser) dispatchMetric(ctx context.Context, metric *gostatsd.
 	if is.namespace != "" {
 		metric.Name = is.namespace + "." + metric.Name
 	}
-	metric.Tags = metric.Tags.Concat(is.tags)
+	metric.Tags = metric.Tags.Concat(is.tags.Load().(gostatsd.Tags))
 	is.handler.DispatchMetrics(ctx, []*gostatsd.Metric{metric})
 }
@@ -1,6 +1,7 @@
 package stats
 
 import (
+	"sync/atomic"
 	"time"
 
 	"github.com/atlassian/gostatsd"
@@ -12,24 +13,30 @@ import (
 type LoggingStatser struct {
 	flushNotifier
 
-	tags   gostatsd.Tags
+	tags   atomic.Value // gostatsd.Tags, replaced by SetTags
 	logger *log.Entry
 }
 
 // NewLoggingStatser creates a new Statser which sends metrics to the
 // supplied log.Entry
 func NewLoggingStatser(tags gostatsd.Tags, logger *log.Entry) Statser {
-	return &LoggingStatser{
-		tags:   tags,
+	ls := &LoggingStatser{
 		logger: logger,
 	}
+	ls.tags.Store(tags)
+	return ls
+}
+
+// SetTags replaces the tags added to every metric.
+func (ls *LoggingStatser) SetTags(tags gostatsd.Tags) {
+	ls.tags.Store(tags)
 }
 
 // Gauge sends a gauge metric
 func (ls *LoggingStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
 	ls.logger.WithFields(log.Fields{
 		"name":  name,
-		"tags":  ls.tags.Concat(tags),
+		"tags":  ls.tags.Load().(gostatsd.Tags).Concat(tags),
 		"value": value,
 	}).Infof("gauge")
 }
@@ -38,7 +45,7 @@ func (ls *LoggingStatser) Gauge(name string, value float64, tags gostatsd.Tags)
 func (ls *LoggingStatser) Count(name string, amount float64, tags gostatsd.Tags) {
 	ls.logger.WithFields(log.Fields{
 		"name":   name,
-		"tags":   ls.tags.Concat(tags),
+		"tags":   ls.tags.Load().(gostatsd.Tags).Concat(tags),
 		"amount": amount,
 	}).Infof("count")
 }
@@ -47,7 +54,7 @@ func (ls *LoggingStatser) Count(name string, amount float64, tags gostatsd.Tags)
 func (ls *LoggingStatser) Increment(name string, tags gostatsd.Tags) {
 	ls.logger.WithFields(log.Fields{
 		"name": name,
-		"tags": ls.tags.Concat(tags),
+		"tags": ls.tags.Load().(gostatsd.Tags).Concat(tags),
 	}).Infof("increment")
 }
 
@@ -55,7 +62,7 @@ func (ls *LoggingStatser) Increment(name string, tags gostatsd.Tags) {
 func (ls *LoggingStatser) TimingMS(name string, ms float64, tags gostatsd.Tags) {
 	ls.logger.WithFields(log.Fields{
 		"name": name,
-		"tags": ls.tags.Concat(tags),
+		"tags": ls.tags.Load().(gostatsd.Tags).Concat(tags),
 		"ms":   ms,
 	}).Infof("timing")
 }
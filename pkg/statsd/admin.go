@@ -0,0 +1,263 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/gorilla/mux"
+	log "github.com/sirupsen/logrus"
+)
+
+// defaultAdminTopNames is the number of metric names with the most tag sets included in a snapshot, unless the top
+// query parameter is given.
+const defaultAdminTopNames = 10
+
+// defaultHealthMaxFlushAgeIntervals is how many flush intervals a backend can go without a successful send and still
+// be healthy, unless health-max-flush-age is set.
+const defaultHealthMaxFlushAgeIntervals = 3
+
+// adminHealthyBody is the response to a health check when every backend is healthy, written as is so frequent probes
+// don't allocate.
+var adminHealthyBody = []byte(`{"healthy":true}` + "\n")
+
+var adminJSONContentType = []string{"application/json"}
+
+// adminServer serves the internal state of the aggregators and backends as JSON, for debugging.  Snapshots are only
+// taken when requested, and the aggregators are only held for as long as it takes to count their metrics, so they
+// never wait for the response to be written.
+type adminServer struct {
+	address            string
+	aggregateProcesser AggregateProcesser
+	status             *backendStatus
+	healthMaxFlushAge  time.Duration // How recently each backend must have had a successful send to be healthy
+	flushInterval      time.Duration // How long a backend which has never had a successful send is healthy for
+	router             *mux.Router
+}
+
+// adminHealth is the response to a health check when a backend is unhealthy.
+type adminHealth struct {
+	Healthy           bool               `json:"healthy"`
+	UnhealthyBackends []unhealthyBackend `json:"unhealthy_backends"` // Ordered by name
+}
+
+// adminSnapshot is the internal state of the aggregators and backends at the time of a request.
+type adminSnapshot struct {
+	Counters      metricCounts         `json:"counters"`
+	Gauges        metricCounts         `json:"gauges"`
+	Timers        metricCounts         `json:"timers"`
+	Sets          metricCounts         `json:"sets"`
+	Distributions metricCounts         `json:"distributions"`
+	TopNames      []nameCardinality    `json:"top_names"` // Ordered by the most tag sets first
+	Backends      []backendFlushStatus `json:"backends"`  // Ordered by name
+}
+
+// metricCounts is the number of metric names of a type, and the total number of tag sets across them.
+type metricCounts struct {
+	Names   int `json:"names"`
+	TagSets int `json:"tag_sets"`
+}
+
+// nameCardinality is the number of tag sets of a metric name.
+type nameCardinality struct {
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	TagSets int    `json:"tag_sets"`
+}
+
+func newAdminServer(address string, aggregateProcesser AggregateProcesser, status *backendStatus) *adminServer {
+	as := &adminServer{
+		address:            address,
+		aggregateProcesser: aggregateProcesser,
+		status:             status,
+		router:             mux.NewRouter(),
+	}
+	as.router.HandleFunc("/snapshot", as.snapshotHandler).Methods("GET")
+	as.router.HandleFunc("/counters/reset", as.resetCountersHandler).Methods("POST")
+	as.router.HandleFunc("/healthz", as.healthHandler).Methods("GET")
+	return as
+}
+
+// Run serves requests until the Context is closed.
+func (as *adminServer) Run(ctx context.Context) {
+	server := &http.Server{
+		Addr:    as.address,
+		Handler: as.router,
+	}
+
+	go func() {
+		<-ctx.Done()
+		timeoutCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(timeoutCtx); err != nil {
+			log.WithError(err).Warn("Failed to stop admin server")
+		}
+	}()
+
+	log.WithField("address", as.address).Info("Admin server listening")
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
+		log.WithError(err).Error("Admin server failed")
+	}
+}
+
+func (as *adminServer) snapshotHandler(w http.ResponseWriter, req *http.Request) {
+	top := defaultAdminTopNames
+	if s := req.URL.Query().Get("top"); s != "" {
+		var err error
+		if top, err = strconv.Atoi(s); err != nil || top < 0 {
+			http.Error(w, "top must be a non-negative integer", http.StatusBadRequest)
+			return
+		}
+	}
+	snapshot, err := as.snapshot(req.Context(), top)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	as.writeJSON(w, snapshot)
+}
+
+// healthHandler responds with 200 if every backend has had a successful send within healthMaxFlushAge, otherwise with
+// 503 and the backends which haven't.
+func (as *adminServer) healthHandler(w http.ResponseWriter, req *http.Request) {
+	var unhealthy []unhealthyBackend
+	if as.status != nil {
+		unhealthy = as.status.unhealthy(time.Now(), as.healthMaxFlushAge, as.flushInterval)
+	}
+	w.Header()["Content-Type"] = adminJSONContentType
+	if len(unhealthy) == 0 {
+		if _, err := w.Write(adminHealthyBody); err != nil {
+			log.WithError(err).Warn("Failed to write admin response")
+		}
+		return
+	}
+	w.WriteHeader(http.StatusServiceUnavailable)
+	if err := json.NewEncoder(w).Encode(adminHealth{UnhealthyBackends: unhealthy}); err != nil {
+		log.WithError(err).Warn("Failed to write admin response")
+	}
+}
+
+func (as *adminServer) resetCountersHandler(w http.ResponseWriter, req *http.Request) {
+	reset, err := as.resetCounters(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	log.WithField("tag_sets", reset).Info("Counters reset by admin request")
+	as.writeJSON(w, map[string]int{"tag_sets_reset": reset})
+}
+
+func (as *adminServer) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.WithError(err).Warn("Failed to write admin response")
+	}
+}
+
+// snapshot counts the metrics in every aggregator, and includes the top metric names with the most tag sets.  Each
+// aggregator is counted on the goroutine which owns it, between receiving metrics, so every count is consistent with
+// a single point in time for that aggregator.  Returns the error of ctx if it is done before every aggregator is
+// counted.
+func (as *adminServer) snapshot(ctx context.Context, top int) (*adminSnapshot, error) {
+	var mu sync.Mutex
+	snapshot := &adminSnapshot{}
+	tagSets := map[nameType]int{}
+	wait := as.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
+		aggr.Process(func(mm *gostatsd.MetricMap) {
+			mu.Lock()
+			defer mu.Unlock()
+			for name, series := range mm.Counters {
+				tagSets[nameType{name, gostatsd.COUNTER}] += len(series)
+				snapshot.Counters.TagSets += len(series)
+			}
+			for name, series := range mm.Gauges {
+				tagSets[nameType{name, gostatsd.GAUGE}] += len(series)
+				snapshot.Gauges.TagSets += len(series)
+			}
+			for name, series := range mm.Timers {
+				tagSets[nameType{name, gostatsd.TIMER}] += len(series)
+				snapshot.Timers.TagSets += len(series)
+			}
+			for name, series := range mm.Sets {
+				tagSets[nameType{name, gostatsd.SET}] += len(series)
+				snapshot.Sets.TagSets += len(series)
+			}
+			for name, series := range mm.Distributions {
+				tagSets[nameType{name, gostatsd.DISTRIBUTION}] += len(series)
+				snapshot.Distributions.TagSets += len(series)
+			}
+		})
+	})
+	wait()
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	names := make([]nameCardinality, 0, len(tagSets))
+	for nt, n := range tagSets {
+		switch nt.metricType {
+		case gostatsd.COUNTER:
+			snapshot.Counters.Names++
+		case gostatsd.GAUGE:
+			snapshot.Gauges.Names++
+		case gostatsd.TIMER:
+			snapshot.Timers.Names++
+		case gostatsd.SET:
+			snapshot.Sets.Names++
+		case gostatsd.DISTRIBUTION:
+			snapshot.Distributions.Names++
+		}
+		names = append(names, nameCardinality{Name: nt.name, Type: nt.metricType.String(), TagSets: n})
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if names[i].TagSets != names[j].TagSets {
+			return names[i].TagSets > names[j].TagSets
+		}
+		if names[i].Name != names[j].Name {
+			return names[i].Name < names[j].Name
+		}
+		return names[i].Type < names[j].Type
+	})
+	if len(names) > top {
+		names = names[:top]
+	}
+	snapshot.TopNames = names
+	if as.status != nil {
+		snapshot.Backends = as.status.snapshot()
+	}
+	return snapshot, nil
+}
+
+// nameType identifies a metric name of a type, as the same name can be used by several types.
+type nameType struct {
+	name       string
+	metricType gostatsd.MetricType
+}
+
+// resetCounters deletes every counter from every aggregator, discarding any values which have not been flushed, so
+// the counters which are still being received can be seen in later snapshots.  Returns the number of tag sets
+// deleted, and the error of ctx if it is done before every aggregator is reset.
+func (as *adminServer) resetCounters(ctx context.Context) (int, error) {
+	var mu sync.Mutex
+	reset := 0
+	wait := as.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
+		aggr.Process(func(mm *gostatsd.MetricMap) {
+			n := 0
+			for name, series := range mm.Counters {
+				n += len(series)
+				delete(mm.Counters, name)
+			}
+			mu.Lock()
+			reset += n
+			mu.Unlock()
+		})
+	})
+	wait()
+	return reset, ctx.Err()
+}
@@ -0,0 +1,190 @@
+package statsd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdminServerSnapshot(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	aggr.Receive(
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/a"}, Timestamp: now},
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/b"}, Timestamp: now},
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/c"}, Timestamp: now},
+		&gostatsd.Metric{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"path:/a"}, Timestamp: now},
+		&gostatsd.Metric{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"path:/b"}, Timestamp: now},
+		&gostatsd.Metric{Name: "queue", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Timestamp: now},
+		&gostatsd.Metric{Name: "users", StringValue: "u", Rate: 1, Type: gostatsd.SET, Timestamp: now},
+	)
+	status := newBackendStatus([]gostatsd.Backend{&capturingBackend{}}, time.Unix(0, 0))
+	status.record("capturingBackend", []error{nil}, time.Unix(100, 0))
+	status.record("capturingBackend", []error{errors.New("boom")}, time.Unix(200, 0))
+	as := newAdminServer("", &singleAggregateProcesser{aggr: aggr}, status)
+
+	rec := httptest.NewRecorder()
+	as.router.ServeHTTP(rec, httptest.NewRequest("GET", "/snapshot?top=2", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var snapshot adminSnapshot
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&snapshot))
+
+	assert.Equal(t, metricCounts{Names: 1, TagSets: 3}, snapshot.Counters)
+	assert.Equal(t, metricCounts{Names: 1, TagSets: 1}, snapshot.Gauges)
+	assert.Equal(t, metricCounts{Names: 1, TagSets: 2}, snapshot.Timers)
+	assert.Equal(t, metricCounts{Names: 1, TagSets: 1}, snapshot.Sets)
+	assert.Equal(t, []nameCardinality{
+		{Name: "requests", Type: "counter", TagSets: 3},
+		{Name: "latency", Type: "timer", TagSets: 2},
+	}, snapshot.TopNames)
+	require.Len(t, snapshot.Backends, 1)
+	backend := snapshot.Backends[0]
+	assert.Equal(t, "capturingBackend", backend.Name)
+	assert.True(t, time.Unix(100, 0).Equal(*backend.LastSuccess))
+	assert.True(t, time.Unix(200, 0).Equal(*backend.LastError))
+	assert.Equal(t, "boom", backend.Error)
+	assert.EqualValues(t, 2, backend.Sends)
+	assert.EqualValues(t, 1, backend.Failures)
+
+	rec = httptest.NewRecorder()
+	as.router.ServeHTTP(rec, httptest.NewRequest("GET", "/snapshot?top=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestAdminServerResetCounters(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	aggr.Receive(
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/a"}, Timestamp: now},
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"path:/b"}, Timestamp: now},
+		&gostatsd.Metric{Name: "queue", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Timestamp: now},
+	)
+	as := newAdminServer("", &singleAggregateProcesser{aggr: aggr}, nil)
+
+	rec := httptest.NewRecorder()
+	as.router.ServeHTTP(rec, httptest.NewRequest("GET", "/counters/reset", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	as.router.ServeHTTP(rec, httptest.NewRequest("POST", "/counters/reset", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"tag_sets_reset":2}`, rec.Body.String())
+	assert.Empty(t, aggr.metricMap.Counters)
+	assert.Len(t, aggr.metricMap.Gauges, 1)
+
+	snapshot, err := as.snapshot(context.Background(), defaultAdminTopNames)
+	require.NoError(t, err)
+	assert.Equal(t, metricCounts{}, snapshot.Counters)
+	assert.Nil(t, snapshot.Backends)
+}
+
+func TestFlusherRecordsBackendStatus(t *testing.T) {
+	t.Parallel()
+	backend := &scriptedBackend{script: [][]error{{nil}, {errors.New("failed")}}}
+	fl := NewMetricFlusher(time.Second, nil, []gostatsd.Backend{backend})
+	fl.status = newBackendStatus(fl.backends, time.Now())
+
+	for i := 0; i < 2; i++ {
+		sent := make(chan struct{})
+		fl.sendWithRetries(context.Background(), backend, gostatsd.NewMetricMap(), func(errs []error) { close(sent) })
+		<-sent
+	}
+
+	statuses := fl.status.snapshot()
+	require.Len(t, statuses, 1)
+	assert.NotNil(t, statuses[0].LastSuccess)
+	assert.NotNil(t, statuses[0].LastError)
+	assert.Equal(t, "failed", statuses[0].Error)
+	assert.EqualValues(t, 2, statuses[0].Sends)
+	assert.EqualValues(t, 1, statuses[0].Failures)
+}
+
+func TestAdminServerHealth(t *testing.T) {
+	t.Parallel()
+	a := &namedCapturingBackend{name: "a"}
+	b := &namedCapturingBackend{name: "b"}
+	status := newBackendStatus([]gostatsd.Backend{a, b}, time.Now().Add(-time.Hour))
+	as := newAdminServer("", &singleAggregateProcesser{aggr: newFakeAggregator()}, status)
+	as.healthMaxFlushAge = time.Minute
+	as.flushInterval = time.Second
+	status.record("a", []error{nil}, time.Now())
+	status.record("b", []error{errors.New("boom")}, time.Now())
+
+	// b has never had a successful send, and the startup grace has passed
+	rec := httptest.NewRecorder()
+	as.router.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var health adminHealth
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&health))
+	assert.False(t, health.Healthy)
+	assert.Equal(t, []unhealthyBackend{{Name: "b", Error: "boom"}}, health.UnhealthyBackends)
+
+	status.record("b", []error{nil}, time.Now())
+	rec = httptest.NewRecorder()
+	as.router.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.JSONEq(t, `{"healthy":true}`, rec.Body.String())
+}
+
+func TestBackendStatusUnhealthy(t *testing.T) {
+	t.Parallel()
+	start := time.Unix(1000, 0)
+	status := newBackendStatus([]gostatsd.Backend{&namedCapturingBackend{name: "a"}, &namedCapturingBackend{name: "b"}}, start)
+
+	// The first flush is taken an interval after start, and its send completes after that, which is still healthy
+	firstSend := start.Add(12 * time.Second)
+	assert.Nil(t, status.unhealthy(firstSend.Add(-time.Second), time.Minute, 10*time.Second))
+	status.record("a", []error{nil}, firstSend)
+	assert.Nil(t, status.unhealthy(firstSend.Add(time.Second), time.Minute, 10*time.Second))
+
+	// A backend which never has a successful send is healthy until the max age and an interval have passed
+	assert.Nil(t, status.unhealthy(start.Add(70*time.Second), time.Minute, 10*time.Second))
+	unhealthy := status.unhealthy(start.Add(71*time.Second), time.Minute, 10*time.Second)
+	require.Len(t, unhealthy, 1)
+	assert.Equal(t, "b", unhealthy[0].Name)
+	assert.Nil(t, unhealthy[0].LastSuccess)
+
+	sent := start.Add(20 * time.Second)
+	status.record("a", []error{nil}, sent)
+	status.record("b", []error{nil}, sent)
+	assert.Nil(t, status.unhealthy(sent.Add(time.Minute), time.Minute, 10*time.Second))
+	unhealthy = status.unhealthy(sent.Add(time.Minute+time.Second), time.Minute, 10*time.Second)
+	require.Len(t, unhealthy, 2)
+	assert.True(t, sent.Equal(*unhealthy[0].LastSuccess))
+}
+
+func BenchmarkAdminServerHealth(b *testing.B) {
+	backends := make([]gostatsd.Backend, 0, 5)
+	for i := 0; i < 5; i++ {
+		backends = append(backends, &namedCapturingBackend{name: strconv.Itoa(i)})
+	}
+	status := newBackendStatus(backends, time.Now())
+	for _, backend := range backends {
+		status.record(backend.Name(), []error{nil}, time.Now())
+	}
+	as := newAdminServer("", &singleAggregateProcesser{aggr: newFakeAggregator()}, status)
+	as.healthMaxFlushAge = time.Hour
+	as.flushInterval = time.Second
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/healthz", nil)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec.Body.Reset()
+		as.healthHandler(rec, req)
+	}
+}
@@ -3,11 +3,16 @@ package statsd
 import (
 	"context"
 	"math"
+	"math/rand"
 	"sort"
 	"strconv"
 	"time"
 
+	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/catalog"
 	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
@@ -19,18 +24,53 @@ type percentStruct struct {
 	sumSquares string
 	upper      string
 	lower      string
+	dist       string // The value at the percentile of a distribution, for positive percentiles
 }
 
 // MetricAggregator aggregates metrics.
 type MetricAggregator struct {
-	metricsReceived    uint64
-	metricMapsReceived uint64
-	expiryInterval     time.Duration // How often to expire metrics
-	percentThresholds  map[float64]percentStruct
-	now                func() time.Time // Returns current time. Useful for testing.
-	statser            stats.Statser
-	disabledSubtypes   gostatsd.TimerSubtypes
-	metricMap          *gostatsd.MetricMap
+	metricsReceived      uint64
+	metricMapsReceived   uint64
+	namesDropped         uint64
+	countersConverted    uint64
+	tagsBucketed         uint64
+	seriesEvicted        uint64
+	namesCapped          uint64
+	tagSetsOverflowed    uint64
+	invalidRates         uint64
+	expiryInterval       time.Duration            // How long after a metric was last received it is expired
+	maxNames             int                      // Maximum number of distinct metric names, 0 for unlimited
+	names                map[string]struct{}      // Distinct metric names tracked when maxNames is set, rebuilt on Reset
+	maxSeries            int                      // Maximum number of series, least recently updated are evicted
+	seriesLRU            *seriesLRU               // Order series were last updated, only used with maxSeries
+	maxCardinality       int                      // Maximum number of tag sets per metric name each flush, 0 for unlimited
+	tagSets              tagSetsByName            // Tag sets received this flush, only used with maxCardinality
+	tagValueLimits       map[string]int           // Maximum number of distinct values per metric name for each tag key
+	tagBuckets           TagBucketRules           // Rules to bucket numeric tag values, keyed by tag key
+	countersAsGauges     gostatsd.StringMatchList // Names of counters to aggregate as gauges
+	counterWindowRules   CounterWindowRules       // Rules to flush percentiles of counters over a rolling window
+	counterWindows       counterWindows           // Windows of each counter with a rule, only used with counterWindowRules
+	percentileMinSamples int                      // Minimum number of samples in a timer to calculate percentiles
+	histogramBuckets     []histogramBucket        // Upper bounds of the cumulative timer histogram buckets, ascending
+	weightTimers         bool                     // Weight timer values by their sampling rate when they differ
+	timerReservoirSize   int                      // Maximum number of values kept for each timer, 0 for all of them
+	timerReservoirs      timerReservoirs          // Exact aggregations of each timer, only used with timerReservoirSize
+	reservoirRand        *rand.Rand               // Picks the values kept in the reservoirs
+	setMemberTTL         time.Duration            // How long set members are kept after they were last seen, 0 for one flush
+	setMembers           setMembers               // When each set member was last seen, only used with setMemberTTL
+	setEmitMembers       gostatsd.StringMatchList // Names of sets to also flush the members of, as gauges
+	setMaxMembers        int                      // Sets with more members only flush the number of members
+	setMemberGauges      []seriesKey              // Gauges added by emitSetMembers, removed on reset
+	suppressZeroCounters bool                     // Don't flush counters with a value of zero
+	flushLatency         bool                     // Track the oldest receive time since the last flush
+	oldestReceived       gostatsd.Nanotime        // Oldest receive time since the last flush, 0 for none
+	catalog              *catalog.Catalog         // Optional, records the names and tag keys of flushed metrics
+	percentThresholds    map[float64]percentStruct
+	rateLogLimiter       *rate.Limiter    // Limits logging of metrics with an invalid sample rate
+	now                  func() time.Time // Returns current time. Useful for testing.
+	statser              stats.Statser
+	disabledSubtypes     gostatsd.TimerSubtypes
+	metricMap            *gostatsd.MetricMap
 }
 
 // NewMetricAggregator creates a new MetricAggregator object.
@@ -38,6 +78,7 @@ func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Durati
 	a := MetricAggregator{
 		expiryInterval:    expiryInterval,
 		percentThresholds: make(map[float64]percentStruct, len(percentThresholds)),
+		rateLogLimiter:    rate.NewLimiter(rate.Every(time.Second), 1),
 		now:               time.Now,
 		statser:           stats.NewNullStatser(), // Will probably be replaced via RunMetrics
 		metricMap:         gostatsd.NewMetricMap(),
@@ -52,6 +93,7 @@ func NewMetricAggregator(percentThresholds []float64, expiryInterval time.Durati
 			sumSquares: "sum_squares_" + sPct,
 			upper:      "upper_" + sPct,
 			lower:      "lower_" + sPct,
+			dist:       "p" + sPct,
 		}
 	}
 	return &a
@@ -67,6 +109,58 @@ func round(v float64) float64 {
 func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 	a.statser.Gauge("aggregator.metrics_received", float64(a.metricsReceived), nil)
 	a.statser.Gauge("aggregator.metricmaps_received", float64(a.metricMapsReceived), nil)
+	a.statser.Gauge("aggregator.invalid_sample_rates", float64(a.invalidRates), nil)
+	if a.maxNames > 0 {
+		a.statser.Gauge("aggregator.metric_names", float64(a.nameCount()), nil)
+		a.statser.Gauge("aggregator.metric_names_dropped", float64(a.namesDropped), nil)
+	}
+	if a.maxSeries > 0 {
+		a.statser.Gauge("aggregator.series", float64(a.seriesLRU.len()), nil)
+		a.statser.Gauge("aggregator.series_evicted", float64(a.seriesEvicted), nil)
+	}
+	if a.maxCardinality > 0 {
+		a.statser.Gauge("aggregator.cardinality_capped", float64(a.namesCapped), nil)
+		a.statser.Gauge("aggregator.cardinality_overflowed", float64(a.tagSetsOverflowed), nil)
+	}
+	if len(a.countersAsGauges) > 0 {
+		a.statser.Gauge("aggregator.counters_converted", float64(a.countersConverted), nil)
+	}
+	if len(a.tagBuckets) > 0 {
+		a.statser.Gauge("aggregator.tags_bucketed", float64(a.tagsBucketed), nil)
+	}
+	if len(a.counterWindowRules) > 0 {
+		a.statser.Gauge("aggregator.counter_windows", float64(len(a.counterWindows)), nil)
+	}
+	if a.flushLatency && a.oldestReceived != 0 {
+		age := a.now().Sub(time.Unix(0, int64(a.oldestReceived)))
+		a.statser.Gauge("aggregator.flush_latency", float64(age)/float64(time.Millisecond), nil)
+	}
+	if len(a.counterWindowRules) > 0 {
+		// Before suppressing zero counters, as a flush with no updates is part of the distribution
+		a.flushCounterWindows()
+	}
+	if a.suppressZeroCounters {
+		a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+			if counter.Value == 0 {
+				deleteMetric(key, tagsKey, a.metricMap.Counters)
+			}
+		})
+	}
+	if a.setMemberTTL > 0 {
+		// Before collapsing tag values, as that changes the tags keys of the sets
+		a.retainSetMembers(gostatsd.Nanotime(a.now().UnixNano()))
+	}
+	if len(a.tagValueLimits) > 0 {
+		collapsed := a.collapseTagValues()
+		a.statser.Gauge("aggregator.tag_values_collapsed", float64(collapsed), nil)
+	}
+	if len(a.setEmitMembers) > 0 {
+		// After collapsing tag values, so the gauges have the same tags as their set
+		a.emitSetMembers()
+	}
+	if a.catalog != nil {
+		a.catalog.ObserveMap(a.metricMap)
+	}
 
 	flushInSeconds := float64(flushInterval) / float64(time.Second)
 
@@ -77,6 +171,27 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 
 	a.metricMap.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
 		if count := len(timer.Values); count > 0 {
+			timer.Count = int(round(timer.SampledCount))
+			timer.PerSecond = timer.SampledCount / flushInSeconds
+
+			// The values are a sample when the timer received more than fit in its reservoir
+			var reservoir *timerReservoir
+			if r, ok := a.timerReservoirs[key][tagsKey]; ok && r.seen > count {
+				reservoir = r
+			}
+
+			if a.weightTimers && timer.Weights != nil {
+				a.aggregateWeightedTimer(&timer)
+				if reservoir != nil {
+					a.applyTimerReservoir(&timer, reservoir, true)
+				}
+				if len(a.histogramBuckets) > 0 && !a.disabledSubtypes.Histogram {
+					a.addHistogram(&timer, true)
+				}
+				a.metricMap.Timers[key][tagsKey] = timer
+				return
+			}
+
 			sort.Float64s(timer.Values)
 			timer.Min = timer.Values[0]
 			timer.Max = timer.Values[count-1]
@@ -97,7 +212,12 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 			var sum = timer.Min
 			var thresholdBoundary = timer.Max
 
-			for pct, pctStruct := range a.percentThresholds {
+			// Timers with too few samples have no percentiles
+			percentThresholds := a.percentThresholds
+			if n < a.percentileMinSamples {
+				percentThresholds = nil
+			}
+			for pct, pctStruct := range percentThresholds {
 				numInThreshold := n
 				if n > 1 {
 					numInThreshold = int(round(math.Abs(pct) / 100 * count))
@@ -159,9 +279,13 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 			timer.StdDev = math.Sqrt(sumOfDiffs / count)
 			timer.Sum = sum
 			timer.SumSquares = sumSquares
+			if reservoir != nil {
+				a.applyTimerReservoir(&timer, reservoir, false)
+			}
 
-			timer.Count = int(round(timer.SampledCount))
-			timer.PerSecond = timer.SampledCount / flushInSeconds
+			if len(a.histogramBuckets) > 0 && !a.disabledSubtypes.Histogram {
+				a.addHistogram(&timer, false)
+			}
 
 			a.metricMap.Timers[key][tagsKey] = timer
 		} else {
@@ -170,6 +294,13 @@ func (a *MetricAggregator) Flush(flushInterval time.Duration) {
 			timer.PerSecond = 0
 		}
 	})
+
+	a.metricMap.Distributions.Each(func(key, tagsKey string, distribution gostatsd.Timer) {
+		if len(distribution.Values) > 0 {
+			a.aggregateDistribution(&distribution)
+			a.metricMap.Distributions[key][tagsKey] = distribution
+		}
+	})
 }
 
 func (a *MetricAggregator) RunMetrics(ctx context.Context, statser stats.Statser) {
@@ -180,6 +311,8 @@ func (a *MetricAggregator) Process(f ProcessFunc) {
 	f(a.metricMap)
 }
 
+// isExpired returns true if a metric last received at ts should be expired at now.  Each metric's timestamp is the
+// last time it was received, so expiry doesn't depend on how the flushes line up with it being received.
 func (a *MetricAggregator) isExpired(now, ts gostatsd.Nanotime) bool {
 	return a.expiryInterval != 0 && time.Duration(now-ts) > a.expiryInterval
 }
@@ -195,8 +328,23 @@ func deleteMetric(key, tagsKey string, metrics gostatsd.AggregatedMetrics) {
 func (a *MetricAggregator) Reset() {
 	a.metricsReceived = 0
 	a.metricMapsReceived = 0
+	a.namesDropped = 0
+	a.countersConverted = 0
+	a.tagsBucketed = 0
+	a.seriesEvicted = 0
+	a.namesCapped = 0
+	a.tagSetsOverflowed = 0
+	a.invalidRates = 0
+	a.oldestReceived = 0
 	nowNano := gostatsd.Nanotime(a.now().UnixNano())
 
+	if len(a.setMemberGauges) > 0 {
+		a.removeSetMemberGauges()
+	}
+	if a.timerReservoirSize > 0 {
+		a.timerReservoirs = make(timerReservoirs)
+	}
+
 	a.metricMap.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
 		if a.isExpired(nowNano, counter.Timestamp) {
 			deleteMetric(key, tagsKey, a.metricMap.Counters)
@@ -222,6 +370,19 @@ func (a *MetricAggregator) Reset() {
 		}
 	})
 
+	a.metricMap.Distributions.Each(func(key, tagsKey string, distribution gostatsd.Timer) {
+		if a.isExpired(nowNano, distribution.Timestamp) {
+			deleteMetric(key, tagsKey, a.metricMap.Distributions)
+		} else {
+			a.metricMap.Distributions[key][tagsKey] = gostatsd.Timer{
+				Timestamp: distribution.Timestamp,
+				Hostname:  distribution.Hostname,
+				Tags:      distribution.Tags,
+				Values:    distribution.Values[:0],
+			}
+		}
+	})
+
 	a.metricMap.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
 		if a.isExpired(nowNano, gauge.Timestamp) {
 			deleteMetric(key, tagsKey, a.metricMap.Gauges)
@@ -241,17 +402,224 @@ func (a *MetricAggregator) Reset() {
 			}
 		}
 	})
+
+	if a.maxSeries > 0 {
+		a.syncSeries()
+	}
+	if a.maxCardinality > 0 {
+		a.syncTagSets()
+	}
+	if a.maxNames > 0 {
+		a.rebuildNames()
+	}
 }
 
 // Receive aggregates an incoming metric.
 func (a *MetricAggregator) Receive(ms ...*gostatsd.Metric) {
 	a.metricsReceived += uint64(len(ms))
 	for _, m := range ms {
+		if !(m.Rate > 0) && (m.Type == gostatsd.COUNTER || m.Type == gostatsd.TIMER || m.Type == gostatsd.DISTRIBUTION) {
+			a.fixInvalidRate(m)
+		}
+		if m.Type == gostatsd.COUNTER && a.countersAsGauges.MatchAny(m.Name) {
+			m.Type = gostatsd.GAUGE
+			a.countersConverted++
+		}
+		if len(a.tagBuckets) > 0 {
+			a.bucketMetricTags(m)
+		}
+		if a.maxNames > 0 && !a.allowName(m.Name) {
+			a.namesDropped++
+			m.Done()
+			continue
+		}
+		if a.maxCardinality > 0 {
+			a.overflowMetricTags(m)
+		}
+		if a.setMemberTTL > 0 && m.Type == gostatsd.SET {
+			a.setMembers.touch(m.Name, m.FormatTagsKey(), m.StringValue, m.Timestamp)
+		}
+		if a.flushLatency {
+			a.trackReceived(m.Timestamp)
+		}
+		if a.timerReservoirSize > 0 && m.Type == gostatsd.TIMER {
+			// m is released by Receive, so the key is taken first.
+			name, tagsKey := m.Name, m.FormatTagsKey()
+			if a.maxSeries > 0 {
+				a.seriesLRU.touch(seriesKey{metricType: m.Type, name: name, tagsKey: tagsKey})
+			}
+			a.metricMap.Receive(m)
+			a.sampleTimer(name, tagsKey)
+			if a.maxSeries > 0 {
+				a.evictSeries()
+			}
+			continue
+		}
+		if a.maxSeries > 0 {
+			// m is released by Receive, so the key is taken first.
+			a.seriesLRU.touch(seriesKey{metricType: m.Type, name: m.Name, tagsKey: m.FormatTagsKey()})
+			a.metricMap.Receive(m)
+			a.evictSeries()
+			continue
+		}
 		a.metricMap.Receive(m)
 	}
 }
 
 func (a *MetricAggregator) ReceiveMap(mm *gostatsd.MetricMap) {
 	a.metricMapsReceived++
+	if len(a.countersAsGauges) > 0 {
+		a.convertCounters(mm)
+	}
+	if len(a.tagBuckets) > 0 {
+		a.bucketMapTags(mm)
+	}
+	if a.maxNames > 0 {
+		a.dropNewNames(mm)
+	}
+	if a.maxCardinality > 0 {
+		a.overflowMapTags(mm)
+	}
+	if a.setMemberTTL > 0 {
+		a.setMembers.touchMap(mm)
+	}
+	if a.flushLatency {
+		a.trackReceivedMap(mm)
+	}
+	if a.maxSeries > 0 {
+		a.touchMapSeries(mm)
+		a.metricMap.Merge(mm)
+		if a.timerReservoirSize > 0 {
+			a.sampleTimerMap(mm)
+		}
+		a.evictSeries()
+		return
+	}
 	a.metricMap.Merge(mm)
+	if a.timerReservoirSize > 0 {
+		a.sampleTimerMap(mm)
+	}
+}
+
+// fixInvalidRate treats the zero, negative or NaN sample rate of m as 1, as dividing by it to scale up the value of a
+// counter or the count of a timer is meaningless.
+func (a *MetricAggregator) fixInvalidRate(m *gostatsd.Metric) {
+	a.invalidRates++
+	if a.rateLogLimiter.Allow() {
+		logrus.WithFields(logrus.Fields{
+			"name": m.Name,
+			"rate": m.Rate,
+		}).Warn("Invalid sample rate, treating as 1")
+	}
+	m.Rate = 1
+}
+
+// trackReceived records ts if it is the oldest receive time since the last flush.
+func (a *MetricAggregator) trackReceived(ts gostatsd.Nanotime) {
+	if ts != 0 && (a.oldestReceived == 0 || ts < a.oldestReceived) {
+		a.oldestReceived = ts
+	}
+}
+
+// trackReceivedMap records the oldest receive time of the metrics in mm.  The timestamp of a metric in a MetricMap
+// is the last time it was updated, so this may be newer than the first update of the metric.
+func (a *MetricAggregator) trackReceivedMap(mm *gostatsd.MetricMap) {
+	mm.Counters.Each(func(key, tagsKey string, counter gostatsd.Counter) {
+		a.trackReceived(counter.Timestamp)
+	})
+	mm.Gauges.Each(func(key, tagsKey string, gauge gostatsd.Gauge) {
+		a.trackReceived(gauge.Timestamp)
+	})
+	mm.Timers.Each(func(key, tagsKey string, timer gostatsd.Timer) {
+		a.trackReceived(timer.Timestamp)
+	})
+	mm.Sets.Each(func(key, tagsKey string, set gostatsd.Set) {
+		a.trackReceived(set.Timestamp)
+	})
+	mm.Distributions.Each(func(key, tagsKey string, distribution gostatsd.Timer) {
+		a.trackReceived(distribution.Timestamp)
+	})
+}
+
+// nameCount returns the number of distinct metric names being tracked.  A name used by multiple metric types is
+// counted once.  A name which stops being tracked between flushes, such as by its series being evicted, is counted
+// until the next Reset.
+func (a *MetricAggregator) nameCount() int {
+	if a.names == nil {
+		a.rebuildNames()
+	}
+	return len(a.names)
+}
+
+// rebuildNames rebuilds the set of distinct metric names being tracked.
+func (a *MetricAggregator) rebuildNames() {
+	a.names = make(map[string]struct{}, len(a.metricMap.Counters)+len(a.metricMap.Gauges)+len(a.metricMap.Timers))
+	for name := range a.metricMap.Counters {
+		a.names[name] = struct{}{}
+	}
+	for name := range a.metricMap.Gauges {
+		a.names[name] = struct{}{}
+	}
+	for name := range a.metricMap.Timers {
+		a.names[name] = struct{}{}
+	}
+	for name := range a.metricMap.Sets {
+		a.names[name] = struct{}{}
+	}
+	for name := range a.metricMap.Distributions {
+		a.names[name] = struct{}{}
+	}
+}
+
+// allowName returns true if the name is already being tracked for any metric type, or if there is room to track a
+// new name, in which case it is tracked.
+func (a *MetricAggregator) allowName(name string) bool {
+	if _, exists := a.names[name]; exists {
+		return true
+	}
+	if a.nameCount() >= a.maxNames {
+		return false
+	}
+	a.names[name] = struct{}{}
+	return true
+}
+
+// dropNewNames removes any names from mm which would take the aggregator over its name limit once merged.
+func (a *MetricAggregator) dropNewNames(mm *gostatsd.MetricMap) {
+	admit := func(name string, children int, metrics gostatsd.AggregatedMetrics) {
+		if !a.allowName(name) {
+			a.namesDropped += uint64(children)
+			metrics.Delete(name)
+		}
+	}
+	for name, cs := range mm.Counters {
+		admit(name, len(cs), mm.Counters)
+	}
+	for name, gs := range mm.Gauges {
+		admit(name, len(gs), mm.Gauges)
+	}
+	for name, ts := range mm.Timers {
+		admit(name, len(ts), mm.Timers)
+	}
+	for name, ss := range mm.Sets {
+		admit(name, len(ss), mm.Sets)
+	}
+	for name, ds := range mm.Distributions {
+		admit(name, len(ds), mm.Distributions)
+	}
+}
+
+// convertCounters moves any counters in mm which match countersAsGauges to be gauges.  The individual values are no
+// longer available once consolidated, so the gauge takes the consolidated value of the counter.
+func (a *MetricAggregator) convertCounters(mm *gostatsd.MetricMap) {
+	for name, counters := range mm.Counters {
+		if !a.countersAsGauges.MatchAny(name) {
+			continue
+		}
+		for tagsKey, counter := range counters {
+			mm.MergeGauge(name, tagsKey, gostatsd.NewGauge(counter.Timestamp, float64(counter.Value), counter.Hostname, counter.Tags))
+			a.countersConverted++
+		}
+		delete(mm.Counters, name)
+	}
 }
@@ -0,0 +1,137 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// cardinalityOverflowTag is the only tag of the overflow tag set which a metric name's tag sets are folded in to once
+// it has maxCardinality tag sets.
+const cardinalityOverflowTag = "cardinality:overflow"
+
+// nameTagSets is the distinct tag sets received for a metric name of a type during the flush interval.
+type nameTagSets struct {
+	tagsKeys map[string]struct{}
+	capped   bool // If a tag set has been folded in to the overflow tag set
+}
+
+// tagSetsByName is the distinct tag sets received for each metric name of each type during the flush interval.
+type tagSetsByName map[nameType]*nameTagSets
+
+// isOverflowTags returns true if tags are the tags of the overflow tag set.
+func isOverflowTags(tags gostatsd.Tags) bool {
+	return len(tags) == 1 && tags[0] == cardinalityOverflowTag
+}
+
+// admitTagSet returns true if the tag set can be aggregated with its own tags, because it has already been received
+// for the metric name during the flush interval, or the name has fewer than maxCardinality tag sets.  Otherwise it
+// should be folded in to the overflow tag set, which is always admitted and doesn't count towards the limit.
+func (a *MetricAggregator) admitTagSet(mt gostatsd.MetricType, name, tagsKey string, tags gostatsd.Tags) bool {
+	if isOverflowTags(tags) {
+		return true
+	}
+	key := nameType{name: name, metricType: mt}
+	sets, ok := a.tagSets[key]
+	if !ok {
+		sets = &nameTagSets{tagsKeys: make(map[string]struct{})}
+		a.tagSets[key] = sets
+	}
+	if _, ok := sets.tagsKeys[tagsKey]; ok {
+		return true
+	}
+	if len(sets.tagsKeys) < a.maxCardinality {
+		sets.tagsKeys[tagsKey] = struct{}{}
+		return true
+	}
+	if !sets.capped {
+		sets.capped = true
+		a.namesCapped++
+	}
+	a.tagSetsOverflowed++
+	return false
+}
+
+// syncTagSets starts a new flush interval with only the tag sets still in the MetricMap of the aggregator, so series
+// which haven't expired keep their place and the tag sets flushed for a name never exceed maxCardinality.
+func (a *MetricAggregator) syncTagSets() {
+	a.tagSets = make(tagSetsByName)
+	a.metricMap.Counters.Each(func(name, tagsKey string, counter gostatsd.Counter) {
+		a.admitTagSet(gostatsd.COUNTER, name, tagsKey, counter.Tags)
+	})
+	a.metricMap.Gauges.Each(func(name, tagsKey string, gauge gostatsd.Gauge) {
+		a.admitTagSet(gostatsd.GAUGE, name, tagsKey, gauge.Tags)
+	})
+	a.metricMap.Timers.Each(func(name, tagsKey string, timer gostatsd.Timer) {
+		a.admitTagSet(gostatsd.TIMER, name, tagsKey, timer.Tags)
+	})
+	a.metricMap.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+		a.admitTagSet(gostatsd.SET, name, tagsKey, set.Tags)
+	})
+	a.metricMap.Distributions.Each(func(name, tagsKey string, distribution gostatsd.Timer) {
+		a.admitTagSet(gostatsd.DISTRIBUTION, name, tagsKey, distribution.Tags)
+	})
+}
+
+// overflowMetricTags folds m in to the overflow tag set of its name, if its tag set isn't admitted.
+func (a *MetricAggregator) overflowMetricTags(m *gostatsd.Metric) {
+	if !a.admitTagSet(m.Type, m.Name, m.FormatTagsKey(), m.Tags) {
+		m.Tags = gostatsd.Tags{cardinalityOverflowTag}
+		m.TagsKey = ""
+	}
+}
+
+// overflowMapTags folds the tag sets in mm which aren't admitted in to the overflow tag set of their name.
+func (a *MetricAggregator) overflowMapTags(mm *gostatsd.MetricMap) {
+	overflow := gostatsd.NewMetricMap()
+
+	for name, counters := range mm.Counters {
+		for tagsKey, counter := range counters {
+			if !a.admitTagSet(gostatsd.COUNTER, name, tagsKey, counter.Tags) {
+				counter.Tags = gostatsd.Tags{cardinalityOverflowTag}
+				overflow.MergeCounter(name, gostatsd.FormatTagsKey(counter.Hostname, counter.Tags), counter)
+				deleteMetric(name, tagsKey, mm.Counters)
+			}
+		}
+	}
+
+	for name, gauges := range mm.Gauges {
+		for tagsKey, gauge := range gauges {
+			if !a.admitTagSet(gostatsd.GAUGE, name, tagsKey, gauge.Tags) {
+				gauge.Tags = gostatsd.Tags{cardinalityOverflowTag}
+				overflow.MergeGauge(name, gostatsd.FormatTagsKey(gauge.Hostname, gauge.Tags), gauge)
+				deleteMetric(name, tagsKey, mm.Gauges)
+			}
+		}
+	}
+
+	for name, timers := range mm.Timers {
+		for tagsKey, timer := range timers {
+			if !a.admitTagSet(gostatsd.TIMER, name, tagsKey, timer.Tags) {
+				timer.Tags = gostatsd.Tags{cardinalityOverflowTag}
+				overflow.MergeTimer(name, gostatsd.FormatTagsKey(timer.Hostname, timer.Tags), timer)
+				deleteMetric(name, tagsKey, mm.Timers)
+			}
+		}
+	}
+
+	for name, sets := range mm.Sets {
+		for tagsKey, set := range sets {
+			if !a.admitTagSet(gostatsd.SET, name, tagsKey, set.Tags) {
+				set.Tags = gostatsd.Tags{cardinalityOverflowTag}
+				overflow.MergeSet(name, gostatsd.FormatTagsKey(set.Hostname, set.Tags), set)
+				deleteMetric(name, tagsKey, mm.Sets)
+			}
+		}
+	}
+
+	for name, distributions := range mm.Distributions {
+		for tagsKey, distribution := range distributions {
+			if !a.admitTagSet(gostatsd.DISTRIBUTION, name, tagsKey, distribution.Tags) {
+				distribution.Tags = gostatsd.Tags{cardinalityOverflowTag}
+				overflow.MergeDistribution(name, gostatsd.FormatTagsKey(distribution.Hostname, distribution.Tags), distribution)
+				deleteMetric(name, tagsKey, mm.Distributions)
+			}
+		}
+	}
+
+	mm.Merge(overflow)
+}
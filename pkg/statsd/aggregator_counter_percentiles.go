@@ -0,0 +1,184 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// CounterWindowRule keeps the value of each matching counter at every flush for a rolling Window, and flushes the
+// percentiles of those values as gauges named <counter>.<Suffix>.p<percentile>.
+type CounterWindowRule struct {
+	Name        string
+	Match       gostatsd.StringMatchList // Names of the counters the rule applies to
+	Window      time.Duration            // How long the value at each flush is kept for
+	Suffix      string                   // Added to the name of the counter, before the percentile
+	Percentiles []float64
+	names       []string // Suffix and name of each percentile, in the same order as Percentiles
+}
+
+// CounterWindowRules are the CounterWindowRule in the order they were configured.  The first rule which matches a
+// counter applies to it.
+type CounterWindowRules []*CounterWindowRule
+
+// NewCounterWindowRuleFromViper creates a new CounterWindowRule given a *viper.Viper
+func NewCounterWindowRuleFromViper(name string, v *viper.Viper) (*CounterWindowRule, error) {
+	v.SetDefault("match", []string{})
+	v.SetDefault("window", "1h")
+	v.SetDefault("suffix", "per_flush")
+	v.SetDefault("percentiles", []string{"50", "95", "99"})
+
+	rule := &CounterWindowRule{
+		Name:   name,
+		Match:  toStringMatch(v.GetStringSlice("match")),
+		Window: v.GetDuration("window"),
+		Suffix: strings.Trim(v.GetString("suffix"), "."),
+	}
+	if len(rule.Match) == 0 {
+		return nil, fmt.Errorf("match must be set")
+	}
+	if rule.Window <= 0 {
+		return nil, fmt.Errorf("window must be positive")
+	}
+	if rule.Suffix == "" {
+		return nil, fmt.Errorf("suffix must be set")
+	}
+	for _, pct := range v.GetStringSlice("percentiles") {
+		f, err := strconv.ParseFloat(pct, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid percentile %q: %v", pct, err)
+		}
+		if f <= 0 || f > 100 {
+			return nil, fmt.Errorf("invalid percentile %q, must be above 0 and at most 100", pct)
+		}
+		rule.Percentiles = append(rule.Percentiles, f)
+	}
+	if len(rule.Percentiles) == 0 {
+		return nil, fmt.Errorf("percentiles must be set")
+	}
+	rule.setNames()
+	return rule, nil
+}
+
+// NewCounterWindowRulesFromViper loads the rules named in counter-windows.  Returns nil if no rules are configured.
+func NewCounterWindowRulesFromViper(v *viper.Viper) (CounterWindowRules, error) {
+	var rules CounterWindowRules
+	for _, ruleName := range v.GetStringSlice(ParamCounterWindows) {
+		vRule := v.Sub("counter-window." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Counter window rule doesn't exist: %v", ruleName)
+			continue
+		}
+		rule, err := NewCounterWindowRuleFromViper(ruleName, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("counter window rule %v: %v", ruleName, err)
+		}
+		rules = append(rules, rule)
+		logrus.Infof("Loaded counter window rule %v", ruleName)
+	}
+	return rules, nil
+}
+
+// setNames calculates the suffix of the gauge for each percentile, such as per_flush.p95, or per_flush.p99_9 for 99.9.
+func (r *CounterWindowRule) setNames() {
+	r.names = make([]string, 0, len(r.Percentiles))
+	for _, pct := range r.Percentiles {
+		sPct := strings.Replace(strconv.FormatFloat(pct, 'f', -1, 64), ".", "_", 1)
+		r.names = append(r.names, r.Suffix+".p"+sPct)
+	}
+}
+
+// match returns the first rule which applies to the counter name, or nil if there is none.
+func (rules CounterWindowRules) match(name string) *CounterWindowRule {
+	for _, rule := range rules {
+		if rule.Match.MatchAny(name) {
+			return rule
+		}
+	}
+	return nil
+}
+
+type counterWindowKey struct {
+	name    string
+	tagsKey string
+}
+
+type windowValue struct {
+	ts    gostatsd.Nanotime
+	value float64
+}
+
+// counterWindows are the windows of each counter which has a rule.
+type counterWindows map[counterWindowKey]*counterWindow
+
+// counterWindow is the values of a single counter at each flush within the window of its rule, oldest first.
+type counterWindow struct {
+	rule   *CounterWindowRule
+	values []windowValue
+	sorted []float64 // Reused between flushes
+}
+
+// add records the value at now, and forgets any values older than the window.
+func (w *counterWindow) add(now gostatsd.Nanotime, value float64) {
+	cutoff := now - gostatsd.Nanotime(w.rule.Window)
+	drop := 0
+	for drop < len(w.values) && w.values[drop].ts <= cutoff {
+		drop++
+	}
+	if drop > 0 {
+		w.values = append(w.values[:0], w.values[drop:]...)
+	}
+	w.values = append(w.values, windowValue{ts: now, value: value})
+}
+
+// percentiles calls cb with the name suffix and value of each percentile of the window, using the nearest rank.
+func (w *counterWindow) percentiles(cb func(suffix string, value float64)) {
+	w.sorted = w.sorted[:0]
+	for _, v := range w.values {
+		w.sorted = append(w.sorted, v.value)
+	}
+	sort.Float64s(w.sorted)
+	n := float64(len(w.sorted))
+	for idx, pct := range w.rule.Percentiles {
+		rank := int(math.Ceil(pct/100*n)) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		cb(w.rule.names[idx], w.sorted[rank])
+	}
+}
+
+// flushCounterWindows adds the value of every counter with a rule to its window, and adds the percentiles of each
+// window to the MetricMap as gauges.  Windows of counters which have expired are forgotten.
+func (a *MetricAggregator) flushCounterWindows() {
+	now := gostatsd.Nanotime(a.now().UnixNano())
+	a.metricMap.Counters.Each(func(name, tagsKey string, counter gostatsd.Counter) {
+		key := counterWindowKey{name: name, tagsKey: tagsKey}
+		w, ok := a.counterWindows[key]
+		if !ok {
+			rule := a.counterWindowRules.match(name)
+			if rule == nil {
+				return
+			}
+			w = &counterWindow{rule: rule}
+			a.counterWindows[key] = w
+		}
+		w.add(now, float64(counter.Value))
+		w.percentiles(func(suffix string, value float64) {
+			a.metricMap.MergeGauge(name+"."+suffix, tagsKey, gostatsd.NewGauge(counter.Timestamp, value, counter.Hostname, counter.Tags))
+		})
+	})
+	for key := range a.counterWindows {
+		if _, ok := a.metricMap.Counters[key.name][key.tagsKey]; !ok {
+			delete(a.counterWindows, key)
+		}
+	}
+}
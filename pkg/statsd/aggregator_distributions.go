@@ -0,0 +1,52 @@
+package statsd
+
+import (
+	"sort"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// aggregateDistribution calculates the count, min, max, sum and percentiles of a distribution.  Unlike timers, each
+// value is always weighted by 1 / its sampling rate, so the count, sum and percentiles are estimates of every value
+// which was sampled, and the percentiles are the received value below which that percentage of the weight falls.
+// Only positive percent thresholds are used, as a distribution has no lower percentiles.
+func (a *MetricAggregator) aggregateDistribution(d *gostatsd.Timer) {
+	n := len(d.Values)
+	weight := d.SampledCount / float64(n)
+	if d.Weights != nil {
+		sort.Sort((*weightedValues)(d))
+	} else {
+		sort.Float64s(d.Values)
+	}
+
+	cumulativeWeights := make([]float64, n)
+	var total, sum float64
+	for i, value := range d.Values {
+		if d.Weights != nil {
+			weight = d.Weights[i]
+		}
+		total += weight
+		sum += weight * value
+		cumulativeWeights[i] = total
+	}
+
+	d.Count = int(round(d.SampledCount))
+	d.Min = d.Values[0]
+	d.Max = d.Values[n-1]
+	d.Sum = sum
+	d.Percentiles = d.Percentiles[:0]
+	if a.disabledSubtypes.DistributionPct || n < a.percentileMinSamples {
+		return
+	}
+	for pct, pctStruct := range a.percentThresholds {
+		if pct <= 0 {
+			continue
+		}
+		threshold := pct / 100 * total
+		i := sort.Search(n, func(i int) bool { return cumulativeWeights[i] >= threshold-weightEpsilon })
+		if i == n {
+			i = n - 1
+		}
+		d.Percentiles.Set(pctStruct.dist, d.Values[i])
+	}
+}
@@ -0,0 +1,95 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// histogramBucket is the upper bound of a timer histogram bucket, and its name.
+type histogramBucket struct {
+	bound float64
+	name  string
+}
+
+// ParseHistogramBuckets parses the upper bounds of the timer histogram buckets.  Bounds may be separated by commas or
+// whitespace, and are returned sorted with duplicates removed.  Returns nil if there are no bounds.
+func ParseHistogramBuckets(s []string) ([]float64, error) {
+	var bounds []float64
+	for _, item := range s {
+		for _, sBound := range strings.Split(item, ",") {
+			sBound = strings.TrimSpace(sBound)
+			if sBound == "" {
+				continue
+			}
+			bound, err := strconv.ParseFloat(sBound, 64)
+			if err != nil || math.IsNaN(bound) || math.IsInf(bound, 0) {
+				return nil, fmt.Errorf("invalid timer histogram bucket %q, must be a finite number", sBound)
+			}
+			bounds = append(bounds, bound)
+		}
+	}
+	sort.Float64s(bounds)
+	unique := bounds[:0]
+	for i, bound := range bounds {
+		if i == 0 || bound != bounds[i-1] {
+			unique = append(unique, bound)
+		}
+	}
+	if len(unique) == 0 {
+		return nil, nil
+	}
+	return unique, nil
+}
+
+// newHistogramBuckets returns the buckets for the bounds, named le_<bound> with the bound formatted as the shortest
+// decimal without an exponent and the decimal point replaced by an underscore, so 0.5 is le_0_5.  The names are
+// documented in README.md, and must stay in step with it.
+func newHistogramBuckets(bounds []float64) []histogramBucket {
+	buckets := make([]histogramBucket, 0, len(bounds))
+	for _, bound := range bounds {
+		// Dots are replaced so the bound doesn't add a level to the metric name.
+		sBound := strings.Replace(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_", -1)
+		buckets = append(buckets, histogramBucket{
+			bound: bound,
+			name:  gostatsd.HistogramBucketPrefix + sBound,
+		})
+	}
+	return buckets
+}
+
+// addHistogram sets the histogram of a timer to the cumulative count of its values in each histogram bucket, and in
+// the +Inf bucket.  The values must be sorted.  The counts are scaled by the sampling rate, and by the weights of the
+// values if they are weighted, so the +Inf bucket is the count of the timer.
+func (a *MetricAggregator) addHistogram(timer *gostatsd.Timer, weighted bool) {
+	n := len(timer.Values)
+	var total float64
+	if weighted {
+		for _, weight := range timer.Weights {
+			total += weight
+		}
+	}
+
+	histogram := make([]gostatsd.HistogramBucket, 0, len(a.histogramBuckets)+1)
+	i := 0
+	var count float64
+	for _, bucket := range a.histogramBuckets {
+		for ; i < n && timer.Values[i] <= bucket.bound; i++ {
+			if weighted {
+				count += timer.Weights[i] / total * timer.SampledCount
+			} else {
+				count += timer.SampledCount / float64(n)
+			}
+		}
+		histogram = append(histogram, gostatsd.HistogramBucket{Name: bucket.name, Bound: bucket.bound, Count: int(round(count))})
+	}
+	timer.Histogram = append(histogram, gostatsd.HistogramBucket{
+		Name:  gostatsd.HistogramBucketPrefix + "inf",
+		Bound: math.Inf(1),
+		Count: timer.Count,
+	})
+}
@@ -0,0 +1,166 @@
+package statsd
+
+import (
+	"container/list"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// seriesKey identifies a single series in the MetricMap of an aggregator.
+type seriesKey struct {
+	metricType gostatsd.MetricType
+	name       string
+	tagsKey    string
+}
+
+// seriesLRU tracks the order in which series were last updated, so the least recently updated series can be evicted.
+type seriesLRU struct {
+	order    *list.List // Of seriesKey, most recently updated at the front
+	elements map[seriesKey]*list.Element
+}
+
+func newSeriesLRU() *seriesLRU {
+	return &seriesLRU{
+		order:    list.New(),
+		elements: make(map[seriesKey]*list.Element),
+	}
+}
+
+// touch marks key as the most recently updated series.
+func (l *seriesLRU) touch(key seriesKey) {
+	if e, ok := l.elements[key]; ok {
+		l.order.MoveToFront(e)
+		return
+	}
+	l.elements[key] = l.order.PushFront(key)
+}
+
+// add marks key as the least recently updated series, if it isn't already tracked.
+func (l *seriesLRU) add(key seriesKey) {
+	if _, ok := l.elements[key]; !ok {
+		l.elements[key] = l.order.PushBack(key)
+	}
+}
+
+// remove forgets key.
+func (l *seriesLRU) remove(key seriesKey) {
+	if e, ok := l.elements[key]; ok {
+		l.order.Remove(e)
+		delete(l.elements, key)
+	}
+}
+
+func (l *seriesLRU) len() int {
+	return len(l.elements)
+}
+
+// oldest returns the least recently updated series.  The seriesLRU must not be empty.
+func (l *seriesLRU) oldest() seriesKey {
+	return l.order.Back().Value.(seriesKey)
+}
+
+// touchMapSeries marks every series in mm as updated.
+func (a *MetricAggregator) touchMapSeries(mm *gostatsd.MetricMap) {
+	mm.Counters.Each(func(name, tagsKey string, _ gostatsd.Counter) {
+		a.seriesLRU.touch(seriesKey{metricType: gostatsd.COUNTER, name: name, tagsKey: tagsKey})
+	})
+	mm.Gauges.Each(func(name, tagsKey string, _ gostatsd.Gauge) {
+		a.seriesLRU.touch(seriesKey{metricType: gostatsd.GAUGE, name: name, tagsKey: tagsKey})
+	})
+	mm.Timers.Each(func(name, tagsKey string, _ gostatsd.Timer) {
+		a.seriesLRU.touch(seriesKey{metricType: gostatsd.TIMER, name: name, tagsKey: tagsKey})
+	})
+	mm.Sets.Each(func(name, tagsKey string, _ gostatsd.Set) {
+		a.seriesLRU.touch(seriesKey{metricType: gostatsd.SET, name: name, tagsKey: tagsKey})
+	})
+	mm.Distributions.Each(func(name, tagsKey string, _ gostatsd.Timer) {
+		a.seriesLRU.touch(seriesKey{metricType: gostatsd.DISTRIBUTION, name: name, tagsKey: tagsKey})
+	})
+}
+
+// evictSeries removes the least recently updated series until there are no more than maxSeries.
+func (a *MetricAggregator) evictSeries() {
+	for a.seriesLRU.len() > a.maxSeries {
+		key := a.seriesLRU.oldest()
+		a.seriesLRU.remove(key)
+		if metrics := a.seriesMetrics(key.metricType); metrics != nil {
+			deleteMetric(key.name, key.tagsKey, metrics)
+		}
+		if key.metricType == gostatsd.TIMER && a.timerReservoirs != nil {
+			a.timerReservoirs.delete(key.name, key.tagsKey)
+		}
+		if key.metricType == gostatsd.SET && a.setMembers != nil {
+			if byTags, ok := a.setMembers[key.name]; ok {
+				delete(byTags, key.tagsKey)
+				if len(byTags) == 0 {
+					delete(a.setMembers, key.name)
+				}
+			}
+		}
+		a.seriesEvicted++
+	}
+}
+
+// syncSeries is called when resetting.  Expiry, tag value collapsing and dropping zero counters change the MetricMap
+// without going through Receive, so series which no longer exist are forgotten, and series which aren't tracked are
+// added as the least recently updated.
+func (a *MetricAggregator) syncSeries() {
+	for e := a.seriesLRU.order.Front(); e != nil; {
+		next := e.Next()
+		key := e.Value.(seriesKey)
+		if !a.hasSeries(key) {
+			a.seriesLRU.remove(key)
+		}
+		e = next
+	}
+	a.metricMap.Counters.Each(func(name, tagsKey string, _ gostatsd.Counter) {
+		a.seriesLRU.add(seriesKey{metricType: gostatsd.COUNTER, name: name, tagsKey: tagsKey})
+	})
+	a.metricMap.Gauges.Each(func(name, tagsKey string, _ gostatsd.Gauge) {
+		a.seriesLRU.add(seriesKey{metricType: gostatsd.GAUGE, name: name, tagsKey: tagsKey})
+	})
+	a.metricMap.Timers.Each(func(name, tagsKey string, _ gostatsd.Timer) {
+		a.seriesLRU.add(seriesKey{metricType: gostatsd.TIMER, name: name, tagsKey: tagsKey})
+	})
+	a.metricMap.Sets.Each(func(name, tagsKey string, _ gostatsd.Set) {
+		a.seriesLRU.add(seriesKey{metricType: gostatsd.SET, name: name, tagsKey: tagsKey})
+	})
+	a.metricMap.Distributions.Each(func(name, tagsKey string, _ gostatsd.Timer) {
+		a.seriesLRU.add(seriesKey{metricType: gostatsd.DISTRIBUTION, name: name, tagsKey: tagsKey})
+	})
+}
+
+// hasSeries returns true if the series is in the MetricMap of the aggregator.
+func (a *MetricAggregator) hasSeries(key seriesKey) bool {
+	var exists bool
+	switch key.metricType {
+	case gostatsd.COUNTER:
+		_, exists = a.metricMap.Counters[key.name][key.tagsKey]
+	case gostatsd.GAUGE:
+		_, exists = a.metricMap.Gauges[key.name][key.tagsKey]
+	case gostatsd.TIMER:
+		_, exists = a.metricMap.Timers[key.name][key.tagsKey]
+	case gostatsd.SET:
+		_, exists = a.metricMap.Sets[key.name][key.tagsKey]
+	case gostatsd.DISTRIBUTION:
+		_, exists = a.metricMap.Distributions[key.name][key.tagsKey]
+	}
+	return exists
+}
+
+// seriesMetrics returns the metrics of the given type in the MetricMap of the aggregator.
+func (a *MetricAggregator) seriesMetrics(metricType gostatsd.MetricType) gostatsd.AggregatedMetrics {
+	switch metricType {
+	case gostatsd.COUNTER:
+		return a.metricMap.Counters
+	case gostatsd.GAUGE:
+		return a.metricMap.Gauges
+	case gostatsd.TIMER:
+		return a.metricMap.Timers
+	case gostatsd.SET:
+		return a.metricMap.Sets
+	case gostatsd.DISTRIBUTION:
+		return a.metricMap.Distributions
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package statsd
+
+import (
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// setMembers records when each member of each set was last seen, by metric name, then tags key, then member.
+type setMembers map[string]map[string]map[string]gostatsd.Nanotime
+
+// touch records member as seen at timestamp.
+func (sm setMembers) touch(name, tagsKey, member string, timestamp gostatsd.Nanotime) {
+	byTags, ok := sm[name]
+	if !ok {
+		byTags = make(map[string]map[string]gostatsd.Nanotime)
+		sm[name] = byTags
+	}
+	members, ok := byTags[tagsKey]
+	if !ok {
+		members = make(map[string]gostatsd.Nanotime)
+		byTags[tagsKey] = members
+	}
+	if timestamp > members[member] {
+		members[member] = timestamp
+	}
+}
+
+// touchMap records the members of every set in mm as seen at the timestamp of the set.
+func (sm setMembers) touchMap(mm *gostatsd.MetricMap) {
+	mm.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+		for member := range set.Values {
+			sm.touch(name, tagsKey, member, set.Timestamp)
+		}
+	})
+}
+
+// retainSetMembers is called when flushing.  It removes members which haven't been seen within setMemberTTL, and
+// puts the rest back in to their sets, so a set carries its members across flushes until they go stale.  Members of
+// sets which have expired entirely are forgotten.
+func (a *MetricAggregator) retainSetMembers(now gostatsd.Nanotime) {
+	for name, byTags := range a.setMembers {
+		for tagsKey, members := range byTags {
+			set, ok := a.metricMap.Sets[name][tagsKey]
+			if !ok {
+				delete(byTags, tagsKey)
+				continue
+			}
+			for member, lastSeen := range members {
+				if time.Duration(now-lastSeen) > a.setMemberTTL {
+					delete(members, member)
+				} else {
+					set.Values[member] = struct{}{}
+				}
+			}
+			if len(members) == 0 {
+				delete(byTags, tagsKey)
+			}
+		}
+		if len(byTags) == 0 {
+			delete(a.setMembers, name)
+		}
+	}
+}
+
+// setMembersSuffix is appended to the name of a set to give the name of the gauges its members are flushed as.
+const setMembersSuffix = ".members"
+
+// emitSetMembers is called when flushing.  Every set with a name in setEmitMembers also flushes a gauge for each of
+// its members, with the tags of the set and a member tag, and a value of 1.  A set with more than setMaxMembers
+// members flushes a single gauge of the number of members instead, tagged set:truncated.  The gauges are only for
+// this flush, and are removed by removeSetMemberGauges.
+func (a *MetricAggregator) emitSetMembers() {
+	a.metricMap.Sets.Each(func(name, tagsKey string, set gostatsd.Set) {
+		if len(set.Values) == 0 || !a.setEmitMembers.MatchAny(name) {
+			return
+		}
+		gaugeName := name + setMembersSuffix
+		if len(set.Values) > a.setMaxMembers {
+			a.mergeSetMemberGauge(gaugeName, set, "set:truncated", float64(len(set.Values)))
+			return
+		}
+		for member := range set.Values {
+			a.mergeSetMemberGauge(gaugeName, set, "member:"+member, 1)
+		}
+	})
+}
+
+func (a *MetricAggregator) mergeSetMemberGauge(name string, set gostatsd.Set, tag string, value float64) {
+	tags := append(set.Tags[:len(set.Tags):len(set.Tags)], tag)
+	tagsKey := gostatsd.FormatTagsKey(set.Hostname, tags)
+	a.metricMap.MergeGauge(name, tagsKey, gostatsd.NewGauge(set.Timestamp, value, set.Hostname, tags))
+	a.setMemberGauges = append(a.setMemberGauges, seriesKey{metricType: gostatsd.GAUGE, name: name, tagsKey: tagsKey})
+}
+
+// removeSetMemberGauges is called when resetting, to remove the gauges added by emitSetMembers, so a member which
+// isn't seen again is not flushed again.
+func (a *MetricAggregator) removeSetMemberGauges() {
+	for _, key := range a.setMemberGauges {
+		deleteMetric(key.name, key.tagsKey, a.metricMap.Gauges)
+	}
+	a.setMemberGauges = a.setMemberGauges[:0]
+}
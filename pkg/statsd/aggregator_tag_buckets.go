@@ -0,0 +1,211 @@
+package statsd
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// TagBucketRule replaces the numeric value of the tag Tag with the label of the bucket it falls in to, so metrics
+// with values in the same bucket are aggregated together.  If Bounds is set, the label is the one for the greatest
+// bound which is not above the value, otherwise the value is rounded down to a multiple of Width.
+type TagBucketRule struct {
+	Name   string
+	Tag    string    // Key of the tag to bucket
+	NewTag string    // Key of the bucketed tag, Tag if empty
+	Bounds []float64 // Lower bound of each bucket, ascending
+	Labels []string  // Label of each bucket in Bounds
+	Width  float64   // Width of each bucket when there are no Bounds
+}
+
+// TagBucketRules are the TagBucketRule for each tag key.
+type TagBucketRules map[string]*TagBucketRule
+
+// NewTagBucketRuleFromViper creates a new TagBucketRule given a *viper.Viper
+func NewTagBucketRuleFromViper(name string, v *viper.Viper) (*TagBucketRule, error) {
+	v.SetDefault("tag", "")
+	v.SetDefault("new-tag", "")
+	v.SetDefault("buckets", []string{})
+	v.SetDefault("width", 0)
+
+	rule := &TagBucketRule{
+		Name:   name,
+		Tag:    v.GetString("tag"),
+		NewTag: v.GetString("new-tag"),
+		Width:  v.GetFloat64("width"),
+	}
+	if rule.Tag == "" {
+		return nil, fmt.Errorf("tag must be set")
+	}
+	buckets := v.GetStringSlice("buckets")
+	if len(buckets) > 0 && rule.Width != 0 {
+		return nil, fmt.Errorf("only one of buckets and width can be set")
+	}
+	if len(buckets) == 0 && rule.Width <= 0 {
+		return nil, fmt.Errorf("one of buckets or a positive width must be set")
+	}
+	for _, bucket := range buckets {
+		bound, label, ok := splitTag(bucket)
+		if !ok || label == "" {
+			return nil, fmt.Errorf("invalid bucket %q, must be of the form bound:label", bucket)
+		}
+		f, err := strconv.ParseFloat(bound, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket %q: %v", bucket, err)
+		}
+		if n := len(rule.Bounds); n > 0 && f <= rule.Bounds[n-1] {
+			return nil, fmt.Errorf("invalid bucket %q, bounds must be ascending", bucket)
+		}
+		rule.Bounds = append(rule.Bounds, f)
+		rule.Labels = append(rule.Labels, label)
+	}
+	return rule, nil
+}
+
+// NewTagBucketRulesFromViper loads the rules named in tag-buckets, keyed by the tag they apply to.  Returns nil if no
+// rules are configured.
+func NewTagBucketRulesFromViper(v *viper.Viper) (TagBucketRules, error) {
+	var rules TagBucketRules
+	for _, ruleName := range v.GetStringSlice(ParamTagBuckets) {
+		vRule := v.Sub("tag-bucket." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Tag bucket rule doesn't exist: %v", ruleName)
+			continue
+		}
+		rule, err := NewTagBucketRuleFromViper(ruleName, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("tag bucket rule %v: %v", ruleName, err)
+		}
+		if other, ok := rules[rule.Tag]; ok {
+			return nil, fmt.Errorf("tag bucket rule %v: tag %q is already bucketed by %v", ruleName, rule.Tag, other.Name)
+		}
+		if rules == nil {
+			rules = make(TagBucketRules)
+		}
+		rules[rule.Tag] = rule
+		logrus.Infof("Loaded tag bucket rule %v", ruleName)
+	}
+	return rules, nil
+}
+
+// label returns the label of the bucket value falls in to.  Returns false if the value is not a number, or is below
+// the first bound.
+func (r *TagBucketRule) label(value string) (string, bool) {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+		return "", false
+	}
+	if len(r.Bounds) == 0 {
+		return strconv.FormatFloat(math.Floor(f/r.Width)*r.Width, 'f', -1, 64), true
+	}
+	idx := sort.Search(len(r.Bounds), func(i int) bool { return r.Bounds[i] > f }) - 1
+	if idx < 0 {
+		return "", false
+	}
+	return r.Labels[idx], true
+}
+
+// bucketTags returns a copy of tags with the value of any tag which has a rule replaced by its bucket.  Returns false
+// if no tags need to change.
+func bucketTags(rules TagBucketRules, tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	var bucketed gostatsd.Tags
+	for idx, tag := range tags {
+		key, value, ok := splitTag(tag)
+		if !ok {
+			continue
+		}
+		rule, ok := rules[key]
+		if !ok {
+			continue
+		}
+		label, ok := rule.label(value)
+		if !ok {
+			continue
+		}
+		if rule.NewTag != "" {
+			key = rule.NewTag
+		}
+		if bucketed == nil {
+			bucketed = tags.Copy()
+		}
+		bucketed[idx] = key + ":" + label
+	}
+	return bucketed, bucketed != nil
+}
+
+// bucketMetricTags buckets the tags of m, updating its TagsKey to match.
+func (a *MetricAggregator) bucketMetricTags(m *gostatsd.Metric) {
+	if tags, ok := bucketTags(a.tagBuckets, m.Tags); ok {
+		m.Tags = tags
+		m.TagsKey = gostatsd.FormatTagsKey(m.Hostname, tags)
+		a.tagsBucketed++
+	}
+}
+
+// bucketMapTags buckets the tags of every metric in mm, merging any metrics which then have the same tags.
+func (a *MetricAggregator) bucketMapTags(mm *gostatsd.MetricMap) {
+	bucketed := gostatsd.NewMetricMap()
+
+	for name, counters := range mm.Counters {
+		for tagsKey, counter := range counters {
+			if tags, ok := bucketTags(a.tagBuckets, counter.Tags); ok {
+				counter.Tags = tags
+				bucketed.MergeCounter(name, gostatsd.FormatTagsKey(counter.Hostname, tags), counter)
+				deleteMetric(name, tagsKey, mm.Counters)
+				a.tagsBucketed++
+			}
+		}
+	}
+
+	for name, gauges := range mm.Gauges {
+		for tagsKey, gauge := range gauges {
+			if tags, ok := bucketTags(a.tagBuckets, gauge.Tags); ok {
+				gauge.Tags = tags
+				bucketed.MergeGauge(name, gostatsd.FormatTagsKey(gauge.Hostname, tags), gauge)
+				deleteMetric(name, tagsKey, mm.Gauges)
+				a.tagsBucketed++
+			}
+		}
+	}
+
+	for name, timers := range mm.Timers {
+		for tagsKey, timer := range timers {
+			if tags, ok := bucketTags(a.tagBuckets, timer.Tags); ok {
+				timer.Tags = tags
+				bucketed.MergeTimer(name, gostatsd.FormatTagsKey(timer.Hostname, tags), timer)
+				deleteMetric(name, tagsKey, mm.Timers)
+				a.tagsBucketed++
+			}
+		}
+	}
+
+	for name, sets := range mm.Sets {
+		for tagsKey, set := range sets {
+			if tags, ok := bucketTags(a.tagBuckets, set.Tags); ok {
+				set.Tags = tags
+				bucketed.MergeSet(name, gostatsd.FormatTagsKey(set.Hostname, tags), set)
+				deleteMetric(name, tagsKey, mm.Sets)
+				a.tagsBucketed++
+			}
+		}
+	}
+
+	for name, distributions := range mm.Distributions {
+		for tagsKey, distribution := range distributions {
+			if tags, ok := bucketTags(a.tagBuckets, distribution.Tags); ok {
+				distribution.Tags = tags
+				bucketed.MergeDistribution(name, gostatsd.FormatTagsKey(distribution.Hostname, tags), distribution)
+				deleteMetric(name, tagsKey, mm.Distributions)
+				a.tagsBucketed++
+			}
+		}
+	}
+
+	mm.Merge(bucketed)
+}
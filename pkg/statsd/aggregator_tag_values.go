@@ -0,0 +1,236 @@
+package statsd
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// otherTagValue is the value given to a limited tag key when the original value is not one of the most frequent.
+const otherTagValue = "__other__"
+
+// tagValueRanker counts how often each value of a limited tag key is seen for a single metric name.
+type tagValueRanker struct {
+	limits map[string]int
+	counts map[string]map[string]float64
+}
+
+func newTagValueRanker(limits map[string]int) *tagValueRanker {
+	return &tagValueRanker{
+		limits: limits,
+	}
+}
+
+// splitTag splits a tag of the form key:value, returning false if the tag has no value.
+func splitTag(tag string) (string, string, bool) {
+	idx := strings.IndexByte(tag, ':')
+	if idx < 0 {
+		return "", "", false
+	}
+	return tag[:idx], tag[idx+1:], true
+}
+
+// add records weight against the value of every limited tag key in tags.
+func (r *tagValueRanker) add(tags gostatsd.Tags, weight float64) {
+	for _, tag := range tags {
+		key, value, ok := splitTag(tag)
+		if !ok || value == otherTagValue {
+			continue
+		}
+		if _, limited := r.limits[key]; !limited {
+			continue
+		}
+		if r.counts == nil {
+			r.counts = make(map[string]map[string]float64)
+		}
+		values, ok := r.counts[key]
+		if !ok {
+			values = make(map[string]float64)
+			r.counts[key] = values
+		}
+		values[value] += weight
+	}
+}
+
+// top returns the values to keep for each tag key which has more distinct values than its limit.  Ties are broken by
+// the value, so the result is stable.  Returns nil if nothing needs to be collapsed.
+func (r *tagValueRanker) top() map[string]map[string]struct{} {
+	var keep map[string]map[string]struct{}
+	for key, values := range r.counts {
+		limit := r.limits[key]
+		if len(values) <= limit {
+			continue
+		}
+		sorted := make([]string, 0, len(values))
+		for value := range values {
+			sorted = append(sorted, value)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if values[sorted[i]] != values[sorted[j]] {
+				return values[sorted[i]] > values[sorted[j]]
+			}
+			return sorted[i] < sorted[j]
+		})
+		kept := make(map[string]struct{}, limit)
+		for _, value := range sorted[:limit] {
+			kept[value] = struct{}{}
+		}
+		if keep == nil {
+			keep = make(map[string]map[string]struct{})
+		}
+		keep[key] = kept
+	}
+	return keep
+}
+
+// collapseTags returns a copy of tags with the value of any limited tag key which is not kept replaced by
+// otherTagValue.  Returns false if no tags need to change.
+func collapseTags(keep map[string]map[string]struct{}, tags gostatsd.Tags) (gostatsd.Tags, bool) {
+	var collapsed gostatsd.Tags
+	for idx, tag := range tags {
+		key, value, ok := splitTag(tag)
+		if !ok || value == otherTagValue {
+			continue
+		}
+		kept, limited := keep[key]
+		if !limited {
+			continue
+		}
+		if _, ok := kept[value]; ok {
+			continue
+		}
+		if collapsed == nil {
+			collapsed = tags.Copy()
+		}
+		collapsed[idx] = key + ":" + otherTagValue
+	}
+	return collapsed, collapsed != nil
+}
+
+// collapseTagValues limits the number of distinct values of each tag key in tagValueLimits, for each metric name.
+// The most frequent values are kept, and all others are replaced with otherTagValue, merging any metrics which then
+// have the same tags.  Frequency is the number of samples for counters and timers, the number of unique values for
+// sets, and the number of series for gauges.  A counter, timer, set or distribution which received nothing since the
+// last flush is dropped rather than merged, so once the overflow stops the otherTagValue series stops being updated
+// and expires like any other series.  Returns the number of metrics which were collapsed.
+func (a *MetricAggregator) collapseTagValues() int {
+	collapsed := gostatsd.NewMetricMap()
+	count := 0
+
+	for name, counters := range a.metricMap.Counters {
+		r := newTagValueRanker(a.tagValueLimits)
+		for _, counter := range counters {
+			weight := float64(counter.Value)
+			if weight < 0 {
+				weight = -weight
+			}
+			r.add(counter.Tags, weight)
+		}
+		keep := r.top()
+		if keep == nil {
+			continue
+		}
+		for tagsKey, counter := range counters {
+			if tags, ok := collapseTags(keep, counter.Tags); ok {
+				if counter.Value != 0 {
+					counter.Tags = tags
+					collapsed.MergeCounter(name, gostatsd.FormatTagsKey(counter.Hostname, tags), counter)
+				}
+				deleteMetric(name, tagsKey, a.metricMap.Counters)
+				count++
+			}
+		}
+	}
+
+	for name, gauges := range a.metricMap.Gauges {
+		r := newTagValueRanker(a.tagValueLimits)
+		for _, gauge := range gauges {
+			r.add(gauge.Tags, 1)
+		}
+		keep := r.top()
+		if keep == nil {
+			continue
+		}
+		for tagsKey, gauge := range gauges {
+			if tags, ok := collapseTags(keep, gauge.Tags); ok {
+				gauge.Tags = tags
+				collapsed.MergeGauge(name, gostatsd.FormatTagsKey(gauge.Hostname, tags), gauge)
+				deleteMetric(name, tagsKey, a.metricMap.Gauges)
+				count++
+			}
+		}
+	}
+
+	for name, timers := range a.metricMap.Timers {
+		r := newTagValueRanker(a.tagValueLimits)
+		for _, timer := range timers {
+			r.add(timer.Tags, timer.SampledCount)
+		}
+		keep := r.top()
+		if keep == nil {
+			continue
+		}
+		for tagsKey, timer := range timers {
+			if tags, ok := collapseTags(keep, timer.Tags); ok {
+				deleteMetric(name, tagsKey, a.metricMap.Timers)
+				if len(timer.Values) == 0 {
+					count++
+					continue
+				}
+				timer.Tags = tags
+				newTagsKey := gostatsd.FormatTagsKey(timer.Hostname, tags)
+				collapsed.MergeTimer(name, newTagsKey, timer)
+				if a.timerReservoirs != nil {
+					a.timerReservoirs.move(name, tagsKey, newTagsKey)
+				}
+				count++
+			}
+		}
+	}
+
+	for name, sets := range a.metricMap.Sets {
+		r := newTagValueRanker(a.tagValueLimits)
+		for _, set := range sets {
+			r.add(set.Tags, float64(len(set.Values)))
+		}
+		keep := r.top()
+		if keep == nil {
+			continue
+		}
+		for tagsKey, set := range sets {
+			if tags, ok := collapseTags(keep, set.Tags); ok {
+				if len(set.Values) > 0 {
+					set.Tags = tags
+					collapsed.MergeSet(name, gostatsd.FormatTagsKey(set.Hostname, tags), set)
+				}
+				deleteMetric(name, tagsKey, a.metricMap.Sets)
+				count++
+			}
+		}
+	}
+
+	for name, distributions := range a.metricMap.Distributions {
+		r := newTagValueRanker(a.tagValueLimits)
+		for _, distribution := range distributions {
+			r.add(distribution.Tags, distribution.SampledCount)
+		}
+		keep := r.top()
+		if keep == nil {
+			continue
+		}
+		for tagsKey, distribution := range distributions {
+			if tags, ok := collapseTags(keep, distribution.Tags); ok {
+				if len(distribution.Values) > 0 {
+					distribution.Tags = tags
+					collapsed.MergeDistribution(name, gostatsd.FormatTagsKey(distribution.Hostname, tags), distribution)
+				}
+				deleteMetric(name, tagsKey, a.metricMap.Distributions)
+				count++
+			}
+		}
+	}
+
+	a.metricMap.Merge(collapsed)
+	return count
+}
@@ -1,15 +1,23 @@
 package statsd
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"math"
+	"math/rand"
 	"runtime"
 	"testing"
 	"time"
 
 	"github.com/ash2k/stager"
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/catalog"
+	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 func newFakeAggregator() *MetricAggregator {
@@ -299,6 +307,45 @@ func TestIsExpired(t *testing.T) {
 	assrt.Equal(false, ma.isExpired(now, ts))
 }
 
+func TestExpiryLastReceived(t *testing.T) {
+	t.Parallel()
+	start := time.Now()
+	now := start
+	ma := newFakeAggregator()
+	ma.now = func() time.Time { return now }
+	ma.expiryInterval = 5 * time.Minute
+
+	receive := func() {
+		ts := gostatsd.Nanotime(now.UnixNano())
+		ma.Receive(
+			&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: ts},
+			&gostatsd.Metric{Name: "g", Value: 1, Type: gostatsd.GAUGE, Timestamp: ts},
+			&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: ts},
+			&gostatsd.Metric{Name: "s", StringValue: "x", Type: gostatsd.SET, Timestamp: ts},
+		)
+	}
+	assertPresent := func(present bool) {
+		for _, m := range []gostatsd.AggregatedMetrics{ma.metricMap.Counters, ma.metricMap.Gauges, ma.metricMap.Timers, ma.metricMap.Sets} {
+			assert.Equal(t, present, m.HasChildren("c") || m.HasChildren("g") || m.HasChildren("t") || m.HasChildren("s"))
+		}
+	}
+
+	receive()
+	now = start.Add(4 * time.Minute)
+	receive()
+	ma.Reset()
+	assertPresent(true)
+
+	// More than the interval since first received, but not since last received.
+	now = start.Add(8 * time.Minute)
+	ma.Reset()
+	assertPresent(true)
+
+	now = start.Add(9*time.Minute + time.Second)
+	ma.Reset()
+	assertPresent(false)
+}
+
 func TestDisabledCount(t *testing.T) {
 	t.Parallel()
 	ma := newFakeAggregator()
@@ -416,3 +463,1125 @@ func BenchmarkHotMetric(b *testing.B) {
 
 	stgr.Shutdown()
 }
+
+func TestMaxNames(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.maxNames = 2
+	ma.Receive(
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER},
+		&gostatsd.Metric{Name: "b", Value: 1, Type: gostatsd.GAUGE},
+		&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"foo:bar"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.TIMER},
+	)
+	assert.Len(t, ma.metricMap.Counters["a"], 2)
+	assert.Len(t, ma.metricMap.Gauges, 1)
+	assert.NotContains(t, ma.metricMap.Counters, "c")
+	assert.Contains(t, ma.metricMap.Timers, "a") // A name used by another type doesn't take another slot
+	assert.EqualValues(t, 1, ma.namesDropped)
+	assert.Equal(t, 2, ma.nameCount())
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "b", Value: 1, Type: gostatsd.SET, StringValue: "x"})
+	mm.Receive(&gostatsd.Metric{Name: "d", Value: 1, Type: gostatsd.SET, StringValue: "x"})
+	ma.ReceiveMap(mm)
+	assert.EqualValues(t, 2, ma.metricMap.Counters["a"][""].Value)
+	assert.Contains(t, ma.metricMap.Sets, "b")
+	assert.NotContains(t, ma.metricMap.Sets, "d")
+	assert.EqualValues(t, 2, ma.namesDropped)
+}
+
+func TestMaxNamesExpiry(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.now = func() time.Time { return now }
+	ma.maxNames = 1
+	ma.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	ma.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	assert.NotContains(t, ma.metricMap.Counters, "b")
+
+	// Once "a" expires there is room for "b".
+	now = now.Add(10 * time.Minute)
+	ma.Reset()
+	assert.Empty(t, ma.metricMap.Counters)
+	assert.Zero(t, ma.namesDropped)
+	ma.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	assert.Contains(t, ma.metricMap.Counters, "b")
+}
+
+func TestMaxSeries(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.maxSeries = 2
+	ma.seriesLRU = newSeriesLRU()
+	ma.setMemberTTL = time.Minute
+	ma.setMembers = make(setMembers)
+	ma.Receive(
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"active"}},
+		&gostatsd.Metric{Name: "s", StringValue: "x", Type: gostatsd.SET, Tags: gostatsd.Tags{"dormant"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"active"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"new"}},
+	)
+	assert.EqualValues(t, 2, ma.metricMap.Counters["a"]["active"].Value)
+	assert.Contains(t, ma.metricMap.Counters["a"], "new")
+	assert.Empty(t, ma.metricMap.Sets)
+	assert.Empty(t, ma.setMembers)
+	assert.EqualValues(t, 1, ma.seriesEvicted)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"active"}})
+	mm.Receive(&gostatsd.Metric{Name: "g", Value: 1, Type: gostatsd.GAUGE})
+	ma.ReceiveMap(mm)
+	assert.EqualValues(t, 3, ma.metricMap.Counters["a"]["active"].Value)
+	assert.NotContains(t, ma.metricMap.Counters["a"], "new")
+	assert.Contains(t, ma.metricMap.Gauges, "g")
+	assert.EqualValues(t, 2, ma.seriesEvicted)
+	assert.Equal(t, 2, ma.seriesLRU.len())
+}
+
+func TestMaxSeriesReset(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.now = func() time.Time { return now }
+	ma.maxSeries = 2
+	ma.seriesLRU = newSeriesLRU()
+	ma.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	now = now.Add(10 * time.Minute)
+	ma.Receive(&gostatsd.Metric{Name: "b", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+
+	// Once "a" expires it is no longer tracked, so "c" doesn't evict "b".
+	ma.Reset()
+	assert.Equal(t, 1, ma.seriesLRU.len())
+	assert.Zero(t, ma.seriesEvicted)
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	assert.Contains(t, ma.metricMap.Counters, "b")
+	assert.Contains(t, ma.metricMap.Counters, "c")
+	assert.Zero(t, ma.seriesEvicted)
+}
+
+func TestMaxCardinalityPerMetric(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.maxCardinality = 2
+	ma.tagSets = make(tagSetsByName)
+	ma.Receive(
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:1"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:2"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:3"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:1"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:4"}},
+		&gostatsd.Metric{Name: "a", Value: 1, Type: gostatsd.GAUGE, Tags: gostatsd.Tags{"id:3"}},
+	)
+	counters := ma.metricMap.Counters["a"]
+	require.Len(t, counters, 3)
+	assert.EqualValues(t, 2, counters["id:1"].Value)
+	assert.EqualValues(t, 1, counters["id:2"].Value)
+	assert.EqualValues(t, 2, counters[cardinalityOverflowTag].Value)
+	assert.Equal(t, gostatsd.Tags{cardinalityOverflowTag}, counters[cardinalityOverflowTag].Tags)
+	assert.Contains(t, ma.metricMap.Gauges["a"], "id:3")
+	assert.EqualValues(t, 1, ma.namesCapped)
+	assert.EqualValues(t, 2, ma.tagSetsOverflowed)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:2"}})
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:5"}})
+	mm.Receive(&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{cardinalityOverflowTag}})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"id:1"}, Hostname: "h"})
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 2, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"id:2"}, Hostname: "h"})
+	ma.ReceiveMap(mm)
+	// The tag sets of a MetricMap are received in no particular order, so the one which overflows is sent on its own.
+	mm = gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "t", Value: 3, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"id:3"}, Hostname: "h"})
+	ma.ReceiveMap(mm)
+	require.Len(t, counters, 3)
+	assert.EqualValues(t, 2, counters["id:2"].Value)
+	assert.EqualValues(t, 4, counters[cardinalityOverflowTag].Value)
+	timers := ma.metricMap.Timers["t"]
+	require.Len(t, timers, 3)
+	overflowKey := gostatsd.FormatTagsKey("h", gostatsd.Tags{cardinalityOverflowTag})
+	assert.Equal(t, []float64{3}, timers[overflowKey].Values)
+	assert.Equal(t, "h", timers[overflowKey].Hostname)
+	assert.EqualValues(t, 2, ma.namesCapped)
+	assert.EqualValues(t, 4, ma.tagSetsOverflowed)
+
+	statser := &gaugeStatser{Statser: stats.NewNullStatser(), gauges: map[string]float64{}}
+	ma.statser = statser
+	ma.Flush(1 * time.Second)
+	assert.Equal(t, float64(2), statser.gauges["aggregator.cardinality_capped"])
+	assert.Equal(t, float64(4), statser.gauges["aggregator.cardinality_overflowed"])
+}
+
+func TestMaxCardinalityPerMetricReset(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.now = func() time.Time { return now }
+	ma.maxCardinality = 2
+	ma.tagSets = make(tagSetsByName)
+	ma.Receive(
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:1"}, Timestamp: gostatsd.Nanotime(now.UnixNano())},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:2"}, Timestamp: gostatsd.Nanotime(now.Add(10 * time.Minute).UnixNano())},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:3"}, Timestamp: gostatsd.Nanotime(now.UnixNano())},
+	)
+	now = now.Add(10 * time.Minute)
+
+	// "id:1" and the overflow expire, the retained "id:2" keeps its place, leaving room for one new tag set.
+	ma.Reset()
+	assert.Zero(t, ma.namesCapped)
+	assert.Zero(t, ma.tagSetsOverflowed)
+	ma.Receive(
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:3"}, Timestamp: gostatsd.Nanotime(now.UnixNano())},
+		&gostatsd.Metric{Name: "a", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"id:4"}, Timestamp: gostatsd.Nanotime(now.UnixNano())},
+	)
+	counters := ma.metricMap.Counters["a"]
+	require.Len(t, counters, 3)
+	assert.Contains(t, counters, "id:2")
+	assert.EqualValues(t, 1, counters["id:3"].Value)
+	assert.EqualValues(t, 1, counters[cardinalityOverflowTag].Value)
+	assert.EqualValues(t, 1, ma.tagSetsOverflowed)
+}
+
+func TestTagValueLimits(t *testing.T) {
+	t.Parallel()
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	ma := newFakeAggregator()
+	ma.tagValueLimits = map[string]int{"endpoint": 2}
+	for endpoint, count := range map[string]int{"/a": 5, "/b": 4, "/c": 2, "/d": 1} {
+		for i := 0; i < count; i++ {
+			ma.Receive(&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now, Tags: gostatsd.Tags{"endpoint:" + endpoint, "env:prod"}})
+			ma.Receive(&gostatsd.Metric{Name: "lat", Value: float64(i), Rate: 1, Type: gostatsd.TIMER, Timestamp: now, Tags: gostatsd.Tags{"endpoint:" + endpoint}})
+		}
+	}
+	ma.Receive(&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now, Tags: gostatsd.Tags{"env:prod"}})
+	ma.Receive(&gostatsd.Metric{Name: "other", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now, Tags: gostatsd.Tags{"endpoint:/z"}})
+	ma.Flush(1 * time.Second)
+
+	counters := ma.metricMap.Counters["req"]
+	require.Len(t, counters, 4)
+	assert.EqualValues(t, 5, counters["endpoint:/a,env:prod"].Value)
+	assert.EqualValues(t, 4, counters["endpoint:/b,env:prod"].Value)
+	assert.EqualValues(t, 3, counters["endpoint:__other__,env:prod"].Value)
+	assert.EqualValues(t, 3, counters["endpoint:__other__,env:prod"].PerSecond)
+	assert.Equal(t, gostatsd.Tags{"endpoint:__other__", "env:prod"}, counters["endpoint:__other__,env:prod"].Tags)
+	assert.EqualValues(t, 1, counters["env:prod"].Value)
+	assert.Len(t, ma.metricMap.Counters["other"], 1)
+
+	timers := ma.metricMap.Timers["lat"]
+	require.Len(t, timers, 3)
+	assert.Equal(t, 3, timers["endpoint:__other__"].Count)
+	assert.EqualValues(t, 1, timers["endpoint:__other__"].Max)
+
+	// Values are ranked by their volume in the current interval
+	ma.Reset()
+	ma.Receive(&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now, Tags: gostatsd.Tags{"endpoint:/c", "env:prod"}})
+	ma.Flush(1 * time.Second)
+	counters = ma.metricMap.Counters["req"]
+	require.Len(t, counters, 4)
+	assert.EqualValues(t, 1, counters["endpoint:/c,env:prod"].Value)
+	assert.Contains(t, counters, "endpoint:/a,env:prod")
+	assert.EqualValues(t, 0, counters["endpoint:__other__,env:prod"].Value)
+}
+
+func TestTagValueLimitsOtherExpires(t *testing.T) {
+	t.Parallel()
+	now := time.Now()
+	ma := newFakeAggregator()
+	ma.now = func() time.Time { return now }
+	ma.tagValueLimits = map[string]int{"endpoint": 1}
+	receive := func(endpoints ...string) {
+		for _, endpoint := range endpoints {
+			ts := gostatsd.Nanotime(now.UnixNano())
+			tags := gostatsd.Tags{"endpoint:" + endpoint}
+			ma.Receive(
+				&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: ts, Tags: tags},
+				&gostatsd.Metric{Name: "lat", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: ts, Tags: tags},
+				&gostatsd.Metric{Name: "users", StringValue: "x", Type: gostatsd.SET, Timestamp: ts, Tags: tags},
+			)
+		}
+	}
+	receive("/a", "/a", "/b")
+	ma.Flush(time.Minute)
+	require.Contains(t, ma.metricMap.Counters["req"], "endpoint:__other__")
+
+	// Alternating between values never has more than the limit in an interval, so the series which received nothing
+	// are dropped instead of keeping the overflow series alive.
+	for i := 0; i < 10; i++ {
+		ma.Reset()
+		now = now.Add(time.Minute)
+		endpoint := []string{"/a", "/b"}[i%2]
+		receive(endpoint)
+		ma.Flush(time.Minute)
+		assert.EqualValues(t, 1, ma.metricMap.Counters["req"]["endpoint:"+endpoint].Value)
+		assert.Zero(t, ma.metricMap.Counters["req"]["endpoint:__other__"].Value)
+		assert.True(t, len(ma.metricMap.Counters["req"]) <= 2)
+	}
+	assert.NotContains(t, ma.metricMap.Counters["req"], "endpoint:__other__")
+	assert.NotContains(t, ma.metricMap.Timers["lat"], "endpoint:__other__")
+	assert.NotContains(t, ma.metricMap.Sets["users"], "endpoint:__other__")
+}
+
+func TestTagValueLimitsUnderLimit(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.tagValueLimits = map[string]int{"endpoint": 2}
+	ma.Receive(
+		&gostatsd.Metric{Name: "g", Value: 1, Type: gostatsd.GAUGE, Tags: gostatsd.Tags{"endpoint:/a"}},
+		&gostatsd.Metric{Name: "g", Value: 2, Type: gostatsd.GAUGE, Tags: gostatsd.Tags{"endpoint:/b"}},
+		&gostatsd.Metric{Name: "s", StringValue: "x", Type: gostatsd.SET, Tags: gostatsd.Tags{"endpoint:/a"}},
+		&gostatsd.Metric{Name: "s", StringValue: "y", Type: gostatsd.SET, Tags: gostatsd.Tags{"endpoint:/b"}},
+	)
+	assert.Zero(t, ma.collapseTagValues())
+	assert.Len(t, ma.metricMap.Gauges["g"], 2)
+	assert.Len(t, ma.metricMap.Sets["s"], 2)
+}
+
+func TestTagBuckets(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.tagBuckets = TagBucketRules{
+		"status_code": {Tag: "status_code", NewTag: "status_class", Bounds: []float64{200, 300, 400, 500, 600}, Labels: []string{"2xx", "3xx", "4xx", "5xx", "invalid"}},
+		"size":        {Tag: "size", Width: 100},
+	}
+	for _, code := range []string{"200", "201", "204", "299"} {
+		ma.Receive(&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"status_code:" + code, "env:prod"}})
+	}
+	ma.Receive(
+		&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"status_code:404", "env:prod"}},
+		&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"status_code:100", "env:prod"}},
+		&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"status_code:unknown", "env:prod"}},
+		&gostatsd.Metric{Name: "lat", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"size:1234"}},
+		&gostatsd.Metric{Name: "lat", Value: 2, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"size:1299.5"}},
+	)
+
+	counters := ma.metricMap.Counters["req"]
+	require.Len(t, counters, 4)
+	assert.EqualValues(t, 4, counters["env:prod,status_class:2xx"].Value)
+	assert.ElementsMatch(t, gostatsd.Tags{"status_class:2xx", "env:prod"}, counters["env:prod,status_class:2xx"].Tags)
+	assert.EqualValues(t, 1, counters["env:prod,status_class:4xx"].Value)
+	// Values below the first bound, or which are not numbers, are left alone
+	assert.Contains(t, counters, "env:prod,status_code:100")
+	assert.Contains(t, counters, "env:prod,status_code:unknown")
+	require.Len(t, ma.metricMap.Timers["lat"], 1)
+	assert.Len(t, ma.metricMap.Timers["lat"]["size:1200"].Values, 2)
+	assert.EqualValues(t, 7, ma.tagsBucketed)
+
+	// Metrics from forwarders are bucketed too
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "req", Value: 2, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"status_code:250", "env:prod"}, TagsKey: "env:prod,status_code:250"})
+	mm.Receive(&gostatsd.Metric{Name: "req", Value: 3, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"status_code:251", "env:prod"}, TagsKey: "env:prod,status_code:251"})
+	mm.Receive(&gostatsd.Metric{Name: "s", StringValue: "x", Type: gostatsd.SET, Tags: gostatsd.Tags{"status_code:503"}, TagsKey: "status_code:503"})
+	ma.ReceiveMap(mm)
+	assert.EqualValues(t, 9, ma.metricMap.Counters["req"]["env:prod,status_class:2xx"].Value)
+	assert.Contains(t, ma.metricMap.Sets["s"], "status_class:5xx")
+	assert.EqualValues(t, 10, ma.tagsBucketed)
+}
+
+func TestNewTagBucketRulesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+tag-buckets='status size'
+
+[tag-bucket.status]
+tag='status_code'
+new-tag='status_class'
+buckets='200:2xx 300:3xx 400:4xx 500:5xx'
+
+[tag-bucket.size]
+tag='size'
+width=100
+`))
+	require.NoError(t, err)
+
+	rules, err := NewTagBucketRulesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, rules, 2)
+	assert.Equal(t, &TagBucketRule{
+		Name:   "status",
+		Tag:    "status_code",
+		NewTag: "status_class",
+		Bounds: []float64{200, 300, 400, 500},
+		Labels: []string{"2xx", "3xx", "4xx", "5xx"},
+	}, rules["status_code"])
+	assert.EqualValues(t, 100, rules["size"].Width)
+
+	rules, err = NewTagBucketRulesFromViper(viper.New())
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	for _, invalid := range []map[string]interface{}{
+		{"tag": "", "width": 10},
+		{"tag": "x"},
+		{"tag": "x", "width": 10, "buckets": "1:a"},
+		{"tag": "x", "buckets": "1"},
+		{"tag": "x", "buckets": "a:b"},
+		{"tag": "x", "buckets": "2:a 1:b"},
+	} {
+		v := viper.New()
+		v.Set(ParamTagBuckets, "bad")
+		v.Set("tag-bucket.bad", invalid)
+		_, err := NewTagBucketRulesFromViper(v)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestCounterWindows(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	rule := &CounterWindowRule{
+		Name:        "requests",
+		Match:       gostatsd.StringMatchList{gostatsd.NewStringMatch("requests")},
+		Window:      3 * time.Minute,
+		Suffix:      "per_minute",
+		Percentiles: []float64{50, 100},
+	}
+	rule.setNames()
+	ma.counterWindowRules = CounterWindowRules{rule}
+	ma.counterWindows = make(counterWindows)
+	now := time.Unix(1000, 0)
+	ma.now = func() time.Time { return now }
+
+	for _, value := range []float64{10, 20, 30, 40} {
+		now = now.Add(time.Minute)
+		ma.Receive(
+			&gostatsd.Metric{Name: "requests", Value: value, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"env:prod"}, Timestamp: gostatsd.Nanotime(now.UnixNano())},
+			&gostatsd.Metric{Name: "other", Value: value, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(now.UnixNano())},
+		)
+		ma.Flush(time.Minute)
+		ma.Reset()
+	}
+
+	// The first flush is outside the window
+	gauges := ma.metricMap.Gauges
+	assert.EqualValues(t, 30, gauges["requests.per_minute.p50"]["env:prod"].Value)
+	assert.EqualValues(t, 40, gauges["requests.per_minute.p100"]["env:prod"].Value)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, gauges["requests.per_minute.p50"]["env:prod"].Tags)
+	assert.NotContains(t, gauges, "other.per_minute.p50")
+	assert.Len(t, ma.counterWindows, 1)
+
+	// A flush without updates counts as zero
+	now = now.Add(time.Minute)
+	ma.Flush(time.Minute)
+	assert.EqualValues(t, 30, ma.metricMap.Gauges["requests.per_minute.p50"]["env:prod"].Value)
+	ma.Reset()
+
+	// The window is forgotten once the counter expires
+	now = now.Add(10 * time.Minute)
+	ma.Reset()
+	ma.Flush(time.Minute)
+	assert.Empty(t, ma.counterWindows)
+}
+
+func TestNewCounterWindowRulesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+counter-windows='requests'
+
+[counter-window.requests]
+match='requests requests.*'
+window='1h'
+suffix='per_minute'
+percentiles='95 99.9'
+`))
+	require.NoError(t, err)
+
+	rules, err := NewCounterWindowRulesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, rules, 1)
+	assert.Equal(t, "requests", rules[0].Name)
+	assert.Len(t, rules[0].Match, 2)
+	assert.Equal(t, time.Hour, rules[0].Window)
+	assert.Equal(t, []float64{95, 99.9}, rules[0].Percentiles)
+	assert.Equal(t, []string{"per_minute.p95", "per_minute.p99_9"}, rules[0].names)
+	assert.Equal(t, rules[0], rules.match("requests.get"))
+	assert.Nil(t, rules.match("other"))
+
+	rules, err = NewCounterWindowRulesFromViper(viper.New())
+	require.NoError(t, err)
+	assert.Nil(t, rules)
+
+	for _, invalid := range []map[string]interface{}{
+		{},
+		{"match": "x", "window": "0s"},
+		{"match": "x", "suffix": ""},
+		{"match": "x", "percentiles": "a"},
+		{"match": "x", "percentiles": "0"},
+		{"match": "x", "percentiles": "101"},
+	} {
+		v := viper.New()
+		v.Set(ParamCounterWindows, "bad")
+		v.Set("counter-window.bad", invalid)
+		_, err := NewCounterWindowRulesFromViper(v)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
+
+func TestCountersAsGauges(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.countersAsGauges = gostatsd.StringMatchList{gostatsd.NewStringMatch("queue.*")}
+	ma.Receive(
+		&gostatsd.Metric{Name: "queue.depth", Value: 5, Rate: 1, Type: gostatsd.COUNTER, Timestamp: 1},
+		&gostatsd.Metric{Name: "queue.depth", Value: 3, Rate: 0.5, Type: gostatsd.COUNTER, Timestamp: 2},
+		&gostatsd.Metric{Name: "requests", Value: 2, Rate: 1, Type: gostatsd.COUNTER},
+	)
+	assert.NotContains(t, ma.metricMap.Counters, "queue.depth")
+	assert.EqualValues(t, 3, ma.metricMap.Gauges["queue.depth"][""].Value)
+	assert.EqualValues(t, 2, ma.metricMap.Counters["requests"][""].Value)
+	assert.EqualValues(t, 2, ma.countersConverted)
+
+	mm := gostatsd.NewMetricMap()
+	mm.Counters["queue.size"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(3, 7, "", nil)}
+	mm.Counters["requests"] = map[string]gostatsd.Counter{"": gostatsd.NewCounter(3, 1, "", nil)}
+	ma.ReceiveMap(mm)
+	assert.NotContains(t, ma.metricMap.Counters, "queue.size")
+	assert.EqualValues(t, 7, ma.metricMap.Gauges["queue.size"][""].Value)
+	assert.EqualValues(t, 3, ma.metricMap.Counters["requests"][""].Value)
+	assert.EqualValues(t, 3, ma.countersConverted)
+
+	ma.Reset()
+	assert.Zero(t, ma.countersConverted)
+}
+
+func TestPercentileMinSamples(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(
+		[]float64{90},
+		5*time.Minute,
+		gostatsd.TimerSubtypes{},
+	)
+	ma.percentileMinSamples = 3
+	for i := 0; i < 2; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "few", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+	}
+	for i := 0; i < 3; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "enough", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+	}
+	ma.Flush(1 * time.Second)
+
+	few := ma.metricMap.Timers["few"][""]
+	assert.Empty(t, few.Percentiles)
+	assert.Equal(t, 2, few.Count)
+	assert.EqualValues(t, 0, few.Min)
+	assert.EqualValues(t, 1, few.Max)
+	assert.EqualValues(t, 0.5, few.Mean)
+
+	enough := ma.metricMap.Timers["enough"][""]
+	assert.NotEmpty(t, enough.Percentiles)
+	assert.Equal(t, 3, enough.Count)
+}
+
+func TestSampledTimers(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	for i := 0; i < 1000; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "sampled", Value: float64(i % 10), Rate: 0.1, Type: gostatsd.TIMER})
+	}
+	ma.Flush(10 * time.Second)
+
+	timer := ma.metricMap.Timers["sampled"][""]
+	assert.Equal(t, 10000, timer.Count)
+	assert.InDelta(t, 1000, timer.PerSecond, 1e-9)
+	// Aggregations other than the count are over the samples received.
+	assert.Len(t, timer.Values, 1000)
+	assert.EqualValues(t, 4.5, timer.Mean)
+	assert.EqualValues(t, 4500, timer.Sum)
+	assert.EqualValues(t, 900, timerPercentile(timer, "count_90"))
+	assert.EqualValues(t, 8, timerPercentile(timer, "upper_90"))
+}
+
+func TestInvalidSampleRates(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	for _, r := range []float64{0, -0.5, math.NaN(), 1} {
+		ma.Receive(&gostatsd.Metric{Name: "t", Value: 1, Rate: r, Type: gostatsd.TIMER})
+		ma.Receive(&gostatsd.Metric{Name: "c", Value: 2, Rate: r, Type: gostatsd.COUNTER})
+	}
+	ma.Receive(&gostatsd.Metric{Name: "g", Value: 1, Rate: 0, Type: gostatsd.GAUGE})
+	assert.EqualValues(t, 6, ma.invalidRates)
+	ma.Flush(1 * time.Second)
+
+	timer := ma.metricMap.Timers["t"][""]
+	assert.Equal(t, 4, timer.Count)
+	assert.EqualValues(t, 4, timer.PerSecond)
+	assert.EqualValues(t, 8, ma.metricMap.Counters["c"][""].Value)
+	assert.EqualValues(t, 1, ma.metricMap.Gauges["g"][""].Value)
+}
+
+// timerPercentile returns the value of the named percentile aggregation of timer, or NaN if it wasn't calculated.
+func timerPercentile(timer gostatsd.Timer, name string) float64 {
+	for _, pct := range timer.Percentiles {
+		if pct.Str == name {
+			return pct.Float
+		}
+	}
+	return math.NaN()
+}
+
+func TestWeightedTimers(t *testing.T) {
+	t.Parallel()
+	for _, weightTimers := range []bool{false, true} {
+		ma := newFakeAggregator()
+		ma.weightTimers = weightTimers
+		for i := 1; i < 10; i++ {
+			ma.Receive(&gostatsd.Metric{Name: "mixed", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+		}
+		ma.Receive(&gostatsd.Metric{Name: "mixed", Value: 100, Rate: 0.1, Type: gostatsd.TIMER})
+		ma.Flush(1 * time.Second)
+
+		timer := ma.metricMap.Timers["mixed"][""]
+		assert.Equal(t, 19, timer.Count, "weighted %t", weightTimers)
+		assert.EqualValues(t, 19, timer.PerSecond)
+		assert.EqualValues(t, 1, timer.Min)
+		assert.EqualValues(t, 100, timer.Max)
+		if weightTimers {
+			// The value sampled at 0.1 stands for 10 of the 19 values.
+			assert.InDelta(t, 55, timer.Mean, 1e-9)
+			assert.EqualValues(t, 100, timer.Median)
+			assert.EqualValues(t, 100, timerPercentile(timer, "upper_90"))
+		} else {
+			assert.EqualValues(t, 14.5, timer.Mean)
+			assert.EqualValues(t, 5.5, timer.Median)
+			assert.EqualValues(t, 9, timerPercentile(timer, "upper_90"))
+		}
+	}
+}
+
+func TestDistributions(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator([]float64{90, 50, -10}, 5*time.Minute, gostatsd.TimerSubtypes{})
+	for i := 1; i <= 10; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "latency", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+		ma.Receive(&gostatsd.Metric{Name: "latency", Value: float64(10 * i), Rate: 1, Type: gostatsd.DISTRIBUTION})
+	}
+	ma.Flush(1 * time.Second)
+
+	timer := ma.metricMap.Timers["latency"][""]
+	assert.Equal(t, 10, timer.Count)
+	assert.EqualValues(t, 1, timer.Min)
+	assert.EqualValues(t, 10, timer.Max)
+	assert.EqualValues(t, 55, timer.Sum)
+	assert.True(t, math.IsNaN(timerPercentile(timer, "p90")))
+
+	dist := ma.metricMap.Distributions["latency"][""]
+	assert.Equal(t, 10, dist.Count)
+	assert.EqualValues(t, 10, dist.Min)
+	assert.EqualValues(t, 100, dist.Max)
+	assert.EqualValues(t, 550, dist.Sum)
+	assert.Zero(t, dist.Mean)
+	assert.Len(t, dist.Percentiles, 2) // No lower percentiles
+	assert.EqualValues(t, 90, timerPercentile(dist, "p90"))
+	assert.EqualValues(t, 50, timerPercentile(dist, "p50"))
+	assert.Len(t, dist.Values, 10)
+}
+
+func TestSampledDistributions(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator([]float64{90, 50}, 5*time.Minute, gostatsd.TimerSubtypes{})
+	for i := 1; i < 10; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "mixed", Value: float64(i), Rate: 1, Type: gostatsd.DISTRIBUTION})
+	}
+	ma.Receive(&gostatsd.Metric{Name: "mixed", Value: 100, Rate: 0.1, Type: gostatsd.DISTRIBUTION})
+	for i := 1; i <= 10; i++ {
+		ma.Receive(&gostatsd.Metric{Name: "uniform", Value: float64(i), Rate: 0.1, Type: gostatsd.DISTRIBUTION})
+	}
+	ma.Flush(1 * time.Second)
+
+	// The value sampled at 0.1 stands for 10 of the 19 values.
+	mixed := ma.metricMap.Distributions["mixed"][""]
+	assert.Equal(t, 19, mixed.Count)
+	assert.EqualValues(t, 1, mixed.Min)
+	assert.EqualValues(t, 100, mixed.Max)
+	assert.InDelta(t, 1045, mixed.Sum, 1e-9)
+	assert.EqualValues(t, 100, timerPercentile(mixed, "p50"))
+	assert.EqualValues(t, 100, timerPercentile(mixed, "p90"))
+
+	uniform := ma.metricMap.Distributions["uniform"][""]
+	assert.Equal(t, 100, uniform.Count)
+	assert.InDelta(t, 550, uniform.Sum, 1e-9)
+	assert.EqualValues(t, 5, timerPercentile(uniform, "p50"))
+	assert.EqualValues(t, 9, timerPercentile(uniform, "p90"))
+}
+
+func TestDisabledDistributionPct(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.disabledSubtypes.DistributionPct = true
+	ma.Receive(&gostatsd.Metric{Name: "x", Value: 1, Rate: 1, Type: gostatsd.DISTRIBUTION})
+	ma.Flush(1 * time.Second)
+	dist := ma.metricMap.Distributions["x"][""]
+	assert.Empty(t, dist.Percentiles)
+	assert.Equal(t, 1, dist.Count)
+}
+
+func TestWeightedTimersUniform(t *testing.T) {
+	t.Parallel()
+	percentiles := []float64{90, 50, -10, -40}
+	values := []float64{12, 3, 7, 7, 1, 20, 15, 2, 9, 4, 11}
+
+	for n := 1; n <= len(values); n++ {
+		unweighted := NewMetricAggregator(percentiles, 5*time.Minute, gostatsd.TimerSubtypes{})
+		unweighted.metricMap.Timers["t"] = map[string]gostatsd.Timer{
+			"": {Values: append([]float64(nil), values[:n]...), SampledCount: float64(10 * n)},
+		}
+		unweighted.Flush(1 * time.Second)
+
+		weighted := NewMetricAggregator(percentiles, 5*time.Minute, gostatsd.TimerSubtypes{})
+		weighted.weightTimers = true
+		weights := make([]float64, n)
+		for i := range weights {
+			weights[i] = 10
+		}
+		weighted.metricMap.Timers["t"] = map[string]gostatsd.Timer{
+			"": {Values: append([]float64(nil), values[:n]...), Weights: weights, SampledCount: float64(10 * n)},
+		}
+		weighted.Flush(1 * time.Second)
+
+		expected := unweighted.metricMap.Timers["t"][""]
+		actual := weighted.metricMap.Timers["t"][""]
+		assert.Equal(t, expected.Count, actual.Count, "n=%d", n)
+		assert.Equal(t, expected.Values, actual.Values, "n=%d", n)
+		assert.Equal(t, expected.Min, actual.Min, "n=%d", n)
+		assert.Equal(t, expected.Max, actual.Max, "n=%d", n)
+		assert.Equal(t, expected.Median, actual.Median, "n=%d", n)
+		assert.InDelta(t, expected.Mean, actual.Mean, 1e-9, "n=%d", n)
+		assert.InDelta(t, expected.StdDev, actual.StdDev, 1e-9, "n=%d", n)
+		assert.InDelta(t, expected.Sum, actual.Sum, 1e-9, "n=%d", n)
+		assert.InDelta(t, expected.SumSquares, actual.SumSquares, 1e-9, "n=%d", n)
+		if n == 1 {
+			continue // A single value is never weighted
+		}
+		require.Len(t, actual.Percentiles, len(expected.Percentiles), "n=%d", n)
+		for _, pct := range expected.Percentiles {
+			assert.InDelta(t, pct.Float, timerPercentile(actual, pct.Str), 1e-9, "n=%d %s", n, pct.Str)
+		}
+	}
+}
+
+func TestTimerHistogram(t *testing.T) {
+	t.Parallel()
+	for _, weightTimers := range []bool{false, true} {
+		ma := newFakeAggregator()
+		ma.weightTimers = weightTimers
+		ma.histogramBuckets = newHistogramBuckets([]float64{0.5, 5, 10, 1000})
+		for i := 1; i < 10; i++ {
+			ma.Receive(&gostatsd.Metric{Name: "mixed", Value: float64(i), Rate: 1, Type: gostatsd.TIMER})
+		}
+		ma.Receive(&gostatsd.Metric{Name: "mixed", Value: 100, Rate: 0.1, Type: gostatsd.TIMER})
+		ma.Flush(1 * time.Second)
+
+		timer := ma.metricMap.Timers["mixed"][""]
+		le5, le10 := 10, 17 // Each value stands for 1.9 values.
+		if weightTimers {
+			le5, le10 = 5, 9 // The value sampled at 0.1 stands for 10 of the 19 values.
+		}
+		assert.Equal(t, []gostatsd.HistogramBucket{
+			{Name: "histogram.le_0_5", Bound: 0.5, Count: 0},
+			{Name: "histogram.le_5", Bound: 5, Count: le5},
+			{Name: "histogram.le_10", Bound: 10, Count: le10},
+			{Name: "histogram.le_1000", Bound: 1000, Count: 19},
+			{Name: "histogram.le_inf", Bound: math.Inf(1), Count: 19},
+		}, timer.Histogram, "weighted %t", weightTimers)
+		assert.True(t, math.IsNaN(timerPercentile(timer, "histogram.le_inf")), "weighted %t", weightTimers)
+	}
+}
+
+func TestDisabledTimerHistogram(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator([]float64{90}, 5*time.Minute, gostatsd.TimerSubtypes{Histogram: true})
+	ma.histogramBuckets = newHistogramBuckets([]float64{10})
+	ma.Receive(&gostatsd.Metric{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER})
+	ma.Flush(1 * time.Second)
+
+	timer := ma.metricMap.Timers["latency"][""]
+	assert.EqualValues(t, 1, timerPercentile(timer, "upper_90"))
+	assert.Nil(t, timer.Histogram)
+}
+
+func TestParseHistogramBuckets(t *testing.T) {
+	t.Parallel()
+	bounds, err := ParseHistogramBuckets([]string{"100,10", "0.5", "1e3,", "10"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 10, 100, 1000}, bounds)
+
+	bounds, err = ParseHistogramBuckets(nil)
+	require.NoError(t, err)
+	assert.Nil(t, bounds)
+
+	for _, invalid := range []string{"10,ms", "NaN", "+Inf"} {
+		_, err = ParseHistogramBuckets([]string{invalid})
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestHistogramBucketNames(t *testing.T) {
+	t.Parallel()
+	bounds, err := ParseHistogramBuckets([]string{"1e1", "0.5", "-2.5"})
+	require.NoError(t, err)
+	var names []string
+	for _, bucket := range newHistogramBuckets(bounds) {
+		names = append(names, bucket.name)
+	}
+	assert.Equal(t, []string{"histogram.le_-2_5", "histogram.le_0_5", "histogram.le_10"}, names)
+}
+
+func TestSetMemberTTL(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	ma.setMemberTTL = 30 * time.Second
+	ma.setMembers = make(setMembers)
+	start := time.Now()
+	now := start
+	ma.now = func() time.Time { return now }
+	receive := func(member string) {
+		ma.Receive(&gostatsd.Metric{Name: "sessions", StringValue: member, Type: gostatsd.SET, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	}
+	members := func() map[string]struct{} {
+		ma.Flush(10 * time.Second)
+		values := ma.metricMap.Sets["sessions"][""].Values
+		ma.Reset()
+		return values
+	}
+
+	receive("a")
+	receive("b")
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, members())
+
+	// Both are retained across the flush, and b is seen again
+	now = start.Add(20 * time.Second)
+	receive("b")
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, members())
+
+	// a was last seen more than the TTL ago
+	now = start.Add(40 * time.Second)
+	assert.Equal(t, map[string]struct{}{"b": {}}, members())
+
+	now = start.Add(60 * time.Second)
+	assert.Empty(t, members())
+}
+
+func TestSetMemberTTLReceiveMap(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	ma.setMemberTTL = 30 * time.Second
+	ma.setMembers = make(setMembers)
+	now := time.Now()
+	ma.now = func() time.Time { return now }
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "sessions", StringValue: "a", Type: gostatsd.SET, Timestamp: gostatsd.Nanotime(now.UnixNano())})
+	ma.ReceiveMap(mm)
+	ma.Flush(10 * time.Second)
+	ma.Reset()
+
+	// Retained in the next flush, despite not being received again
+	ma.Flush(10 * time.Second)
+	assert.Equal(t, map[string]struct{}{"a": {}}, ma.metricMap.Sets["sessions"][""].Values)
+}
+
+func TestSetUnionReceiveMap(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+
+	// Forwarded from two nodes which both saw b
+	for _, members := range [][]string{{"a", "b"}, {"b", "c"}} {
+		mm := gostatsd.NewMetricMap()
+		for _, member := range members {
+			mm.Receive(&gostatsd.Metric{Name: "users", StringValue: member, Type: gostatsd.SET, Timestamp: now})
+		}
+		ma.ReceiveMap(mm)
+	}
+	ma.Flush(10 * time.Second)
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}, "c": {}}, ma.metricMap.Sets["users"][""].Values)
+}
+
+func TestSetEmitMembers(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	ma.setEmitMembers = gostatsd.StringMatchList{gostatsd.NewStringMatch("deploy.*")}
+	ma.setMaxMembers = 2
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	receive := func(name string, members ...string) {
+		for _, member := range members {
+			ma.Receive(&gostatsd.Metric{Name: name, StringValue: member, Type: gostatsd.SET, Tags: gostatsd.Tags{"env:prod"}, Hostname: "h", Timestamp: now})
+		}
+	}
+	tagsKey := func(tags ...string) string {
+		return gostatsd.FormatTagsKey("h", tags)
+	}
+
+	receive("deploy.versions", "1.4.2", "1.5.0")
+	receive("deploy.hosts", "a", "b", "c")
+	receive("users", "a")
+	ma.Flush(10 * time.Second)
+
+	// The sets are flushed as usual
+	assert.Len(t, ma.metricMap.Sets["deploy.versions"][tagsKey("env:prod")].Values, 2)
+	versions := ma.metricMap.Gauges["deploy.versions.members"]
+	require.Len(t, versions, 2)
+	for _, member := range []string{"1.4.2", "1.5.0"} {
+		gauge := versions[tagsKey("env:prod", "member:"+member)]
+		assert.EqualValues(t, 1, gauge.Value, member)
+		assert.ElementsMatch(t, gostatsd.Tags{"env:prod", "member:" + member}, gauge.Tags)
+		assert.Equal(t, "h", gauge.Hostname)
+	}
+	// Over the cap, only the number of members
+	hosts := ma.metricMap.Gauges["deploy.hosts.members"]
+	require.Len(t, hosts, 1)
+	assert.EqualValues(t, 3, hosts[tagsKey("env:prod", "set:truncated")].Value)
+	assert.NotContains(t, ma.metricMap.Gauges, "users.members")
+
+	// A member which isn't received again isn't flushed again
+	ma.Reset()
+	assert.Empty(t, ma.metricMap.Gauges)
+	receive("deploy.versions", "1.5.0")
+	ma.Flush(10 * time.Second)
+	require.Len(t, ma.metricMap.Gauges["deploy.versions.members"], 1)
+	assert.Contains(t, ma.metricMap.Gauges["deploy.versions.members"], tagsKey("env:prod", "member:1.5.0"))
+	assert.NotContains(t, ma.metricMap.Gauges, "deploy.hosts.members")
+	// The tags of the set are not modified
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, ma.metricMap.Sets["deploy.versions"][tagsKey("env:prod")].Tags)
+}
+
+func TestSuppressZeroCounters(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	ma.suppressZeroCounters = true
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	ma.Receive(&gostatsd.Metric{Name: "active", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now})
+	ma.Receive(&gostatsd.Metric{Name: "idle", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now})
+	ma.Receive(&gostatsd.Metric{Name: "zero", Value: 0, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now})
+	ma.Flush(1 * time.Second)
+	assert.Contains(t, ma.metricMap.Counters, "active")
+	assert.Contains(t, ma.metricMap.Counters, "idle")
+	assert.NotContains(t, ma.metricMap.Counters, "zero")
+	ma.Reset()
+
+	ma.Receive(&gostatsd.Metric{Name: "active", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now})
+	ma.Flush(1 * time.Second)
+	assert.Contains(t, ma.metricMap.Counters, "active")
+	assert.NotContains(t, ma.metricMap.Counters, "idle")
+}
+
+func TestGaugeDeltas(t *testing.T) {
+	t.Parallel()
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	ma.Receive(&gostatsd.Metric{Name: "queued", Value: 5, Rate: 1, Type: gostatsd.GAUGE, GaugeDelta: true, Timestamp: now})
+	ma.Receive(&gostatsd.Metric{Name: "active", Value: 10, Rate: 1, Type: gostatsd.GAUGE, Timestamp: now})
+	ma.Flush(1 * time.Second)
+	assert.EqualValues(t, 5, ma.metricMap.Gauges["queued"][""].Value) // Relative to zero when first seen
+	assert.EqualValues(t, 10, ma.metricMap.Gauges["active"][""].Value)
+	ma.Reset()
+
+	// Relative to the previously flushed value
+	ma.Receive(&gostatsd.Metric{Name: "queued", Value: -2, Rate: 1, Type: gostatsd.GAUGE, GaugeDelta: true, Timestamp: now})
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "active", Value: 3, Rate: 1, Type: gostatsd.GAUGE, GaugeDelta: true, Timestamp: now})
+	ma.ReceiveMap(mm)
+	ma.Flush(1 * time.Second)
+	assert.EqualValues(t, 3, ma.metricMap.Gauges["queued"][""].Value)
+	assert.EqualValues(t, 13, ma.metricMap.Gauges["active"][""].Value)
+}
+
+// gaugeStatser records the last value of each gauge.
+type gaugeStatser struct {
+	stats.Statser
+	gauges map[string]float64
+}
+
+func (gs *gaugeStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	gs.gauges[name] = value
+}
+
+func TestFlushLatency(t *testing.T) {
+	t.Parallel()
+	statser := &gaugeStatser{Statser: stats.NewNullStatser(), gauges: map[string]float64{}}
+	ma := NewMetricAggregator(nil, 5*time.Minute, gostatsd.TimerSubtypes{})
+	ma.flushLatency = true
+	ma.statser = statser
+	ma.now = func() time.Time {
+		return time.Unix(100, 0)
+	}
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Unix(95, 0).UnixNano())})
+	ma.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Unix(98, 0).UnixNano())})
+	mm := gostatsd.NewMetricMap()
+	mm.Gauges["g"] = map[string]gostatsd.Gauge{
+		"": {Value: 1, Timestamp: gostatsd.Nanotime(time.Unix(92, 500*int64(time.Millisecond)).UnixNano())},
+	}
+	ma.ReceiveMap(mm)
+	ma.Flush(10 * time.Second)
+	assert.Equal(t, float64(7500), statser.gauges["aggregator.flush_latency"])
+
+	// Nothing received since the last flush
+	ma.Reset()
+	delete(statser.gauges, "aggregator.flush_latency")
+	ma.Flush(10 * time.Second)
+	assert.NotContains(t, statser.gauges, "aggregator.flush_latency")
+}
+
+func TestFlushCatalog(t *testing.T) {
+	t.Parallel()
+	ma := newFakeAggregator()
+	ma.catalog = catalog.NewCatalog(time.Hour, 0)
+	ma.tagValueLimits = map[string]int{"endpoint": 1}
+	ma.Receive(
+		&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.NanoNow(), Tags: gostatsd.Tags{"endpoint:/a"}},
+		&gostatsd.Metric{Name: "req", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.NanoNow(), Tags: gostatsd.Tags{"endpoint:/b", "env:prod"}},
+	)
+	ma.Flush(1 * time.Second)
+
+	snapshot := ma.catalog.Snapshot()
+	require.Len(t, snapshot.Metrics, 1)
+	assert.Equal(t, "req", snapshot.Metrics[0].Name)
+	assert.Equal(t, "counter", snapshot.Metrics[0].Type)
+	assert.Len(t, snapshot.Metrics[0].TagKeys, 2)
+}
+
+func newTimerReservoirAggregator(size int, seed int64) *MetricAggregator {
+	ma := NewMetricAggregator([]float64{50, 90, 99, -10}, 5*time.Minute, gostatsd.TimerSubtypes{})
+	ma.timerReservoirSize = size
+	ma.timerReservoirs = make(timerReservoirs)
+	ma.reservoirRand = rand.New(rand.NewSource(seed))
+	return ma
+}
+
+func percentile(timer gostatsd.Timer, name string) float64 {
+	for _, pct := range timer.Percentiles {
+		if pct.Str == name {
+			return pct.Float
+		}
+	}
+	return math.NaN()
+}
+
+func TestTimerReservoir(t *testing.T) {
+	t.Parallel()
+	ma := newTimerReservoirAggregator(10, 1)
+	exact := newTimerReservoirAggregator(0, 1)
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	var sum, sumSquares float64
+	for i := 1; i <= 100; i++ {
+		value := float64(i)
+		sum += value
+		sumSquares += value * value
+		for _, a := range []*MetricAggregator{ma, exact} {
+			a.Receive(&gostatsd.Metric{Name: "latency", Value: value, Rate: 0.5, Type: gostatsd.TIMER, Hostname: "h", Timestamp: now})
+		}
+	}
+	// Values also arrive merged
+	mm := gostatsd.NewMetricMap()
+	mm.Timers["latency"] = map[string]gostatsd.Timer{
+		gostatsd.FormatTagsKey("h", nil): {Values: make([]float64, 50), SampledCount: 100, Timestamp: now, Hostname: "h"},
+	}
+	ma.ReceiveMap(mm)
+	tagsKey := gostatsd.FormatTagsKey("h", nil)
+	assert.Len(t, ma.metricMap.Timers["latency"][tagsKey].Values, 10)
+
+	ma.Flush(10 * time.Second)
+	timer := ma.metricMap.Timers["latency"][tagsKey]
+	// Count and sum are exact
+	assert.Equal(t, 300, timer.Count)
+	assert.EqualValues(t, 300, timer.SampledCount)
+	assert.EqualValues(t, 30, timer.PerSecond)
+	assert.EqualValues(t, sum, timer.Sum)
+	assert.EqualValues(t, sumSquares, timer.SumSquares)
+	assert.EqualValues(t, sum/150, timer.Mean)
+	assert.EqualValues(t, 0, timer.Min)
+	assert.EqualValues(t, 100, timer.Max)
+	// The counts of the percentiles are scaled up from the sample
+	assert.EqualValues(t, 135, percentile(timer, "count_90"))
+
+	// Timers which fit in the reservoir are exactly the same as without one
+	ma.Reset()
+	exact.Reset()
+	for _, a := range []*MetricAggregator{ma, exact} {
+		for _, value := range []float64{5, 1, 3} {
+			a.Receive(&gostatsd.Metric{Name: "latency", Value: value, Rate: 1, Type: gostatsd.TIMER, Hostname: "h", Timestamp: now})
+		}
+		a.Flush(10 * time.Second)
+	}
+	got, want := ma.metricMap.Timers["latency"][tagsKey], exact.metricMap.Timers["latency"][tagsKey]
+	assert.Equal(t, want.Values, got.Values)
+	assert.Nil(t, got.Weights)
+	assert.Equal(t, want.Count, got.Count)
+	assert.Equal(t, want.Sum, got.Sum)
+	assert.Equal(t, want.StdDev, got.StdDev)
+	assert.Equal(t, want.Median, got.Median)
+	assert.ElementsMatch(t, want.Percentiles, got.Percentiles)
+}
+
+// TestTimerReservoirPercentiles checks percentiles estimated from a reservoir are close to the exact percentiles of a
+// normal distribution.
+func TestTimerReservoirPercentiles(t *testing.T) {
+	t.Parallel()
+	const mean, stdDev = 100.0, 15.0
+	ma := newTimerReservoirAggregator(1000, 1)
+	exact := newTimerReservoirAggregator(0, 1)
+	values := rand.New(rand.NewSource(2))
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	for i := 0; i < 100000; i++ {
+		value := values.NormFloat64()*stdDev + mean
+		for _, a := range []*MetricAggregator{ma, exact} {
+			a.Receive(&gostatsd.Metric{Name: "latency", Value: value, Rate: 1, Type: gostatsd.TIMER, Timestamp: now})
+		}
+	}
+	ma.Flush(10 * time.Second)
+	exact.Flush(10 * time.Second)
+
+	sampled := ma.metricMap.Timers["latency"][""]
+	want := exact.metricMap.Timers["latency"][""]
+	require.Len(t, sampled.Values, 1000)
+	assert.Equal(t, want.Count, sampled.Count)
+	assert.InDelta(t, want.Sum, sampled.Sum, 1e-6*want.Sum)
+	assert.Equal(t, want.Min, sampled.Min)
+	assert.Equal(t, want.Max, sampled.Max)
+	assert.InDelta(t, want.Mean, sampled.Mean, 1e-9*want.Mean)
+	assert.InDelta(t, want.StdDev, sampled.StdDev, 1e-6*want.StdDev)
+
+	// The standard error of a percentile of a sample of 1000 is under 0.1 of a standard deviation
+	tolerance := 0.2 * stdDev
+	assert.InDelta(t, want.Median, sampled.Median, tolerance)
+	for _, name := range []string{"upper_50", "upper_90", "upper_99", "lower_-10", "mean_90"} {
+		assert.InDelta(t, percentile(want, name), percentile(sampled, name), tolerance, name)
+	}
+	for _, name := range []string{"count_90", "sum_90"} {
+		assert.InDelta(t, percentile(want, name), percentile(sampled, name), 0.02*percentile(want, name), name)
+	}
+}
+
+// BenchmarkTimerReservoir receives 100000 values for one timer each flush, with and without a reservoir.
+func BenchmarkTimerReservoir(b *testing.B) {
+	for _, size := range []int{0, 1000} {
+		size := size
+		b.Run(fmt.Sprintf("size=%d", size), func(b *testing.B) {
+			ma := newTimerReservoirAggregator(size, 1)
+			metrics := make([]*gostatsd.Metric, 1000)
+			for i := range metrics {
+				metrics[i] = &gostatsd.Metric{Name: "latency", Rate: 1, Type: gostatsd.TIMER}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				for batch := 0; batch < 100; batch++ {
+					for i, m := range metrics {
+						m.Value = float64(batch*len(metrics) + i)
+						m.TagsKey = ""
+					}
+					ma.Receive(metrics...)
+				}
+				b.ReportMetric(float64(cap(ma.metricMap.Timers["latency"][""].Values)*8), "bytes/timer")
+				ma.Flush(time.Second)
+				ma.Reset()
+			}
+		})
+	}
+}
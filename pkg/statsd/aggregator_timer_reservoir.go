@@ -0,0 +1,179 @@
+package statsd
+
+import (
+	"math"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// timerReservoir is the exact aggregations of every value a timer received since the last flush, when its values are
+// a reservoir sample of at most timerReservoirSize of them.
+type timerReservoir struct {
+	kept               int     // The number of values of the timer which are already in the reservoir
+	seen               int     // The number of values received
+	sum                float64 // The sum of the values
+	sumSquares         float64 // The sum of the squares of the values
+	weight             float64 // The sum of the weights of the values
+	weightedSum        float64 // The sum of the values multiplied by their weights
+	weightedSumSquares float64 // The sum of the squares of the values multiplied by their weights
+	min                float64
+	max                float64
+}
+
+// timerReservoirs is the reservoir of each timer, keyed by name and tags key.
+type timerReservoirs map[string]map[string]*timerReservoir
+
+func (tr timerReservoirs) get(name, tagsKey string) *timerReservoir {
+	byTags, ok := tr[name]
+	if !ok {
+		byTags = map[string]*timerReservoir{}
+		tr[name] = byTags
+	}
+	r, ok := byTags[tagsKey]
+	if !ok {
+		r = &timerReservoir{}
+		byTags[tagsKey] = r
+	}
+	return r
+}
+
+func (tr timerReservoirs) delete(name, tagsKey string) {
+	if byTags, ok := tr[name]; ok {
+		delete(byTags, tagsKey)
+		if len(byTags) == 0 {
+			delete(tr, name)
+		}
+	}
+}
+
+// move merges the reservoir of a timer in to the reservoir of the timer it was merged in to.  The values of the timer
+// are appended to the other timer, so they are all already in its reservoir.
+func (tr timerReservoirs) move(name, fromTagsKey, toTagsKey string) {
+	from, ok := tr[name][fromTagsKey]
+	if !ok {
+		return
+	}
+	tr.delete(name, fromTagsKey)
+	to := tr.get(name, toTagsKey)
+	if to.seen == 0 {
+		*to = *from
+		return
+	}
+	to.kept += from.kept
+	to.seen += from.seen
+	to.sum += from.sum
+	to.sumSquares += from.sumSquares
+	to.weight += from.weight
+	to.weightedSum += from.weightedSum
+	to.weightedSumSquares += from.weightedSumSquares
+	to.min = math.Min(to.min, from.min)
+	to.max = math.Max(to.max, from.max)
+}
+
+// sampleTimer adds the values the timer received since it was last sampled to its reservoir, using Algorithm R so
+// every value received since the last flush is equally likely to be kept.  The exact aggregations are updated with
+// every value, and the sampled count of the timer is left unchanged, so its count stays exact.  Once a timer has more
+// values than the reservoir, the weight of each value is kept with it, so the values received later are weighted
+// correctly.
+func (a *MetricAggregator) sampleTimer(name, tagsKey string) {
+	timer, ok := a.metricMap.Timers[name][tagsKey]
+	if !ok {
+		return
+	}
+	r := a.timerReservoirs.get(name, tagsKey)
+	if r.kept > len(timer.Values) {
+		// The timer was replaced since it was last sampled, such as by being evicted and received again.
+		*r = timerReservoir{}
+	}
+	if r.kept == len(timer.Values) {
+		return
+	}
+
+	size := a.timerReservoirSize
+	uniformWeight := 0.0
+	if timer.Weights == nil {
+		uniformWeight = timer.SampledCount / float64(len(timer.Values))
+		if r.seen+len(timer.Values)-r.kept > size {
+			timer.Weights = make([]float64, len(timer.Values))
+			for i := range timer.Weights {
+				timer.Weights[i] = uniformWeight
+			}
+		}
+	}
+
+	for i := r.kept; i < len(timer.Values); i++ {
+		value := timer.Values[i]
+		weight := uniformWeight
+		if timer.Weights != nil {
+			weight = timer.Weights[i]
+		}
+		if r.seen == 0 {
+			r.min, r.max = value, value
+		} else {
+			r.min = math.Min(r.min, value)
+			r.max = math.Max(r.max, value)
+		}
+		r.seen++
+		r.sum += value
+		r.sumSquares += value * value
+		r.weight += weight
+		r.weightedSum += weight * value
+		r.weightedSumSquares += weight * value * value
+
+		if r.seen <= size {
+			continue // Every value is kept until the reservoir is full, and is already in place.
+		}
+		if j := a.reservoirRand.Int63n(int64(r.seen)); j < int64(size) {
+			timer.Values[j] = value
+			timer.Weights[j] = weight
+		}
+	}
+
+	if n := len(timer.Values); n > size {
+		timer.Values = timer.Values[:size]
+		timer.Weights = timer.Weights[:size]
+		if cap(timer.Values) > 2*size {
+			// Don't hold on to the memory of a large batch of values.
+			timer.Values = append(make([]float64, 0, size), timer.Values...)
+			timer.Weights = append(make([]float64, 0, size), timer.Weights...)
+		}
+	}
+	r.kept = len(timer.Values)
+	a.metricMap.Timers[name][tagsKey] = timer
+}
+
+// sampleTimerMap adds the values of every timer in mm to the reservoirs, once mm is merged in to the aggregator.
+func (a *MetricAggregator) sampleTimerMap(mm *gostatsd.MetricMap) {
+	mm.Timers.Each(func(name, tagsKey string, _ gostatsd.Timer) {
+		a.sampleTimer(name, tagsKey)
+	})
+}
+
+// applyTimerReservoir replaces the aggregations of a timer which were calculated from a sample of its values with the
+// exact aggregations.  The count, sum and sum of squares of each percentile are scaled up from the sample.  The
+// percentile values, such as upper_90, and the median are estimated from the sample.
+func (a *MetricAggregator) applyTimerReservoir(timer *gostatsd.Timer, r *timerReservoir, weighted bool) {
+	seen := float64(r.seen)
+	scale := seen / float64(len(timer.Values))
+	for _, pctStruct := range a.percentThresholds {
+		for i, pct := range timer.Percentiles {
+			switch pct.Str {
+			case pctStruct.count, pctStruct.sum, pctStruct.sumSquares:
+				timer.Percentiles[i].Float = pct.Float * scale
+			}
+		}
+	}
+
+	timer.Min = r.min
+	timer.Max = r.max
+	if weighted {
+		// Scaled like aggregateWeightedTimer, so the weights sum to the number of values received.
+		timer.Sum = r.weightedSum / r.weight * seen
+		timer.SumSquares = r.weightedSumSquares / r.weight * seen
+	} else {
+		timer.Sum = r.sum
+		timer.SumSquares = r.sumSquares
+	}
+	timer.Mean = timer.Sum / seen
+	timer.StdDev = math.Sqrt(math.Max(timer.SumSquares/seen-timer.Mean*timer.Mean, 0))
+}
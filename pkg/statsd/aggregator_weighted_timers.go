@@ -0,0 +1,137 @@
+package statsd
+
+import (
+	"math"
+	"sort"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// weightEpsilon is the tolerance when comparing cumulative weights, which are sums of floating point values.
+const weightEpsilon = 1e-9
+
+// weightedValues sorts the values of a timer and their weights together.
+type weightedValues gostatsd.Timer
+
+func (wv *weightedValues) Len() int {
+	return len(wv.Values)
+}
+
+func (wv *weightedValues) Less(i, j int) bool {
+	return wv.Values[i] < wv.Values[j]
+}
+
+func (wv *weightedValues) Swap(i, j int) {
+	wv.Values[i], wv.Values[j] = wv.Values[j], wv.Values[i]
+	wv.Weights[i], wv.Weights[j] = wv.Weights[j], wv.Weights[i]
+}
+
+// aggregateWeightedTimer calculates the aggregations of a timer which received values with different sampling rates,
+// weighting each value by 1 / its sampling rate.  The weights are scaled so they sum to the number of values received,
+// so the result is the same as the unweighted aggregations when every value has the same sampling rate.
+func (a *MetricAggregator) aggregateWeightedTimer(timer *gostatsd.Timer) {
+	sort.Sort((*weightedValues)(timer))
+	n := len(timer.Values)
+	count := float64(n)
+
+	var total float64
+	for _, weight := range timer.Weights {
+		total += weight
+	}
+	scale := count / total
+
+	cumulativeWeights := make([]float64, n)
+	cumulativeValues := make([]float64, n)
+	cumulSumSquaresValues := make([]float64, n)
+	var weight, sum, sumSquares float64
+	for i, value := range timer.Values {
+		w := timer.Weights[i] * scale
+		weight += w
+		sum += w * value
+		sumSquares += w * value * value
+		cumulativeWeights[i] = weight
+		cumulativeValues[i] = sum
+		cumulSumSquaresValues[i] = sumSquares
+	}
+
+	timer.Min = timer.Values[0]
+	timer.Max = timer.Values[n-1]
+
+	// Timers with too few samples have no percentiles
+	percentThresholds := a.percentThresholds
+	if n < a.percentileMinSamples {
+		percentThresholds = nil
+	}
+	for pct, pctStruct := range percentThresholds {
+		// The threshold is rounded to the nearest received value like the unweighted aggregations.
+		threshold := math.Abs(pct) / 100 * count
+		if round(threshold) == 0 {
+			continue
+		}
+		threshold -= 0.5 - weightEpsilon
+
+		var thresholdBoundary, weightInThreshold, sumInThreshold, sumSquaresInThreshold float64
+		if pct > 0 {
+			i := sort.Search(n, func(i int) bool { return cumulativeWeights[i] > threshold })
+			thresholdBoundary = timer.Values[i]
+			weightInThreshold = cumulativeWeights[i]
+			sumInThreshold = cumulativeValues[i]
+			sumSquaresInThreshold = cumulSumSquaresValues[i]
+		} else {
+			// The weight above value i is weight - cumulativeWeights[i-1].
+			i := sort.Search(n, func(i int) bool { return i > 0 && weight-cumulativeWeights[i-1] <= threshold }) - 1
+			thresholdBoundary = timer.Values[i]
+			weightInThreshold = weight
+			sumInThreshold = sum
+			sumSquaresInThreshold = sumSquares
+			if i > 0 {
+				weightInThreshold -= cumulativeWeights[i-1]
+				sumInThreshold -= cumulativeValues[i-1]
+				sumSquaresInThreshold -= cumulSumSquaresValues[i-1]
+			}
+		}
+
+		if !a.disabledSubtypes.CountPct {
+			timer.Percentiles.Set(pctStruct.count, weightInThreshold)
+		}
+		if !a.disabledSubtypes.MeanPct {
+			timer.Percentiles.Set(pctStruct.mean, sumInThreshold/weightInThreshold)
+		}
+		if !a.disabledSubtypes.SumPct {
+			timer.Percentiles.Set(pctStruct.sum, sumInThreshold)
+		}
+		if !a.disabledSubtypes.SumSquaresPct {
+			timer.Percentiles.Set(pctStruct.sumSquares, sumSquaresInThreshold)
+		}
+		if pct > 0 {
+			if !a.disabledSubtypes.UpperPct {
+				timer.Percentiles.Set(pctStruct.upper, thresholdBoundary)
+			}
+		} else {
+			if !a.disabledSubtypes.LowerPct {
+				timer.Percentiles.Set(pctStruct.lower, thresholdBoundary)
+			}
+		}
+	}
+
+	mean := sum / weight
+	var sumOfDiffs float64
+	for i, value := range timer.Values {
+		sumOfDiffs += timer.Weights[i] * scale * (value - mean) * (value - mean)
+	}
+
+	// The median is the value with half the weight below it, or the mean of the two values either side of it if it
+	// falls exactly between them.
+	half := weight / 2
+	mid := sort.Search(n, func(i int) bool { return cumulativeWeights[i] >= half-weightEpsilon })
+	if mid < n-1 && cumulativeWeights[mid] <= half+weightEpsilon {
+		timer.Median = (timer.Values[mid] + timer.Values[mid+1]) / 2
+	} else {
+		timer.Median = timer.Values[mid]
+	}
+
+	timer.Mean = mean
+	timer.StdDev = math.Sqrt(sumOfDiffs / weight)
+	timer.Sum = sum
+	timer.SumSquares = sumSquares
+}
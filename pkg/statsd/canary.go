@@ -0,0 +1,60 @@
+package statsd
+
+import (
+	"context"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// Canary dispatches a counter with a known name, value and tags after every flush, through the same pipeline as
+// received metrics.  Downstream, the counter has the configured value for every flush, 0 if it isn't reaching the
+// aggregators, and is missing if the backend isn't receiving flushes.
+type Canary struct {
+	handler  gostatsd.PipelineHandler
+	name     string
+	value    float64
+	tags     gostatsd.Tags
+	hostname string
+	now      func() time.Time // Returns current time. Useful for testing.
+}
+
+// NewCanary creates a new Canary which dispatches to handler.
+func NewCanary(handler gostatsd.PipelineHandler, name string, value float64, tags gostatsd.Tags, hostname string) *Canary {
+	return &Canary{
+		handler:  handler,
+		name:     name,
+		value:    value,
+		tags:     tags,
+		hostname: hostname,
+		now:      time.Now,
+	}
+}
+
+// Run dispatches the canary after every flush until the context is done.
+func (c *Canary) Run(ctx context.Context) {
+	flushed, unregister := stats.FromContext(ctx).RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			c.emit(ctx)
+		}
+	}
+}
+
+func (c *Canary) emit(ctx context.Context) {
+	c.handler.DispatchMetrics(ctx, []*gostatsd.Metric{{
+		Name:      c.name,
+		Value:     c.value,
+		Rate:      1,
+		Tags:      c.tags.Copy(), // Handlers may modify the tags in place
+		Hostname:  c.hostname,
+		Timestamp: gostatsd.Nanotime(c.now().UnixNano()),
+		Type:      gostatsd.COUNTER,
+	}})
+}
@@ -0,0 +1,61 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestCanaryEmit(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+	c := NewCanary(ch, "gostatsd.canary", 2, gostatsd.Tags{"pipeline:main"}, "host1")
+	c.now = func() time.Time { return time.Unix(100, 0) }
+
+	c.emit(context.Background())
+	c.emit(context.Background())
+
+	require.Len(t, ch.m, 2)
+	assert.Equal(t, &gostatsd.Metric{
+		Name:      "gostatsd.canary",
+		Value:     2,
+		Rate:      1,
+		Tags:      gostatsd.Tags{"pipeline:main"},
+		Hostname:  "host1",
+		Timestamp: gostatsd.Nanotime(time.Unix(100, 0).UnixNano()),
+		Type:      gostatsd.COUNTER,
+	}, ch.m[0])
+	// Each metric has its own tags, as handlers may modify them
+	ch.m[0].Tags[0] = "modified"
+	assert.Equal(t, gostatsd.Tags{"pipeline:main"}, ch.m[1].Tags)
+}
+
+func TestCanaryRun(t *testing.T) {
+	t.Parallel()
+	ch := &countingHandler{}
+	c := NewCanary(ch, "gostatsd.canary", 1, nil, "")
+	statser := stats.NewNullStatser()
+	ctx, cancel := context.WithCancel(stats.NewContext(context.Background(), statser))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Run(ctx)
+	}()
+
+	// The canary is dispatched after each flush, once it has registered for them
+	waitUntil(t, func() bool {
+		statser.NotifyFlush(time.Second)
+		ch.mu.Lock()
+		defer ch.mu.Unlock()
+		return len(ch.metrics) > 0
+	})
+	cancel()
+	<-done
+	assert.Equal(t, "gostatsd.canary", ch.metrics[0].Name)
+}
@@ -3,6 +3,9 @@ package statsd
 import (
 	"context"
 	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -10,6 +13,7 @@ import (
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/stats"
 
+	"github.com/ash2k/stager/wait"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -22,8 +26,56 @@ type MetricFlusher struct {
 	lastFlushError int64 // Time of the last flush error. Unix timestamp in nsec.
 
 	flushInterval      time.Duration // How often to flush metrics to the sender
+	alignFlush         bool          // Flush on multiples of flushInterval of the wall clock, rather than from start
 	aggregateProcesser AggregateProcesser
 	backends           []gostatsd.Backend
+	flushSeq           uint64              // Number of flushes performed, only accessed from Run
+	flushSeqTag        string              // Tag key to stamp the flush sequence on all metrics with, empty to disable
+	namespaces         []string            // Namespaces to emit every metric under, empty to emit them unchanged
+	backendNamespaces  map[string][]string // Per backend name overrides of namespaces
+	namespace          string              // Namespace of the server, which namespaceOverrides replace
+	namespaceOverrides map[string]string   // Per backend name namespaces which replace the namespace of the server
+	backendTags        backendTags         // Optional, per backend name tags added to every metric sent
+	backendFilters     backendFilters      // Optional, per backend name filters of the metrics sent
+	router             *backendRouter      // Optional, which backends each metric is sent to
+	counterRates       bool                // Emit each counter as a count and a per second gauge
+	fallback           gostatsd.Backend    // Optional, also sent metrics once every backend has been failing
+	fallbackAfter      int                 // Number of consecutive flushes every backend must fail for to use fallback
+	failedFlushes      int                 // Number of consecutive flushes every backend failed, only accessed from Run
+	backendQueueSize   int                 // Optional, each backend is sent flushes from its own queue of this size
+	queues             []*backendQueue     // One per backend if backendQueueSize is set, created by Run
+	backendOrder       string              // Order backends are sent each flush in, see BackendOrderFixed
+	lag                *backendLag         // Optional, when each backend last delivered a flush
+	status             *backendStatus      // Optional, the result of the most recent sends to each backend
+	rand               *rand.Rand          // Used for BackendOrderRandom, only accessed from Run
+	backendRetries     int                 // Optional, how many times a failed send to a backend is retried
+	flushRequests      chan chan struct{}  // Flushes requested outside of the interval, closed once flushed
+}
+
+// failedBackends records which backends failed during a flush.
+type failedBackends struct {
+	mu    sync.Mutex
+	names map[string]struct{}
+}
+
+func (fb *failedBackends) add(name string) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	fb.names[name] = struct{}{}
+}
+
+// backendSendTimes records the longest time each backend took to send a MetricMap during a flush.
+type backendSendTimes struct {
+	mu    sync.Mutex
+	times map[string]time.Duration
+}
+
+func (bst *backendSendTimes) add(name string, d time.Duration) {
+	bst.mu.Lock()
+	defer bst.mu.Unlock()
+	if d > bst.times[name] {
+		bst.times[name] = d
+	}
 }
 
 // NewMetricFlusher creates a new MetricFlusher with provided configuration.
@@ -32,6 +84,7 @@ func NewMetricFlusher(flushInterval time.Duration, aggregateProcesser AggregateP
 		flushInterval:      flushInterval,
 		aggregateProcesser: aggregateProcesser,
 		backends:           backends,
+		flushRequests:      make(chan chan struct{}),
 	}
 }
 
@@ -39,27 +92,107 @@ func NewMetricFlusher(flushInterval time.Duration, aggregateProcesser AggregateP
 func (f *MetricFlusher) Run(ctx context.Context) {
 	statser := stats.FromContext(ctx)
 
-	flushTicker := time.NewTicker(f.flushInterval)
-	defer flushTicker.Stop()
+	if f.backendQueueSize > 0 && f.aggregateProcesser != AggregateProcesser(nil) {
+		var wg wait.Group
+		defer wg.Wait()
+		f.queues = f.newBackendQueues()
+		for _, q := range f.queues {
+			q := q
+			csw := stats.NewChannelStatsWatcher(
+				statser,
+				"backend_queue",
+				gostatsd.Tags{"backend:" + q.backend.Name()},
+				cap(q.queue),
+				func() int { return len(q.queue) },
+				time.Second,
+			)
+			wg.StartWithContext(ctx, csw.Run)
+			wg.StartWithContext(ctx, q.run)
+		}
+	}
+
+	var flushC <-chan time.Time
+	var alignTimer *time.Timer
+	if f.alignFlush {
+		alignTimer = time.NewTimer(time.Until(nextAlignedFlush(time.Now(), f.flushInterval, 0)))
+		defer alignTimer.Stop()
+		flushC = alignTimer.C
+	} else {
+		flushTicker := time.NewTicker(f.flushInterval)
+		defer flushTicker.Stop()
+		flushC = flushTicker.C
+	}
 
+	// The first window is only until the first flush, so when flushes are aligned its rates are calculated over the
+	// partial window rather than a whole interval.
 	lastFlush := time.Now()
+	flush := func(thisFlush time.Time) {
+		flushDelta := thisFlush.Sub(lastFlush)
+		if f.aggregateProcesser != AggregateProcesser(nil) {
+			f.flushData(ctx, flushDelta, statser)
+		}
+		statser.NotifyFlush(flushDelta)
+		lastFlush = thisFlush
+	}
 	for {
 		select {
 		case <-ctx.Done():
 			return
-		case thisFlush := <-flushTicker.C: // Time to flush to the backends
-			flushDelta := thisFlush.Sub(lastFlush)
-			if f.aggregateProcesser != AggregateProcesser(nil) {
-				f.flushData(ctx, flushDelta, statser)
+		case thisFlush := <-flushC: // Time to flush to the backends
+			flush(thisFlush)
+			if alignTimer != nil {
+				// Aligning every flush corrects for drift of the timer and changes to the wall clock.  The next
+				// boundary is at least half an interval away, so a timer which fires just early doesn't flush twice.
+				alignTimer.Reset(time.Until(nextAlignedFlush(time.Now(), f.flushInterval, f.flushInterval/2)))
 			}
-			statser.NotifyFlush(flushDelta)
-			lastFlush = thisFlush
+		case flushed := <-f.flushRequests:
+			flush(time.Now())
+			close(flushed)
 		}
 	}
 }
 
+// nextAlignedFlush returns the first multiple of interval of the wall clock which is at least minDelay after now.
+func nextAlignedFlush(now time.Time, interval, minDelay time.Duration) time.Time {
+	next := now.Truncate(interval).Add(interval)
+	for next.Sub(now) < minDelay {
+		next = next.Add(interval)
+	}
+	return next
+}
+
+// Flush flushes the metrics from all Aggregators to the backends immediately, rather than waiting for the flush
+// interval, and waits for the backends to finish sending them.  If backends are sent flushes from queues, it only
+// waits for the flush to be queued.  Returns the error of ctx if it is done first.
+func (f *MetricFlusher) Flush(ctx context.Context) error {
+	flushed := make(chan struct{})
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case f.flushRequests <- flushed:
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-flushed:
+		return nil
+	}
+}
+
 func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Duration, statser stats.Statser) {
+	flushed := time.Now()
 	var sendWg sync.WaitGroup
+	f.flushSeq++
+	var seqTags gostatsd.Tags
+	if f.flushSeqTag != "" {
+		seqTags = gostatsd.Tags{f.flushSeqTag + ":" + strconv.FormatUint(f.flushSeq, 10)}
+	}
+	useFallback := f.fallback != nil && f.failedFlushes >= f.fallbackAfter
+	failed := &failedBackends{names: map[string]struct{}{}}
+	sendTimes := &backendSendTimes{times: map[string]time.Duration{}}
+	backends := f.orderedBackends()
+	var queuedMu sync.Mutex
+	var queued []*gostatsd.MetricMap
 	timerTotal := statser.NewTimer("flusher.total_time", nil)
 	processWait := f.aggregateProcesser.Process(ctx, func(workerId int, aggr Aggregator) {
 		// This is in the flusher, but it's an aggregator action, so put it in that space.
@@ -71,7 +204,28 @@ func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Durati
 
 		timerProcess := statser.NewTimer("aggregator.process_time", tags)
 		aggr.Process(func(m *gostatsd.MetricMap) {
-			f.sendMetricsAsync(ctx, &sendWg, m)
+			if f.queues != nil || f.backendRetries > 0 {
+				// The aggregator is reset once this returns, so queued flushes and retries must not share anything
+				// with it.
+				m = m.Copy()
+			}
+			if f.counterRates {
+				m = m.WithCounterRates()
+			}
+			if seqTags != nil {
+				// Tag a copy, so the tags don't accumulate in the aggregator across flushes.
+				m = m.WithTags(seqTags)
+			}
+			if f.queues != nil {
+				queuedMu.Lock()
+				queued = append(queued, m)
+				queuedMu.Unlock()
+			} else {
+				f.sendMetricsAsync(ctx, &sendWg, backends, m, failed, sendTimes)
+			}
+			if useFallback {
+				f.sendFallbackAsync(ctx, &sendWg, m)
+			}
 		})
 		timerProcess.SendGauge()
 
@@ -80,21 +234,261 @@ func (f *MetricFlusher) flushData(ctx context.Context, flushInterval time.Durati
 		timerReset.SendGauge()
 	})
 	processWait() // Wait for all workers to execute function
-	sendWg.Wait() // Wait for all backends to finish sending
+	if f.queues != nil {
+		f.enqueue(queued, flushed)
+	}
+	sendWg.Wait() // Wait for all backends to finish sending, or only the fallback if they are queued
 	timerTotal.SendGauge()
+	// flusher.backend_send_time is the longest time a MetricMap of this flush took to send to the backend, or for
+	// queued backends, of the most recent flush they sent.
+	for name, d := range sendTimes.times {
+		statser.Gauge("flusher.backend_send_time", durationToMs(d), gostatsd.Tags{"backend:" + name})
+	}
+	for _, q := range f.queues {
+		tags := gostatsd.Tags{"backend:" + q.backend.Name()}
+		statser.Gauge("flusher.backend_queue_dropped", float64(atomic.LoadUint64(&q.dropped)), tags)
+		if d := time.Duration(atomic.LoadInt64(&q.sendTime)); d > 0 {
+			statser.Gauge("flusher.backend_send_time", durationToMs(d), tags)
+		}
+	}
+	if f.lag != nil {
+		if f.queues == nil {
+			for _, backend := range f.backends {
+				if _, ok := failed.names[backend.Name()]; !ok {
+					f.lag.deliver(backend.Name(), flushed)
+				}
+			}
+		}
+		f.lag.emit(statser, time.Now())
+	}
+	if f.fallback != nil {
+		f.updateFallback(f.allBackendsFailed(failed))
+		statser.Gauge("flusher.fallback_active", boolToFloat(f.failedFlushes >= f.fallbackAfter), nil)
+	}
+}
+
+// updateFallback counts the consecutive flushes in which every backend failed, and logs when the fallback starts
+// and stops being used.
+func (f *MetricFlusher) updateFallback(allFailed bool) {
+	wasActive := f.failedFlushes >= f.fallbackAfter
+	if allFailed {
+		f.failedFlushes++
+	} else {
+		f.failedFlushes = 0
+	}
+	active := f.failedFlushes >= f.fallbackAfter
+	if active && !wasActive {
+		log.WithField("flushes", f.failedFlushes).Warnf("Every backend has failed, also sending metrics to %s", f.fallback.Name())
+	} else if !active && wasActive {
+		log.Infof("A backend has recovered, no longer sending metrics to %s", f.fallback.Name())
+	}
+}
+
+func durationToMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// sendFallbackAsync sends the metrics to the fallback backend.  Its result doesn't affect whether the backends are
+// considered to be failing.
+func (f *MetricFlusher) sendFallbackAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
+	if len(f.namespaces) > 0 {
+		m = m.WithNamespaces(f.namespaces)
+	}
+	wg.Add(1)
+	f.fallback.SendMetricsAsync(ctx, m, func(errs []error) {
+		defer wg.Done()
+		f.handleSendResult(errs)
+	})
 }
 
-func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, m *gostatsd.MetricMap) {
-	wg.Add(len(f.backends))
+func (f *MetricFlusher) newBackendQueues() []*backendQueue {
+	queues := make([]*backendQueue, 0, len(f.backends))
 	for _, backend := range f.backends {
-		backend.SendMetricsAsync(ctx, m, func(errs []error) {
+		queues = append(queues, newBackendQueue(backend, f.backendQueueSize, f.sendWithRetries, f.handleSendResult, f.lag))
+	}
+	return queues
+}
+
+// enqueue adds the MetricMaps of a flush to the queue of every backend.
+func (f *MetricFlusher) enqueue(maps []*gostatsd.MetricMap, flushed time.Time) {
+	prepared := make([]*backendMaps, 0, len(maps))
+	for _, m := range maps {
+		prepared = append(prepared, f.newBackendMaps(m))
+	}
+	for _, q := range f.queues {
+		queueMaps := make([]*gostatsd.MetricMap, 0, len(maps))
+		for _, bm := range prepared {
+			queueMaps = append(queueMaps, bm.forBackend(q.backend))
+		}
+		q.enqueue(queueMaps, flushed)
+	}
+}
+
+// allBackendsFailed returns true if every backend failed during this flush, or for queued backends, during the most
+// recent flush they sent.
+func (f *MetricFlusher) allBackendsFailed(failed *failedBackends) bool {
+	if len(f.backends) == 0 {
+		return false
+	}
+	if f.queues == nil {
+		return len(failed.names) == len(f.backends)
+	}
+	for _, q := range f.queues {
+		if atomic.LoadUint32(&q.failing) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// orderedBackends returns the backends in the order they are sent this flush.  This is the configured order for
+// BackendOrderFixed, otherwise it changes every flush, so no backend is always sent first when they compete for
+// network egress.
+func (f *MetricFlusher) orderedBackends() []gostatsd.Backend {
+	if len(f.backends) < 2 {
+		return f.backends
+	}
+	switch f.backendOrder {
+	case BackendOrderRandom:
+		if f.rand == nil {
+			f.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+		}
+		backends := make([]gostatsd.Backend, len(f.backends))
+		for i, j := range f.rand.Perm(len(f.backends)) {
+			backends[i] = f.backends[j]
+		}
+		return backends
+	case BackendOrderRoundRobin:
+		first := int(f.flushSeq % uint64(len(f.backends)))
+		backends := make([]gostatsd.Backend, 0, len(f.backends))
+		return append(append(backends, f.backends[first:]...), f.backends[:first]...)
+	}
+	return f.backends
+}
+
+func (f *MetricFlusher) sendMetricsAsync(ctx context.Context, wg *sync.WaitGroup, backends []gostatsd.Backend, m *gostatsd.MetricMap, failed *failedBackends, sendTimes *backendSendTimes) {
+	wg.Add(len(backends))
+	bm := f.newBackendMaps(m)
+	for _, backend := range backends {
+		mm := bm.forBackend(backend)
+		name := backend.Name()
+		start := time.Now()
+		f.sendWithRetries(ctx, backend, mm, func(errs []error) {
 			defer wg.Done()
-			f.handleSendResult(errs)
+			sendTimes.add(name, time.Since(start))
+			if f.handleSendResult(errs) {
+				failed.add(name)
+			}
 		})
 	}
 }
 
-func (f *MetricFlusher) handleSendResult(flushResults []error) {
+// backendTags are the tags added to the metrics sent to each backend which has them, keyed by name.
+type backendTags map[string]gostatsd.Tags
+
+// backendMaps prepares the MetricMap sent to each backend from the MetricMap of an aggregator, by routing it,
+// filtering it, replacing its namespace, emitting it under the namespaces of the backend and adding its tags.
+// Backends with the same routes, filter, namespaces and tags share a MetricMap.
+type backendMaps struct {
+	f          *MetricFlusher
+	m          *gostatsd.MetricMap
+	routed     map[string]*gostatsd.MetricMap // MetricMap routed to each backend, nil if there are no routes
+	filtered   map[filteredKey]*gostatsd.MetricMap
+	namespaced map[namespacedKey]*gostatsd.MetricMap
+}
+
+type filteredKey struct {
+	m      *gostatsd.MetricMap
+	filter *BackendFilter
+}
+
+type namespacedKey struct {
+	m                *gostatsd.MetricMap
+	namespace        string
+	replaceNamespace bool
+	namespaces       string
+	tags             string
+}
+
+func (f *MetricFlusher) newBackendMaps(m *gostatsd.MetricMap) *backendMaps {
+	bm := &backendMaps{
+		f:          f,
+		m:          m,
+		filtered:   map[filteredKey]*gostatsd.MetricMap{},
+		namespaced: map[namespacedKey]*gostatsd.MetricMap{},
+	}
+	if f.router != nil {
+		bm.routed = f.router.route(m)
+	}
+	return bm
+}
+
+// forBackend returns the MetricMap to send backend.
+func (bm *backendMaps) forBackend(backend gostatsd.Backend) *gostatsd.MetricMap {
+	mm := bm.m
+	if bm.routed != nil {
+		var ok bool
+		if mm, ok = bm.routed[backend.Name()]; !ok {
+			return gostatsd.NewMetricMap()
+		}
+	}
+	if filter := bm.f.backendFilters[backend.Name()]; filter != nil {
+		key := filteredKey{m: mm, filter: filter}
+		filtered, ok := bm.filtered[key]
+		if !ok {
+			filtered = filter.filter(mm)
+			bm.filtered[key] = filtered
+		}
+		mm = filtered
+	}
+	namespace, replaceNamespace := bm.f.namespaceOverrides[backend.Name()]
+	namespaces := bm.f.namespacesFor(backend)
+	tags := bm.f.backendTags[backend.Name()]
+	if !replaceNamespace && len(namespaces) == 0 && len(tags) == 0 {
+		return mm
+	}
+	key := namespacedKey{
+		m:                mm,
+		namespace:        namespace,
+		replaceNamespace: replaceNamespace,
+		namespaces:       strings.Join(namespaces, " "),
+		tags:             strings.Join(tags, ","),
+	}
+	namespaced, ok := bm.namespaced[key]
+	if !ok {
+		// Each step returns a copy, so the MetricMap shared with other backends is never modified.
+		namespaced = mm
+		if replaceNamespace {
+			namespaced = namespaced.WithNamespaceReplaced(bm.f.namespace, namespace)
+		}
+		if len(namespaces) > 0 {
+			namespaced = namespaced.WithNamespaces(namespaces)
+		}
+		if len(tags) > 0 {
+			namespaced = namespaced.WithTags(tags)
+		}
+		bm.namespaced[key] = namespaced
+	}
+	return namespaced
+}
+
+// namespacesFor returns the namespaces to emit metrics to backend under.
+func (f *MetricFlusher) namespacesFor(backend gostatsd.Backend) []string {
+	if namespaces, ok := f.backendNamespaces[backend.Name()]; ok {
+		return namespaces
+	}
+	return f.namespaces
+}
+
+// handleSendResult records the time of the last successful or failed flush, and returns true if it failed.
+func (f *MetricFlusher) handleSendResult(flushResults []error) bool {
 	timestampPointer := &f.lastFlush
 	for _, err := range flushResults {
 		if err != nil {
@@ -105,4 +499,5 @@ func (f *MetricFlusher) handleSendResult(flushResults []error) {
 		}
 	}
 	atomic.StoreInt64(timestampPointer, time.Now().UnixNano())
+	return timestampPointer == &f.lastFlushError
 }
@@ -0,0 +1,43 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+)
+
+// BackendFilter limits the metrics and events sent to a backend by name.  A metric or event is sent if its name
+// matches Include, or Include is empty, and doesn't match Exclude.  Events are matched by their title.
+type BackendFilter struct {
+	Include gostatsd.StringMatchList
+	Exclude gostatsd.StringMatchList
+}
+
+// backendFilters are the BackendFilter of each backend which has one, keyed by name.
+type backendFilters map[string]*BackendFilter
+
+// NewBackendFilter creates a BackendFilter from the include and exclude settings of a backend.  Returns nil if
+// neither is set, so the backend receives everything.
+func NewBackendFilter(include, exclude []string) *BackendFilter {
+	if len(include) == 0 && len(exclude) == 0 {
+		return nil
+	}
+	return &BackendFilter{
+		Include: toStringMatch(include),
+		Exclude: toStringMatch(exclude),
+	}
+}
+
+func (bf *BackendFilter) match(name string) bool {
+	return (len(bf.Include) == 0 || bf.Include.MatchAny(name)) && !bf.Exclude.MatchAny(name)
+}
+
+func (bf *BackendFilter) matchMetric(metricName, _ string, _ gostatsd.Tags) int {
+	if bf.match(metricName) {
+		return 0
+	}
+	return 1
+}
+
+// filter returns a MetricMap with only the metrics of m which match the filter.
+func (bf *BackendFilter) filter(m *gostatsd.MetricMap) *gostatsd.MetricMap {
+	return m.SplitFunc(2, bf.matchMetric)[0]
+}
@@ -0,0 +1,113 @@
+package statsd
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestFlusherBackendFilters(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	graphite := &namedCapturingBackend{name: "graphite"}
+	saas := &namedCapturingBackend{name: "saas"}
+	all := &namedCapturingBackend{name: "all"}
+	backends := []gostatsd.Backend{graphite, saas, all}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, backends)
+	fl.backendFilters = backendFilters{
+		"graphite": NewBackendFilter(nil, []string{"billing.*"}),
+		"saas":     NewBackendFilter([]string{"billing.*"}, []string{"billing.debug"}),
+	}
+	fl.namespaces = []string{"ns"}
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	aggr.Receive(
+		&gostatsd.Metric{Name: "billing.invoices", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now},
+		&gostatsd.Metric{Name: "billing.debug", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Timestamp: now},
+		&gostatsd.Metric{Name: "billing.latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: now},
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now},
+		&gostatsd.Metric{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: now},
+	)
+	fl.flushData(context.Background(), time.Second, stats.NewNullStatser())
+
+	// Filters match the names before namespaces are applied.
+	require.Len(t, graphite.mm, 1)
+	assert.Len(t, graphite.mm[0].Counters, 1)
+	assert.Contains(t, graphite.mm[0].Counters, "ns.requests")
+	assert.Empty(t, graphite.mm[0].Gauges)
+	assert.Len(t, graphite.mm[0].Timers, 1)
+	assert.Contains(t, graphite.mm[0].Timers, "ns.latency")
+
+	require.Len(t, saas.mm, 1)
+	assert.Len(t, saas.mm[0].Counters, 1)
+	assert.Contains(t, saas.mm[0].Counters, "ns.billing.invoices")
+	assert.Empty(t, saas.mm[0].Gauges)
+	assert.Len(t, saas.mm[0].Timers, 1)
+	assert.Contains(t, saas.mm[0].Timers, "ns.billing.latency")
+
+	// The two filtered backends receive disjoint sets.
+	for name := range graphite.mm[0].Counters {
+		assert.NotContains(t, saas.mm[0].Counters, name)
+	}
+	for name := range graphite.mm[0].Timers {
+		assert.NotContains(t, saas.mm[0].Timers, name)
+	}
+
+	// A backend without a filter receives everything.
+	require.Len(t, all.mm, 1)
+	assert.Len(t, all.mm[0].Counters, 2)
+	assert.Len(t, all.mm[0].Gauges, 1)
+	assert.Len(t, all.mm[0].Timers, 2)
+}
+
+type namedEventCapturingBackend struct {
+	eventCapturingBackend
+	name string
+}
+
+func (neb *namedEventCapturingBackend) Name() string {
+	return neb.name
+}
+
+func TestDispatchEventBackendFilters(t *testing.T) {
+	t.Parallel()
+	graphite := &namedEventCapturingBackend{name: "graphite"}
+	saas := &namedEventCapturingBackend{name: "saas"}
+	all := &namedEventCapturingBackend{name: "all"}
+	h := NewBackendHandler([]gostatsd.Backend{graphite, saas, all}, 10, 1, 1, newTestFactory())
+	h.backendFilters = backendFilters{
+		"graphite": NewBackendFilter(nil, []string{"deploy.*"}),
+		"saas":     NewBackendFilter([]string{"deploy.*"}, nil),
+	}
+
+	h.DispatchEvent(context.Background(), &gostatsd.Event{Title: "deploy.web"})
+	h.DispatchEvent(context.Background(), &gostatsd.Event{Title: "restart"})
+	h.WaitForEvents()
+
+	require.Len(t, graphite.events, 1)
+	assert.Equal(t, "restart", graphite.events[0].Title)
+	require.Len(t, saas.events, 1)
+	assert.Equal(t, "deploy.web", saas.events[0].Title)
+	assert.Len(t, all.events, 2)
+}
+
+func TestNewBackendFilter(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, NewBackendFilter(nil, nil))
+
+	filter := NewBackendFilter([]string{"api.*", "regex:^db\\."}, []string{"api.debug*"})
+	assert.True(t, filter.match("api.requests"))
+	assert.True(t, filter.match("db.queries"))
+	assert.False(t, filter.match("api.debug.requests"))
+	assert.False(t, filter.match("web.requests"))
+
+	filter = NewBackendFilter(nil, []string{"api.*"})
+	assert.True(t, filter.match("web.requests"))
+	assert.False(t, filter.match("api.requests"))
+}
@@ -0,0 +1,48 @@
+package statsd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// backendLag records when the most recent flush each backend successfully delivered was taken, so how far each
+// backend is behind the wall clock can be reported.  A flush is delivered when every MetricMap in it was sent
+// without error.
+type backendLag struct {
+	mu        sync.Mutex
+	delivered map[string]time.Time // Keyed by backend name
+}
+
+// newBackendLag creates a backendLag for the backends, treating them as having delivered a flush taken at start, so
+// a backend which never delivers anything is reported as falling behind from then.
+func newBackendLag(backends []gostatsd.Backend, start time.Time) *backendLag {
+	bl := &backendLag{
+		delivered: make(map[string]time.Time, len(backends)),
+	}
+	for _, backend := range backends {
+		bl.delivered[backend.Name()] = start
+	}
+	return bl
+}
+
+// deliver records that backend delivered the flush taken at flushed.  Flushes delivered out of order don't move the
+// time backwards.
+func (bl *backendLag) deliver(name string, flushed time.Time) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	if flushed.After(bl.delivered[name]) {
+		bl.delivered[name] = flushed
+	}
+}
+
+// emit reports the seconds between the most recent flush each backend delivered being taken and now.
+func (bl *backendLag) emit(statser stats.Statser, now time.Time) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	for name, flushed := range bl.delivered {
+		statser.Gauge("flusher.backend_lag", now.Sub(flushed).Seconds(), gostatsd.Tags{"backend:" + name})
+	}
+}
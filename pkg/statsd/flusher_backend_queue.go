@@ -0,0 +1,91 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// backendQueue sends flushes to a single backend from its own queue, so a backend which is slow or retrying only
+// delays itself.  Flushes are sent in order, each one after the previous has finished.  When the queue is full the
+// oldest flush is dropped, so a backend which recovers catches up with the most recent data.
+type backendQueue struct {
+	dropped  uint64 // Number of flushes dropped because the queue was full, must be accessed atomically
+	sendTime int64  // Nanoseconds the most recently sent flush took to send, must be accessed atomically
+	failing  uint32 // 1 if the most recently sent flush failed, must be accessed atomically
+
+	backend          gostatsd.Backend
+	queue            chan queuedFlush
+	sendMetrics      func(context.Context, gostatsd.Backend, *gostatsd.MetricMap, gostatsd.SendCallback)
+	handleSendResult func([]error) bool
+	lag              *backendLag // Optional, records when the backend last delivered a flush
+}
+
+// queuedFlush is the MetricMaps of a flush, and when the flush was taken.
+type queuedFlush struct {
+	maps    []*gostatsd.MetricMap
+	flushed time.Time
+}
+
+func newBackendQueue(backend gostatsd.Backend, size int, sendMetrics func(context.Context, gostatsd.Backend, *gostatsd.MetricMap, gostatsd.SendCallback), handleSendResult func([]error) bool, lag *backendLag) *backendQueue {
+	return &backendQueue{
+		backend:          backend,
+		queue:            make(chan queuedFlush, size),
+		sendMetrics:      sendMetrics,
+		handleSendResult: handleSendResult,
+		lag:              lag,
+	}
+}
+
+// enqueue adds the MetricMaps of a flush to the queue without blocking, dropping the oldest flush if it is full.  The
+// MetricMaps must not be modified afterwards.
+func (q *backendQueue) enqueue(maps []*gostatsd.MetricMap, flushed time.Time) {
+	for {
+		select {
+		case q.queue <- queuedFlush{maps: maps, flushed: flushed}:
+			return
+		default:
+		}
+		select {
+		case <-q.queue:
+			atomic.AddUint64(&q.dropped, 1)
+		default:
+		}
+	}
+}
+
+// run sends each queued flush to the backend until the Context is closed.
+func (q *backendQueue) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case flush := <-q.queue:
+			q.send(ctx, flush)
+		}
+	}
+}
+
+func (q *backendQueue) send(ctx context.Context, flush queuedFlush) {
+	var wg sync.WaitGroup
+	var failed uint32
+	start := time.Now()
+	wg.Add(len(flush.maps))
+	for _, mm := range flush.maps {
+		q.sendMetrics(ctx, q.backend, mm, func(errs []error) {
+			defer wg.Done()
+			if q.handleSendResult(errs) {
+				atomic.StoreUint32(&failed, 1)
+			}
+		})
+	}
+	wg.Wait()
+	atomic.StoreInt64(&q.sendTime, int64(time.Since(start)))
+	atomic.StoreUint32(&q.failing, atomic.LoadUint32(&failed))
+	if q.lag != nil && failed == 0 {
+		q.lag.deliver(q.backend.Name(), flush.flushed)
+	}
+}
@@ -0,0 +1,89 @@
+package statsd
+
+import (
+	"context"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/cenkalti/backoff"
+	log "github.com/sirupsen/logrus"
+)
+
+// sendWithRetries sends mm to backend, calling cb with the result.  If backendRetries is set, and every part of the
+// send failed with a retryable error, it is sent again up to backendRetries times, with exponential backoff and
+// jitter.  A send where any part succeeded is not retried, as every part would be sent again.  Retries are only
+// started within the flush interval of the first attempt, and are cancelled at the end of it, so the retries of one
+// flush never overlap the next.  A backend which keeps state across flushes is never retried, as the retry would
+// update the state again.  The final result is recorded in the backend status, if it is tracked.  Retries read mm
+// after sendWithRetries returns, so it must not be shared with an aggregator when backendRetries is set.
+func (f *MetricFlusher) sendWithRetries(ctx context.Context, backend gostatsd.Backend, mm *gostatsd.MetricMap, cb gostatsd.SendCallback) {
+	if f.status != nil {
+		sent := cb
+		cb = func(errs []error) {
+			f.status.record(backend.Name(), errs, time.Now())
+			sent(errs)
+		}
+	}
+	if f.backendRetries <= 0 || keepsFlushState(backend) {
+		backend.SendMetricsAsync(ctx, mm, cb)
+		return
+	}
+
+	deadline := time.Now().Add(f.flushInterval)
+	retryCtx, cancel := context.WithDeadline(ctx, deadline)
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = f.flushInterval / 20
+	b.MaxElapsedTime = f.flushInterval
+	b.Reset()
+	statser := stats.FromContext(ctx)
+	tags := gostatsd.Tags{"backend:" + backend.Name()}
+
+	var attempt func(sendCtx context.Context, retries int)
+	attempt = func(sendCtx context.Context, retries int) {
+		backend.SendMetricsAsync(sendCtx, mm, func(errs []error) {
+			next := backoff.Stop
+			if retries < f.backendRetries && allRetryable(errs) {
+				next = b.NextBackOff()
+			}
+			if next == backoff.Stop || time.Now().Add(next).After(deadline) {
+				cancel()
+				cb(errs)
+				return
+			}
+			statser.Increment("backend.retry", tags)
+			log.WithField("backend", backend.Name()).Warnf("Sending metrics failed, retrying in %s: %v", next, errs[0])
+			go func() {
+				timer := time.NewTimer(next)
+				select {
+				case <-retryCtx.Done():
+					timer.Stop()
+					cancel()
+					cb(errs)
+				case <-timer.C:
+					attempt(retryCtx, retries+1)
+				}
+			}()
+		})
+	}
+	attempt(ctx, 0)
+}
+
+// keepsFlushState returns true if backend keeps state across flushes, so sending it a flush again would count the
+// flush twice.
+func keepsFlushState(backend gostatsd.Backend) bool {
+	k, ok := backend.(gostatsd.FlushStateKeeper)
+	return ok && k.KeepsFlushState()
+}
+
+// allRetryable returns true if there is at least one error, and every error is retryable.
+func allRetryable(errs []error) bool {
+	for _, err := range errs {
+		if err == nil || !util.IsRetryable(err) {
+			return false
+		}
+	}
+	return len(errs) > 0
+}
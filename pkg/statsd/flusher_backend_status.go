@@ -0,0 +1,111 @@
+package statsd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// backendStatus records the result of the most recent sends to each backend, so it can be reported by the admin
+// server.
+type backendStatus struct {
+	mu       sync.Mutex
+	start    time.Time                      // When the backends started being sent metrics
+	backends map[string]*backendFlushStatus // Keyed by backend name
+}
+
+// backendFlushStatus is the result of the most recent sends to a backend.  The times are nil if there has not been
+// a send with that result yet.
+type backendFlushStatus struct {
+	Name        string     `json:"name"`
+	LastSuccess *time.Time `json:"last_success"`
+	LastError   *time.Time `json:"last_error"`
+	Error       string     `json:"error,omitempty"` // The error of the most recent failed send
+	Sends       uint64     `json:"sends"`
+	Failures    uint64     `json:"failures"`
+}
+
+// unhealthyBackend is a backend which hasn't had a successful send recently enough.
+type unhealthyBackend struct {
+	Name        string     `json:"name"`
+	LastSuccess *time.Time `json:"last_success"`    // Nil if there has never been a successful send
+	Error       string     `json:"error,omitempty"` // The error of the most recent failed send
+}
+
+func newBackendStatus(backends []gostatsd.Backend, start time.Time) *backendStatus {
+	bs := &backendStatus{
+		start:    start,
+		backends: make(map[string]*backendFlushStatus, len(backends)),
+	}
+	for _, backend := range backends {
+		bs.backends[backend.Name()] = &backendFlushStatus{Name: backend.Name()}
+	}
+	return bs
+}
+
+// record records the result of a send to the backend name at now.
+func (bs *backendStatus) record(name string, errs []error, now time.Time) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	status, ok := bs.backends[name]
+	if !ok {
+		status = &backendFlushStatus{Name: name}
+		bs.backends[name] = status
+	}
+	status.Sends++
+	for _, err := range errs {
+		if err != nil {
+			status.Failures++
+			status.LastError = &now
+			status.Error = err.Error()
+			return
+		}
+	}
+	status.LastSuccess = &now
+}
+
+// snapshot returns a copy of the status of every backend, ordered by name.
+func (bs *backendStatus) snapshot() []backendFlushStatus {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	statuses := make([]backendFlushStatus, 0, len(bs.backends))
+	for _, status := range bs.backends {
+		statuses = append(statuses, *status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// unhealthy returns the backends which haven't had a successful send within maxAge of now, ordered by name, or nil if
+// every backend is healthy.  A backend which has never had a successful send is healthy until maxAge plus
+// flushInterval after start, as the first flush is only taken a flush interval after start (or later, if flushes are
+// aligned), and its send takes time to complete.  It doesn't allocate unless a backend is unhealthy.
+func (bs *backendStatus) unhealthy(now time.Time, maxAge, flushInterval time.Duration) []unhealthyBackend {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	var unhealthy []unhealthyBackend
+	for _, status := range bs.backends {
+		if status.LastSuccess != nil {
+			if now.Sub(*status.LastSuccess) <= maxAge {
+				continue
+			}
+		} else if now.Sub(bs.start) <= maxAge+flushInterval {
+			continue
+		}
+		unhealthy = append(unhealthy, unhealthyBackend{
+			Name:        status.Name,
+			LastSuccess: status.LastSuccess,
+			Error:       status.Error,
+		})
+	}
+	if len(unhealthy) > 1 {
+		sort.Slice(unhealthy, func(i, j int) bool {
+			return unhealthy[i].Name < unhealthy[j].Name
+		})
+	}
+	return unhealthy
+}
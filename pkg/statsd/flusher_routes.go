@@ -0,0 +1,164 @@
+package statsd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Route sends the metrics which match it only to Backends, rather than to every backend.
+type Route struct {
+	Name         string
+	MatchMetrics gostatsd.StringMatchList // Name must match
+	MatchTags    gostatsd.StringMatchList // Any tag must match, if set
+	Backends     []string                 // Names of the backends the metrics are sent to
+}
+
+// NewRouteFromViper creates a new Route given a *viper.Viper
+func NewRouteFromViper(name string, v *viper.Viper) (*Route, error) {
+	v.SetDefault("match-metrics", []string{})
+	v.SetDefault("match-tags", []string{})
+	v.SetDefault("backends", []string{})
+
+	route := &Route{
+		Name:         name,
+		MatchMetrics: toStringMatch(v.GetStringSlice("match-metrics")),
+		MatchTags:    toStringMatch(v.GetStringSlice("match-tags")),
+		Backends:     v.GetStringSlice("backends"),
+	}
+	if len(route.MatchMetrics) == 0 {
+		return nil, fmt.Errorf("match-metrics must be set")
+	}
+	if len(route.Backends) == 0 {
+		return nil, fmt.Errorf("backends must be set")
+	}
+	return route, nil
+}
+
+// NewRoutesFromViper loads the routes named in routes, in the order they are named.
+func NewRoutesFromViper(v *viper.Viper) ([]*Route, error) {
+	var routes []*Route
+	for _, routeName := range v.GetStringSlice(ParamRoutes) {
+		vRoute := v.Sub("route." + routeName)
+		if vRoute == nil {
+			log.Warnf("Route doesn't exist: %v", routeName)
+			continue
+		}
+		route, err := NewRouteFromViper(routeName, vRoute)
+		if err != nil {
+			return nil, fmt.Errorf("route %v: %v", routeName, err)
+		}
+		routes = append(routes, route)
+		log.Infof("Loaded route %v", routeName)
+	}
+	return routes, nil
+}
+
+func (r *Route) match(metricName string, tags gostatsd.Tags) bool {
+	return r.MatchMetrics.MatchAny(metricName) && (len(r.MatchTags) == 0 || r.MatchTags.MatchAnyMultiple(tags))
+}
+
+// backendRouter decides which backends each metric is sent to.  A metric is sent to the backends of the first route
+// it matches, or to the default backends if it matches none.
+type backendRouter struct {
+	routes []*Route
+	// Indexes of the routes each backend is sent, where len(routes) is the default route.  Joined in to a string,
+	// backends with the same routes share a MetricMap.
+	backendRoutes map[string][]int
+	routesKeys    map[string]string
+}
+
+// newBackendRouter creates a backendRouter for the backends, the metrics which match no route are sent to
+// defaultBackends, or every backend if it is empty.  Returns nil if there are no routes.
+func newBackendRouter(routes []*Route, defaultBackends []string, backends []gostatsd.Backend) *backendRouter {
+	if len(routes) == 0 {
+		return nil
+	}
+	names := make(map[string]bool, len(backends))
+	for _, backend := range backends {
+		names[backend.Name()] = true
+	}
+	r := &backendRouter{
+		routes:        routes,
+		backendRoutes: make(map[string][]int, len(backends)),
+		routesKeys:    make(map[string]string, len(backends)),
+	}
+	for idx, route := range routes {
+		for _, name := range route.Backends {
+			if !names[name] {
+				log.Warnf("Route %v sends metrics to backend %v which isn't running", route.Name, name)
+				continue
+			}
+			r.addRoute(name, idx)
+		}
+	}
+	if len(defaultBackends) == 0 {
+		defaultBackends = make([]string, 0, len(backends))
+		for _, backend := range backends {
+			defaultBackends = append(defaultBackends, backend.Name())
+		}
+	}
+	for _, name := range defaultBackends {
+		if !names[name] {
+			log.Warnf("Metrics which match no route are sent to backend %v which isn't running", name)
+			continue
+		}
+		r.addRoute(name, len(routes))
+	}
+	for name, idxs := range r.backendRoutes {
+		keys := make([]string, 0, len(idxs))
+		for _, idx := range idxs {
+			keys = append(keys, strconv.Itoa(idx))
+		}
+		r.routesKeys[name] = strings.Join(keys, " ")
+	}
+	return r
+}
+
+func (r *backendRouter) addRoute(name string, idx int) {
+	idxs := r.backendRoutes[name]
+	if n := len(idxs); n > 0 && idxs[n-1] == idx {
+		return // Named twice by the same route
+	}
+	r.backendRoutes[name] = append(idxs, idx)
+}
+
+// routeIndex returns the index of the first route the metric matches, or len(routes) if it matches none.
+func (r *backendRouter) routeIndex(metricName, _ string, tags gostatsd.Tags) int {
+	for idx, route := range r.routes {
+		if route.match(metricName, tags) {
+			return idx
+		}
+	}
+	return len(r.routes)
+}
+
+// route returns the MetricMap to send each backend, keyed by name.  A backend which isn't sent any routes is not
+// included.
+func (r *backendRouter) route(m *gostatsd.MetricMap) map[string]*gostatsd.MetricMap {
+	parts := m.SplitFunc(len(r.routes)+1, r.routeIndex)
+	byKey := make(map[string]*gostatsd.MetricMap, len(r.routesKeys))
+	routed := make(map[string]*gostatsd.MetricMap, len(r.routesKeys))
+	for name, idxs := range r.backendRoutes {
+		key := r.routesKeys[name]
+		mm, ok := byKey[key]
+		if !ok {
+			if len(idxs) == 1 {
+				mm = parts[idxs[0]]
+			} else {
+				mm = gostatsd.NewMetricMap()
+				for _, idx := range idxs {
+					mm.Merge(parts[idx])
+				}
+			}
+			byKey[key] = mm
+		}
+		routed[name] = mm
+	}
+	return routed
+}
@@ -0,0 +1,89 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+func TestFlusherRoutes(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	datadog := &namedCapturingBackend{name: "datadog"}
+	siem := &namedCapturingBackend{name: "siem"}
+	audit := &namedCapturingBackend{name: "audit"}
+	backends := []gostatsd.Backend{datadog, siem, audit}
+	routes := []*Route{
+		{Name: "security", MatchMetrics: toStringMatch([]string{"security.*"}), Backends: []string{"siem"}},
+		{Name: "audit", MatchMetrics: toStringMatch([]string{"*"}), MatchTags: toStringMatch([]string{"audit:*"}), Backends: []string{"siem", "audit"}},
+	}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, backends)
+	fl.router = newBackendRouter(routes, []string{"datadog"}, backends)
+	fl.namespaces = []string{"ns"}
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	aggr.Receive(
+		&gostatsd.Metric{Name: "security.login", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now},
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: now},
+		&gostatsd.Metric{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"audit:true"}, Timestamp: now},
+		&gostatsd.Metric{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: now},
+	)
+	fl.flushData(context.Background(), time.Second, stats.NewNullStatser())
+
+	require.Len(t, datadog.mm, 1)
+	assert.Len(t, datadog.mm[0].Counters, 1)
+	assert.Len(t, datadog.mm[0].Counters["ns.requests"], 1)
+	assert.Contains(t, datadog.mm[0].Counters["ns.requests"], "")
+	assert.Contains(t, datadog.mm[0].Timers, "ns.latency")
+	require.Len(t, siem.mm, 1)
+	assert.Len(t, siem.mm[0].Counters, 2)
+	assert.Contains(t, siem.mm[0].Counters, "ns.security.login")
+	assert.Contains(t, siem.mm[0].Counters["ns.requests"], "audit:true")
+	assert.Empty(t, siem.mm[0].Timers)
+	require.Len(t, audit.mm, 1)
+	assert.Len(t, audit.mm[0].Counters, 1)
+	assert.Contains(t, audit.mm[0].Counters["ns.requests"], "audit:true")
+}
+
+func TestNewRoutesFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+routes='security'
+
+[route.security]
+match-metrics='security.*'
+match-tags='team:sec'
+backends='siem'
+`))
+	require.NoError(t, err)
+
+	routes, err := NewRoutesFromViper(v)
+	require.NoError(t, err)
+	require.Len(t, routes, 1)
+	assert.Equal(t, "security", routes[0].Name)
+	assert.Equal(t, []string{"siem"}, routes[0].Backends)
+	assert.True(t, routes[0].match("security.login", gostatsd.Tags{"team:sec"}))
+	assert.False(t, routes[0].match("security.login", nil))
+	assert.False(t, routes[0].match("requests", gostatsd.Tags{"team:sec"}))
+
+	for _, invalid := range []map[string]interface{}{
+		{"backends": "siem"},
+		{"match-metrics": "security.*"},
+	} {
+		v := viper.New()
+		v.Set(ParamRoutes, "bad")
+		v.Set("route.bad", invalid)
+		_, err := NewRoutesFromViper(v)
+		assert.Error(t, err, "%v", invalid)
+	}
+}
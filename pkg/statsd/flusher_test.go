@@ -1,9 +1,23 @@
 package statsd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
 	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+	"github.com/atlassian/gostatsd/pkg/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestFlusherHandleSendResultNoErrors(t *testing.T) {
@@ -48,3 +62,735 @@ func TestFlusherHandleSendResultError(t *testing.T) {
 		})
 	}
 }
+
+type singleAggregateProcesser struct {
+	aggr Aggregator
+}
+
+func (sap *singleAggregateProcesser) Process(ctx context.Context, fn DispatcherProcessFunc) gostatsd.Wait {
+	fn(0, sap.aggr)
+	return func() {}
+}
+
+// notifyingAggregateProcesser closes processed once the aggregator has been flushed and reset, like a worker which
+// then goes back to receiving metrics.
+type notifyingAggregateProcesser struct {
+	aggr      Aggregator
+	processed chan struct{}
+}
+
+func (nap *notifyingAggregateProcesser) Process(ctx context.Context, fn DispatcherProcessFunc) gostatsd.Wait {
+	fn(0, nap.aggr)
+	close(nap.processed)
+	return func() {}
+}
+
+type capturingBackend struct {
+	mu sync.Mutex
+	mm []*gostatsd.MetricMap
+}
+
+func (cb *capturingBackend) Name() string {
+	return "capturingBackend"
+}
+
+func (cb *capturingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	cb.mu.Lock()
+	cb.mm = append(cb.mm, mm)
+	cb.mu.Unlock()
+	callback(nil)
+}
+
+func (cb *capturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherFlushSequenceTag(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	cb := &capturingBackend{}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{cb})
+	fl.flushSeqTag = "flush_seq"
+
+	statser := stats.NewNullStatser()
+	for i := 0; i < 2; i++ {
+		aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"foo:bar"}, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+		fl.flushData(context.Background(), time.Second, statser)
+	}
+
+	require.Len(t, cb.mm, 2)
+	assert.Equal(t, gostatsd.Tags{"foo:bar", "flush_seq:1"}, cb.mm[0].Counters["c"]["foo:bar"].Tags)
+	assert.Equal(t, gostatsd.Tags{"foo:bar", "flush_seq:2"}, cb.mm[1].Counters["c"]["foo:bar"].Tags)
+	// The aggregator keeps the original tags
+	assert.Equal(t, gostatsd.Tags{"foo:bar"}, aggr.metricMap.Counters["c"]["foo:bar"].Tags)
+}
+
+type namedCapturingBackend struct {
+	capturingBackend
+	name string
+}
+
+func (ncb *namedCapturingBackend) Name() string {
+	return ncb.name
+}
+
+func TestFlusherNamespaces(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	global := &namedCapturingBackend{name: "global"}
+	override := &namedCapturingBackend{name: "override"}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{global, override})
+	fl.namespaces = []string{"old", "new"}
+	fl.backendNamespaces = map[string][]string{"override": {"new"}}
+
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+	fl.flushData(context.Background(), time.Second, stats.NewNullStatser())
+
+	require.Len(t, global.mm, 1)
+	assert.Len(t, global.mm[0].Counters, 2)
+	assert.Contains(t, global.mm[0].Counters, "old.c")
+	assert.Contains(t, global.mm[0].Counters, "new.c")
+	require.Len(t, override.mm, 1)
+	assert.Len(t, override.mm[0].Counters, 1)
+	assert.Contains(t, override.mm[0].Counters, "new.c")
+	// The aggregator keeps the original names
+	assert.Contains(t, aggr.metricMap.Counters, "c")
+}
+
+func TestFlusherNamespaceOverridesAndExtraTags(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	graphite := &namedCapturingBackend{name: "graphite"}
+	vendor := &namedCapturingBackend{name: "vendor"}
+	internal := &namedCapturingBackend{name: "internal"}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{graphite, vendor, internal})
+	fl.namespace = "prod"
+	fl.namespaceOverrides = map[string]string{"vendor": "", "internal": "team"}
+	fl.backendTags = backendTags{"vendor": {"source:gostatsd"}}
+
+	now := gostatsd.Nanotime(time.Now().UnixNano())
+	aggr.Receive(
+		&gostatsd.Metric{Name: "prod.requests", Value: 1, Rate: 1, Tags: gostatsd.Tags{"env:prod"}, Type: gostatsd.COUNTER, Timestamp: now},
+		&gostatsd.Metric{Name: "prod.latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Timestamp: now},
+	)
+	fl.flushData(context.Background(), time.Second, stats.NewNullStatser())
+
+	// A backend without overrides keeps the namespace of the server
+	require.Len(t, graphite.mm, 1)
+	require.Contains(t, graphite.mm[0].Counters, "prod.requests")
+	assert.Contains(t, graphite.mm[0].Timers, "prod.latency")
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, graphite.mm[0].Counters["prod.requests"]["env:prod"].Tags)
+
+	require.Len(t, vendor.mm, 1)
+	assert.Len(t, vendor.mm[0].Counters, 1)
+	require.Contains(t, vendor.mm[0].Counters, "requests")
+	assert.Contains(t, vendor.mm[0].Timers, "latency")
+	assert.Equal(t, gostatsd.Tags{"env:prod", "source:gostatsd"}, vendor.mm[0].Counters["requests"]["env:prod"].Tags)
+
+	require.Len(t, internal.mm, 1)
+	require.Contains(t, internal.mm[0].Counters, "team.requests")
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, internal.mm[0].Counters["team.requests"]["env:prod"].Tags)
+
+	// The aggregator keeps the original names and tags
+	require.Contains(t, aggr.metricMap.Counters, "prod.requests")
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, aggr.metricMap.Counters["prod.requests"]["env:prod"].Tags)
+}
+
+func TestFlusherCounterRates(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	backend := &namedCapturingBackend{name: "backend"}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{backend})
+	fl.counterRates = true
+
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 30, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+	fl.flushData(context.Background(), 2*time.Second, stats.NewNullStatser())
+
+	require.Len(t, backend.mm, 1)
+	assert.Empty(t, backend.mm[0].Counters)
+	assert.Equal(t, float64(30), backend.mm[0].Gauges["c"][""].Value)
+	assert.Equal(t, float64(15), backend.mm[0].Gauges["c.per_second"][""].Value)
+}
+
+type orderingBackend struct {
+	name  string
+	order *[]string
+}
+
+func (ob *orderingBackend) Name() string {
+	return ob.name
+}
+
+func (ob *orderingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	*ob.order = append(*ob.order, ob.name)
+	callback(nil)
+}
+
+func (ob *orderingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherBackendOrder(t *testing.T) {
+	t.Parallel()
+	flushOrders := func(backendOrder string, flushes int) [][]string {
+		var order []string
+		backends := []gostatsd.Backend{
+			&orderingBackend{name: "a", order: &order},
+			&orderingBackend{name: "b", order: &order},
+			&orderingBackend{name: "c", order: &order},
+		}
+		fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: newFakeAggregator()}, backends)
+		fl.backendOrder = backendOrder
+		fl.rand = rand.New(rand.NewSource(1))
+		var orders [][]string
+		for i := 0; i < flushes; i++ {
+			order = nil
+			fl.flushData(context.Background(), time.Second, stats.NewNullStatser())
+			orders = append(orders, order)
+		}
+		return orders
+	}
+
+	assert.Equal(t, [][]string{{"a", "b", "c"}, {"a", "b", "c"}}, flushOrders(BackendOrderFixed, 2))
+	assert.Equal(t, [][]string{{"b", "c", "a"}, {"c", "a", "b"}, {"a", "b", "c"}}, flushOrders(BackendOrderRoundRobin, 3))
+
+	first := map[string]int{}
+	for _, order := range flushOrders(BackendOrderRandom, 30) {
+		assert.ElementsMatch(t, []string{"a", "b", "c"}, order)
+		first[order[0]]++
+	}
+	assert.Len(t, first, 3)
+}
+
+type failingBackend struct {
+	mu     sync.Mutex
+	failed bool
+}
+
+func (fb *failingBackend) Name() string {
+	return "failingBackend"
+}
+
+func (fb *failingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	fb.mu.Lock()
+	defer fb.mu.Unlock()
+	if fb.failed {
+		callback([]error{errors.New("boom")})
+	} else {
+		callback(nil)
+	}
+}
+
+func (fb *failingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func TestFlusherFallback(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	failing := &failingBackend{failed: true}
+	healthy := &namedCapturingBackend{name: "healthy"}
+	fallback := &namedCapturingBackend{name: "fallback"}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{failing, healthy})
+	fl.fallback = fallback
+	fl.fallbackAfter = 2
+
+	flush := func() {
+		aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+		fl.flushData(context.Background(), time.Second, stats.NewNullStatser())
+	}
+
+	// Not every backend is failing
+	flush()
+	flush()
+	assert.Empty(t, fallback.mm)
+
+	// Used once every backend has failed for fallbackAfter flushes
+	fl.backends = []gostatsd.Backend{failing}
+	flush()
+	flush()
+	assert.Empty(t, fallback.mm)
+	flush()
+	assert.Len(t, fallback.mm, 1)
+	flush()
+	assert.Len(t, fallback.mm, 2)
+
+	// Used until a backend recovers
+	failing.mu.Lock()
+	failing.failed = false
+	failing.mu.Unlock()
+	flush()
+	assert.Len(t, fallback.mm, 3)
+	flush()
+	assert.Len(t, fallback.mm, 3)
+}
+
+// backendGaugeStatser records the last value of each gauge, by the backend tag.
+type backendGaugeStatser struct {
+	stats.Statser
+	gauges map[string]float64
+}
+
+func (bgs *backendGaugeStatser) Gauge(name string, value float64, tags gostatsd.Tags) {
+	bgs.gauges[name+" "+tags.String()] = value
+}
+
+func TestFlusherBackendLag(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	failing := &failingBackend{failed: true}
+	healthy := &namedCapturingBackend{name: "healthy"}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{failing, healthy})
+	start := time.Now().Add(-time.Minute)
+	fl.lag = newBackendLag(fl.backends, start)
+	statser := &backendGaugeStatser{Statser: stats.NewNullStatser(), gauges: map[string]float64{}}
+
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+	fl.flushData(context.Background(), time.Second, statser)
+
+	// The failing backend has never delivered a flush, so it is behind from the start
+	assert.InDelta(t, 60, statser.gauges["flusher.backend_lag backend:failingBackend"], 5)
+	assert.InDelta(t, 0, statser.gauges["flusher.backend_lag backend:healthy"], 5)
+}
+
+// slowBackend takes delay to send each MetricMap.
+type slowBackend struct {
+	capturingBackend
+	delay time.Duration
+}
+
+func (sb *slowBackend) Name() string {
+	return "slowBackend"
+}
+
+func (sb *slowBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	time.AfterFunc(sb.delay, func() {
+		sb.capturingBackend.SendMetricsAsync(ctx, mm, callback)
+	})
+}
+
+func TestFlusherBackendSendTime(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	slow := &slowBackend{delay: 50 * time.Millisecond}
+	fast := &namedCapturingBackend{name: "fast"}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{slow, fast})
+	statser := &backendGaugeStatser{Statser: stats.NewNullStatser(), gauges: map[string]float64{}}
+
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+	fl.flushData(context.Background(), time.Second, statser)
+
+	assert.GreaterOrEqual(t, statser.gauges["flusher.backend_send_time backend:slowBackend"], 50.0)
+	assert.Contains(t, statser.gauges, "flusher.backend_send_time backend:fast")
+	assert.Less(t, statser.gauges["flusher.backend_send_time backend:fast"], 50.0)
+}
+
+type blockingBackend struct {
+	capturingBackend
+	release chan struct{}
+}
+
+func (bb *blockingBackend) Name() string {
+	return "blockingBackend"
+}
+
+func (bb *blockingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	bb.capturingBackend.SendMetricsAsync(ctx, mm, func(errs []error) {
+		go func() {
+			<-bb.release
+			callback(errs)
+		}()
+	})
+}
+
+func (cb *capturingBackend) len() int {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return len(cb.mm)
+}
+
+// waitUntil polls condition until it returns true, failing the test if it doesn't within 5 seconds.
+func waitUntil(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			require.FailNow(t, "timed out waiting for condition")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFlusherBackendQueues(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	fast := &namedCapturingBackend{name: "fast"}
+	slow := &blockingBackend{release: make(chan struct{})}
+	fl := NewMetricFlusher(0, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{fast, slow})
+	fl.backendQueueSize = 1
+	fl.queues = fl.newBackendQueues()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+	for _, q := range fl.queues {
+		q := q
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			q.run(ctx)
+		}()
+	}
+
+	for i := 1; i <= 3; i++ {
+		aggr.Receive(&gostatsd.Metric{Name: "c", Value: float64(i), Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+		fl.flushData(ctx, time.Second, stats.NewNullStatser())
+		// The slow backend doesn't delay the fast one
+		waitUntil(t, func() bool { return fast.len() == i })
+		waitUntil(t, func() bool { return slow.len() == 1 })
+	}
+
+	// The first flush is being sent, the second was dropped for the third
+	assert.EqualValues(t, 1, atomic.LoadUint64(&fl.queues[1].dropped))
+	close(slow.release)
+	waitUntil(t, func() bool { return slow.len() == 2 })
+	assert.EqualValues(t, 1, slow.mm[0].Counters["c"][""].Value)
+	assert.EqualValues(t, 3, slow.mm[1].Counters["c"][""].Value)
+	for i, mm := range fast.mm {
+		assert.EqualValues(t, i+1, mm.Counters["c"][""].Value)
+	}
+}
+
+type summingBackend struct {
+	counters int64
+}
+
+func (sb *summingBackend) Name() string {
+	return "summingBackend"
+}
+
+func (sb *summingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	// Backends are required to read the MetricMap synchronously, and the flusher waits for every aggregator, so
+	// access is serialized.
+	mm.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		atomic.AddInt64(&sb.counters, c.Value)
+	})
+	callback(nil)
+}
+
+func (sb *summingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+// TestFlusherNoLossAcrossFlushes sends metrics continuously while flushing as fast as possible, and checks that
+// every metric is flushed exactly once.
+func TestFlusherNoLossAcrossFlushes(t *testing.T) {
+	t.Parallel()
+	const senders = 4
+	const batches = 2000
+	const batchSize = 5
+
+	sb := &summingBackend{}
+	bh := NewBackendHandler([]gostatsd.Backend{sb}, 1, 4, 10, &fakeAggregatorFactory{})
+	fl := NewMetricFlusher(0, bh, []gostatsd.Backend{sb})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var bhWg sync.WaitGroup
+	bhWg.Add(1)
+	go func() {
+		defer bhWg.Done()
+		bh.Run(ctx)
+	}()
+
+	var sendWg sync.WaitGroup
+	sendWg.Add(senders)
+	for s := 0; s < senders; s++ {
+		s := s
+		go func() {
+			defer sendWg.Done()
+			for b := 0; b < batches; b++ {
+				ms := make([]*gostatsd.Metric, 0, batchSize)
+				for i := 0; i < batchSize; i++ {
+					ms = append(ms, &gostatsd.Metric{
+						Name:      "counter." + strconv.Itoa((b+i)%7),
+						Value:     1,
+						Rate:      1,
+						Type:      gostatsd.COUNTER,
+						Hostname:  strconv.Itoa(s),
+						Timestamp: gostatsd.Nanotime(time.Now().UnixNano()),
+					})
+				}
+				bh.DispatchMetrics(ctx, ms)
+			}
+		}()
+	}
+
+	sendDone := make(chan struct{})
+	go func() {
+		sendWg.Wait()
+		close(sendDone)
+	}()
+
+	statser := stats.NewNullStatser()
+	flushes := 0
+loop:
+	for {
+		select {
+		case <-sendDone:
+			break loop
+		default:
+			fl.flushData(ctx, time.Millisecond, statser)
+			flushes++
+		}
+	}
+	// Everything has been dispatched, a final flush must pick up whatever is still queued.
+	fl.flushData(ctx, time.Millisecond, statser)
+
+	cancel()
+	bhWg.Wait()
+
+	assert.NotZero(t, flushes)
+	assert.EqualValues(t, senders*batches*batchSize, atomic.LoadInt64(&sb.counters))
+}
+
+// scriptedBackend fails each send with the next errors in its script, and succeeds once the script is exhausted.
+type scriptedBackend struct {
+	mu       sync.Mutex
+	script   [][]error
+	sends    int
+	stateful bool
+	values   []int64 // Value of the counter c in each send
+}
+
+func (sb *scriptedBackend) Name() string {
+	return "scriptedBackend"
+}
+
+func (sb *scriptedBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	sb.mu.Lock()
+	var errs []error
+	if sb.sends < len(sb.script) {
+		errs = sb.script[sb.sends]
+	}
+	sb.sends++
+	if v, ok := mm.Counters["c"][""]; ok {
+		sb.values = append(sb.values, v.Value)
+	}
+	sb.mu.Unlock()
+	go callback(errs)
+}
+
+func (sb *scriptedBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	return nil
+}
+
+func (sb *scriptedBackend) KeepsFlushState() bool {
+	return sb.stateful
+}
+
+// incrementStatser counts the increments of each counter, by its tags.
+type incrementStatser struct {
+	stats.Statser
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func (is *incrementStatser) Increment(name string, tags gostatsd.Tags) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+	is.counts[name+" "+tags.String()]++
+}
+
+func TestFlusherBackendRetries(t *testing.T) {
+	t.Parallel()
+	unavailable := &util.StatusError{StatusCode: http.StatusServiceUnavailable}
+	badRequest := &util.StatusError{StatusCode: http.StatusBadRequest}
+	tests := []struct {
+		name     string
+		retries  int
+		script   [][]error
+		stateful bool
+		sends    int
+		failed   bool
+	}{
+		{name: "disabled", retries: 0, script: [][]error{{unavailable}}, sends: 1, failed: true},
+		{name: "recovers", retries: 3, script: [][]error{{unavailable}, {fmt.Errorf("wrapped: %w", unavailable)}}, sends: 3},
+		{name: "exhausted", retries: 1, script: [][]error{{unavailable}, {unavailable}, {unavailable}}, sends: 2, failed: true},
+		{name: "not retryable", retries: 3, script: [][]error{{badRequest}}, sends: 1, failed: true},
+		{name: "partial success", retries: 3, script: [][]error{{nil, unavailable}}, sends: 1, failed: true},
+		{name: "keeps flush state", retries: 3, script: [][]error{{unavailable}}, stateful: true, sends: 1, failed: true},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+			backend := &scriptedBackend{script: test.script, stateful: test.stateful}
+			fl := NewMetricFlusher(time.Second, nil, []gostatsd.Backend{backend})
+			fl.backendRetries = test.retries
+			statser := &incrementStatser{Statser: stats.NewNullStatser(), counts: map[string]int{}}
+			ctx := stats.NewContext(context.Background(), statser)
+
+			result := make(chan []error, 1)
+			fl.sendWithRetries(ctx, backend, gostatsd.NewMetricMap(), func(errs []error) {
+				result <- errs
+			})
+			select {
+			case errs := <-result:
+				assert.Equal(t, test.failed, fl.handleSendResult(errs))
+			case <-time.After(5 * time.Second):
+				require.FailNow(t, "send didn't finish")
+			}
+			assert.Equal(t, test.sends, backend.sends)
+			assert.Equal(t, test.sends-1, statser.counts["backend.retry backend:scriptedBackend"])
+		})
+	}
+}
+
+func TestFlusherBackendRetriesWithinFlushInterval(t *testing.T) {
+	t.Parallel()
+	unavailable := &util.StatusError{StatusCode: http.StatusServiceUnavailable}
+	backend := &scriptedBackend{}
+	for i := 0; i < 1000; i++ {
+		backend.script = append(backend.script, []error{unavailable})
+	}
+	fl := NewMetricFlusher(100*time.Millisecond, nil, []gostatsd.Backend{backend})
+	fl.backendRetries = len(backend.script)
+
+	start := time.Now()
+	result := make(chan []error, 1)
+	fl.sendWithRetries(context.Background(), backend, gostatsd.NewMetricMap(), func(errs []error) {
+		result <- errs
+	})
+	errs := <-result
+	// Retries which wouldn't start within the flush interval aren't made, so the send finishes in time for the next
+	assert.Less(t, int64(time.Since(start)), int64(150*time.Millisecond))
+	assert.Error(t, errs[0])
+}
+
+func TestFlusherBackendRetriesAfterReset(t *testing.T) {
+	t.Parallel()
+	unavailable := &util.StatusError{StatusCode: http.StatusServiceUnavailable}
+	aggr := newFakeAggregator()
+	backend := &scriptedBackend{script: [][]error{{unavailable}}}
+	processed := make(chan struct{})
+	fl := NewMetricFlusher(200*time.Millisecond, &notifyingAggregateProcesser{aggr: aggr, processed: processed}, []gostatsd.Backend{backend})
+	fl.backendRetries = 1
+	ctx := stats.NewContext(context.Background(), stats.NewNullStatser())
+
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 5, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.NanoNow()})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		fl.flushData(ctx, 200*time.Millisecond, stats.NewNullStatser())
+	}()
+	// The aggregator is reset and receives the next interval while the retry is waiting.
+	<-processed
+	for i := 0; i < 100; i++ {
+		aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.NanoNow()})
+	}
+	<-done
+
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+	assert.Equal(t, []int64{5, 5}, backend.values)
+}
+
+func TestNextAlignedFlush(t *testing.T) {
+	t.Parallel()
+	base := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	interval := 10 * time.Second
+
+	// The first flush is at the next boundary, however close it is.
+	assert.Equal(t, base.Add(10*time.Second), nextAlignedFlush(base.Add(3*time.Second), interval, 0))
+	assert.Equal(t, base.Add(10*time.Second), nextAlignedFlush(base.Add(9999*time.Millisecond), interval, 0))
+	assert.Equal(t, base.Add(10*time.Second), nextAlignedFlush(base, interval, 0))
+
+	// Later flushes skip a boundary which is less than minDelay away, so a timer firing just early doesn't flush twice.
+	assert.Equal(t, base.Add(20*time.Second), nextAlignedFlush(base.Add(9999*time.Millisecond), interval, interval/2))
+	assert.Equal(t, base.Add(20*time.Second), nextAlignedFlush(base.Add(10001*time.Millisecond), interval, interval/2))
+	assert.Equal(t, base.Add(10*time.Second), nextAlignedFlush(base.Add(4*time.Second), interval, interval/2))
+}
+
+// rateBackend records when each flush is sent and the rate of the counter c in it, as the MetricMap is reset once it
+// is sent.
+type rateBackend struct {
+	capturingBackend
+	sent  chan time.Time
+	rates chan float64
+}
+
+func (rb *rateBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	select {
+	case rb.rates <- mm.Counters["c"][""].PerSecond:
+		rb.sent <- time.Now()
+	default:
+	}
+	callback(nil)
+}
+
+func TestFlusherAlignFlush(t *testing.T) {
+	t.Parallel()
+	aggr := newFakeAggregator()
+	rb := &rateBackend{sent: make(chan time.Time, 1), rates: make(chan float64, 1)}
+	interval := 400 * time.Millisecond
+	fl := NewMetricFlusher(interval, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{rb})
+	fl.alignFlush = true
+
+	// Start a quarter of the way through an interval, so the first window is three quarters of an interval.
+	time.Sleep(time.Until(nextAlignedFlush(time.Now(), interval, 0)) + interval/4)
+	started := time.Now()
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(started.UnixNano())})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fl.Run(ctx)
+
+	select {
+	case rate := <-rb.rates:
+		sent := <-rb.sent
+		assert.True(t, sent.Sub(sent.Truncate(interval)) < interval/4, "sent %v after the boundary", sent.Sub(sent.Truncate(interval)))
+		// The rate of the first window is over the partial window, not a whole interval.
+		assert.InEpsilon(t, 1/sent.Sub(started).Seconds(), rate, 0.2)
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for a flush")
+	}
+}
+
+// intervalAggregator records the interval passed to each Flush.
+type intervalAggregator struct {
+	Aggregator
+	intervals chan time.Duration
+}
+
+func (ia *intervalAggregator) Flush(interval time.Duration) {
+	ia.intervals <- interval
+	ia.Aggregator.Flush(interval)
+}
+
+func TestFlusherPassesElapsedTime(t *testing.T) {
+	t.Parallel()
+	aggr := &intervalAggregator{Aggregator: newFakeAggregator(), intervals: make(chan time.Duration, 2)}
+	rb := &rateBackend{sent: make(chan time.Time, 2), rates: make(chan float64, 2)}
+	fl := NewMetricFlusher(time.Hour, &singleAggregateProcesser{aggr: aggr}, []gostatsd.Backend{rb})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go fl.Run(ctx)
+
+	beforeFirst := time.Now()
+	require.NoError(t, fl.Flush(ctx))
+	<-aggr.intervals
+	<-rb.rates
+
+	time.Sleep(100 * time.Millisecond)
+	aggr.Receive(&gostatsd.Metric{Name: "c", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Timestamp: gostatsd.Nanotime(time.Now().UnixNano())})
+	require.NoError(t, fl.Flush(ctx))
+	afterSecond := time.Now()
+
+	// The interval is the time between the flushes, not the hour long flush interval.
+	interval := <-aggr.intervals
+	assert.True(t, interval >= 100*time.Millisecond, "interval %v", interval)
+	assert.True(t, interval <= afterSecond.Sub(beforeFirst), "interval %v", interval)
+	assert.InEpsilon(t, 1/interval.Seconds(), <-rb.rates, 0.001)
+}
@@ -4,15 +4,25 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
+const (
+	// workerScaleUpFill is the peak worker queue fill at or above which a worker is added.
+	workerScaleUpFill = 0.5
+	// workerScaleDownFill is the peak worker queue fill at or below which a worker is removed.
+	workerScaleDownFill = 0.1
+)
+
 // AggregatorFactory creates Aggregator objects.
 type AggregatorFactory interface {
 	// Create creates Aggregator objects.
@@ -29,56 +39,189 @@ func (f AggregatorFactoryFunc) Create() Aggregator {
 
 // BackendEventHandler dispatches metrics and events to all configured backends (via Aggregators)
 type BackendHandler struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	eventsDropped    uint64
+	eventsTruncated  uint64
+	eventBatchesSent uint64
+
 	eventWg          sync.WaitGroup
 	backends         []gostatsd.Backend
+	backendFilters   backendFilters // Optional, per backend name filters of the events sent
 	concurrentEvents chan struct{}
+	eventBatcher     *eventBatcher // Optional, events are sent in batches
+	eventLimiter     *rate.Limiter // Optional, events over the rate are dropped
+	maxEventSize     int           // Maximum size of an event body, 0 for unlimited
+	nameSeparator    byte          // Optional, separators in metric names are replaced with this
+	sampler          *loadSampler  // Optional, counters and timers are sampled to shed load
+	workerHash       *workerHash   // Optional, picks the Aggregator of each metric instead of gostatsd.Bucket
 
-	numWorkers int
-	workers    []*worker
+	numWorkers          int           // Number of Aggregators, and the maximum number of workers
+	minWorkers          int           // Optional, the workers are scaled between this and numWorkers
+	scaleInterval       time.Duration // How often the number of workers is re-evaluated when scaling
+	perWorkerBufferSize int
+	aggregators         []Aggregator
+
+	workersMu      sync.RWMutex // Held for writing while the workers are being replaced
+	workers        []*worker
+	currentWorkers atomic.Value // []*worker, a copy of workers which can be read without waiting for workersMu
 }
 
 // NewBackendHandler initialises a new Handler which sends metrics and events to all backends
 func NewBackendHandler(backends []gostatsd.Backend, maxConcurrentEvents uint, numWorkers int, perWorkerBufferSize int, af AggregatorFactory) *BackendHandler {
-	workers := make([]*worker, numWorkers)
-
+	aggregators := make([]Aggregator, numWorkers)
 	for i := 0; i < numWorkers; i++ {
-		workers[i] = &worker{
-			aggr: af.Create(),
-			// TODO: Reassess the defaults
-			metricsQueue:   make(chan []*gostatsd.Metric, perWorkerBufferSize),
-			metricMapQueue: make(chan *gostatsd.MetricMap, perWorkerBufferSize),
-			processChan:    make(chan *processCommand),
-			id:             i,
-		}
+		aggregators[i] = af.Create()
 	}
 
-	return &BackendHandler{
+	bh := &BackendHandler{
 		backends:         backends,
 		concurrentEvents: make(chan struct{}, maxConcurrentEvents),
 
-		numWorkers: numWorkers,
-		workers:    workers,
+		numWorkers:          numWorkers,
+		scaleInterval:       DefaultWorkerScaleInterval,
+		perWorkerBufferSize: perWorkerBufferSize,
+		aggregators:         aggregators,
 	}
+	bh.workers = bh.newWorkers(numWorkers)
+	bh.currentWorkers.Store(bh.workers)
+	return bh
+}
+
+func (bh *BackendHandler) newWorkers(n int) []*worker {
+	workers := make([]*worker, n)
+	for i := 0; i < n; i++ {
+		workers[i] = newWorker(i, n, bh.perWorkerBufferSize, bh.aggregators)
+	}
+	return workers
 }
 
 // Run runs the BackendHandler workers until the Context is closed.
 func (bh *BackendHandler) Run(ctx context.Context) {
-	var wg wait.Group
+	// The workers are only replaced by this goroutine, so they can be read without the lock.  Dispatching may be
+	// blocked holding it until the workers start.
+	for _, worker := range bh.workers {
+		go worker.work()
+	}
 	defer func() {
+		bh.workersMu.Lock()
+		defer bh.workersMu.Unlock()
 		for _, worker := range bh.workers {
 			close(worker.metricsQueue)   // Close channel to terminate worker
 			close(worker.metricMapQueue) // Close channel to terminate worker
 		}
-		wg.Wait() // Wait for all workers to finish
+		for _, worker := range bh.workers {
+			<-worker.done // Wait for all workers to finish
+		}
 	}()
-	for _, worker := range bh.workers {
-		wg.Start(worker.work)
+
+	if bh.scalingEnabled() {
+		bh.scaleWorkers(ctx)
+		return
 	}
 
 	// Work until asked to stop
 	<-ctx.Done()
 }
 
+func (bh *BackendHandler) scalingEnabled() bool {
+	return bh.minWorkers > 0 && bh.minWorkers < bh.numWorkers
+}
+
+// scaleWorkers samples how full the worker queues are every second, and every scaleInterval adds a worker if the
+// queues were under pressure, or removes one if they were idle.  Returns when the Context is closed.
+func (bh *BackendHandler) scaleWorkers(ctx context.Context) {
+	sampleTicker := time.NewTicker(time.Second)
+	defer sampleTicker.Stop()
+	scaleTicker := time.NewTicker(bh.scaleInterval)
+	defer scaleTicker.Stop()
+
+	peakFill := 0.0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-sampleTicker.C:
+			if fill := bh.queueFill(); fill > peakFill {
+				peakFill = fill
+			}
+		case <-scaleTicker.C:
+			if fill := bh.queueFill(); fill > peakFill {
+				peakFill = fill
+			}
+			current := bh.numActiveWorkers()
+			if n := bh.scaledWorkers(current, peakFill); n != current {
+				logrus.WithFields(logrus.Fields{
+					"workers":   n,
+					"queueFill": peakFill,
+				}).Info("Resizing worker pool")
+				bh.resizeWorkers(n)
+			}
+			peakFill = 0
+		}
+	}
+}
+
+// scaledWorkers returns the number of workers there should be, given the current number and the peak queue fill
+// since the last evaluation.  The pool changes by at most one worker at a time.
+func (bh *BackendHandler) scaledWorkers(current int, peakFill float64) int {
+	switch {
+	case peakFill >= workerScaleUpFill && current < bh.numWorkers:
+		return current + 1
+	case peakFill <= workerScaleDownFill && current > bh.minWorkers:
+		return current - 1
+	}
+	return current
+}
+
+// resizeWorkers replaces the workers with n new ones.  Dispatching is paused while the old workers are stopped, and
+// everything they had queued is received before the Aggregators are handed to the new workers.
+func (bh *BackendHandler) resizeWorkers(n int) {
+	bh.workersMu.Lock()
+	defer bh.workersMu.Unlock()
+	if n == len(bh.workers) {
+		return
+	}
+	for _, worker := range bh.workers {
+		worker.stop()
+	}
+	bh.workers = bh.newWorkers(n)
+	bh.currentWorkers.Store(bh.workers)
+	for _, worker := range bh.workers {
+		go worker.work()
+	}
+}
+
+func (bh *BackendHandler) numActiveWorkers() int {
+	bh.workersMu.RLock()
+	defer bh.workersMu.RUnlock()
+	return len(bh.workers)
+}
+
+// queueFill returns how full the fullest worker queue is, from 0 to 1.
+func (bh *BackendHandler) queueFill() float64 {
+	bh.workersMu.RLock()
+	defer bh.workersMu.RUnlock()
+	fill := 0.0
+	for _, worker := range bh.workers {
+		if f := worker.queueFill(); f > fill {
+			fill = f
+		}
+	}
+	return fill
+}
+
+// queueLen returns the length of the metrics queue of the worker with the given id, or 0 if there is no such worker.
+func (bh *BackendHandler) queueLen(id int) int {
+	bh.workersMu.RLock()
+	defer bh.workersMu.RUnlock()
+	if id >= len(bh.workers) {
+		return 0
+	}
+	return len(bh.workers[id].metricsQueue)
+}
+
 // RunMetricsContext pulls a Statser from the Context and invokes RunMetrics.  Allows a BackendHandler to still
 // conform to MetricEmitter.
 func (bh *BackendHandler) RunMetricsContext(ctx context.Context) {
@@ -91,11 +234,17 @@ func (bh *BackendHandler) RunMetrics(ctx context.Context, statser stats.Statser)
 	defer wg.Wait()
 
 	// Starts the metrics for workers
-	for _, worker := range bh.workers {
-		worker := worker
-		wg.Start(func() {
-			worker.RunMetrics(ctx, statser)
-		})
+	for i := 0; i < bh.numWorkers; i++ {
+		id := i
+		csw := stats.NewChannelStatsWatcher(
+			statser,
+			"dispatch_aggregator",
+			gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", id)},
+			bh.perWorkerBufferSize,
+			func() int { return bh.queueLen(id) },
+			1000*time.Millisecond, // TODO: Make configurable
+		)
+		wg.StartWithContext(ctx, csw.Run)
 	}
 
 	// Starts the metrics for aggregators
@@ -116,6 +265,43 @@ func (bh *BackendHandler) RunMetrics(ctx context.Context, statser stats.Statser)
 		time.Second,
 	)
 	wg.StartWithContext(ctx, csw.Run)
+
+	wg.StartWithContext(ctx, func(ctx context.Context) {
+		flushed, unregister := statser.RegisterFlush()
+		defer unregister()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-flushed:
+				bh.emitQueueDepths(statser)
+				if bh.eventLimiter != nil || bh.maxEventSize > 0 || bh.eventBatcher != nil {
+					statser.Gauge("backend_handler.events_dropped", float64(atomic.LoadUint64(&bh.eventsDropped)), nil)
+					statser.Gauge("backend_handler.events_truncated", float64(atomic.LoadUint64(&bh.eventsTruncated)), nil)
+				}
+				if bh.eventBatcher != nil {
+					statser.Gauge("backend_handler.event_batches_sent", float64(atomic.LoadUint64(&bh.eventBatchesSent)), nil)
+				}
+				if bh.scalingEnabled() {
+					statser.Gauge("backend_handler.workers", float64(bh.numActiveWorkers()), nil)
+				}
+				if bh.sampler != nil {
+					statser.Gauge("backend_handler.metrics_sampled_out", float64(atomic.LoadUint64(&bh.sampler.sampledOut)), nil)
+				}
+			}
+		}
+	})
+}
+
+// emitQueueDepths emits backend_handler.queue_depth, the number of batches queued for each worker at the time of the
+// flush, and backend_handler.queue_size, the capacity of each queue.  The workers are read without waiting for
+// workersMu, so a flush isn't held up while the workers are being replaced.
+func (bh *BackendHandler) emitQueueDepths(statser stats.Statser) {
+	for _, worker := range bh.currentWorkers.Load().([]*worker) {
+		tags := gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", worker.id)}
+		statser.Gauge("backend_handler.queue_depth", float64(worker.queueDepth()), tags)
+	}
+	statser.Gauge("backend_handler.queue_size", float64(bh.perWorkerBufferSize), nil)
 }
 
 // EstimatedTags returns a guess for how many tags to pre-allocate
@@ -125,33 +311,62 @@ func (bh *BackendHandler) EstimatedTags() int {
 
 // DispatchMetrics dispatches metric to a corresponding Aggregator.
 func (bh *BackendHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	if bh.sampler != nil {
+		metrics = bh.sampler.sample(metrics)
+	}
 	metricsByAggr := make([][]*gostatsd.Metric, bh.numWorkers)
 
 	for _, m := range metrics {
+		if bh.nameSeparator != 0 {
+			// Before bucketing, so names which normalize the same go to the same aggregator
+			m.Name = normalizeSeparators(m.Name, bh.nameSeparator)
+		}
 		m.TagsKey = m.FormatTagsKey() // this is expensive, so do it with no aggregator affinity
-		bucket := m.Bucket(bh.numWorkers)
+		bucket := bh.bucket(m)
 		metricsByAggr[bucket] = append(metricsByAggr[bucket], m)
 	}
 
+	bh.workersMu.RLock()
+	defer bh.workersMu.RUnlock()
 	for aggrIdx, bucketedMetrics := range metricsByAggr {
-		w := bh.workers[aggrIdx]
+		w := bh.workers[aggrIdx%len(bh.workers)]
 		select {
 		case <-ctx.Done():
-		case w.metricsQueue <- bucketedMetrics:
+		case w.metricsQueue <- workerMetrics{aggrId: aggrIdx, metrics: bucketedMetrics}:
 		}
 	}
 }
 
+// bucket returns the Aggregator of m, which must have its TagsKey set.
+func (bh *BackendHandler) bucket(m *gostatsd.Metric) int {
+	if bh.workerHash == nil {
+		return m.Bucket(bh.numWorkers)
+	}
+	return bh.workerHash.metricBucket(m, bh.numWorkers)
+}
+
 // DispatchMetricMap re-dispatches a metric map through BackendHandler.DispatchMetrics
 func (bh *BackendHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
-	maps := mm.Split(bh.numWorkers)
+	if bh.nameSeparator != 0 {
+		mm = normalizeMetricMapSeparators(mm, bh.nameSeparator)
+	}
+	var maps []*gostatsd.MetricMap
+	if bh.workerHash == nil {
+		maps = mm.Split(bh.numWorkers)
+	} else {
+		maps = mm.SplitFunc(bh.numWorkers, func(metricName, hostname string, tags gostatsd.Tags) int {
+			return bh.workerHash.mapBucket(metricName, hostname, tags, bh.numWorkers)
+		})
+	}
 
+	bh.workersMu.RLock()
+	defer bh.workersMu.RUnlock()
 	for aggrIdx, mmSplit := range maps {
 		if !mmSplit.IsEmpty() {
-			w := bh.workers[aggrIdx]
+			w := bh.workers[aggrIdx%len(bh.workers)]
 			select {
 			case <-ctx.Done():
-			case w.metricMapQueue <- mmSplit:
+			case w.metricMapQueue <- workerMetricMap{aggrId: aggrIdx, mm: mmSplit}:
 			}
 		}
 	}
@@ -168,6 +383,10 @@ func (bh *BackendHandler) Process(ctx context.Context, f DispatcherProcessFunc)
 	}
 	wg.Add(bh.numWorkers)
 	cmdSent := 0
+
+	// The workers can't be replaced until every command is sent, after which they finish the commands before stopping.
+	bh.workersMu.RLock()
+	defer bh.workersMu.RUnlock()
 loop:
 	for _, worker := range bh.workers {
 		select {
@@ -175,7 +394,7 @@ loop:
 			wg.Add(cmdSent - bh.numWorkers) // Not all commands have been sent, should decrement the WG counter.
 			break loop
 		case worker.processChan <- cmd:
-			cmdSent++
+			cmdSent += len(worker.aggrIds)
 		}
 	}
 
@@ -183,13 +402,38 @@ loop:
 }
 
 func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	if bh.eventLimiter != nil && !bh.eventLimiter.Allow() {
+		atomic.AddUint64(&bh.eventsDropped, 1)
+		return
+	}
+	if bh.maxEventSize > 0 && len(e.Text) > bh.maxEventSize {
+		e.Text = truncateUTF8(e.Text, bh.maxEventSize)
+		atomic.AddUint64(&bh.eventsTruncated, 1)
+	}
+	if bh.eventBatcher != nil {
+		if !bh.eventBatcher.add(e) {
+			atomic.AddUint64(&bh.eventsDropped, 1)
+		}
+		return
+	}
+
+	backends := bh.backends
+	if len(bh.backendFilters) > 0 {
+		backends = make([]gostatsd.Backend, 0, len(bh.backends))
+		for _, backend := range bh.backends {
+			if filter := bh.backendFilters[backend.Name()]; filter == nil || filter.match(e.Title) {
+				backends = append(backends, backend)
+			}
+		}
+	}
+
 	eventsDispatched := 0
-	bh.eventWg.Add(len(bh.backends))
-	for _, backend := range bh.backends {
+	bh.eventWg.Add(len(backends))
+	for _, backend := range backends {
 		select {
 		case <-ctx.Done():
 			// Not all backends got the event, should decrement the wg counter
-			bh.eventWg.Add(eventsDispatched - len(bh.backends))
+			bh.eventWg.Add(eventsDispatched - len(backends))
 			return
 		case bh.concurrentEvents <- struct{}{}:
 			// Creates a new context for dispatching the event.
@@ -204,8 +448,11 @@ func (bh *BackendHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event)
 	}
 }
 
-// WaitForEvents waits for all event-dispatching goroutines to finish.
+// WaitForEvents waits for all event-dispatching goroutines to finish, sending any events waiting to be batched first.
 func (bh *BackendHandler) WaitForEvents() {
+	if bh.eventBatcher != nil {
+		bh.eventBatcher.flush()
+	}
 	bh.eventWg.Wait()
 }
 
@@ -218,3 +465,26 @@ func (bh *BackendHandler) internalDispatchEvent(ctx context.Context, backend gos
 		logrus.Errorf("Sending event to backend failed: %v", err)
 	}
 }
+
+// newEventLimiter creates a limiter allowing limit events per second, or nil if limit is not positive.
+func newEventLimiter(limit rate.Limit) *rate.Limiter {
+	if limit <= 0 {
+		return nil
+	}
+	burst := int(limit)
+	if burst < 1 {
+		burst = 1
+	}
+	return rate.NewLimiter(limit, burst)
+}
+
+// truncateUTF8 truncates s to at most n bytes, without splitting a multi-byte character.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
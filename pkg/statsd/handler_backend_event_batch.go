@@ -0,0 +1,188 @@
+package statsd
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/tilinna/clock"
+
+	"github.com/atlassian/gostatsd"
+)
+
+const (
+	// eventBatchQueueBatches is how many batches of events can be queued, more events are dropped.
+	eventBatchQueueBatches = 10
+	// eventBatchShutdownTimeout is how long the events still queued when stopping wait to be sent.
+	eventBatchShutdownTimeout = 2 * time.Second
+)
+
+// eventBatcher coalesces events in to batches, which are sent once they have size events, or window after their
+// first event.  Events are queued to a single goroutine, so dispatching never blocks, and are dropped if the queue is
+// full, such as while the backends are unavailable.
+type eventBatcher struct {
+	window  time.Duration
+	size    int
+	events  chan *gostatsd.Event
+	flushes chan chan struct{} // Requests to send everything queued, closed once it's sent
+	done    chan struct{}      // Closed when Run returns
+	send    func(context.Context, []*gostatsd.Event)
+}
+
+func newEventBatcher(window time.Duration, size int, send func(context.Context, []*gostatsd.Event)) *eventBatcher {
+	return &eventBatcher{
+		window:  window,
+		size:    size,
+		events:  make(chan *gostatsd.Event, eventBatchQueueBatches*size),
+		flushes: make(chan chan struct{}),
+		done:    make(chan struct{}),
+		send:    send,
+	}
+}
+
+// add queues e to be sent in the next batch, returning false if the queue is full.
+func (eb *eventBatcher) add(e *gostatsd.Event) bool {
+	select {
+	case eb.events <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+// flush sends everything queued, and waits until it's dispatched.
+func (eb *eventBatcher) flush() {
+	flushed := make(chan struct{})
+	select {
+	case <-eb.done:
+		return
+	case eb.flushes <- flushed:
+	}
+	select {
+	case <-eb.done:
+	case <-flushed:
+	}
+}
+
+// Run batches the queued events until the context is done, then sends everything still queued.
+func (eb *eventBatcher) Run(ctx context.Context) {
+	defer close(eb.done)
+
+	var batch []*gostatsd.Event
+	var timer *clock.Timer
+	var timeout <-chan time.Time
+	send := func(ctx context.Context) {
+		if timer != nil {
+			timer.Stop()
+			timer, timeout = nil, nil
+		}
+		if len(batch) > 0 {
+			eb.send(ctx, batch)
+			batch = nil
+		}
+	}
+	add := func(ctx context.Context, e *gostatsd.Event) {
+		batch = append(batch, e)
+		if len(batch) >= eb.size {
+			send(ctx)
+		} else if timer == nil {
+			timer = clock.NewTimer(ctx, eb.window)
+			timeout = timer.C
+		}
+	}
+	sendQueued := func(ctx context.Context) {
+		for {
+			select {
+			case e := <-eb.events:
+				add(ctx, e)
+			default:
+				send(ctx)
+				return
+			}
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			stopCtx, cancel := context.WithTimeout(context.Background(), eventBatchShutdownTimeout)
+			sendQueued(stopCtx)
+			cancel()
+			return
+		case e := <-eb.events:
+			add(ctx, e)
+		case <-timeout:
+			send(ctx)
+		case flushed := <-eb.flushes:
+			sendQueued(ctx)
+			close(flushed)
+		}
+	}
+}
+
+// eventBatchDispatcher returns a function which sends a batch of events to every backend, filtered by the
+// backendFilters.  A backend which implements gostatsd.BatchEventSender is sent the batch in one call, any other is
+// sent each event in order.  Each batch is sent in its own goroutine, but waits for the previous batch to the same
+// backend to be sent first, so each backend receives the batches in order.  The function must only be called from a
+// single goroutine, such as that of the eventBatcher.
+func (bh *BackendHandler) eventBatchDispatcher() func(context.Context, []*gostatsd.Event) {
+	previous := make(map[string]chan struct{}) // Closed once the last batch dispatched to each backend is sent
+	return func(ctx context.Context, events []*gostatsd.Event) {
+		for _, backend := range bh.backends {
+			batch := events
+			if filter := bh.backendFilters[backend.Name()]; filter != nil {
+				batch = make([]*gostatsd.Event, 0, len(events))
+				for _, e := range events {
+					if filter.match(e.Title) {
+						batch = append(batch, e)
+					}
+				}
+				if len(batch) == 0 {
+					continue
+				}
+			}
+			select {
+			case <-ctx.Done():
+				atomic.AddUint64(&bh.eventsDropped, uint64(len(batch)))
+				continue
+			case bh.concurrentEvents <- struct{}{}:
+			}
+			done := make(chan struct{})
+			after := previous[backend.Name()]
+			previous[backend.Name()] = done
+			bh.eventWg.Add(1)
+			go bh.internalDispatchEventBatch(backend, batch, after, done)
+		}
+	}
+}
+
+// internalDispatchEventBatch sends events to backend once after is closed, if it isn't nil, then closes done.
+func (bh *BackendHandler) internalDispatchEventBatch(backend gostatsd.Backend, events []*gostatsd.Event, after <-chan struct{}, done chan<- struct{}) {
+	defer bh.eventWg.Done()
+	defer func() {
+		<-bh.concurrentEvents
+	}()
+	defer close(done)
+	if after != nil {
+		<-after
+	}
+	atomic.AddUint64(&bh.eventBatchesSent, 1)
+	if sender, ok := backend.(gostatsd.BatchEventSender); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		if err := sender.SendEvents(ctx, events); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+			logrus.Errorf("Sending events to backend failed: %v", err)
+		}
+		return
+	}
+	for _, e := range events {
+		func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+			defer cancel()
+			if err := backend.SendEvent(ctx, e); err != nil && err != context.Canceled && err != context.DeadlineExceeded {
+				logrus.Errorf("Sending event to backend failed: %v", err)
+			}
+		}()
+	}
+}
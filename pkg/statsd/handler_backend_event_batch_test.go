@@ -0,0 +1,165 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+type batchEventCapturingBackend struct {
+	namedEventCapturingBackend
+	batches   [][]*gostatsd.Event
+	started   bool
+	firstWait time.Duration // Optional, how long sending the first batch takes
+	sent      chan struct{} // Optional, receives once for each batch sent
+}
+
+func (beb *batchEventCapturingBackend) SendEvents(ctx context.Context, events []*gostatsd.Event) error {
+	beb.mu.Lock()
+	first := !beb.started
+	beb.started = true
+	beb.mu.Unlock()
+	if first {
+		time.Sleep(beb.firstWait) // Later batches overtake this one, unless they wait for it
+	}
+	beb.mu.Lock()
+	beb.batches = append(beb.batches, events)
+	beb.mu.Unlock()
+	if beb.sent != nil {
+		beb.sent <- struct{}{}
+	}
+	return nil
+}
+
+func eventTitles(events []*gostatsd.Event) []string {
+	titles := make([]string, 0, len(events))
+	for _, e := range events {
+		titles = append(titles, e.Title)
+	}
+	return titles
+}
+
+func newTestBatchingBackendHandler(window time.Duration, size int, backends ...gostatsd.Backend) *BackendHandler {
+	h := NewBackendHandler(backends, 10, 1, 1, newTestFactory())
+	h.eventBatcher = newEventBatcher(window, size, h.eventBatchDispatcher())
+	return h
+}
+
+func TestEventBatcherSendsFullBatches(t *testing.T) {
+	t.Parallel()
+	batcher := &batchEventCapturingBackend{
+		namedEventCapturingBackend: namedEventCapturingBackend{name: "batcher"},
+		firstWait:                  20 * time.Millisecond,
+	}
+	single := &namedEventCapturingBackend{name: "single"}
+	h := newTestBatchingBackendHandler(time.Hour, 2, batcher, single)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.eventBatcher.Run(ctx)
+
+	for i := 0; i < 5; i++ {
+		h.DispatchEvent(ctx, &gostatsd.Event{Title: fmt.Sprintf("e%d", i)})
+	}
+	h.WaitForEvents()
+
+	require.Len(t, batcher.batches, 3)
+	assert.Equal(t, []string{"e0", "e1"}, eventTitles(batcher.batches[0]))
+	assert.Equal(t, []string{"e2", "e3"}, eventTitles(batcher.batches[1]))
+	assert.Equal(t, []string{"e4"}, eventTitles(batcher.batches[2]))
+	assert.Empty(t, batcher.events)
+	assert.ElementsMatch(t, []string{"e0", "e1", "e2", "e3", "e4"}, eventTitles(single.events))
+	assert.EqualValues(t, 6, h.eventBatchesSent)
+}
+
+func TestEventBatcherSendsAfterWindow(t *testing.T) {
+	t.Parallel()
+	batcher := &batchEventCapturingBackend{
+		namedEventCapturingBackend: namedEventCapturingBackend{name: "batcher"},
+		sent:                       make(chan struct{}, 1),
+	}
+	h := newTestBatchingBackendHandler(10*time.Millisecond, 100, batcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.eventBatcher.Run(ctx)
+
+	h.DispatchEvent(ctx, &gostatsd.Event{Title: "a"})
+	h.DispatchEvent(ctx, &gostatsd.Event{Title: "b"})
+	select {
+	case <-batcher.sent:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for the batch")
+	}
+	h.eventWg.Wait()
+	require.Len(t, batcher.batches, 1)
+	assert.Equal(t, []string{"a", "b"}, eventTitles(batcher.batches[0]))
+}
+
+func TestEventBatcherSendsQueuedOnStop(t *testing.T) {
+	t.Parallel()
+	batcher := &batchEventCapturingBackend{namedEventCapturingBackend: namedEventCapturingBackend{name: "batcher"}}
+	h := newTestBatchingBackendHandler(time.Hour, 100, batcher)
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.eventBatcher.Run(ctx)
+	}()
+
+	h.DispatchEvent(ctx, &gostatsd.Event{Title: "a"})
+	cancel()
+	wg.Wait()
+	h.WaitForEvents() // Returns once the batcher has stopped
+
+	require.Len(t, batcher.batches, 1)
+	assert.Equal(t, []string{"a"}, eventTitles(batcher.batches[0]))
+}
+
+func TestEventBatcherBackendFilters(t *testing.T) {
+	t.Parallel()
+	graphite := &namedEventCapturingBackend{name: "graphite"}
+	saas := &batchEventCapturingBackend{namedEventCapturingBackend: namedEventCapturingBackend{name: "saas"}}
+	h := newTestBatchingBackendHandler(time.Hour, 100, graphite, saas)
+	h.backendFilters = backendFilters{
+		"graphite": NewBackendFilter(nil, []string{"deploy.*"}),
+		"saas":     NewBackendFilter([]string{"nothing"}, nil),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.eventBatcher.Run(ctx)
+
+	h.DispatchEvent(ctx, &gostatsd.Event{Title: "deploy.web"})
+	h.DispatchEvent(ctx, &gostatsd.Event{Title: "restart"})
+	h.DispatchEvent(ctx, &gostatsd.Event{Title: "deploy.db"})
+	h.WaitForEvents()
+
+	assert.Equal(t, []string{"restart"}, eventTitles(graphite.events))
+	assert.Empty(t, saas.batches) // Every event is filtered, so nothing is sent
+	assert.EqualValues(t, 1, h.eventBatchesSent)
+}
+
+func TestEventBatcherDropsWhenQueueFull(t *testing.T) {
+	t.Parallel()
+	eb := &eventCapturingBackend{}
+	h := newTestBatchingBackendHandler(time.Hour, 2, eb)
+
+	// Nothing is batching, so the queue fills
+	for i := 0; i < eventBatchQueueBatches*2+3; i++ {
+		h.DispatchEvent(context.Background(), &gostatsd.Event{Title: fmt.Sprintf("e%d", i)})
+	}
+	assert.EqualValues(t, 3, h.eventsDropped)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.eventBatcher.Run(ctx)
+	h.WaitForEvents()
+	require.Len(t, eb.events, eventBatchQueueBatches*2)
+	assert.NotContains(t, eventTitles(eb.events), fmt.Sprintf("e%d", eventBatchQueueBatches*2))
+}
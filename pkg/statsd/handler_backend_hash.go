@@ -0,0 +1,182 @@
+package statsd
+
+import (
+	"fmt"
+	"hash/adler32"
+	"math/bits"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// workerHash picks the Aggregator each metric is sent to.  The result only depends on the key of the metric, so a
+// series is always aggregated by the same Aggregator for the lifetime of the process.
+type workerHash struct {
+	hash        func(key string, max int) int
+	includeTags bool // The tags are part of the key, so the series of a single name are spread across Aggregators
+}
+
+// newWorkerHash returns the workerHash for the named algorithm, or nil for the default of WorkerHashAdler32 without
+// the tags, which is gostatsd.Bucket.  An empty name is WorkerHashAdler32.
+func newWorkerHash(name string, includeTags bool) (*workerHash, error) {
+	var hash func(key string, max int) int
+	switch name {
+	case "", WorkerHashAdler32:
+		if !includeTags {
+			return nil, nil
+		}
+		hash = adler32Bucket
+	case WorkerHashFNV:
+		hash = fnvBucket
+	case WorkerHashXXHash:
+		hash = xxhashBucket
+	case WorkerHashJump:
+		hash = jumpBucket
+	default:
+		return nil, fmt.Errorf("invalid %s %q, must be one of %s, %s, %s or %s", ParamWorkerHash, name, WorkerHashAdler32, WorkerHashFNV, WorkerHashXXHash, WorkerHashJump)
+	}
+	return &workerHash{
+		hash:        hash,
+		includeTags: includeTags,
+	}, nil
+}
+
+// metricBucket returns the Aggregator of m, which must have its TagsKey set.  max is exclusive.
+func (wh *workerHash) metricBucket(m *gostatsd.Metric, max int) int {
+	return wh.bucket(m.Name, m.Hostname, m.TagsKey, max)
+}
+
+// mapBucket returns the Aggregator of a metric in a MetricMap.  max is exclusive.
+func (wh *workerHash) mapBucket(metricName, hostname string, tags gostatsd.Tags, max int) int {
+	tagsKey := ""
+	if wh.includeTags {
+		tagsKey = gostatsd.FormatTagsKey(hostname, tags)
+	}
+	return wh.bucket(metricName, hostname, tagsKey, max)
+}
+
+func (wh *workerHash) bucket(metricName, hostname, tagsKey string, max int) int {
+	key := metricName + "\x00" + hostname
+	if wh.includeTags {
+		key += "\x00" + tagsKey
+	}
+	return wh.hash(key, max)
+}
+
+func adler32Bucket(key string, max int) int {
+	return int(adler32.Checksum([]byte(key)) % uint32(max))
+}
+
+func fnvBucket(key string, max int) int {
+	return int(fnv64a(key) % uint64(max))
+}
+
+func xxhashBucket(key string, max int) int {
+	return int(xxhash64(key) % uint64(max))
+}
+
+func jumpBucket(key string, max int) int {
+	return jumpHash(xxhash64(key), max)
+}
+
+const (
+	fnvOffset64 = 14695981039346656037
+	fnvPrime64  = 1099511628211
+)
+
+// fnv64a is the 64 bit FNV-1a hash of s, the same as hash/fnv without converting s to a []byte.
+func fnv64a(s string) uint64 {
+	h := uint64(fnvOffset64)
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i])
+		h *= fnvPrime64
+	}
+	return h
+}
+
+const (
+	xxPrime1 uint64 = 11400714785074694791
+	xxPrime2 uint64 = 14029467366897019727
+	xxPrime3 uint64 = 1609587929392839161
+	xxPrime4 uint64 = 9650029242287828579
+	xxPrime5 uint64 = 2870177450012600261
+)
+
+// xxhash64 is the XXH64 hash of s with a seed of 0.
+func xxhash64(s string) uint64 {
+	n := len(s)
+	var h uint64
+	if n >= 32 {
+		prime1 := xxPrime1
+		v1 := prime1 + xxPrime2
+		v2 := xxPrime2
+		v3 := uint64(0)
+		v4 := -prime1
+		for ; len(s) >= 32; s = s[32:] {
+			v1 = xxRound(v1, readUint64(s[0:8]))
+			v2 = xxRound(v2, readUint64(s[8:16]))
+			v3 = xxRound(v3, readUint64(s[16:24]))
+			v4 = xxRound(v4, readUint64(s[24:32]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		h = xxMergeRound(h, v1)
+		h = xxMergeRound(h, v2)
+		h = xxMergeRound(h, v3)
+		h = xxMergeRound(h, v4)
+	} else {
+		h = xxPrime5
+	}
+	h += uint64(n)
+
+	for ; len(s) >= 8; s = s[8:] {
+		h ^= xxRound(0, readUint64(s[:8]))
+		h = bits.RotateLeft64(h, 27)*xxPrime1 + xxPrime4
+	}
+	if len(s) >= 4 {
+		h ^= uint64(readUint32(s[:4])) * xxPrime1
+		h = bits.RotateLeft64(h, 23)*xxPrime2 + xxPrime3
+		s = s[4:]
+	}
+	for i := 0; i < len(s); i++ {
+		h ^= uint64(s[i]) * xxPrime5
+		h = bits.RotateLeft64(h, 11) * xxPrime1
+	}
+
+	h ^= h >> 33
+	h *= xxPrime2
+	h ^= h >> 29
+	h *= xxPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxRound(acc, input uint64) uint64 {
+	acc += input * xxPrime2
+	acc = bits.RotateLeft64(acc, 31)
+	return acc * xxPrime1
+}
+
+func xxMergeRound(acc, val uint64) uint64 {
+	acc ^= xxRound(0, val)
+	return acc*xxPrime1 + xxPrime4
+}
+
+func readUint64(s string) uint64 {
+	return uint64(s[0]) | uint64(s[1])<<8 | uint64(s[2])<<16 | uint64(s[3])<<24 |
+		uint64(s[4])<<32 | uint64(s[5])<<40 | uint64(s[6])<<48 | uint64(s[7])<<56
+}
+
+func readUint32(s string) uint32 {
+	return uint32(s[0]) | uint32(s[1])<<8 | uint32(s[2])<<16 | uint32(s[3])<<24
+}
+
+// jumpHash is the jump consistent hash of key, from https://arxiv.org/abs/1406.2294.  It moves the fewest keys
+// between buckets when the number of buckets changes.
+func jumpHash(key uint64, numBuckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(numBuckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
@@ -0,0 +1,181 @@
+package statsd
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+var workerHashes = []string{WorkerHashAdler32, WorkerHashFNV, WorkerHashXXHash, WorkerHashJump}
+
+func TestXXHash64(t *testing.T) {
+	t.Parallel()
+	// Reference values from the xxHash implementation.
+	assert.Equal(t, uint64(0xef46db3751d8e999), xxhash64(""))
+	assert.Equal(t, uint64(0xd24ec4f1a98c6e5b), xxhash64("a"))
+	assert.Equal(t, uint64(0x44bc2cf5ad770999), xxhash64("abc"))
+	assert.Equal(t, uint64(0xfbcea83c8a378bf1), xxhash64("Nobody inspects the spammish repetition"))
+}
+
+func TestFNV64a(t *testing.T) {
+	t.Parallel()
+	for _, s := range []string{"", "a", "metric.name\x00host", "Nobody inspects the spammish repetition"} {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(s))
+		assert.Equal(t, h.Sum64(), fnv64a(s), s)
+	}
+}
+
+func TestJumpHash(t *testing.T) {
+	t.Parallel()
+	// Growing the number of buckets only moves keys to the new bucket.
+	for key := uint64(0); key < 1000; key++ {
+		before := jumpHash(key, 10)
+		after := jumpHash(key, 11)
+		assert.True(t, after == before || after == 10, "key %d moved from %d to %d", key, before, after)
+	}
+}
+
+func TestNewWorkerHash(t *testing.T) {
+	t.Parallel()
+	wh, err := newWorkerHash("", false)
+	require.NoError(t, err)
+	assert.Nil(t, wh)
+	wh, err = newWorkerHash(WorkerHashAdler32, false)
+	require.NoError(t, err)
+	assert.Nil(t, wh)
+	wh, err = newWorkerHash(WorkerHashAdler32, true)
+	require.NoError(t, err)
+	assert.NotNil(t, wh)
+	_, err = newWorkerHash("md5", false)
+	assert.Error(t, err)
+}
+
+func TestWorkerHashConsistent(t *testing.T) {
+	t.Parallel()
+	for _, name := range workerHashes {
+		for _, includeTags := range []bool{false, true} {
+			wh, err := newWorkerHash(name, includeTags)
+			require.NoError(t, err)
+			if wh == nil {
+				continue
+			}
+			for i := 0; i < 100; i++ {
+				m := &gostatsd.Metric{
+					Name:     fmt.Sprintf("metric.%d", i%10),
+					Hostname: "host",
+					Tags:     gostatsd.Tags{fmt.Sprintf("id:%d", i), "env:prod"},
+				}
+				m.TagsKey = m.FormatTagsKey()
+				bucket := wh.metricBucket(m, 7)
+				require.True(t, bucket >= 0 && bucket < 7)
+				// The same series maps to the same worker every time, whether it is received as a metric or in a
+				// MetricMap, so it is always aggregated in one place.
+				assert.Equal(t, bucket, wh.metricBucket(m, 7))
+				assert.Equal(t, bucket, wh.mapBucket(m.Name, m.Hostname, gostatsd.Tags{"env:prod", fmt.Sprintf("id:%d", i)}, 7))
+			}
+		}
+	}
+}
+
+func TestWorkerHashTagsSpreadsName(t *testing.T) {
+	t.Parallel()
+	for _, name := range workerHashes {
+		buckets := func(includeTags bool) map[int]struct{} {
+			wh, err := newWorkerHash(name, includeTags)
+			require.NoError(t, err)
+			seen := map[int]struct{}{}
+			for i := 0; i < 100; i++ {
+				m := &gostatsd.Metric{Name: "hot.metric", Tags: gostatsd.Tags{fmt.Sprintf("id:%d", i)}}
+				m.TagsKey = m.FormatTagsKey()
+				if wh == nil {
+					seen[m.Bucket(8)] = struct{}{}
+				} else {
+					seen[wh.metricBucket(m, 8)] = struct{}{}
+				}
+			}
+			return seen
+		}
+		assert.Len(t, buckets(false), 1, name)
+		assert.True(t, len(buckets(true)) > 4, name)
+	}
+}
+
+// workerHashCorpus returns series resembling a real workload, with the number of datapoints received for each.  A few
+// hot names are received often with many tag sets, and most names are received rarely with few tag sets.
+func workerHashCorpus() ([]*gostatsd.Metric, []int) {
+	var series []*gostatsd.Metric
+	var volumes []int
+	services := []string{"api", "web", "billing", "search", "auth", "queue", "cache", "db"}
+	for s, service := range services {
+		for n := 0; n < 50; n++ {
+			name := fmt.Sprintf("%s.handler%d.requests", service, n)
+			tagSets, volume := 3, 1
+			if n == 0 && s < 3 {
+				tagSets, volume = 200, 100
+			}
+			for i := 0; i < tagSets; i++ {
+				m := &gostatsd.Metric{
+					Name:     name,
+					Hostname: fmt.Sprintf("%s-%d", service, i%10),
+					Tags:     gostatsd.Tags{fmt.Sprintf("status:%d", 200+i%5), fmt.Sprintf("endpoint:/v1/%d", i), "env:prod"},
+				}
+				m.TagsKey = m.FormatTagsKey()
+				series = append(series, m)
+				volumes = append(volumes, volume)
+			}
+		}
+	}
+	return series, volumes
+}
+
+// BenchmarkWorkerHashDistribution reports how evenly each hash spreads the datapoints of workerHashCorpus across 8
+// workers, as the ratio of the busiest worker to the mean (1 is perfectly even), and the coefficient of variation.
+func BenchmarkWorkerHashDistribution(b *testing.B) {
+	const workers = 8
+	series, volumes := workerHashCorpus()
+	for _, name := range workerHashes {
+		for _, includeTags := range []bool{false, true} {
+			name, includeTags := name, includeTags
+			b.Run(fmt.Sprintf("%s/tags=%t", name, includeTags), func(b *testing.B) {
+				wh, err := newWorkerHash(name, includeTags)
+				require.NoError(b, err)
+				var load [workers]float64
+				b.ReportAllocs()
+				b.ResetTimer()
+				for n := 0; n < b.N; n++ {
+					load = [workers]float64{}
+					for i, m := range series {
+						var bucket int
+						if wh == nil {
+							bucket = m.Bucket(workers)
+						} else {
+							bucket = wh.metricBucket(m, workers)
+						}
+						load[bucket] += float64(volumes[i])
+					}
+				}
+				b.StopTimer()
+
+				var total, max float64
+				for _, l := range load {
+					total += l
+					max = math.Max(max, l)
+				}
+				mean := total / workers
+				var variance float64
+				for _, l := range load {
+					variance += (l - mean) * (l - mean) / workers
+				}
+				b.ReportMetric(max/mean, "max/mean")
+				b.ReportMetric(math.Sqrt(variance)/mean, "cv")
+			})
+		}
+	}
+}
@@ -14,6 +14,8 @@ import (
 
 	"github.com/ash2k/stager/wait"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
 )
 
 type testAggregator struct {
@@ -156,6 +158,74 @@ func TestDispatchMetricsShouldDistributeMetrics(t *testing.T) {
 	}
 }
 
+func TestEmitQueueDepths(t *testing.T) {
+	t.Parallel()
+	// The workers aren't run, so the metrics stay queued.
+	h := NewBackendHandler(nil, 0, 2, 10, newTestFactory())
+	h.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "a", Type: gostatsd.COUNTER, Value: 1}})
+	h.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "a", Type: gostatsd.COUNTER, Value: 1}})
+	statser := &backendGaugeStatser{Statser: stats.NewNullStatser(), gauges: map[string]float64{}}
+
+	// Every worker is sent a batch for each dispatch, even if it is empty.
+	h.emitQueueDepths(statser)
+	assert.EqualValues(t, 2, statser.gauges["backend_handler.queue_depth aggregator_id:0"])
+	assert.EqualValues(t, 2, statser.gauges["backend_handler.queue_depth aggregator_id:1"])
+	assert.EqualValues(t, 10, statser.gauges["backend_handler.queue_size "])
+}
+
+func TestResizeWorkersKeepsAggregatorAffinity(t *testing.T) {
+	t.Parallel()
+	const numAggregators = 4
+	factory := newTestFactory()
+	h := NewBackendHandler(nil, 0, numAggregators, 10, factory)
+	ctx, cancelFunc := context.WithCancel(context.Background())
+	defer cancelFunc()
+	var wgFinish wait.Group
+	wgFinish.StartWithContext(ctx, h.Run)
+	h.Process(ctx, func(int, Aggregator) {})() // Wait for the workers to start
+
+	var wgResize wait.Group
+	resizeCtx, cancelResize := context.WithCancel(ctx)
+	wgResize.StartWithContext(resizeCtx, func(ctx context.Context) {
+		for n := 1; ctx.Err() == nil; n++ {
+			h.resizeWorkers(n%numAggregators + 1)
+		}
+	})
+
+	expected := make(map[int]int, numAggregators)
+	for i := 0; i < 1000; i++ {
+		m := &gostatsd.Metric{
+			Type:  gostatsd.COUNTER,
+			Name:  fmt.Sprintf("counter.metric.%d", i%50),
+			Value: 1,
+		}
+		expected[m.Bucket(numAggregators)]++
+		h.DispatchMetrics(ctx, []*gostatsd.Metric{m})
+	}
+	cancelResize()
+	wgResize.Wait()
+	cancelFunc()
+	wgFinish.Wait()
+
+	factory.Lock()
+	defer factory.Unlock()
+	for agrNum := 0; agrNum < numAggregators; agrNum++ {
+		assert.Equalf(t, expected[agrNum], factory.receiveInvocations[agrNum], "aggregator=%d", agrNum)
+	}
+}
+
+func TestScaledWorkers(t *testing.T) {
+	t.Parallel()
+	h := NewBackendHandler(nil, 0, 4, 10, newTestFactory())
+	h.minWorkers = 2
+
+	assert.Equal(t, 3, h.scaledWorkers(2, 0.5))
+	assert.Equal(t, 4, h.scaledWorkers(4, 1))
+	assert.Equal(t, 3, h.scaledWorkers(3, 0.3))
+	assert.Equal(t, 2, h.scaledWorkers(3, 0.1))
+	assert.Equal(t, 2, h.scaledWorkers(2, 0))
+}
+
 func TestDispatchMetricMapShouldDistributeMetrics(t *testing.T) {
 	t.Parallel()
 	r := rand.New(rand.NewSource(time.Now().UnixNano()))
@@ -206,6 +276,49 @@ func getTotalInvocations(inv map[int]int) int {
 	return counter
 }
 
+type eventCapturingBackend struct {
+	mu     sync.Mutex
+	events []*gostatsd.Event
+}
+
+func (eb *eventCapturingBackend) Name() string {
+	return "eventCapturingBackend"
+}
+
+func (eb *eventCapturingBackend) SendMetricsAsync(ctx context.Context, mm *gostatsd.MetricMap, callback gostatsd.SendCallback) {
+	callback(nil)
+}
+
+func (eb *eventCapturingBackend) SendEvent(ctx context.Context, e *gostatsd.Event) error {
+	eb.mu.Lock()
+	eb.events = append(eb.events, e)
+	eb.mu.Unlock()
+	return nil
+}
+
+func TestDispatchEventLimits(t *testing.T) {
+	t.Parallel()
+	eb := &eventCapturingBackend{}
+	h := NewBackendHandler([]gostatsd.Backend{eb}, 10, 1, 1, newTestFactory())
+	h.eventLimiter = rate.NewLimiter(rate.Every(time.Hour), 2)
+	h.maxEventSize = 5
+
+	h.DispatchEvent(context.Background(), &gostatsd.Event{Title: "a", Text: "short"})
+	h.DispatchEvent(context.Background(), &gostatsd.Event{Title: "b", Text: "abcd\u00e9f"})
+	h.DispatchEvent(context.Background(), &gostatsd.Event{Title: "c", Text: "dropped"})
+	h.WaitForEvents()
+
+	require.Len(t, eb.events, 2)
+	texts := map[string]string{}
+	for _, e := range eb.events {
+		texts[e.Title] = e.Text
+	}
+	// The multi-byte character would be split at 5 bytes, so it is dropped
+	assert.Equal(t, map[string]string{"a": "short", "b": "abcd"}, texts)
+	assert.EqualValues(t, 1, h.eventsDropped)
+	assert.EqualValues(t, 1, h.eventsTruncated)
+}
+
 func BenchmarkBackendHandler(b *testing.B) {
 	rand.Seed(time.Now().UnixNano())
 	factory := newTestFactory()
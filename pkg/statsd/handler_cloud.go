@@ -113,6 +113,11 @@ func (f *CloudHandlerFactory) InitCloudProvider(v *viper.Viper) error {
 	return nil
 }
 
+// CloudProvider returns the cloud provider, which is nil until InitCloudProvider has been called.
+func (f *CloudHandlerFactory) CloudProvider() gostatsd.CloudProvider {
+	return f.cloudProvider
+}
+
 // NewCloudHandler creates a new Cloud Handler based on the options set in the CloudHandlerFactory.
 func (f *CloudHandlerFactory) NewCloudHandler(handler gostatsd.PipelineHandler) *CloudHandler {
 	return NewCloudHandler(f.cloudProvider, handler, f.logger, f.limiter, f.cacheOptions)
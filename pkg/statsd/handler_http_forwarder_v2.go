@@ -2,6 +2,7 @@ package statsd
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
 	"context"
 	"fmt"
@@ -29,12 +30,33 @@ import (
 const (
 	defaultConsolidatorFlushInterval = 1 * time.Second
 	defaultCompress                  = true
+	defaultCompressEncoding          = CompressEncodingDeflate
 	defaultApiEndpoint               = ""
 	defaultMaxRequestElapsedTime     = 30 * time.Second
 	defaultMaxRequests               = 1000
 	defaultTransport                 = "default"
 )
 
+const (
+	// CompressEncodingDeflate is the Content-Encoding of forwarded messages compressed with zlib.
+	CompressEncodingDeflate = "deflate"
+	// CompressEncodingGzip is the Content-Encoding of forwarded messages compressed with gzip.
+	CompressEncodingGzip = "gzip"
+)
+
+// ForwardEndpoint is a gostatsd server which metrics are forwarded to.  Each endpoint receives a share of the
+// forwarded messages proportional to its Weight.
+type ForwardEndpoint struct {
+	ApiEndpoint string
+	Weight      int
+}
+
+// weightedEndpoint is a ForwardEndpoint and its current weight for smooth weighted round-robin.
+type weightedEndpoint struct {
+	ForwardEndpoint
+	current int
+}
+
 // HttpForwarderHandlerV2 is a PipelineHandler which sends metrics to another gostatsd instance
 type HttpForwarderHandlerV2 struct {
 	postId          uint64 // atomic - used for an id in logs
@@ -45,7 +67,8 @@ type HttpForwarderHandlerV2 struct {
 	messagesDropped uint64 // atomic - final failure
 
 	logger                logrus.FieldLogger
-	apiEndpoint           string
+	endpointsLock         sync.Mutex
+	endpoints             []*weightedEndpoint
 	maxRequestElapsedTime time.Duration
 	metricsSem            chan struct{}
 	client                *http.Client
@@ -53,6 +76,7 @@ type HttpForwarderHandlerV2 struct {
 	consolidatedMetrics   <-chan []*gostatsd.MetricMap
 	eventWg               sync.WaitGroup
 	compress              bool
+	compressEncoding      string
 	headers               map[string]string
 }
 
@@ -61,19 +85,27 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 	subViper := util.GetSubViper(v, "http-transport")
 	subViper.SetDefault("transport", defaultTransport)
 	subViper.SetDefault("compress", defaultCompress)
+	subViper.SetDefault("compress-encoding", defaultCompressEncoding)
 	subViper.SetDefault("api-endpoint", defaultApiEndpoint)
 	subViper.SetDefault("max-requests", defaultMaxRequests)
 	subViper.SetDefault("max-request-elapsed-time", defaultMaxRequestElapsedTime)
 	subViper.SetDefault("consolidator-slots", v.GetInt(ParamMaxParsers))
 	subViper.SetDefault("flush-interval", defaultConsolidatorFlushInterval)
+	subViper.SetDefault("endpoints", []string{})
+
+	endpoints, err := forwardEndpointsFromViper(subViper)
+	if err != nil {
+		return nil, err
+	}
 
 	return NewHttpForwarderHandlerV2(
 		logger,
 		subViper.GetString("transport"),
-		subViper.GetString("api-endpoint"),
+		endpoints,
 		subViper.GetInt("consolidator-slots"),
 		subViper.GetInt("max-requests"),
 		subViper.GetBool("compress"),
+		subViper.GetString("compress-encoding"),
 		subViper.GetDuration("max-request-elapsed-time"),
 		subViper.GetDuration("flush-interval"),
 		subViper.GetStringMapString("custom-headers"),
@@ -81,21 +113,59 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 	)
 }
 
-// NewHttpForwarderHandlerV2 returns a new handler which dispatches metrics over http to another gostatsd server.
+// forwardEndpointsFromViper returns the api-endpoint, if set, with a weight of 1, and each of the endpoints named in
+// endpoints, configured in sections named endpoint.<name>.
+func forwardEndpointsFromViper(v *viper.Viper) ([]ForwardEndpoint, error) {
+	var endpoints []ForwardEndpoint
+	if apiEndpoint := v.GetString("api-endpoint"); apiEndpoint != "" {
+		endpoints = append(endpoints, ForwardEndpoint{ApiEndpoint: apiEndpoint, Weight: 1})
+	}
+	for _, name := range v.GetStringSlice("endpoints") {
+		vEndpoint := v.Sub("endpoint." + name)
+		if vEndpoint == nil {
+			return nil, fmt.Errorf("endpoint %s is not configured", name)
+		}
+		vEndpoint.SetDefault("api-endpoint", "")
+		vEndpoint.SetDefault("weight", 1)
+		endpoints = append(endpoints, ForwardEndpoint{
+			ApiEndpoint: vEndpoint.GetString("api-endpoint"),
+			Weight:      vEndpoint.GetInt("weight"),
+		})
+	}
+	return endpoints, nil
+}
+
+// NewHttpForwarderHandlerV2 returns a new handler which dispatches metrics over http to another gostatsd server.  If
+// compress is set, messages are compressed with compressEncoding, which is CompressEncodingDeflate or
+// CompressEncodingGzip.
 func NewHttpForwarderHandlerV2(
 	logger logrus.FieldLogger,
-	transport,
-	apiEndpoint string,
+	transport string,
+	apiEndpoints []ForwardEndpoint,
 	consolidatorSlots,
 	maxRequests int,
 	compress bool,
+	compressEncoding string,
 	maxRequestElapsedTime time.Duration,
 	flushInterval time.Duration,
 	xheaders map[string]string,
 	pool *transport.TransportPool,
 ) (*HttpForwarderHandlerV2, error) {
-	if apiEndpoint == "" {
-		return nil, fmt.Errorf("api-endpoint is required")
+	if len(apiEndpoints) == 0 {
+		return nil, fmt.Errorf("api-endpoint or endpoints is required")
+	}
+	endpoints := make([]*weightedEndpoint, 0, len(apiEndpoints))
+	for _, endpoint := range apiEndpoints {
+		if endpoint.ApiEndpoint == "" {
+			return nil, fmt.Errorf("api-endpoint is required for every endpoint")
+		}
+		if endpoint.Weight <= 0 {
+			return nil, fmt.Errorf("weight must be positive for endpoint %s", endpoint.ApiEndpoint)
+		}
+		endpoints = append(endpoints, &weightedEndpoint{ForwardEndpoint: endpoint})
+	}
+	if compress && compressEncoding != CompressEncodingDeflate && compressEncoding != CompressEncodingGzip {
+		return nil, fmt.Errorf("compress-encoding must be %s or %s", CompressEncodingDeflate, CompressEncodingGzip)
 	}
 	if consolidatorSlots <= 0 {
 		return nil, fmt.Errorf("consolidator-slots must be positive")
@@ -117,8 +187,9 @@ func NewHttpForwarderHandlerV2(
 	}
 
 	logger.WithFields(logrus.Fields{
-		"api-endpoint":             apiEndpoint,
+		"api-endpoints":            apiEndpoints,
 		"compress":                 compress,
+		"compress-encoding":        compressEncoding,
 		"max-request-elapsed-time": maxRequestElapsedTime,
 		"max-requests":             maxRequests,
 		"consolidator-slots":       consolidatorSlots,
@@ -148,10 +219,11 @@ func NewHttpForwarderHandlerV2(
 
 	return &HttpForwarderHandlerV2{
 		logger:                logger.WithField("component", "http-forwarder-handler-v2"),
-		apiEndpoint:           apiEndpoint,
+		endpoints:             endpoints,
 		maxRequestElapsedTime: maxRequestElapsedTime,
 		metricsSem:            metricsSem,
 		compress:              compress,
+		compressEncoding:      compressEncoding,
 		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
 		consolidatedMetrics:   ch,
 		client:                httpClient.Client,
@@ -159,6 +231,29 @@ func NewHttpForwarderHandlerV2(
 	}, nil
 }
 
+// nextEndpoint returns the endpoint the next message should be sent to.  Endpoints are chosen by smooth weighted
+// round-robin, so each receives a share of the messages proportional to its weight, interleaved with the others.
+func (hfh *HttpForwarderHandlerV2) nextEndpoint() string {
+	if len(hfh.endpoints) == 1 {
+		return hfh.endpoints[0].ApiEndpoint
+	}
+
+	hfh.endpointsLock.Lock()
+	defer hfh.endpointsLock.Unlock()
+
+	total := 0
+	var best *weightedEndpoint
+	for _, endpoint := range hfh.endpoints {
+		endpoint.current += endpoint.Weight
+		total += endpoint.Weight
+		if best == nil || endpoint.current > best.current {
+			best = endpoint
+		}
+	}
+	best.current -= total
+	return best.ApiEndpoint
+}
+
 func (hfh *HttpForwarderHandlerV2) EstimatedTags() int {
 	return 0
 }
@@ -257,6 +352,7 @@ func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
 				Tags:     metric.Tags,
 				Hostname: metric.Hostname,
 				Value:    metric.Value,
+				Delta:    metric.Delta,
 			}
 		}
 	}
@@ -302,6 +398,19 @@ func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
 		}
 	}
 
+	pbMetricMap.Distributions = map[string]*pb.TimerTagV2{}
+	for metricName, m := range metricMap.Distributions {
+		pbMetricMap.Distributions[metricName] = &pb.TimerTagV2{TagMap: map[string]*pb.RawTimerV2{}}
+		for tagsKey, metric := range m {
+			pbMetricMap.Distributions[metricName].TagMap[tagsKey] = &pb.RawTimerV2{
+				Tags:        metric.Tags,
+				Hostname:    metric.Hostname,
+				SampleCount: metric.SampledCount,
+				Values:      metric.Values,
+			}
+		}
+	}
+
 	return &pbMetricMap
 }
 
@@ -311,12 +420,14 @@ func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, metricMap *g
 }
 
 func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Message, id uint64, endpointType, endpoint string) {
+	apiEndpoint := hfh.nextEndpoint()
 	logger := hfh.logger.WithFields(logrus.Fields{
-		"id":   id,
-		"type": endpointType,
+		"id":           id,
+		"type":         endpointType,
+		"api-endpoint": apiEndpoint,
 	})
 
-	post, err := hfh.constructPost(ctx, logger, hfh.apiEndpoint+endpoint, message)
+	post, err := hfh.constructPost(ctx, logger, apiEndpoint+endpoint, message)
 	if err != nil {
 		atomic.AddUint64(&hfh.messagesInvalid, 1)
 		logger.WithError(err).Error("failed to create request")
@@ -381,7 +492,12 @@ func (hfh *HttpForwarderHandlerV2) serializeAndCompress(message proto.Message) (
 	}
 
 	buf := &bytes.Buffer{}
-	compressor, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	var compressor io.WriteCloser
+	if hfh.compressEncoding == CompressEncodingGzip {
+		compressor, err = gzip.NewWriterLevel(buf, gzip.BestCompression)
+	} else {
+		compressor, err = zlib.NewWriterLevel(buf, zlib.BestCompression)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -402,7 +518,7 @@ func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger log
 
 	if hfh.compress {
 		body, err = hfh.serializeAndCompress(message)
-		encoding = "deflate"
+		encoding = hfh.compressEncoding
 	} else {
 		body, err = hfh.serialize(message)
 		encoding = "identity"
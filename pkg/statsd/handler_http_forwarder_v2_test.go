@@ -1,10 +1,17 @@
 package statsd
 
 import (
+	"bytes"
+	"math"
 	"testing"
+	"time"
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/transport"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -28,6 +35,15 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 			Rate:     0.1, // ignored
 			Type:     gostatsd.GAUGE,
 		},
+		{
+			Name:       "TestHttpForwarderTranslation.gaugedelta",
+			Value:      -12,
+			Tags:       gostatsd.Tags{"TestHttpForwarderTranslation.gaugedelta.tag1", "TestHttpForwarderTranslation.gaugedelta.tag2"},
+			Hostname:   "TestHttpForwarderTranslation.gaugedelta.host",
+			Rate:       1,
+			Type:       gostatsd.GAUGE,
+			GaugeDelta: true,
+		},
 		{
 			Name:     "TestHttpForwarderTranslation.counter",
 			Value:    12347,
@@ -76,6 +92,14 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 			Rate:        0.1, // ignored
 			Type:        gostatsd.SET,
 		},
+		{
+			Name:     "TestHttpForwarderTranslation.distribution",
+			Value:    12353,
+			Tags:     gostatsd.Tags{"TestHttpForwarderTranslation.distribution.tag1", "TestHttpForwarderTranslation.distribution.tag2"},
+			Hostname: "TestHttpForwarderTranslation.distribution.host",
+			Rate:     0.1, // propagated
+			Type:     gostatsd.DISTRIBUTION,
+		},
 	}
 
 	mm := gostatsd.NewMetricMap()
@@ -105,6 +129,16 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 					},
 				},
 			},
+			"TestHttpForwarderTranslation.gaugedelta": {
+				TagMap: map[string]*pb.RawGaugeV2{
+					"TestHttpForwarderTranslation.gaugedelta.tag1,TestHttpForwarderTranslation.gaugedelta.tag2,s:TestHttpForwarderTranslation.gaugedelta.host": {
+						Tags:     []string{"TestHttpForwarderTranslation.gaugedelta.tag1", "TestHttpForwarderTranslation.gaugedelta.tag2"},
+						Hostname: "TestHttpForwarderTranslation.gaugedelta.host",
+						Value:    -12,
+						Delta:    true,
+					},
+				},
+			},
 		},
 		Counters: map[string]*pb.CounterTagV2{
 			"TestHttpForwarderTranslation.counter": {
@@ -168,12 +202,106 @@ func TestHttpForwarderV2Translation(t *testing.T) {
 				},
 			},
 		},
+		Distributions: map[string]*pb.TimerTagV2{
+			"TestHttpForwarderTranslation.distribution": {
+				TagMap: map[string]*pb.RawTimerV2{
+					"TestHttpForwarderTranslation.distribution.tag1,TestHttpForwarderTranslation.distribution.tag2,s:TestHttpForwarderTranslation.distribution.host": {
+						Tags:        []string{"TestHttpForwarderTranslation.distribution.tag1", "TestHttpForwarderTranslation.distribution.tag2"},
+						Hostname:    "TestHttpForwarderTranslation.distribution.host",
+						SampleCount: 10,
+						Values:      []float64{12353},
+					},
+				},
+			},
+		},
 	}
 	//require.EqualValues(t, expected, pbMetrics)
 	require.EqualValues(t, expected.Gauges, pbMetrics.Gauges)
 	require.EqualValues(t, expected.Counters, pbMetrics.Counters)
 	require.EqualValues(t, expected.Timers, pbMetrics.Timers)
 	require.EqualValues(t, expected.Sets, pbMetrics.Sets)
+	require.EqualValues(t, expected.Distributions, pbMetrics.Distributions)
+}
+
+func TestHttpForwarderV2TranslationInvalidRates(t *testing.T) {
+	t.Parallel()
+
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "counter", Value: 5, Rate: 0, Type: gostatsd.COUNTER})
+	mm.Receive(&gostatsd.Metric{Name: "timer", Value: 6, Rate: -1, Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "timer", Value: 7, Rate: math.NaN(), Type: gostatsd.TIMER})
+	mm.Receive(&gostatsd.Metric{Name: "distribution", Value: 8, Rate: 0, Type: gostatsd.DISTRIBUTION})
+
+	pbMetrics := translateToProtobufV2(mm)
+
+	// An invalid sample rate is treated as 1, rather than forwarding an infinite or NaN count.
+	assert.EqualValues(t, 5, pbMetrics.Counters["counter"].TagMap[""].Value)
+	assert.EqualValues(t, 2, pbMetrics.Timers["timer"].TagMap[""].SampleCount)
+	assert.Equal(t, []float64{6, 7}, pbMetrics.Timers["timer"].TagMap[""].Values)
+	assert.EqualValues(t, 1, pbMetrics.Distributions["distribution"].TagMap[""].SampleCount)
+}
+
+func TestHttpForwarderV2EndpointsFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+max-parsers=1
+
+[http-transport]
+endpoints='large small'
+
+[http-transport.endpoint.large]
+api-endpoint='http://large'
+weight=2
+
+[http-transport.endpoint.small]
+api-endpoint='http://small'
+`))
+	require.NoError(t, err)
+
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	hfh, err := NewHttpForwarderHandlerV2FromViper(logrus.New(), v, p)
+	require.NoError(t, err)
+	require.Len(t, hfh.endpoints, 2)
+	assert.Equal(t, ForwardEndpoint{ApiEndpoint: "http://large", Weight: 2}, hfh.endpoints[0].ForwardEndpoint)
+	assert.Equal(t, ForwardEndpoint{ApiEndpoint: "http://small", Weight: 1}, hfh.endpoints[1].ForwardEndpoint)
+
+	v.Set("http-transport.endpoints", []string{"missing"})
+	_, err = NewHttpForwarderHandlerV2FromViper(logrus.New(), v, p)
+	require.Error(t, err)
+}
+
+func TestHttpForwarderV2EndpointWeights(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	newHandler := func(endpoints ...ForwardEndpoint) (*HttpForwarderHandlerV2, error) {
+		return NewHttpForwarderHandlerV2(logrus.New(), "default", endpoints, 1, 1, false, "", time.Second, time.Second, nil, p)
+	}
+
+	_, err := newHandler()
+	require.Error(t, err)
+	_, err = newHandler(ForwardEndpoint{ApiEndpoint: "http://a", Weight: 0})
+	require.Error(t, err)
+
+	hfh, err := newHandler(
+		ForwardEndpoint{ApiEndpoint: "http://a", Weight: 2},
+		ForwardEndpoint{ApiEndpoint: "http://b", Weight: 1},
+	)
+	require.NoError(t, err)
+
+	// Smooth weighted round-robin interleaves the endpoints rather than sending runs to each.
+	var order []string
+	for i := 0; i < 6; i++ {
+		order = append(order, hfh.nextEndpoint())
+	}
+	assert.Equal(t, []string{"http://a", "http://b", "http://a", "http://a", "http://b", "http://a"}, order)
+
+	counts := map[string]int{}
+	for i := 0; i < 300; i++ {
+		counts[hfh.nextEndpoint()]++
+	}
+	assert.Equal(t, map[string]int{"http://a": 200, "http://b": 100}, counts)
 }
 
 func BenchmarkHttpForwarderV2TranslateAll(b *testing.B) {
@@ -202,3 +330,26 @@ func BenchmarkHttpForwarderV2TranslateAll(b *testing.B) {
 		translateToProtobufV2(mm)
 	}
 }
+
+func TestHttpForwarderV2CompressEncoding(t *testing.T) {
+	t.Parallel()
+	p := transport.NewTransportPool(logrus.New(), viper.New())
+	endpoints := []ForwardEndpoint{{ApiEndpoint: "http://a", Weight: 1}}
+	newHandler := func(compress bool, compressEncoding string) (*HttpForwarderHandlerV2, error) {
+		return NewHttpForwarderHandlerV2(logrus.New(), "default", endpoints, 1, 1, compress, compressEncoding, time.Second, time.Second, nil, p)
+	}
+
+	for _, encoding := range []string{CompressEncodingDeflate, CompressEncodingGzip} {
+		hfh, err := newHandler(true, encoding)
+		require.NoError(t, err)
+		body, err := hfh.serializeAndCompress(&pb.RawMessageV2{})
+		require.NoError(t, err)
+		assert.NotEmpty(t, body, encoding)
+	}
+
+	_, err := newHandler(true, "br")
+	require.Error(t, err)
+	// The encoding is ignored when the payload isn't compressed.
+	_, err = newHandler(false, "br")
+	require.NoError(t, err)
+}
@@ -0,0 +1,255 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// NameRewriteRule replaces every match of Pattern in the name of a metric with Replacement, which can refer to the
+// captures of Pattern as $1 or ${name}, see regexp.Regexp.Expand.
+type NameRewriteRule struct {
+	Name        string
+	Pattern     *regexp.Regexp
+	Replacement string
+
+	rewritten uint64 // Number of metrics which were rewritten, must be accessed atomically
+}
+
+// NameRewriteHandler rewrites the names of metrics, dropping any which are rewritten to an empty name.
+type NameRewriteHandler struct {
+	dropped uint64 // Number of metrics dropped, must be accessed atomically
+
+	handler gostatsd.PipelineHandler
+	mu      sync.RWMutex // Guards rules, which are replaced by Reload
+	rules   []*NameRewriteRule
+}
+
+// NewNameRewriteRuleFromViper creates a new NameRewriteRule given a *viper.Viper
+func NewNameRewriteRuleFromViper(name string, v *viper.Viper) (*NameRewriteRule, error) {
+	v.SetDefault("pattern", "")
+	v.SetDefault("replacement", "")
+
+	if v.GetString("pattern") == "" {
+		return nil, fmt.Errorf("pattern is required")
+	}
+	pattern, err := regexp.Compile(v.GetString("pattern"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", v.GetString("pattern"), err)
+	}
+	return &NameRewriteRule{
+		Name:        name,
+		Pattern:     pattern,
+		Replacement: v.GetString("replacement"),
+	}, nil
+}
+
+// NewNameRewriteHandlerFromViper creates a new NameRewriteHandler from the rules named in name-rewrite-rules.  If
+// no rules are configured, the provided handler is returned unchanged.
+func NewNameRewriteHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) (gostatsd.PipelineHandler, error) {
+	rules, err := NewNameRewriteRulesFromViper(v)
+	if err != nil {
+		return nil, err
+	}
+	if len(rules) == 0 {
+		return handler, nil
+	}
+	return NewNameRewriteHandler(handler, rules), nil
+}
+
+// NewNameRewriteRulesFromViper creates the rules named in name-rewrite-rules given a *viper.Viper
+func NewNameRewriteRulesFromViper(v *viper.Viper) ([]*NameRewriteRule, error) {
+	ruleNameList := v.GetStringSlice(ParamNameRewriteRules)
+	var rules []*NameRewriteRule
+	for _, ruleName := range ruleNameList {
+		vRule := v.Sub("name-rewrite." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Name rewrite rule doesn't exist: %v", ruleName)
+			continue
+		}
+		rule, err := NewNameRewriteRuleFromViper(ruleName, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("name rewrite rule %v: %v", ruleName, err)
+		}
+		rules = append(rules, rule)
+		logrus.Infof("Loaded name rewrite rule %v", ruleName)
+	}
+	return rules, nil
+}
+
+// NewNameRewriteHandler initialises a new handler which applies each rule in order to the names of metrics, and
+// passes them to the next handler.
+func NewNameRewriteHandler(handler gostatsd.PipelineHandler, rules []*NameRewriteRule) *NameRewriteHandler {
+	return &NameRewriteHandler{
+		handler: handler,
+		rules:   rules,
+	}
+}
+
+// Reload replaces the rules.  The count of metrics rewritten by a rule carries over to the new rule of the same
+// name.
+func (nrh *NameRewriteHandler) Reload(rules []*NameRewriteRule) {
+	nrh.mu.Lock()
+	defer nrh.mu.Unlock()
+	for _, rule := range rules {
+		for _, old := range nrh.rules {
+			if old.Name == rule.Name {
+				atomic.AddUint64(&rule.rewritten, atomic.LoadUint64(&old.rewritten))
+				break
+			}
+		}
+	}
+	nrh.rules = rules
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (nrh *NameRewriteHandler) EstimatedTags() int {
+	return nrh.handler.EstimatedTags()
+}
+
+// RunMetrics emits the number of metrics rewritten by each rule, and the number dropped once there are rules.
+func (nrh *NameRewriteHandler) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			nrh.mu.RLock()
+			rules := nrh.rules
+			nrh.mu.RUnlock()
+			for _, rule := range rules {
+				statser.Gauge("name_rewrite.rewritten", float64(atomic.LoadUint64(&rule.rewritten)), gostatsd.Tags{"rule:" + rule.Name})
+			}
+			// Nothing is reported until there are rules, as the handler is always in the pipeline
+			if dropped := atomic.LoadUint64(&nrh.dropped); len(rules) > 0 || dropped > 0 {
+				statser.Gauge("name_rewrite.dropped", float64(dropped), nil)
+			}
+		}
+	}
+}
+
+// DispatchMetrics rewrites the name of each metric and passes them to the next stage in the pipeline.  The metrics
+// rewritten to an empty name are released.
+func (nrh *NameRewriteHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	kept := metrics[:0]
+	dropped := 0
+	nrh.mu.RLock()
+	for _, m := range metrics {
+		m.Name = nrh.rewrite(m.Name)
+		if m.Name == "" {
+			dropped++
+			m.Done()
+			continue
+		}
+		kept = append(kept, m)
+	}
+	nrh.mu.RUnlock()
+	if dropped > 0 {
+		atomic.AddUint64(&nrh.dropped, uint64(dropped))
+		if len(kept) == 0 {
+			return
+		}
+	}
+	nrh.handler.DispatchMetrics(ctx, kept)
+}
+
+// DispatchMetricMap rewrites the name of each consolidated metric in the map and passes it to the next stage in the
+// pipeline.  Metrics which are rewritten to the same name are merged.
+func (nrh *NameRewriteHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+	dropped := 0
+
+	nrh.mu.RLock()
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if metricName = nrh.rewrite(metricName); metricName == "" {
+			dropped++
+			return
+		}
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if metricName = nrh.rewrite(metricName); metricName == "" {
+			dropped++
+			return
+		}
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if metricName = nrh.rewrite(metricName); metricName == "" {
+			dropped++
+			return
+		}
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if metricName = nrh.rewrite(metricName); metricName == "" {
+			dropped++
+			return
+		}
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+
+	mm.Distributions.Each(func(metricName, tagsKey string, d gostatsd.Timer) {
+		if metricName = nrh.rewrite(metricName); metricName == "" {
+			dropped++
+			return
+		}
+		mmNew.MergeDistribution(metricName, tagsKey, d)
+	})
+	nrh.mu.RUnlock()
+
+	if dropped > 0 {
+		atomic.AddUint64(&nrh.dropped, uint64(dropped))
+	}
+	nrh.handler.DispatchMetricMap(ctx, mmNew)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline.  Events have no metric name, so are not
+// rewritten.
+func (nrh *NameRewriteHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	nrh.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (nrh *NameRewriteHandler) WaitForEvents() {
+	nrh.handler.WaitForEvents()
+}
+
+// rewrite applies every rule to name in order, each to the result of the one before, stopping if the name becomes
+// empty.  A rule which doesn't match doesn't allocate.  nrh.mu must be held for reading.
+func (nrh *NameRewriteHandler) rewrite(name string) string {
+	for _, rule := range nrh.rules {
+		matches := rule.Pattern.FindAllStringSubmatchIndex(name, -1)
+		if matches == nil {
+			continue
+		}
+		atomic.AddUint64(&rule.rewritten, 1)
+		dst := make([]byte, 0, len(name)+len(rule.Replacement))
+		last := 0
+		for _, match := range matches {
+			dst = append(dst, name[last:match[0]]...)
+			dst = rule.Pattern.ExpandString(dst, rule.Replacement, name, match)
+			last = match[1]
+		}
+		dst = append(dst, name[last:]...)
+		if name = string(dst); name == "" {
+			break
+		}
+	}
+	return name
+}
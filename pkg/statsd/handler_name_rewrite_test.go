@@ -0,0 +1,157 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameRewriteHandlerDispatchMetrics(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	ids := &NameRewriteRule{Name: "ids", Pattern: regexp.MustCompile(`\.\d+(\.|$)`), Replacement: ".id$1"}
+	swap := &NameRewriteRule{Name: "swap", Pattern: regexp.MustCompile(`^(?P<first>\w+)\.(\w+)\.id\.`), Replacement: "${2}.${first}."}
+	drop := &NameRewriteRule{Name: "drop", Pattern: regexp.MustCompile(`^debug\..*`)}
+	nrh := NewNameRewriteHandler(tch, []*NameRewriteRule{ids, swap, drop})
+
+	var done int
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "api.user.12345.latency"},
+		{Name: "api.order.1.item.2"},
+		{Name: "debug.trace", DoneFunc: func() { done++ }},
+		{Name: "unchanged"},
+	})
+
+	require.Len(t, tch.m, 3)
+	assert.Equal(t, "user.api.latency", tch.m[0].Name)
+	assert.Equal(t, "order.api.item.id", tch.m[1].Name)
+	assert.Equal(t, "unchanged", tch.m[2].Name)
+	assert.Equal(t, 1, done) // The dropped metric is released
+	assert.EqualValues(t, 2, ids.rewritten)
+	assert.EqualValues(t, 2, swap.rewritten)
+	assert.EqualValues(t, 1, drop.rewritten)
+	assert.EqualValues(t, 1, nrh.dropped)
+
+	// Nothing is dispatched if every metric is dropped
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "debug.x"}})
+	assert.Len(t, tch.m, 3)
+}
+
+func TestNameRewriteHandlerDispatchMetricMap(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	nrh := NewNameRewriteHandler(tch, []*NameRewriteRule{
+		{Name: "ids", Pattern: regexp.MustCompile(`\.\d+\.`), Replacement: ".id."},
+		{Name: "drop", Pattern: regexp.MustCompile(`^debug$`)},
+	})
+
+	mm := gostatsd.NewMetricMap()
+	for _, m := range []*gostatsd.Metric{
+		{Name: "api.1.requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Hostname: "h"},
+		{Name: "api.2.requests", Value: 2, Rate: 1, Type: gostatsd.COUNTER, Hostname: "h"},
+		{Name: "debug", Value: 1, Rate: 1, Type: gostatsd.GAUGE, Hostname: "h"},
+	} {
+		m.TagsKey = m.FormatTagsKey()
+		mm.Receive(m)
+	}
+	nrh.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	require.Len(t, tch.mm[0].Counters, 1)
+	assert.EqualValues(t, 3, tch.mm[0].Counters["api.id.requests"][gostatsd.FormatTagsKey("h", nil)].Value) // Merged
+	assert.Empty(t, tch.mm[0].Gauges)
+	assert.EqualValues(t, 1, nrh.dropped)
+}
+
+func TestNewNameRewriteHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+name-rewrite-rules='ids'
+
+[name-rewrite.ids]
+pattern='\.\d+\.'
+replacement='.id.'
+`))
+	require.NoError(t, err)
+
+	tch := &capturingHandler{}
+	handler, err := NewNameRewriteHandlerFromViper(v, tch)
+	require.NoError(t, err)
+	nrh, ok := handler.(*NameRewriteHandler)
+	require.True(t, ok)
+	require.Len(t, nrh.rules, 1)
+	assert.Equal(t, "ids", nrh.rules[0].Name)
+	assert.Equal(t, ".id.", nrh.rules[0].Replacement)
+
+	// No rules leaves the handler unchanged
+	handler, err = NewNameRewriteHandlerFromViper(viper.New(), tch)
+	require.NoError(t, err)
+	assert.Equal(t, tch, handler)
+
+	v.Set("name-rewrite.ids.pattern", "(")
+	_, err = NewNameRewriteHandlerFromViper(v, tch)
+	assert.Error(t, err)
+
+	v.Set("name-rewrite.ids.pattern", "")
+	_, err = NewNameRewriteHandlerFromViper(v, tch)
+	assert.Error(t, err)
+}
+
+func TestNameRewriteHandlerReload(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	nrh := NewNameRewriteHandler(tch, nil)
+
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "api.1"}})
+	ids := &NameRewriteRule{Name: "ids", Pattern: regexp.MustCompile(`\.\d+$`), Replacement: ".id"}
+	nrh.Reload([]*NameRewriteRule{ids})
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "api.2"}})
+
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, "api.1", tch.m[0].Name)
+	assert.Equal(t, "api.id", tch.m[1].Name)
+
+	// The count of a rule carries over to the rule of the same name
+	reloaded := &NameRewriteRule{Name: "ids", Pattern: regexp.MustCompile(`\.\d+$`), Replacement: ".n"}
+	nrh.Reload([]*NameRewriteRule{reloaded})
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "api.3"}})
+	require.Len(t, tch.m, 3)
+	assert.Equal(t, "api.n", tch.m[2].Name)
+	assert.EqualValues(t, 2, reloaded.rewritten)
+}
+
+// benchmarkNameRewrite dispatches a single metric named name through a handler with rules which rewrite the ids in
+// api style names.
+func benchmarkNameRewrite(b *testing.B, name string) {
+	nrh := NewNameRewriteHandler(&nopHandler{}, []*NameRewriteRule{
+		{Name: "ids", Pattern: regexp.MustCompile(`\.\d+\.`), Replacement: ".id."},
+		{Name: "versions", Pattern: regexp.MustCompile(`^(\w+)\.v\d+\.`), Replacement: "$1."},
+	})
+	m := &gostatsd.Metric{}
+	metrics := []*gostatsd.Metric{m}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		m.Name = name
+		nrh.DispatchMetrics(context.Background(), metrics)
+	}
+}
+
+func BenchmarkNameRewriteHandlerNoMatch(b *testing.B) {
+	benchmarkNameRewrite(b, "api.user.latency")
+}
+
+func BenchmarkNameRewriteHandlerMatch(b *testing.B) {
+	benchmarkNameRewrite(b, "api.v2.user.12345.latency")
+}
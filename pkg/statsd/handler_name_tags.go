@@ -0,0 +1,196 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// NameTagRule adds tags built from the captures of Match to any metric with a name matching it.  Each of Tags is a
+// template which can refer to the captures as $1 or ${name}, see regexp.Regexp.Expand.
+type NameTagRule struct {
+	Name  string
+	Match *regexp.Regexp
+	Tags  []string
+
+	matched uint64 // Number of metrics which matched, must be accessed atomically
+}
+
+// NameTagHandler adds tags to metrics based on their name.
+type NameTagHandler struct {
+	handler       gostatsd.PipelineHandler
+	rules         []*NameTagRule
+	estimatedTags int
+}
+
+// NewNameTagRuleFromViper creates a new NameTagRule given a *viper.Viper
+func NewNameTagRuleFromViper(name string, v *viper.Viper) (*NameTagRule, error) {
+	v.SetDefault("match", "")
+	v.SetDefault("tags", []string{})
+
+	match, err := regexp.Compile(v.GetString("match"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid match %q: %v", v.GetString("match"), err)
+	}
+	return &NameTagRule{
+		Name:  name,
+		Match: match,
+		Tags:  v.GetStringSlice("tags"),
+	}, nil
+}
+
+// NewNameTagHandlerFromViper creates a new NameTagHandler from the rules named in name-tags.  If no rules are
+// configured, the provided handler is returned unchanged.
+func NewNameTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) (gostatsd.PipelineHandler, error) {
+	ruleNameList := v.GetStringSlice(ParamNameTags)
+	var rules []*NameTagRule
+	for _, ruleName := range ruleNameList {
+		vRule := v.Sub("name-tag." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Name tag rule doesn't exist: %v", ruleName)
+			continue
+		}
+		rule, err := NewNameTagRuleFromViper(ruleName, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("name tag rule %v: %v", ruleName, err)
+		}
+		rules = append(rules, rule)
+		logrus.Infof("Loaded name tag rule %v", ruleName)
+	}
+	if len(rules) == 0 {
+		return handler, nil
+	}
+	return NewNameTagHandler(handler, rules), nil
+}
+
+// NewNameTagHandler initialises a new handler which adds the tags of every matching rule to metrics based on their
+// name, and passes them to the next handler.
+func NewNameTagHandler(handler gostatsd.PipelineHandler, rules []*NameTagRule) *NameTagHandler {
+	maxTags := 0
+	for _, rule := range rules {
+		maxTags += len(rule.Tags)
+	}
+	return &NameTagHandler{
+		handler:       handler,
+		rules:         rules,
+		estimatedTags: maxTags + handler.EstimatedTags(),
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (nth *NameTagHandler) EstimatedTags() int {
+	return nth.estimatedTags
+}
+
+// RunMetrics emits the number of metrics matched by each rule.
+func (nth *NameTagHandler) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for _, rule := range nth.rules {
+				statser.Gauge("name_tags.matched", float64(atomic.LoadUint64(&rule.matched)), gostatsd.Tags{"rule:" + rule.Name})
+			}
+		}
+	}
+}
+
+// DispatchMetrics adds the tags for the name to each metric and passes them to the next stage in the pipeline.
+func (nth *NameTagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	for _, m := range metrics {
+		m.Tags = nth.appendTags(m.Tags, m.Name)
+	}
+	nth.handler.DispatchMetrics(ctx, metrics)
+}
+
+// DispatchMetricMap adds the tags for the name to each consolidated metric in the map and passes it to the next
+// stage in the pipeline.
+func (nth *NameTagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if tags := nth.appendTags(c.Tags, metricName); len(tags) != len(c.Tags) {
+			c.Tags = tags
+			tagsKey = gostatsd.FormatTagsKey(c.Hostname, c.Tags)
+		}
+		mmNew.MergeCounter(metricName, tagsKey, c)
+	})
+
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if tags := nth.appendTags(g.Tags, metricName); len(tags) != len(g.Tags) {
+			g.Tags = tags
+			tagsKey = gostatsd.FormatTagsKey(g.Hostname, g.Tags)
+		}
+		mmNew.MergeGauge(metricName, tagsKey, g)
+	})
+
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if tags := nth.appendTags(t.Tags, metricName); len(tags) != len(t.Tags) {
+			t.Tags = tags
+			tagsKey = gostatsd.FormatTagsKey(t.Hostname, t.Tags)
+		}
+		mmNew.MergeTimer(metricName, tagsKey, t)
+	})
+
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if tags := nth.appendTags(s.Tags, metricName); len(tags) != len(s.Tags) {
+			s.Tags = tags
+			tagsKey = gostatsd.FormatTagsKey(s.Hostname, s.Tags)
+		}
+		mmNew.MergeSet(metricName, tagsKey, s)
+	})
+
+	mm.Distributions.Each(func(metricName, tagsKey string, d gostatsd.Timer) {
+		if tags := nth.appendTags(d.Tags, metricName); len(tags) != len(d.Tags) {
+			d.Tags = tags
+			tagsKey = gostatsd.FormatTagsKey(d.Hostname, d.Tags)
+		}
+		mmNew.MergeDistribution(metricName, tagsKey, d)
+	})
+
+	nth.handler.DispatchMetricMap(ctx, mmNew)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline.  Events have no metric name, so no tags are added.
+func (nth *NameTagHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	nth.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (nth *NameTagHandler) WaitForEvents() {
+	nth.handler.WaitForEvents()
+}
+
+// appendTags appends the tags of every rule which matches name to tags.  A tag which expands to nothing, or to a
+// key with no value, is not added.  If no tags are added, tags is returned unchanged.
+func (nth *NameTagHandler) appendTags(tags gostatsd.Tags, name string) gostatsd.Tags {
+	for _, rule := range nth.rules {
+		submatches := rule.Match.FindStringSubmatchIndex(name)
+		if submatches == nil {
+			continue
+		}
+		atomic.AddUint64(&rule.matched, 1)
+		for _, template := range rule.Tags {
+			tag := string(rule.Match.ExpandString(nil, template, name, submatches))
+			if tag == "" || strings.HasSuffix(tag, ":") {
+				continue
+			}
+			// A copy, so a tags slice shared with other metrics is never appended to in place.
+			tags = append(tags[:len(tags):len(tags)], tag)
+		}
+	}
+	return tags
+}
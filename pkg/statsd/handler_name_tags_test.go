@@ -0,0 +1,92 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"regexp"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNameTagHandlerDispatchMetrics(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	service := &NameTagRule{Name: "service", Match: regexp.MustCompile(`^svc\.(?P<service>[^.]+)\.(\w+)$`), Tags: []string{"service:${service}", "kind:$2"}}
+	optional := &NameTagRule{Name: "optional", Match: regexp.MustCompile(`^opt(\.(\w+))?$`), Tags: []string{"opt:$2"}}
+	nth := NewNameTagHandler(tch, []*NameTagRule{service, optional})
+
+	nth.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "svc.api.latency", Tags: gostatsd.Tags{"foo:bar"}},
+		{Name: "svc.api.requests.count"},
+		{Name: "opt"},
+		{Name: "opt.x"},
+	})
+
+	require.Len(t, tch.m, 4)
+	assert.Equal(t, gostatsd.Tags{"foo:bar", "service:api", "kind:latency"}, tch.m[0].Tags)
+	assert.Empty(t, tch.m[1].Tags)
+	assert.Empty(t, tch.m[2].Tags) // A tag with no value isn't added
+	assert.Equal(t, gostatsd.Tags{"opt:x"}, tch.m[3].Tags)
+	assert.EqualValues(t, 1, service.matched)
+	assert.EqualValues(t, 2, optional.matched)
+}
+
+func TestNameTagHandlerDispatchMetricMap(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	nth := NewNameTagHandler(tch, []*NameTagRule{
+		{Name: "service", Match: regexp.MustCompile(`^svc\.([^.]+)\.`), Tags: []string{"service:$1"}},
+	})
+
+	mm := gostatsd.NewMetricMap()
+	for _, m := range []*gostatsd.Metric{
+		{Name: "svc.api.latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"foo:bar"}, Hostname: "h"},
+		{Name: "other", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Hostname: "h"},
+	} {
+		m.TagsKey = m.FormatTagsKey()
+		mm.Receive(m)
+	}
+	nth.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	tags := gostatsd.Tags{"foo:bar", "service:api"}
+	assert.Equal(t, tags, tch.mm[0].Timers["svc.api.latency"][gostatsd.FormatTagsKey("h", tags)].Tags)
+	assert.Contains(t, tch.mm[0].Counters["other"], gostatsd.FormatTagsKey("h", nil))
+}
+
+func TestNewNameTagHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+name-tags='service'
+
+[name-tag.service]
+match='^svc\.([^.]+)\.'
+tags='service:$1'
+`))
+	require.NoError(t, err)
+
+	tch := &capturingHandler{}
+	handler, err := NewNameTagHandlerFromViper(v, tch)
+	require.NoError(t, err)
+	nth, ok := handler.(*NameTagHandler)
+	require.True(t, ok)
+	require.Len(t, nth.rules, 1)
+	assert.Equal(t, "service", nth.rules[0].Name)
+	assert.Equal(t, []string{"service:$1"}, nth.rules[0].Tags)
+
+	// No rules leaves the handler unchanged
+	handler, err = NewNameTagHandlerFromViper(viper.New(), tch)
+	require.NoError(t, err)
+	assert.Equal(t, tch, handler)
+
+	v.Set("name-tag.service.match", "(")
+	_, err = NewNameTagHandlerFromViper(v, tch)
+	assert.Error(t, err)
+}
@@ -0,0 +1,149 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+// SourceTagRule adds Tags to any metric or event received from an address in one of Networks.
+type SourceTagRule struct {
+	Networks []*net.IPNet
+	Tags     gostatsd.Tags
+}
+
+// SourceTagHandler adds tags to metrics and events based on the network the source IP belongs to.
+type SourceTagHandler struct {
+	handler       gostatsd.PipelineHandler
+	rules         []SourceTagRule
+	estimatedTags int
+}
+
+// NewSourceTagRuleFromViper creates a new SourceTagRule given a *viper.Viper
+func NewSourceTagRuleFromViper(v *viper.Viper) (SourceTagRule, error) {
+	v.SetDefault("cidrs", []string{})
+	v.SetDefault("tags", []string{})
+
+	var networks []*net.IPNet
+	for _, cidr := range v.GetStringSlice("cidrs") {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return SourceTagRule{}, fmt.Errorf("invalid cidr %q: %v", cidr, err)
+		}
+		networks = append(networks, network)
+	}
+	return SourceTagRule{
+		Networks: networks,
+		Tags:     v.GetStringSlice("tags"),
+	}, nil
+}
+
+// NewSourceTagHandlerFromViper creates a new SourceTagHandler from the rules named in source-tags.  If no rules
+// are configured, the provided handler is returned unchanged.
+func NewSourceTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) (gostatsd.PipelineHandler, error) {
+	ruleNameList := v.GetStringSlice(ParamSourceTags)
+	var rules []SourceTagRule
+	for _, ruleName := range ruleNameList {
+		vRule := v.Sub("source-tag." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Source tag rule doesn't exist: %v", ruleName)
+			continue
+		}
+		rule, err := NewSourceTagRuleFromViper(vRule)
+		if err != nil {
+			return nil, fmt.Errorf("source tag rule %v: %v", ruleName, err)
+		}
+		rules = append(rules, rule)
+		logrus.Infof("Loaded source tag rule %v", ruleName)
+	}
+	if len(rules) == 0 {
+		return handler, nil
+	}
+	return NewSourceTagHandler(handler, rules), nil
+}
+
+// NewSourceTagHandler initialises a new handler which adds the tags of every matching rule to metrics and events
+// based on their source IP, and passes them to the next handler.
+func NewSourceTagHandler(handler gostatsd.PipelineHandler, rules []SourceTagRule) *SourceTagHandler {
+	maxTags := 0
+	for _, rule := range rules {
+		maxTags += len(rule.Tags)
+	}
+	return &SourceTagHandler{
+		handler:       handler,
+		rules:         rules,
+		estimatedTags: maxTags + handler.EstimatedTags(),
+	}
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (sth *SourceTagHandler) EstimatedTags() int {
+	return sth.estimatedTags
+}
+
+// DispatchMetrics adds the tags for the source network to each metric and passes them to the next stage in the
+// pipeline.
+func (sth *SourceTagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	// Metrics in a batch tend to come from the same source, so remember the last lookup.
+	var lastIP gostatsd.IP
+	var lastTags gostatsd.Tags
+	for _, m := range metrics {
+		if m.SourceIP == gostatsd.UnknownIP {
+			continue
+		}
+		if m.SourceIP != lastIP {
+			lastIP = m.SourceIP
+			lastTags = sth.tagsFor(m.SourceIP)
+		}
+		m.Tags = append(m.Tags, lastTags...)
+	}
+	sth.handler.DispatchMetrics(ctx, metrics)
+}
+
+// DispatchMetricMap passes the MetricMap to the next stage in the pipeline.  Aggregated metrics do not carry a
+// source IP, so no tags are added.
+func (sth *SourceTagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	sth.handler.DispatchMetricMap(ctx, mm)
+}
+
+// DispatchEvent adds the tags for the source network to the event and passes it to the next stage in the pipeline.
+func (sth *SourceTagHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	if e.SourceIP != gostatsd.UnknownIP {
+		e.Tags = append(e.Tags, sth.tagsFor(e.SourceIP)...)
+	}
+	sth.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (sth *SourceTagHandler) WaitForEvents() {
+	sth.handler.WaitForEvents()
+}
+
+// tagsFor returns the tags of all rules which match the ip.  The returned value must not be modified.
+func (sth *SourceTagHandler) tagsFor(ip gostatsd.IP) gostatsd.Tags {
+	parsed := net.ParseIP(string(ip))
+	if parsed == nil {
+		return nil
+	}
+	var tags gostatsd.Tags
+	matched := 0
+	for _, rule := range sth.rules {
+		for _, network := range rule.Networks {
+			if network.Contains(parsed) {
+				matched++
+				if matched == 1 {
+					tags = rule.Tags
+				} else {
+					tags = append(tags[:len(tags):len(tags)], rule.Tags...)
+				}
+				break
+			}
+		}
+	}
+	return tags
+}
@@ -0,0 +1,99 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseCIDR(t *testing.T, cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	require.NoError(t, err)
+	return network
+}
+
+func TestSourceTagHandlerDispatchMetrics(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	sth := NewSourceTagHandler(tch, []SourceTagRule{
+		{Networks: []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")}, Tags: gostatsd.Tags{"team:payments"}},
+		{Networks: []*net.IPNet{mustParseCIDR(t, "10.0.0.0/8")}, Tags: gostatsd.Tags{"env:internal"}},
+	})
+
+	sth.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "a", SourceIP: "10.1.2.3", Tags: gostatsd.Tags{"foo:bar"}},
+		{Name: "b", SourceIP: "10.1.2.3"},
+		{Name: "c", SourceIP: "10.2.0.1"},
+		{Name: "d", SourceIP: "192.168.0.1"},
+		{Name: "e"},
+	})
+
+	require.Len(t, tch.m, 5)
+	assert.Equal(t, gostatsd.Tags{"foo:bar", "team:payments", "env:internal"}, tch.m[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"team:payments", "env:internal"}, tch.m[1].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:internal"}, tch.m[2].Tags)
+	assert.Empty(t, tch.m[3].Tags)
+	assert.Empty(t, tch.m[4].Tags)
+}
+
+func TestSourceTagHandlerDispatchEvent(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	sth := NewSourceTagHandler(tch, []SourceTagRule{
+		{Networks: []*net.IPNet{mustParseCIDR(t, "10.1.0.0/16")}, Tags: gostatsd.Tags{"team:payments"}},
+	})
+
+	sth.DispatchEvent(context.Background(), &gostatsd.Event{Title: "a", SourceIP: "10.1.0.1"})
+	sth.DispatchEvent(context.Background(), &gostatsd.Event{Title: "b", SourceIP: "10.2.0.1"})
+
+	require.Len(t, tch.e, 2)
+	assert.Equal(t, gostatsd.Tags{"team:payments"}, tch.e[0].Tags)
+	assert.Empty(t, tch.e[1].Tags)
+}
+
+func TestNewSourceTagHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+source-tags='payments'
+
+[source-tag.payments]
+cidrs='10.1.0.0/16 10.3.0.0/16'
+tags='team:payments'
+`))
+	require.NoError(t, err)
+
+	tch := &capturingHandler{}
+	handler, err := NewSourceTagHandlerFromViper(v, tch)
+	require.NoError(t, err)
+	sth, ok := handler.(*SourceTagHandler)
+	require.True(t, ok)
+	require.Len(t, sth.rules, 1)
+	assert.Len(t, sth.rules[0].Networks, 2)
+	assert.Equal(t, gostatsd.Tags{"team:payments"}, sth.rules[0].Tags)
+}
+
+func TestNewSourceTagHandlerFromViperNoRules(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	handler, err := NewSourceTagHandlerFromViper(viper.New(), tch)
+	require.NoError(t, err)
+	assert.Equal(t, tch, handler)
+}
+
+func TestNewSourceTagHandlerFromViperInvalidCIDR(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.Set("source-tags", []string{"bad"})
+	v.Set("source-tag.bad.cidrs", []string{"10.1.0.0/33"})
+	_, err := NewSourceTagHandlerFromViper(v, &capturingHandler{})
+	require.Error(t, err)
+}
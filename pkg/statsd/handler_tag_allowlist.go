@@ -0,0 +1,250 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+)
+
+const (
+	// TagAllowlistActionDrop drops metrics with a value which isn't allowed.
+	TagAllowlistActionDrop = "drop"
+	// TagAllowlistActionRewrite replaces a value which isn't allowed with the Other value of the rule.
+	TagAllowlistActionRewrite = "rewrite"
+
+	defaultTagAllowlistOther = "other"
+)
+
+// TagAllowlistRule restricts the values of the tag named Tag to Values.  Metrics with any other value are dropped,
+// or have the value replaced with Other when Rewrite is set.
+type TagAllowlistRule struct {
+	Tag     string
+	Values  map[string]struct{}
+	Rewrite bool
+	Other   string
+
+	rejected uint64 // Number of values which weren't allowed, must be accessed atomically
+}
+
+// TagAllowlistHandler drops or rewrites metrics with a tag value which isn't in the allowlist of the tag.
+type TagAllowlistHandler struct {
+	handler gostatsd.PipelineHandler
+	rules   map[string]*TagAllowlistRule // Keyed by tag name
+}
+
+// NewTagAllowlistRuleFromViper creates a new TagAllowlistRule for the tag given a *viper.Viper
+func NewTagAllowlistRuleFromViper(tag string, v *viper.Viper) (*TagAllowlistRule, error) {
+	v.SetDefault("values", []string{})
+	v.SetDefault("action", TagAllowlistActionDrop)
+	v.SetDefault("other", defaultTagAllowlistOther)
+
+	values := map[string]struct{}{}
+	for _, value := range v.GetStringSlice("values") {
+		values[value] = present
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("values must not be empty")
+	}
+	rule := &TagAllowlistRule{
+		Tag:    tag,
+		Values: values,
+		Other:  v.GetString("other"),
+	}
+	switch action := v.GetString("action"); action {
+	case TagAllowlistActionDrop:
+	case TagAllowlistActionRewrite:
+		if rule.Other == "" {
+			return nil, fmt.Errorf("other must not be empty with action %s", TagAllowlistActionRewrite)
+		}
+		rule.Rewrite = true
+	default:
+		return nil, fmt.Errorf("invalid action %q, must be %s or %s", action, TagAllowlistActionDrop, TagAllowlistActionRewrite)
+	}
+	return rule, nil
+}
+
+// NewTagAllowlistHandlerFromViper creates a new TagAllowlistHandler from the tags named in tag-allowlists.  If no
+// tags are configured, the provided handler is returned unchanged.
+func NewTagAllowlistHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler) (gostatsd.PipelineHandler, error) {
+	var rules []*TagAllowlistRule
+	for _, tag := range v.GetStringSlice(ParamTagAllowlists) {
+		vRule := v.Sub("tag-allowlist." + tag)
+		if vRule == nil {
+			logrus.Warnf("Tag allowlist doesn't exist: %v", tag)
+			continue
+		}
+		rule, err := NewTagAllowlistRuleFromViper(tag, vRule)
+		if err != nil {
+			return nil, fmt.Errorf("tag allowlist %v: %v", tag, err)
+		}
+		rules = append(rules, rule)
+		logrus.Infof("Loaded tag allowlist %v", tag)
+	}
+	if len(rules) == 0 {
+		return handler, nil
+	}
+	return NewTagAllowlistHandler(handler, rules)
+}
+
+// NewTagAllowlistHandler initialises a new handler which drops or rewrites metrics with a tag value which isn't
+// allowed by the rule for the tag, and passes them to the next handler.
+func NewTagAllowlistHandler(handler gostatsd.PipelineHandler, rules []*TagAllowlistRule) (*TagAllowlistHandler, error) {
+	byTag := make(map[string]*TagAllowlistRule, len(rules))
+	for _, rule := range rules {
+		if _, ok := byTag[rule.Tag]; ok {
+			return nil, fmt.Errorf("tag %v has more than one allowlist", rule.Tag)
+		}
+		byTag[rule.Tag] = rule
+	}
+	return &TagAllowlistHandler{
+		handler: handler,
+		rules:   byTag,
+	}, nil
+}
+
+// EstimatedTags returns a guess for how many tags to pre-allocate
+func (tah *TagAllowlistHandler) EstimatedTags() int {
+	return tah.handler.EstimatedTags()
+}
+
+// RunMetrics emits the number of values which weren't allowed for each tag.
+func (tah *TagAllowlistHandler) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			for _, rule := range tah.rules {
+				action := TagAllowlistActionDrop
+				if rule.Rewrite {
+					action = TagAllowlistActionRewrite
+				}
+				statser.Gauge("tag_allowlist.rejected", float64(atomic.LoadUint64(&rule.rejected)), gostatsd.Tags{"tag:" + rule.Tag, "action:" + action})
+			}
+		}
+	}
+}
+
+// DispatchMetrics drops or rewrites each metric with a value which isn't allowed and passes the rest to the next
+// stage in the pipeline.
+func (tah *TagAllowlistHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	var toDispatch []*gostatsd.Metric
+	for _, m := range metrics {
+		if tags, _, ok := tah.filterTags(m.Tags); ok {
+			m.Tags = tags
+			toDispatch = append(toDispatch, m)
+		}
+	}
+	if len(toDispatch) > 0 {
+		tah.handler.DispatchMetrics(ctx, toDispatch)
+	}
+}
+
+// DispatchMetricMap drops or rewrites each consolidated metric in the map with a value which isn't allowed and
+// passes the map to the next stage in the pipeline.  Rewritten metrics are merged with any metric which already has
+// the new tags.
+func (tah *TagAllowlistHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	mmNew := gostatsd.NewMetricMap()
+
+	mm.Counters.Each(func(metricName, tagsKey string, c gostatsd.Counter) {
+		if tags, rewritten, ok := tah.filterTags(c.Tags); ok {
+			if rewritten {
+				c.Tags = tags
+				tagsKey = gostatsd.FormatTagsKey(c.Hostname, c.Tags)
+			}
+			mmNew.MergeCounter(metricName, tagsKey, c)
+		}
+	})
+
+	mm.Gauges.Each(func(metricName, tagsKey string, g gostatsd.Gauge) {
+		if tags, rewritten, ok := tah.filterTags(g.Tags); ok {
+			if rewritten {
+				g.Tags = tags
+				tagsKey = gostatsd.FormatTagsKey(g.Hostname, g.Tags)
+			}
+			mmNew.MergeGauge(metricName, tagsKey, g)
+		}
+	})
+
+	mm.Timers.Each(func(metricName, tagsKey string, t gostatsd.Timer) {
+		if tags, rewritten, ok := tah.filterTags(t.Tags); ok {
+			if rewritten {
+				t.Tags = tags
+				tagsKey = gostatsd.FormatTagsKey(t.Hostname, t.Tags)
+			}
+			mmNew.MergeTimer(metricName, tagsKey, t)
+		}
+	})
+
+	mm.Sets.Each(func(metricName, tagsKey string, s gostatsd.Set) {
+		if tags, rewritten, ok := tah.filterTags(s.Tags); ok {
+			if rewritten {
+				s.Tags = tags
+				tagsKey = gostatsd.FormatTagsKey(s.Hostname, s.Tags)
+			}
+			mmNew.MergeSet(metricName, tagsKey, s)
+		}
+	})
+
+	mm.Distributions.Each(func(metricName, tagsKey string, d gostatsd.Timer) {
+		if tags, rewritten, ok := tah.filterTags(d.Tags); ok {
+			if rewritten {
+				d.Tags = tags
+				tagsKey = gostatsd.FormatTagsKey(d.Hostname, d.Tags)
+			}
+			mmNew.MergeDistribution(metricName, tagsKey, d)
+		}
+	})
+
+	tah.handler.DispatchMetricMap(ctx, mmNew)
+}
+
+// DispatchEvent passes the event to the next stage in the pipeline.  Allowlists only apply to metrics.
+func (tah *TagAllowlistHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	tah.handler.DispatchEvent(ctx, e)
+}
+
+// WaitForEvents waits for all event-dispatching goroutines to finish.
+func (tah *TagAllowlistHandler) WaitForEvents() {
+	tah.handler.WaitForEvents()
+}
+
+// filterTags checks the value of every tag with an allowlist.  Returns false if the metric should be dropped.  If a
+// value is rewritten a copy of tags is returned with rewritten set, as tags may be shared with other metrics,
+// otherwise tags is returned unchanged.  Tags without a value are not checked.
+func (tah *TagAllowlistHandler) filterTags(tags gostatsd.Tags) (_ gostatsd.Tags, rewritten, ok bool) {
+	for i, tag := range tags {
+		idx := strings.IndexByte(tag, ':')
+		if idx < 0 {
+			continue
+		}
+		rule, found := tah.rules[tag[:idx]]
+		if !found {
+			continue
+		}
+		if _, allowed := rule.Values[tag[idx+1:]]; allowed {
+			continue
+		}
+		atomic.AddUint64(&rule.rejected, 1)
+		if !rule.Rewrite {
+			return nil, false, false
+		}
+		if !rewritten {
+			tags = tags.Copy()
+			rewritten = true
+		}
+		tags[i] = rule.Tag + ":" + rule.Other
+	}
+	return tags, rewritten, true
+}
@@ -0,0 +1,122 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestTagAllowlistHandler(t *testing.T, next gostatsd.PipelineHandler) (*TagAllowlistHandler, *TagAllowlistRule, *TagAllowlistRule) {
+	region := &TagAllowlistRule{Tag: "region", Values: map[string]struct{}{"us-east-1": present, "eu-west-1": present}, Rewrite: true, Other: "other"}
+	env := &TagAllowlistRule{Tag: "env", Values: map[string]struct{}{"prod": present}}
+	tah, err := NewTagAllowlistHandler(next, []*TagAllowlistRule{region, env})
+	require.NoError(t, err)
+	return tah, region, env
+}
+
+func TestTagAllowlistHandlerDispatchMetrics(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	tah, region, env := newTestTagAllowlistHandler(t, tch)
+
+	shared := gostatsd.Tags{"region:garbage", "foo:bar"}
+	tah.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "allowed", Tags: gostatsd.Tags{"region:us-east-1", "env:prod"}},
+		{Name: "rewritten", Tags: shared},
+		{Name: "dropped", Tags: gostatsd.Tags{"region:eu-west-1", "env:dev"}},
+		{Name: "untouched", Tags: gostatsd.Tags{"host:abc", "region"}},
+	})
+
+	require.Len(t, tch.m, 3)
+	assert.Equal(t, "allowed", tch.m[0].Name)
+	assert.Equal(t, gostatsd.Tags{"region:us-east-1", "env:prod"}, tch.m[0].Tags)
+	assert.Equal(t, "rewritten", tch.m[1].Name)
+	assert.Equal(t, gostatsd.Tags{"region:other", "foo:bar"}, tch.m[1].Tags)
+	assert.Equal(t, gostatsd.Tags{"region:garbage", "foo:bar"}, shared) // Tags shared with other metrics aren't modified
+	assert.Equal(t, "untouched", tch.m[2].Name)
+	assert.Equal(t, gostatsd.Tags{"host:abc", "region"}, tch.m[2].Tags)
+	assert.EqualValues(t, 1, region.rejected)
+	assert.EqualValues(t, 1, env.rejected)
+
+	// Nothing is passed on when every metric is dropped
+	tah.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "dropped", Tags: gostatsd.Tags{"env:dev"}}})
+	assert.Len(t, tch.m, 3)
+}
+
+func TestTagAllowlistHandlerDispatchMetricMap(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	tah, _, _ := newTestTagAllowlistHandler(t, tch)
+
+	mm := gostatsd.NewMetricMap()
+	for _, m := range []*gostatsd.Metric{
+		{Name: "requests", Value: 1, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"region:garbage"}, Hostname: "h"},
+		{Name: "requests", Value: 2, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"region:rubbish"}, Hostname: "h"},
+		{Name: "requests", Value: 4, Rate: 1, Type: gostatsd.COUNTER, Tags: gostatsd.Tags{"region:us-east-1"}, Hostname: "h"},
+		{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"env:dev"}, Hostname: "h"},
+		{Name: "latency", Value: 1, Rate: 1, Type: gostatsd.TIMER, Tags: gostatsd.Tags{"env:prod"}, Hostname: "h"},
+	} {
+		m.TagsKey = m.FormatTagsKey()
+		mm.Receive(m)
+	}
+	tah.DispatchMetricMap(context.Background(), mm)
+
+	require.Len(t, tch.mm, 1)
+	counters := tch.mm[0].Counters["requests"]
+	require.Len(t, counters, 2)
+	// Rewritten values are merged into a single series
+	assert.EqualValues(t, 3, counters[gostatsd.FormatTagsKey("h", gostatsd.Tags{"region:other"})].Value)
+	assert.EqualValues(t, 4, counters[gostatsd.FormatTagsKey("h", gostatsd.Tags{"region:us-east-1"})].Value)
+	timers := tch.mm[0].Timers["latency"]
+	require.Len(t, timers, 1)
+	assert.Contains(t, timers, gostatsd.FormatTagsKey("h", gostatsd.Tags{"env:prod"}))
+}
+
+func TestNewTagAllowlistHandlerFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	err := v.ReadConfig(bytes.NewBufferString(`
+tag-allowlists='region env'
+
+[tag-allowlist.region]
+values='us-east-1 us-west-2'
+action='rewrite'
+other='unknown'
+
+[tag-allowlist.env]
+values='prod'
+`))
+	require.NoError(t, err)
+
+	tch := &capturingHandler{}
+	handler, err := NewTagAllowlistHandlerFromViper(v, tch)
+	require.NoError(t, err)
+	tah, ok := handler.(*TagAllowlistHandler)
+	require.True(t, ok)
+	require.Len(t, tah.rules, 2)
+	assert.Equal(t, map[string]struct{}{"us-east-1": present, "us-west-2": present}, tah.rules["region"].Values)
+	assert.True(t, tah.rules["region"].Rewrite)
+	assert.Equal(t, "unknown", tah.rules["region"].Other)
+	assert.False(t, tah.rules["env"].Rewrite)
+
+	// No allowlists leaves the handler unchanged
+	handler, err = NewTagAllowlistHandlerFromViper(viper.New(), tch)
+	require.NoError(t, err)
+	assert.Equal(t, tch, handler)
+
+	v.Set("tag-allowlist.env.action", "keep")
+	_, err = NewTagAllowlistHandlerFromViper(v, tch)
+	assert.Error(t, err)
+
+	v.Set("tag-allowlist.env.action", "drop")
+	v.Set("tag-allowlist.env.values", []string{})
+	_, err = NewTagAllowlistHandlerFromViper(v, tch)
+	assert.Error(t, err)
+}
@@ -2,6 +2,7 @@ package statsd
 
 import (
 	"context"
+	"sync"
 
 	"github.com/atlassian/gostatsd"
 
@@ -11,6 +12,7 @@ import (
 
 type TagHandler struct {
 	handler       gostatsd.PipelineHandler
+	mu            sync.RWMutex  // Guards tags and filters, which are replaced by Reload
 	tags          gostatsd.Tags // Tags to add to all metrics
 	filters       []Filter
 	estimatedTags int
@@ -19,6 +21,11 @@ type TagHandler struct {
 var present = struct{}{}
 
 func NewTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler, tags gostatsd.Tags) *TagHandler {
+	return NewTagHandler(handler, tags, NewFiltersFromViper(v))
+}
+
+// NewFiltersFromViper creates the filters named in filters given a *viper.Viper
+func NewFiltersFromViper(v *viper.Viper) []Filter {
 	filterNameList := v.GetStringSlice("filters")
 	var filters []Filter
 	for _, filterName := range filterNameList {
@@ -30,7 +37,7 @@ func NewTagHandlerFromViper(v *viper.Viper, handler gostatsd.PipelineHandler, ta
 		filters = append(filters, NewFilterFromViper(vFilter))
 		logrus.Infof("Loaded filter %v", filterName)
 	}
-	return NewTagHandler(handler, tags, filters)
+	return filters
 }
 
 // NewTagHandler initialises a new handler which adds unique tags, and sends metrics/events to the next handler based
@@ -45,6 +52,16 @@ func NewTagHandler(handler gostatsd.PipelineHandler, tags gostatsd.Tags, filters
 	}
 }
 
+// Reload replaces the tags added to all metrics and events, and the filters.  The estimated number of tags is not
+// changed.
+func (th *TagHandler) Reload(tags gostatsd.Tags, filters []Filter) {
+	tags = uniqueTags(tags, gostatsd.Tags{}) // de-dupe tags
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	th.tags = tags
+	th.filters = filters
+}
+
 // EstimatedTags returns a guess for how many tags to pre-allocate
 func (th *TagHandler) EstimatedTags() int {
 	return th.estimatedTags
@@ -54,6 +71,7 @@ func (th *TagHandler) EstimatedTags() int {
 func (th *TagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
 	var toDispatch []*gostatsd.Metric
 
+	th.mu.RLock()
 	for _, m := range metrics {
 		if m.Hostname == "" {
 			m.Hostname = string(m.SourceIP)
@@ -62,6 +80,7 @@ func (th *TagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.M
 			toDispatch = append(toDispatch, m)
 		}
 	}
+	th.mu.RUnlock()
 	if len(toDispatch) > 0 {
 		th.handler.DispatchMetrics(ctx, toDispatch)
 	}
@@ -75,6 +94,7 @@ func (th *TagHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.M
 func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
 	mmNew := gostatsd.NewMetricMap()
 
+	th.mu.RLock()
 	mm.Counters.Each(func(metricName, _ string, cOriginal gostatsd.Counter) {
 		if th.uniqueFilterAndAddTags(metricName, &cOriginal.Hostname, &cOriginal.Tags) {
 			newTagsKey := gostatsd.FormatTagsKey(cOriginal.Hostname, cOriginal.Tags)
@@ -116,9 +136,8 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 			newTagsKey := gostatsd.FormatTagsKey(tOriginal.Hostname, tOriginal.Tags)
 			if ts, ok := mmNew.Timers[metricName]; ok {
 				if tNew, ok := ts[newTagsKey]; ok {
-					tNew.Values = append(tNew.Values, tOriginal.Values...)
+					tNew.AppendValues(tOriginal)
 					tNew.Timestamp = gostatsd.NanoMax(tNew.Timestamp, tOriginal.Timestamp)
-					tNew.SampledCount += tOriginal.SampledCount
 					ts[newTagsKey] = tNew
 				} else {
 					ts[newTagsKey] = tOriginal
@@ -148,6 +167,13 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 		}
 	})
 
+	mm.Distributions.Each(func(metricName, _ string, dOriginal gostatsd.Timer) {
+		if th.uniqueFilterAndAddTags(metricName, &dOriginal.Hostname, &dOriginal.Tags) {
+			mmNew.MergeDistribution(metricName, gostatsd.FormatTagsKey(dOriginal.Hostname, dOriginal.Tags), dOriginal)
+		}
+	})
+	th.mu.RUnlock()
+
 	if !mmNew.IsEmpty() {
 		th.handler.DispatchMetricMap(ctx, mmNew)
 	}
@@ -161,7 +187,7 @@ func (th *TagHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.Metric
 // Everything is done in one function for efficiency, as the steps listed above are interrelated, and this is on the
 // hot code path.
 //
-// Returns true if the metric should be processed further, or false to drop it.
+// Returns true if the metric should be processed further, or false to drop it.  th.mu must be held for reading.
 func (th *TagHandler) uniqueFilterAndAddTags(mName string, mHostname *string, mTags *gostatsd.Tags) bool {
 	if len(th.filters) == 0 {
 		*mTags = uniqueTags(*mTags, th.tags)
@@ -217,7 +243,9 @@ func (th *TagHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	if e.Hostname == "" {
 		e.Hostname = string(e.SourceIP)
 	}
+	th.mu.RLock()
 	e.Tags = uniqueTags(e.Tags, th.tags)
+	th.mu.RUnlock()
 	th.handler.DispatchEvent(ctx, e)
 }
 
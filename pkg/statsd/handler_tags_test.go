@@ -85,6 +85,25 @@ func TestTagStripMergesSets(t *testing.T) {
 	require.EqualValues(t, expected, tch.mm[0])
 }
 
+func TestTagHandlerReload(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, gostatsd.Tags{"env:dev"}, nil)
+
+	th.Reload(gostatsd.Tags{"env:prod", "env:prod"}, []Filter{{MatchMetrics: gostatsd.StringMatchList{gostatsd.NewStringMatch("debug.*")}, DropMetric: true}})
+	th.DispatchMetrics(context.Background(), []*gostatsd.Metric{
+		{Name: "debug.x"},
+		{Name: "api", Tags: gostatsd.Tags{"foo:bar"}},
+	})
+	th.DispatchEvent(context.Background(), &gostatsd.Event{Title: "deploy"})
+
+	require.Len(t, tch.m, 1)
+	assert.Equal(t, "api", tch.m[0].Name)
+	assert.Equal(t, gostatsd.Tags{"foo:bar", "env:prod"}, tch.m[0].Tags)
+	require.Len(t, tch.e, 1)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, tch.e[0].Tags)
+}
+
 func TestFilterPassesNoFilters(t *testing.T) {
 	tch := &capturingHandler{}
 	th := NewTagHandler(tch, gostatsd.Tags{}, nil)
@@ -0,0 +1,107 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// Hostname strategies, see ResolveHostname.
+const (
+	HostnameStrategyStatic = "static"
+	HostnameStrategyOS     = "os"
+	HostnameStrategyEnv    = "env:"
+	HostnameStrategyFile   = "file:"
+	HostnameStrategyCloud  = "cloud"
+)
+
+// ResolveHostname evaluates each of the strategies in order, and returns the first non-empty hostname.  A strategy
+// which fails is logged and the next one is tried.  The strategies are:
+//   - static: the value of static, typically from the hostname setting
+//   - os: the hostname reported by the OS
+//   - env:VAR: the value of the environment variable VAR
+//   - file:path: the contents of the file at path, with surrounding whitespace removed
+//   - cloud: the instance ID of this host as reported by the cloud provider, which may be nil
+//
+// If no strategy gives a hostname, an empty string is returned.  An error is only returned if a strategy is invalid.
+func ResolveHostname(ctx context.Context, strategies []string, static string, cloud gostatsd.CloudProvider) (string, error) {
+	for _, strategy := range strategies {
+		if err := validateHostnameStrategy(strategy); err != nil {
+			return "", err
+		}
+	}
+	for _, strategy := range strategies {
+		hostname, err := resolveHostnameStrategy(ctx, strategy, static, cloud)
+		if err != nil {
+			log.WithError(err).WithField("strategy", strategy).Warn("Failed to resolve hostname")
+			continue
+		}
+		if hostname != "" {
+			log.WithFields(log.Fields{
+				"strategy": strategy,
+				"hostname": hostname,
+			}).Info("Resolved hostname")
+			return hostname, nil
+		}
+	}
+	log.WithField("strategies", strategies).Warn("No hostname strategy gave a hostname")
+	return "", nil
+}
+
+func validateHostnameStrategy(strategy string) error {
+	switch {
+	case strategy == HostnameStrategyStatic, strategy == HostnameStrategyOS, strategy == HostnameStrategyCloud:
+		return nil
+	case strings.HasPrefix(strategy, HostnameStrategyEnv) && len(strategy) > len(HostnameStrategyEnv):
+		return nil
+	case strings.HasPrefix(strategy, HostnameStrategyFile) && len(strategy) > len(HostnameStrategyFile):
+		return nil
+	}
+	return fmt.Errorf("invalid hostname strategy %q", strategy)
+}
+
+func resolveHostnameStrategy(ctx context.Context, strategy, static string, cloud gostatsd.CloudProvider) (string, error) {
+	switch {
+	case strategy == HostnameStrategyStatic:
+		return static, nil
+	case strategy == HostnameStrategyOS:
+		return os.Hostname()
+	case strategy == HostnameStrategyCloud:
+		return cloudHostname(ctx, cloud)
+	case strings.HasPrefix(strategy, HostnameStrategyEnv):
+		return os.Getenv(strategy[len(HostnameStrategyEnv):]), nil
+	case strings.HasPrefix(strategy, HostnameStrategyFile):
+		data, err := ioutil.ReadFile(strategy[len(HostnameStrategyFile):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	return "", fmt.Errorf("invalid hostname strategy %q", strategy)
+}
+
+// cloudHostname looks up the instance ID of this host from the cloud provider.
+func cloudHostname(ctx context.Context, cloud gostatsd.CloudProvider) (string, error) {
+	if cloud == nil {
+		return "", fmt.Errorf("no cloud provider configured")
+	}
+	ip, err := cloud.SelfIP()
+	if err != nil {
+		return "", err
+	}
+	instances, err := cloud.Instance(ctx, ip)
+	if err != nil {
+		return "", err
+	}
+	instance := instances[ip]
+	if instance == nil {
+		return "", fmt.Errorf("instance %s not found", ip)
+	}
+	return instance.ID, nil
+}
@@ -0,0 +1,65 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestResolveHostnameStrategies(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "hostname")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "hostname")
+	require.NoError(t, ioutil.WriteFile(file, []byte("  from-file\n"), 0600))
+
+	const envVar = "GOSTATSD_TEST_RESOLVE_HOSTNAME"
+	require.NoError(t, os.Setenv(envVar, "from-env"))
+	defer os.Unsetenv(envVar)
+
+	cloud := &fakeProvider{
+		instance: &gostatsd.Instance{ID: "i-13123123"},
+	}
+
+	tests := []struct {
+		name       string
+		strategies []string
+		cloud      gostatsd.CloudProvider
+		expected   string
+	}{
+		{"static", []string{"static"}, nil, "static-host"},
+		{"env", []string{"env:" + envVar, "static"}, nil, "from-env"},
+		{"env unset falls back", []string{"env:GOSTATSD_TEST_UNSET", "static"}, nil, "static-host"},
+		{"file", []string{"file:" + file, "static"}, nil, "from-file"},
+		{"missing file falls back", []string{"file:" + filepath.Join(dir, "missing"), "static"}, nil, "static-host"},
+		{"cloud", []string{"cloud", "static"}, cloud, "i-13123123"},
+		{"no cloud falls back", []string{"cloud", "static"}, nil, "static-host"},
+		{"nothing resolves", []string{"env:GOSTATSD_TEST_UNSET"}, nil, ""},
+	}
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			hostname, err := ResolveHostname(context.Background(), tc.strategies, "static-host", tc.cloud)
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, hostname)
+		})
+	}
+}
+
+func TestResolveHostnameInvalidStrategy(t *testing.T) {
+	t.Parallel()
+
+	for _, strategy := range []string{"bogus", "env:", "file:"} {
+		_, err := ResolveHostname(context.Background(), []string{"static", strategy}, "static-host", nil)
+		assert.Error(t, err, strategy)
+	}
+}
@@ -23,6 +23,7 @@ type lexer struct {
 	namespace     string
 	err           error
 	sampling      float64
+	maxLineLength int // Lines longer than this are rejected without being lexed, 0 for unlimited
 
 	metricPool *pool.MetricPool
 }
@@ -41,6 +42,7 @@ var (
 	errOverflow              = errors.New("overflow")
 	errNotEnoughData         = errors.New("not enough data")
 	errNaN                   = errors.New("invalid value NaN")
+	errLineTooLong           = errors.New("line too long")
 )
 
 var escapedNewline = []byte("\\n")
@@ -64,6 +66,9 @@ func (l *lexer) next() byte {
 }
 
 func (l *lexer) run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd.Event, error) {
+	if l.maxLineLength > 0 && len(input) > l.maxLineLength {
+		return nil, nil, errLineTooLong
+	}
 	l.input = input
 	l.namespace = namespace
 	l.len = uint32(len(l.input))
@@ -86,6 +91,10 @@ func (l *lexer) run(input []byte, namespace string) (*gostatsd.Metric, *gostatsd
 				return nil, nil, errNaN
 			}
 			l.m.Value = v
+			if l.m.Type == gostatsd.GAUGE && (l.m.StringValue[0] == '+' || l.m.StringValue[0] == '-') {
+				// A signed gauge adjusts the current value, so a negative value can only be set after zeroing it.
+				l.m.GaugeDelta = true
+			}
 			l.m.StringValue = ""
 		}
 		l.m.Tags = l.tags
@@ -241,7 +250,7 @@ func lexEventAttribute(l *lexer) stateFn {
 			return lexEventAttributes
 		}))
 	case '#':
-		return lexTags
+		return lexEventTags
 	case eof:
 	default:
 		l.err = errInvalidAttributes
@@ -381,6 +390,10 @@ func lexType(l *lexer) stateFn {
 		l.m.Type = gostatsd.SET
 		l.start = l.pos
 		return lexTypeSep
+	case 'd':
+		l.m.Type = gostatsd.DISTRIBUTION
+		l.start = l.pos
+		return lexTypeSep
 	default:
 		l.err = errInvalidType
 		return nil
@@ -402,7 +415,7 @@ func lexTypeSep(l *lexer) stateFn {
 	return nil
 }
 
-// lex the sample rate or the tags.
+// lex the sample rate or the tags.  Empty sections, including a trailing separator, are skipped.
 func lexSampleRateOrTags(l *lexer) stateFn {
 	b := l.next()
 	switch b {
@@ -418,7 +431,11 @@ func lexSampleRateOrTags(l *lexer) stateFn {
 			}
 		}
 	case '#':
-		return lexTags
+		return lexMetricTags
+	case '|':
+		return lexSampleRateOrTags
+	case eof:
+		return nil
 	default:
 		l.err = errInvalidSamplingOrTags
 		return nil
@@ -436,19 +453,45 @@ func lexSampleRate(l *lexer) stateFn {
 	if l.pos >= l.len {
 		return nil
 	}
-	return lexAssert('#', lexTags)
+	return lexSampleRateOrTags
 }
 
-// lex the tags.
-func lexTags(l *lexer) stateFn {
-	return lexUntil(',', func(l *lexer, data []byte) stateFn {
-		if len(data) > 0 {
-			l.tags = append(l.tags, string(data))
-		}
-		if l.pos == l.len { // eof
-			return nil
+// lex the tags of a metric, and then any following section.
+func lexMetricTags(l *lexer) stateFn {
+	if lexTags(l) {
+		return lexSampleRateOrTags
+	}
+	return nil
+}
+
+// lex the tags of an event, and then any following attribute.
+func lexEventTags(l *lexer) stateFn {
+	if lexTags(l) {
+		return lexEventAttribute
+	}
+	return nil
+}
+
+// lexTags appends the comma separated tags up to the next pipe to l.tags, skipping empty tags.  Tags are not split,
+// so a value containing colons (such as url:http://example.com) is kept intact.  Returns true if the tags were
+// terminated by a pipe, which has been consumed, or false if they were terminated by eof.
+func lexTags(l *lexer) bool {
+	start := l.pos
+	for {
+		switch b := l.next(); b {
+		case ',', '|':
+			if l.pos-1 > start {
+				l.tags = append(l.tags, string(l.input[start:l.pos-1]))
+			}
+			if b == '|' {
+				return true
+			}
+			start = l.pos
+		case eof:
+			if l.pos > start {
+				l.tags = append(l.tags, string(l.input[start:l.pos]))
+			}
+			return false
 		}
-		l.pos++ // consume comma
-		return lexTags
-	})
+	}
 }
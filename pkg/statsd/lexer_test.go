@@ -18,6 +18,8 @@ func TestMetricsLexer(t *testing.T) {
 		"def.g:10|ms":                   {Name: "def.g", Value: 10, Type: gostatsd.TIMER, Rate: 1.0},
 		"def.h:10|h":                    {Name: "def.h", Value: 10, Type: gostatsd.TIMER, Rate: 1.0},
 		"def.i:10|h|#foo":               {Name: "def.i", Value: 10, Type: gostatsd.TIMER, Rate: 1.0, Tags: gostatsd.Tags{"foo"}},
+		"def.j:10|d":                    {Name: "def.j", Value: 10, Type: gostatsd.DISTRIBUTION, Rate: 1.0},
+		"def.k:10|d|@0.5|#foo":          {Name: "def.k", Value: 10, Type: gostatsd.DISTRIBUTION, Rate: 0.5, Tags: gostatsd.Tags{"foo"}},
 		"smp.rte:5|c|@0.1":              {Name: "smp.rte", Value: 5, Type: gostatsd.COUNTER, Rate: 0.1},
 		"smp.rte:5|c|@0.1|#foo:bar,baz": {Name: "smp.rte", Value: 5, Type: gostatsd.COUNTER, Rate: 0.1, Tags: gostatsd.Tags{"foo:bar", "baz"}},
 		"smp.rte:5|c|#foo:bar,baz":      {Name: "smp.rte", Value: 5, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"foo:bar", "baz"}},
@@ -39,6 +41,19 @@ func TestMetricsLexer(t *testing.T) {
 		"a:1|g|#":                       {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
 		"a:1|g|#,":                      {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
 		"a:1|g|#,,":                     {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
+		"a:1|g|#|@0.5":                  {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 0.5},
+		"a:1|g|#f:b|@0.5":               {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 0.5, Tags: gostatsd.Tags{"f:b"}},
+		"a:1|g||#f":                     {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0, Tags: gostatsd.Tags{"f"}},
+		"a:1|g|":                        {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0},
+		"a:1|g|@0.5|":                   {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 0.5},
+		"a:1|g|#f|":                     {Name: "a", Value: 1, Type: gostatsd.GAUGE, Rate: 1.0, Tags: gostatsd.Tags{"f"}},
+		"a:1|c|#url:http://example.com": {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"url:http://example.com"}},
+		"a:1|c|#a:b:c,d::":              {Name: "a", Value: 1, Type: gostatsd.COUNTER, Rate: 1.0, Tags: gostatsd.Tags{"a:b:c", "d::"}},
+		"a:+5|g":                        {Name: "a", Value: 5, Type: gostatsd.GAUGE, Rate: 1.0, GaugeDelta: true},
+		"a:-3.5|g":                      {Name: "a", Value: -3.5, Type: gostatsd.GAUGE, Rate: 1.0, GaugeDelta: true},
+		"a:-0|g|#f":                     {Name: "a", Value: 0, Type: gostatsd.GAUGE, Rate: 1.0, GaugeDelta: true, Tags: gostatsd.Tags{"f"}},
+		"a:-3|c":                        {Name: "a", Value: -3, Type: gostatsd.COUNTER, Rate: 1.0},
+		"a:-3|ms":                       {Name: "a", Value: -3, Type: gostatsd.TIMER, Rate: 1.0},
 	}
 
 	compareMetric(t, tests, "")
@@ -66,6 +81,24 @@ func TestInvalidMetricsLexer(t *testing.T) {
 	compareMetric(t, tests, "stats")
 }
 
+func TestLexerMaxLineLength(t *testing.T) {
+	t.Parallel()
+	l := lexer{
+		metricPool:    pool.NewMetricPool(0),
+		maxLineLength: 8,
+	}
+	m, _, err := l.run([]byte("a:1|c|#x"), "")
+	require.NoError(t, err)
+	assert.Equal(t, "a", m.Name)
+
+	l = lexer{
+		metricPool:    pool.NewMetricPool(0),
+		maxLineLength: 8,
+	}
+	_, _, err = l.run([]byte("a:1|c|#xy"), "")
+	assert.Equal(t, errLineTooLong, err)
+}
+
 func TestEventsLexer(t *testing.T) {
 	t.Parallel()
 	//_e{title.length,text.length}:title|text|d:date_happened|h:hostname|p:priority|t:alert_type|#tag1,tag2
@@ -85,6 +118,8 @@ func TestEventsLexer(t *testing.T) {
 		"_e{1,1}:a|b|p:low":        {Title: "a", Text: "b", Priority: gostatsd.PriLow},
 		"_e{1,1}:a|b|t:warning":    {Title: "a", Text: "b", AlertType: gostatsd.AlertWarning},
 		"_e{1,1}:a|b|#tag1,t:tag2": {Title: "a", Text: "b", Tags: []string{"tag1", "t:tag2"}},
+		"_e{1,1}:a|b|#t:a:b|h:hst": {Title: "a", Text: "b", Hostname: "hst", Tags: []string{"t:a:b"}},
+		"_e{1,1}:a|b|#|h:hoost":    {Title: "a", Text: "b", Hostname: "hoost"},
 		"_e{20,34}:Deployment completed|Deployment completed in 7 minutes.|d:1463746133|h:9c00cf070c14|s:Micros Server|t:success|#topic:service.deploy,message_env:pdev,service_id:node-refapp-ci-internal,deployment_id:72e95b0f-37b0-4cf9-8e92-3e47d006b63f": {
 			Title:          "Deployment completed",
 			Text:           "Deployment completed in 7 minutes.",
@@ -0,0 +1,74 @@
+package statsd
+
+import (
+	"math"
+	"sync/atomic"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// loadSampler sheds load by keeping a fraction of the counter and timer datapoints before they are aggregated.
+// Whether a datapoint is kept is a deterministic function of its position in the sequence they are dispatched in,
+// scrambled so that clients which send datapoints in a repeating pattern aren't sampled in step with it.  The sample
+// rate of each kept datapoint is scaled by rate, so the aggregated counter values and timer counts are scaled up to
+// make up for the datapoints discarded, and the timer values are a uniform sample.  Gauges and sets are always kept,
+// as only their last value or every member is meaningful.
+type loadSampler struct {
+	seq        uint64 // atomic - sequence number of the next counter or timer datapoint
+	sampledOut uint64 // atomic - datapoints discarded by sampling
+	rate       float64
+	threshold  uint64 // Datapoints whose scrambled sequence number is below this are kept
+}
+
+// newLoadSampler returns a loadSampler keeping rate of the counter and timer datapoints, or nil if rate is not
+// between 0 and 1, as nothing would be discarded.
+func newLoadSampler(rate float64) *loadSampler {
+	if rate <= 0 || rate >= 1 {
+		return nil
+	}
+	return &loadSampler{
+		rate:      rate,
+		threshold: uint64(rate * math.MaxUint64),
+	}
+}
+
+// scramble maps a sequence number to a uniformly distributed value, using the splitmix64 finalizer.
+func scramble(seq uint64) uint64 {
+	seq = (seq ^ (seq >> 30)) * 0xbf58476d1ce4e5b9
+	seq = (seq ^ (seq >> 27)) * 0x94d049bb133111eb
+	return seq ^ (seq >> 31)
+}
+
+// sample returns the metrics which are kept, scaling their rates.  The metrics which are discarded are released.
+// A sequence number is reserved for the whole batch at once, so concurrent dispatches don't contend on every
+// datapoint.
+func (s *loadSampler) sample(metrics []*gostatsd.Metric) []*gostatsd.Metric {
+	sampleable := 0
+	for _, m := range metrics {
+		if m.Type == gostatsd.COUNTER || m.Type == gostatsd.TIMER {
+			sampleable++
+		}
+	}
+	if sampleable == 0 {
+		return metrics
+	}
+	seq := atomic.AddUint64(&s.seq, uint64(sampleable)) - uint64(sampleable)
+
+	kept := make([]*gostatsd.Metric, 0, len(metrics)-sampleable+int(math.Ceil(float64(sampleable)*s.rate)))
+	sampledOut := 0
+	for _, m := range metrics {
+		if m.Type == gostatsd.COUNTER || m.Type == gostatsd.TIMER {
+			keep := scramble(seq) < s.threshold
+			seq++
+			if !keep {
+				sampledOut++
+				m.Done()
+				continue
+			}
+			m.Rate *= s.rate
+		}
+		kept = append(kept, m)
+	}
+	atomic.AddUint64(&s.sampledOut, uint64(sampledOut))
+	return kept
+}
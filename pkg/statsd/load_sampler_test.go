@@ -0,0 +1,52 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestNewLoadSampler(t *testing.T) {
+	t.Parallel()
+	assert.Nil(t, newLoadSampler(0))
+	assert.Nil(t, newLoadSampler(1))
+	assert.NotNil(t, newLoadSampler(0.5))
+}
+
+func TestLoadSampler(t *testing.T) {
+	t.Parallel()
+	s := newLoadSampler(0.25)
+	mm := gostatsd.NewMetricMap()
+	released := 0
+	for batch := 0; batch < 100; batch++ {
+		var metrics []*gostatsd.Metric
+		for i := 0; i < 100; i++ {
+			// A repeating pattern of datapoints, which must not be sampled in step with the pattern.
+			metrics = append(metrics,
+				&gostatsd.Metric{Name: "c1", Value: 1, Rate: 1, Type: gostatsd.COUNTER},
+				&gostatsd.Metric{Name: "c2", Value: 1, Rate: 1, Type: gostatsd.COUNTER},
+				&gostatsd.Metric{Name: "t", Value: float64(i), Rate: 1, Type: gostatsd.TIMER},
+				&gostatsd.Metric{Name: "g", Value: float64(i), Type: gostatsd.GAUGE},
+			)
+		}
+		for _, m := range metrics {
+			m.DoneFunc = func() { released++ }
+		}
+		kept := s.sample(metrics)
+		released -= len(kept) // Receive releases the kept metrics
+		for _, m := range kept {
+			mm.Receive(m)
+		}
+	}
+
+	// Counters and timer counts are scaled to make up for what was sampled out, gauges are untouched.
+	assert.InEpsilon(t, 10000, mm.Counters["c1"][""].Value, 0.05)
+	assert.InEpsilon(t, 10000, mm.Counters["c2"][""].Value, 0.05)
+	assert.InEpsilon(t, 10000, mm.Timers["t"][""].SampledCount, 0.05)
+	assert.InEpsilon(t, 2500, len(mm.Timers["t"][""].Values), 0.05)
+	assert.EqualValues(t, 99, mm.Gauges["g"][""].Value)
+	assert.EqualValues(t, released, s.sampledOut)
+	assert.InEpsilon(t, 22500, s.sampledOut, 0.05)
+}
@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// NameSeparators are the characters which are normalized by the name-separator option.
+const NameSeparators = "._-"
+
+// normalizeSeparators replaces every separator in name with sep.  The name is returned without allocating if it
+// only contains sep.
+func normalizeSeparators(name string, sep byte) string {
+	idx := -1
+	for i := 0; i < len(name); i++ {
+		if name[i] != sep && strings.IndexByte(NameSeparators, name[i]) != -1 {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		return name
+	}
+	b := []byte(name)
+	for i := idx; i < len(b); i++ {
+		if strings.IndexByte(NameSeparators, b[i]) != -1 {
+			b[i] = sep
+		}
+	}
+	return string(b)
+}
+
+// normalizeMetricMapSeparators returns mm with every separator in the metric names replaced by sep.  Metrics which
+// have the same name once normalized are merged.  If no names change, mm is returned unmodified.
+func normalizeMetricMapSeparators(mm *gostatsd.MetricMap, sep byte) *gostatsd.MetricMap {
+	changed := false
+	check := func(name string) {
+		if !changed && normalizeSeparators(name, sep) != name {
+			changed = true
+		}
+	}
+	for name := range mm.Counters {
+		check(name)
+	}
+	for name := range mm.Gauges {
+		check(name)
+	}
+	for name := range mm.Timers {
+		check(name)
+	}
+	for name := range mm.Sets {
+		check(name)
+	}
+	for name := range mm.Distributions {
+		check(name)
+	}
+	if !changed {
+		return mm
+	}
+
+	mmNew := gostatsd.NewMetricMap()
+	mm.Counters.Each(func(name, tagsKey string, c gostatsd.Counter) {
+		mmNew.MergeCounter(normalizeSeparators(name, sep), tagsKey, c)
+	})
+	mm.Gauges.Each(func(name, tagsKey string, g gostatsd.Gauge) {
+		mmNew.MergeGauge(normalizeSeparators(name, sep), tagsKey, g)
+	})
+	mm.Timers.Each(func(name, tagsKey string, t gostatsd.Timer) {
+		mmNew.MergeTimer(normalizeSeparators(name, sep), tagsKey, t)
+	})
+	mm.Sets.Each(func(name, tagsKey string, s gostatsd.Set) {
+		mmNew.MergeSet(normalizeSeparators(name, sep), tagsKey, s)
+	})
+	mm.Distributions.Each(func(name, tagsKey string, d gostatsd.Timer) {
+		mmNew.MergeDistribution(normalizeSeparators(name, sep), tagsKey, d)
+	})
+	return mmNew
+}
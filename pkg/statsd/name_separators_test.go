@@ -0,0 +1,49 @@
+package statsd
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestNormalizeSeparators(t *testing.T) {
+	t.Parallel()
+	tests := map[string]string{
+		"":                 "",
+		"api":              "api",
+		"api.latency":      "api.latency",
+		"api_latency":      "api.latency",
+		"api-latency":      "api.latency",
+		"api_latency-p99.": "api.latency.p99.",
+		"a__b":             "a..b",
+	}
+	for input, expected := range tests {
+		assert.Equal(t, expected, normalizeSeparators(input, '.'), input)
+	}
+	assert.Equal(t, "api_latency_p99", normalizeSeparators("api.latency-p99", '_'))
+}
+
+func TestNormalizeMetricMapSeparators(t *testing.T) {
+	t.Parallel()
+	mm := gostatsd.NewMetricMap()
+	mm.MergeCounter("api.requests", "", gostatsd.Counter{Value: 1, Timestamp: 10})
+	mm.MergeCounter("api_requests", "", gostatsd.Counter{Value: 2, Timestamp: 20})
+	mm.MergeGauge("api-level", "", gostatsd.Gauge{Value: 3, Timestamp: 10})
+	mm.MergeTimer("api.latency", "", gostatsd.Timer{Values: []float64{1}, SampledCount: 1, Timestamp: 10})
+	mm.MergeTimer("api_latency", "", gostatsd.Timer{Values: []float64{2}, SampledCount: 1, Timestamp: 10})
+	mm.MergeSet("api_users", "", gostatsd.Set{Values: map[string]struct{}{"a": {}}, Timestamp: 10})
+
+	normalized := normalizeMetricMapSeparators(mm, '.')
+	require.Len(t, normalized.Counters, 1)
+	assert.Equal(t, gostatsd.Counter{Value: 3, Timestamp: 20}, normalized.Counters["api.requests"][""])
+	assert.Contains(t, normalized.Gauges, "api.level")
+	require.Len(t, normalized.Timers, 1)
+	assert.ElementsMatch(t, []float64{1, 2}, normalized.Timers["api.latency"][""].Values)
+	assert.Contains(t, normalized.Sets, "api.users")
+
+	// Returned unchanged if there is nothing to normalize
+	assert.True(t, normalized == normalizeMetricMapSeparators(normalized, '.'))
+}
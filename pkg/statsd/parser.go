@@ -26,6 +26,7 @@ type DatagramParser struct {
 	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
 	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
 	badLines        uint64
+	longLines       uint64
 	metricsReceived uint64
 	eventsReceived  uint64
 
@@ -36,6 +37,10 @@ type DatagramParser struct {
 	metricPool *pool.MetricPool
 
 	badLineLimiter *rate.Limiter
+	badLineDump    *badLineDump   // Optional, writes the lines which failed to parse to a file
+	sourceLimiter  *sourceLimiter // Optional, limits the metrics accepted from each source address
+	parseTiming    *parseTiming   // Optional, time spent parsing each type of line
+	maxLineLength  int            // Lines longer than this are rejected, 0 for unlimited
 
 	in <-chan []*Datagram // Input chan of datagram batches to parse
 
@@ -62,11 +67,24 @@ func NewDatagramParser(in <-chan []*Datagram, ns string, ignoreHost bool, estima
 	}
 }
 
+// SetBadLineRateLimit changes how many bad lines are logged per second, 0 logs none.
+func (dp *DatagramParser) SetBadLineRateLimit(badLineRateLimitPerSecond rate.Limit) {
+	if badLineRateLimitPerSecond > 0 {
+		dp.badLineLimiter.SetLimit(badLineRateLimitPerSecond)
+		dp.badLineLimiter.SetBurst(1)
+	} else {
+		dp.badLineLimiter.SetLimit(0)
+		dp.badLineLimiter.SetBurst(0)
+	}
+}
+
 func (dp *DatagramParser) RunMetrics(ctx context.Context) {
 	statser := stats.FromContext(ctx)
 	flushed, unregister := statser.RegisterFlush()
 	defer unregister()
 
+	var lastTiming parseTimingSnapshot
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -75,6 +93,15 @@ func (dp *DatagramParser) RunMetrics(ctx context.Context) {
 			statser.Gauge("parser.metrics_received", float64(atomic.LoadUint64(&dp.metricsReceived)), nil)
 			statser.Gauge("parser.events_received", float64(atomic.LoadUint64(&dp.eventsReceived)), nil)
 			statser.Gauge("parser.bad_lines_seen", float64(atomic.LoadUint64(&dp.badLines)), nil)
+			if dp.maxLineLength > 0 {
+				statser.Gauge("parser.long_lines_rejected", float64(atomic.LoadUint64(&dp.longLines)), nil)
+			}
+			if dp.parseTiming != nil {
+				dp.parseTiming.sendMetrics(statser, &lastTiming)
+			}
+			if dp.sourceLimiter != nil {
+				dp.sourceLimiter.sendMetrics(statser)
+			}
 		}
 	}
 }
@@ -86,14 +113,22 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		case dgs := <-dp.in:
+		case dgs, ok := <-dp.in:
+			if !ok {
+				return
+			}
 			var metrics []*gostatsd.Metric
 
-			accumB, accumE := uint64(0), uint64(0)
+			accumB, accumE, accumT := uint64(0), uint64(0), uint64(0)
 			for _, dg := range dgs {
 				// TODO: Dispatch Events in Run, not handleDatagram, so it's consistent with Metrics
-				parsedMetrics, eventCount, badLineCount := dp.handleDatagram(ctx, dg.Timestamp, dg.IP, dg.Msg)
+				parsedMetrics, eventCount, badLineCount := dp.handleDatagram(ctx, dg.Timestamp, dg.IP, dg.Tags, dg.Msg)
 				dg.DoneFunc()
+				if dp.sourceLimiter != nil {
+					var throttled int
+					parsedMetrics, throttled = dp.sourceLimiter.allow(dg.IP, parsedMetrics)
+					accumT += uint64(throttled)
+				}
 				metrics = append(metrics, parsedMetrics...)
 				accumE += eventCount
 				accumB += badLineCount
@@ -103,7 +138,7 @@ func (dp *DatagramParser) Run(ctx context.Context) {
 
 				dp.doLogRawMetric(metrics)
 			}
-			atomic.AddUint64(&dp.metricsReceived, uint64(len(metrics)))
+			atomic.AddUint64(&dp.metricsReceived, uint64(len(metrics))+accumT)
 			atomic.AddUint64(&dp.eventsReceived, accumE)
 			atomic.AddUint64(&dp.badLines, accumB)
 		}
@@ -118,8 +153,8 @@ func (dp *DatagramParser) logBadLineRateLimited(line []byte, ip gostatsd.IP, err
 }
 
 // handleDatagram handles the contents of a datagram and parsers it in to Metrics (which are returned), or
-// Events (which are sent to the pipeline via DispatchEvent).
-func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanotime, ip gostatsd.IP, msg []byte) (metrics []*gostatsd.Metric, eventCount uint64, badLineCount uint64) {
+// Events (which are sent to the pipeline via DispatchEvent).  The tags are added to every Metric and Event.
+func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanotime, ip gostatsd.IP, tags gostatsd.Tags, msg []byte) (metrics []*gostatsd.Metric, eventCount uint64, badLineCount uint64) {
 	var numEvents, numBad uint64
 	for {
 		idx := bytes.IndexByte(msg, '\n')
@@ -135,11 +170,29 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanot
 			line = msg[:idx]
 			msg = msg[idx+1:]
 		}
+		var start time.Time
+		if dp.parseTiming != nil {
+			start = time.Now()
+		}
 		metric, event, err := dp.parseLine(line)
+		if dp.parseTiming != nil {
+			dp.parseTiming.record(metric, event, time.Since(start))
+		}
+		if err == errLineTooLong {
+			// Don't log the line, it's likely to be large garbage
+			if dp.badLineLimiter.Allow() {
+				log.Infof("Rejected line of %d bytes from %s: %v", len(line), ip, err)
+			}
+			atomic.AddUint64(&dp.longLines, 1)
+			continue
+		}
 		if err != nil {
 			// logging as debug to avoid spamming logs when a bad actor sends
 			// badly formatted messages
 			dp.logBadLineRateLimited(line, ip, err)
+			if dp.badLineDump != nil {
+				dp.badLineDump.dump(line, ip, err)
+			}
 			numBad++
 			continue
 		}
@@ -159,11 +212,17 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanot
 			} else {
 				metric.SourceIP = ip
 			}
+			if len(tags) > 0 {
+				metric.Tags = append(metric.Tags, tags...)
+			}
 			metric.Timestamp = now
 			metrics = append(metrics, metric)
 		} else if event != nil {
 			numEvents++
 			event.SourceIP = ip // Always keep the source ip for events
+			if len(tags) > 0 {
+				event.Tags = append(event.Tags, tags...)
+			}
 			if event.DateHappened == 0 {
 				event.DateHappened = time.Now().Unix()
 			}
@@ -179,7 +238,8 @@ func (dp *DatagramParser) handleDatagram(ctx context.Context, now gostatsd.Nanot
 // parseLine with lexer.
 func (dp *DatagramParser) parseLine(line []byte) (*gostatsd.Metric, *gostatsd.Event, error) {
 	l := lexer{
-		metricPool: dp.metricPool,
+		metricPool:    dp.metricPool,
+		maxLineLength: dp.maxLineLength,
 	}
 	return l.run(line, dp.namespace)
 }
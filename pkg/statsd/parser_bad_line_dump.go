@@ -0,0 +1,233 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// badLineDumpQueueSize is the number of bad lines which can be waiting to be written, more are only counted.
+	badLineDumpQueueSize = 1000
+	// badLineDumpFlushInterval is how often buffered bad lines are written to the file.
+	badLineDumpFlushInterval = time.Second
+)
+
+// badLine is a line which failed to parse, as written to the dump file.
+type badLine struct {
+	Time   time.Time   `json:"time"`
+	Source gostatsd.IP `json:"source"`
+	Reason string      `json:"reason"`
+	Line   string      `json:"line"`
+}
+
+// badLineDump writes a rate limited sample of the lines which failed to parse to a file, as one JSON object per line,
+// so the mistakes clients make can be inspected.  The file is rotated once it reaches maxSize bytes, keeping
+// maxBackups old files named with a .1, .2, ... suffix, most recent first.  Lines are queued to a single writer so
+// they never block the parsers, and are dropped if the queue is full.
+type badLineDump struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	dumped  uint64
+	dropped uint64
+
+	path       string
+	maxSize    int64
+	maxBackups int
+	limiter    *rate.Limiter
+	lines      chan *badLine
+
+	// Only used by Run
+	file   *os.File
+	writer *bufio.Writer
+	size   int64
+}
+
+// newBadLineDump opens the dump file at path, appending to it if it already exists.
+func newBadLineDump(path string, maxSize int64, maxBackups int, limit rate.Limit) (*badLineDump, error) {
+	if maxSize <= 0 {
+		return nil, fmt.Errorf("%s must be positive", ParamBadLineDumpMaxSize)
+	}
+	if maxBackups < 0 {
+		return nil, fmt.Errorf("%s must not be negative", ParamBadLineDumpMaxBackups)
+	}
+	burst := int(limit)
+	if burst < 1 {
+		burst = 1
+	}
+	d := &badLineDump{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+		limiter:    rate.NewLimiter(limit, burst),
+		lines:      make(chan *badLine, badLineDumpQueueSize),
+	}
+	if err := d.open(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// dump queues line to be written, if the rate limit allows it and the queue isn't full.  The line is copied, so the
+// buffer it is in can be reused.
+func (d *badLineDump) dump(line []byte, ip gostatsd.IP, err error) {
+	if !d.limiter.Allow() {
+		atomic.AddUint64(&d.dropped, 1)
+		return
+	}
+	bl := &badLine{
+		Time:   time.Now(),
+		Source: ip,
+		Reason: err.Error(),
+		Line:   string(line),
+	}
+	select {
+	case d.lines <- bl:
+	default:
+		atomic.AddUint64(&d.dropped, 1)
+	}
+}
+
+// Run writes the queued lines to the file until the context is done, then writes what is buffered and closes it.
+func (d *badLineDump) Run(ctx context.Context) {
+	ticker := time.NewTicker(badLineDumpFlushInterval)
+	defer ticker.Stop()
+	defer d.close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			for {
+				select {
+				case bl := <-d.lines:
+					d.write(bl)
+				default:
+					return
+				}
+			}
+		case bl := <-d.lines:
+			d.write(bl)
+		case <-ticker.C:
+			d.flush()
+		}
+	}
+}
+
+// RunMetrics emits the number of lines dumped and dropped.
+func (d *badLineDump) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("parser.bad_lines_dumped", float64(atomic.LoadUint64(&d.dumped)), nil)
+			statser.Gauge("parser.bad_lines_dump_dropped", float64(atomic.LoadUint64(&d.dropped)), nil)
+		}
+	}
+}
+
+func (d *badLineDump) write(bl *badLine) {
+	if d.writer == nil {
+		// The file couldn't be reopened after rotating, try again.
+		if err := d.open(); err != nil {
+			atomic.AddUint64(&d.dropped, 1)
+			log.Warnf("Failed to open bad line dump file: %v", err)
+			return
+		}
+	}
+	data, err := json.Marshal(bl)
+	if err != nil {
+		atomic.AddUint64(&d.dropped, 1)
+		return
+	}
+	data = append(data, '\n')
+	if d.size > 0 && d.size+int64(len(data)) > d.maxSize {
+		if err := d.rotate(); err != nil {
+			atomic.AddUint64(&d.dropped, 1)
+			log.Warnf("Failed to rotate bad line dump file: %v", err)
+			return
+		}
+	}
+	n, err := d.writer.Write(data)
+	d.size += int64(n)
+	if err != nil {
+		atomic.AddUint64(&d.dropped, 1)
+		log.Warnf("Failed to write bad line dump file: %v", err)
+		return
+	}
+	atomic.AddUint64(&d.dumped, 1)
+}
+
+func (d *badLineDump) open() error {
+	file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to open bad line dump file: %v", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("failed to open bad line dump file: %v", err)
+	}
+	d.file = file
+	d.writer = bufio.NewWriter(file)
+	d.size = info.Size()
+	return nil
+}
+
+// rotate closes the file and renames it, and the backups, to the next suffix, removing the oldest, then opens a new
+// file.
+func (d *badLineDump) rotate() error {
+	d.close()
+	if d.maxBackups == 0 {
+		if err := os.Remove(d.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	} else {
+		for i := d.maxBackups - 1; i > 0; i-- {
+			if err := os.Rename(d.backupPath(i), d.backupPath(i+1)); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		if err := os.Rename(d.path, d.backupPath(1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return d.open()
+}
+
+func (d *badLineDump) backupPath(i int) string {
+	return fmt.Sprintf("%s.%d", d.path, i)
+}
+
+func (d *badLineDump) flush() {
+	if d.writer != nil {
+		if err := d.writer.Flush(); err != nil {
+			log.Warnf("Failed to write bad line dump file: %v", err)
+		}
+	}
+}
+
+func (d *badLineDump) close() {
+	if d.file == nil {
+		return
+	}
+	d.flush()
+	if err := d.file.Close(); err != nil {
+		log.Warnf("Failed to close bad line dump file: %v", err)
+	}
+	d.file = nil
+	d.writer = nil
+}
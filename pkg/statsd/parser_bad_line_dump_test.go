@@ -0,0 +1,115 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+func newTestBadLineDump(t *testing.T, maxSize int64, maxBackups int, limit rate.Limit) (*badLineDump, string, func()) {
+	dir, err := ioutil.TempDir("", "badlines")
+	require.NoError(t, err)
+	path := filepath.Join(dir, "bad.log")
+	d, err := newBadLineDump(path, maxSize, maxBackups, limit)
+	require.NoError(t, err)
+	return d, path, func() { _ = os.RemoveAll(dir) }
+}
+
+func readBadLines(t *testing.T, path string) []badLine {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	var lines []badLine
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var bl badLine
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &bl))
+		lines = append(lines, bl)
+	}
+	require.NoError(t, scanner.Err())
+	return lines
+}
+
+// runBadLineDump writes everything queued, as when the server stops.
+func runBadLineDump(d *badLineDump) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+}
+
+func TestBadLineDumpFromParser(t *testing.T) {
+	t.Parallel()
+	d, path, cleanup := newTestBadLineDump(t, DefaultBadLineDumpMaxSize, 0, 100)
+	defer cleanup()
+	dp, _ := newTestParser(false)
+	dp.badLineDump = d
+
+	msg := []byte("a:1|c\nbad\nb:x|c")
+	_, _, badLines := dp.handleDatagram(context.Background(), 0, "10.0.0.1", nil, msg)
+	assert.EqualValues(t, 2, badLines)
+	copy(msg, "xxxxxxxxxxxxxxx") // The datagram buffer is reused once parsed
+	runBadLineDump(d)
+
+	lines := readBadLines(t, path)
+	require.Len(t, lines, 2)
+	assert.Equal(t, "bad", lines[0].Line)
+	assert.Equal(t, gostatsd.IP("10.0.0.1"), lines[0].Source)
+	assert.NotEmpty(t, lines[0].Reason)
+	assert.False(t, lines[0].Time.IsZero())
+	assert.Equal(t, "b:x|c", lines[1].Line)
+	assert.EqualValues(t, 2, d.dumped)
+}
+
+func TestBadLineDumpRotates(t *testing.T) {
+	t.Parallel()
+	d, path, cleanup := newTestBadLineDump(t, 150, 2, 100)
+	defer cleanup()
+
+	// Each line is around 100 bytes, so every line is in its own file
+	for i := 0; i < 4; i++ {
+		d.dump([]byte(fmt.Sprintf("line%d", i)), "10.0.0.1", errors.New("bad"))
+	}
+	runBadLineDump(d)
+
+	for file, line := range map[string]string{path: "line3", path + ".1": "line2", path + ".2": "line1"} {
+		lines := readBadLines(t, file)
+		require.Len(t, lines, 1, file)
+		assert.Equal(t, line, lines[0].Line, file)
+	}
+	_, err := os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestBadLineDumpDrops(t *testing.T) {
+	t.Parallel()
+	d, path, cleanup := newTestBadLineDump(t, DefaultBadLineDumpMaxSize, 0, badLineDumpQueueSize*2)
+	defer cleanup()
+
+	// Nothing is writing, so the queue fills
+	for i := 0; i < badLineDumpQueueSize+10; i++ {
+		d.dump([]byte("bad"), "10.0.0.1", errors.New("bad"))
+	}
+	assert.EqualValues(t, 10, d.dropped)
+	runBadLineDump(d)
+	assert.Len(t, readBadLines(t, path), badLineDumpQueueSize)
+
+	// Lines over the rate limit are dropped
+	d, _, cleanup2 := newTestBadLineDump(t, DefaultBadLineDumpMaxSize, 0, 1)
+	defer cleanup2()
+	d.dump([]byte("bad"), "10.0.0.1", errors.New("bad"))
+	d.dump([]byte("bad"), "10.0.0.1", errors.New("bad"))
+	assert.EqualValues(t, 1, d.dropped)
+	assert.Len(t, d.lines, 1)
+}
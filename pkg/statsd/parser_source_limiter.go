@@ -0,0 +1,127 @@
+package statsd
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// sourceLimiterShards is the number of independently locked shards of a sourceLimiter, so parsers rarely wait
+	// for each other.
+	sourceLimiterShards = 16
+	// sourceLimiterMaxSources is the number of sources a sourceLimiter tracks, the least recently seen are forgotten.
+	sourceLimiterMaxSources = 65536
+)
+
+// sourceLimiter limits the number of metrics accepted per second from each source address, with a token bucket for
+// each source.
+type sourceLimiter struct {
+	limit  rate.Limit
+	burst  int
+	shards [sourceLimiterShards]sourceLimiterShard
+}
+
+// sourceLimiterShard tracks the buckets of the sources which hash to it, evicting the least recently seen.
+type sourceLimiterShard struct {
+	mu         sync.Mutex
+	maxSources int
+	order      *list.List // Of *sourceBucket, most recently seen at the front
+	elements   map[gostatsd.IP]*list.Element
+}
+
+type sourceBucket struct {
+	ip        gostatsd.IP
+	limiter   *rate.Limiter
+	throttled uint64 // Number of metrics dropped since the last flush
+}
+
+// newSourceLimiter returns a sourceLimiter which accepts limit metrics per second from each source, with bursts of up
+// to one second of metrics.
+func newSourceLimiter(limit rate.Limit) *sourceLimiter {
+	burst := int(limit)
+	if burst < 1 {
+		burst = 1
+	}
+	sl := &sourceLimiter{
+		limit: limit,
+		burst: burst,
+	}
+	for i := range sl.shards {
+		sl.shards[i].maxSources = sourceLimiterMaxSources / sourceLimiterShards
+		sl.shards[i].order = list.New()
+		sl.shards[i].elements = make(map[gostatsd.IP]*list.Element)
+	}
+	return sl
+}
+
+// allow filters metrics to the ones accepted from ip, releasing and counting the rest.  The shard of ip is locked once
+// for all the metrics.  metrics is modified in place.
+func (sl *sourceLimiter) allow(ip gostatsd.IP, metrics []*gostatsd.Metric) ([]*gostatsd.Metric, int) {
+	if len(metrics) == 0 {
+		return metrics, 0
+	}
+	shard := &sl.shards[fnv64a(string(ip))%sourceLimiterShards]
+	now := time.Now()
+
+	shard.mu.Lock()
+	bucket := shard.touch(ip, sl.limit, sl.burst)
+	accepted := metrics[:0]
+	throttled := 0
+	for _, m := range metrics {
+		if bucket.limiter.AllowN(now, 1) {
+			accepted = append(accepted, m)
+		} else {
+			throttled++
+			m.Done()
+		}
+	}
+	bucket.throttled += uint64(throttled)
+	shard.mu.Unlock()
+
+	return accepted, throttled
+}
+
+// touch returns the bucket of ip as the most recently seen, creating it if ip isn't tracked.  The shard must be locked.
+func (s *sourceLimiterShard) touch(ip gostatsd.IP, limit rate.Limit, burst int) *sourceBucket {
+	if e, ok := s.elements[ip]; ok {
+		s.order.MoveToFront(e)
+		return e.Value.(*sourceBucket)
+	}
+	if len(s.elements) >= s.maxSources {
+		oldest := s.order.Back()
+		s.order.Remove(oldest)
+		delete(s.elements, oldest.Value.(*sourceBucket).ip)
+	}
+	bucket := &sourceBucket{
+		ip:      ip,
+		limiter: rate.NewLimiter(limit, burst),
+	}
+	s.elements[ip] = s.order.PushFront(bucket)
+	return bucket
+}
+
+// sendMetrics emits the number of metrics dropped from each source since the last flush.
+func (sl *sourceLimiter) sendMetrics(statser stats.Statser) {
+	for i := range sl.shards {
+		shard := &sl.shards[i]
+		shard.mu.Lock()
+		for e := shard.order.Front(); e != nil; e = e.Next() {
+			bucket := e.Value.(*sourceBucket)
+			if bucket.throttled > 0 {
+				source := string(bucket.ip)
+				if bucket.ip == gostatsd.UnknownIP {
+					source = "unknown"
+				}
+				statser.Count("parser.throttled", float64(bucket.throttled), gostatsd.Tags{"source:" + source})
+				bucket.throttled = 0
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
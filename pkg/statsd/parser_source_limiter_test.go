@@ -0,0 +1,110 @@
+package statsd
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countStatser records the total of each counter, by its tags.
+type countStatser struct {
+	stats.Statser
+	counts map[string]float64
+}
+
+func (cs *countStatser) Count(name string, amount float64, tags gostatsd.Tags) {
+	cs.counts[name+" "+tags.String()] += amount
+}
+
+func sourceLimiterMetrics(n int, done *int) []*gostatsd.Metric {
+	metrics := make([]*gostatsd.Metric, n)
+	for i := range metrics {
+		metrics[i] = &gostatsd.Metric{Name: fmt.Sprintf("m%d", i), DoneFunc: func() { *done++ }}
+	}
+	return metrics
+}
+
+func TestSourceLimiterAllow(t *testing.T) {
+	t.Parallel()
+	sl := newSourceLimiter(3)
+	var done int
+
+	accepted, throttled := sl.allow("10.0.0.1", sourceLimiterMetrics(5, &done))
+	require.Len(t, accepted, 3)
+	assert.Equal(t, "m0", accepted[0].Name)
+	assert.Equal(t, "m2", accepted[2].Name)
+	assert.Equal(t, 2, throttled)
+	assert.Equal(t, 2, done) // The throttled metrics are released
+
+	// Each source has its own bucket
+	accepted, throttled = sl.allow("10.0.0.2", sourceLimiterMetrics(3, &done))
+	assert.Len(t, accepted, 3)
+	assert.Zero(t, throttled)
+	_, throttled = sl.allow(gostatsd.UnknownIP, sourceLimiterMetrics(4, &done))
+	assert.Equal(t, 1, throttled)
+
+	statser := &countStatser{Statser: stats.NewNullStatser(), counts: map[string]float64{}}
+	sl.sendMetrics(statser)
+	assert.Equal(t, map[string]float64{
+		"parser.throttled source:10.0.0.1": 2,
+		"parser.throttled source:unknown":  1,
+	}, statser.counts)
+
+	// Counts are reset every flush
+	sl.sendMetrics(statser)
+	assert.Len(t, statser.counts, 2)
+	assert.EqualValues(t, 2, statser.counts["parser.throttled source:10.0.0.1"])
+}
+
+func TestSourceLimiterEvictsLeastRecentlySeen(t *testing.T) {
+	t.Parallel()
+	sl := newSourceLimiter(1)
+	var done int
+	shard := &sl.shards[0]
+	shard.maxSources = 2
+
+	// Find sources in the same shard
+	var ips []gostatsd.IP
+	for i := 0; len(ips) < 3; i++ {
+		ip := gostatsd.IP(fmt.Sprintf("10.0.0.%d", i))
+		if fnv64a(string(ip))%sourceLimiterShards == 0 {
+			ips = append(ips, ip)
+		}
+	}
+
+	sl.allow(ips[0], sourceLimiterMetrics(1, &done))
+	sl.allow(ips[1], sourceLimiterMetrics(1, &done))
+	sl.allow(ips[0], sourceLimiterMetrics(1, &done)) // ips[1] is now the least recently seen
+	sl.allow(ips[2], sourceLimiterMetrics(1, &done))
+
+	assert.Len(t, shard.elements, 2)
+	assert.Contains(t, shard.elements, ips[0])
+	assert.NotContains(t, shard.elements, ips[1])
+	assert.Contains(t, shard.elements, ips[2])
+}
+
+func BenchmarkSourceLimiterAllow(b *testing.B) {
+	sl := newSourceLimiter(1e9)
+	ips := make([]gostatsd.IP, 1000)
+	for i := range ips {
+		ips[i] = gostatsd.IP(fmt.Sprintf("10.0.%d.%d", i/256, i%256))
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		metrics := make([]*gostatsd.Metric, 10)
+		i := 0
+		for pb.Next() {
+			for j := range metrics {
+				metrics[j] = &gostatsd.Metric{}
+			}
+			sl.allow(ips[i%len(ips)], metrics)
+			i++
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package statsd
 
 import (
+	"bytes"
 	"context"
 	"strconv"
 	"testing"
@@ -8,6 +9,7 @@ import (
 	"github.com/atlassian/gostatsd"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -35,7 +37,7 @@ func TestParseEmptyDatagram(t *testing.T) {
 		t.Run(strconv.Itoa(pos), func(t *testing.T) {
 			t.Parallel()
 			mr, ch := newTestParser(false)
-			_, _, _ = mr.handleDatagram(context.Background(), 0, gostatsd.UnknownIP, inp)
+			_, _, _ = mr.handleDatagram(context.Background(), 0, gostatsd.UnknownIP, nil, inp)
 			assert.Zero(t, len(ch.events), ch.events)
 			assert.Zero(t, len(ch.metrics), ch.metrics)
 		})
@@ -92,7 +94,7 @@ func TestParseDatagram(t *testing.T) {
 		t.Run(datagram, func(t *testing.T) {
 			t.Parallel()
 			mr, ch := newTestParser(false)
-			metrics, _, _ := mr.handleDatagram(context.Background(), 0, fakeIP, []byte(datagram))
+			metrics, _, _ := mr.handleDatagram(context.Background(), 0, fakeIP, nil, []byte(datagram))
 			ch.DispatchMetrics(context.Background(), metrics)
 			for i, e := range ch.events {
 				if e.DateHappened <= 0 {
@@ -161,7 +163,7 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 		t.Run(datagram, func(t *testing.T) {
 			t.Parallel()
 			mr, ch := newTestParser(true)
-			metrics, _, _ := mr.handleDatagram(context.Background(), 0, fakeIP, []byte(datagram))
+			metrics, _, _ := mr.handleDatagram(context.Background(), 0, fakeIP, nil, []byte(datagram))
 			for i, e := range ch.events {
 				if e.DateHappened <= 0 {
 					t.Errorf("%q: DateHappened should be positive", e)
@@ -174,3 +176,41 @@ func TestParseDatagramIgnoreHost(t *testing.T) {
 		})
 	}
 }
+
+func TestParseDatagramMaxLineLength(t *testing.T) {
+	t.Parallel()
+	mr, _ := newTestParser(false)
+	mr.maxLineLength = 1024
+	long := bytes.Repeat([]byte("x"), 1024*1024)
+	metrics, _, badLines := mr.handleDatagram(context.Background(), 0, fakeIP, nil, append([]byte("a:1|c\n"), long...))
+	assert.Len(t, metrics, 1)
+	assert.Zero(t, badLines)
+	assert.EqualValues(t, 1, mr.longLines)
+}
+
+func TestParseDatagramTags(t *testing.T) {
+	t.Parallel()
+	mr, ch := newTestParser(false)
+	metrics, events, _ := mr.handleDatagram(context.Background(), 0, fakeIP, gostatsd.Tags{"tenant:billing"}, []byte("a:1|c|#env:prod\nb:2|ms\n_e{1,1}:a|b"))
+	require.Len(t, metrics, 2)
+	assert.Equal(t, gostatsd.Tags{"env:prod", "tenant:billing"}, metrics[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"tenant:billing"}, metrics[1].Tags)
+	assert.EqualValues(t, 1, events)
+	require.Len(t, ch.events, 1)
+	assert.Equal(t, gostatsd.Tags{"tenant:billing"}, ch.events[0].Tags)
+}
+
+func TestParseTiming(t *testing.T) {
+	t.Parallel()
+	mr, _ := newTestParser(false)
+	mr.parseTiming = &parseTiming{}
+	_, _, _ = mr.handleDatagram(context.Background(), 0, fakeIP, nil, []byte("a:1|c\nb:2|ms\nc:3|ms\n_e{1,1}:a|b\nbad"))
+
+	assert.EqualValues(t, 1, mr.parseTiming.lines[gostatsd.COUNTER])
+	assert.EqualValues(t, 2, mr.parseTiming.lines[gostatsd.TIMER])
+	assert.EqualValues(t, 0, mr.parseTiming.lines[gostatsd.GAUGE])
+	assert.EqualValues(t, 0, mr.parseTiming.lines[gostatsd.SET])
+	assert.EqualValues(t, 1, mr.parseTiming.lines[parseTimingEvent])
+	assert.Equal(t, gostatsd.Tags{"type:timer"}, parseTimingTypeTags(int(gostatsd.TIMER)))
+	assert.Equal(t, gostatsd.Tags{"type:event"}, parseTimingTypeTags(parseTimingEvent))
+}
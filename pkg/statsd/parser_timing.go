@@ -0,0 +1,61 @@
+package statsd
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// parseTimingEvent is the index events are timed under, after the metric types.
+const parseTimingEvent = int(gostatsd.SET) + 1
+
+// parseTiming accumulates the time spent parsing lines of each type, indexed by gostatsd.MetricType, with events
+// after them.  It's two atomic adds and a monotonic clock read per line, so cheap enough to leave on.
+type parseTiming struct {
+	// Must be accessed atomically
+	lines [parseTimingEvent + 1]uint64
+	nanos [parseTimingEvent + 1]uint64
+}
+
+// record adds the time taken to parse a line which resulted in metric or event.
+func (pt *parseTiming) record(metric *gostatsd.Metric, event *gostatsd.Event, d time.Duration) {
+	idx := parseTimingEvent
+	if metric != nil {
+		idx = int(metric.Type)
+		if idx >= parseTimingEvent {
+			return
+		}
+	} else if event == nil {
+		return
+	}
+	atomic.AddUint64(&pt.lines[idx], 1)
+	atomic.AddUint64(&pt.nanos[idx], uint64(d))
+}
+
+// parseTimingTypeTags returns the tags for the index of a type.
+func parseTimingTypeTags(idx int) gostatsd.Tags {
+	if idx == parseTimingEvent {
+		return gostatsd.Tags{"type:event"}
+	}
+	return gostatsd.Tags{"type:" + gostatsd.MetricType(idx).String()}
+}
+
+// parseTimingSnapshot holds the totals of a parseTiming at the last flush.
+type parseTimingSnapshot struct {
+	lines [parseTimingEvent + 1]uint64
+	nanos [parseTimingEvent + 1]uint64
+}
+
+// sendMetrics emits the number of lines, and the total time spent parsing them, for each type since last.
+func (pt *parseTiming) sendMetrics(statser stats.Statser, last *parseTimingSnapshot) {
+	for idx := range pt.lines {
+		lines := atomic.LoadUint64(&pt.lines[idx])
+		nanos := atomic.LoadUint64(&pt.nanos[idx])
+		tags := parseTimingTypeTags(idx)
+		statser.Gauge("parser.lines_parsed", float64(lines-last.lines[idx]), tags)
+		statser.Gauge("parser.parse_time", float64(nanos-last.nanos[idx])/float64(time.Millisecond), tags)
+		last.lines[idx], last.nanos[idx] = lines, nanos
+	}
+}
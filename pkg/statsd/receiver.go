@@ -7,6 +7,7 @@ import (
 	"sync/atomic"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/capture"
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
 	"github.com/atlassian/gostatsd/pkg/pool"
 	"github.com/atlassian/gostatsd/pkg/stats"
@@ -32,7 +33,11 @@ type DatagramReceiver struct {
 
 	receiveBatchSize int // The number of datagrams to read in each batch
 	numReaders       int
-	socketFactory    SocketFactory
+	listeners        []datagramListener
+	capturer         *capture.Capturer // Optional, samples raw datagrams for debugging
+	warmedUp         <-chan struct{}   // Optional, datagrams are not read until it is closed
+	ports            atomic.Value      // map[uint64]struct{}, the local UDP ports of the sockets, set by Run
+	lastDrops        uint64            // Datagrams dropped as of the previous flush, only accessed by RunMetrics
 
 	out chan<- []*Datagram // Output chan of read datagram batches
 }
@@ -43,7 +48,7 @@ func NewDatagramReceiver(out chan<- []*Datagram, sf SocketFactory, numReaders, r
 		out:              out,
 		receiveBatchSize: receiveBatchSize,
 		numReaders:       numReaders,
-		socketFactory:    sf,
+		listeners:        []datagramListener{{socketFactory: sf}},
 		bufPool:          pool.NewDatagramBufferPool(packetSizeUDP),
 	}
 }
@@ -69,6 +74,11 @@ func (dr *DatagramReceiver) RunMetrics(ctx context.Context) {
 			}
 			statser.Gauge("receiver.datagrams_received", float64(dr.cumulDatagramsReceived), nil)
 			statser.Gauge("receiver.avg_datagrams_in_batch", avgDatagramsInBatch, nil)
+			// receiver.datagrams_dropped is the number of datagrams the kernel dropped since the previous flush
+			// because the receive buffers of the sockets were full.  It is only known on Linux.
+			if dropped, ok := dr.datagramsDropped(); ok {
+				statser.Gauge("receiver.datagrams_dropped", float64(dropped), nil)
+			}
 		}
 	}
 }
@@ -76,15 +86,43 @@ func (dr *DatagramReceiver) RunMetrics(ctx context.Context) {
 func (dr *DatagramReceiver) Run(ctx context.Context) {
 	wg := wait.Group{}
 	var connections []net.PacketConn
+	var connectionTags []gostatsd.Tags
+
+	for _, l := range dr.listeners {
+		for r := 0; r < dr.numReaders; r++ {
+			c, err := l.socketFactory()
+			if err != nil {
+				logger := logrus.WithError(err)
+				if l.addr != "" {
+					logger = logger.WithField("addr", l.addr)
+				}
+				logger.Fatal("unable to create socket")
+			}
+			connections = append(connections, c)
+			connectionTags = append(connectionTags, l.tags)
+		}
+	}
 
-	for r := 0; r < dr.numReaders; r++ {
-		c, err := dr.socketFactory()
-		if err != nil {
-			logrus.WithError(err).Fatal("unable to create socket")
+	ports := map[uint64]struct{}{}
+	for _, c := range connections {
+		if addr, ok := c.LocalAddr().(*net.UDPAddr); ok {
+			ports[uint64(addr.Port)] = struct{}{}
+		}
+	}
+	dr.ports.Store(ports)
+
+	// The sockets are bound, so datagrams which arrive while warming up are buffered by the OS until they are read.
+	if dr.warmedUp != nil {
+		select {
+		case <-ctx.Done():
+		case <-dr.warmedUp:
 		}
-		connections = append(connections, c)
+	}
+
+	for i, c := range connections {
+		c, tags := c, connectionTags[i]
 		wg.StartWithContext(ctx, func(ctx context.Context) {
-			dr.Receive(ctx, c)
+			dr.receive(ctx, c, tags)
 		})
 	}
 
@@ -102,8 +140,33 @@ func (dr *DatagramReceiver) Run(ctx context.Context) {
 	wg.Wait()
 }
 
+// datagramsDropped returns the number of datagrams dropped by the sockets since it was last called.  Returns false if
+// the sockets aren't UDP sockets, or their drops can't be read.
+func (dr *DatagramReceiver) datagramsDropped() (uint64, bool) {
+	ports, _ := dr.ports.Load().(map[uint64]struct{})
+	if len(ports) == 0 {
+		return 0, false
+	}
+	drops, ok := udpDrops(udpSocketFiles, ports)
+	if !ok {
+		return 0, false
+	}
+	dropped := drops - dr.lastDrops
+	if drops < dr.lastDrops {
+		// The sockets have been replaced, so their counts started again.
+		dropped = drops
+	}
+	dr.lastDrops = drops
+	return dropped, true
+}
+
 // Receive accepts incoming datagrams on c, and passes them off to be parsed
 func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
+	dr.receive(ctx, c, nil)
+}
+
+// receive accepts incoming datagrams on c, and passes them off to be parsed with tags added to what they contain.
+func (dr *DatagramReceiver) receive(ctx context.Context, c net.PacketConn, tags gostatsd.Tags) {
 	br := NewBatchReader(c)
 	messages := make([]Message, dr.receiveBatchSize)
 	retBuffers := make([]*[][]byte, dr.receiveBatchSize)
@@ -147,6 +210,10 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 				Msg:       buf,
 				Timestamp: now,
 				DoneFunc:  doneFn,
+				Tags:      tags,
+			}
+			if dr.capturer != nil {
+				dr.capturer.Capture(dgs[i].IP, now, buf)
 			}
 			retBuffers[i] = dr.bufPool.Get()
 			messages[i].Buffers = *retBuffers[i]
@@ -161,8 +228,12 @@ func (dr *DatagramReceiver) Receive(ctx context.Context, c net.PacketConn) {
 }
 
 func getIP(addr net.Addr) gostatsd.IP {
-	if a, ok := addr.(*net.UDPAddr); ok {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
 		return gostatsd.IP(a.IP.String())
+	case *net.UnixAddr, nil:
+		// Datagrams on a Unix domain socket have no address, or the path of the sender if it is bound
+		return gostatsd.UnknownIP
 	}
 	logrus.Errorf("Cannot get source address %q of type %T", addr, addr)
 	return gostatsd.UnknownIP
@@ -0,0 +1,65 @@
+package statsd
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// udpSocketFiles are the files Linux lists the UDP sockets of the network namespace in, with the number of datagrams
+// each has dropped because its receive buffer was full.
+var udpSocketFiles = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+// udpDrops returns the total number of datagrams dropped by the UDP sockets bound to any of ports, from the socket
+// lists in files.  Returns false if none of the files can be read, such as when not running on Linux.
+func udpDrops(files []string, ports map[uint64]struct{}) (uint64, bool) {
+	var total uint64
+	read := false
+	for _, file := range files {
+		drops, err := readUDPDrops(file, ports)
+		if err != nil {
+			continue
+		}
+		total += drops
+		read = true
+	}
+	return total, read
+}
+
+// readUDPDrops sums the drops column of the sockets in a /proc/net/udp style file which are bound to any of ports.
+// Each line after the header is of the form:
+//
+//	sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+//	0: 00000000:1F90 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 12345 2 0000000000000000 0
+func readUDPDrops(file string, ports map[uint64]struct{}) (uint64, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var total uint64
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // Skip the header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		local := fields[1]
+		port, err := strconv.ParseUint(local[strings.LastIndexByte(local, ':')+1:], 16, 16)
+		if err != nil {
+			continue
+		}
+		if _, ok := ports[port]; !ok {
+			continue
+		}
+		drops, err := strconv.ParseUint(fields[len(fields)-1], 10, 64)
+		if err != nil {
+			continue
+		}
+		total += drops
+	}
+	return total, scanner.Err()
+}
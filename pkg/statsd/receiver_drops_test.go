@@ -0,0 +1,41 @@
+package statsd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDPDrops(t *testing.T) {
+	t.Parallel()
+	dir, err := ioutil.TempDir("", "udpdrops")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	udp := filepath.Join(dir, "udp")
+	require.NoError(t, ioutil.WriteFile(udp, []byte(`   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  100: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1001 2 0000000000000000 3
+  101: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1002 2 0000000000000000 4
+  102: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1003 2 0000000000000000 100
+`), 0644))
+	udp6 := filepath.Join(dir, "udp6")
+	require.NoError(t, ioutil.WriteFile(udp6, []byte(`  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  200: 00000000000000000000000000000000:1FBD 00000000000000000000000000000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 2001 2 0000000000000000 5
+`), 0644))
+
+	// Port 8125 is 1FBD, port 53 (0035) belongs to another process.
+	drops, ok := udpDrops([]string{udp, udp6}, map[uint64]struct{}{8125: {}})
+	assert.True(t, ok)
+	assert.EqualValues(t, 12, drops)
+
+	drops, ok = udpDrops([]string{udp, filepath.Join(dir, "missing")}, map[uint64]struct{}{8125: {}})
+	assert.True(t, ok)
+	assert.EqualValues(t, 7, drops)
+
+	_, ok = udpDrops([]string{filepath.Join(dir, "missing")}, map[uint64]struct{}{8125: {}})
+	assert.False(t, ok)
+}
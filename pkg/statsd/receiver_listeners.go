@@ -0,0 +1,87 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// datagramListener is an address the DatagramReceiver receives datagrams on.
+type datagramListener struct {
+	addr          string // Only used for logging, empty for a custom socket
+	socketFactory SocketFactory
+	tags          gostatsd.Tags // Optional, added to every metric and event received on the listener
+}
+
+// ParseMetricsAddrs splits a comma separated list of addresses to listen for metrics on.
+func ParseMetricsAddrs(s string) ([]string, error) {
+	var addrs []string
+	seen := map[string]struct{}{}
+	for _, addr := range strings.Split(s, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+		if _, ok := seen[addr]; ok {
+			return nil, fmt.Errorf("%s is listed more than once in %s", addr, ParamMetricsAddr)
+		}
+		seen[addr] = struct{}{}
+		addrs = append(addrs, addr)
+	}
+	if len(addrs) == 0 {
+		return nil, errors.New(ParamMetricsAddr + " must not be empty")
+	}
+	return addrs, nil
+}
+
+// NewListenerTagsFromViper returns the tags to add to metrics and events received on each address, from the rules
+// named in listener-tags.  Every rule must be for one of addrs.
+func NewListenerTagsFromViper(v *viper.Viper, addrs []string) (map[string]gostatsd.Tags, error) {
+	listening := make(map[string]struct{}, len(addrs))
+	for _, addr := range addrs {
+		listening[addr] = struct{}{}
+	}
+	tags := map[string]gostatsd.Tags{}
+	for _, ruleName := range v.GetStringSlice(ParamListenerTags) {
+		vRule := v.Sub("listener-tag." + ruleName)
+		if vRule == nil {
+			logrus.Warnf("Listener tag rule doesn't exist: %v", ruleName)
+			continue
+		}
+		vRule.SetDefault("addr", "")
+		vRule.SetDefault("tags", []string{})
+		addr := vRule.GetString("addr")
+		if _, ok := listening[addr]; !ok {
+			return nil, fmt.Errorf("listener tag rule %v: addr %q is not in %s", ruleName, addr, ParamMetricsAddr)
+		}
+		tags[addr] = append(tags[addr], vRule.GetStringSlice("tags")...)
+		logrus.Infof("Loaded listener tag rule %v", ruleName)
+	}
+	return tags, nil
+}
+
+// newListeners returns a listener for every address in MetricsAddr.
+func (s *Server) newListeners() ([]datagramListener, error) {
+	addrs, err := ParseMetricsAddrs(s.MetricsAddr)
+	if err != nil {
+		return nil, err
+	}
+	tags, err := NewListenerTagsFromViper(s.Viper, addrs)
+	if err != nil {
+		return nil, err
+	}
+	listeners := make([]datagramListener, 0, len(addrs))
+	for _, addr := range addrs {
+		listeners = append(listeners, datagramListener{
+			addr:          addr,
+			socketFactory: socketFactory(addr, s.ConnPerReader),
+			tags:          tags[addr],
+		})
+	}
+	return listeners, nil
+}
@@ -0,0 +1,52 @@
+package statsd
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func TestParseMetricsAddrs(t *testing.T) {
+	t.Parallel()
+	addrs, err := ParseMetricsAddrs(":8125")
+	require.NoError(t, err)
+	assert.Equal(t, []string{":8125"}, addrs)
+
+	addrs, err = ParseMetricsAddrs(" :8125, 127.0.0.1:8126 ,")
+	require.NoError(t, err)
+	assert.Equal(t, []string{":8125", "127.0.0.1:8126"}, addrs)
+
+	_, err = ParseMetricsAddrs(":8125,:8125")
+	assert.Error(t, err)
+	_, err = ParseMetricsAddrs(" , ")
+	assert.Error(t, err)
+}
+
+func TestNewListenerTagsFromViper(t *testing.T) {
+	t.Parallel()
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(strings.NewReader(`
+listener-tags = ['billing', 'billing-team', 'missing']
+
+[listener-tag.billing]
+addr = '127.0.0.1:8126'
+tags = ['tenant:billing']
+
+[listener-tag.billing-team]
+addr = '127.0.0.1:8126'
+tags = ['team:payments']
+`)))
+	tags, err := NewListenerTagsFromViper(v, []string{":8125", "127.0.0.1:8126"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]gostatsd.Tags{"127.0.0.1:8126": {"tenant:billing", "team:payments"}}, tags)
+
+	// A rule must be for an address which is listened on.
+	_, err = NewListenerTagsFromViper(v, []string{":8125"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,329 @@
+package statsd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/capture"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// tcpBatchSize is the size in bytes after which the lines read from a connection are passed off to be parsed, even if
+// more are immediately available.
+const tcpBatchSize = packetSizeUDP
+
+// tcpAcceptRetryDelay is how long to wait before accepting another connection after an error.
+const tcpAcceptRetryDelay = 100 * time.Millisecond
+
+// The ways lines can be framed on a connection.
+const (
+	// FramingNewline is a stream of newline delimited lines.  A line may be split across any number of writes, so
+	// a line is only parsed once its newline is read.
+	FramingNewline = "newline"
+	// FramingLengthPrefix is a stream of frames, each a 4 byte big-endian length followed by that many bytes of
+	// newline delimited lines.  A frame is parsed as a whole once it is read, so a client which writes its buffer as
+	// a frame never has a line split at the end of the buffer.
+	FramingLengthPrefix = "length-prefix"
+)
+
+// validateFraming returns an error if framing, the value of param, isn't a known framing.  Empty is FramingNewline.
+func validateFraming(param, framing string) error {
+	switch framing {
+	case "", FramingNewline, FramingLengthPrefix:
+		return nil
+	}
+	return fmt.Errorf("invalid %s %q, must be %s or %s", param, framing, FramingNewline, FramingLengthPrefix)
+}
+
+// TCPReceiver accepts connections on its Listener, and passes the lines read from each off to be parsed as
+// datagrams.
+type TCPReceiver struct {
+	// Counter fields below must be read/written only using atomic instructions.
+	// 64-bit fields must be the first fields in the struct to guarantee proper memory alignment.
+	// See https://golang.org/pkg/sync/atomic/#pkg-note-BUG
+	connectionsAccepted uint64
+	connectionsActive   int64
+	linesTooLong        uint64
+	framesTooLong       uint64
+
+	listener      net.Listener
+	slots         chan struct{} // Limits the number of connections read from concurrently
+	maxLineLength int           // Lines longer than this are discarded
+	network       string        // Used in the names of the internal metrics, tcp or unix
+	framing       string        // How lines are framed, FramingNewline or FramingLengthPrefix
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{} // Open connections, closed when the receiver stops
+	closed bool                  // True once the receiver has stopped, new connections are closed immediately
+
+	capturer *capture.Capturer // Optional, samples raw datagrams for debugging
+	warmedUp <-chan struct{}   // Optional, connections are not accepted until it is closed
+
+	out chan<- []*Datagram // Output chan of read datagram batches
+}
+
+// NewTCPReceiver initialises a new TCPReceiver.  At most maxConnections are read from concurrently, further
+// connections wait to be accepted.
+func NewTCPReceiver(out chan<- []*Datagram, listener net.Listener, maxConnections, maxLineLength int) *TCPReceiver {
+	return &TCPReceiver{
+		out:           out,
+		listener:      listener,
+		slots:         make(chan struct{}, maxConnections),
+		maxLineLength: maxLineLength,
+		network:       "tcp",
+		framing:       FramingNewline,
+		conns:         make(map[net.Conn]struct{}),
+	}
+}
+
+func (tr *TCPReceiver) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("receiver."+tr.network+"_connections_accepted", float64(atomic.LoadUint64(&tr.connectionsAccepted)), nil)
+			statser.Gauge("receiver."+tr.network+"_connections_active", float64(atomic.LoadInt64(&tr.connectionsActive)), nil)
+			statser.Gauge("receiver."+tr.network+"_lines_too_long", float64(atomic.LoadUint64(&tr.linesTooLong)), nil)
+			statser.Gauge("receiver."+tr.network+"_frames_too_long", float64(atomic.LoadUint64(&tr.framesTooLong)), nil)
+		}
+	}
+}
+
+func (tr *TCPReceiver) Run(ctx context.Context) {
+	// The listener is bound, so connections made while warming up wait in the OS backlog until they are accepted.
+	if tr.warmedUp != nil {
+		select {
+		case <-ctx.Done():
+		case <-tr.warmedUp:
+		}
+	}
+
+	wg := wait.Group{}
+	wg.StartWithContext(ctx, func(ctx context.Context) {
+		tr.accept(ctx, &wg)
+	})
+
+	// Work until done
+	<-ctx.Done()
+
+	// Close the listener and all the connections, which will make the readers error out and stop
+	if e := tr.listener.Close(); e != nil && !strings.Contains(e.Error(), "use of closed network connection") {
+		logrus.WithError(e).Warn("Error closing listener")
+	}
+	tr.mu.Lock()
+	tr.closed = true
+	for c := range tr.conns {
+		_ = c.Close()
+	}
+	tr.mu.Unlock()
+
+	// Wait for everything to stop
+	wg.Wait()
+}
+
+// accept accepts connections until the listener is closed, reading from each in its own goroutine in wg.
+func (tr *TCPReceiver) accept(ctx context.Context, wg *wait.Group) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case tr.slots <- struct{}{}:
+		}
+		c, err := tr.listener.Accept()
+		if err != nil {
+			<-tr.slots
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+			logrus.WithError(err).Warn("Error accepting connection")
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(tcpAcceptRetryDelay):
+			}
+			continue
+		}
+		atomic.AddUint64(&tr.connectionsAccepted, 1)
+		if !tr.track(c) {
+			_ = c.Close()
+			<-tr.slots
+			return
+		}
+		wg.StartWithContext(ctx, func(ctx context.Context) {
+			defer func() {
+				tr.untrack(c)
+				<-tr.slots
+			}()
+			tr.Receive(ctx, c)
+		})
+	}
+}
+
+// track records c as open, returning false if the receiver has already stopped.
+func (tr *TCPReceiver) track(c net.Conn) bool {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if tr.closed {
+		return false
+	}
+	tr.conns[c] = struct{}{}
+	atomic.AddInt64(&tr.connectionsActive, 1)
+	return true
+}
+
+// untrack closes c and records it as no longer open.
+func (tr *TCPReceiver) untrack(c net.Conn) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if e := c.Close(); e != nil && !tr.closed && !strings.Contains(e.Error(), "use of closed network connection") {
+		logrus.WithError(e).Warn("Error closing connection")
+	}
+	delete(tr.conns, c)
+	atomic.AddInt64(&tr.connectionsActive, -1)
+}
+
+// Receive reads lines from c until it is closed, framed as configured, and passes them off to be parsed.
+func (tr *TCPReceiver) Receive(ctx context.Context, c net.Conn) {
+	ip := getTCPIP(c.RemoteAddr())
+	if tr.framing == FramingLengthPrefix {
+		tr.receiveFrames(ctx, c, ip)
+	} else {
+		tr.receiveLines(ctx, c, ip)
+	}
+}
+
+// receiveLines reads newline delimited lines from c until it is closed, and passes them off to be parsed.  The
+// lines immediately available are passed off together as a single datagram.  A line may be split across any number
+// of reads, and lines longer than maxLineLength are discarded.
+func (tr *TCPReceiver) receiveLines(ctx context.Context, c net.Conn, ip gostatsd.IP) {
+	r := bufio.NewReaderSize(c, tr.maxLineLength+1) // Room for the newline
+	var batch []byte
+	discarding := false // True while reading the rest of a line which is too long
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			if !discarding {
+				atomic.AddUint64(&tr.linesTooLong, 1)
+				discarding = true
+			}
+			continue
+		}
+		if discarding {
+			discarding = false
+		} else {
+			batch = append(batch, line...)
+		}
+		if len(batch) > 0 && (err != nil || r.Buffered() == 0 || len(batch) >= tcpBatchSize) {
+			if !tr.send(ctx, ip, batch) {
+				return
+			}
+			batch = nil
+		}
+		if err != nil {
+			tr.readError(ctx, ip, err)
+			return
+		}
+	}
+}
+
+// receiveFrames reads length-prefixed frames from c until it is closed, and passes the lines in them off to be
+// parsed.  The frames immediately available are passed off together as a single datagram, and frames longer than
+// maxLineLength are discarded.  A connection closed part way through a frame discards the frame.
+func (tr *TCPReceiver) receiveFrames(ctx context.Context, c net.Conn, ip gostatsd.IP) {
+	r := bufio.NewReaderSize(c, tcpBatchSize)
+	var batch []byte
+	var header [4]byte
+	for {
+		_, err := io.ReadFull(r, header[:])
+		if err == nil {
+			size := binary.BigEndian.Uint32(header[:])
+			if uint64(size) > uint64(tr.maxLineLength) {
+				atomic.AddUint64(&tr.framesTooLong, 1)
+				_, err = io.CopyN(ioutil.Discard, r, int64(size))
+			} else if size > 0 {
+				start := len(batch)
+				batch = append(batch, make([]byte, size)...)
+				if _, err = io.ReadFull(r, batch[start:]); err != nil {
+					batch = batch[:start]
+				} else if batch[len(batch)-1] != '\n' {
+					batch = append(batch, '\n') // Keeps the last line of the frame apart from the next frame
+				}
+			}
+		}
+		if len(batch) > 0 && (err != nil || r.Buffered() == 0 || len(batch) >= tcpBatchSize) {
+			if !tr.send(ctx, ip, batch) {
+				return
+			}
+			batch = nil
+		}
+		if err != nil {
+			tr.readError(ctx, ip, err)
+			return
+		}
+	}
+}
+
+// readError logs err from reading a connection, unless it was closed by the client or because the receiver is
+// stopping.
+func (tr *TCPReceiver) readError(ctx context.Context, ip gostatsd.IP, err error) {
+	select {
+	case <-ctx.Done():
+		return
+	default:
+	}
+	if err != io.EOF && !strings.Contains(err.Error(), "use of closed network connection") {
+		logrus.WithError(err).WithField("ip", ip).Warn("Error reading from connection")
+	}
+}
+
+// send passes msg off to be parsed, returning false if the context is done.
+func (tr *TCPReceiver) send(ctx context.Context, ip gostatsd.IP, msg []byte) bool {
+	now := gostatsd.NanoNow()
+	dg := &Datagram{
+		IP:        ip,
+		Msg:       msg,
+		Timestamp: now,
+		DoneFunc:  func() {},
+	}
+	if tr.capturer != nil {
+		tr.capturer.Capture(ip, now, msg)
+	}
+	select {
+	case tr.out <- []*Datagram{dg}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func getTCPIP(addr net.Addr) gostatsd.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return gostatsd.IP(a.IP.String())
+	case *net.UnixAddr:
+		// Connections to a Unix domain socket have no address
+		return gostatsd.UnknownIP
+	}
+	logrus.Errorf("Cannot get source address %q of type %T", addr, addr)
+	return gostatsd.UnknownIP
+}
@@ -0,0 +1,202 @@
+package statsd
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startTCPReceiver runs a TCPReceiver on a random local port until the test ends, returning its address.
+func startTCPReceiver(t *testing.T, out chan<- []*Datagram, maxConnections, maxLineLength int, framing string) (*TCPReceiver, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tr := NewTCPReceiver(out, listener, maxConnections, maxLineLength)
+	tr.framing = framing
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tr.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return tr, listener.Addr().String()
+}
+
+// readLines reads datagrams from ch until n lines have been read, returning them.
+func readLines(t *testing.T, ch <-chan []*Datagram, n int) []string {
+	var lines []string
+	for len(lines) < n {
+		select {
+		case dgs := <-ch:
+			for _, dg := range dgs {
+				assert.Equal(t, "127.0.0.1", string(dg.IP))
+				lines = append(lines, strings.Split(strings.TrimSuffix(string(dg.Msg), "\n"), "\n")...)
+				dg.DoneFunc()
+			}
+		case <-time.After(5 * time.Second):
+			require.FailNow(t, "timed out waiting for lines", "read %v", lines)
+		}
+	}
+	return lines
+}
+
+func TestTCPReceiverPartialReads(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	_, addr := startTCPReceiver(t, ch, 1, 1024, FramingNewline)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	for _, part := range []string{"a:1|", "c\nb:", "2|g\n", "c:3|ms"} {
+		_, err = c.Write([]byte(part))
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, c.Close()) // The final line doesn't need a newline
+
+	assert.Equal(t, []string{"a:1|c", "b:2|g", "c:3|ms"}, readLines(t, ch, 3))
+}
+
+func TestTCPReceiverLineTooLong(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	tr, addr := startTCPReceiver(t, ch, 1, 16, FramingNewline)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("before:1|c\n" + strings.Repeat("x", 100) + ":1|c\nafter:1|c\n"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"before:1|c", "after:1|c"}, readLines(t, ch, 2))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&tr.linesTooLong))
+}
+
+// frame returns payload prefixed with its length.
+func frame(payload string) []byte {
+	b := make([]byte, 4, 4+len(payload))
+	binary.BigEndian.PutUint32(b, uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestTCPReceiverLengthPrefixPartialReads(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	_, addr := startTCPReceiver(t, ch, 1, 1024, FramingLengthPrefix)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	// The frames are split across writes part way through the length and the lines, and the last line of a frame
+	// doesn't need a newline
+	data := append(frame("a:1|c\nb:2|g"), frame("c:3|ms\n")...)
+	for _, part := range [][]byte{data[:2], data[2:7], data[7:19], data[19:]} {
+		_, err = c.Write(part)
+		require.NoError(t, err)
+		time.Sleep(10 * time.Millisecond)
+	}
+	require.NoError(t, c.Close())
+
+	assert.Equal(t, []string{"a:1|c", "b:2|g", "c:3|ms"}, readLines(t, ch, 3))
+}
+
+func TestTCPReceiverLengthPrefixFrameTooLong(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	tr, addr := startTCPReceiver(t, ch, 1, 16, FramingLengthPrefix)
+
+	c, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	var data []byte
+	data = append(data, frame("before:1|c")...)
+	data = append(data, frame("")...) // Empty frames are ignored
+	data = append(data, frame(strings.Repeat("x", 100)+":1|c")...)
+	data = append(data, frame("after:1|c")...)
+	data = append(data, frame("truncated:1|c")[:8]...) // Discarded when the connection closes
+	_, err = c.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	assert.Equal(t, []string{"before:1|c", "after:1|c"}, readLines(t, ch, 2))
+	assert.EqualValues(t, 1, atomic.LoadUint64(&tr.framesTooLong))
+	select {
+	case dgs := <-ch:
+		assert.Fail(t, "unexpected datagram", "%q", dgs[0].Msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestValidateFraming(t *testing.T) {
+	t.Parallel()
+	assert.NoError(t, validateFraming(ParamTCPFraming, ""))
+	assert.NoError(t, validateFraming(ParamTCPFraming, FramingNewline))
+	assert.NoError(t, validateFraming(ParamTCPFraming, FramingLengthPrefix))
+	assert.EqualError(t, validateFraming(ParamTCPFraming, "netstring"), `invalid tcp-framing "netstring", must be newline or length-prefix`)
+}
+
+func TestTCPReceiverMaxConnections(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	tr, addr := startTCPReceiver(t, ch, 1, 1024, FramingNewline)
+
+	c1, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	_, err = c1.Write([]byte("first:1|c\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"first:1|c"}, readLines(t, ch, 1))
+
+	c2, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer c2.Close()
+	_, err = c2.Write([]byte("second:1|c\n"))
+	require.NoError(t, err)
+	select {
+	case <-ch:
+		require.FailNow(t, "second connection read while the first is open")
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.EqualValues(t, 1, atomic.LoadUint64(&tr.connectionsAccepted))
+
+	require.NoError(t, c1.Close())
+	assert.Equal(t, []string{"second:1|c"}, readLines(t, ch, 1))
+	assert.EqualValues(t, 2, atomic.LoadUint64(&tr.connectionsAccepted))
+}
+
+func TestTCPReceiverStop(t *testing.T) {
+	t.Parallel()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	ch := make(chan []*Datagram, 10)
+	tr := NewTCPReceiver(ch, listener, 2, 1024)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tr.Run(ctx)
+	}()
+
+	c, err := net.Dial("tcp", listener.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("open:1|c\n"))
+	require.NoError(t, err)
+	readLines(t, ch, 1)
+	assert.EqualValues(t, 1, atomic.LoadInt64(&tr.connectionsActive))
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "receiver didn't stop")
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt64(&tr.connectionsActive))
+}
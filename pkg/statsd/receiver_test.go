@@ -2,11 +2,14 @@ package statsd
 
 import (
 	"context"
+	"net"
 	"runtime"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/fakesocket"
 	"github.com/magiconair/properties/assert"
 	"github.com/stretchr/testify/require"
@@ -87,3 +90,108 @@ func TestDatagramReceiver_Receive(t *testing.T) {
 	assert.Equal(t, string(dg.IP), fakesocket.FakeAddr.IP.String())
 	assert.Equal(t, dg.Msg, fakesocket.FakeMetric)
 }
+
+func TestDatagramReceiver_RunWarmup(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 1)
+	var sockets uint32
+	mr := NewDatagramReceiver(ch, func() (net.PacketConn, error) {
+		atomic.AddUint32(&sockets, 1)
+		return fakesocket.NewFakePacketConn(), nil
+	}, 1, 1)
+	warmedUp := make(chan struct{})
+	mr.warmedUp = warmedUp
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mr.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// The socket is created straight away, but not read from until warmed up
+	select {
+	case <-ch:
+		t.Fatal("datagram received before warming up")
+	case <-time.After(100 * time.Millisecond):
+	}
+	require.EqualValues(t, 1, atomic.LoadUint32(&sockets))
+
+	close(warmedUp)
+	select {
+	case dgs := <-ch:
+		require.Len(t, dgs, 1)
+		for _, dg := range dgs {
+			dg.DoneFunc()
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for datagram")
+	}
+}
+
+func TestDatagramReceiver_RunListeners(t *testing.T) {
+	t.Parallel()
+	ch := make(chan []*Datagram, 10)
+	var mu sync.Mutex
+	var sockets []net.PacketConn
+	newSocketFactory := func() SocketFactory {
+		return func() (net.PacketConn, error) {
+			c := fakesocket.NewFakePacketConn()
+			mu.Lock()
+			sockets = append(sockets, c)
+			mu.Unlock()
+			return c, nil
+		}
+	}
+	mr := NewDatagramReceiver(ch, nil, 2, 1)
+	mr.listeners = []datagramListener{
+		{socketFactory: newSocketFactory()},
+		{socketFactory: newSocketFactory(), tags: gostatsd.Tags{"tenant:billing"}},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		mr.Run(ctx)
+	}()
+
+	// Read until a datagram from each listener has been received
+	var untagged, tagged bool
+	timeout := time.After(time.Second)
+	for !untagged || !tagged {
+		select {
+		case dgs := <-ch:
+			for _, dg := range dgs {
+				if len(dg.Tags) == 0 {
+					untagged = true
+				} else {
+					require.Equal(t, gostatsd.Tags{"tenant:billing"}, dg.Tags)
+					tagged = true
+				}
+				dg.DoneFunc()
+			}
+		case <-timeout:
+			t.Fatal("timeout waiting for datagrams")
+		}
+	}
+
+	cancel()
+	go func() {
+		for range ch {
+		}
+	}()
+	<-done
+	close(ch)
+
+	// Every listener has its own readers, and all the sockets are closed once done.
+	require.Len(t, sockets, 4)
+	for _, c := range sockets {
+		_, _, err := c.ReadFrom(make([]byte, 100))
+		require.Equal(t, fakesocket.ErrClosedConnection, err)
+	}
+}
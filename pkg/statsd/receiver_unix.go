@@ -0,0 +1,89 @@
+package statsd
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The Unix domain socket types which can be listened on for metrics.
+//
+// A SOCK_DGRAM socket keeps the semantics of UDP: each write by a client is received as a single datagram, so the
+// client needs no framing and the datagrams are read in batches by the DatagramReceiver.  Unlike UDP, a full receive
+// buffer blocks the client (or fails its write, if non-blocking) instead of silently dropping the datagram, and the
+// largest datagram is limited by the socket buffers rather than the network.  There's no connection, so the source
+// of a datagram is unknown.
+//
+// A SOCK_STREAM socket is a connection, like TCP: writes are a stream of bytes, so metrics must be newline delimited
+// and are read by a TCPReceiver.  It has no limit on the size of a write, and a client finds out when the server goes
+// away, but each client holds a connection, and a line split across writes must wait for the rest of it.
+const (
+	// SocketTypeDatagram is the name used to listen on a Unix domain SOCK_DGRAM socket.
+	SocketTypeDatagram = "unixgram"
+	// SocketTypeStream is the name used to listen on a Unix domain SOCK_STREAM socket.
+	SocketTypeStream = "unix"
+)
+
+// listenUnixgram listens for datagrams on a Unix domain socket at path, created with perm.
+func listenUnixgram(path string, perm os.FileMode) (net.PacketConn, error) {
+	if err := removeStaleSocket(SocketTypeDatagram, path); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenPacket(SocketTypeDatagram, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		_ = conn.Close()
+		removeSocket(path)
+		return nil, fmt.Errorf("unable to set the permissions of %s: %v", path, err)
+	}
+	return conn, nil
+}
+
+// listenUnixStream listens for connections on a Unix domain socket at path, created with perm.
+func listenUnixStream(path string, perm os.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(SocketTypeStream, path); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen(SocketTypeStream, path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %v", path, err)
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		_ = listener.Close()
+		removeSocket(path)
+		return nil, fmt.Errorf("unable to set the permissions of %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// removeStaleSocket removes the socket at path left behind by a server which didn't stop cleanly.  Returns an error
+// if path isn't a socket, or something is still listening on it.
+func removeStaleSocket(socketType, path string) error {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial(socketType, path); err == nil {
+		_ = conn.Close()
+		return fmt.Errorf("%s is already in use", path)
+	}
+	logrus.WithField("path", path).Info("Removing stale socket")
+	return os.Remove(path)
+}
+
+// removeSocket unlinks the socket at path once it's closed, so it isn't left behind.
+func removeSocket(path string) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		logrus.WithError(err).WithField("path", path).Warn("Error removing socket")
+	}
+}
@@ -0,0 +1,123 @@
+package statsd
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+)
+
+func newTestSocketPath(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "gostatsd")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return filepath.Join(dir, "statsd.sock")
+}
+
+// readDatagram reads a single datagram from ch.
+func readDatagram(t *testing.T, ch <-chan []*Datagram) *Datagram {
+	select {
+	case dgs := <-ch:
+		require.Len(t, dgs, 1)
+		return dgs[0]
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "timed out waiting for a datagram")
+		return nil
+	}
+}
+
+func TestListenUnixgram(t *testing.T) {
+	t.Parallel()
+	path := newTestSocketPath(t)
+	// A server which didn't stop cleanly leaves its socket behind
+	stale, err := net.ListenPacket(SocketTypeDatagram, path)
+	require.NoError(t, err)
+	require.NoError(t, stale.Close())
+
+	conn, err := listenUnixgram(path, 0600)
+	require.NoError(t, err)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	ch := make(chan []*Datagram, 1)
+	dr := NewDatagramReceiver(ch, func() (net.PacketConn, error) { return conn, nil }, 2, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		dr.Run(ctx)
+	}()
+
+	c, err := net.Dial(SocketTypeDatagram, path)
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("a:1|c\nb:2|g"))
+	require.NoError(t, err)
+
+	dg := readDatagram(t, ch)
+	assert.Equal(t, "a:1|c\nb:2|g", string(dg.Msg))
+	assert.Equal(t, gostatsd.UnknownIP, dg.IP)
+	dg.DoneFunc()
+
+	cancel()
+	<-done
+	removeSocket(path)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestListenUnixStream(t *testing.T) {
+	t.Parallel()
+	path := newTestSocketPath(t)
+	listener, err := listenUnixStream(path, 0622)
+	require.NoError(t, err)
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0622), fi.Mode().Perm())
+
+	ch := make(chan []*Datagram, 1)
+	tr := NewTCPReceiver(ch, listener, 1, 1024)
+	tr.network = "unix"
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go tr.Run(ctx)
+
+	c, err := net.Dial(SocketTypeStream, path)
+	require.NoError(t, err)
+	_, err = c.Write([]byte("a:1|c\n"))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	dg := readDatagram(t, ch)
+	assert.Equal(t, "a:1|c\n", string(dg.Msg))
+	assert.Equal(t, gostatsd.UnknownIP, dg.IP)
+}
+
+func TestListenUnixRefusesToReplace(t *testing.T) {
+	t.Parallel()
+	path := newTestSocketPath(t)
+	conn, err := listenUnixgram(path, 0600)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// A socket which is still being listened on isn't stale
+	_, err = listenUnixgram(path, 0600)
+	assert.EqualError(t, err, path+" is already in use")
+
+	// Anything other than a socket is never removed
+	file := filepath.Join(filepath.Dir(path), "file")
+	require.NoError(t, ioutil.WriteFile(file, []byte("data"), 0600))
+	_, err = listenUnixStream(file, 0600)
+	assert.EqualError(t, err, file+" exists and is not a socket")
+	_, err = os.Stat(file)
+	assert.NoError(t, err)
+}
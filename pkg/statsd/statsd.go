@@ -4,12 +4,17 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/backends/stdout"
+	"github.com/atlassian/gostatsd/pkg/capture"
+	"github.com/atlassian/gostatsd/pkg/catalog"
 	"github.com/atlassian/gostatsd/pkg/stats"
 	"github.com/atlassian/gostatsd/pkg/transport"
 	"github.com/atlassian/gostatsd/pkg/web"
@@ -25,40 +30,110 @@ import (
 // the statsd server. These can either be set via command line or directly.
 type Server struct {
 	Backends                  []gostatsd.Backend
+	FailedBackends            int // The number of configured backends which failed to initialise
 	CloudHandlerFactory       *CloudHandlerFactory
 	InternalTags              gostatsd.Tags
 	InternalNamespace         string
 	DefaultTags               gostatsd.Tags
 	ExpiryInterval            time.Duration
 	FlushInterval             time.Duration
+	AlignFlushToInterval      bool
 	MaxReaders                int
 	MaxParsers                int
 	MaxWorkers                int
+	MinWorkers                int
+	WorkerScaleInterval       time.Duration
 	MaxQueueSize              int
 	MaxConcurrentEvents       int
+	EventRateLimitPerSecond   rate.Limit
+	MaxEventSize              int
+	EventBatchWindow          time.Duration
+	EventBatchSize            int
 	MaxEventQueueSize         int
+	MaxMetricNames            int
+	MaxSeries                 int
+	MaxCardinalityPerMetric   int
+	FlushSequenceTag          string
+	FlushNamespaces           []string
+	BackendNamespaces         map[string][]string
+	BackendFilters            map[string]*BackendFilter
+	BackendNamespaceOverrides map[string]string
+	BackendExtraTags          map[string]gostatsd.Tags
+	TagValueLimits            map[string]int
+	CountersAsGauges          []string
+	PercentileMinSamples      int
+	WeightedTimers            bool
+	TimerReservoirSize        int
+	SetMemberTTL              time.Duration
+	SetEmitMembers            []string
+	SetMaxMembers             int
+	SuppressZeroCounters      bool
+	FlushLatency              bool
+	CounterRates              bool
+	StdoutFallbackAfter       int
+	BackendQueueSize          int
+	BackendRetries            int
+	BackendOrder              string
+	BackendLag                bool
+	WorkerHash                string
+	WorkerHashTags            bool
+	SampleRate                float64
+	WarmupTimeout             time.Duration
+	CatalogTTL                time.Duration
+	CatalogMaxNames           int
+	NameSeparator             string
 	EstimatedTags             int
 	MetricsAddr               string
+	ShutdownDrainTimeout      time.Duration
+	Drain                     <-chan struct{} // Optional, closed to drain the server and stop, see ShutdownDrainTimeout
+	TCPAddr                   string
+	TCPMaxConnections         int
+	TCPFraming                string
+	SocketPath                string
+	SocketType                string
+	SocketPermissions         os.FileMode
+	SocketFraming             string
+	AdminAddr                 string
+	HealthMaxFlushAge         time.Duration
 	Namespace                 string
 	StatserType               string
 	PercentThreshold          []float64
+	TimerHistogramBuckets     []float64
 	IgnoreHost                bool
 	ConnPerReader             bool
 	HeartbeatEnabled          bool
 	HeartbeatTags             gostatsd.Tags
+	CanaryName                string
+	CanaryValue               float64
+	CanaryTags                gostatsd.Tags
 	ReceiveBatchSize          int
 	DisabledSubTypes          gostatsd.TimerSubtypes
 	BadLineRateLimitPerSecond rate.Limit
+	PerSourceRateLimit        rate.Limit
 	ServerMode                string
 	Hostname                  string
 	LogRawMetric              bool
+	ParseTiming               bool
+	MaxLineLength             int
+	BadLineDumpFile           string
+	BadLineDumpMaxSize        int64
+	BadLineDumpMaxBackups     int
+	BadLineDumpLinesPerSecond rate.Limit
+	CaptureFile               string
 	Viper                     *viper.Viper
 	TransportPool             *transport.TransportPool
+
+	reloadMu sync.Mutex  // Guards running
+	running  *reloadable // The components changed by Reload, nil unless running
 }
 
-// Run runs the server until context signals done.
+// Run runs the server until context signals done.  Metrics are received on every address in MetricsAddr.
 func (s *Server) Run(ctx context.Context) error {
-	return s.RunWithCustomSocket(ctx, socketFactory(s.MetricsAddr, s.ConnPerReader))
+	listeners, err := s.newListeners()
+	if err != nil {
+		return err
+	}
+	return s.run(ctx, listeners)
 }
 
 // SocketFactory is an indirection layer over net.ListenPacket() to allow for different implementations.
@@ -84,7 +159,14 @@ func socketFactory(metricsAddr string, connPerReader bool) SocketFactory {
 	}
 }
 
-func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createStandaloneSink(metricCatalog *catalog.Catalog) (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
+	// Hashing the tags spreads the series of a name across the aggregators, which each count the name separately.
+	if s.WorkerHashTags && s.MaxWorkers > 1 {
+		if param := s.perNameLimitParam(); param != "" {
+			return nil, nil, nil, fmt.Errorf("%s can't be used with %s, as each aggregator would apply the limit to the series of a name it has separately", ParamWorkerHashTags, param)
+		}
+	}
+
 	var runnables []gostatsd.Runnable
 
 	for _, backend := range s.Backends {
@@ -93,58 +175,183 @@ func (s *Server) createStandaloneSink() (gostatsd.PipelineHandler, []gostatsd.Ru
 		}
 	}
 
+	tagBuckets, err := NewTagBucketRulesFromViper(s.Viper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	counterWindows, err := NewCounterWindowRulesFromViper(s.Viper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	routes, err := NewRoutesFromViper(s.Viper)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
 	// Create the backend handler
 	factory := agrFactory{
-		percentThresholds: s.PercentThreshold,
-		expiryInterval:    s.ExpiryInterval,
-		disabledSubtypes:  s.DisabledSubTypes,
+		percentThresholds:    s.PercentThreshold,
+		expiryInterval:       s.ExpiryInterval,
+		disabledSubtypes:     s.DisabledSubTypes,
+		maxNames:             namesPerAggregator(s.MaxMetricNames, s.MaxWorkers),
+		maxSeries:            namesPerAggregator(s.MaxSeries, s.MaxWorkers),
+		maxCardinality:       s.MaxCardinalityPerMetric,
+		tagValueLimits:       s.TagValueLimits,
+		tagBuckets:           tagBuckets,
+		countersAsGauges:     toStringMatch(s.CountersAsGauges),
+		counterWindows:       counterWindows,
+		percentileMinSamples: s.PercentileMinSamples,
+		histogramBuckets:     s.TimerHistogramBuckets,
+		weightTimers:         s.WeightedTimers,
+		timerReservoirSize:   s.TimerReservoirSize,
+		setMemberTTL:         s.SetMemberTTL,
+		setEmitMembers:       toStringMatch(s.SetEmitMembers),
+		setMaxMembers:        s.SetMaxMembers,
+		suppressZeroCounters: s.SuppressZeroCounters,
+		flushLatency:         s.FlushLatency,
+		catalog:              metricCatalog,
+	}
+
+	workerHash, err := newWorkerHash(s.WorkerHash, s.WorkerHashTags)
+	if err != nil {
+		return nil, nil, nil, err
 	}
 
 	backendHandler := NewBackendHandler(s.Backends, uint(s.MaxConcurrentEvents), s.MaxWorkers, s.MaxQueueSize, &factory)
+	backendHandler.workerHash = workerHash
+	backendHandler.eventLimiter = newEventLimiter(s.EventRateLimitPerSecond)
+	backendHandler.maxEventSize = s.MaxEventSize
+	if s.EventBatchWindow > 0 {
+		if s.EventBatchSize <= 0 {
+			return nil, nil, nil, fmt.Errorf("%s must be positive", ParamEventBatchSize)
+		}
+		backendHandler.eventBatcher = newEventBatcher(s.EventBatchWindow, s.EventBatchSize, backendHandler.eventBatchDispatcher())
+	}
+	backendHandler.backendFilters = s.BackendFilters
+	backendHandler.minWorkers = s.MinWorkers
+	backendHandler.sampler = newLoadSampler(s.SampleRate)
+	if s.WorkerScaleInterval > 0 {
+		backendHandler.scaleInterval = s.WorkerScaleInterval
+	}
+	if s.NameSeparator != "" {
+		backendHandler.nameSeparator = s.NameSeparator[0]
+	}
 	runnables = append(runnables, backendHandler.Run, backendHandler.RunMetricsContext)
+	if backendHandler.eventBatcher != nil {
+		runnables = append(runnables, backendHandler.eventBatcher.Run)
+	}
 
 	// Create the Flusher
 	flusher := NewMetricFlusher(s.FlushInterval, backendHandler, s.Backends)
+	flusher.alignFlush = s.AlignFlushToInterval
+	flusher.flushSeqTag = s.FlushSequenceTag
+	flusher.namespaces = s.FlushNamespaces
+	flusher.backendNamespaces = s.BackendNamespaces
+	flusher.namespace = s.Namespace
+	flusher.namespaceOverrides = s.BackendNamespaceOverrides
+	flusher.backendTags = s.BackendExtraTags
+	flusher.backendFilters = s.BackendFilters
+	flusher.router = newBackendRouter(routes, s.Viper.GetStringSlice(ParamRouteDefaultBackends), s.Backends)
+	flusher.counterRates = s.CounterRates
+	flusher.backendQueueSize = s.BackendQueueSize
+	flusher.backendRetries = s.BackendRetries
+	flusher.backendOrder = s.BackendOrder
+	if s.BackendLag {
+		flusher.lag = newBackendLag(s.Backends, time.Now())
+	}
+	if s.AdminAddr != "" {
+		flusher.status = newBackendStatus(s.Backends, time.Now())
+		adminServer := newAdminServer(s.AdminAddr, backendHandler, flusher.status)
+		adminServer.healthMaxFlushAge = s.HealthMaxFlushAge
+		if adminServer.healthMaxFlushAge <= 0 {
+			adminServer.healthMaxFlushAge = defaultHealthMaxFlushAgeIntervals * s.FlushInterval
+		}
+		adminServer.flushInterval = s.FlushInterval
+		runnables = append(runnables, adminServer.Run)
+	}
+	if s.StdoutFallbackAfter > 0 {
+		fallback, err := stdout.NewClient(s.DisabledSubTypes, 1)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		flusher.fallback = fallback
+		flusher.fallbackAfter = s.StdoutFallbackAfter
+	}
 	runnables = append(runnables, flusher.Run)
 
-	return backendHandler, runnables, nil
+	return backendHandler, flusher, runnables, nil
 }
 
-func (s *Server) createForwarderSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createForwarderSink() (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
+	if s.AdminAddr != "" {
+		return nil, nil, nil, fmt.Errorf("%s requires server-mode standalone", ParamAdminAddr)
+	}
 	forwarderHandler, err := NewHttpForwarderHandlerV2FromViper(
 		log.StandardLogger(),
 		s.Viper,
 		s.TransportPool,
 	)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
 	// Create a Flusher, this is primarily for all the periodic metrics which are emitted.
 	flusher := NewMetricFlusher(s.FlushInterval, nil, s.Backends)
+	flusher.alignFlush = s.AlignFlushToInterval
 
-	return forwarderHandler, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetrics, flusher.Run}, nil
+	return forwarderHandler, flusher, []gostatsd.Runnable{forwarderHandler.Run, forwarderHandler.RunMetrics, flusher.Run}, nil
 }
 
-func (s *Server) createFinalSink() (gostatsd.PipelineHandler, []gostatsd.Runnable, error) {
+func (s *Server) createFinalSink(metricCatalog *catalog.Catalog) (gostatsd.PipelineHandler, *MetricFlusher, []gostatsd.Runnable, error) {
 	if s.ServerMode == "standalone" {
-		return s.createStandaloneSink()
+		return s.createStandaloneSink(metricCatalog)
 	} else if s.ServerMode == "forwarder" {
 		return s.createForwarderSink()
 	}
-	return nil, nil, errors.New("invalid server-mode, must be standalone, or forwarder")
+	return nil, nil, nil, errors.New("invalid server-mode, must be standalone, or forwarder")
 }
 
 // RunWithCustomSocket runs the server until context signals done.
 // Listening socket is created using sf.
 func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) error {
-	handler, runnables, err := s.createFinalSink()
+	return s.run(ctx, []datagramListener{{socketFactory: sf}})
+}
+
+func (s *Server) run(ctx context.Context, listeners []datagramListener) error {
+	// The catalog is filled by the aggregators, so it's only used in standalone mode
+	var metricCatalog *catalog.Catalog
+	if s.CatalogTTL > 0 && s.ServerMode == "standalone" {
+		metricCatalog = catalog.NewCatalog(s.CatalogTTL, s.CatalogMaxNames)
+	}
+
+	handler, flusher, runnables, err := s.createFinalSink(metricCatalog)
 	if err != nil {
 		return err
 	}
+	if metricCatalog != nil {
+		runnables = append(runnables, metricCatalog.RunMetrics)
+	}
 
 	// Create the tag processor
-	handler = NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
+	tagHandler := NewTagHandlerFromViper(s.Viper, handler, s.DefaultTags)
+	handler = tagHandler
+
+	// Create the tag allowlist processor, which runs after every stage which adds tags other than the default tags
+	handler, err = NewTagAllowlistHandlerFromViper(s.Viper, handler)
+	if err != nil {
+		return err
+	}
+	if tagAllowlistHandler, ok := handler.(*TagAllowlistHandler); ok {
+		runnables = append(runnables, tagAllowlistHandler.RunMetrics)
+	}
+
+	// Anything which isn't ready as soon as it's started is waited for when warming up, keyed by name
+	readyWaiters := make(map[string]gostatsd.ReadyWaiter)
+	for _, backend := range s.Backends {
+		if rw, ok := backend.(gostatsd.ReadyWaiter); ok {
+			readyWaiters["backend "+backend.Name()] = rw
+		}
+	}
 
 	// Create the cloud handler
 	ip := gostatsd.UnknownIP
@@ -152,6 +359,9 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		cloudHandler := s.CloudHandlerFactory.NewCloudHandler(handler)
 		runnables = append(runnables, cloudHandler.Run)
 		handler = cloudHandler
+		if rw, ok := cloudHandler.cloud.(gostatsd.ReadyWaiter); ok {
+			readyWaiters["cloud provider "+cloudHandler.cloud.Name()] = rw
+		}
 		selfIP, err2 := cloudHandler.cloud.SelfIP()
 		if err2 != nil {
 			log.Warnf("Failed to get self ip: %v", err2)
@@ -160,26 +370,165 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		}
 	}
 
+	// Create the source tag processor
+	handler, err = NewSourceTagHandlerFromViper(s.Viper, handler)
+	if err != nil {
+		return err
+	}
+
+	// Create the name tag processor
+	handler, err = NewNameTagHandlerFromViper(s.Viper, handler)
+	if err != nil {
+		return err
+	}
+	if nameTagHandler, ok := handler.(*NameTagHandler); ok {
+		runnables = append(runnables, nameTagHandler.RunMetrics)
+	}
+
+	// Create the name rewriter, which is first so every other stage sees the rewritten names.  It's created even with
+	// no rules, so rules can be added by Reload.
+	nameRewriteRules, err := NewNameRewriteRulesFromViper(s.Viper)
+	if err != nil {
+		return err
+	}
+	nameRewriteHandler := NewNameRewriteHandler(handler, nameRewriteRules)
+	handler = nameRewriteHandler
+	runnables = append(runnables, nameRewriteHandler.RunMetrics)
+
+	if s.FailedBackends > 0 {
+		runnables = append(runnables, s.reportFailedBackends)
+	}
+
 	// Create the heartbeater
 	if s.HeartbeatEnabled {
 		hb := stats.NewHeartBeater("heartbeat", s.HeartbeatTags)
 		runnables = append(runnables, hb.Run)
 	}
 
+	// Create the canary, dispatching to the same handler as received metrics
+	if s.CanaryName != "" {
+		c := NewCanary(handler, s.CanaryName, s.CanaryValue, s.CanaryTags, s.Hostname)
+		runnables = append(runnables, c.Run)
+	}
+
 	// Open receiver <-> parser chan
 	datagrams := make(chan []*Datagram)
 
+	// When draining, everything which receives metrics is stopped, then the parsers once they have parsed everything
+	// received, before the final flush
+	stopReceiving := make(chan struct{})
+	var receiving, parsing sync.WaitGroup
+
 	// Create the Parser
 	parser := NewDatagramParser(datagrams, s.Namespace, s.IgnoreHost, s.EstimatedTags, handler, s.BadLineRateLimitPerSecond, s.LogRawMetric)
+	if s.ParseTiming {
+		parser.parseTiming = &parseTiming{}
+	}
+	parser.maxLineLength = s.MaxLineLength
+	if s.PerSourceRateLimit > 0 {
+		parser.sourceLimiter = newSourceLimiter(s.PerSourceRateLimit)
+	}
+	if s.BadLineDumpFile != "" {
+		dump, err := newBadLineDump(s.BadLineDumpFile, s.BadLineDumpMaxSize, s.BadLineDumpMaxBackups, s.BadLineDumpLinesPerSecond)
+		if err != nil {
+			return err
+		}
+		parser.badLineDump = dump
+		runnables = append(runnables, dump.Run, dump.RunMetrics)
+	}
 	runnables = append(runnables, parser.RunMetrics)
 	for i := 0; i < s.MaxParsers; i++ {
-		runnables = append(runnables, parser.Run)
+		runnables = append(runnables, stoppable(parser.Run, nil, &parsing))
 	}
 
-	// Create the Receiver
-	receiver := NewDatagramReceiver(datagrams, sf, s.MaxReaders, s.ReceiveBatchSize)
+	// Create the Receiver, which reads from MaxReaders sockets for each listener
+	receiver := NewDatagramReceiver(datagrams, nil, s.MaxReaders, s.ReceiveBatchSize)
+	receiver.listeners = listeners
+	var capturer *capture.Capturer
+	if s.CaptureFile != "" {
+		capturer = capture.NewCapturer(log.StandardLogger(), s.CaptureFile)
+		receiver.capturer = capturer
+	}
+	var warmedUp chan struct{}
+	var ready func() bool
+	if s.WarmupTimeout > 0 {
+		warmedUp = make(chan struct{})
+		receiver.warmedUp = warmedUp
+		ready = func() bool {
+			select {
+			case <-warmedUp:
+				return true
+			default:
+				return false
+			}
+		}
+	}
 	runnables = append(runnables, receiver.RunMetrics)
-	runnables = append(runnables, receiver.Run) // loop is contained in Run to keep additional logic contained
+	runnables = append(runnables, stoppable(receiver.Run, stopReceiving, &receiving)) // loop is contained in Run to keep additional logic contained
+
+	// Create the TCP Receiver, feeding the same Parser
+	maxLineLength := s.MaxLineLength
+	if maxLineLength <= 0 {
+		maxLineLength = packetSizeUDP
+	}
+	if s.TCPAddr != "" {
+		if s.TCPMaxConnections <= 0 {
+			return fmt.Errorf("%s must be positive", ParamTCPMaxConnections)
+		}
+		if err := validateFraming(ParamTCPFraming, s.TCPFraming); err != nil {
+			return err
+		}
+		listener, err := net.Listen("tcp", s.TCPAddr)
+		if err != nil {
+			return fmt.Errorf("unable to listen on %s: %v", s.TCPAddr, err)
+		}
+		tcpReceiver := NewTCPReceiver(datagrams, listener, s.TCPMaxConnections, maxLineLength)
+		tcpReceiver.framing = s.TCPFraming
+		tcpReceiver.capturer = capturer
+		tcpReceiver.warmedUp = warmedUp
+		runnables = append(runnables, tcpReceiver.RunMetrics)
+		runnables = append(runnables, stoppable(tcpReceiver.Run, stopReceiving, &receiving))
+	}
+
+	// Listen on the Unix domain socket, feeding the same Parser.  Datagrams are read by the Receiver, and connections
+	// by a TCPReceiver.  The socket is removed once everything has stopped.
+	if s.SocketPath != "" {
+		switch s.SocketType {
+		case SocketTypeDatagram:
+			conn, err := listenUnixgram(s.SocketPath, s.SocketPermissions)
+			if err != nil {
+				return err
+			}
+			defer removeSocket(s.SocketPath)
+			receiver.listeners = append(receiver.listeners, datagramListener{
+				addr: s.SocketPath,
+				socketFactory: func() (net.PacketConn, error) {
+					return conn, nil
+				},
+			})
+		case SocketTypeStream:
+			if s.TCPMaxConnections <= 0 {
+				return fmt.Errorf("%s must be positive", ParamTCPMaxConnections)
+			}
+			if err := validateFraming(ParamSocketFraming, s.SocketFraming); err != nil {
+				return err
+			}
+			listener, err := listenUnixStream(s.SocketPath, s.SocketPermissions)
+			if err != nil {
+				return err
+			}
+			defer removeSocket(s.SocketPath)
+			unixReceiver := NewTCPReceiver(datagrams, listener, s.TCPMaxConnections, maxLineLength)
+			unixReceiver.network = "unix"
+			unixReceiver.framing = s.SocketFraming
+			unixReceiver.capturer = capturer
+			unixReceiver.warmedUp = warmedUp
+			runnables = append(runnables, unixReceiver.RunMetrics)
+			runnables = append(runnables, stoppable(unixReceiver.Run, stopReceiving, &receiving))
+		default:
+			return fmt.Errorf("invalid %s %q, must be %s or %s", ParamSocketType, s.SocketType, SocketTypeDatagram, SocketTypeStream)
+		}
+	}
 
 	// Create the Statser
 	hostname := s.Hostname
@@ -189,13 +538,24 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 	}
 
 	// Create any http servers
-	httpServers, err := web.NewHttpServersFromViper(s.Viper, log.StandardLogger(), handler)
+	httpServers, err := web.NewHttpServersFromViper(s.Viper, log.StandardLogger(), handler, capturer, metricCatalog, ready)
 	if err != nil {
 		return err
 	}
 	for _, server := range httpServers {
-		runnables = append(runnables, server.Run)
+		runnables = append(runnables, stoppable(server.Run, stopReceiving, &receiving))
+	}
+
+	running := &reloadable{
+		tagHandler:         tagHandler,
+		nameRewriteHandler: nameRewriteHandler,
+		parser:             parser,
+	}
+	if tagged, ok := statser.(interface{ SetTags(gostatsd.Tags) }); ok {
+		running.statser = tagged
 	}
+	s.setRunning(running)
+	defer s.setRunning(nil)
 
 	// Start the world!
 	runCtx := stats.NewContext(context.Background(), statser)
@@ -205,14 +565,60 @@ func (s *Server) RunWithCustomSocket(ctx context.Context, sf SocketFactory) erro
 		stgr.NextStageWithContext(runCtx).StartWithContext(runnable)
 	}
 
+	if warmedUp != nil {
+		s.warmup(ctx, readyWaiters)
+		close(warmedUp)
+	}
+
 	// Send events on start and on stop
 	// TODO: Push these in to statser
 	defer sendStopEvent(handler, ip, hostname)
 	sendStartEvent(runCtx, handler, ip, hostname)
 
-	// Listen until done
-	<-ctx.Done()
-	return ctx.Err()
+	// Listen until done, or drained
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.Drain:
+	}
+	close(stopReceiving)
+	return s.drain(ctx, &receiving, datagrams, &parsing, flusher)
+}
+
+// warmup waits for everything in readyWaiters to be ready, for at most WarmupTimeout.  Anything which isn't ready in
+// time is logged, and metrics are processed regardless.
+func (s *Server) warmup(ctx context.Context, readyWaiters map[string]gostatsd.ReadyWaiter) {
+	ctx, cancel := context.WithTimeout(ctx, s.WarmupTimeout)
+	defer cancel()
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for name, rw := range readyWaiters {
+		wg.Add(1)
+		go func(name string, rw gostatsd.ReadyWaiter) {
+			defer wg.Done()
+			if err := rw.WaitReady(ctx); err != nil {
+				log.WithError(err).Warnf("Finished warming up before %s was ready", name)
+			}
+		}(name, rw)
+	}
+	wg.Wait()
+	log.WithField("duration", time.Since(start)).Info("Finished warming up")
+}
+
+// reportFailedBackends reports the number of backends which failed to initialise every flush, so it can be alerted on.
+func (s *Server) reportFailedBackends(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+	flushed, unregister := statser.RegisterFlush()
+	defer unregister()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-flushed:
+			statser.Gauge("backends_failed", float64(s.FailedBackends), nil)
+		}
+	}
 }
 
 func (s *Server) createStatser(hostname string, handler gostatsd.PipelineHandler) stats.Statser {
@@ -269,13 +675,89 @@ func getHost() string {
 }
 
 type agrFactory struct {
-	percentThresholds []float64
-	expiryInterval    time.Duration
-	disabledSubtypes  gostatsd.TimerSubtypes
+	percentThresholds    []float64
+	expiryInterval       time.Duration
+	disabledSubtypes     gostatsd.TimerSubtypes
+	maxNames             int
+	maxSeries            int
+	maxCardinality       int
+	tagValueLimits       map[string]int
+	tagBuckets           TagBucketRules
+	countersAsGauges     gostatsd.StringMatchList
+	counterWindows       CounterWindowRules
+	percentileMinSamples int
+	histogramBuckets     []float64
+	weightTimers         bool
+	timerReservoirSize   int
+	setMemberTTL         time.Duration
+	setEmitMembers       gostatsd.StringMatchList
+	setMaxMembers        int
+	suppressZeroCounters bool
+	flushLatency         bool
+	catalog              *catalog.Catalog
 }
 
 func (af *agrFactory) Create() Aggregator {
-	return NewMetricAggregator(af.percentThresholds, af.expiryInterval, af.disabledSubtypes)
+	a := NewMetricAggregator(af.percentThresholds, af.expiryInterval, af.disabledSubtypes)
+	a.maxNames = af.maxNames
+	if af.maxSeries > 0 {
+		a.maxSeries = af.maxSeries
+		a.seriesLRU = newSeriesLRU()
+	}
+	if af.maxCardinality > 0 {
+		a.maxCardinality = af.maxCardinality
+		a.tagSets = make(tagSetsByName)
+	}
+	a.tagValueLimits = af.tagValueLimits
+	a.tagBuckets = af.tagBuckets
+	a.countersAsGauges = af.countersAsGauges
+	if len(af.counterWindows) > 0 {
+		a.counterWindowRules = af.counterWindows
+		a.counterWindows = make(counterWindows)
+	}
+	a.percentileMinSamples = af.percentileMinSamples
+	if len(af.histogramBuckets) > 0 {
+		a.histogramBuckets = newHistogramBuckets(af.histogramBuckets)
+	}
+	a.weightTimers = af.weightTimers
+	if af.timerReservoirSize > 0 {
+		a.timerReservoirSize = af.timerReservoirSize
+		a.timerReservoirs = make(timerReservoirs)
+		a.reservoirRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	a.suppressZeroCounters = af.suppressZeroCounters
+	a.flushLatency = af.flushLatency
+	a.catalog = af.catalog
+	if af.setMemberTTL > 0 {
+		a.setMemberTTL = af.setMemberTTL
+		a.setMembers = make(setMembers)
+	}
+	a.setEmitMembers = af.setEmitMembers
+	a.setMaxMembers = af.setMaxMembers
+	return a
+}
+
+// perNameLimitParam returns the parameter of a limit which is set and counted per metric name, or "" if none are set.
+// These limits are only exact if every series of a name is aggregated by the same aggregator.
+func (s *Server) perNameLimitParam() string {
+	switch {
+	case s.MaxMetricNames > 0:
+		return ParamMaxMetricNames
+	case s.MaxCardinalityPerMetric > 0:
+		return ParamMaxCardinalityPerMetric
+	case len(s.TagValueLimits) > 0:
+		return ParamTagValueLimits
+	}
+	return ""
+}
+
+// namesPerAggregator splits a total limit on metric names or series evenly across the aggregators, rounding up so that a
+// non-zero limit is never disabled.
+func namesPerAggregator(maxNames, aggregators int) int {
+	if maxNames <= 0 || aggregators <= 1 {
+		return maxNames
+	}
+	return (maxNames + aggregators - 1) / aggregators
 }
 
 func toStringSlice(fs []float64) []string {
@@ -7,6 +7,7 @@ import (
 
 	"github.com/atlassian/gostatsd"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/aws"
+	"github.com/atlassian/gostatsd/pkg/cloudproviders/hostfile"
 	"github.com/atlassian/gostatsd/pkg/cloudproviders/k8s"
 
 	"github.com/spf13/pflag"
@@ -50,6 +51,14 @@ var DefaultCloudProviderCacheValues = map[string]CacheOptions{
 		CacheTTL:                  DefaultCacheTTL,
 		CacheNegativeTTL:          DefaultCacheNegativeTTL,
 	},
+	hostfile.ProviderName: {
+		// Looking up a host is only a map lookup, so like the k8s provider the data is refreshed every refresh period,
+		// which picks up changes to the file soon after it is reloaded.
+		CacheRefreshPeriod:        15 * time.Second,
+		CacheEvictAfterIdlePeriod: DefaultCacheEvictAfterIdlePeriod,
+		CacheTTL:                  1 * time.Millisecond,
+		CacheNegativeTTL:          1 * time.Millisecond,
+	},
 }
 
 type LimiterValues struct {
@@ -68,6 +77,11 @@ var DefaultCloudProviderLimiterValues = map[string]LimiterValues{
 		MaxCloudRequests:   DefaultMaxCloudRequests,
 		BurstCloudRequests: DefaultBurstCloudRequests,
 	},
+	hostfile.ProviderName: {
+		// High limit for the host file since lookups don't make any requests
+		MaxCloudRequests:   10000,
+		BurstCloudRequests: 5000,
+	},
 }
 
 const (
@@ -81,6 +95,34 @@ const (
 	StatserTagged = "tagged"
 )
 
+const (
+	// BackendInitModeStrict is the name used to indicate the server fails to start if any backend fails to initialise.
+	BackendInitModeStrict = "strict"
+	// BackendInitModeLenient is the name used to indicate the server starts with the backends which initialised.
+	BackendInitModeLenient = "lenient"
+)
+
+const (
+	// BackendOrderFixed is the name used to indicate backends are sent each flush in the order they are configured.
+	BackendOrderFixed = "fixed"
+	// BackendOrderRandom is the name used to indicate backends are sent each flush in a random order.
+	BackendOrderRandom = "random"
+	// BackendOrderRoundRobin is the name used to indicate the first backend sent each flush rotates through them.
+	BackendOrderRoundRobin = "round-robin"
+)
+
+const (
+	// WorkerHashAdler32 is the name used to indicate metrics are sharded across workers by the adler32 checksums of
+	// their name and host.
+	WorkerHashAdler32 = "adler32"
+	// WorkerHashFNV is the name used to indicate metrics are sharded across workers by a 64 bit FNV-1a hash.
+	WorkerHashFNV = "fnv"
+	// WorkerHashXXHash is the name used to indicate metrics are sharded across workers by a 64 bit xxHash.
+	WorkerHashXXHash = "xxhash"
+	// WorkerHashJump is the name used to indicate metrics are sharded across workers by a jump consistent hash.
+	WorkerHashJump = "jump"
+)
+
 const (
 	// DefaultMaxCloudRequests is the maximum number of cloud provider requests per second.
 	DefaultMaxCloudRequests = 10
@@ -90,10 +132,33 @@ const (
 	DefaultExpiryInterval = 5 * time.Minute
 	// DefaultFlushInterval is the default metrics flush interval.
 	DefaultFlushInterval = 1 * time.Second
+	// DefaultAlignFlushToInterval is the default of whether flushes are aligned to multiples of the flush interval.
+	DefaultAlignFlushToInterval = false
 	// DefaultIgnoreHost is the default value for whether the source should be used as the host
 	DefaultIgnoreHost = false
 	// DefaultMetricsAddr is the default address on which to listen for metrics.
 	DefaultMetricsAddr = ":8125"
+	// DefaultShutdownDrainTimeout is the default time to drain for on shutdown, 0 to stop immediately.
+	DefaultShutdownDrainTimeout = 0 * time.Second
+	// DefaultTCPAddr is the default address on which to listen for metrics over TCP, empty to disable.
+	DefaultTCPAddr = ""
+	// DefaultTCPMaxConnections is the default maximum number of TCP connections read from concurrently.
+	DefaultTCPMaxConnections = 100
+	// DefaultTCPFraming is the default framing of lines on TCP connections.
+	DefaultTCPFraming = FramingNewline
+	// DefaultSocketPath is the default path of the Unix domain socket on which to listen for metrics, empty to disable.
+	DefaultSocketPath = ""
+	// DefaultSocketType is the default type of the Unix domain socket on which to listen for metrics.
+	DefaultSocketType = SocketTypeDatagram
+	// DefaultSocketPermissions is the default permissions of the Unix domain socket, which anyone can write to.
+	DefaultSocketPermissions = "0622"
+	// DefaultSocketFraming is the default framing of lines on Unix domain socket connections.
+	DefaultSocketFraming = FramingNewline
+	// DefaultAdminAddr is the default address on which to serve the admin endpoints, empty to disable.
+	DefaultAdminAddr = ""
+	// DefaultHealthMaxFlushAge is the default time since the last successful send to each backend for the server to
+	// be healthy, 0 for three flush intervals.
+	DefaultHealthMaxFlushAge = 0 * time.Second
 	// DefaultMaxQueueSize is the default maximum number of buffered metrics per worker.
 	DefaultMaxQueueSize = 10000 // arbitrary
 	// DefaultMaxConcurrentEvents is the default maximum number of events sent concurrently.
@@ -120,10 +185,94 @@ const (
 	DefaultStatserType = StatserInternal
 	// DefaultBadLinesPerMinute is the default number of bad lines to allow to log per minute
 	DefaultBadLinesPerMinute = 0
+	// DefaultBadLineDumpFile is the default file to write the lines which failed to parse to, empty to disable
+	DefaultBadLineDumpFile = ""
+	// DefaultBadLineDumpMaxSize is the default size in bytes the bad line dump file is rotated at
+	DefaultBadLineDumpMaxSize = 10 * 1024 * 1024
+	// DefaultBadLineDumpMaxBackups is the default number of rotated bad line dump files kept
+	DefaultBadLineDumpMaxBackups = 3
+	// DefaultBadLineDumpLinesPerSecond is the default maximum number of bad lines written to the dump file per second
+	DefaultBadLineDumpLinesPerSecond = 100
 	// DefaultServerMode is the default mode to run as, standalone|forwarder
 	DefaultServerMode = "standalone"
 	// DefaultLogRawMetric is the default value for whether to log the metrics received from network
 	DefaultLogRawMetric = false
+	// DefaultMaxEventsPerSecond is the default maximum number of events per second, 0 for unlimited
+	DefaultMaxEventsPerSecond = 0
+	// DefaultPerSourceRateLimit is the default maximum number of metrics per second from each source, 0 for unlimited
+	DefaultPerSourceRateLimit = 0
+	// DefaultMaxEventSize is the default maximum size of an event body in bytes, 0 for unlimited
+	DefaultMaxEventSize = 0
+	// DefaultEventBatchWindow is the default time events wait to be batched, 0 to send each event as it's received
+	DefaultEventBatchWindow = 0 * time.Second
+	// DefaultEventBatchSize is the default maximum number of events in a batch
+	DefaultEventBatchSize = 100
+	// DefaultPercentileMinSamples is the default minimum number of samples in a timer to calculate percentiles
+	DefaultPercentileMinSamples = 0
+	// DefaultTimerSampleRateWeighting is the default for whether timer values are weighted by their sampling rate
+	DefaultTimerSampleRateWeighting = false
+	// DefaultTimerReservoirSize is the default maximum number of values kept for each timer, 0 for all of them
+	DefaultTimerReservoirSize = 0
+	// DefaultSetMemberTTL is the default time set members are kept after they were last seen, 0 for one flush
+	DefaultSetMemberTTL = 0 * time.Second
+	// DefaultSetMaxMembers is the default maximum number of members of a set to flush with set-emit-members
+	DefaultSetMaxMembers = 20
+	// DefaultSuppressZeroCounters is the default for whether counters with a value of zero are flushed
+	DefaultSuppressZeroCounters = false
+	// DefaultFlushLatency is the default for whether the age of the oldest metric at flush time is measured
+	DefaultFlushLatency = false
+	// DefaultCounterRates is the default for whether counters are emitted as a count and a per second gauge
+	DefaultCounterRates = false
+	// DefaultStdoutFallbackAfter is the default number of flushes every backend must fail before metrics are also
+	// written to stdout, 0 to disable
+	DefaultStdoutFallbackAfter = 0
+	// DefaultBackendQueueSize is the default number of flushes queued for each backend, 0 to send every flush to all
+	// backends together
+	DefaultBackendQueueSize = 0
+	// DefaultBackendRetries is the default number of times a failed send to a backend is retried, 0 to not retry
+	DefaultBackendRetries = 0
+	// DefaultWarmupTimeout is the default maximum time to wait for the cloud provider and backends to be ready before
+	// processing metrics, 0 to not wait
+	DefaultWarmupTimeout = 0 * time.Second
+	// DefaultCatalogTTL is the default time a metric name or tag key is kept in the catalog after it was last seen, 0
+	// to disable the catalog
+	DefaultCatalogTTL = 0 * time.Second
+	// DefaultCatalogMaxNames is the default maximum number of metrics tracked by the catalog
+	DefaultCatalogMaxNames = 10000
+	// DefaultNameSeparator is the default separator metric name separators are normalized to, empty to disable
+	DefaultNameSeparator = ""
+	// DefaultBackendInitMode is the default handling of backends which fail to initialise
+	DefaultBackendInitMode = BackendInitModeStrict
+	// DefaultBackendOrder is the default order backends are sent each flush in
+	DefaultBackendOrder = BackendOrderFixed
+	// DefaultWorkerHash is the default hash metrics are sharded across workers by
+	DefaultWorkerHash = WorkerHashAdler32
+	// DefaultWorkerHashTags is the default setting for whether the tags of a metric are hashed when sharding
+	DefaultWorkerHashTags = false
+	// DefaultBackendLag is the default for whether how far each backend is behind the wall clock is measured
+	DefaultBackendLag = false
+	// DefaultSampleRate is the default fraction of counter and timer datapoints aggregated, 1 for all of them
+	DefaultSampleRate = 1.0
+	// DefaultParseTiming is the default for whether the time spent parsing each type of line is measured
+	DefaultParseTiming = false
+	// DefaultMaxLineLength is the default maximum length of a line in bytes, 0 for unlimited
+	DefaultMaxLineLength = 0
+	// DefaultCanaryName is the default name of the canary counter dispatched every flush, empty to disable
+	DefaultCanaryName = ""
+	// DefaultCanaryValue is the default value of the canary counter
+	DefaultCanaryValue = 1.0
+	// DefaultHostnameStrategy is the default strategy used to resolve the hostname
+	DefaultHostnameStrategy = HostnameStrategyStatic
+	// DefaultMaxMetricNames is the default maximum number of distinct metric names, 0 for unlimited
+	DefaultMaxMetricNames = 0
+	// DefaultMaxSeries is the default maximum number of series, 0 for unlimited
+	DefaultMaxSeries = 0
+	// DefaultMaxCardinalityPerMetric is the default maximum number of tag sets per metric name, 0 for unlimited
+	DefaultMaxCardinalityPerMetric = 0
+	// DefaultMinWorkers is the default minimum number of goroutines that aggregate metrics, 0 to disable scaling
+	DefaultMinWorkers = 0
+	// DefaultWorkerScaleInterval is the default interval at which the number of workers is re-evaluated
+	DefaultWorkerScaleInterval = 10 * time.Second
 )
 
 const (
@@ -145,6 +294,8 @@ const (
 	ParamExpiryInterval = "expiry-interval"
 	// ParamFlushInterval is the name of parameter with metrics flush interval.
 	ParamFlushInterval = "flush-interval"
+	// ParamAlignFlushToInterval is the name of parameter with whether flushes are aligned to the wall clock.
+	ParamAlignFlushToInterval = "align-flush-to-interval"
 	// ParamIgnoreHost is the name of parameter indicating if the source should be used as the host
 	ParamIgnoreHost = "ignore-host"
 	// ParamMaxReaders is the name of parameter with number of socket readers.
@@ -153,10 +304,24 @@ const (
 	ParamMaxParsers = "max-parsers"
 	// ParamMaxWorkers is the name of parameter with number of goroutines that aggregate metrics.
 	ParamMaxWorkers = "max-workers"
+	// ParamMinWorkers is the name of parameter with minimum number of goroutines that aggregate metrics.
+	ParamMinWorkers = "min-workers"
+	// ParamWorkerScaleInterval is the name of parameter with the interval at which the number of workers is re-evaluated.
+	ParamWorkerScaleInterval = "worker-scale-interval"
 	// ParamMaxQueueSize is the name of parameter with maximum number of buffered metrics per worker.
 	ParamMaxQueueSize = "max-queue-size"
 	// ParamMaxConcurrentEvents is the name of parameter with maximum number of events sent concurrently.
 	ParamMaxConcurrentEvents = "max-concurrent-events"
+	// ParamMaxEventsPerSecond is the name of parameter with maximum number of events per second sent to backends.
+	ParamMaxEventsPerSecond = "max-events-per-second"
+	// ParamPerSourceRateLimit is the name of parameter with maximum number of metrics per second from each source.
+	ParamPerSourceRateLimit = "per-source-rate-limit"
+	// ParamMaxEventSize is the name of parameter with maximum size of an event body sent to backends.
+	ParamMaxEventSize = "max-event-size"
+	// ParamEventBatchWindow is the name of parameter with the time events wait to be batched.
+	ParamEventBatchWindow = "event-batch-window"
+	// ParamEventBatchSize is the name of parameter with the maximum number of events in a batch.
+	ParamEventBatchSize = "event-batch-size"
 	// ParamEstimatedTags is the name of parameter with estimated number of tags per metric
 	ParamEstimatedTags = "estimated-tags"
 	// ParamCacheRefreshPeriod is the name of parameter with cache refresh period.
@@ -167,14 +332,37 @@ const (
 	ParamCacheTTL = "cloud-cache-ttl"
 	// ParamCacheNegativeTTL is the name of parameter with cache TTL for failed lookups (errors or when instance was not found).
 	ParamCacheNegativeTTL = "cloud-cache-negative-ttl"
-	// ParamMetricsAddr is the name of parameter with address on which to listen for metrics.
+	// ParamMetricsAddr is the name of parameter with the comma separated addresses on which to listen for metrics.
 	ParamMetricsAddr = "metrics-addr"
+	// ParamShutdownDrainTimeout is the name of parameter with the time to drain for on shutdown.
+	ParamShutdownDrainTimeout = "shutdown-drain-timeout"
+	// ParamTCPAddr is the name of parameter with address on which to listen for metrics over TCP.
+	ParamTCPAddr = "tcp-addr"
+	// ParamTCPMaxConnections is the name of parameter with the maximum number of TCP connections read from concurrently.
+	ParamTCPMaxConnections = "tcp-max-connections"
+	// ParamTCPFraming is the name of parameter with the framing of lines on TCP connections.
+	ParamTCPFraming = "tcp-framing"
+	// ParamSocketPath is the name of parameter with the path of the Unix domain socket on which to listen for metrics.
+	ParamSocketPath = "socket-path"
+	// ParamSocketType is the name of parameter with the type of the Unix domain socket, unixgram or unix.
+	ParamSocketType = "socket-type"
+	// ParamSocketPermissions is the name of parameter with the permissions the Unix domain socket is created with.
+	ParamSocketPermissions = "socket-permissions"
+	// ParamSocketFraming is the name of parameter with the framing of lines on Unix domain socket connections.
+	ParamSocketFraming = "socket-framing"
+	// ParamAdminAddr is the name of parameter with address on which to serve the admin endpoints.
+	ParamAdminAddr = "admin-addr"
+	// ParamHealthMaxFlushAge is the name of parameter with the time since the last successful send to each backend
+	// for the server to be healthy.
+	ParamHealthMaxFlushAge = "health-max-flush-age"
 	// ParamNamespace is the name of parameter with namespace for all metrics.
 	ParamNamespace = "namespace"
 	// ParamStatserType is the name of parameter with type of statser.
 	ParamStatserType = "statser-type"
 	// ParamPercentThreshold is the name of parameter with list of applied percentiles.
 	ParamPercentThreshold = "percent-threshold"
+	// ParamTimerHistogramBuckets is the name of parameter with the list of upper bounds of timer histogram buckets.
+	ParamTimerHistogramBuckets = "timer-histogram-buckets"
 	// ParamHeartbeatEnabled is the name of the parameter with the heartbeat enabled
 	ParamHeartbeatEnabled = "heartbeat-enabled"
 	// ParamReceiveBatchSize is the name of the parameter with the number of datagrams to read in each receive batch
@@ -183,31 +371,161 @@ const (
 	ParamConnPerReader = "conn-per-reader"
 	// ParamBadLineRateLimitPerMinute is the name of the parameter indicating how many bad lines can be logged per minute
 	ParamBadLinesPerMinute = "bad-lines-per-minute"
+	// ParamBadLineDumpFile is the name of the parameter with the file to write the lines which failed to parse to
+	ParamBadLineDumpFile = "bad-line-dump-file"
+	// ParamBadLineDumpMaxSize is the name of the parameter with the size in bytes the bad line dump file is rotated at
+	ParamBadLineDumpMaxSize = "bad-line-dump-max-size"
+	// ParamBadLineDumpMaxBackups is the name of the parameter with the number of rotated bad line dump files kept
+	ParamBadLineDumpMaxBackups = "bad-line-dump-max-backups"
+	// ParamBadLineDumpLinesPerSecond is the name of the parameter with the maximum number of bad lines dumped per second
+	ParamBadLineDumpLinesPerSecond = "bad-line-dump-lines-per-second"
 	// ParamServerMode is the name of the parameter used to configure the server mode.
 	ParamServerMode = "server-mode"
 	// ParamHostname allows hostname overrides
 	ParamHostname = "hostname"
+	// ParamHostnameStrategy is the name of the parameter with the list of strategies used to resolve the hostname
+	ParamHostnameStrategy = "hostname-strategy"
 	// ParamLogRawMetric enables custom metrics to be printed to stdout
 	ParamLogRawMetric = "log-raw-metric"
+	// ParamSourceTags is the name of the parameter with the list of source tag rules.
+	ParamSourceTags = "source-tags"
+	// ParamListenerTags is the name of the parameter with the list of listener tag rules.
+	ParamListenerTags = "listener-tags"
+	// ParamNameTags is the name of the parameter with the list of name tag rules.
+	ParamNameTags = "name-tags"
+	// ParamTagAllowlists is the name of the parameter with the list of tags which have an allowlist of values.
+	ParamTagAllowlists = "tag-allowlists"
+	// ParamNameRewriteRules is the name of the parameter with the list of name rewrite rules.
+	ParamNameRewriteRules = "name-rewrite-rules"
+	// ParamTagBuckets is the name of the parameter with the list of tag bucket rules.
+	ParamTagBuckets = "tag-buckets"
+	// ParamCounterWindows is the name of the parameter with the list of counter window rules.
+	ParamCounterWindows = "counter-windows"
+	// ParamRoutes is the name of the parameter with the list of routes of metrics to backends.
+	ParamRoutes = "routes"
+	// ParamRouteDefaultBackends is the name of the parameter with the list of backends to send metrics which match no
+	// route to.
+	ParamRouteDefaultBackends = "route-default-backends"
+	// ParamMaxMetricNames is the name of the parameter with the maximum number of distinct metric names to aggregate
+	ParamMaxMetricNames = "max-metric-names"
+	// ParamMaxSeries is the name of the parameter with the maximum number of series to aggregate
+	ParamMaxSeries = "max-series"
+	// ParamMaxCardinalityPerMetric is the name of the parameter with the maximum number of tag sets per metric name in
+	// each flush interval
+	ParamMaxCardinalityPerMetric = "max-cardinality-per-metric"
+	// ParamFlushSequenceTag is the name of the parameter with the tag key used to stamp the flush sequence number
+	ParamFlushSequenceTag = "flush-sequence-tag"
+	// ParamFlushNamespaces is the name of the parameter with the list of namespaces to emit every metric under
+	ParamFlushNamespaces = "flush-namespaces"
+	// ParamBackendInclude is the name of the parameter in a backend's section with the list of names of the metrics
+	// and events sent to it
+	ParamBackendInclude = "include"
+	// ParamBackendExclude is the name of the parameter in a backend's section with the list of names of the metrics
+	// and events not sent to it
+	ParamBackendExclude = "exclude"
+	// ParamBackendExtraTags is the name of the parameter in a backend's section with the list of tags added to every
+	// metric sent to it
+	ParamBackendExtraTags = "extra-tags"
+	// ParamTagValueLimits is the name of the parameter with the list of tag keys to limit the distinct values of
+	ParamTagValueLimits = "tag-value-limits"
+	// ParamCaptureFile is the name of the parameter with the file to write captured datagrams to
+	ParamCaptureFile = "capture-file"
+	// ParamCountersAsGauges is the name of the parameter with the list of counter names to aggregate as gauges
+	ParamCountersAsGauges = "counters-as-gauges"
+	// ParamPercentileMinSamples is the name of parameter with the minimum number of samples to calculate percentiles
+	ParamPercentileMinSamples = "percentile-min-samples"
+	// ParamTimerSampleRateWeighting is the name of parameter to weight timer values by their sampling rate
+	ParamTimerSampleRateWeighting = "timer-sample-rate-weighting"
+	// ParamTimerReservoirSize is the name of parameter with the maximum number of values kept for each timer
+	ParamTimerReservoirSize = "timer-reservoir-size"
+	// ParamSetMemberTTL is the name of parameter with the time set members are kept after they were last seen
+	ParamSetMemberTTL = "set-member-ttl"
+	// ParamSetEmitMembers is the name of parameter with the list of set names to also flush the members of
+	ParamSetEmitMembers = "set-emit-members"
+	// ParamSetMaxMembers is the name of parameter with the maximum number of members of a set to flush
+	ParamSetMaxMembers = "set-max-members"
+	// ParamSuppressZeroCounters is the name of parameter to not flush counters with a value of zero
+	ParamSuppressZeroCounters = "suppress-zero-counters"
+	// ParamFlushLatency is the name of parameter to measure the age of the oldest metric at flush time
+	ParamFlushLatency = "flush-latency"
+	// ParamCounterRates is the name of parameter to emit counters as a count and a per second gauge
+	ParamCounterRates = "counter-rates"
+	// ParamStdoutFallbackAfter is the name of parameter with the number of flushes every backend must fail before
+	// metrics are also written to stdout
+	ParamStdoutFallbackAfter = "stdout-fallback-after"
+	// ParamBackendQueueSize is the name of parameter with the number of flushes queued for each backend
+	ParamBackendQueueSize = "backend-queue-size"
+	// ParamBackendRetries is the name of parameter with the number of times a failed send to a backend is retried
+	ParamBackendRetries = "backend-retries"
+	// ParamWarmupTimeout is the name of parameter with the maximum time to wait for the cloud provider and backends to
+	// be ready before processing metrics
+	ParamWarmupTimeout = "warmup-timeout"
+	// ParamCatalogTTL is the name of parameter with the time a metric name or tag key is kept in the catalog after it
+	// was last seen
+	ParamCatalogTTL = "catalog-ttl"
+	// ParamCatalogMaxNames is the name of parameter with the maximum number of metrics tracked by the catalog
+	ParamCatalogMaxNames = "catalog-max-names"
+	// ParamNameSeparator is the name of parameter with the separator metric name separators are normalized to
+	ParamNameSeparator = "name-separator"
+	// ParamBackendInitMode is the name of parameter with the handling of backends which fail to initialise
+	ParamBackendInitMode = "backend-init-mode"
+	// ParamBackendOrder is the name of parameter with the order backends are sent each flush in
+	ParamBackendOrder = "backend-order"
+	// ParamWorkerHash is the name of parameter with the hash metrics are sharded across workers by
+	ParamWorkerHash = "worker-hash"
+	// ParamWorkerHashTags is the name of parameter to include the tags of a metric when sharding
+	ParamWorkerHashTags = "worker-hash-tags"
+	// ParamBackendLag is the name of parameter to measure how far each backend is behind the wall clock
+	ParamBackendLag = "backend-lag"
+	// ParamSampleRate is the name of parameter with the fraction of counter and timer datapoints aggregated
+	ParamSampleRate = "sample-rate"
+	// ParamParseTiming is the name of parameter to measure the time spent parsing each type of line
+	ParamParseTiming = "parse-timing"
+	// ParamMaxLineLength is the name of parameter with the maximum length of a line in bytes
+	ParamMaxLineLength = "max-line-length"
+	// ParamCanaryName is the name of parameter with the name of the canary counter dispatched every flush
+	ParamCanaryName = "canary-name"
+	// ParamCanaryValue is the name of parameter with the value of the canary counter
+	ParamCanaryValue = "canary-value"
+	// ParamCanaryTags is the name of parameter with the tags of the canary counter
+	ParamCanaryTags = "canary-tags"
 )
 
 // AddFlags adds flags to the specified FlagSet.
 func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamCloudProvider, "", "If set, use the cloud provider to retrieve metadata about the sender")
-	fs.Duration(ParamExpiryInterval, DefaultExpiryInterval, "After how long do we expire metrics (0 to disable)")
+	fs.Duration(ParamExpiryInterval, DefaultExpiryInterval, "How long after a metric was last received it is expired (0 to disable)")
 	fs.Duration(ParamFlushInterval, DefaultFlushInterval, "How often to flush metrics to the backends")
+	fs.Bool(ParamAlignFlushToInterval, DefaultAlignFlushToInterval, "Flush metrics on multiples of the flush interval of the wall clock, rather than relative to when the server started")
 	fs.Bool(ParamIgnoreHost, DefaultIgnoreHost, "Ignore the source for populating the hostname field of metrics")
 	fs.Int(ParamMaxReaders, DefaultMaxReaders, "Maximum number of socket readers")
 	fs.Int(ParamMaxParsers, DefaultMaxParsers, "Maximum number of workers to parse datagrams into metrics")
 	fs.Int(ParamMaxWorkers, DefaultMaxWorkers, "Maximum number of workers to process metrics")
+	fs.Int(ParamMinWorkers, DefaultMinWorkers, "Minimum number of workers to process metrics, the workers are scaled between this and max-workers based on queue depth (0 to disable scaling)")
+	fs.Duration(ParamWorkerScaleInterval, DefaultWorkerScaleInterval, "How often the number of workers is re-evaluated when scaling")
 	fs.Int(ParamMaxQueueSize, DefaultMaxQueueSize, "Maximum number of buffered metrics per worker")
 	fs.Int(ParamMaxConcurrentEvents, DefaultMaxConcurrentEvents, "Maximum number of events sent concurrently")
+	fs.Float64(ParamMaxEventsPerSecond, DefaultMaxEventsPerSecond, "Maximum number of events per second sent to backends, events over the limit are dropped (0 for unlimited)")
+	fs.Float64(ParamPerSourceRateLimit, DefaultPerSourceRateLimit, "Maximum number of metrics per second accepted over UDP and TCP from each source address, metrics over the limit are dropped (0 for unlimited)")
+	fs.Int(ParamMaxEventSize, DefaultMaxEventSize, "Maximum size in bytes of an event body sent to backends, longer bodies are truncated (0 for unlimited)")
+	fs.Duration(ParamEventBatchWindow, DefaultEventBatchWindow, "How long events wait to be sent to backends in a batch (0 to send each event as it's received)")
+	fs.Int(ParamEventBatchSize, DefaultEventBatchSize, "Maximum number of events in a batch, a full batch is sent without waiting for event-batch-window")
 	fs.Int(ParamEstimatedTags, DefaultEstimatedTags, "Estimated number of expected tags on an individual metric submitted externally")
 	fs.Duration(ParamCacheRefreshPeriod, DefaultCacheRefreshPeriod, "Cloud cache refresh period")
 	fs.Duration(ParamCacheEvictAfterIdlePeriod, DefaultCacheEvictAfterIdlePeriod, "Idle cloud cache eviction period")
 	fs.Duration(ParamCacheTTL, DefaultCacheTTL, "Cloud cache TTL for successful lookups")
 	fs.Duration(ParamCacheNegativeTTL, DefaultCacheNegativeTTL, "Cloud cache TTL for failed lookups")
-	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Address on which to listen for metrics")
+	fs.String(ParamMetricsAddr, DefaultMetricsAddr, "Comma separated addresses on which to listen for metrics")
+	fs.Duration(ParamShutdownDrainTimeout, DefaultShutdownDrainTimeout, "On SIGTERM or interrupt, stop receiving and flush what was received once before stopping, failing if it takes longer than this (0 to stop immediately)")
+	fs.String(ParamTCPAddr, DefaultTCPAddr, "Address on which to listen for newline delimited metrics over TCP, in addition to UDP (empty to disable)")
+	fs.Int(ParamTCPMaxConnections, DefaultTCPMaxConnections, "Maximum number of TCP connections read from concurrently, further connections wait to be accepted")
+	fs.String(ParamTCPFraming, DefaultTCPFraming, "Framing of lines on TCP connections, newline or length-prefix for a 4 byte big-endian length before each batch of lines")
+	fs.String(ParamSocketPath, DefaultSocketPath, "Path of a Unix domain socket on which to listen for metrics, in addition to UDP (empty to disable)")
+	fs.String(ParamSocketType, DefaultSocketType, "Type of the Unix domain socket, unixgram for datagrams like UDP, or unix for newline delimited metrics like TCP")
+	fs.String(ParamSocketPermissions, DefaultSocketPermissions, "Permissions the Unix domain socket is created with, in octal")
+	fs.String(ParamSocketFraming, DefaultSocketFraming, "Framing of lines on Unix domain socket connections with socket-type unix, newline or length-prefix")
+	fs.String(ParamAdminAddr, DefaultAdminAddr, "Address on which to serve snapshots of the aggregators and backends as JSON, for debugging (empty to disable)")
+	fs.Duration(ParamHealthMaxFlushAge, DefaultHealthMaxFlushAge, "Maximum time since the last successful send to each backend for /healthz on the admin-addr to be healthy (0 for three flush intervals)")
 	fs.String(ParamNamespace, "", "Namespace all metrics")
 	fs.String(ParamBackends, strings.Join(DefaultBackends, " "), "Space separated list of backends")
 	fs.Int(ParamMaxCloudRequests, DefaultMaxCloudRequests, "Maximum number of cloud provider requests per second")
@@ -217,12 +535,53 @@ func AddFlags(fs *pflag.FlagSet) {
 	fs.String(ParamInternalNamespace, DefaultInternalNamespace, "Namespace for internal metrics, may be \"\"")
 	fs.String(ParamStatserType, DefaultStatserType, "Statser type to be used for sending metrics")
 	fs.String(ParamPercentThreshold, strings.Join(toStringSlice(DefaultPercentThreshold), " "), "Space separated list of percentiles")
+	fs.String(ParamTimerHistogramBuckets, "", "Comma or space separated list of upper bounds of cumulative timer histogram buckets (empty to disable)")
+	fs.Int(ParamPercentileMinSamples, DefaultPercentileMinSamples, "Minimum number of samples in a timer for percentiles to be calculated (0 for always)")
+	fs.Bool(ParamTimerSampleRateWeighting, DefaultTimerSampleRateWeighting, "Weight timer values by 1 / their sampling rate when calculating percentiles, mean, median and standard deviation")
+	fs.Int(ParamTimerReservoirSize, DefaultTimerReservoirSize, "Maximum number of values kept for each timer each flush, sampled uniformly, to calculate percentiles and the median from (0 to keep all of them)")
+	fs.Int(ParamMaxLineLength, DefaultMaxLineLength, "Maximum length of a line in bytes, longer lines are rejected without being parsed (0 for unlimited)")
+	fs.String(ParamBadLineDumpFile, DefaultBadLineDumpFile, "File to write the lines which failed to parse to, with their source and the reason, as JSON (empty to disable)")
+	fs.Int64(ParamBadLineDumpMaxSize, DefaultBadLineDumpMaxSize, "Size in bytes the bad line dump file is rotated at")
+	fs.Int(ParamBadLineDumpMaxBackups, DefaultBadLineDumpMaxBackups, "Number of rotated bad line dump files kept")
+	fs.Float64(ParamBadLineDumpLinesPerSecond, DefaultBadLineDumpLinesPerSecond, "Maximum number of bad lines written to the dump file per second, more are only counted")
+	fs.String(ParamCanaryName, DefaultCanaryName, "Name of a canary counter to dispatch through the pipeline every flush, so its absence downstream indicates a break (empty to disable)")
+	fs.Float64(ParamCanaryValue, DefaultCanaryValue, "Value of the canary counter")
+	fs.String(ParamCanaryTags, "", "Space separated list of tags of the canary counter")
+	fs.Bool(ParamParseTiming, DefaultParseTiming, "Emit internal metrics for the time spent parsing each type of line")
+	fs.Float64(ParamSampleRate, DefaultSampleRate, "Fraction of counter and timer datapoints to aggregate, shedding load by sampling, with counters and timer counts scaled up to compensate (1 for all of them)")
+	fs.Bool(ParamBackendLag, DefaultBackendLag, "Emit an internal metric per backend for the time since the most recent flush it successfully delivered was taken")
+	fs.String(ParamBackendOrder, DefaultBackendOrder, "Order backends are sent each flush in: fixed for the configured order, random, or round-robin to rotate which is first")
+	fs.String(ParamWorkerHash, DefaultWorkerHash, "Hash metrics are sharded across workers by: adler32, fnv, xxhash or jump")
+	fs.Bool(ParamWorkerHashTags, DefaultWorkerHashTags, "Include the tags of a metric when sharding across workers, so the series of a hot metric name are spread across workers")
+	fs.String(ParamBackendInitMode, DefaultBackendInitMode, "How to handle backends which fail to initialise: strict to fail, or lenient to run with the other backends")
+	fs.String(ParamNameSeparator, DefaultNameSeparator, "Replace every '.', '_' and '-' in metric names with this separator before aggregation, so inconsistently separated names are merged (empty to disable)")
+	fs.Duration(ParamCatalogTTL, DefaultCatalogTTL, "How long a metric name or tag key is kept in the catalog after it was last seen (0 to disable the catalog)")
+	fs.Int(ParamCatalogMaxNames, DefaultCatalogMaxNames, "Maximum number of metrics tracked by the catalog (0 for unlimited)")
+	fs.Duration(ParamWarmupTimeout, DefaultWarmupTimeout, "Maximum time to wait after starting for the cloud provider and backends to be ready before metrics are processed, the healthcheck fails until then (0 to not wait)")
+	fs.Int(ParamBackendQueueSize, DefaultBackendQueueSize, "Number of flushes queued for each backend, so a slow or failing backend doesn't delay the others, the oldest is dropped when full (0 to send every flush to all backends together)")
+	fs.Int(ParamBackendRetries, DefaultBackendRetries, "Number of times a send to a backend which failed with a transient error is retried within the flush interval (0 to not retry)")
+	fs.Int(ParamStdoutFallbackAfter, DefaultStdoutFallbackAfter, "Also write metrics to stdout once every backend has failed for this many consecutive flushes, until one recovers (0 to disable)")
+	fs.Bool(ParamCounterRates, DefaultCounterRates, "Emit each counter as two gauges, <name> with the count and <name>.per_second with the rate")
+	fs.Bool(ParamFlushLatency, DefaultFlushLatency, "Emit an internal metric for the time from the oldest metric in each flush being received to it being flushed")
+	fs.Bool(ParamSuppressZeroCounters, DefaultSuppressZeroCounters, "Don't flush counters with a value of zero, such as counters which weren't received during the flush interval")
+	fs.Duration(ParamSetMemberTTL, DefaultSetMemberTTL, "How long set members are kept after they were last seen (0 to keep them for one flush)")
+	fs.String(ParamSetEmitMembers, "", "Space separated list of set names to also flush each member of as a <name>.members gauge tagged with the member, supports prefix* and regex:")
+	fs.Int(ParamSetMaxMembers, DefaultSetMaxMembers, "Maximum number of members of a set flushed with set-emit-members, larger sets flush a single gauge of the number of members tagged set:truncated")
 	fs.Bool(ParamHeartbeatEnabled, DefaultHeartbeatEnabled, "Enables heartbeat")
 	fs.Int(ParamReceiveBatchSize, DefaultReceiveBatchSize, "The number of datagrams to read in each receive batch")
 	fs.Bool(ParamConnPerReader, DefaultConnPerReader, "Create a separate connection per reader (requires system support for reusing addresses)")
 	fs.String(ParamServerMode, DefaultServerMode, "The server mode to run in")
 	fs.String(ParamHostname, getHost(), "overrides the hostname of the server")
+	fs.String(ParamHostnameStrategy, DefaultHostnameStrategy, "Space separated list of strategies to resolve the hostname, the first to give a value is used: static (the hostname setting), os, env:VAR, file:path, or cloud")
 	fs.Bool(ParamLogRawMetric, DefaultLogRawMetric, "Print metrics received from network to stdout in JSON format")
+	fs.String(ParamFlushSequenceTag, "", "If set, tag all flushed metrics with this key and the flush sequence number")
+	fs.String(ParamFlushNamespaces, "", "Space separated list of namespaces to emit every metric under when flushing, may be overridden per backend")
+	fs.String(ParamCaptureFile, "", "File to append captured datagrams to, enables the capture endpoints on http servers with enable-capture")
+	fs.String(ParamCountersAsGauges, "", "Space separated list of counter names to aggregate as gauges (last value), supports prefix* and regex:")
+	fs.String(ParamTagValueLimits, "", "Space separated list of key:K, keep only the K most frequent values of each tag key per metric, collapsing the rest in to "+otherTagValue)
+	fs.Int(ParamMaxMetricNames, DefaultMaxMetricNames, "Maximum number of distinct metric names to aggregate, new names beyond this are dropped (0 for unlimited)")
+	fs.Int(ParamMaxSeries, DefaultMaxSeries, "Maximum number of series (distinct name, type and tags) to aggregate, the least recently updated series are evicted to make room for new ones (0 for unlimited)")
+	fs.Int(ParamMaxCardinalityPerMetric, DefaultMaxCardinalityPerMetric, "Maximum number of tag sets per metric name in each flush interval, further tag sets are folded in to "+cardinalityOverflowTag+" (0 for unlimited)")
 }
 
 func minInt(a, b int) int {
@@ -0,0 +1,77 @@
+package statsd
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// ErrDrainTimeout is returned by Server.Run when the server didn't finish draining within ShutdownDrainTimeout.
+var ErrDrainTimeout = errors.New("timed out draining")
+
+// stoppable returns a Runnable which runs run until its context is done or stop is closed, and which is tracked by
+// wg.  A nil stop is never closed.
+func stoppable(run gostatsd.Runnable, stop <-chan struct{}, wg *sync.WaitGroup) gostatsd.Runnable {
+	wg.Add(1)
+	return func(ctx context.Context) {
+		defer wg.Done()
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+			case <-stop:
+				cancel()
+			}
+		}()
+		run(ctx)
+	}
+}
+
+// waitGroup waits for wg, returning the error of ctx if it is done first.
+func waitGroup(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// drain waits for everything which receives metrics to stop, then for the parsers to parse what was received, then
+// flushes once so nothing received is lost, all within ShutdownDrainTimeout.
+func (s *Server) drain(ctx context.Context, receiving *sync.WaitGroup, datagrams chan []*Datagram, parsing *sync.WaitGroup, flusher *MetricFlusher) error {
+	log.WithField("timeout", s.ShutdownDrainTimeout).Info("Draining")
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, s.ShutdownDrainTimeout)
+	defer cancel()
+
+	err := waitGroup(ctx, receiving)
+	if err == nil {
+		// Nothing sends to the parsers anymore, so they stop once they have parsed everything received.
+		close(datagrams)
+		err = waitGroup(ctx, parsing)
+	}
+	if err == nil {
+		err = flusher.Flush(ctx)
+	}
+	switch err {
+	case nil:
+		log.WithField("duration", time.Since(start)).Info("Finished draining")
+		return nil
+	case context.DeadlineExceeded:
+		return ErrDrainTimeout
+	default:
+		return err
+	}
+}
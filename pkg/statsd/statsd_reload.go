@@ -0,0 +1,76 @@
+package statsd
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/atlassian/gostatsd"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// ReloadableParams are the parameters which Reload applies to a running Server.  Every other parameter requires a
+// restart to change.  The sections of filters and name rewrite rules are also reloadable, see ReloadablePrefixes.
+var ReloadableParams = []string{
+	ParamDefaultTags,
+	ParamInternalTags,
+	ParamBadLinesPerMinute,
+	"filters",
+	ParamNameRewriteRules,
+}
+
+// ReloadablePrefixes are the prefixes of the sections which Reload applies to a running Server.
+var ReloadablePrefixes = []string{
+	"filter.",
+	"name-rewrite.",
+}
+
+// reloadable is the components of a running Server which Reload changes.
+type reloadable struct {
+	tagHandler         *TagHandler
+	nameRewriteHandler *NameRewriteHandler
+	parser             *DatagramParser
+	statser            interface{ SetTags(gostatsd.Tags) } // nil if the statser has no tags
+}
+
+// Reload applies the ReloadableParams in v to the running Server.  Everything is parsed before anything is changed,
+// so if an error is returned the Server is unchanged.
+func (s *Server) Reload(v *viper.Viper) error {
+	defaultTags := gostatsd.Tags(v.GetStringSlice(ParamDefaultTags))
+	internalTags := gostatsd.Tags(v.GetStringSlice(ParamInternalTags))
+	badLineRateLimitPerSecond := rate.Limit(v.GetFloat64(ParamBadLinesPerMinute) / 60.0)
+	if badLineRateLimitPerSecond < 0 {
+		return fmt.Errorf("invalid %s %v, must not be negative", ParamBadLinesPerMinute, v.GetFloat64(ParamBadLinesPerMinute))
+	}
+	filters := NewFiltersFromViper(v)
+	rules, err := NewNameRewriteRulesFromViper(v)
+	if err != nil {
+		return err
+	}
+
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	if s.running == nil {
+		return errors.New("server is not running")
+	}
+	s.running.tagHandler.Reload(defaultTags.Copy(), filters)
+	s.running.nameRewriteHandler.Reload(rules)
+	s.running.parser.SetBadLineRateLimit(badLineRateLimitPerSecond)
+	if s.running.statser != nil {
+		s.running.statser.SetTags(internalTags)
+	}
+	s.DefaultTags = defaultTags
+	s.InternalTags = internalTags
+	s.BadLineRateLimitPerSecond = badLineRateLimitPerSecond
+	log.Infof("Reloaded %d filters and %d name rewrite rules", len(filters), len(rules))
+	return nil
+}
+
+// setRunning records the components which Reload changes, or nil once the Server stops.
+func (s *Server) setRunning(r *reloadable) {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	s.running = r
+}
@@ -0,0 +1,96 @@
+package statsd
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+)
+
+type capturingTagsStatser struct {
+	tags gostatsd.Tags
+}
+
+func (cts *capturingTagsStatser) SetTags(tags gostatsd.Tags) {
+	cts.tags = tags
+}
+
+func newReloadTestViper(t *testing.T, config string) *viper.Viper {
+	v := viper.New()
+	v.SetConfigType("toml")
+	require.NoError(t, v.ReadConfig(bytes.NewBufferString(config)))
+	return v
+}
+
+func TestServerReload(t *testing.T) {
+	t.Parallel()
+	tch := &capturingHandler{}
+	th := NewTagHandler(tch, gostatsd.Tags{"env:dev"}, nil)
+	nrh := NewNameRewriteHandler(th, nil)
+	parser := NewDatagramParser(nil, "", false, 0, nrh, 0, false)
+	statser := &capturingTagsStatser{}
+	s := &Server{}
+
+	v := newReloadTestViper(t, `
+default-tags='env:prod'
+internal-tags='service:gostatsd'
+bad-lines-per-minute=120
+filters='no-debug'
+name-rewrite-rules='ids'
+
+[filter.no-debug]
+match-metrics='debug.*'
+drop-metric=true
+
+[name-rewrite.ids]
+pattern='\.\d+$'
+replacement='.id'
+`)
+	require.Error(t, s.Reload(v)) // Not running
+
+	s.setRunning(&reloadable{tagHandler: th, nameRewriteHandler: nrh, parser: parser, statser: statser})
+	require.NoError(t, s.Reload(v))
+
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "debug.x"}, {Name: "api.1"}})
+	require.Len(t, tch.m, 1)
+	assert.Equal(t, "api.id", tch.m[0].Name)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, tch.m[0].Tags)
+	assert.Equal(t, gostatsd.Tags{"service:gostatsd"}, statser.tags)
+	assert.Equal(t, rate.Limit(2), parser.badLineLimiter.Limit())
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, s.DefaultTags)
+
+	// An invalid configuration changes nothing
+	invalid := newReloadTestViper(t, `
+default-tags='env:staging'
+name-rewrite-rules='ids'
+
+[name-rewrite.ids]
+pattern='('
+`)
+	require.Error(t, s.Reload(invalid))
+	nrh.DispatchMetrics(context.Background(), []*gostatsd.Metric{{Name: "api.2"}})
+	require.Len(t, tch.m, 2)
+	assert.Equal(t, "api.id", tch.m[1].Name)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, tch.m[1].Tags)
+	assert.Equal(t, gostatsd.Tags{"env:prod"}, s.DefaultTags)
+}
+
+func TestDatagramParserSetBadLineRateLimit(t *testing.T) {
+	t.Parallel()
+	parser := NewDatagramParser(nil, "", false, 0, &nopHandler{}, 0, false)
+	assert.False(t, parser.badLineLimiter.Allow())
+
+	parser.SetBadLineRateLimit(1)
+	assert.Equal(t, rate.Limit(1), parser.badLineLimiter.Limit())
+	assert.Equal(t, 1, parser.badLineLimiter.Burst())
+
+	parser.SetBadLineRateLimit(0)
+	assert.Equal(t, rate.Limit(0), parser.badLineLimiter.Limit())
+	assert.False(t, parser.badLineLimiter.Allow())
+}
@@ -13,6 +13,8 @@ import (
 
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"golang.org/x/time/rate"
 )
 
@@ -89,6 +91,80 @@ func TestStatsdThroughput(t *testing.T) {
 		memStatsFinish.GCCPUFraction)
 }
 
+// newDrainTestServer returns a Server which reads fake datagrams, and only flushes when drained.
+func newDrainTestServer(backend gostatsd.Backend, drain <-chan struct{}) *Server {
+	return &Server{
+		Backends:             []gostatsd.Backend{backend},
+		ExpiryInterval:       DefaultExpiryInterval,
+		FlushInterval:        time.Hour,
+		MaxReaders:           1,
+		MaxParsers:           2,
+		MaxWorkers:           2,
+		MaxQueueSize:         DefaultMaxQueueSize,
+		EstimatedTags:        1,
+		PercentThreshold:     DefaultPercentThreshold,
+		ReceiveBatchSize:     DefaultReceiveBatchSize,
+		MaxConcurrentEvents:  2,
+		ServerMode:           "standalone",
+		ShutdownDrainTimeout: 5 * time.Second,
+		Drain:                drain,
+		Viper:                viper.New(),
+	}
+}
+
+func TestServerDrain(t *testing.T) {
+	t.Parallel()
+	backend := &countingBackend{}
+	drain := make(chan struct{})
+	s := newDrainTestServer(backend, drain)
+	time.AfterFunc(200*time.Millisecond, func() {
+		close(drain)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.NoError(t, s.RunWithCustomSocket(ctx, fakesocket.Factory))
+	// The flush interval is never reached, so everything was sent by the final flush.
+	require.NotZero(t, atomic.LoadUint64(&backend.metrics))
+}
+
+func TestServerDrainTimeout(t *testing.T) {
+	t.Parallel()
+	drain := make(chan struct{})
+	close(drain)
+	// The backend is released once the drain has timed out, so the server can stop.
+	backend := &blockingBackend{release: make(chan struct{})}
+	time.AfterFunc(time.Second, func() {
+		close(backend.release)
+	})
+	s := newDrainTestServer(backend, drain)
+	s.ShutdownDrainTimeout = 100 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	require.Equal(t, ErrDrainTimeout, s.RunWithCustomSocket(ctx, fakesocket.Factory))
+}
+
+func TestServerWorkerHashTagsWithPerNameLimits(t *testing.T) {
+	t.Parallel()
+	for _, limit := range []func(s *Server){
+		func(s *Server) { s.MaxMetricNames = 10 },
+		func(s *Server) { s.MaxCardinalityPerMetric = 10 },
+		func(s *Server) { s.TagValueLimits = map[string]int{"path": 10} },
+	} {
+		s := newDrainTestServer(&countingBackend{}, nil)
+		s.WorkerHashTags = true
+		limit(s)
+		_, _, _, err := s.createStandaloneSink(nil)
+		assert.EqualError(t, err, ParamWorkerHashTags+" can't be used with "+s.perNameLimitParam()+", as each aggregator would apply the limit to the series of a name it has separately")
+
+		// A single worker has every series of a name
+		s.MaxWorkers = 1
+		_, _, _, err = s.createStandaloneSink(nil)
+		assert.NoError(t, err)
+	}
+}
+
 type countingBackend struct {
 	metrics uint64
 	events  uint64
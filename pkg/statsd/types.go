@@ -37,7 +37,8 @@ type Datagram struct {
 	IP        gostatsd.IP
 	Msg       []byte
 	Timestamp gostatsd.Nanotime
-	DoneFunc  func() // to be called once the datagram has been parsed and msg can be freed
+	DoneFunc  func()        // to be called once the datagram has been parsed and msg can be freed
+	Tags      gostatsd.Tags // Optional, added to every metric and event parsed from the datagram
 }
 
 // MetricEmitter is an object that emits metrics.  Used to pass a Statser to the object
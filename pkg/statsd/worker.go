@@ -1,12 +1,7 @@
 package statsd
 
 import (
-	"context"
-	"fmt"
-	"time"
-
 	"github.com/atlassian/gostatsd"
-	"github.com/atlassian/gostatsd/pkg/stats"
 )
 
 type processCommand struct {
@@ -14,46 +9,122 @@ type processCommand struct {
 	done func()
 }
 
+// workerMetrics is a batch of metrics for the Aggregator with id aggrId.
+type workerMetrics struct {
+	aggrId  int
+	metrics []*gostatsd.Metric
+}
+
+// workerMetricMap is a MetricMap for the Aggregator with id aggrId.
+type workerMetricMap struct {
+	aggrId int
+	mm     *gostatsd.MetricMap
+}
+
+// worker owns a fixed set of Aggregators for as long as it runs.  The Aggregator with id i is always owned by worker
+// i % len(workers), so metrics for a name always reach the same Aggregator, however many workers there are.
 type worker struct {
-	aggr           Aggregator
-	metricsQueue   chan []*gostatsd.Metric
-	metricMapQueue chan *gostatsd.MetricMap
+	aggrs          []Aggregator // All Aggregators, indexed by id, only those in aggrIds may be used
+	aggrIds        []int
+	metricsQueue   chan workerMetrics
+	metricMapQueue chan workerMetricMap
 	processChan    chan *processCommand
+	done           chan struct{} // Closed when work returns
 	id             int
 }
 
+func newWorker(id, numWorkers, perWorkerBufferSize int, aggrs []Aggregator) *worker {
+	w := &worker{
+		aggrs: aggrs,
+		// TODO: Reassess the defaults
+		metricsQueue:   make(chan workerMetrics, perWorkerBufferSize),
+		metricMapQueue: make(chan workerMetricMap, perWorkerBufferSize),
+		processChan:    make(chan *processCommand),
+		done:           make(chan struct{}),
+		id:             id,
+	}
+	for aggrId := id; aggrId < len(aggrs); aggrId += numWorkers {
+		w.aggrIds = append(w.aggrIds, aggrId)
+	}
+	return w
+}
+
+// work receives metrics in to the Aggregators and executes process commands against them.  Both happen on the same
+// goroutine, so a flush (Flush, Process, Reset) is never interleaved with incoming metrics.  Metrics which arrive
+// while a flush is in progress wait in the queues and are aggregated in to the next window.
 func (w *worker) work() {
+	defer close(w.done)
 	for {
 		select {
-		case metrics, ok := <-w.metricsQueue:
+		case wm, ok := <-w.metricsQueue:
 			if !ok {
 				return
 			}
-			w.aggr.Receive(metrics...)
-		case mm, ok := <-w.metricMapQueue:
+			w.aggrs[wm.aggrId].Receive(wm.metrics...)
+		case wmm, ok := <-w.metricMapQueue:
 			if !ok {
 				return
 			}
-			w.aggr.ReceiveMap(mm)
+			w.aggrs[wmm.aggrId].ReceiveMap(wmm.mm)
 		case cmd := <-w.processChan:
+			// select picks randomly between ready channels, so anything which was queued before the command
+			// arrived must be received first, otherwise it would be attributed to the following window.
+			w.drainQueues()
 			w.executeProcess(cmd)
 		}
 	}
 }
 
+// drainQueues receives everything which is currently queued, without waiting for anything new.
+func (w *worker) drainQueues() {
+	for n := len(w.metricsQueue); n > 0; n-- {
+		wm, ok := <-w.metricsQueue
+		if !ok {
+			break
+		}
+		w.aggrs[wm.aggrId].Receive(wm.metrics...)
+	}
+	for n := len(w.metricMapQueue); n > 0; n-- {
+		wmm, ok := <-w.metricMapQueue
+		if !ok {
+			break
+		}
+		w.aggrs[wmm.aggrId].ReceiveMap(wmm.mm)
+	}
+}
+
 func (w *worker) executeProcess(cmd *processCommand) {
-	defer cmd.done() // Done with the process command
-	cmd.f(w.id, w.aggr)
-}
-
-func (w *worker) RunMetrics(ctx context.Context, statser stats.Statser) {
-	csw := stats.NewChannelStatsWatcher(
-		statser,
-		"dispatch_aggregator",
-		gostatsd.Tags{fmt.Sprintf("aggregator_id:%d", w.id)},
-		cap(w.metricsQueue),
-		func() int { return len(w.metricsQueue) },
-		1000*time.Millisecond, // TODO: Make configurable
-	)
-	csw.Run(ctx)
+	for _, aggrId := range w.aggrIds {
+		cmd.f(aggrId, w.aggrs[aggrId])
+		cmd.done() // Done with the process command for this Aggregator
+	}
+}
+
+// stop closes the queues and waits for work to return.  Anything left in the queues is then received, so nothing
+// is lost when the Aggregators are handed to another worker.
+func (w *worker) stop() {
+	close(w.metricsQueue)
+	close(w.metricMapQueue)
+	<-w.done
+	w.drainQueues()
+}
+
+// queueDepth returns the number of batches in the fuller of the queues.
+func (w *worker) queueDepth() int {
+	if n := len(w.metricMapQueue); n > len(w.metricsQueue) {
+		return n
+	}
+	return len(w.metricsQueue)
+}
+
+// queueFill returns how full the fuller of the queues is, from 0 to 1.  Unbuffered queues always report 0.
+func (w *worker) queueFill() float64 {
+	if cap(w.metricsQueue) == 0 {
+		return 0
+	}
+	fill := float64(len(w.metricsQueue)) / float64(cap(w.metricsQueue))
+	if mapFill := float64(len(w.metricMapQueue)) / float64(cap(w.metricMapQueue)); mapFill > fill {
+		fill = mapFill
+	}
+	return fill
 }
@@ -0,0 +1,40 @@
+package util
+
+import (
+	"bytes"
+	"sync"
+)
+
+// BufferPool is a pool of buffers for serializing payloads, so the buffers can be reused between flushes rather
+// than allocated each time.  Buffers which have grown beyond maxSize are dropped instead of being returned to the
+// pool, so an unusually large payload doesn't stay in memory.
+type BufferPool struct {
+	pool    sync.Pool
+	maxSize int
+}
+
+// NewBufferPool creates a new BufferPool which keeps buffers up to maxSize bytes, or of any size if maxSize is 0.
+func NewBufferPool(maxSize int) *BufferPool {
+	return &BufferPool{
+		pool: sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		},
+		maxSize: maxSize,
+	}
+}
+
+// Get returns an empty buffer from the pool.
+func (bp *BufferPool) Get() *bytes.Buffer {
+	return bp.pool.Get().(*bytes.Buffer)
+}
+
+// Put returns buf to the pool.  It must not be used after this.
+func (bp *BufferPool) Put(buf *bytes.Buffer) {
+	if bp.maxSize > 0 && buf.Cap() > bp.maxSize {
+		return
+	}
+	buf.Reset()
+	bp.pool.Put(buf)
+}
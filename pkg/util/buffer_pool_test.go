@@ -0,0 +1,28 @@
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferPoolResetsBuffers(t *testing.T) {
+	t.Parallel()
+	bp := NewBufferPool(0)
+	buf := bp.Get()
+	buf.WriteString("payload")
+	bp.Put(buf)
+	assert.Zero(t, bp.Get().Len())
+}
+
+func TestBufferPoolDropsLargeBuffers(t *testing.T) {
+	t.Parallel()
+	bp := NewBufferPool(16)
+	buf := bp.Get()
+	buf.Grow(1024)
+	bp.Put(buf)
+	// sync.Pool makes no guarantee a returned buffer is handed out again, so only check the large one never is.
+	for i := 0; i < 10; i++ {
+		assert.True(t, bp.Get() != buf)
+	}
+}
@@ -0,0 +1,98 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/cenkalti/backoff"
+)
+
+// ThrottledError is returned when a request is rejected with 429 Too Many Requests.
+type ThrottledError struct {
+	RetryAfter time.Duration // How long the server asked to wait before retrying, 0 if it didn't say
+}
+
+func (e *ThrottledError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("received bad status code %d, retry after %s", http.StatusTooManyRequests, e.RetryAfter)
+	}
+	return fmt.Sprintf("received bad status code %d", http.StatusTooManyRequests)
+}
+
+// NewThrottledError returns a ThrottledError using the Retry-After header of resp.
+func NewThrottledError(resp *http.Response) *ThrottledError {
+	return &ThrottledError{
+		RetryAfter: ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now()),
+	}
+}
+
+// StatusError is returned when a request is rejected with a status code other than 429 Too Many Requests.
+type StatusError struct {
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("received bad status code %d", e.StatusCode)
+}
+
+// NewStatusError returns a StatusError for the status code, or a ThrottledError if it is 429 Too Many Requests.
+func NewStatusError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusTooManyRequests {
+		return NewThrottledError(resp)
+	}
+	return &StatusError{StatusCode: resp.StatusCode}
+}
+
+// IsRetryable returns true if err is likely to be transient: a 5xx status code, a timeout, or the connection being
+// reset.  Other errors, including every 4xx status code, are not retryable.
+func IsRetryable(err error) bool {
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= http.StatusInternalServerError
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// ParseRetryAfter parses a Retry-After header, which is either a number of seconds or an HTTP date.  Returns 0 if
+// the header is empty or invalid, or the date has passed.
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	header = strings.TrimSpace(header)
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.ParseUint(header, 10, 32); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && date.After(now) {
+		return date.Sub(now)
+	}
+	return 0
+}
+
+// NextRetry returns how long to wait before retrying a request which failed with err, and whether it was throttled.
+// If the server asked to wait for longer than the next backoff, that is used instead, unless it would take the
+// retries past the MaxElapsedTime of b, in which case backoff.Stop is returned rather than retrying early.
+func NextRetry(b *backoff.ExponentialBackOff, err error) (time.Duration, bool) {
+	next := b.NextBackOff()
+	var throttled *ThrottledError
+	if !errors.As(err, &throttled) {
+		return next, false
+	}
+	if next == backoff.Stop || throttled.RetryAfter <= next {
+		return next, true
+	}
+	if b.MaxElapsedTime != 0 && b.GetElapsedTime()+throttled.RetryAfter > b.MaxElapsedTime {
+		return backoff.Stop, true
+	}
+	return throttled.RetryAfter, true
+}
@@ -0,0 +1,82 @@
+package util
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	assert.Equal(t, 30*time.Second, ParseRetryAfter("30", now))
+	assert.Equal(t, 30*time.Second, ParseRetryAfter(" 30 ", now))
+	assert.Equal(t, 90*time.Second, ParseRetryAfter(now.Add(90*time.Second).Format(http.TimeFormat), now))
+	assert.Zero(t, ParseRetryAfter(now.Add(-time.Minute).Format(http.TimeFormat), now))
+	assert.Zero(t, ParseRetryAfter("", now))
+	assert.Zero(t, ParseRetryAfter("-5", now))
+	assert.Zero(t, ParseRetryAfter("soon", now))
+}
+
+func TestNextRetry(t *testing.T) {
+	t.Parallel()
+	newBackOff := func() *backoff.ExponentialBackOff {
+		b := backoff.NewExponentialBackOff()
+		b.InitialInterval = time.Second
+		b.RandomizationFactor = 0
+		b.MaxElapsedTime = time.Minute
+		b.Reset()
+		return b
+	}
+
+	next, throttled := NextRetry(newBackOff(), fmt.Errorf("received bad status code 500"))
+	assert.Equal(t, time.Second, next)
+	assert.False(t, throttled)
+
+	// Retry-After is used if it is longer than the backoff
+	next, throttled = NextRetry(newBackOff(), fmt.Errorf("wrapped: %w", &ThrottledError{RetryAfter: 10 * time.Second}))
+	assert.Equal(t, 10*time.Second, next)
+	assert.True(t, throttled)
+
+	next, throttled = NextRetry(newBackOff(), &ThrottledError{})
+	assert.Equal(t, time.Second, next)
+	assert.True(t, throttled)
+
+	// Stop rather than retry before the server asked to
+	next, throttled = NextRetry(newBackOff(), &ThrottledError{RetryAfter: 2 * time.Minute})
+	assert.Equal(t, backoff.Stop, next)
+	assert.True(t, throttled)
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	t.Parallel()
+	assert.True(t, IsRetryable(&StatusError{StatusCode: http.StatusServiceUnavailable}))
+	assert.True(t, IsRetryable(fmt.Errorf("[backend] %w", &StatusError{StatusCode: http.StatusInternalServerError})))
+	assert.False(t, IsRetryable(&StatusError{StatusCode: http.StatusBadRequest}))
+	assert.False(t, IsRetryable(&ThrottledError{}))
+	assert.True(t, IsRetryable(fmt.Errorf("error POSTing: %w", timeoutError{})))
+	assert.True(t, IsRetryable(&net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}))
+	assert.False(t, IsRetryable(errors.New("boom")))
+}
+
+func TestNewStatusError(t *testing.T) {
+	t.Parallel()
+	err := NewStatusError(&http.Response{StatusCode: http.StatusBadGateway})
+	assert.Equal(t, &StatusError{StatusCode: http.StatusBadGateway}, err)
+	assert.Equal(t, "received bad status code 502", err.Error())
+	assert.IsType(t, &ThrottledError{}, NewStatusError(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{}}))
+}
@@ -0,0 +1,96 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/capture"
+)
+
+const (
+	defaultCaptureRate  = 100
+	defaultCaptureLimit = 10000
+)
+
+type captureController struct {
+	logger   logrus.FieldLogger
+	capturer *capture.Capturer
+}
+
+// status reports the current capture state.
+func (cc *captureController) status(w http.ResponseWriter, req *http.Request) {
+	cc.writeStatus(w)
+}
+
+// start begins a capture, configured by the optional query parameters source-ip, rate (datagrams per second), and
+// limit (total datagrams, 0 for unlimited).
+func (cc *captureController) start(w http.ResponseWriter, req *http.Request) {
+	opts, err := parseCaptureOptions(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := cc.capturer.Start(opts); err != nil {
+		cc.logger.WithError(err).Error("failed to start capture")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cc.writeStatus(w)
+}
+
+// stop ends the running capture.
+func (cc *captureController) stop(w http.ResponseWriter, req *http.Request) {
+	if err := cc.capturer.Stop(); err != nil {
+		if err == capture.ErrNotActive {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		cc.logger.WithError(err).Error("failed to stop capture")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	cc.writeStatus(w)
+}
+
+func (cc *captureController) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(cc.capturer.Status()); err != nil {
+		cc.logger.WithError(err).Warn("failed to write capture status")
+	}
+}
+
+func parseCaptureOptions(req *http.Request) (capture.Options, error) {
+	query := req.URL.Query()
+	opts := capture.Options{
+		Rate:  defaultCaptureRate,
+		Limit: defaultCaptureLimit,
+	}
+	if s := query.Get("source-ip"); s != "" {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return opts, fmt.Errorf("invalid source-ip %q", s)
+		}
+		opts.SourceIP = gostatsd.IP(ip.String())
+	}
+	if s := query.Get("rate"); s != "" {
+		r, err := strconv.ParseFloat(s, 64)
+		if err != nil || r <= 0 {
+			return opts, fmt.Errorf("invalid rate %q, must be a positive number", s)
+		}
+		opts.Rate = r
+	}
+	if s := query.Get("limit"); s != "" {
+		l, err := strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			return opts, fmt.Errorf("invalid limit %q, must be a non-negative integer", s)
+		}
+		opts.Limit = l
+	}
+	return opts, nil
+}
@@ -0,0 +1,111 @@
+package web_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/capture"
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+func TestCaptureEndpoints(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "capture")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	capturer := capture.NewCapturer(logrus.New(), filepath.Join(dir, "capture.log"))
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		capturer,
+		nil,
+		nil,
+		"TestCaptureEndpoints",
+		"",
+		false,
+		false,
+		false,
+		false,
+		true,
+		false,
+		false,
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	do := func(method, path string) (int, capture.Status) {
+		req, err := http.NewRequest(method, c.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var status capture.Status
+		if resp.StatusCode == http.StatusOK {
+			require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		}
+		return resp.StatusCode, status
+	}
+
+	code, status := do("POST", "/capture/start?source-ip=10.0.0.1&rate=5&limit=20")
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Active)
+	assert.EqualValues(t, "10.0.0.1", status.SourceIP)
+	assert.EqualValues(t, 5, status.Rate)
+	assert.EqualValues(t, 20, status.Limit)
+	assert.True(t, capturer.Active())
+
+	code, status = do("GET", "/capture")
+	require.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Active)
+
+	code, status = do("POST", "/capture/stop")
+	require.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Active)
+	assert.False(t, capturer.Active())
+
+	code, _ = do("POST", "/capture/stop")
+	assert.Equal(t, http.StatusConflict, code)
+
+	code, _ = do("POST", "/capture/start?source-ip=not-an-ip")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.False(t, capturer.Active())
+}
+
+func TestCaptureRequiresCapturer(t *testing.T) {
+	t.Parallel()
+
+	_, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		nil,
+		nil,
+		nil,
+		"TestCaptureRequiresCapturer",
+		"",
+		false,
+		false,
+		false,
+		false,
+		true,
+		false,
+		false,
+		"",
+		nil,
+	)
+	require.Error(t, err)
+}
@@ -0,0 +1,20 @@
+package web
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd/pkg/catalog"
+)
+
+// catalogHandler serves the names and tag keys of every metric in the catalog, and when each was last seen.
+func catalogHandler(logger logrus.FieldLogger, metricCatalog *catalog.Catalog) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(metricCatalog.Snapshot()); err != nil {
+			logger.WithError(err).Warn("failed to write catalog")
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package web_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/catalog"
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+func TestCatalogEndpoint(t *testing.T) {
+	t.Parallel()
+	ts := time.Now().Truncate(time.Second).UTC()
+	mm := gostatsd.NewMetricMap()
+	mm.Receive(&gostatsd.Metric{Name: "req", Type: gostatsd.COUNTER, Value: 1, Rate: 1, Tags: gostatsd.Tags{"env:prod"}, Timestamp: gostatsd.Nanotime(ts.UnixNano())})
+	metricCatalog := catalog.NewCatalog(time.Hour, 0)
+	metricCatalog.ObserveMap(mm)
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		nil,
+		metricCatalog,
+		nil,
+		"TestCatalogEndpoint",
+		"",
+		false,
+		false,
+		false,
+		false,
+		false,
+		true,
+		false,
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	resp, err := http.Get(c.URL + "/catalog")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var snapshot catalog.Snapshot
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&snapshot))
+	assert.Equal(t, catalog.Snapshot{
+		Metrics: []catalog.Metric{
+			{Name: "req", Type: "counter", LastSeen: ts, TagKeys: map[string]time.Time{"env": ts}},
+		},
+	}, snapshot)
+}
+
+func TestCatalogRequiresCatalog(t *testing.T) {
+	t.Parallel()
+	_, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		nil,
+		nil,
+		nil,
+		"TestCatalogRequiresCatalog",
+		"",
+		false,
+		false,
+		false,
+		false,
+		false,
+		true,
+		false,
+		"",
+		nil,
+	)
+	require.Error(t, err)
+}
@@ -0,0 +1,41 @@
+package web
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+)
+
+// expvarHandler serves exported variables in the same format as expvar.Handler, with each name prefixed by prefix so
+// the output of multiple servers can be combined.  If vars is not empty, only the named variables are included.
+func expvarHandler(prefix string, vars []string) http.HandlerFunc {
+	var include map[string]struct{}
+	if len(vars) > 0 {
+		include = make(map[string]struct{}, len(vars))
+		for _, name := range vars {
+			include[name] = struct{}{}
+		}
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, _ = w.Write([]byte("{\n"))
+		first := true
+		expvar.Do(func(kv expvar.KeyValue) {
+			if include != nil {
+				if _, ok := include[kv.Key]; !ok {
+					return
+				}
+			}
+			if !first {
+				_, _ = w.Write([]byte(",\n"))
+			}
+			first = false
+			key, _ := json.Marshal(prefix + kv.Key)
+			_, _ = w.Write(key)
+			_, _ = w.Write([]byte(": "))
+			_, _ = w.Write([]byte(kv.Value.String()))
+		})
+		_, _ = w.Write([]byte("\n}\n"))
+	}
+}
@@ -0,0 +1,69 @@
+package web_test
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+func init() {
+	expvar.NewString("expvar_test_var").Set("value")
+}
+
+func getExpvars(t *testing.T, prefix string, vars []string) map[string]interface{} {
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		nil,
+		nil,
+		nil,
+		"TestExpvar",
+		"",
+		false,
+		true,
+		false,
+		false,
+		false,
+		false,
+		false,
+		prefix,
+		vars,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	resp, err := http.Get(c.URL + "/expvar")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var result map[string]interface{}
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&result))
+	return result
+}
+
+func TestExpvarPrefix(t *testing.T) {
+	t.Parallel()
+	result := getExpvars(t, "instance1.", nil)
+	assert.Equal(t, "value", result["instance1.expvar_test_var"])
+	assert.Contains(t, result, "instance1.memstats")
+	for key := range result {
+		assert.Regexp(t, "^instance1\\.", key)
+	}
+}
+
+func TestExpvarVars(t *testing.T) {
+	t.Parallel()
+	result := getExpvars(t, "", []string{"expvar_test_var", "doesnotexist"})
+	assert.Equal(t, map[string]interface{}{"expvar_test_var": "value"}, result)
+}
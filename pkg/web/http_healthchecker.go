@@ -8,11 +8,18 @@ import (
 
 type healthChecker struct {
 	logger logrus.FieldLogger
+	ready  func() bool // Optional, reports if the server has finished warming up
 }
 
-// healthCheck reports if the server is ready to process traffic.  It does not validate downstream dependencies.
+// healthCheck reports if the server is ready to process traffic.  It does not validate downstream dependencies, but
+// does report unavailable until the server has finished warming up.
 func (hc *healthChecker) healthCheck(w http.ResponseWriter, req *http.Request) {
 	hc.logger.Info("healthCheck")
+	if hc.ready != nil && !hc.ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("warming up"))
+		return
+	}
 	_, _ = w.Write([]byte("OK"))
 }
 
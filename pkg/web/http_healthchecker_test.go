@@ -0,0 +1,60 @@
+package web_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+func TestHealthCheckWarmup(t *testing.T) {
+	t.Parallel()
+	var ready uint32
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		nil,
+		nil,
+		nil,
+		func() bool { return atomic.LoadUint32(&ready) == 1 },
+		"TestHealthCheckWarmup",
+		"",
+		false,
+		false,
+		false,
+		true,
+		false,
+		false,
+		false,
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	check := func() (int, string) {
+		resp, err := http.Get(c.URL + "/healthcheck")
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, body := check()
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.Equal(t, "warming up", body)
+
+	atomic.StoreUint32(&ready, 1)
+	status, body = check()
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "OK", body)
+}
@@ -0,0 +1,186 @@
+package web
+
+import (
+	"context"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+)
+
+// prometheusSeriesExpiry is how long the last value of a cumulative series is remembered without an update.
+const prometheusSeriesExpiry = time.Hour
+
+// promCounter is the last value received for a cumulative series.
+type promCounter struct {
+	value    float64
+	lastSeen time.Time
+}
+
+// prometheusHandler accepts metrics in the Prometheus text exposition format.  Counters, histogram buckets and the
+// sum and count of histograms and summaries are cumulative, so the difference from the previous value of the series
+// is dispatched as a counter, and the first value of a series is only remembered.  Gauges, untyped samples and
+// summary quantiles are dispatched as gauges.
+type prometheusHandler struct {
+	requestSuccess      uint64 // atomic
+	requestFailureRead  uint64 // atomic
+	requestFailureParse uint64 // atomic
+	metricsProcessed    uint64 // atomic
+
+	logger     logrus.FieldLogger
+	handler    gostatsd.PipelineHandler
+	serverName string
+	now        func() time.Time // Returns current time. Useful for testing.
+
+	mu       sync.Mutex
+	previous map[string]promCounter // Keyed by name, source and tags
+}
+
+func newPrometheusHandler(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler) *prometheusHandler {
+	return &prometheusHandler{
+		logger:     logger,
+		handler:    handler,
+		serverName: serverName,
+		now:        time.Now,
+		previous:   map[string]promCounter{},
+	}
+}
+
+func (ph *prometheusHandler) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx).WithTags([]string{"server-name:" + ph.serverName})
+
+	notify, cancel := statser.RegisterFlush()
+	defer cancel()
+
+	for {
+		select {
+		case <-notify:
+			ph.expire()
+			ph.emitMetrics(statser)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (ph *prometheusHandler) emitMetrics(statser stats.Statser) {
+	requestSuccess := atomic.SwapUint64(&ph.requestSuccess, 0)
+	requestFailureRead := atomic.SwapUint64(&ph.requestFailureRead, 0)
+	requestFailureParse := atomic.SwapUint64(&ph.requestFailureParse, 0)
+	metricsProcessed := atomic.SwapUint64(&ph.metricsProcessed, 0)
+
+	ph.mu.Lock()
+	series := len(ph.previous)
+	ph.mu.Unlock()
+
+	statser.Count("http.prometheus.incoming", float64(requestSuccess), []string{"result:success"})
+	statser.Count("http.prometheus.incoming", float64(requestFailureRead), []string{"result:failure", "failure:read"})
+	statser.Count("http.prometheus.incoming", float64(requestFailureParse), []string{"result:failure", "failure:parse"})
+	statser.Count("http.prometheus.metrics", float64(metricsProcessed), nil)
+	statser.Gauge("http.prometheus.series", float64(series), nil)
+}
+
+// expire forgets the cumulative series which haven't been updated within prometheusSeriesExpiry.
+func (ph *prometheusHandler) expire() {
+	cutoff := ph.now().Add(-prometheusSeriesExpiry)
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+	for key, counter := range ph.previous {
+		if counter.lastSeen.Before(cutoff) {
+			delete(ph.previous, key)
+		}
+	}
+}
+
+func (ph *prometheusHandler) MetricHandler(w http.ResponseWriter, req *http.Request) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		atomic.AddUint64(&ph.requestFailureRead, 1)
+		ph.logger.WithError(err).Info("failed reading body")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	req.Body.Close()
+
+	samples, err := parsePrometheusText(b)
+	if err != nil {
+		atomic.AddUint64(&ph.requestFailureParse, 1)
+		ph.logger.WithError(err).Info("failed to parse prometheus metrics")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(err.Error()))
+		return
+	}
+
+	ip := gostatsd.UnknownIP
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		ip = gostatsd.IP(host)
+	}
+
+	metrics := ph.toMetrics(samples, ip)
+	if len(metrics) > 0 {
+		ph.handler.DispatchMetrics(req.Context(), metrics)
+	}
+
+	atomic.AddUint64(&ph.metricsProcessed, uint64(len(metrics)))
+	atomic.AddUint64(&ph.requestSuccess, 1)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// toMetrics converts the samples received from ip to metrics.  Samples with a NaN value are dropped.
+func (ph *prometheusHandler) toMetrics(samples []promSample, ip gostatsd.IP) []*gostatsd.Metric {
+	now := ph.now()
+	timestamp := gostatsd.Nanotime(now.UnixNano())
+	metrics := make([]*gostatsd.Metric, 0, len(samples))
+
+	ph.mu.Lock()
+	defer ph.mu.Unlock()
+
+	for _, sample := range samples {
+		if math.IsNaN(sample.value) {
+			continue
+		}
+		m := &gostatsd.Metric{
+			Name:      sample.name,
+			Value:     sample.value,
+			Rate:      1,
+			Tags:      sample.tags,
+			SourceIP:  ip,
+			Timestamp: timestamp,
+			Type:      gostatsd.GAUGE,
+		}
+		if sample.cumulative() {
+			key := sample.name + "|" + string(ip) + "|" + gostatsd.FormatTagsKey("", sample.tags)
+			previous, ok := ph.previous[key]
+			ph.previous[key] = promCounter{value: sample.value, lastSeen: now}
+			if !ok {
+				continue
+			}
+			m.Type = gostatsd.COUNTER
+			if sample.value >= previous.value {
+				m.Value = sample.value - previous.value
+			} // Otherwise the series was reset, and the whole value is new
+		}
+		metrics = append(metrics, m)
+	}
+	return metrics
+}
+
+// cumulative returns true if the value of the sample only increases, until it is reset.
+func (s promSample) cumulative() bool {
+	switch s.kind {
+	case "counter", "histogram":
+		return true
+	case "summary":
+		return s.name != s.family
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package web_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/web"
+)
+
+const prometheusText = `# HELP http_requests_total The total number of requests.
+# TYPE http_requests_total counter
+http_requests_total{method="post",code="200"} %d 1395066363000
+# TYPE queue_length gauge
+queue_length{queue="a \"b\""} 7
+# TYPE request_seconds histogram
+request_seconds_bucket{le="0.5"} %d
+request_seconds_bucket{le="+Inf"} %d
+request_seconds_sum %d
+request_seconds_count %d
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.99"} 3
+rpc_seconds_count %d
+temperature NaN
+`
+
+// prometheusBody returns prometheusText with every cumulative value set to value.
+func prometheusBody(value string) string {
+	return strings.Replace(prometheusText, "%d", value, -1)
+}
+
+func TestPrometheusEndpoint(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		nil,
+		nil,
+		nil,
+		"TestPrometheusEndpoint",
+		"",
+		false,
+		false,
+		false,
+		false,
+		false,
+		false,
+		true,
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	post := func(body string) int {
+		resp, err := http.Post(c.URL+"/prometheus", "text/plain", strings.NewReader(body))
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	// Cumulative values are 1, then 11, so the counters are only sent the second time, as a difference of 10.
+	require.Equal(t, http.StatusAccepted, post(prometheusBody("1")))
+	require.Equal(t, http.StatusAccepted, post(prometheusBody("11")))
+
+	gauge := func(name string, value float64, tags ...string) *gostatsd.Metric {
+		return &gostatsd.Metric{Name: name, Value: value, Rate: 1, Tags: tags, SourceIP: "127.0.0.1", Type: gostatsd.GAUGE}
+	}
+	counter := func(name string, value float64, tags ...string) *gostatsd.Metric {
+		m := gauge(name, value, tags...)
+		m.Type = gostatsd.COUNTER
+		return m
+	}
+	expected := []*gostatsd.Metric{
+		gauge("queue_length", 7, `queue:a "b"`),
+		gauge("rpc_seconds", 3, "quantile:0.99"),
+		counter("http_requests_total", 10, "code:200", "method:post"),
+		gauge("queue_length", 7, `queue:a "b"`),
+		counter("request_seconds_bucket", 10, "le:0.5"),
+		counter("request_seconds_bucket", 10, "le:+Inf"),
+		counter("request_seconds_sum", 10),
+		counter("request_seconds_count", 10),
+		gauge("rpc_seconds", 3, "quantile:0.99"),
+		counter("rpc_seconds_count", 10),
+	}
+
+	actual := ch.GetMetrics()
+	for _, m := range actual {
+		require.NotZero(t, m.Timestamp)
+		m.Timestamp = 0
+	}
+	assert.Equal(t, expected, actual)
+}
+
+func TestPrometheusEndpointInvalid(t *testing.T) {
+	t.Parallel()
+	ch := &capturingHandler{}
+
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		nil,
+		nil,
+		nil,
+		"TestPrometheusEndpointInvalid",
+		"",
+		false,
+		false,
+		false,
+		false,
+		false,
+		false,
+		true,
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	for _, body := range []string{
+		"no_value",
+		"{} 1",
+		"name{label=unquoted} 1",
+		`name{label="unterminated} 1`,
+		`name{label="value" 1`,
+		"name not_a_number",
+		"name 1 2 3",
+	} {
+		resp, err := http.Post(c.URL+"/prometheus", "text/plain", strings.NewReader("ok 1\n"+body))
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, body)
+	}
+	assert.Empty(t, ch.GetMetrics())
+}
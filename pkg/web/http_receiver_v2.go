@@ -13,6 +13,13 @@ import (
 	"github.com/atlassian/gostatsd/pkg/stats"
 	"github.com/golang/protobuf/proto"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+// Bad requests are logged at most this often, so a misbehaving client can't flood the log.
+const (
+	badRequestLogsPerSecond = 1
+	badRequestLogsBurst     = 5
 )
 
 type rawHttpHandlerV2 struct {
@@ -25,6 +32,7 @@ type rawHttpHandlerV2 struct {
 	eventsProcessed          uint64 // atomic
 
 	logger     logrus.FieldLogger
+	logLimiter *rate.Limiter // Limits the logging of bad requests
 	handler    gostatsd.PipelineHandler
 	serverName string
 }
@@ -32,6 +40,7 @@ type rawHttpHandlerV2 struct {
 func newRawHttpHandlerV2(logger logrus.FieldLogger, serverName string, handler gostatsd.PipelineHandler) *rawHttpHandlerV2 {
 	return &rawHttpHandlerV2{
 		logger:     logger,
+		logLimiter: rate.NewLimiter(badRequestLogsPerSecond, badRequestLogsBurst),
 		handler:    handler,
 		serverName: serverName,
 	}
@@ -84,11 +93,8 @@ func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
 	switch encoding {
 	case "deflate":
 		b, err = decompress(b)
-		if err != nil {
-			atomic.AddUint64(&rhh.requestFailureDecompress, 1)
-			rhh.logger.WithError(err).Info("failed decompressing body")
-			return nil, http.StatusBadRequest
-		}
+	case "gzip", "x-gzip":
+		b, err = decompressGzip(b)
 	case "identity", "":
 		// no action
 	default:
@@ -96,7 +102,16 @@ func (rhh *rawHttpHandlerV2) readBody(req *http.Request) ([]byte, int) {
 		if len(encoding) > 64 {
 			encoding = encoding[0:64]
 		}
-		rhh.logger.WithField("encoding", encoding).Info("invalid encoding")
+		if rhh.logLimiter.Allow() {
+			rhh.logger.WithField("encoding", encoding).Info("invalid encoding")
+		}
+		return nil, http.StatusBadRequest
+	}
+	if err != nil {
+		atomic.AddUint64(&rhh.requestFailureDecompress, 1)
+		if rhh.logLimiter.Allow() {
+			rhh.logger.WithError(err).WithField("encoding", encoding).Info("failed decompressing body")
+		}
 		return nil, http.StatusBadRequest
 	}
 
@@ -115,7 +130,9 @@ func (rhh *rawHttpHandlerV2) MetricHandler(w http.ResponseWriter, req *http.Requ
 	err := proto.Unmarshal(b, &msg)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
-		rhh.logger.WithError(err).Error("failed to unmarshal")
+		if rhh.logLimiter.Allow() {
+			rhh.logger.WithError(err).Error("failed to unmarshal")
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -139,7 +156,9 @@ func (rhh *rawHttpHandlerV2) EventHandler(w http.ResponseWriter, req *http.Reque
 	err := proto.Unmarshal(b, &msg)
 	if err != nil {
 		atomic.AddUint64(&rhh.requestFailureUnmarshal, 1)
-		rhh.logger.WithError(err).Error("failed to unmarshal")
+		if rhh.logLimiter.Allow() {
+			rhh.logger.WithError(err).Error("failed to unmarshal")
+		}
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -196,6 +215,7 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 				Timestamp: now,
 				Hostname:  gauge.Hostname,
 				Tags:      gauge.Tags,
+				Delta:     gauge.Delta,
 			}
 		}
 	}
@@ -225,6 +245,19 @@ func translateFromProtobufV2(pbMetricMap *pb.RawMessageV2) *gostatsd.MetricMap {
 		}
 	}
 
+	for metricName, tagMap := range pbMetricMap.Distributions {
+		mm.Distributions[metricName] = map[string]gostatsd.Timer{}
+		for tagsKey, distribution := range tagMap.TagMap {
+			mm.Distributions[metricName][tagsKey] = gostatsd.Timer{
+				Values:       distribution.Values,
+				Timestamp:    now,
+				Tags:         distribution.Tags,
+				Hostname:     distribution.Hostname,
+				SampledCount: distribution.SampleCount,
+			}
+		}
+	}
+
 	for metricName, tagMap := range pbMetricMap.Sets {
 		mm.Sets[metricName] = map[string]gostatsd.Set{}
 		for tagsKey, set := range tagMap.TagMap {
@@ -1,6 +1,10 @@
 package web_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"net/http"
 	"net/http/httptest"
 	"sort"
 	"testing"
@@ -9,6 +13,7 @@ import (
 	"github.com/ash2k/stager/wait"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tilinna/clock"
 
@@ -20,7 +25,20 @@ import (
 
 func TestForwardingEndToEndV2(t *testing.T) {
 	t.Parallel()
+	testForwardingEndToEndV2(t, false, "")
+}
+
+func TestForwardingEndToEndV2Deflate(t *testing.T) {
+	t.Parallel()
+	testForwardingEndToEndV2(t, true, statsd.CompressEncodingDeflate)
+}
+
+func TestForwardingEndToEndV2Gzip(t *testing.T) {
+	t.Parallel()
+	testForwardingEndToEndV2(t, true, statsd.CompressEncodingGzip)
+}
 
+func testForwardingEndToEndV2(t *testing.T, compress bool, compressEncoding string) {
 	ctxTest, testDone := testContext(t)
 	mockClock := clock.NewMock(time.Unix(0, 0))
 	ctxTest = clock.Context(ctxTest, mockClock)
@@ -30,12 +48,20 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	hs, err := web.NewHttpServer(
 		logrus.StandardLogger(),
 		ch,
+		nil,
+		nil,
+		nil,
 		"TestForwardingEndToEndV2",
 		"",
 		false,
 		false,
 		true,
 		false,
+		false,
+		false,
+		false,
+		"",
+		nil,
 	)
 	require.NoError(t, err)
 
@@ -46,10 +72,11 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	hfh, err := statsd.NewHttpForwarderHandlerV2(
 		logrus.StandardLogger(),
 		"default",
-		c.URL,
+		[]statsd.ForwardEndpoint{{ApiEndpoint: c.URL, Weight: 1}},
 		5, // deliberately prime, so the loop below doesn't send the same thing to the same MetricMap every time.
 		10,
-		false,
+		compress,
+		compressEncoding,
 		10*time.Second,
 		10*time.Millisecond,
 		nil,
@@ -109,12 +136,25 @@ func TestForwardingEndToEndV2(t *testing.T) {
 		StringValue: "def",
 		Rate:        0.1,
 	}
+	m9 := &gostatsd.Metric{
+		Name:  "distribution",
+		Type:  gostatsd.DISTRIBUTION,
+		Value: 20,
+		Rate:  0.5,
+	}
+	m10 := &gostatsd.Metric{
+		Name:       "gaugedelta",
+		Type:       gostatsd.GAUGE,
+		Value:      -2,
+		Rate:       1,
+		GaugeDelta: true,
+	}
 
 	for i := 0; i < 100; i++ {
-		hfh.DispatchMetrics(ctxTest, []*gostatsd.Metric{m1, m2, m5, m6, m7, m8})
+		hfh.DispatchMetrics(ctxTest, []*gostatsd.Metric{m1, m2, m5, m6, m7, m8, m10})
 	}
 	// only do timers once, because they're very noisy in the output.
-	hfh.DispatchMetrics(ctxTest, []*gostatsd.Metric{m3, m4})
+	hfh.DispatchMetrics(ctxTest, []*gostatsd.Metric{m3, m4, m9})
 
 	// There's no good way to tell when the Ticker has been created, so we use a hard loop
 	for _, d := mockClock.AddNext(); d == 0 && ctxTest.Err() == nil; _, d = mockClock.AddNext() {
@@ -126,6 +166,8 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	expected := []*gostatsd.Metric{
 		{Name: "counter", Type: gostatsd.COUNTER, Value: (100 * 10) + (100 * 10 / 0.1), Rate: 1},
 		{Name: "gauge", Type: gostatsd.GAUGE, Value: 10, Rate: 1},
+		// The deltas are added together, and stay a delta to apply to the value on the receiving server
+		{Name: "gaugedelta", Type: gostatsd.GAUGE, Value: 100 * -2, Rate: 1, GaugeDelta: true},
 		// 10 = the sample count for the timer where rate=0.1
 		// 1 = the sample count for the timer where rate=1
 		// 2 = number of timers
@@ -133,6 +175,7 @@ func TestForwardingEndToEndV2(t *testing.T) {
 		{Name: "timer", Type: gostatsd.TIMER, Value: 10, Rate: 1.0 / ((10.0 + 1.0) / 2.0)},
 		{Name: "set", Type: gostatsd.SET, StringValue: "abc", Rate: 1},
 		{Name: "set", Type: gostatsd.SET, StringValue: "def", Rate: 1},
+		{Name: "distribution", Type: gostatsd.DISTRIBUTION, Value: 20, Rate: 0.5},
 	}
 
 	actual := ch.GetMetrics()
@@ -162,3 +205,59 @@ func TestForwardingEndToEndV2(t *testing.T) {
 	require.EqualValues(t, expected, actual)
 	testDone()
 }
+
+func TestMalformedCompressedBodyV2(t *testing.T) {
+	t.Parallel()
+
+	ch := &capturingHandler{}
+	hs, err := web.NewHttpServer(
+		logrus.StandardLogger(),
+		ch,
+		nil,
+		nil,
+		nil,
+		"TestMalformedCompressedBodyV2",
+		"",
+		false,
+		false,
+		true,
+		false,
+		false,
+		false,
+		false,
+		"",
+		nil,
+	)
+	require.NoError(t, err)
+
+	c := httptest.NewServer(hs.Router)
+	defer c.Close()
+
+	var deflated, gzipped bytes.Buffer
+	zw := zlib.NewWriter(&deflated)
+	_, _ = zw.Write([]byte("this is not going to arrive in one piece"))
+	require.NoError(t, zw.Close())
+	gw := gzip.NewWriter(&gzipped)
+	_, _ = gw.Write([]byte("this is not going to arrive in one piece"))
+	require.NoError(t, gw.Close())
+
+	for _, tc := range []struct {
+		encoding string
+		body     []byte
+	}{
+		{"deflate", deflated.Bytes()[:deflated.Len()/2]},
+		{"gzip", gzipped.Bytes()[:gzipped.Len()/2]},
+		{"gzip", []byte("not gzip")},
+		{"deflate", gzipped.Bytes()},
+		{"br", deflated.Bytes()},
+	} {
+		req, err := http.NewRequest("POST", c.URL+"/v2/raw", bytes.NewReader(tc.body))
+		require.NoError(t, err)
+		req.Header.Set("Content-Encoding", tc.encoding)
+		resp, err := c.Client().Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode, tc.encoding)
+	}
+	assert.Empty(t, ch.GetMetrics())
+}
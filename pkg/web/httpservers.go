@@ -2,13 +2,14 @@ package web
 
 import (
 	"context"
-	"expvar"
 	"fmt"
 	"net/http"
 	"strings"
 	"time"
 
 	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/capture"
+	"github.com/atlassian/gostatsd/pkg/catalog"
 	"github.com/atlassian/gostatsd/pkg/util"
 
 	"github.com/ash2k/stager/wait"
@@ -22,6 +23,7 @@ type httpServer struct {
 	address      string
 	Router       *mux.Router // should be private, but project layout is not great.
 	rawMetricsV2 *rawHttpHandlerV2
+	prometheus   *prometheusHandler
 }
 
 type route struct {
@@ -33,11 +35,18 @@ type route struct {
 
 var done = struct{}{}
 
-func NewHttpServersFromViper(v *viper.Viper, logger logrus.FieldLogger, handler gostatsd.PipelineHandler) ([]*httpServer, error) {
+func NewHttpServersFromViper(
+	v *viper.Viper,
+	logger logrus.FieldLogger,
+	handler gostatsd.PipelineHandler,
+	capturer *capture.Capturer,
+	metricCatalog *catalog.Catalog,
+	ready func() bool,
+) ([]*httpServer, error) {
 	httpServerNames := v.GetStringSlice("http-servers")
 	servers := make([]*httpServer, 0, len(httpServerNames))
 	for _, httpServerName := range httpServerNames {
-		server, err := newHttpServerFromViper(logger, v, httpServerName, handler)
+		server, err := newHttpServerFromViper(logger, v, httpServerName, handler, capturer, metricCatalog, ready)
 		if err != nil {
 			return nil, fmt.Errorf("failed to make http-server %s: %v", httpServerName, err)
 		}
@@ -51,6 +60,9 @@ func newHttpServerFromViper(
 	vMain *viper.Viper,
 	serverName string,
 	handler gostatsd.PipelineHandler,
+	capturer *capture.Capturer,
+	metricCatalog *catalog.Catalog,
+	ready func() bool,
 ) (*httpServer, error) {
 	vSub := util.GetSubViper(vMain, "http."+serverName)
 	vSub.SetDefault("address", "127.0.0.1:8080")
@@ -58,27 +70,48 @@ func newHttpServerFromViper(
 	vSub.SetDefault("enable-expvar", false)
 	vSub.SetDefault("enable-ingestion", false)
 	vSub.SetDefault("enable-healthcheck", true)
+	vSub.SetDefault("enable-capture", false)
+	vSub.SetDefault("enable-catalog", false)
+	vSub.SetDefault("enable-prometheus", false)
+	vSub.SetDefault("expvar-prefix", "")
+	vSub.SetDefault("expvar-vars", []string{})
 
 	return NewHttpServer(
 		logger.WithField("http-server", serverName),
 		handler,
+		capturer,
+		metricCatalog,
+		ready,
 		serverName,
 		vSub.GetString("address"),
 		vSub.GetBool("enable-prof"),
 		vSub.GetBool("enable-expvar"),
 		vSub.GetBool("enable-ingestion"),
 		vSub.GetBool("enable-healthcheck"),
+		vSub.GetBool("enable-capture"),
+		vSub.GetBool("enable-catalog"),
+		vSub.GetBool("enable-prometheus"),
+		vSub.GetString("expvar-prefix"),
+		vSub.GetStringSlice("expvar-vars"),
 	)
 }
 
 func NewHttpServer(
 	logger logrus.FieldLogger,
 	handler gostatsd.PipelineHandler,
+	capturer *capture.Capturer,
+	metricCatalog *catalog.Catalog,
+	ready func() bool,
 	serverName, address string,
 	enableProf,
 	enableExpVar,
 	enableIngestion,
-	enableHealthcheck bool,
+	enableHealthcheck,
+	enableCapture,
+	enableCatalog,
+	enablePrometheus bool,
+	expvarPrefix string,
+	expvarVars []string,
 ) (*httpServer, error) {
 	var routes []route
 
@@ -98,7 +131,7 @@ func NewHttpServer(
 
 	if enableExpVar {
 		routes = append(routes,
-			route{path: "/expvar", handler: expvar.Handler().ServeHTTP, method: "GET", name: "expvar_get"},
+			route{path: "/expvar", handler: expvarHandler(expvarPrefix, expvarVars), method: "GET", name: "expvar_get"},
 		)
 	}
 
@@ -111,15 +144,43 @@ func NewHttpServer(
 	}
 
 	if enableHealthcheck {
-		hc := &healthChecker{logger}
+		hc := &healthChecker{logger: logger, ready: ready}
 		routes = append(routes,
 			route{path: "/healthcheck", handler: hc.healthCheck, method: "GET", name: "healthcheck_get"},
 			route{path: "/deepcheck", handler: hc.deepCheck, method: "GET", name: "deepcheck_get"},
 		)
 	}
 
+	if enableCapture {
+		if capturer == nil {
+			return nil, fmt.Errorf("enable-capture requires capture-file to be set")
+		}
+		cc := &captureController{logger: logger, capturer: capturer}
+		routes = append(routes,
+			route{path: "/capture", handler: cc.status, method: "GET", name: "capture_get"},
+			route{path: "/capture/start", handler: cc.start, method: "POST", name: "capture_start_post"},
+			route{path: "/capture/stop", handler: cc.stop, method: "POST", name: "capture_stop_post"},
+		)
+	}
+
+	if enableCatalog {
+		if metricCatalog == nil {
+			return nil, fmt.Errorf("enable-catalog requires catalog-ttl to be set in standalone mode")
+		}
+		routes = append(routes,
+			route{path: "/catalog", handler: catalogHandler(logger, metricCatalog), method: "GET", name: "catalog_get"},
+		)
+	}
+
+	if enablePrometheus {
+		server.prometheus = newPrometheusHandler(logger, serverName, handler)
+		routes = append(routes,
+			route{path: "/prometheus", handler: server.prometheus.MetricHandler, method: "POST", name: "prometheus_post"},
+		)
+	}
+
 	if len(routes) == 0 {
-		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, or healthcheck")
+		return nil, fmt.Errorf("must enable at least one of prof, expvar, ingestion, healthcheck, capture, catalog, or prometheus")
 	}
 
 	router, err := createRoutes(routes)
@@ -136,6 +197,10 @@ func NewHttpServer(
 		"enable-expvar":      enableExpVar,
 		"enable-ingestion":   enableIngestion,
 		"enable-healthcheck": enableHealthcheck,
+		"enable-capture":     enableCapture,
+		"enable-catalog":     enableCatalog,
+		"enable-prometheus":  enablePrometheus,
+		"expvar-prefix":      expvarPrefix,
 	}).Info("Created server")
 
 	return server, nil
@@ -189,11 +254,14 @@ func (hs *httpServer) logRequest(handler http.Handler) http.Handler {
 }
 
 func (hs *httpServer) Run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
 	if hs.rawMetricsV2 != nil {
-		var wg wait.Group
-		defer wg.Wait()
 		wg.StartWithContext(ctx, hs.rawMetricsV2.RunMetrics)
 	}
+	if hs.prometheus != nil {
+		wg.StartWithContext(ctx, hs.prometheus.RunMetrics)
+	}
 
 	server := &http.Server{
 		Addr:    hs.address,
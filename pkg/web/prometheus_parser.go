@@ -0,0 +1,164 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/atlassian/gostatsd"
+)
+
+// promSample is a single sample of the Prometheus text exposition format.
+type promSample struct {
+	name   string
+	family string // Name of the metric family the sample belongs to
+	kind   string // Type of the family, one of counter, gauge, histogram, summary or untyped
+	tags   gostatsd.Tags
+	value  float64
+}
+
+// parsePrometheusText parses the Prometheus text exposition format.  Labels become tags of the form name:value, and
+// timestamps are ignored.  Returns an error for the first line which can't be parsed.
+func parsePrometheusText(b []byte) ([]promSample, error) {
+	types := map[string]string{}
+	var samples []promSample
+
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	scanner.Buffer(nil, len(b)+1)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if line[0] == '#' {
+			fields := strings.Fields(line[1:])
+			if len(fields) >= 3 && fields[0] == "TYPE" {
+				types[fields[1]] = fields[2]
+			}
+			continue
+		}
+		sample, err := parsePromSample(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		sample.family, sample.kind = promFamily(sample.name, types)
+		samples = append(samples, sample)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
+
+// promFamily returns the family of the sample called name and its type.  The _bucket, _sum and _count samples belong
+// to the histogram or summary they are suffixed to.
+func promFamily(name string, types map[string]string) (string, string) {
+	if kind, ok := types[name]; ok {
+		return name, kind
+	}
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family := name[:len(name)-len(suffix)]
+		switch kind := types[family]; {
+		case kind == "histogram":
+			return family, kind
+		case kind == "summary" && suffix != "_bucket":
+			return family, kind
+		}
+	}
+	return name, "untyped"
+}
+
+// parsePromSample parses a line of the form name{label="value",...} value [timestamp].
+func parsePromSample(line string) (promSample, error) {
+	var sample promSample
+
+	end := strings.IndexAny(line, "{ \t")
+	if end == 0 {
+		return sample, fmt.Errorf("missing metric name")
+	}
+	if end < 0 {
+		return sample, fmt.Errorf("missing value")
+	}
+	sample.name = line[:end]
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		tags, remaining, err := parsePromLabels(rest[1:])
+		if err != nil {
+			return sample, err
+		}
+		sample.tags = tags
+		rest = remaining
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return sample, fmt.Errorf("missing value")
+	}
+	if len(fields) > 2 {
+		return sample, fmt.Errorf("unexpected %q after value", fields[2])
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("invalid value %q", fields[0])
+	}
+	sample.value = value
+	return sample, nil
+}
+
+// parsePromLabels parses the labels following the opening brace, returning them as tags and the remainder of the line
+// after the closing brace.
+func parsePromLabels(s string) (gostatsd.Tags, string, error) {
+	var tags gostatsd.Tags
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return nil, "", fmt.Errorf("missing closing brace")
+		}
+		if s[0] == '}' {
+			return tags, s[1:], nil
+		}
+
+		eq := strings.IndexByte(s, '=')
+		if eq <= 0 {
+			return nil, "", fmt.Errorf("invalid label")
+		}
+		name := strings.TrimSpace(s[:eq])
+		s = strings.TrimLeft(s[eq+1:], " \t")
+		if s == "" || s[0] != '"' {
+			return nil, "", fmt.Errorf("label %s: value must be quoted", name)
+		}
+
+		var value strings.Builder
+		idx := 1
+		for ; idx < len(s) && s[idx] != '"'; idx++ {
+			c := s[idx]
+			if c == '\\' && idx+1 < len(s) {
+				idx++
+				switch s[idx] {
+				case 'n':
+					c = '\n'
+				default:
+					c = s[idx] // \\ and \"
+				}
+			}
+			value.WriteByte(c)
+		}
+		if idx == len(s) {
+			return nil, "", fmt.Errorf("label %s: missing closing quote", name)
+		}
+		tags = append(tags, name+":"+value.String())
+
+		s = strings.TrimLeft(s[idx+1:], " \t")
+		if s != "" && s[0] == ',' {
+			s = s[1:]
+		} else if s != "" && s[0] != '}' {
+			return nil, "", fmt.Errorf("label %s: expected comma or closing brace", name)
+		}
+	}
+}
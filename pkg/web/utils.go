@@ -2,18 +2,35 @@ package web
 
 import (
 	"bytes"
+	"compress/gzip"
 	"compress/zlib"
+	"io"
 )
 
+// decompress inflates a zlib compressed body, as sent with a Content-Encoding of deflate.
 func decompress(input []byte) ([]byte, error) {
 	decompressor, err := zlib.NewReader(bytes.NewReader(input))
 	if err != nil {
 		return nil, err
 	}
+	return readAllAndClose(decompressor)
+}
+
+// decompressGzip inflates a gzip compressed body.
+func decompressGzip(input []byte) ([]byte, error) {
+	decompressor, err := gzip.NewReader(bytes.NewReader(input))
+	if err != nil {
+		return nil, err
+	}
+	return readAllAndClose(decompressor)
+}
+
+// readAllAndClose reads all of decompressor, failing if the stream is truncated or its checksum doesn't match.
+func readAllAndClose(decompressor io.ReadCloser) ([]byte, error) {
 	defer decompressor.Close()
 
 	var out bytes.Buffer
-	if _, err = out.ReadFrom(decompressor); err != nil {
+	if _, err := out.ReadFrom(decompressor); err != nil {
 		return nil, err
 	}
 	return out.Bytes(), nil
@@ -17,12 +17,20 @@ func TestHttpServerShutsdown(t *testing.T) {
 	hs, err := web.NewHttpServer(
 		logrus.StandardLogger(),
 		nil,
+		nil,
+		nil,
+		nil,
 		"TestHttpServerShutsdown",
 		"127.0.0.1:0", // should pick a random port to bind to
 		false,
 		false,
 		false,
 		true,
+		false,
+		false,
+		false,
+		"",
+		nil,
 	)
 	require.NoError(t, err)
 
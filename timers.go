@@ -2,23 +2,37 @@ package gostatsd
 
 import "github.com/spf13/viper"
 
+// HistogramBucketPrefix is the prefix of the name of a timer histogram bucket, such as histogram.le_100.  The +Inf
+// bucket is histogram.le_inf.
+const HistogramBucketPrefix = "histogram.le_"
+
+// HistogramBucket is the cumulative count of the values of a timer which are less than or equal to the upper bound
+// of a histogram bucket.
+type HistogramBucket struct {
+	Name  string  // The name of the bucket, such as histogram.le_100
+	Bound float64 // The upper bound of the bucket, +Inf for the bucket which counts every value
+	Count int     // The number of values in the bucket, scaled by their sampling rate
+}
+
 // Timer is used for storing aggregated values for timers.
 type Timer struct {
-	Count        int         // The number of timers in the series
-	SampledCount float64     // Number of timings received, divided by sampling rate
-	PerSecond    float64     // The calculated per second rate
-	Mean         float64     // The mean time of the series
-	Median       float64     // The median time of the series
-	Min          float64     // The minimum time of the series
-	Max          float64     // The maximum time of the series
-	StdDev       float64     // The standard deviation for the series
-	Sum          float64     // The sum for the series
-	SumSquares   float64     // The sum squares for the series
-	Values       []float64   // The numeric value of the metric
-	Percentiles  Percentiles // The percentile aggregations of the metric
-	Timestamp    Nanotime    // Last time value was updated
-	Hostname     string      // Hostname of the source of the metric
-	Tags         Tags        // The tags for the timer
+	Count        int               // The number of timers in the series
+	SampledCount float64           // Number of timings received, divided by sampling rate
+	PerSecond    float64           // The calculated per second rate
+	Mean         float64           // The mean time of the series
+	Median       float64           // The median time of the series
+	Min          float64           // The minimum time of the series
+	Max          float64           // The maximum time of the series
+	StdDev       float64           // The standard deviation for the series
+	Sum          float64           // The sum for the series
+	SumSquares   float64           // The sum squares for the series
+	Values       []float64         // The numeric value of the metric
+	Weights      []float64         // The weight of each value (1 / sampling rate), nil if every value has the same weight
+	Percentiles  Percentiles       // The percentile aggregations of the metric
+	Histogram    []HistogramBucket // The cumulative histogram buckets of the metric, ascending, with the +Inf bucket last
+	Timestamp    Nanotime          // Last time value was updated
+	Hostname     string            // Hostname of the source of the metric
+	Tags         Tags              // The tags for the timer
 }
 
 // NewTimer initialises a new timer.
@@ -26,6 +40,53 @@ func NewTimer(timestamp Nanotime, values []float64, hostname string, tags Tags)
 	return Timer{Values: values, Timestamp: timestamp, Hostname: hostname, Tags: tags.Copy(), SampledCount: float64(len(values))}
 }
 
+// AddValue adds a value to the timer, which was received with a weight of 1 / sampling rate.
+func (t *Timer) AddValue(value, weight float64) {
+	if t.Weights == nil && len(t.Values) > 0 && weight != t.uniformWeight() {
+		t.Weights = t.valueWeights()
+	}
+	t.Values = append(t.Values, value)
+	if t.Weights != nil {
+		t.Weights = append(t.Weights, weight)
+	}
+	t.SampledCount += weight
+}
+
+// AppendValues adds the values of another timer to the timer, keeping track of the weight of each value if they
+// aren't all the same.
+func (t *Timer) AppendValues(from Timer) {
+	switch {
+	case len(t.Values) == 0:
+		if from.Weights != nil {
+			t.Weights = append(t.Weights[:0], from.Weights...)
+		} else {
+			t.Weights = nil
+		}
+	case t.Weights != nil || from.Weights != nil || (len(from.Values) > 0 && t.uniformWeight() != from.uniformWeight()):
+		t.Weights = append(t.valueWeights(), from.valueWeights()...)
+	}
+	t.Values = append(t.Values, from.Values...)
+	t.SampledCount += from.SampledCount
+}
+
+// uniformWeight returns the weight of each value of a timer without Weights.
+func (t *Timer) uniformWeight() float64 {
+	return t.SampledCount / float64(len(t.Values))
+}
+
+// valueWeights returns the weight of each value.
+func (t *Timer) valueWeights() []float64 {
+	if t.Weights != nil || len(t.Values) == 0 {
+		return t.Weights
+	}
+	weight := t.uniformWeight()
+	weights := make([]float64, len(t.Values), cap(t.Values))
+	for i := range weights {
+		weights[i] = weight
+	}
+	return weights
+}
+
 // NewTimerValues initialises a new timer only from Values array
 func NewTimerValues(values []float64) Timer {
 	return NewTimer(Nanotime(0), values, "", nil)
@@ -84,6 +145,12 @@ func DisabledSubMetrics(viper *viper.Viper) TimerSubtypes {
 	subViper.SetDefault("sum-pct", false)
 	subViper.SetDefault("sum-squares", false)
 	subViper.SetDefault("sum-squares-pct", false)
+	subViper.SetDefault("histogram", false)
+	subViper.SetDefault("distribution-min", false)
+	subViper.SetDefault("distribution-max", false)
+	subViper.SetDefault("distribution-count", false)
+	subViper.SetDefault("distribution-sum", false)
+	subViper.SetDefault("distribution-pct", false)
 
 	return TimerSubtypes{
 		Lower:          subViper.GetBool("lower"),
@@ -101,6 +168,13 @@ func DisabledSubMetrics(viper *viper.Viper) TimerSubtypes {
 		SumPct:         subViper.GetBool("sum-pct"),
 		SumSquares:     subViper.GetBool("sum-squares"),
 		SumSquaresPct:  subViper.GetBool("sum-squares-pct"),
+		Histogram:      subViper.GetBool("histogram"),
+
+		DistributionMin:   subViper.GetBool("distribution-min"),
+		DistributionMax:   subViper.GetBool("distribution-max"),
+		DistributionCount: subViper.GetBool("distribution-count"),
+		DistributionSum:   subViper.GetBool("distribution-sum"),
+		DistributionPct:   subViper.GetBool("distribution-pct"),
 	}
 
 }
@@ -45,6 +45,14 @@ type TimerSubtypes struct {
 	SumPct         bool // pct
 	SumSquares     bool
 	SumSquaresPct  bool // pct
+	Histogram      bool // The histogram buckets of timer-histogram-buckets
+
+	// Sub-metrics of distributions
+	DistributionMin   bool
+	DistributionMax   bool
+	DistributionCount bool
+	DistributionSum   bool
+	DistributionPct   bool // pct
 }
 
 // Runnable is a long running function intended to be launched in a goroutine.
@@ -55,6 +63,13 @@ type Runner interface {
 	Run(ctx context.Context)
 }
 
+// ReadyWaiter is implemented by a CloudProvider or Backend which is not ready to be used as soon as it is started, for
+// example because it needs to fill a cache or establish a connection.
+type ReadyWaiter interface {
+	// WaitReady blocks until ready, returning ctx.Err() if ctx is done first.
+	WaitReady(ctx context.Context) error
+}
+
 // RawMetricHandler is an interface that accepts a Metric for processing.  Raw refers to pre-aggregation, not
 // pre-consolidation.
 type RawMetricHandler interface {